@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	agentCommandName = "agent"
+	// envVarNodeName the node on which the agent runs, usually from the downward API
+	envVarNodeName = "NODE_NAME"
+)
+
+// newAgentCommand the agent subcommand, which runs the node-local agent, usually as a
+// DaemonSet. It needs neither the provider config nor the Equinix Metal API, only access
+// to the kubernetes API and the metadata service of its device.
+func newAgentCommand() *cobra.Command {
+	config := metal.AgentConfig{NodeName: os.Getenv(envVarNodeName), Interval: metal.DefaultAgentInterval}
+	var (
+		kubeconfig string
+		qps        float32
+		burst      int
+	)
+	command := &cobra.Command{
+		Use:   agentCommandName,
+		Short: "Run the node agent, which reports the device metadata of its node in a MetalNode",
+		Long: `Run the node agent, usually as a DaemonSet with host networking. It reads the metadata
+service of its device, and reports the device, its BGP neighbours and any spot market termination
+in the MetalNode of its node, for the CCM to use instead of polling the Equinix Metal API. With
+--bind-loopback, it binds to the loopback interface the addresses that the CCM lists in the spec
+of that MetalNode, such as the control plane elastic IP.`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+			if err != nil {
+				return err
+			}
+			restConfig.QPS, restConfig.Burst = qps, burst
+			client, err := dynamic.NewForConfig(restConfig)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-signals
+				cancel()
+			}()
+			return metal.RunAgent(ctx, config, client)
+		},
+	}
+	command.Flags().StringVar(&kubeconfig, "kubeconfig", "", "path to a kubeconfig; in-cluster config if not set")
+	command.Flags().Float32Var(&qps, "kube-api-qps", rest.DefaultQPS, "QPS to use while talking with the kubernetes apiserver")
+	command.Flags().IntVar(&burst, "kube-api-burst", rest.DefaultBurst, "burst to use while talking with the kubernetes apiserver")
+	command.Flags().StringVar(&config.NodeName, "node-name", config.NodeName, "name of the node on which the agent runs, env var "+envVarNodeName)
+	command.Flags().StringVar(&config.MetadataURL, "metadata-url", "", "URL of the metadata service; the Equinix Metal one if not set")
+	command.Flags().DurationVar(&config.Interval, "interval", config.Interval, "how often to read the metadata service")
+	command.Flags().BoolVar(&config.BindLoopback, "bind-loopback", false, "bind the addresses listed in the MetalNode of this node, such as the control plane elastic IP, to the loopback interface")
+	return command
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/spf13/cobra"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/cloud-provider/app"
+	cloudcontrollerconfig "k8s.io/cloud-provider/app/config"
+	"k8s.io/cloud-provider/options"
+	genericcontrollermanager "k8s.io/controller-manager/app"
+	"k8s.io/klog/v2"
+)
+
+// newCloudControllerManagerCommand the cloud controller manager command of k8s.io/cloud-provider,
+// which runs its controllers with the cloud provider of the --cloud-provider flag.
+//
+// That command takes its config and its controllers when it is created, before it parses its flags,
+// so both are left empty here, and are filled in once the flags are parsed, just before the command
+// runs. The controllers are named up front, since the command lists them in the --controllers flag.
+func newCloudControllerManagerCommand() (*cobra.Command, error) {
+	s, err := options.NewCloudControllerManagerOptions()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize command options: %w", err)
+	}
+	c := &cloudcontrollerconfig.Config{}
+	// the controllers do not need the config or the cloud provider to be named
+	controllers := app.DefaultControllerInitializers(nil, nil)
+	command := app.NewCloudControllerManagerCommand(s, c, controllers)
+	command.PreRunE = func(cmd *cobra.Command, args []string) error {
+		return configureCloudControllerManager(s, c, controllers)
+	}
+	return command, nil
+}
+
+// configureCloudControllerManager build the config from the parsed options, and the controllers
+// with the cloud provider of the config, in place of the empty ones the command was created with
+func configureCloudControllerManager(s *options.CloudControllerManagerOptions, c *cloudcontrollerconfig.Config, controllers map[string]app.InitFunc) error {
+	config, err := s.Config(app.KnownControllers(controllers), app.ControllersDisabledByDefault.List())
+	if err != nil {
+		return err
+	}
+	*c = *config
+	cloudConfig := c.ComponentConfig.KubeCloudShared.CloudProvider
+	cloud, err := cloudprovider.InitCloudProvider(cloudConfig.Name, cloudConfig.CloudConfigFile)
+	if err != nil {
+		return fmt.Errorf("cloud provider could not be initialized: %w", err)
+	}
+	if cloud == nil {
+		return fmt.Errorf("cloud provider %q is not registered", cloudConfig.Name)
+	}
+	if !cloud.HasClusterID() {
+		if !c.ComponentConfig.KubeCloudShared.AllowUntaggedCloud {
+			return fmt.Errorf("no ClusterID found, which the cloud provider requires unless --allow-untagged-cloud is set")
+		}
+		klog.Warning("detected a cluster without a ClusterID.  A ClusterID will be required in the future.  Please tag your cluster to avoid any future issues")
+	}
+	completed := c.Complete()
+	for name, initFn := range initializeCloudFirst(completed, cloud, app.DefaultControllerInitializers(completed, cloud)) {
+		controllers[name] = initFn
+	}
+	return nil
+}
+
+// initializeCloudFirst the controllers, each of which initializes the cloud provider before it
+// starts, if none did yet. Unlike the controller manager of Kubernetes 1.19, that of
+// k8s.io/cloud-provider leaves initializing the cloud provider to its caller. Doing so before the
+// command runs would start the reconcilers of the cloud provider on every replica, not only on the
+// leader; the controllers start only on the leader, after the shared informers the cloud provider
+// uses are set, and before they are started.
+func initializeCloudFirst(c *cloudcontrollerconfig.CompletedConfig, cloud cloudprovider.Interface, controllers map[string]app.InitFunc) map[string]app.InitFunc {
+	var once sync.Once
+	initialize := func(ctx genericcontrollermanager.ControllerContext) {
+		once.Do(func() {
+			cloud.Initialize(c.ClientBuilder, ctx.Stop)
+			if informerUser, ok := cloud.(cloudprovider.InformerUser); ok {
+				informerUser.SetInformers(c.SharedInformers)
+			}
+		})
+	}
+	wrapped := map[string]app.InitFunc{}
+	for name, initFn := range controllers {
+		initFn := initFn
+		wrapped[name] = func(ctx genericcontrollermanager.ControllerContext) (http.Handler, bool, error) {
+			initialize(ctx)
+			return initFn(ctx)
+		}
+	}
+	return wrapped
+}
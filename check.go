@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal"
+	"github.com/spf13/cobra"
+)
+
+// newCheckCommand the check subcommand, which validates the configuration against the
+// Equinix Metal API without changing anything, e.g. in CI before deploying the CCM
+func newCheckCommand(config *metal.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Validate the provider config against the Equinix Metal API, without changing anything",
+		Long: `Validate the provider config against the Equinix Metal API, without changing anything:
+project access, the scope of the token, the facility, the control plane elastic IP tag and the
+BGP state of the project. Prints a report, and exits non-zero if any check failed.`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return metal.Check(*config, os.Stdout)
+		},
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// envResolver read the env vars for the config, in order of precedence:
+//
+//  1. METAL_<NAME>
+//  2. PACKET_<NAME>, deprecated, from when this was the Packet CCM
+//
+// and remember which it used for each, so that the resolved config can be reported
+// at startup. Anything not set in either falls back to the config file, then the default.
+type envResolver struct {
+	// sources the env var actually used for each setting, by its METAL_ name
+	sources map[string]string
+	// deprecated the deprecated env vars in use
+	deprecated []string
+}
+
+func newEnvResolver() *envResolver {
+	return &envResolver{sources: map[string]string{}}
+}
+
+// get the value of the METAL_ env var, or if it is not set, its deprecated PACKET_ equivalent
+func (e *envResolver) get(name string) string {
+	deprecatedName := deprecatedEnvVarPrefix + strings.TrimPrefix(name, envVarPrefix)
+	v, deprecatedV := os.Getenv(name), os.Getenv(deprecatedName)
+	if deprecatedV != "" {
+		e.deprecate(deprecatedName)
+	}
+	switch {
+	case v != "" && deprecatedV != "" && v != deprecatedV:
+		klog.Warningf("env vars %s and %s are both set, to different values; using %s", name, deprecatedName, name)
+	case v == "" && deprecatedV != "":
+		klog.Warningf("env var %s is deprecated, use %s instead", deprecatedName, name)
+		e.sources[name] = deprecatedName
+		return deprecatedV
+	}
+	if v != "" {
+		e.sources[name] = name
+	}
+	return v
+}
+
+// deprecate record that a deprecated env var is in use
+func (e *envResolver) deprecate(name string) {
+	for _, d := range e.deprecated {
+		if d == name {
+			return
+		}
+	}
+	e.deprecated = append(e.deprecated, name)
+	sort.Strings(e.deprecated)
+}
+
+// report log where the config came from; the values themselves, with secrets
+// masked, are reported with the config
+func (e *envResolver) report(providerConfig string) {
+	if providerConfig != "" {
+		klog.Infof("config file: '%s', overridden by env vars", providerConfig)
+	}
+	names := make([]string, 0, len(e.sources))
+	for name := range e.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		klog.Infof("config from env var: %s", e.sources[name])
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEnvResolver(t *testing.T) {
+	tests := []struct {
+		metal      string
+		packet     string
+		expected   string
+		source     string
+		deprecated []string
+	}{
+		{"", "", "", "", nil},
+		{"a", "", "a", "METAL_TEST_SETTING", nil},
+		{"", "b", "b", "PACKET_TEST_SETTING", []string{"PACKET_TEST_SETTING"}},
+		{"a", "a", "a", "METAL_TEST_SETTING", []string{"PACKET_TEST_SETTING"}},
+		{"a", "b", "a", "METAL_TEST_SETTING", []string{"PACKET_TEST_SETTING"}},
+	}
+	defer os.Unsetenv("METAL_TEST_SETTING")
+	defer os.Unsetenv("PACKET_TEST_SETTING")
+	for i, tt := range tests {
+		os.Setenv("METAL_TEST_SETTING", tt.metal)
+		os.Setenv("PACKET_TEST_SETTING", tt.packet)
+		env := newEnvResolver()
+		if v := env.get("METAL_TEST_SETTING"); v != tt.expected {
+			t.Errorf("%d: mismatched value, actual %q expected %q", i, v, tt.expected)
+		}
+		if source := env.sources["METAL_TEST_SETTING"]; source != tt.source {
+			t.Errorf("%d: mismatched source, actual %q expected %q", i, source, tt.source)
+		}
+		if !reflect.DeepEqual(env.deprecated, tt.deprecated) {
+			t.Errorf("%d: mismatched deprecated, actual %v expected %v", i, env.deprecated, tt.deprecated)
+		}
+	}
+}
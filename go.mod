@@ -3,44 +3,55 @@ module github.com/equinix/cloud-provider-equinix-metal
 go 1.15
 
 require (
+	github.com/aws/aws-sdk-go v1.35.24
 	github.com/hashicorp/go-hclog v0.12.0 // indirect
 	github.com/hashicorp/go-retryablehttp v0.6.6
 	github.com/packethost/packet-api-server v0.0.0-20200706140707-f0f79ef89944
 	github.com/packethost/packngo v0.5.1
 	github.com/pallinder/go-randomdata v1.2.0
 	github.com/pkg/errors v0.9.1
+	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
+	google.golang.org/grpc v1.27.1
 	gopkg.in/yaml.v2 v2.2.8
-	k8s.io/api v0.19.4
-	k8s.io/apimachinery v0.19.4
-	k8s.io/client-go v0.19.4
-	k8s.io/cloud-provider v0.19.4
-	k8s.io/component-base v0.19.4
+	k8s.io/api v0.20.4
+	k8s.io/apimachinery v0.20.4
+	k8s.io/client-go v0.20.4
+	k8s.io/cloud-provider v0.20.4
+	k8s.io/component-base v0.20.4
+	k8s.io/controller-manager v0.20.4
 	k8s.io/klog/v2 v2.5.0
-	k8s.io/kubernetes v1.19.4
+	k8s.io/kubernetes v1.20.4
 )
 
 replace (
-	k8s.io/api => k8s.io/api v0.19.4
-	k8s.io/apiextensions-apiserver => k8s.io/apiextensions-apiserver v0.19.4
-	k8s.io/apimachinery => k8s.io/apimachinery v0.19.4
-	k8s.io/apiserver => k8s.io/apiserver v0.19.4
-	k8s.io/cli-runtime => k8s.io/cli-runtime v0.19.4
-	k8s.io/client-go => k8s.io/client-go v0.19.4
-	k8s.io/cloud-provider => k8s.io/cloud-provider v0.19.4
-	k8s.io/cluster-bootstrap => k8s.io/cluster-bootstrap v0.19.4
-	k8s.io/code-generator => k8s.io/code-generator v0.19.4
-	k8s.io/component-base => k8s.io/component-base v0.19.4
-	k8s.io/cri-api => k8s.io/cri-api v0.19.4
-	k8s.io/csi-translation-lib => k8s.io/csi-translation-lib v0.19.4
-	k8s.io/kube-aggregator => k8s.io/kube-aggregator v0.19.4
-	k8s.io/kube-controller-manager => k8s.io/kube-controller-manager v0.19.4
-	k8s.io/kube-proxy => k8s.io/kube-proxy v0.19.4
-	k8s.io/kube-scheduler => k8s.io/kube-scheduler v0.19.4
-	k8s.io/kubectl => k8s.io/kubectl v0.19.4
-	k8s.io/kubelet => k8s.io/kubelet v0.19.4
-	k8s.io/kubernetes => k8s.io/kubernetes v1.19.4
-	k8s.io/legacy-cloud-providers => k8s.io/legacy-cloud-providers v0.19.4
-	k8s.io/metrics => k8s.io/metrics v0.19.4
-	k8s.io/sample-apiserver => k8s.io/sample-apiserver v0.19.4
+	k8s.io/api => k8s.io/api v0.20.4
+	k8s.io/apiextensions-apiserver => k8s.io/apiextensions-apiserver v0.20.4
+	k8s.io/apimachinery => k8s.io/apimachinery v0.20.4
+	k8s.io/apiserver => k8s.io/apiserver v0.20.4
+	k8s.io/cli-runtime => k8s.io/cli-runtime v0.20.4
+	k8s.io/client-go => k8s.io/client-go v0.20.4
+	k8s.io/cloud-provider => k8s.io/cloud-provider v0.20.4
+	k8s.io/cluster-bootstrap => k8s.io/cluster-bootstrap v0.20.4
+	k8s.io/code-generator => k8s.io/code-generator v0.20.4
+	k8s.io/component-base => k8s.io/component-base v0.20.4
+	k8s.io/component-helpers => k8s.io/component-helpers v0.20.4
+	k8s.io/controller-manager => k8s.io/controller-manager v0.20.4
+	k8s.io/cri-api => k8s.io/cri-api v0.20.4
+	k8s.io/csi-translation-lib => k8s.io/csi-translation-lib v0.20.4
+	k8s.io/kube-aggregator => k8s.io/kube-aggregator v0.20.4
+	k8s.io/kube-controller-manager => k8s.io/kube-controller-manager v0.20.4
+	k8s.io/kube-proxy => k8s.io/kube-proxy v0.20.4
+	k8s.io/kube-scheduler => k8s.io/kube-scheduler v0.20.4
+	k8s.io/kubectl => k8s.io/kubectl v0.20.4
+	k8s.io/kubelet => k8s.io/kubelet v0.20.4
+	k8s.io/kubernetes => k8s.io/kubernetes v1.20.4
+	k8s.io/legacy-cloud-providers => k8s.io/legacy-cloud-providers v0.20.4
+	k8s.io/metrics => k8s.io/metrics v0.20.4
+	k8s.io/mount-utils => k8s.io/mount-utils v0.20.4
+	k8s.io/sample-apiserver => k8s.io/sample-apiserver v0.20.4
+	k8s.io/sample-cli-plugin => k8s.io/sample-cli-plugin v0.20.4
+	k8s.io/sample-controller => k8s.io/sample-controller v0.20.4
 )
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/labels"
@@ -16,28 +17,93 @@ import (
 	_ "k8s.io/component-base/metrics/prometheus/clientgo" // for client metric registration
 	_ "k8s.io/component-base/metrics/prometheus/version"  // for version metric registration
 	"k8s.io/klog/v2"
-	"k8s.io/kubernetes/cmd/cloud-controller-manager/app"
 
 	"github.com/equinix/cloud-provider-equinix-metal/metal"
 	"github.com/spf13/pflag"
 )
 
 const (
-	apiKeyName                   = "METAL_API_KEY"
-	projectIDName                = "METAL_PROJECT_ID"
-	facilityName                 = "METAL_FACILITY_NAME"
-	loadBalancerSettingName      = "METAL_LB"
-	envVarLocalASN               = "METAL_LOCAL_ASN"
-	envVarBGPPass                = "METAL_BGP_PASS"
-	envVarAnnotationLocalASN     = "METAL_ANNOTATION_LOCAL_ASN"
-	envVarAnnotationPeerASNs     = "METAL_ANNOTATION_PEER_ASNS"
-	envVarAnnotationPeerIPs      = "METAL_ANNOTATION_PEER_IPS"
-	envVarAnnotationSrcIP        = "METAL_ANNOTATION_SRC_IP"
-	envVarAnnotationBGPPass      = "METAL_ANNOTATION_BGP_PASS"
-	envVarEIPTag                 = "METAL_EIP_TAG"
-	envVarAPIServerPort          = "METAL_API_SERVER_PORT"
-	envVarBGPNodeSelector        = "METAL_BGP_NODE_SELECTOR"
-	defaultLoadBalancerConfigMap = "metallb-system:config"
+	apiKeyName          = "METAL_API_KEY"
+	envVarAPIKeySource  = "METAL_API_KEY_SOURCE"
+	envVarAPIKeyRefresh = "METAL_API_KEY_REFRESH"
+	envVarVaultAddress  = "METAL_VAULT_ADDR"
+	envVarVaultToken    = "METAL_VAULT_TOKEN"
+	envVarVaultRole     = "METAL_VAULT_ROLE"
+	envVarVaultAuthPath = "METAL_VAULT_AUTH_PATH"
+	envVarAWSRegion     = "METAL_AWS_REGION"
+	// vaultAddressName, vaultTokenName, awsRegionName the env vars of the Vault CLI and the AWS SDKs, used if the METAL_ ones are not set
+	vaultAddressName                 = "VAULT_ADDR"
+	vaultTokenName                   = "VAULT_TOKEN"
+	awsRegionName                    = "AWS_REGION"
+	projectIDName                    = "METAL_PROJECT_ID"
+	facilityName                     = "METAL_FACILITY_NAME"
+	loadBalancerSettingName          = "METAL_LOAD_BALANCER"
+	deprecatedLoadBalancerName       = "METAL_LB"
+	envVarLocalASN                   = "METAL_LOCAL_ASN"
+	envVarBGPPass                    = "METAL_BGP_PASS"
+	envVarBGPPassSecret              = "METAL_BGP_PASS_SECRET"
+	envVarAnnotationLocalASN         = "METAL_ANNOTATION_LOCAL_ASN"
+	envVarAnnotationPeerASNs         = "METAL_ANNOTATION_PEER_ASNS"
+	envVarAnnotationPeerIPs          = "METAL_ANNOTATION_PEER_IPS"
+	envVarAnnotationSrcIP            = "METAL_ANNOTATION_SRC_IP"
+	envVarAnnotationBGPPass          = "METAL_ANNOTATION_BGP_PASS"
+	envVarPrivateASNRange            = "METAL_PRIVATE_ASN_RANGE"
+	envVarAnnotationPrivateASN       = "METAL_ANNOTATION_PRIVATE_ASN"
+	envVarEIPTag                     = "METAL_EIP_TAG"
+	envVarAPIServerPort              = "METAL_API_SERVER_PORT"
+	envVarEIPMaintenanceHold         = "METAL_EIP_MAINTENANCE_HOLD"
+	envVarEIPFailoverCooldown        = "METAL_EIP_FAILOVER_COOLDOWN"
+	envVarEIPMaxFailovers            = "METAL_EIP_MAX_FAILOVERS_PER_HOUR"
+	envVarEIPFailoverGrace           = "METAL_EIP_FAILOVER_GRACE_PERIOD"
+	envVarEIPManagement              = "METAL_EIP_MANAGEMENT"
+	envVarEIPSelectionPolicy         = "METAL_EIP_SELECTION_POLICY"
+	envVarEIPDriftPolicy             = "METAL_EIP_DRIFT_POLICY"
+	envVarEIPLoopback                = "METAL_EIP_LOOPBACK"
+	envVarEIPHairpin                 = "METAL_EIP_HAIRPIN"
+	envVarEIPEtcdLeaderMetrics       = "METAL_EIP_ETCD_LEADER_METRICS"
+	envVarEIPRebootAfter             = "METAL_EIP_REBOOT_AFTER"
+	envVarEIPMaxReboots              = "METAL_EIP_MAX_REBOOTS"
+	envVarEIPHealthCheckConcurrency  = "METAL_EIP_HEALTHCHECK_CONCURRENCY"
+	envVarEIPReconcileTimeout        = "METAL_EIP_RECONCILE_TIMEOUT"
+	envVarEIPCreate                  = "METAL_EIP_CREATE"
+	envVarEIPCreateMetro             = "METAL_EIP_CREATE_METRO"
+	envVarControlPlaneLB             = "METAL_CONTROL_PLANE_LOAD_BALANCER"
+	envVarControlPlaneHealth         = "METAL_CONTROL_PLANE_HEALTHCHECK"
+	envVarControlPlaneExternalHealth = "METAL_CONTROL_PLANE_EXTERNAL_HEALTHCHECK"
+	envVarControlPlaneGatewayClass   = "METAL_CONTROL_PLANE_GATEWAY_CLASS"
+	envVarBGPNodeSelector            = "METAL_BGP_NODE_SELECTOR"
+	envVarFallbackMetros             = "METAL_FALLBACK_METROS"
+	envVarLBHealthCheck              = "METAL_LOAD_BALANCER_HEALTHCHECK"
+	envVarLBExcludeCP                = "METAL_LOAD_BALANCER_EXCLUDE_CONTROL_PLANE"
+	envVarLBNamespaces               = "METAL_LOAD_BALANCER_NAMESPACES"
+	envVarLBExcludedNamespaces       = "METAL_LOAD_BALANCER_EXCLUDED_NAMESPACES"
+	envVarLBMaxIPs                   = "METAL_LOAD_BALANCER_MAX_IPS"
+	envVarLBMaxIPsPerNamespace       = "METAL_LOAD_BALANCER_MAX_IPS_PER_NAMESPACE"
+	envVarLBKeepIPGrace              = "METAL_LOAD_BALANCER_KEEP_IP_GRACE_PERIOD"
+	envVarLBNameFormat               = "METAL_LOAD_BALANCER_NAME_FORMAT"
+	envVarLBAddressPool              = "METAL_LOAD_BALANCER_ADDRESS_POOL"
+	envVarLBIPAllocator              = "METAL_LOAD_BALANCER_IP_ALLOCATOR"
+	envVarLBRackSpread               = "METAL_LOAD_BALANCER_RACK_SPREAD"
+	envVarLBReusePoolTag             = "METAL_LOAD_BALANCER_REUSE_POOL_TAG"
+	envVarPlanCapacity               = "METAL_PLAN_CAPACITY"
+	envVarIngressHints               = "METAL_INGRESS_HINTS"
+	envVarFeatureGates               = "METAL_FEATURE_GATES"
+	envVarDisableReconcilers         = "METAL_DISABLE_RECONCILERS"
+	envVarIPv6NodeAddresses          = "METAL_IPV6_NODE_ADDRESSES"
+	envVarNodeDeletionConfirmations  = "METAL_NODE_DELETION_CONFIRMATIONS"
+	envVarNodeDeletionDisabled       = "METAL_NODE_DELETION_DISABLED"
+	envVarWebhookAddress             = "METAL_WEBHOOK_ADDRESS"
+	envVarWebhookCertFile            = "METAL_WEBHOOK_CERT_FILE"
+	envVarWebhookKeyFile             = "METAL_WEBHOOK_KEY_FILE"
+	envVarAgentMode                  = "METAL_AGENT_MODE"
+	envVarNodeAddressType            = "METAL_NODE_ADDRESS_TYPE"
+	envVarTracingEndpoint            = "METAL_TRACING_ENDPOINT"
+	envVarTracingInsecure            = "METAL_TRACING_INSECURE"
+	envVarFaultInjection             = "METAL_FAULT_INJECTION"
+
+	envVarPrefix = "METAL_"
+	// deprecatedEnvVarPrefix the prefix of env vars from when this was the Packet CCM
+	deprecatedEnvVarPrefix = "PACKET_"
 )
 
 var (
@@ -47,11 +113,28 @@ var (
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	command := app.NewCloudControllerManagerCommand()
+	command, err := newCloudControllerManagerCommand()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
 
 	pflag.CommandLine.SetNormalizeFunc(cliflag.WordSepNormalizeFunc)
 	pflag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 
+	// the agent runs on each node without the provider config, so it cannot wait for it below
+	if len(os.Args) > 1 && os.Args[1] == agentCommandName {
+		logs.InitLogs()
+		defer logs.FlushLogs()
+		agent := newAgentCommand()
+		agent.SetArgs(os.Args[2:])
+		if err := agent.Execute(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// add our config
 	command.PersistentFlags().StringVar(&providerConfig, "provider-config", "", "path to provider config file")
 
@@ -76,6 +159,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	command.AddCommand(newCheckCommand(&config))
+	// listed for help only; it runs before the provider config is read, see above
+	command.AddCommand(newAgentCommand())
+
 	if err := command.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
@@ -85,6 +172,7 @@ func main() {
 func getMetalConfig(providerConfig string) (metal.Config, error) {
 	// get our token and project
 	var config, rawConfig metal.Config
+	env := newEnvResolver()
 	if providerConfig != "" {
 		configBytes, err := ioutil.ReadFile(providerConfig)
 		if err != nil {
@@ -97,36 +185,186 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 	}
 
 	// read env vars; if not set, use rawConfig
-	apiToken := os.Getenv(apiKeyName)
+	apiToken := env.get(apiKeyName)
 	if apiToken == "" {
 		apiToken = rawConfig.AuthToken
 	}
 	config.AuthToken = apiToken
 
-	projectID := os.Getenv(projectIDName)
+	config.AuthTokenSource = rawConfig.AuthTokenSource
+	if v := env.get(envVarAPIKeySource); v != "" {
+		config.AuthTokenSource = v
+	}
+	if err := metal.ValidateAuthTokenSource(config.AuthTokenSource); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarAPIKeySource, err)
+	}
+	config.AuthTokenRefresh = rawConfig.AuthTokenRefresh
+	if v := env.get(envVarAPIKeyRefresh); v != "" {
+		config.AuthTokenRefresh = v
+	}
+	if config.AuthTokenRefresh != "" {
+		if d, err := time.ParseDuration(config.AuthTokenRefresh); err != nil || d <= 0 {
+			return config, fmt.Errorf("%s must be a positive duration, e.g. 5m, was %s", envVarAPIKeyRefresh, config.AuthTokenRefresh)
+		}
+	}
+	config.VaultAddress = rawConfig.VaultAddress
+	if v := env.get(envVarVaultAddress); v != "" {
+		config.VaultAddress = v
+	} else if v := os.Getenv(vaultAddressName); v != "" && config.VaultAddress == "" {
+		config.VaultAddress = v
+	}
+	config.VaultToken = rawConfig.VaultToken
+	if v := env.get(envVarVaultToken); v != "" {
+		config.VaultToken = v
+	} else if v := os.Getenv(vaultTokenName); v != "" && config.VaultToken == "" {
+		config.VaultToken = v
+	}
+	config.VaultRole = rawConfig.VaultRole
+	if v := env.get(envVarVaultRole); v != "" {
+		config.VaultRole = v
+	}
+	config.VaultAuthPath = rawConfig.VaultAuthPath
+	if v := env.get(envVarVaultAuthPath); v != "" {
+		config.VaultAuthPath = v
+	}
+	config.AWSRegion = rawConfig.AWSRegion
+	if v := env.get(envVarAWSRegion); v != "" {
+		config.AWSRegion = v
+	} else if v := os.Getenv(awsRegionName); v != "" && config.AWSRegion == "" {
+		config.AWSRegion = v
+	}
+
+	projectID := env.get(projectIDName)
 	if projectID == "" {
 		projectID = rawConfig.ProjectID
 	}
 	config.ProjectID = projectID
 
-	loadBalancerSetting := os.Getenv(loadBalancerSettingName)
+	loadBalancerSetting := env.get(loadBalancerSettingName)
+	if loadBalancerSetting == "" {
+		if loadBalancerSetting = env.get(deprecatedLoadBalancerName); loadBalancerSetting != "" {
+			klog.Warningf("env var %s is deprecated, use %s instead", deprecatedLoadBalancerName, loadBalancerSettingName)
+			env.deprecate(deprecatedLoadBalancerName)
+		}
+	}
 	config.LoadBalancerSetting = rawConfig.LoadBalancerSetting
 	// rule for processing: any setting in env var overrides setting from file
 	if loadBalancerSetting != "" {
 		config.LoadBalancerSetting = loadBalancerSetting
 	}
-	// and set for default
-	if config.LoadBalancerSetting == "" {
-		config.LoadBalancerSetting = defaultLoadBalancerConfigMap
+	// the legacy <namespace>:<name> form of the metallb configmap still works, but is deprecated
+	if setting, legacy := metal.MigrateLoadBalancerSetting(config.LoadBalancerSetting); legacy {
+		klog.Warningf("load balancer setting %q is deprecated, use %q instead", config.LoadBalancerSetting, setting)
+		config.LoadBalancerSetting = setting
+	}
+	// an empty setting means load balancing is disabled; anything else must be valid
+	if _, err := metal.ParseLoadBalancerSetting(config.LoadBalancerSetting); err != nil {
+		return config, fmt.Errorf("%s: %w", loadBalancerSettingName, err)
+	}
+
+	config.LoadBalancerHealthCheck = rawConfig.LoadBalancerHealthCheck
+	if v := env.get(envVarLBHealthCheck); v != "" {
+		healthCheck, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarLBHealthCheck, v, err)
+		}
+		config.LoadBalancerHealthCheck = healthCheck
+	}
+
+	config.LBExcludeControlPlane = rawConfig.LBExcludeControlPlane
+	if v := env.get(envVarLBExcludeCP); v != "" {
+		exclude, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarLBExcludeCP, v, err)
+		}
+		config.LBExcludeControlPlane = exclude
+	}
+
+	config.LBNamespaces = rawConfig.LBNamespaces
+	if v := env.get(envVarLBNamespaces); v != "" {
+		config.LBNamespaces = strings.Split(v, ",")
+	}
+	config.LBExcludedNamespaces = rawConfig.LBExcludedNamespaces
+	if v := env.get(envVarLBExcludedNamespaces); v != "" {
+		config.LBExcludedNamespaces = strings.Split(v, ",")
+	}
+
+	config.LBMaxIPs = rawConfig.LBMaxIPs
+	if v := env.get(envVarLBMaxIPs); v != "" {
+		maxIPs, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarLBMaxIPs, v, err)
+		}
+		config.LBMaxIPs = maxIPs
+	}
+	config.LBMaxIPsPerNamespace = rawConfig.LBMaxIPsPerNamespace
+	if v := env.get(envVarLBMaxIPsPerNamespace); v != "" {
+		maxIPs, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarLBMaxIPsPerNamespace, v, err)
+		}
+		config.LBMaxIPsPerNamespace = maxIPs
+	}
+
+	config.LBKeepIPGracePeriod = rawConfig.LBKeepIPGracePeriod
+	if v := env.get(envVarLBKeepIPGrace); v != "" {
+		config.LBKeepIPGracePeriod = v
+	}
+	if config.LBKeepIPGracePeriod != "" {
+		if _, err := time.ParseDuration(config.LBKeepIPGracePeriod); err != nil {
+			return config, fmt.Errorf("%s must be a duration, e.g. 1h, was %s: %v", envVarLBKeepIPGrace, config.LBKeepIPGracePeriod, err)
+		}
+	}
+
+	config.LBNameFormat = rawConfig.LBNameFormat
+	if v := env.get(envVarLBNameFormat); v != "" {
+		config.LBNameFormat = v
+	}
+	if err := metal.ValidateLoadBalancerNameFormat(config.LBNameFormat); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarLBNameFormat, err)
+	}
+
+	config.LBAddressPool = rawConfig.LBAddressPool
+	if v := env.get(envVarLBAddressPool); v != "" {
+		config.LBAddressPool = v
+	}
+	if err := metal.ValidateLBAddressPool(config.LBAddressPool); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarLBAddressPool, err)
+	}
+
+	config.LBIPAllocator = rawConfig.LBIPAllocator
+	if v := env.get(envVarLBIPAllocator); v != "" {
+		config.LBIPAllocator = v
+	}
+	if err := metal.ValidateIPAllocator(config.LBIPAllocator); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarLBIPAllocator, err)
+	}
+
+	config.LBRackSpread = rawConfig.LBRackSpread
+	if v := env.get(envVarLBRackSpread); v != "" {
+		rackSpread, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarLBRackSpread, v, err)
+		}
+		config.LBRackSpread = rackSpread
+	}
+
+	config.LBReusePoolTag = rawConfig.LBReusePoolTag
+	if v := env.get(envVarLBReusePoolTag); v != "" {
+		config.LBReusePoolTag = v
+	}
+	if err := metal.ValidateLBReusePoolTag(config.LBReusePoolTag); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarLBReusePoolTag, err)
 	}
 
-	facility := os.Getenv(facilityName)
+	facility := env.get(facilityName)
 	if facility == "" {
 		facility = rawConfig.Facility
 	}
 
-	if apiToken == "" {
-		return config, fmt.Errorf("environment variable %q is required", apiKeyName)
+	// with a source, the token is read from it when the CCM starts
+	if apiToken == "" && config.AuthTokenSource == "" {
+		return config, fmt.Errorf("environment variable %q is required, unless %q is set", apiKeyName, envVarAPIKeySource)
 	}
 
 	if projectID == "" {
@@ -137,14 +375,19 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 	if facility == "" {
 		metadata, err := metal.GetAndParseMetadata("")
 		if err != nil {
-			return config, fmt.Errorf("facility not set in environment variable %q or config file, and error reading metadata: %v", facilityName, err)
+			return config, fmt.Errorf("facility not set in environment variable %q or config file, and error reading metadata, which is only available on Equinix Metal devices: %v", facilityName, err)
 		}
 		facility = metadata.Facility
 	}
 	config.Facility = facility
 
+	config.FallbackMetros = rawConfig.FallbackMetros
+	if v := env.get(envVarFallbackMetros); v != "" {
+		config.FallbackMetros = strings.Split(v, ",")
+	}
+
 	// get the local ASN
-	localASN := os.Getenv(envVarLocalASN)
+	localASN := env.get(envVarLocalASN)
 	switch {
 	case localASN != "":
 		localASNNo, err := strconv.Atoi(localASN)
@@ -158,48 +401,72 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 		config.LocalASN = metal.DefaultLocalASN
 	}
 
-	bgpPass := os.Getenv(envVarBGPPass)
+	bgpPass := env.get(envVarBGPPass)
 	if bgpPass != "" {
 		config.BGPPass = bgpPass
 	}
 
+	config.BGPPassSecret = rawConfig.BGPPassSecret
+	if v := env.get(envVarBGPPassSecret); v != "" {
+		bgpPassSecret, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarBGPPassSecret, v, err)
+		}
+		config.BGPPassSecret = bgpPassSecret
+	}
+
 	// set the annotations
 	config.AnnotationLocalASN = metal.DefaultAnnotationNodeASN
-	annotationLocalASN := os.Getenv(envVarAnnotationLocalASN)
+	annotationLocalASN := env.get(envVarAnnotationLocalASN)
 	if annotationLocalASN != "" {
 		config.AnnotationLocalASN = annotationLocalASN
 	}
 	config.AnnotationPeerASNs = metal.DefaultAnnotationPeerASNs
-	annotationPeerASNs := os.Getenv(envVarAnnotationPeerASNs)
+	annotationPeerASNs := env.get(envVarAnnotationPeerASNs)
 	if annotationPeerASNs != "" {
 		config.AnnotationPeerASNs = annotationPeerASNs
 	}
 	config.AnnotationPeerIPs = metal.DefaultAnnotationPeerIPs
-	annotationPeerIPs := os.Getenv(envVarAnnotationPeerIPs)
+	annotationPeerIPs := env.get(envVarAnnotationPeerIPs)
 	if annotationPeerIPs != "" {
 		config.AnnotationPeerIPs = annotationPeerIPs
 	}
 	config.AnnotationSrcIP = metal.DefaultAnnotationSrcIP
-	annotationSrcIP := os.Getenv(envVarAnnotationSrcIP)
+	annotationSrcIP := env.get(envVarAnnotationSrcIP)
 	if annotationSrcIP != "" {
 		config.AnnotationSrcIP = annotationSrcIP
 	}
 
 	config.AnnotationBGPPass = metal.DefaultAnnotationBGPPass
-	annotationBGPPass := os.Getenv(envVarAnnotationBGPPass)
+	annotationBGPPass := env.get(envVarAnnotationBGPPass)
 	if annotationBGPPass != "" {
 		config.AnnotationBGPPass = annotationBGPPass
 	}
 
+	config.PrivateASNRange = rawConfig.PrivateASNRange
+	if v := env.get(envVarPrivateASNRange); v != "" {
+		config.PrivateASNRange = v
+	}
+	if _, err := metal.ParseASNRange(config.PrivateASNRange); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarPrivateASNRange, err)
+	}
+	config.AnnotationPrivateASN = metal.DefaultAnnotationPrivateASN
+	if rawConfig.AnnotationPrivateASN != "" {
+		config.AnnotationPrivateASN = rawConfig.AnnotationPrivateASN
+	}
+	if v := env.get(envVarAnnotationPrivateASN); v != "" {
+		config.AnnotationPrivateASN = v
+	}
+
 	if rawConfig.EIPTag != "" {
 		config.EIPTag = rawConfig.EIPTag
 	}
-	eipTag := os.Getenv(envVarEIPTag)
+	eipTag := env.get(envVarEIPTag)
 	if eipTag != "" {
 		config.EIPTag = eipTag
 	}
 
-	apiServer := os.Getenv(envVarAPIServerPort)
+	apiServer := env.get(envVarAPIServerPort)
 	switch {
 	case apiServer != "":
 		apiServerNo, err := strconv.Atoi(apiServer)
@@ -213,9 +480,184 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 		// if nothing else set it, we set it to 0, to indicate that it should use whatever the kube-apiserver port is
 		config.APIServerPort = 0
 	}
+	if config.APIServerPort < 0 || config.APIServerPort > 65535 {
+		return config, fmt.Errorf("api server port must be between 0 and 65535, was %d", config.APIServerPort)
+	}
+
+	config.EIPMaintenanceHold = rawConfig.EIPMaintenanceHold
+	if v := env.get(envVarEIPMaintenanceHold); v != "" {
+		hold, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarEIPMaintenanceHold, v, err)
+		}
+		config.EIPMaintenanceHold = hold
+	}
+
+	config.EIPFailoverCooldown = rawConfig.EIPFailoverCooldown
+	if v := env.get(envVarEIPFailoverCooldown); v != "" {
+		config.EIPFailoverCooldown = v
+	}
+	if config.EIPFailoverCooldown != "" {
+		if _, err := time.ParseDuration(config.EIPFailoverCooldown); err != nil {
+			return config, fmt.Errorf("%s must be a duration, e.g. 5m, was %s: %v", envVarEIPFailoverCooldown, config.EIPFailoverCooldown, err)
+		}
+	}
+
+	config.EIPMaxFailoversPerHour = rawConfig.EIPMaxFailoversPerHour
+	if v := env.get(envVarEIPMaxFailovers); v != "" {
+		maxFailovers, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarEIPMaxFailovers, v, err)
+		}
+		config.EIPMaxFailoversPerHour = maxFailovers
+	}
+
+	config.EIPFailoverGracePeriod = rawConfig.EIPFailoverGracePeriod
+	if v := env.get(envVarEIPFailoverGrace); v != "" {
+		config.EIPFailoverGracePeriod = v
+	}
+	if config.EIPFailoverGracePeriod != "" {
+		if _, err := time.ParseDuration(config.EIPFailoverGracePeriod); err != nil {
+			return config, fmt.Errorf("%s must be a duration, e.g. 5m, was %s: %v", envVarEIPFailoverGrace, config.EIPFailoverGracePeriod, err)
+		}
+	}
+
+	config.EIPManagement = rawConfig.EIPManagement
+	if v := env.get(envVarEIPManagement); v != "" {
+		config.EIPManagement = v
+	}
+	if err := metal.ValidateEIPManagement(config.EIPManagement); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarEIPManagement, err)
+	}
+
+	config.EIPSelectionPolicy = rawConfig.EIPSelectionPolicy
+	if v := env.get(envVarEIPSelectionPolicy); v != "" {
+		config.EIPSelectionPolicy = v
+	}
+	if err := metal.ValidateEIPSelectionPolicy(config.EIPSelectionPolicy); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarEIPSelectionPolicy, err)
+	}
+
+	config.EIPDriftPolicy = rawConfig.EIPDriftPolicy
+	if v := env.get(envVarEIPDriftPolicy); v != "" {
+		config.EIPDriftPolicy = v
+	}
+	if err := metal.ValidateEIPDriftPolicy(config.EIPDriftPolicy); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarEIPDriftPolicy, err)
+	}
+
+	config.EIPLoopback = rawConfig.EIPLoopback
+	if v := env.get(envVarEIPLoopback); v != "" {
+		eipLoopback, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarEIPLoopback, v, err)
+		}
+		config.EIPLoopback = eipLoopback
+	}
+
+	config.EIPHairpin = rawConfig.EIPHairpin
+	if v := env.get(envVarEIPHairpin); v != "" {
+		eipHairpin, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarEIPHairpin, v, err)
+		}
+		config.EIPHairpin = eipHairpin
+	}
+
+	config.EIPEtcdLeaderMetrics = rawConfig.EIPEtcdLeaderMetrics
+	if v := env.get(envVarEIPEtcdLeaderMetrics); v != "" {
+		config.EIPEtcdLeaderMetrics = v
+	}
+	if err := metal.ValidateEIPEtcdLeaderMetrics(config.EIPEtcdLeaderMetrics); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarEIPEtcdLeaderMetrics, err)
+	}
+
+	config.EIPRebootAfter = rawConfig.EIPRebootAfter
+	if v := env.get(envVarEIPRebootAfter); v != "" {
+		config.EIPRebootAfter = v
+	}
+	if config.EIPRebootAfter != "" {
+		if _, err := time.ParseDuration(config.EIPRebootAfter); err != nil {
+			return config, fmt.Errorf("%s must be a duration, e.g. 15m, was %s: %v", envVarEIPRebootAfter, config.EIPRebootAfter, err)
+		}
+	}
+
+	config.EIPMaxReboots = rawConfig.EIPMaxReboots
+	if v := env.get(envVarEIPMaxReboots); v != "" {
+		maxReboots, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarEIPMaxReboots, v, err)
+		}
+		config.EIPMaxReboots = maxReboots
+	}
+
+	config.EIPHealthCheckConcurrency = rawConfig.EIPHealthCheckConcurrency
+	if v := env.get(envVarEIPHealthCheckConcurrency); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarEIPHealthCheckConcurrency, v, err)
+		}
+		config.EIPHealthCheckConcurrency = concurrency
+	}
+	if config.EIPHealthCheckConcurrency < 0 {
+		return config, fmt.Errorf("%s must not be negative, was %d", envVarEIPHealthCheckConcurrency, config.EIPHealthCheckConcurrency)
+	}
+
+	config.EIPReconcileTimeout = rawConfig.EIPReconcileTimeout
+	if v := env.get(envVarEIPReconcileTimeout); v != "" {
+		config.EIPReconcileTimeout = v
+	}
+	if config.EIPReconcileTimeout != "" {
+		if _, err := time.ParseDuration(config.EIPReconcileTimeout); err != nil {
+			return config, fmt.Errorf("%s must be a duration, e.g. 45s, was %s: %v", envVarEIPReconcileTimeout, config.EIPReconcileTimeout, err)
+		}
+	}
+
+	config.EIPCreate = rawConfig.EIPCreate
+	if v := env.get(envVarEIPCreate); v != "" {
+		eipCreate, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarEIPCreate, v, err)
+		}
+		config.EIPCreate = eipCreate
+	}
+
+	config.EIPCreateMetro = rawConfig.EIPCreateMetro
+	if v := env.get(envVarEIPCreateMetro); v != "" {
+		config.EIPCreateMetro = v
+	}
+
+	config.ControlPlaneLBSetting = rawConfig.ControlPlaneLBSetting
+	if v := env.get(envVarControlPlaneLB); v != "" {
+		config.ControlPlaneLBSetting = v
+	}
+	if err := metal.ValidateControlPlaneLBSetting(config.ControlPlaneLBSetting); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarControlPlaneLB, err)
+	}
+
+	config.ControlPlaneHealthCheck = rawConfig.ControlPlaneHealthCheck
+	if v := env.get(envVarControlPlaneHealth); v != "" {
+		config.ControlPlaneHealthCheck = v
+	}
+
+	config.ControlPlaneExternalHealthCheck = rawConfig.ControlPlaneExternalHealthCheck
+	if v := env.get(envVarControlPlaneExternalHealth); v != "" {
+		config.ControlPlaneExternalHealthCheck = v
+	}
+	if err := metal.ValidateControlPlaneExternalHealthCheck(config.ControlPlaneExternalHealthCheck); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarControlPlaneExternalHealth, err)
+	}
+
+	config.ControlPlaneGatewayClass = rawConfig.ControlPlaneGatewayClass
+	if v := env.get(envVarControlPlaneGatewayClass); v != "" {
+		config.ControlPlaneGatewayClass = v
+	}
+	if err := metal.ValidateControlPlaneGatewayClass(config.ControlPlaneGatewayClass); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarControlPlaneGatewayClass, err)
+	}
 
 	config.BGPNodeSelector = rawConfig.BGPNodeSelector
-	if v := os.Getenv(envVarBGPNodeSelector); v != "" {
+	if v := env.get(envVarBGPNodeSelector); v != "" {
 		config.BGPNodeSelector = v
 	}
 
@@ -223,6 +665,129 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 		return config, fmt.Errorf("BGP Node Selector must be valid Kubernetes selector: %w", err)
 	}
 
+	config.PlanCapacity = rawConfig.PlanCapacity
+	if v := env.get(envVarPlanCapacity); v != "" {
+		planCapacity, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarPlanCapacity, v, err)
+		}
+		config.PlanCapacity = planCapacity
+	}
+
+	config.IngressHints = rawConfig.IngressHints
+	if v := env.get(envVarIngressHints); v != "" {
+		ingressHints, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarIngressHints, v, err)
+		}
+		config.IngressHints = ingressHints
+	}
+
+	config.FeatureGates = rawConfig.FeatureGates
+	if v := env.get(envVarFeatureGates); v != "" {
+		config.FeatureGates = v
+	}
+	if _, err := metal.ParseFeatureGates(config.FeatureGates); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarFeatureGates, err)
+	}
+
+	config.DisabledReconcilers = rawConfig.DisabledReconcilers
+	if v := env.get(envVarDisableReconcilers); v != "" {
+		config.DisabledReconcilers = v
+	}
+	if _, err := metal.ParseDisabledReconcilers(config.DisabledReconcilers); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarDisableReconcilers, err)
+	}
+
+	config.IPv6NodeAddresses = rawConfig.IPv6NodeAddresses
+	if v := env.get(envVarIPv6NodeAddresses); v != "" {
+		ipv6, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarIPv6NodeAddresses, v, err)
+		}
+		config.IPv6NodeAddresses = ipv6
+	}
+
+	nodeDeletionConfirmations := env.get(envVarNodeDeletionConfirmations)
+	switch {
+	case nodeDeletionConfirmations != "":
+		confirmations, err := strconv.Atoi(nodeDeletionConfirmations)
+		if err != nil || confirmations < 1 {
+			return config, fmt.Errorf("env var %s must be a number of at least 1, was %s", envVarNodeDeletionConfirmations, nodeDeletionConfirmations)
+		}
+		config.NodeDeletionConfirmations = confirmations
+	case rawConfig.NodeDeletionConfirmations != 0:
+		config.NodeDeletionConfirmations = rawConfig.NodeDeletionConfirmations
+	default:
+		config.NodeDeletionConfirmations = metal.DefaultNodeDeletionConfirmations
+	}
+
+	config.NodeDeletionDisabled = rawConfig.NodeDeletionDisabled
+	if v := env.get(envVarNodeDeletionDisabled); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarNodeDeletionDisabled, v, err)
+		}
+		config.NodeDeletionDisabled = disabled
+	}
+
+	config.WebhookAddress = rawConfig.WebhookAddress
+	if v := env.get(envVarWebhookAddress); v != "" {
+		config.WebhookAddress = v
+	}
+	config.WebhookCertFile = rawConfig.WebhookCertFile
+	if v := env.get(envVarWebhookCertFile); v != "" {
+		config.WebhookCertFile = v
+	}
+	config.WebhookKeyFile = rawConfig.WebhookKeyFile
+	if v := env.get(envVarWebhookKeyFile); v != "" {
+		config.WebhookKeyFile = v
+	}
+	// the apiserver only calls webhooks over TLS
+	if config.WebhookAddress != "" && (config.WebhookCertFile == "" || config.WebhookKeyFile == "") {
+		return config, fmt.Errorf("%s requires both %s and %s", envVarWebhookAddress, envVarWebhookCertFile, envVarWebhookKeyFile)
+	}
+
+	config.AgentMode = rawConfig.AgentMode
+	if v := env.get(envVarAgentMode); v != "" {
+		agentMode, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarAgentMode, v, err)
+		}
+		config.AgentMode = agentMode
+	}
+
+	config.NodeAddressType = rawConfig.NodeAddressType
+	if v := env.get(envVarNodeAddressType); v != "" {
+		config.NodeAddressType = v
+	}
+	if err := metal.ValidateNodeAddressType(config.NodeAddressType); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarNodeAddressType, err)
+	}
+
+	config.TracingEndpoint = rawConfig.TracingEndpoint
+	if v := env.get(envVarTracingEndpoint); v != "" {
+		config.TracingEndpoint = v
+	}
+	config.TracingInsecure = rawConfig.TracingInsecure
+	if v := env.get(envVarTracingInsecure); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarTracingInsecure, v, err)
+		}
+		config.TracingInsecure = insecure
+	}
+
+	config.FaultInjection = rawConfig.FaultInjection
+	if v := env.get(envVarFaultInjection); v != "" {
+		config.FaultInjection = v
+	}
+	if err := metal.ValidateFaultInjection(config.FaultInjection); err != nil {
+		return config, fmt.Errorf("%s: %w", envVarFaultInjection, err)
+	}
+
+	env.report(providerConfig)
+	config.DeprecatedSettings = env.deprecated
 	return config, nil
 }
 
@@ -232,4 +797,7 @@ func printMetalConfig(config metal.Config) {
 	for _, l := range lines {
 		klog.Infof(l)
 	}
+	if config.FaultInjection != "" {
+		klog.V(2).Infof("fault injection: '%s'", config.FaultInjection)
+	}
 }
@@ -0,0 +1,268 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/packethost/packngo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultMetadataURL the Equinix Metal metadata service, as seen from a device
+	defaultMetadataURL = "https://metadata.platformequinix.com/metadata"
+	// DefaultAgentInterval how often the agent reads the metadata service by default
+	DefaultAgentInterval = 30 * time.Second
+
+	managedByAgent = "cloud-provider-equinix-metal-agent"
+)
+
+// AgentConfig configuration for the node agent
+type AgentConfig struct {
+	// NodeName the name of the node on which the agent runs
+	NodeName string
+	// MetadataURL the metadata service; empty for the Equinix Metal one
+	MetadataURL string
+	Interval    time.Duration
+	// BindLoopback bind the addresses that the CCM lists in the MetalNode to the loopback interface
+	BindLoopback bool
+}
+
+// deviceMetadata the parts of the metadata of a device that the agent reports;
+// the packngo metadata client does not parse the BGP neighbours or spot market fields
+type deviceMetadata struct {
+	ID           string                `json:"id"`
+	Hostname     string                `json:"hostname"`
+	Facility     string                `json:"facility"`
+	Plan         string                `json:"plan"`
+	BGPNeighbors []packngo.BGPNeighbor `json:"bgp_neighbors"`
+	Spot         struct {
+		TerminationTime *time.Time `json:"termination_time"`
+	} `json:"spot"`
+}
+
+// getDeviceMetadata read the metadata of the device from the metadata service
+func getDeviceMetadata(ctx context.Context, client *http.Client, u string) (*deviceMetadata, error) {
+	if u == "" {
+		u = defaultMetadataURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service returned %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var md deviceMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	return &md, nil
+}
+
+// agent the node-local agent: it reads the metadata service of its device, and reports
+// it in the MetalNode of its node, so that the CCM need not poll the Equinix Metal API
+// for each node. Optionally, it binds to the loopback interface the addresses that the
+// CCM lists in the spec of the MetalNode, such as the control plane elastic IP.
+type agent struct {
+	config        AgentConfig
+	httpClient    *http.Client
+	dynamicClient dynamic.Interface
+	loopback      loopbackAddresses
+	// bound the addresses the agent bound to the loopback interface
+	bound []string
+}
+
+// loopbackAddresses add and remove addresses on the loopback interface
+type loopbackAddresses interface {
+	add(ip net.IP) error
+	remove(ip net.IP) error
+}
+
+// RunAgent run the node agent until the context is done
+func RunAgent(ctx context.Context, config AgentConfig, client dynamic.Interface) error {
+	if config.NodeName == "" {
+		return fmt.Errorf("node name is required")
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultAgentInterval
+	}
+	a := &agent{
+		config:        config,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		dynamicClient: client,
+		loopback:      systemLoopback{},
+	}
+	// pick up what an earlier run of the agent bound, so that it can be removed when stale
+	if obj, err := client.Resource(metalNodeResource).Get(ctx, config.NodeName, metav1.GetOptions{}); err == nil {
+		if status, err := parseMetalNodeStatus(obj.Object); err == nil {
+			a.bound = status.LoopbackAddresses
+		}
+	}
+	klog.Infof("agent started for node %s, every %s", config.NodeName, config.Interval)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := a.sync(ctx); err != nil {
+			klog.Errorf("agent sync failed: %v", err)
+		}
+	}, config.Interval)
+	return nil
+}
+
+// sync read the metadata, update the loopback interface and report both
+func (a *agent) sync(ctx context.Context) error {
+	md, err := getDeviceMetadata(ctx, a.httpClient, a.config.MetadataURL)
+	if err != nil {
+		return fmt.Errorf("unable to read metadata: %w", err)
+	}
+	if a.config.BindLoopback {
+		if err := a.syncLoopback(ctx); err != nil {
+			klog.Errorf("unable to update loopback addresses: %v", err)
+		}
+	}
+	return a.writeStatus(ctx, newMetalNodeStatus(md, a.bound, time.Now()))
+}
+
+// syncLoopback bind to the loopback interface the addresses that the CCM set in the spec
+// of the MetalNode of this node, and remove any address bound earlier that it no longer lists
+func (a *agent) syncLoopback(ctx context.Context) error {
+	obj, err := a.dynamicClient.Resource(metalNodeResource).Get(ctx, a.config.NodeName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to get metal node %s: %w", a.config.NodeName, err)
+	}
+	var desired []string
+	if err == nil {
+		desired = metalNodeLoopbackAddresses(obj.Object)
+	}
+	add, remove := loopbackChanges(desired, a.bound)
+	bound := map[string]bool{}
+	for _, addr := range a.bound {
+		bound[addr] = true
+	}
+	var errs []error
+	for _, addr := range remove {
+		if err := a.loopback.remove(net.ParseIP(addr)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to remove %s: %w", addr, err))
+			continue
+		}
+		klog.Infof("removed %s from the loopback interface", addr)
+		delete(bound, addr)
+	}
+	for _, addr := range add {
+		if err := a.loopback.add(net.ParseIP(addr)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to add %s: %w", addr, err))
+			continue
+		}
+		klog.Infof("added %s to the loopback interface", addr)
+		bound[addr] = true
+	}
+	a.bound = make([]string, 0, len(bound))
+	for addr := range bound {
+		a.bound = append(a.bound, addr)
+	}
+	sort.Strings(a.bound)
+	return utilerrors.NewAggregate(errs)
+}
+
+// loopbackChanges the valid addresses to add to and remove from the loopback interface,
+// to go from the bound ones to the desired ones
+func loopbackChanges(desired, bound []string) (add, remove []string) {
+	want := map[string]bool{}
+	for _, addr := range desired {
+		if net.ParseIP(addr) != nil {
+			want[addr] = true
+		}
+	}
+	have := map[string]bool{}
+	for _, addr := range bound {
+		have[addr] = true
+		if !want[addr] && net.ParseIP(addr) != nil {
+			remove = append(remove, addr)
+		}
+	}
+	for addr := range want {
+		if !have[addr] {
+			add = append(add, addr)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+	return add, remove
+}
+
+// newMetalNodeStatus the status of a MetalNode from the metadata of its device; the
+// BGP passwords are left out, as the status can be read more widely than secrets
+func newMetalNodeStatus(md *deviceMetadata, loopback []string, now time.Time) metalNodeStatus {
+	status := metalNodeStatus{
+		DeviceID:          md.ID,
+		Hostname:          md.Hostname,
+		Facility:          md.Facility,
+		Plan:              md.Plan,
+		LoopbackAddresses: loopback,
+		LastUpdateTime:    metav1.NewTime(now),
+	}
+	for _, n := range md.BGPNeighbors {
+		status.BGPNeighbours = append(status.BGPNeighbours, metalNodeBGPNeighbour{
+			AddressFamily: n.AddressFamily,
+			CustomerAS:    n.CustomerAs,
+			CustomerIP:    n.CustomerIP,
+			PeerAS:        n.PeerAs,
+			PeerIPs:       n.PeerIps,
+			Multihop:      n.Multihop,
+			MD5Enabled:    n.Md5Enabled,
+		})
+	}
+	if md.Spot.TerminationTime != nil {
+		t := metav1.NewTime(*md.Spot.TerminationTime)
+		status.SpotTerminationTime = &t
+	}
+	return status
+}
+
+// writeStatus write the status of the MetalNode of this node, creating it if needed
+func (a *agent) writeStatus(ctx context.Context, status metalNodeStatus) error {
+	client := a.dynamicClient.Resource(metalNodeResource)
+	obj, err := client.Get(ctx, a.config.NodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion(metalNodeResource.GroupVersion().String())
+		obj.SetKind(metalNodeKind)
+		obj.SetName(a.config.NodeName)
+		obj.SetLabels(map[string]string{managedByLabel: managedByAgent})
+		obj, err = client.Create(ctx, obj, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get metal node %s: %w", a.config.NodeName, err)
+	}
+	statusObj, err := status.unstructured()
+	if err != nil {
+		return fmt.Errorf("unable to convert status: %w", err)
+	}
+	if err := unstructured.SetNestedMap(obj.Object, statusObj, "status"); err != nil {
+		return fmt.Errorf("unable to set status: %w", err)
+	}
+	if _, err := client.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("unable to update status of metal node %s: %w", a.config.NodeName, err)
+	}
+	return nil
+}
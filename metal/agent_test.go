@@ -0,0 +1,150 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testDeviceMetadata = `{
+  "id": "abc",
+  "hostname": "worker-1",
+  "facility": "ewr1",
+  "plan": "c3.small.x86",
+  "bgp_neighbors": [
+    {"address_family": 4, "customer_as": 65000, "customer_ip": "10.0.0.2", "md5_enabled": true, "md5_password": "secret",
+     "multihop": true, "peer_as": 65530, "peer_ips": ["169.254.255.1", "169.254.255.2"]}
+  ],
+  "spot": {"termination_time": "2021-01-01T00:00:00Z"}
+}`
+
+type testLoopback struct {
+	addresses map[string]bool
+}
+
+func (l *testLoopback) add(ip net.IP) error {
+	l.addresses[ip.String()] = true
+	return nil
+}
+
+func (l *testLoopback) remove(ip net.IP) error {
+	delete(l.addresses, ip.String())
+	return nil
+}
+
+func TestGetDeviceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testDeviceMetadata)
+	}))
+	defer server.Close()
+
+	md, err := getDeviceMetadata(context.Background(), server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status := newMetalNodeStatus(md, nil, time.Now())
+	if status.DeviceID != "abc" || status.Facility != "ewr1" || status.Plan != "c3.small.x86" {
+		t.Errorf("mismatched device, actual %+v", status)
+	}
+	if status.SpotTerminationTime == nil || !status.SpotTerminationTime.Equal(&metav1.Time{Time: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}) {
+		t.Errorf("mismatched spot termination time, actual %v", status.SpotTerminationTime)
+	}
+	expected := []metalNodeBGPNeighbour{{AddressFamily: 4, CustomerAS: 65000, CustomerIP: "10.0.0.2", PeerAS: 65530, PeerIPs: []string{"169.254.255.1", "169.254.255.2"}, Multihop: true, MD5Enabled: true}}
+	if !reflect.DeepEqual(status.BGPNeighbours, expected) {
+		t.Errorf("mismatched bgp neighbours, actual %+v expected %+v", status.BGPNeighbours, expected)
+	}
+}
+
+func TestLoopbackChanges(t *testing.T) {
+	tests := []struct {
+		desired []string
+		bound   []string
+		add     []string
+		remove  []string
+	}{
+		{nil, nil, nil, nil},
+		{[]string{testEIP}, nil, []string{testEIP}, nil},
+		{[]string{testEIP}, []string{testEIP}, nil, nil},
+		{nil, []string{testEIP}, nil, []string{testEIP}},
+		{[]string{"147.75.0.2"}, []string{testEIP}, []string{"147.75.0.2"}, []string{testEIP}},
+		{[]string{"invalid"}, nil, nil, nil},
+	}
+	for i, tt := range tests {
+		add, remove := loopbackChanges(tt.desired, tt.bound)
+		if !reflect.DeepEqual(add, tt.add) || !reflect.DeepEqual(remove, tt.remove) {
+			t.Errorf("%d: mismatched changes, actual add %v remove %v, expected add %v remove %v", i, add, remove, tt.add, tt.remove)
+		}
+	}
+}
+
+func TestAgentSync(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testDeviceMetadata)
+	}))
+	defer server.Close()
+
+	client := testDynamicClient()
+	node := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"loopbackAddresses": []interface{}{testEIP}},
+	}}
+	node.SetAPIVersion(metalNodeResource.GroupVersion().String())
+	node.SetKind(metalNodeKind)
+	node.SetName("worker-1")
+	if _, err := client.Resource(metalNodeResource).Create(ctx, node, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unable to create metal node: %v", err)
+	}
+
+	loopback := &testLoopback{addresses: map[string]bool{}}
+	a := &agent{
+		config:        AgentConfig{NodeName: "worker-1", MetadataURL: server.URL, BindLoopback: true},
+		httpClient:    server.Client(),
+		dynamicClient: client,
+		loopback:      loopback,
+	}
+	getStatus := func() metalNodeStatus {
+		obj, err := client.Resource(metalNodeResource).Get(ctx, "worker-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get metal node: %v", err)
+		}
+		status, err := parseMetalNodeStatus(obj.Object)
+		if err != nil {
+			t.Fatalf("unable to parse metal node status: %v", err)
+		}
+		return status
+	}
+
+	// listed in the spec, the elastic ip is bound and reported
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status := getStatus()
+	if status.DeviceID != "abc" || !reflect.DeepEqual(status.LoopbackAddresses, []string{testEIP}) || !loopback.addresses[testEIP] {
+		t.Errorf("mismatched status while listed in the spec, actual %+v, bound %v", status, loopback.addresses)
+	}
+
+	// once the CCM no longer lists it, it is removed
+	obj, err := client.Resource(metalNodeResource).Get(ctx, "worker-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get metal node: %v", err)
+	}
+	unstructured.RemoveNestedField(obj.Object, "spec", "loopbackAddresses")
+	if _, err := client.Resource(metalNodeResource).Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update metal node: %v", err)
+	}
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status = getStatus()
+	if len(status.LoopbackAddresses) != 0 || len(loopback.addresses) != 0 {
+		t.Errorf("mismatched status after it was no longer listed, actual %+v, bound %v", status, loopback.addresses)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/packethost/packngo"
 	"github.com/pkg/errors"
@@ -17,6 +19,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
@@ -32,14 +35,38 @@ type bgp struct {
 	annotationSrcIP    string
 	annotationBgpPass  string
 	nodeSelector       labels.Selector
+
+	// asnLock protects the allocation of private ASNs to nodes
+	asnLock              sync.Mutex
+	privateASNRange      *ASNRange
+	annotationPrivateASN string
+
+	// passSecret whether to keep the project BGP password in a secret
+	passSecret bool
+	recorder   record.EventRecorder
+	// metalNodes the BGP neighbours reported by node agents, if in agent mode
+	metalNodes *metalNodeManager
+
+	// sessions enables BGP on devices; enableLock protects enableFailures, the nodes on
+	// whose devices enabling BGP failed, to retry with backoff, see ensureNodeBGP
+	sessions       packngo.BGPSessionService
+	enableLock     sync.Mutex
+	enableFailures map[string]*bgpEnableFailure
+	now            func() time.Time
 }
 
-func newBGP(client *packngo.Client, project string, localASN int, bgpPass string, annotationLocalASN, annotationPeerASNs, annotationPeerIPs, annotationSrcIP, annotationBgpPass string, nodeSelector string) *bgp {
+func newBGP(client *packngo.Client, project string, localASN int, bgpPass string, annotationLocalASN, annotationPeerASNs, annotationPeerIPs, annotationSrcIP, annotationBgpPass string, nodeSelector string, privateASNRange, annotationPrivateASN string, passSecret bool, metalNodes *metalNodeManager) *bgp {
 
 	selector := labels.Everything()
 	if nodeSelector != "" {
 		selector, _ = labels.Parse(nodeSelector)
 	}
+	asnRange, _ := ParseASNRange(privateASNRange)
+
+	var sessions packngo.BGPSessionService
+	if client != nil {
+		sessions = client.BGPSessions
+	}
 
 	return &bgp{
 		project:            project,
@@ -52,6 +79,15 @@ func newBGP(client *packngo.Client, project string, localASN int, bgpPass string
 		annotationSrcIP:    annotationSrcIP,
 		annotationBgpPass:  annotationBgpPass,
 		nodeSelector:       selector,
+
+		privateASNRange:      asnRange,
+		annotationPrivateASN: annotationPrivateASN,
+		passSecret:           passSecret,
+		metalNodes:           metalNodes,
+
+		sessions:       sessions,
+		enableFailures: map[string]*bgpEnableFailure{},
+		now:            time.Now,
 	}
 }
 
@@ -60,10 +96,18 @@ func (b *bgp) name() string {
 }
 func (b *bgp) init(k8sclient kubernetes.Interface) error {
 	b.k8sclient = k8sclient
+	b.recorder = newEventRecorder(k8sclient)
+	if b.passSecret {
+		pass, err := ensureBGPPassSecret(context.Background(), k8sclient, b.client.BGPConfig, b.project, b.bgpPass)
+		if err != nil {
+			return fmt.Errorf("failed to get BGP password secret: %w", err)
+		}
+		b.bgpPass = pass
+	}
 	// enable BGP
 	klog.V(2).Info("bgp.init(): enabling BGP on project")
 	if err := b.enableBGP(); err != nil {
-		return fmt.Errorf("failed to enable BGP on project %s: %v", b.project, err)
+		return fmt.Errorf("failed to enable BGP on project %s: %w", b.project, err)
 	}
 	klog.V(2).Info("bgp.init(): BGP enabled")
 	return nil
@@ -93,7 +137,7 @@ func (b *bgp) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateM
 		nodeNames = append(nodeNames, node.Name)
 	}
 	klog.V(2).Infof("bgp.reconcileNodes(): called for nodes %v", nodeNames)
-	// whether adding or syncing, we just enable bgp. Nothing to do when we remove.
+	// whether adding or syncing, we just enable bgp. When removing, we forget failures to enable it.
 	switch mode {
 	case ModeAdd, ModeSync:
 		for _, node := range filteredNodes {
@@ -104,54 +148,29 @@ func (b *bgp) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateM
 				return fmt.Errorf("no provider ID given")
 			}
 			klog.V(2).Infof("bgp.reconcileNodes(): enabling BGP on node %s", node.Name)
-			// ensure BGP is enabled for the node
-			if err := ensureNodeBGPEnabled(id, b.client); err != nil {
-				klog.Errorf("could not ensure BGP enabled for node %s: %v", node.Name, err)
+			// ensure BGP is enabled for the node, retrying failures with backoff
+			if err := b.ensureNodeBGP(ctx, node); err != nil {
+				klog.Errorf("bgp.reconcileNodes(): could not report BGP state of node %s: %v", node.Name, err)
 			}
-			klog.V(2).Infof("bgp.reconcileNodes(): bgp enabled on node %s", node.Name)
 
 			// add annotations for bgp
 			klog.V(2).Infof("bgp.reconcileNodes(): setting annotations on node %s", node.Name)
 			// get the bgp info
-			peer, err := getNodeBGPConfig(id, b.client)
-			if err != nil || peer == nil {
+			neighbours, err := nodeBGPNeighbours(node, b.client, b.metalNodes)
+			if err != nil {
+				klog.Errorf("bgp.reconcileNodes(): could not get BGP info for node %s: %v", node.Name, err)
+			} else if annotations, err := b.bgpAnnotations(neighbours); err != nil {
 				klog.Errorf("bgp.reconcileNodes(): could not get BGP info for node %s: %v", node.Name, err)
 			} else {
-				localASN := strconv.Itoa(peer.CustomerAs)
-				peerASN := strconv.Itoa(peer.PeerAs)
 				newAnnotations := make(map[string]string)
 				oldAnnotations := node.Annotations
 				if oldAnnotations == nil {
 					oldAnnotations = make(map[string]string)
 				}
-				val, ok := oldAnnotations[b.annotationLocalASN]
-				if !ok || val != localASN {
-					newAnnotations[b.annotationLocalASN] = localASN
-				}
-
-				val, ok = oldAnnotations[b.annotationPeerASNs]
-				if !ok || val != peerASN {
-					newAnnotations[b.annotationPeerASNs] = peerASN
-				}
-
-				// we always set the peer IPs as a sorted list, comma-separated
-				pips := peer.PeerIps
-				sort.Strings(pips)
-				peerList := strings.Join(pips, ",")
-				val, ok = oldAnnotations[b.annotationPeerIPs]
-				if !ok || val != peerList {
-					newAnnotations[b.annotationPeerIPs] = peerList
-				}
-
-				val, ok = oldAnnotations[b.annotationSrcIP]
-				if !ok || val != peer.CustomerIP {
-					newAnnotations[b.annotationSrcIP] = peer.CustomerIP
-				}
-
-				val, ok = oldAnnotations[b.annotationBgpPass]
-				newVal := base64.StdEncoding.EncodeToString([]byte(peer.Md5Password))
-				if !ok || val != newVal {
-					newAnnotations[b.annotationBgpPass] = newVal
+				for k, v := range annotations {
+					if val, ok := oldAnnotations[k]; !ok || val != v {
+						newAnnotations[k] = v
+					}
 				}
 
 				// patch the node with the new annotations
@@ -172,8 +191,15 @@ func (b *bgp) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateM
 				}
 			}
 		}
+		if b.privateASNRange != nil {
+			if err := b.reconcileNodeASNs(ctx, nodes, mode); err != nil {
+				klog.Errorf("bgp.reconcileNodes(): failed to allocate private ASNs: %v", err)
+			}
+		}
 	case ModeRemove:
-		klog.V(2).Info("bgp.reconcileNodes(): nothing to do for removing nodes")
+		for _, node := range nodes {
+			b.forgetNodeBGP(node)
+		}
 	}
 	klog.V(2).Info("bgp.reconcileNodes(): complete")
 	return nil
@@ -203,11 +229,11 @@ func (b *bgp) enableBGP() error {
 		UseCase:        "kubernetes-load-balancer",
 	}
 	_, err = b.client.BGPConfig.Create(b.project, req)
-	return err
+	return wrapAPIError(err)
 }
 
 // ensureNodeBGPEnabled check if the node has bgp enabled, and set it if it does not
-func ensureNodeBGPEnabled(id string, client *packngo.Client) error {
+func ensureNodeBGPEnabled(id string, sessions packngo.BGPSessionService) error {
 	// if we are rnning ccm properly, then the provider ID will be on the node object
 	id, err := deviceIDFromProviderID(id)
 	if err != nil {
@@ -217,30 +243,79 @@ func ensureNodeBGPEnabled(id string, client *packngo.Client) error {
 	req := packngo.CreateBGPSessionRequest{
 		AddressFamily: "ipv4",
 	}
-	_, response, err := client.BGPSessions.Create(id, req)
+	_, response, err := sessions.Create(id, req)
 	// if we already had one, then we can ignore the error
-	// this really should be a 409, but 422 is what is returned
-	if response.StatusCode == 422 && strings.Contains(fmt.Sprintf("%s", err), "already has session") {
+	// this really should be a 409, but 422 is what is returned;
+	// there is no response at all if the API could not be reached
+	if response != nil && response.StatusCode == 422 && strings.Contains(fmt.Sprintf("%s", err), "already has session") {
 		err = nil
 	}
-	return err
+	return wrapAPIError(err)
+}
+
+// bgpAnnotations the node annotations for the BGP sessions of a device, from its
+// BGP neighbours. The peers differ per facility, and even per rack, so they are
+// always those the API reports for the device, rather than well-known addresses.
+func (b *bgp) bgpAnnotations(neighbours []packngo.BGPNeighbor) (map[string]string, error) {
+	peer := bgpNeighbour(neighbours, 4)
+	if peer == nil {
+		return nil, errors.New("no matching ipv4 neighbour found")
+	}
+	annotations := map[string]string{
+		b.annotationLocalASN:  strconv.Itoa(peer.CustomerAs),
+		b.annotationPeerASNs:  strconv.Itoa(peer.PeerAs),
+		b.annotationPeerIPs:   sortedPeerIPs(peer.PeerIps),
+		b.annotationSrcIP:     peer.CustomerIP,
+		b.annotationBgpPass:   base64.StdEncoding.EncodeToString([]byte(peer.Md5Password)),
+		annotationBGPMultihop: strconv.FormatBool(peer.Multihop),
+	}
+	// the ipv6 session is optional; publish its peers only if the device has one
+	if peer6 := bgpNeighbour(neighbours, 6); peer6 != nil {
+		annotations[annotationPeerIPsIPv6] = sortedPeerIPs(peer6.PeerIps)
+		annotations[annotationSrcIPIPv6] = peer6.CustomerIP
+	}
+	return annotations, nil
+}
+
+// sortedPeerIPs the peer IPs as a sorted list, comma-separated
+func sortedPeerIPs(ips []string) string {
+	sorted := append([]string{}, ips...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// bgpNeighbour the neighbour for the given address family, nil if there is none
+func bgpNeighbour(neighbours []packngo.BGPNeighbor, addressFamily int) *packngo.BGPNeighbor {
+	for i := range neighbours {
+		if neighbours[i].AddressFamily == addressFamily {
+			return &neighbours[i]
+		}
+	}
+	return nil
 }
 
-// getNodeBGPConfig get the BGP config for a specific node
-func getNodeBGPConfig(providerID string, client *packngo.Client) (peer *packngo.BGPNeighbor, err error) {
+// getNodeBGPNeighbours get the BGP neighbours of a specific node, of all address families
+func getNodeBGPNeighbours(providerID string, client *packngo.Client) ([]packngo.BGPNeighbor, error) {
 	id, err := deviceIDFromProviderID(providerID)
 	if err != nil {
 		return nil, err
 	}
 	neighbours, _, err := client.Devices.ListBGPNeighbors(id, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get device neighbours for device %s: %v", id, err)
+		return nil, fmt.Errorf("failed to get device neighbours for device %s: %w", id, wrapAPIError(err))
+	}
+	return neighbours, nil
+}
+
+// nodeBGPConfig get the ipv4 BGP config for a specific node
+func nodeBGPConfig(node *v1.Node, client *packngo.Client, metalNodes *metalNodeManager) (*packngo.BGPNeighbor, error) {
+	neighbours, err := nodeBGPNeighbours(node, client, metalNodes)
+	if err != nil {
+		return nil, err
 	}
 	// we need the ipv4 neighbour
-	for _, n := range neighbours {
-		if n.AddressFamily == 4 {
-			return &n, nil
-		}
+	if n := bgpNeighbour(neighbours, 4); n != nil {
+		return n, nil
 	}
 	return nil, errors.New("no matching ipv4 neighbour found")
 }
@@ -248,7 +323,7 @@ func getNodeBGPConfig(providerID string, client *packngo.Client) (peer *packngo.
 // patchUpdatedNode apply a patch to the node
 func patchUpdatedNode(ctx context.Context, name string, patch []byte, client kubernetes.Interface) error {
 	if _, err := client.CoreV1().Nodes().Patch(ctx, name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
-		return fmt.Errorf("Failed to patch node %s: %v", name, err)
+		return fmt.Errorf("Failed to patch node %s: %w", name, err)
 	}
 	return nil
 }
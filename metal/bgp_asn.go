@@ -0,0 +1,144 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultAnnotationPrivateASN = "metal.equinix.com/private-asn"
+)
+
+// private ASN ranges, per RFC 6996
+var privateASNRanges = []ASNRange{
+	{First: 64512, Last: 65534},
+	{First: 4200000000, Last: 4294967294},
+}
+
+// ASNRange an inclusive range of ASNs from which to allocate a private ASN for each node
+type ASNRange struct {
+	First uint32
+	Last  uint32
+}
+
+// ParseASNRange parse a range of the form <first>-<last>, which must lie
+// entirely within one of the private ASN ranges. An empty range returns nil,
+// meaning that per-node ASNs are disabled.
+func ParseASNRange(s string) (*ASNRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid ASN range %q: must be of the form <first>-<last>", s)
+	}
+	first, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASN range %q: %w", s, err)
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASN range %q: %w", s, err)
+	}
+	r := ASNRange{First: uint32(first), Last: uint32(last)}
+	if r.First > r.Last {
+		return nil, fmt.Errorf("invalid ASN range %q: first is greater than last", s)
+	}
+	for _, p := range privateASNRanges {
+		if p.contains(r.First) && p.contains(r.Last) {
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid ASN range %q: must be within a private ASN range, %d-%d or %d-%d", s, privateASNRanges[0].First, privateASNRanges[0].Last, privateASNRanges[1].First, privateASNRanges[1].Last)
+}
+
+func (r ASNRange) contains(asn uint32) bool {
+	return asn >= r.First && asn <= r.Last
+}
+
+func (r ASNRange) String() string {
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// allocateNodeASNs determine the private ASN of each selected node. A node keeps the
+// ASN in its annotation if it is in the range and no other node has it; if two nodes
+// have the same one, the one whose name sorts first keeps it. Every other selected node
+// gets the lowest free ASN in the range, in order of node name, so that allocation is
+// deterministic. Returns only the new allocations, by node name.
+func allocateNodeASNs(nodes []*v1.Node, selected func(*v1.Node) bool, annotation string, r ASNRange) (map[string]uint32, error) {
+	sorted := make([]*v1.Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	used := map[uint32]bool{}
+	pending := []string{}
+	for _, node := range sorted {
+		asn, err := strconv.ParseUint(node.Annotations[annotation], 10, 32)
+		valid := err == nil && r.contains(uint32(asn)) && !used[uint32(asn)]
+		if valid {
+			used[uint32(asn)] = true
+			continue
+		}
+		if selected(node) {
+			pending = append(pending, node.Name)
+		}
+	}
+
+	allocated := map[string]uint32{}
+	next := r.First
+	for _, name := range pending {
+		for used[next] {
+			if next == r.Last {
+				return allocated, fmt.Errorf("ASN range %s exhausted, cannot allocate for node %s", r, name)
+			}
+			next++
+		}
+		used[next] = true
+		allocated[name] = next
+	}
+	return allocated, nil
+}
+
+// reconcileNodeASNs allocate a private ASN for each BGP node without one, and record it as a node annotation
+func (b *bgp) reconcileNodeASNs(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+	b.asnLock.Lock()
+	defer b.asnLock.Unlock()
+
+	// uniqueness is across the cluster, so for single node updates, get all of them
+	if mode != ModeSync {
+		nodeList, err := b.k8sclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to list nodes to allocate ASNs: %w", err)
+		}
+		nodes = []*v1.Node{}
+		for i := range nodeList.Items {
+			nodes = append(nodes, &nodeList.Items[i])
+		}
+	}
+	selected := func(node *v1.Node) bool {
+		return b.nodeSelector.Matches(labels.Set(node.Labels))
+	}
+	allocated, err := allocateNodeASNs(nodes, selected, b.annotationPrivateASN, *b.privateASNRange)
+	for name, asn := range allocated {
+		mergePatch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{b.annotationPrivateASN: strconv.FormatUint(uint64(asn), 10)},
+			},
+		})
+		if err := patchUpdatedNode(ctx, name, mergePatch, b.k8sclient); err != nil {
+			klog.Errorf("bgp.reconcileNodeASNs(): failed to save private ASN %d on node %s: %v", asn, name, err)
+			continue
+		}
+		klog.Infof("allocated private ASN %d to node %s", asn, name)
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package metal
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseASNRange(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected *ASNRange
+		err      bool
+	}{
+		{"", nil, false},
+		{"64512-64600", &ASNRange{First: 64512, Last: 64600}, false},
+		{"4200000000-4200000099", &ASNRange{First: 4200000000, Last: 4200000099}, false},
+		{"65000-65000", &ASNRange{First: 65000, Last: 65000}, false},
+		{"64600-64512", nil, true},
+		{"65000-4200000000", nil, true},
+		{"100-200", nil, true},
+		{"65000", nil, true},
+		{"a-b", nil, true},
+	}
+	for i, tt := range tests {
+		r, err := ParseASNRange(tt.s)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched errors for %q, actual %v expected error %v", i, tt.s, err, tt.err)
+		case !reflect.DeepEqual(r, tt.expected):
+			t.Errorf("%d: mismatched range for %q, actual %v expected %v", i, tt.s, r, tt.expected)
+		}
+	}
+}
+
+func TestAllocateNodeASNs(t *testing.T) {
+	node := func(name, asn string) *v1.Node {
+		n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}}}
+		if asn != "" {
+			n.Annotations[DefaultAnnotationPrivateASN] = asn
+		}
+		return n
+	}
+	all := func(*v1.Node) bool { return true }
+	r := ASNRange{First: 65000, Last: 65002}
+	tests := []struct {
+		nodes    []*v1.Node
+		expected map[string]uint32
+		err      bool
+	}{
+		// deterministic, by name
+		{[]*v1.Node{node("c", ""), node("a", ""), node("b", "")}, map[string]uint32{"a": 65000, "b": 65001, "c": 65002}, false},
+		// existing kept, gaps filled
+		{[]*v1.Node{node("a", "65001"), node("b", "")}, map[string]uint32{"b": 65000}, false},
+		// duplicates: first by name keeps it
+		{[]*v1.Node{node("b", "65000"), node("a", "65000")}, map[string]uint32{"b": 65001}, false},
+		// out of range or invalid reallocated
+		{[]*v1.Node{node("a", "64999"), node("b", "foo")}, map[string]uint32{"a": 65000, "b": 65001}, false},
+		// exhausted
+		{[]*v1.Node{node("a", ""), node("b", ""), node("c", ""), node("d", "")}, map[string]uint32{"a": 65000, "b": 65001, "c": 65002}, true},
+	}
+	for i, tt := range tests {
+		allocated, err := allocateNodeASNs(tt.nodes, all, DefaultAnnotationPrivateASN, r)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched errors, actual %v expected error %v", i, err, tt.err)
+		case !reflect.DeepEqual(allocated, tt.expected):
+			t.Errorf("%d: mismatched allocation, actual %v expected %v", i, allocated, tt.expected)
+		}
+	}
+
+	// unselected nodes keep their ASN reserved, but get none allocated
+	selected := func(n *v1.Node) bool { return n.Name != "b" }
+	allocated, _ := allocateNodeASNs([]*v1.Node{node("a", ""), node("b", ""), node("c", "65000")}, selected, DefaultAnnotationPrivateASN, r)
+	if !reflect.DeepEqual(allocated, map[string]uint32{"a": 65001}) {
+		t.Errorf("mismatched allocation with selector, actual %v expected map[a:65001]", allocated)
+	}
+}
@@ -0,0 +1,91 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodeConditionBGPEnabled whether BGP is enabled on the device of a node; without it, the node
+	// cannot announce load balancer IPs, so they are not reachable through it
+	nodeConditionBGPEnabled v1.NodeConditionType = "metal.equinix.com/BGPEnabled"
+
+	bgpEnabledReason      = "SessionEnabled"
+	bgpEnableFailedReason = "EnableFailed"
+
+	eventReasonBGPEnableFailed = "BGPEnableFailed"
+
+	// bgpEnableRetryMin, bgpEnableRetryMax how long to wait before enabling BGP on a device again,
+	// after the first and after many failures
+	bgpEnableRetryMin = time.Minute
+	bgpEnableRetryMax = 30 * time.Minute
+)
+
+// bgpEnableFailure the failures so far to enable BGP on the device of a node
+type bgpEnableFailure struct {
+	count   int
+	retryAt time.Time
+}
+
+// bgpEnableBackoff how long to wait after the given number of failures in a row
+func bgpEnableBackoff(failures int) time.Duration {
+	backoff := bgpEnableRetryMin
+	for i := 1; i < failures && backoff < bgpEnableRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > bgpEnableRetryMax {
+		backoff = bgpEnableRetryMax
+	}
+	return backoff
+}
+
+// ensureNodeBGP enable BGP on the device of the node, and report the outcome in the BGPEnabled
+// condition of the node. After a failure, e.g. because BGP is not configured on the project,
+// it is retried with exponential backoff, and each failure is recorded as an event on the node.
+func (b *bgp) ensureNodeBGP(ctx context.Context, node *v1.Node) error {
+	now := b.now()
+	b.enableLock.Lock()
+	failure := b.enableFailures[node.Name]
+	b.enableLock.Unlock()
+	if failure != nil && now.Before(failure.retryAt) {
+		klog.V(2).Infof("bgp.reconcileNodes(): not enabling BGP on node %s again until %s", node.Name, failure.retryAt.Format(time.RFC3339))
+		return nil
+	}
+
+	err := ensureNodeBGPEnabled(node.Spec.ProviderID, b.sessions)
+	b.enableLock.Lock()
+	if err == nil {
+		delete(b.enableFailures, node.Name)
+	} else {
+		if failure == nil {
+			failure = &bgpEnableFailure{}
+			b.enableFailures[node.Name] = failure
+		}
+		failure.count++
+		failure.retryAt = now.Add(bgpEnableBackoff(failure.count))
+	}
+	b.enableLock.Unlock()
+
+	if err == nil {
+		_, err := setNodeCondition(ctx, b.k8sclient, node, nodeConditionBGPEnabled, v1.ConditionTrue, bgpEnabledReason, "BGP session enabled on the device")
+		return err
+	}
+	message := fmt.Sprintf("unable to enable BGP on the device, %d failures in a row, retrying at %s: %v", failure.count, failure.retryAt.UTC().Format(time.RFC3339), err)
+	klog.Errorf("could not ensure BGP enabled for node %s: %s", node.Name, message)
+	b.recorder.Event(node, v1.EventTypeWarning, eventReasonBGPEnableFailed, message)
+	if _, err := setNodeCondition(ctx, b.k8sclient, node, nodeConditionBGPEnabled, v1.ConditionFalse, bgpEnableFailedReason, message); err != nil {
+		return err
+	}
+	return nil
+}
+
+// forgetNodeBGP forget the failures to enable BGP on the device of a removed node
+func (b *bgp) forgetNodeBGP(node *v1.Node) {
+	b.enableLock.Lock()
+	defer b.enableLock.Unlock()
+	delete(b.enableFailures, node.Name)
+}
@@ -0,0 +1,171 @@
+package metal
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// bgpPassSecretName the secret in which the CCM keeps the project BGP password,
+	// when asked to manage it
+	bgpPassSecretName      = "cloud-provider-equinix-metal-bgp"
+	bgpPassSecretNamespace = "kube-system"
+	// bgpPassSecretKey the key in the secret with the password
+	bgpPassSecretKey = "password"
+	// generatedBGPPassLength the length of a password generated when none is configured
+	generatedBGPPassLength = 24
+	generatedBGPPassChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	eventReasonBGPPasswordMismatch = "BGPPasswordMismatch"
+)
+
+// ensureBGPPassSecret get the project BGP password from the secret, creating the
+// secret if it does not exist. A new secret gets the configured password if
+// there is one, else the password of the project, if BGP is already enabled on
+// it, else a generated one. The password is never logged.
+func ensureBGPPassSecret(ctx context.Context, k8sclient kubernetes.Interface, configs packngo.BGPConfigService, project, configured string) (string, error) {
+	secrets := k8sclient.CoreV1().Secrets(bgpPassSecretNamespace)
+	secret, err := secrets.Get(ctx, bgpPassSecretName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		if pass := string(secret.Data[bgpPassSecretKey]); pass != "" {
+			if configured != "" && configured != pass {
+				klog.Warningf("BGP password in secret %s/%s differs from the configured one, using the one in the secret", bgpPassSecretNamespace, bgpPassSecretName)
+			}
+			return pass, nil
+		}
+	case apierrors.IsNotFound(err):
+		secret = nil
+	default:
+		return "", fmt.Errorf("unable to get secret %s/%s: %w", bgpPassSecretNamespace, bgpPassSecretName, err)
+	}
+
+	pass, source, err := initialBGPPass(configs, project, configured)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      bgpPassSecretName,
+				Namespace: bgpPassSecretNamespace,
+			},
+			Type: v1.SecretTypeOpaque,
+			Data: map[string][]byte{bgpPassSecretKey: []byte(pass)},
+		}
+		if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return "", fmt.Errorf("unable to create secret %s/%s: %w", bgpPassSecretNamespace, bgpPassSecretName, err)
+		}
+	} else {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[bgpPassSecretKey] = []byte(pass)
+		if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return "", fmt.Errorf("unable to update secret %s/%s: %w", bgpPassSecretNamespace, bgpPassSecretName, err)
+		}
+	}
+	klog.Infof("saved BGP password from %s in secret %s/%s", source, bgpPassSecretNamespace, bgpPassSecretName)
+	return pass, nil
+}
+
+// initialBGPPass the password with which to start the secret, and where it came from
+func initialBGPPass(configs packngo.BGPConfigService, project, configured string) (string, string, error) {
+	if configured != "" {
+		return configured, "configuration", nil
+	}
+	if md5 := projectBGPPass(configs, project); md5 != "" {
+		return md5, "project", nil
+	}
+	pass, err := generateBGPPass()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to generate BGP password: %w", err)
+	}
+	return pass, "generator", nil
+}
+
+// projectBGPPass the BGP password of the project, empty if BGP is not enabled on it
+// or it cannot be read
+func projectBGPPass(configs packngo.BGPConfigService, project string) string {
+	config, _, err := configs.Get(project, &packngo.GetOptions{})
+	if err != nil || config == nil || config.ID == "" {
+		return ""
+	}
+	return config.Md5
+}
+
+// generateBGPPass a random password, of characters that any BGP speaker accepts
+func generateBGPPass() (string, error) {
+	max := big.NewInt(int64(len(generatedBGPPassChars)))
+	b := make([]byte, generatedBGPPassLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = generatedBGPPassChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// checkBGPPassSecret compare the password in the secret with the one of the project,
+// and record an event on the secret if they differ. The Equinix Metal API cannot
+// change the password of a project, so the peers keep using the one of the project,
+// which they get from the BGP neighbours of each device, until it is changed.
+func checkBGPPassSecret(recorder record.EventRecorder, configs packngo.BGPConfigService, project string, secret *v1.Secret) bool {
+	pass := string(secret.Data[bgpPassSecretKey])
+	md5 := projectBGPPass(configs, project)
+	if pass == "" || md5 == "" || pass == md5 {
+		return true
+	}
+	klog.Warningf("BGP password in secret %s/%s differs from the one of project %s", bgpPassSecretNamespace, bgpPassSecretName, project)
+	recorder.Eventf(secret, v1.EventTypeWarning, eventReasonBGPPasswordMismatch,
+		"BGP password differs from the one of project %s, which cannot be changed through the API; BGP peers keep using the project password until it is changed", project)
+	return false
+}
+
+// watch check the BGP password secret whenever it changes
+func (b *bgp) watch(ctx context.Context) error {
+	if !b.passSecret {
+		return nil
+	}
+	informer := informers.NewSharedInformerFactoryWithOptions(b.k8sclient, 0,
+		informers.WithNamespace(bgpPassSecretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", bgpPassSecretName).String()
+		}),
+	)
+	check := func(obj interface{}) {
+		secret, ok := obj.(*v1.Secret)
+		if !ok {
+			return
+		}
+		checkBGPPassSecret(b.recorder, b.client.BGPConfig, b.project, secret)
+	}
+	secretsInformer := informer.Core().V1().Secrets().Informer()
+	secretsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: check,
+		UpdateFunc: func(_, obj interface{}) {
+			check(obj)
+		},
+	})
+	informer.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), secretsInformer.HasSynced) {
+		return fmt.Errorf("syncing caches failed")
+	}
+	klog.Info("bgp password secret watcher started")
+	return nil
+}
@@ -0,0 +1,86 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func testBGPPassSecret(data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: bgpPassSecretName, Namespace: bgpPassSecretNamespace},
+		Data:       data,
+	}
+}
+
+func TestEnsureBGPPassSecret(t *testing.T) {
+	enabled := &packngo.BGPConfig{ID: "bgp", Md5: "project"}
+	tests := []struct {
+		secret     *v1.Secret
+		config     *packngo.BGPConfig
+		configured string
+		expected   string
+	}{
+		{testBGPPassSecret(map[string][]byte{bgpPassSecretKey: []byte("secret")}), enabled, "configured", "secret"},
+		{nil, enabled, "configured", "configured"},
+		{nil, enabled, "", "project"},
+		{testBGPPassSecret(nil), enabled, "", "project"},
+		{nil, &packngo.BGPConfig{}, "", ""},
+	}
+	for i, tt := range tests {
+		objs := []runtime.Object{}
+		if tt.secret != nil {
+			objs = append(objs, tt.secret)
+		}
+		client := fake.NewSimpleClientset(objs...)
+		pass, err := ensureBGPPassSecret(context.Background(), client, testCheckBGPConfig{config: tt.config}, "project", tt.configured)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		switch {
+		case tt.expected == "" && len(pass) != generatedBGPPassLength:
+			t.Errorf("%d: mismatched generated password length, actual %d expected %d", i, len(pass), generatedBGPPassLength)
+		case tt.expected != "" && pass != tt.expected:
+			t.Errorf("%d: mismatched password, actual %s expected %s", i, pass, tt.expected)
+		}
+		secret, err := client.CoreV1().Secrets(bgpPassSecretNamespace).Get(context.Background(), bgpPassSecretName, metav1.GetOptions{})
+		if err != nil {
+			t.Errorf("%d: unable to get secret: %v", i, err)
+			continue
+		}
+		if saved := string(secret.Data[bgpPassSecretKey]); saved != pass {
+			t.Errorf("%d: mismatched saved password, actual %s expected %s", i, saved, pass)
+		}
+	}
+}
+
+func TestCheckBGPPassSecret(t *testing.T) {
+	tests := []struct {
+		pass   string
+		config *packngo.BGPConfig
+		match  bool
+	}{
+		{"same", &packngo.BGPConfig{ID: "bgp", Md5: "same"}, true},
+		{"rotated", &packngo.BGPConfig{ID: "bgp", Md5: "same"}, false},
+		{"rotated", &packngo.BGPConfig{}, true},
+		{"", &packngo.BGPConfig{ID: "bgp", Md5: "same"}, true},
+	}
+	for i, tt := range tests {
+		recorder := record.NewFakeRecorder(1)
+		secret := testBGPPassSecret(map[string][]byte{bgpPassSecretKey: []byte(tt.pass)})
+		match := checkBGPPassSecret(recorder, testCheckBGPConfig{config: tt.config}, "project", secret)
+		if match != tt.match {
+			t.Errorf("%d: mismatched match, actual %t expected %t", i, match, tt.match)
+		}
+		if recorded := len(recorder.Events) > 0; recorded == tt.match {
+			t.Errorf("%d: mismatched event, recorded %t, expected match %t", i, recorded, tt.match)
+		}
+	}
+}
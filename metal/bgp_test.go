@@ -0,0 +1,163 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBGPAnnotations(t *testing.T) {
+	b := newBGP(nil, "project", DefaultLocalASN, "", DefaultAnnotationNodeASN, DefaultAnnotationPeerASNs, DefaultAnnotationPeerIPs, DefaultAnnotationSrcIP, DefaultAnnotationBGPPass, "", "", "", false, nil)
+	ipv4 := packngo.BGPNeighbor{AddressFamily: 4, CustomerAs: 65000, CustomerIP: "10.0.0.2", PeerAs: 65530, PeerIps: []string{"169.254.255.2", "169.254.255.1"}, Multihop: true, Md5Password: "pass"}
+	ipv6 := packngo.BGPNeighbor{AddressFamily: 6, CustomerAs: 65000, CustomerIP: "2604:1380::2", PeerAs: 65530, PeerIps: []string{"fc00::e", "fc00::f"}}
+	tests := []struct {
+		neighbours []packngo.BGPNeighbor
+		expected   map[string]string
+		err        bool
+	}{
+		{nil, nil, true},
+		{[]packngo.BGPNeighbor{ipv6}, nil, true},
+		{[]packngo.BGPNeighbor{ipv4}, map[string]string{
+			DefaultAnnotationNodeASN:  "65000",
+			DefaultAnnotationPeerASNs: "65530",
+			DefaultAnnotationPeerIPs:  "169.254.255.1,169.254.255.2",
+			DefaultAnnotationSrcIP:    "10.0.0.2",
+			DefaultAnnotationBGPPass:  "cGFzcw==",
+			annotationBGPMultihop:     "true",
+		}, false},
+		{[]packngo.BGPNeighbor{ipv6, ipv4}, map[string]string{
+			DefaultAnnotationNodeASN:  "65000",
+			DefaultAnnotationPeerASNs: "65530",
+			DefaultAnnotationPeerIPs:  "169.254.255.1,169.254.255.2",
+			DefaultAnnotationSrcIP:    "10.0.0.2",
+			DefaultAnnotationBGPPass:  "cGFzcw==",
+			annotationBGPMultihop:     "true",
+			annotationPeerIPsIPv6:     "fc00::e,fc00::f",
+			annotationSrcIPIPv6:       "2604:1380::2",
+		}, false},
+	}
+	for i, tt := range tests {
+		annotations, err := b.bgpAnnotations(tt.neighbours)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error", i)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case len(annotations) != len(tt.expected):
+			t.Errorf("%d: mismatched annotations, actual %v expected %v", i, annotations, tt.expected)
+		default:
+			for k, v := range tt.expected {
+				if annotations[k] != v {
+					t.Errorf("%d: mismatched annotation %s, actual %s expected %s", i, k, annotations[k], v)
+				}
+			}
+		}
+	}
+}
+
+// testBGPSessions a BGP session service that fails to create sessions while err is set
+type testBGPSessions struct {
+	err     error
+	creates int
+}
+
+func (s *testBGPSessions) Get(string, *packngo.GetOptions) (*packngo.BGPSession, *packngo.Response, error) {
+	return nil, nil, errors.New("not implemented")
+}
+
+func (s *testBGPSessions) Create(string, packngo.CreateBGPSessionRequest) (*packngo.BGPSession, *packngo.Response, error) {
+	s.creates++
+	if s.err != nil {
+		return nil, &packngo.Response{Response: &http.Response{StatusCode: http.StatusUnprocessableEntity}}, s.err
+	}
+	return &packngo.BGPSession{}, &packngo.Response{Response: &http.Response{StatusCode: http.StatusCreated}}, nil
+}
+
+func (s *testBGPSessions) Delete(string) (*packngo.Response, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestEnsureNodeBGPRetries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	sessions := &testBGPSessions{err: errors.New("project BGP not configured")}
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://1234"},
+	}
+	client := fake.NewSimpleClientset(node)
+
+	b := newBGP(nil, "project", DefaultLocalASN, "", DefaultAnnotationNodeASN, DefaultAnnotationPeerASNs, DefaultAnnotationPeerIPs, DefaultAnnotationSrcIP, DefaultAnnotationBGPPass, "", "", "", false, nil)
+	b.sessions = sessions
+	b.now = func() time.Time { return now }
+	b.k8sclient = client
+	b.recorder = newEventRecorder(client)
+
+	tests := []struct {
+		advance time.Duration
+		fail    bool
+		creates int
+		status  v1.ConditionStatus
+		reason  string
+	}{
+		{0, true, 1, v1.ConditionFalse, bgpEnableFailedReason},
+		// within the backoff, not retried
+		{30 * time.Second, true, 1, v1.ConditionFalse, bgpEnableFailedReason},
+		{time.Minute, true, 2, v1.ConditionFalse, bgpEnableFailedReason},
+		// backoff doubled to 2m
+		{time.Minute, true, 2, v1.ConditionFalse, bgpEnableFailedReason},
+		{time.Minute, false, 3, v1.ConditionTrue, bgpEnabledReason},
+		// enabled, so checked again on each sync
+		{0, false, 4, v1.ConditionTrue, bgpEnabledReason},
+	}
+
+	for i, tt := range tests {
+		now = now.Add(tt.advance)
+		if !tt.fail {
+			sessions.err = nil
+		}
+		if err := b.ensureNodeBGP(ctx, node); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if sessions.creates != tt.creates {
+			t.Errorf("%d: mismatched session creates, actual %d expected %d", i, sessions.creates, tt.creates)
+		}
+		updated, err := client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: unable to get node: %v", i, err)
+		}
+		condition := nodeCondition(updated, nodeConditionBGPEnabled)
+		if condition == nil || condition.Status != tt.status || condition.Reason != tt.reason {
+			t.Errorf("%d: mismatched condition, actual %v expected status %s reason %s", i, condition, tt.status, tt.reason)
+		}
+		node = updated
+	}
+	if len(b.enableFailures) != 0 {
+		t.Errorf("mismatched remembered failures, actual %d expected 0", len(b.enableFailures))
+	}
+}
+
+func TestBGPEnableBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		backoff  time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, bgpEnableRetryMax},
+		{100, bgpEnableRetryMax},
+	}
+	for i, tt := range tests {
+		if backoff := bgpEnableBackoff(tt.failures); backoff != tt.backoff {
+			t.Errorf("%d: mismatched backoff, actual %s expected %s", i, backoff, tt.backoff)
+		}
+	}
+}
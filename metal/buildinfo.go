@@ -0,0 +1,64 @@
+package metal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"k8s.io/component-base/configz"
+)
+
+const (
+	// buildInfoConfigzName the name under which the build info is served on /configz
+	buildInfoConfigzName = "equinix-metal"
+	// configHashLength how many hex characters of the config hash to report
+	configHashLength = 16
+)
+
+// buildInfo what is running: which build of the CCM, and with which configuration
+type buildInfo struct {
+	Version    string `json:"version"`
+	GitCommit  string `json:"gitCommit"`
+	GoVersion  string `json:"goVersion"`
+	ConfigHash string `json:"configHash"`
+}
+
+// newBuildInfo get the build info for this binary running with the given config
+func newBuildInfo(config Config) buildInfo {
+	return buildInfo{
+		Version:    VERSION,
+		GitCommit:  GitCommit,
+		GoVersion:  runtime.Version(),
+		ConfigHash: configHash(config),
+	}
+}
+
+// configHash a short hash of the effective config, so that the configs running in
+// different clusters can be compared. It hashes the same masked output that is
+// logged at startup, so secrets do not change it and cannot be recovered from it.
+func configHash(config Config) string {
+	sum := sha256.Sum256([]byte(strings.Join(config.Strings(), "\n")))
+	return hex.EncodeToString(sum[:])[:configHashLength]
+}
+
+// buildInfoConfigz the build info on the /configz endpoint, once first published
+var buildInfoConfigz *configz.Config
+
+// publishBuildInfo report the build info as the build info metric, and on the
+// /configz endpoint of the controller manager, replacing any published before
+func publishBuildInfo(config Config) error {
+	info := newBuildInfo(config)
+	buildInfoMetric.Reset()
+	buildInfoMetric.WithLabelValues(info.Version, info.GitCommit, info.GoVersion, info.ConfigHash).Set(1)
+	if buildInfoConfigz == nil {
+		cz, err := configz.New(buildInfoConfigzName)
+		if err != nil {
+			return fmt.Errorf("unable to register build info: %w", err)
+		}
+		buildInfoConfigz = cz
+	}
+	buildInfoConfigz.Set(info)
+	return nil
+}
@@ -0,0 +1,29 @@
+package metal
+
+import (
+	"testing"
+)
+
+func TestConfigHash(t *testing.T) {
+	base := Config{AuthToken: "token", ProjectID: "project", Facility: "ewr1", BGPPass: "secret"}
+	tests := []struct {
+		config Config
+		same   bool
+	}{
+		{base, true},
+		{Config{AuthToken: "other", ProjectID: "project", Facility: "ewr1", BGPPass: "secret"}, true},
+		{Config{AuthToken: "token", ProjectID: "project", Facility: "ewr1", BGPPass: "other"}, true},
+		{Config{AuthToken: "token", ProjectID: "project", Facility: "sjc1", BGPPass: "secret"}, false},
+		{Config{AuthToken: "token", ProjectID: "project", Facility: "ewr1", BGPPass: "secret", LBExcludeControlPlane: true}, false},
+	}
+	expected := configHash(base)
+	if len(expected) != configHashLength {
+		t.Fatalf("mismatched hash length, actual %d expected %d", len(expected), configHashLength)
+	}
+	for i, tt := range tests {
+		actual := configHash(tt.config)
+		if (actual == expected) != tt.same {
+			t.Errorf("%d: mismatched hash, actual %s base %s, expected same %t", i, actual, expected, tt.same)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/packethost/packngo"
+)
+
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// checkResult the outcome of one check of a Check run
+type checkResult struct {
+	name   string
+	status string
+	detail string
+}
+
+// checker read-only validation of a configuration against the Equinix Metal API,
+// before the CCM is deployed with it; it never creates or changes anything
+type checker struct {
+	config     Config
+	projects   packngo.ProjectService
+	apiKeys    packngo.APIKeyService
+	facilities packngo.FacilityService
+	ips        packngo.ProjectIPService
+	bgpConfig  packngo.BGPConfigService
+}
+
+// Check validate the configuration against the Equinix Metal API without changing anything:
+// project access, the scope of the token, the facility, the control plane elastic IP tag and
+// the BGP state of the project. It writes a report to out, and returns an error if any check failed.
+func Check(config Config, out io.Writer) error {
+	if config.AuthTokenSource != "" {
+		token, err := loadAuthToken(context.Background(), config)
+		if err != nil {
+			return err
+		}
+		config.AuthToken = token
+	}
+	client := packngo.NewClientWithAuth("", config.AuthToken, nil)
+	client.UserAgent = fmt.Sprintf("cloud-provider-equinix-metal/%s %s", VERSION, client.UserAgent)
+	c := checker{
+		config:     config,
+		projects:   client.Projects,
+		apiKeys:    client.APIKeys,
+		facilities: client.Facilities,
+		ips:        client.ProjectIPs,
+		bgpConfig:  client.BGPConfig,
+	}
+	return c.run(out)
+}
+
+// run all checks, write the report, and return an error if any failed
+func (c checker) run(out io.Writer) error {
+	results := []checkResult{
+		c.checkProject(),
+		c.checkToken(),
+		c.checkFacility(),
+		c.checkEIP(),
+		c.checkBGP(),
+	}
+	var failed []string
+	for _, r := range results {
+		fmt.Fprintf(out, "%-4s %-24s %s\n", r.status, r.name, r.detail)
+		if r.status == checkFail {
+			failed = append(failed, r.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed checks: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (c checker) checkProject() checkResult {
+	r := checkResult{name: "project access"}
+	project, _, err := c.projects.Get(c.config.ProjectID, nil)
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("unable to get project %s: %v", c.config.ProjectID, wrapAPIError(err))
+		return r
+	}
+	r.status, r.detail = checkOK, fmt.Sprintf("project %s (%s)", project.Name, project.ID)
+	return r
+}
+
+// checkToken find the API key of the token among those of the project and the user,
+// to tell whether it is read-only, which the CCM cannot work with
+func (c checker) checkToken() checkResult {
+	r := checkResult{name: "token scope"}
+	projectKeys, _, projectErr := c.apiKeys.ProjectList(c.config.ProjectID, nil)
+	userKeys, _, userErr := c.apiKeys.UserList(nil)
+	for _, key := range append(projectKeys, userKeys...) {
+		if key.Token != c.config.AuthToken {
+			continue
+		}
+		scope := "user"
+		if key.Project != nil {
+			scope = "project"
+		}
+		if key.ReadOnly {
+			r.status, r.detail = checkFail, fmt.Sprintf("%s token is read-only, the CCM needs to reserve IPs and enable BGP", scope)
+			return r
+		}
+		r.status, r.detail = checkOK, fmt.Sprintf("%s token with read-write access", scope)
+		return r
+	}
+	r.status = checkWarn
+	switch {
+	case projectErr != nil && userErr != nil:
+		r.detail = fmt.Sprintf("unable to list API keys, scope unknown: %v", wrapAPIError(projectErr))
+	default:
+		r.detail = "token not found among the API keys of the project or user, scope unknown"
+	}
+	return r
+}
+
+func (c checker) checkFacility() checkResult {
+	r := checkResult{name: "facility"}
+	if c.config.Facility == "" {
+		r.status, r.detail = checkWarn, "no facility set, it is taken from the first device the CCM sees"
+		return r
+	}
+	facilities, _, err := c.facilities.List(nil)
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("unable to list facilities: %v", wrapAPIError(err))
+		return r
+	}
+	wanted := []string{c.config.Facility}
+	known := map[string]bool{}
+	for _, f := range facilities {
+		known[f.Code] = true
+	}
+	var unknown []string
+	for _, code := range wanted {
+		if !known[code] {
+			unknown = append(unknown, code)
+		}
+	}
+	if len(unknown) > 0 {
+		r.status, r.detail = checkFail, fmt.Sprintf("unknown facilities %s", strings.Join(unknown, ", "))
+		return r
+	}
+	r.status, r.detail = checkOK, strings.Join(wanted, ", ")
+	return r
+}
+
+func (c checker) checkEIP() checkResult {
+	r := checkResult{name: "control plane elastic ip"}
+	if c.config.EIPTag == "" {
+		r.status, r.detail = checkOK, "no tag set, not managed"
+		return r
+	}
+	ips, _, err := c.ips.List(c.config.ProjectID, &packngo.ListOptions{Includes: []string{"assignments"}})
+	if err != nil {
+		r.status, r.detail = checkFail, fmt.Sprintf("unable to list IP reservations: %v", wrapAPIError(err))
+		return r
+	}
+	matches := ipReservationsByAllTags([]string{c.config.EIPTag}, ips)
+	switch {
+	case len(matches) == 0:
+		r.status, r.detail = checkFail, fmt.Sprintf("%v with tag %s", ErrEIPNotFound, c.config.EIPTag)
+	case len(matches) > 1:
+		r.status, r.detail = checkFail, fmt.Sprintf("%d IP reservations with tag %s, expected exactly one", len(matches), c.config.EIPTag)
+	case len(matches[0].Assignments) > 1:
+		r.status, r.detail = checkFail, fmt.Sprintf("%s is assigned to %d devices, expected at most one", matches[0].Address, len(matches[0].Assignments))
+	case len(matches[0].Assignments) == 0:
+		r.status, r.detail = checkOK, fmt.Sprintf("%s, not yet assigned", matches[0].Address)
+	default:
+		r.status, r.detail = checkOK, fmt.Sprintf("%s, assigned to device %s", matches[0].Address, assignedDeviceID(matches[0]))
+	}
+	return r
+}
+
+func (c checker) checkBGP() checkResult {
+	r := checkResult{name: "bgp"}
+	config, _, err := c.bgpConfig.Get(c.config.ProjectID, nil)
+	switch {
+	case err != nil:
+		r.status, r.detail = checkFail, fmt.Sprintf("unable to get BGP config: %v", wrapAPIError(err))
+	// the API answers 200 without a config when BGP is not enabled, see enableBGP
+	case config == nil || config.ID == "" || strings.ToLower(config.Status) == "disabled":
+		r.status, r.detail = checkWarn, "not enabled on the project, the CCM enables it"
+	default:
+		r.status, r.detail = checkOK, fmt.Sprintf("%s, %s, ASN %d", config.Status, config.DeploymentType, config.Asn)
+	}
+	return r
+}
@@ -0,0 +1,98 @@
+package metal
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+)
+
+type testCheckProjects struct {
+	packngo.ProjectService
+	err error
+}
+
+func (s testCheckProjects) Get(projectID string, opts *packngo.GetOptions) (*packngo.Project, *packngo.Response, error) {
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	return &packngo.Project{ID: projectID, Name: "test"}, nil, nil
+}
+
+type testCheckAPIKeys struct {
+	packngo.APIKeyService
+	project, user []packngo.APIKey
+}
+
+func (s testCheckAPIKeys) ProjectList(projectID string, opts *packngo.ListOptions) ([]packngo.APIKey, *packngo.Response, error) {
+	return s.project, nil, nil
+}
+
+func (s testCheckAPIKeys) UserList(opts *packngo.ListOptions) ([]packngo.APIKey, *packngo.Response, error) {
+	return s.user, nil, nil
+}
+
+type testCheckFacilities struct {
+	packngo.FacilityService
+}
+
+func (s testCheckFacilities) List(opts *packngo.ListOptions) ([]packngo.Facility, *packngo.Response, error) {
+	return []packngo.Facility{{Code: "ewr1"}, {Code: "ny5"}}, nil, nil
+}
+
+type testCheckBGPConfig struct {
+	packngo.BGPConfigService
+	config *packngo.BGPConfig
+}
+
+func (s testCheckBGPConfig) Get(projectID string, opts *packngo.GetOptions) (*packngo.BGPConfig, *packngo.Response, error) {
+	return s.config, nil, nil
+}
+
+func TestCheck(t *testing.T) {
+	eip := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}}}
+	healthy := func() checker {
+		return checker{
+			config:     Config{AuthToken: "token", ProjectID: "project", Facility: "ewr1", FallbackMetros: []string{"ny"}, EIPTag: "eiptag"},
+			projects:   testCheckProjects{},
+			apiKeys:    testCheckAPIKeys{user: []packngo.APIKey{{Token: "other"}, {Token: "token"}}},
+			facilities: testCheckFacilities{},
+			ips:        &countingProjectIPService{ips: []packngo.IPAddressReservation{eip}},
+			bgpConfig:  testCheckBGPConfig{config: &packngo.BGPConfig{ID: "bgp", Status: "enabled", DeploymentType: "local", Asn: 65000}},
+		}
+	}
+	tests := []struct {
+		modify func(c *checker)
+		failed string
+		report string
+	}{
+		{func(c *checker) {}, "", "OK   token scope              user token with read-write access"},
+		{func(c *checker) { c.projects = testCheckProjects{err: testAPIError(http.StatusNotFound)} }, "project access", "FAIL project access"},
+		{func(c *checker) {
+			c.apiKeys = testCheckAPIKeys{project: []packngo.APIKey{{Token: "token", ReadOnly: true, Project: &packngo.Project{}}}}
+		}, "token scope", "project token is read-only"},
+		// not finding the key is not a failure
+		{func(c *checker) { c.apiKeys = testCheckAPIKeys{} }, "", "WARN token scope"},
+		{func(c *checker) { c.config.Facility = "xx1" }, "facility", "unknown facilities xx1"},
+		{func(c *checker) { c.config.EIPTag = "othertag" }, "control plane elastic ip", "not found with tag othertag"},
+		{func(c *checker) { c.config.EIPTag = "" }, "", "no tag set"},
+		{func(c *checker) { c.bgpConfig = testCheckBGPConfig{config: &packngo.BGPConfig{}} }, "", "WARN bgp"},
+	}
+	for i, tt := range tests {
+		c := healthy()
+		tt.modify(&c)
+		out := &bytes.Buffer{}
+		err := c.run(out)
+		switch {
+		case tt.failed == "" && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case tt.failed != "" && (err == nil || !strings.Contains(err.Error(), tt.failed)):
+			t.Errorf("%d: mismatched error, actual %v expected failed %s", i, err, tt.failed)
+		}
+		if !strings.Contains(out.String(), tt.report) {
+			t.Errorf("%d: report does not contain %q:\n%s", i, tt.report, out.String())
+		}
+	}
+}
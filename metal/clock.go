@@ -0,0 +1,21 @@
+package metal
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// Clock tells the control plane endpoint manager and the load balancers the time, for failover
+// cooldowns and grace periods, how long to keep the IPs of deleted services, and how long to reuse
+// the IP reservations. Tests, also those of code that uses this package, can set a fake clock,
+// e.g. clock.NewFakeClock, in the Config, and step it through those, rather than wait for them.
+type Clock = clock.PassiveClock
+
+// clockNow the time of the clock, or the real time if there is none
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
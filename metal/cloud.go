@@ -4,12 +4,17 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/packethost/packngo"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -27,6 +32,9 @@ const (
 	// ConsumerToken token for metal consumer
 	ConsumerToken         string = "cloud-provider-equinix-metal"
 	checkLoopTimerSeconds        = 60
+	// initialSyncSeconds the least time before the first full sync after startup, to which up to as much is
+	// added again at random, so that replicas restarted together do not all sync at once
+	initialSyncSeconds = 2
 )
 
 type nodeReconciler func(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error
@@ -40,6 +48,18 @@ type cloudService interface {
 	serviceReconciler() serviceReconciler
 }
 
+// cloudWatcher an internal service that needs to watch kubernetes resources
+// beyond the nodes and services passed to its reconcilers
+type cloudWatcher interface {
+	watch(ctx context.Context) error
+}
+
+// cloudCustomResources an internal service that manages custom resources,
+// for which it needs a dynamic client; called before init
+type cloudCustomResources interface {
+	initCustomResources(client dynamic.Interface)
+}
+
 type cloudInstances interface {
 	cloudprovider.Instances
 	cloudService
@@ -47,6 +67,8 @@ type cloudInstances interface {
 type cloudLoadBalancers interface {
 	cloudprovider.LoadBalancer
 	cloudService
+	// managed whether the service controller of kubernetes drives the load balancers via cloudprovider.LoadBalancer
+	managed() bool
 }
 type cloudZones interface {
 	cloudprovider.Zones
@@ -56,35 +78,129 @@ type cloudZones interface {
 // cloud implements cloudprovider.Interface
 type cloud struct {
 	client                      *packngo.Client
+	credentials                 *credentialManager
 	instances                   cloudInstances
 	zones                       cloudZones
 	loadBalancer                cloudLoadBalancers
 	facility                    string
 	controlPlaneEndpointManager *controlPlaneEndpointManager
+	logging                     *loggingManager
+	plans                       *planCapacityManager
+	nodePools                   *nodePoolManager
+	webhook                     *serviceWebhook
+	metalNodes                  *metalNodeManager
+	notifications               *notificationManager
+	ingressHints                *ingressHintsManager
 	// holds our bgp service handler
 	bgp *bgp
+	// disabledReconcilers the reconcilers not to run, e.g. bgp for users running their own BGP stack
+	disabledReconcilers map[string]bool
+	// registry the services above that are initializable, see register
+	registry *serviceRegistry
+	// pressure whether the kubernetes API is under pressure, to sync less often
+	pressure *apiPressure
 }
 
-func newCloud(metalConfig Config, client *packngo.Client) (cloudprovider.Interface, error) {
-	i := newInstances(client, metalConfig.ProjectID)
-	return &cloud{
+func newCloud(metalConfig Config, client *packngo.Client, credentials *credentialManager) (cloudprovider.Interface, error) {
+	if credentials == nil {
+		credentials = &credentialManager{current: metalConfig.AuthToken}
+	}
+	i := newInstances(client, metalConfig.ProjectID, metalConfig.IPv6NodeAddresses, metalConfig.NodeDeletionConfirmations, metalConfig.NodeDeletionDisabled)
+	gates, err := ParseFeatureGates(metalConfig.FeatureGates)
+	if err != nil {
+		return nil, err
+	}
+	reportFeatureGates(gates)
+	disabledReconcilers, err := ParseDisabledReconcilers(metalConfig.DisabledReconcilers)
+	if err != nil {
+		return nil, err
+	}
+	var lbType string
+	// validated when the config was loaded; nil means load balancing is disabled
+	if lbSetting, _ := ParseLoadBalancerSetting(metalConfig.LoadBalancerSetting); lbSetting != nil {
+		lbType = lbSetting.Type
+	}
+	controlPlaneEndpointManager := newControlPlaneEndpointManager(metalConfig, client, i, newLBaaSClient(credentials.token))
+	metalNodes := newMetalNodeManager(client.BGPConfig, metalConfig.ProjectID, metalConfig.AgentMode)
+	loadBalancer := newLoadBalancers(metalConfig, client, metalNodes, controlPlaneEndpointManager.lbaas)
+	c := &cloud{
 		client:                      client,
+		credentials:                 credentials,
 		facility:                    metalConfig.Facility,
 		instances:                   i,
 		zones:                       newZones(client, metalConfig.ProjectID),
-		loadBalancer:                newLoadBalancers(client, metalConfig.ProjectID, metalConfig.Facility, metalConfig.LoadBalancerSetting),
-		bgp:                         newBGP(client, metalConfig.ProjectID, metalConfig.LocalASN, metalConfig.BGPPass, metalConfig.AnnotationLocalASN, metalConfig.AnnotationPeerASNs, metalConfig.AnnotationPeerIPs, metalConfig.AnnotationSrcIP, metalConfig.AnnotationBGPPass, metalConfig.BGPNodeSelector),
-		controlPlaneEndpointManager: newControlPlaneEndpointManager(metalConfig.EIPTag, metalConfig.ProjectID, client.DeviceIPs, client.ProjectIPs, i, metalConfig.APIServerPort),
-	}, nil
+		loadBalancer:                loadBalancer,
+		bgp:                         newBGP(client, metalConfig.ProjectID, metalConfig.LocalASN, metalConfig.BGPPass, metalConfig.AnnotationLocalASN, metalConfig.AnnotationPeerASNs, metalConfig.AnnotationPeerIPs, metalConfig.AnnotationSrcIP, metalConfig.AnnotationBGPPass, metalConfig.BGPNodeSelector, metalConfig.PrivateASNRange, metalConfig.AnnotationPrivateASN, metalConfig.BGPPassSecret, metalNodes),
+		controlPlaneEndpointManager: controlPlaneEndpointManager,
+		logging:                     newLoggingManager(),
+		plans:                       newPlanCapacityManager(client.Plans, metalConfig.PlanCapacity),
+		nodePools:                   newNodePoolManager(packngoNodePoolDevices{client: client}, metalConfig.ProjectID, gates.Enabled(FeatureNodePools)),
+		webhook:                     newServiceWebhook(metalConfig.WebhookAddress, metalConfig.WebhookCertFile, metalConfig.WebhookKeyFile, lbType),
+		metalNodes:                  metalNodes,
+		notifications:               newNotificationManager(metalConfig, client),
+		ingressHints:                newIngressHintsManager(metalConfig.LocalASN, metalConfig.IngressHints),
+		disabledReconcilers:         disabledReconcilers,
+		pressure:                    newAPIPressure(),
+	}
+	c.registry = c.register()
+	if _, err := c.registry.ordered(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewCloudProvider the Equinix Metal cloud provider for the config, for binaries that embed it, e.g. to run
+// it alongside controllers of their own, without registering it, as InitializeProvider does. If client
+// is nil, one for the auth token of the config talks to the Equinix Metal API, with faults injected as
+// configured. Like InitializeProvider, it registers the metrics of the CCM, and its build info on /configz.
+func NewCloudProvider(metalConfig Config, client *packngo.Client) (cloudprovider.Interface, error) {
+	registerMetrics()
+	for _, name := range metalConfig.DeprecatedSettings {
+		deprecatedSetting.WithLabelValues(name).Set(1)
+	}
+	if err := publishBuildInfo(metalConfig); err != nil {
+		return nil, err
+	}
+	if metalConfig.TracingEndpoint != "" {
+		if err := initTracing(metalConfig.TracingEndpoint, metalConfig.TracingInsecure); err != nil {
+			return nil, err
+		}
+	}
+	credentials, err := newCredentialManager(metalConfig)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		// validated when the config was loaded; nil means no faults are injected
+		faults, _ := parseFaultInjection(metalConfig.FaultInjection)
+		if faults != nil {
+			klog.Warningf("fault injection enabled, Equinix Metal API calls and health checks fail at random: %s", metalConfig.FaultInjection)
+		}
+		// a secret is read once there is a kubernetes client, see Initialize; any other source now
+		if _, ok := credentials.provider.(kubernetesCredentialProvider); !ok {
+			if err := credentials.load(context.Background()); err != nil {
+				return nil, err
+			}
+		}
+		client = faults.newPacketClient(metalConfig.AuthToken, credentials)
+		client.UserAgent = fmt.Sprintf("cloud-provider-equinix-metal/%s %s", VERSION, client.UserAgent)
+	} else if credentials.provider != nil {
+		klog.Warningf("auth token source %s ignored, the given Equinix Metal API client authenticates itself", credentials.provider)
+		credentials = nil
+	}
+	cloud, err := newCloud(metalConfig, client, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new cloud handler: %w", err)
+	}
+	return cloud, nil
 }
 
+// InitializeProvider create the Equinix Metal cloud provider for the config, and register it
+// with the cloud provider framework, for the controller manager to find by its name
 func InitializeProvider(metalConfig Config) error {
-	// set up our client and create the cloud interface
-	client := packngo.NewClientWithAuth("", metalConfig.AuthToken, nil)
-	client.UserAgent = fmt.Sprintf("cloud-provider-equinix-metal/%s %s", VERSION, client.UserAgent)
-	cloud, err := newCloud(metalConfig, client)
+	cloud, err := NewCloudProvider(metalConfig, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create new cloud handler: %v", err)
+		return err
 	}
 
 	// finally, register
@@ -96,29 +212,65 @@ func InitializeProvider(metalConfig Config) error {
 	return nil
 }
 
-// services get those elements that are initializable
-func (c *cloud) services() []cloudService {
-	return []cloudService{c.loadBalancer, c.instances, c.zones, c.bgp, c.controlPlaneEndpointManager}
+// register the elements that are initializable, with the services each depends on
+func (c *cloud) register() *serviceRegistry {
+	r := &serviceRegistry{}
+	// first, so that any other service that calls the Equinix Metal API on init has the auth token
+	r.register(c.credentials)
+	r.register(c.instances)
+	r.register(c.zones)
+	r.register(c.metalNodes)
+	// BGP neighbours come from the node agents in agent mode
+	r.register(c.bgp, c.metalNodes.name())
+	// load balancer IPs are announced via BGP, which must be enabled on the project first
+	r.register(c.loadBalancer, c.bgp.name(), c.metalNodes.name())
+	r.register(c.controlPlaneEndpointManager, c.instances.name())
+	r.register(c.logging)
+	r.register(c.plans)
+	r.register(c.nodePools)
+	r.register(c.webhook)
+	r.register(c.notifications)
+	// publishes the IPs the load balancer assigned in the same sync
+	r.register(c.ingressHints, c.loadBalancer.name())
+	return r
 }
 
 // Initialize provides the cloud with a kubernetes client builder and may spawn goroutines
 // to perform housekeeping activities within the cloud provider.
 func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	klog.V(5).Info("called Initialize")
-	clientset := clientBuilder.ClientOrDie("cloud-provider-equinix-metal-shared-informers")
+	config := clientBuilder.ConfigOrDie("cloud-provider-equinix-metal-shared-informers")
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return newTracingRoundTripper("kubernetes", newPressureRoundTripper(c.pressure, rt))
+	})
+	clientset := kubernetes.NewForConfigOrDie(config)
+	dynamicClient := dynamic.NewForConfigOrDie(config)
 	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
 	// if we have services that want to reconcile, we will start node loop
 	nodeReconcilers := []nodeReconciler{}
 	serviceReconcilers := []serviceReconciler{}
-	for _, elm := range c.services() {
+	if len(c.disabledReconcilers) > 0 {
+		klog.Infof("reconcilers disabled: %s", strings.Join(c.disabledReconcilerNames(), ","))
+	}
+	services, err := c.enabledServices()
+	if err != nil {
+		klog.Fatalf("could not order services: %v", err)
+	}
+	for _, elm := range services {
+		if cr, ok := elm.(cloudCustomResources); ok {
+			cr.initCustomResources(dynamicClient)
+		}
 		if err := elm.init(clientset); err != nil {
 			klog.Fatalf("could not initialize %s: %v", elm.name(), err)
 		}
+		if c.disabledReconcilers[c.reconcilerOf(elm)] {
+			continue
+		}
 		if n := elm.nodeReconciler(); n != nil {
-			nodeReconcilers = append(nodeReconcilers, n)
+			nodeReconcilers = append(nodeReconcilers, tracedNodeReconciler(elm.name(), n))
 		}
 		if s := elm.serviceReconciler(); s != nil {
-			serviceReconcilers = append(serviceReconcilers, s)
+			serviceReconcilers = append(serviceReconcilers, tracedServiceReconciler(elm.name(), s))
 		}
 	}
 
@@ -134,15 +286,29 @@ func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder,
 	if err := startServicesWatcher(ctx, sharedInformer, serviceReconcilers); err != nil {
 		klog.Errorf("services watcher initialization failed: %v", err)
 	}
-	go timerLoop(ctx, sharedInformer, nodeReconcilers, serviceReconcilers)
+	for _, elm := range services {
+		if w, ok := elm.(cloudWatcher); ok {
+			if err := w.watch(ctx); err != nil {
+				klog.Errorf("%s watcher initialization failed: %v", elm.name(), err)
+			}
+		}
+	}
+	// the first full sync runs right after startup, rather than after a whole interval, so that e.g. a detached
+	// control plane EIP is repaired in seconds after a restart
+	go timerLoop(ctx, sharedInformer, nodeReconcilers, serviceReconcilers, c.pressure, wait.Jitter(initialSyncSeconds*time.Second, 1))
 	klog.V(5).Info("Initialize complete")
 }
 
 // LoadBalancer returns a balancer interface. Also returns true if the interface is supported, false otherwise.
-// TODO unimplemented
+// Only managed load balancers are driven by the service controller of kubernetes via the interface; for
+// the other types, the load balancer reconcilers allocate the IPs of services, and the implementation,
+// e.g. metallb, sets their status.
 func (c *cloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 	klog.V(5).Info("called LoadBalancer")
-	return nil, false
+	if !c.loadBalancer.managed() {
+		return nil, false
+	}
+	return c.loadBalancer, true
 }
 
 // Instances returns an instances interface. Also returns true if the interface is supported, false otherwise.
@@ -243,6 +409,12 @@ func startNodesWatcher(ctx context.Context, informer informers.SharedInformerFac
 	return nil
 }
 
+// serviceChanged whether a service changed in a way that a service reconciler may care about,
+// i.e. its spec or annotations; changes of its status, e.g. by the CCM itself, are left to the loop
+func serviceChanged(old, svc *v1.Service) bool {
+	return !equality.Semantic.DeepEqual(old.Spec, svc.Spec) || !equality.Semantic.DeepEqual(old.Annotations, svc.Annotations)
+}
+
 // startServicesWatcher start a goroutine that watches k8s for services and calls
 // any handlers
 func startServicesWatcher(ctx context.Context, informer informers.SharedInformerFactory, handlers []serviceReconciler) error {
@@ -263,6 +435,17 @@ func startServicesWatcher(ctx context.Context, informer informers.SharedInformer
 				}
 			}
 		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, svc := oldObj.(*v1.Service), newObj.(*v1.Service)
+			if !serviceChanged(old, svc) {
+				return
+			}
+			for _, h := range handlers {
+				if err := h(ctx, []*v1.Service{svc}, ModeUpdate); err != nil {
+					klog.Errorf("failed to update and sync service for update %s/%s: %v", svc.Namespace, svc.Name, err)
+				}
+			}
+		},
 		DeleteFunc: func(obj interface{}) {
 			svc := obj.(*v1.Service)
 			for _, h := range handlers {
@@ -299,19 +482,22 @@ func startServicesWatcher(ctx context.Context, informer informers.SharedInformer
 	return nil
 }
 
-func timerLoop(ctx context.Context, informer informers.SharedInformerFactory, nodesHandlers []nodeReconciler, servicesHandlers []serviceReconciler) {
+// timerLoop run a full sync of all services and nodes after the delay first, and then after each interval
+func timerLoop(ctx context.Context, informer informers.SharedInformerFactory, nodesHandlers []nodeReconciler, servicesHandlers []serviceReconciler, pressure *apiPressure, first time.Duration) {
 	servicesLister := informer.Core().V1().Services().Lister()
 	nodesLister := informer.Core().V1().Nodes().Lister()
+	delay := first
 	for {
 		select {
-		case <-time.After(checkLoopTimerSeconds * time.Second):
+		case <-time.After(delay):
+			ctx, span := startSpan(ctx, "timerLoop")
 			servicesList, err := servicesLister.List(labels.Everything())
 			if err != nil {
 				klog.Errorf("timed reservations watcher: failed to list services: %v", err)
 			}
 			for _, h := range servicesHandlers {
 				if err := h(ctx, servicesList, ModeSync); err != nil {
-					klog.Errorf("failed to update and sync services: %v", err)
+					repeatedErrors.Errorf(errorReasonSyncServices, "failed to update and sync services: %v", err)
 				}
 			}
 			nodesList, err := nodesLister.List(labels.Everything())
@@ -320,9 +506,11 @@ func timerLoop(ctx context.Context, informer informers.SharedInformerFactory, no
 			}
 			for _, h := range nodesHandlers {
 				if err := h(ctx, nodesList, ModeSync); err != nil {
-					klog.Errorf("failed to update and sync nodes: %v", err)
+					repeatedErrors.Errorf(errorReasonSyncNodes, "failed to update and sync nodes: %v", err)
 				}
 			}
+			span.End()
+			delay = pressure.interval(checkLoopTimerSeconds * time.Second)
 		case <-ctx.Done():
 			return
 		}
@@ -1,15 +1,21 @@
 package metal
 
 import (
+	"context"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	emServer "github.com/packethost/packet-api-server/pkg/server"
 	"github.com/packethost/packet-api-server/pkg/store"
 	"github.com/packethost/packngo"
 
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
 	cloudprovider "k8s.io/cloud-provider"
 )
 
@@ -63,11 +69,33 @@ func testGetValidCloud(t *testing.T) (*cloud, *store.Memory) {
 	config := Config{
 		ProjectID: projectID,
 	}
-	c, _ := newCloud(config, client)
+	c, _ := newCloud(config, client, nil)
 	validCloud = c.(*cloud)
 	return validCloud, backend
 }
 
+func TestNewCloudProvider(t *testing.T) {
+	client := constructClient(token, nil)
+	provider, err := NewCloudProvider(Config{ProjectID: projectID, FeatureGates: "bogus=true"}, client)
+	if err == nil {
+		t.Errorf("expected error for invalid feature gates")
+	}
+	provider, err = NewCloudProvider(Config{ProjectID: projectID}, client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name := provider.ProviderName(); name != providerName {
+		t.Errorf("mismatched provider name, actual %s expected %s", name, providerName)
+	}
+	if c, ok := provider.(*cloud); !ok || c.client != client {
+		t.Errorf("cloud provider does not use the given client")
+	}
+	// not registered, which only InitializeProvider does
+	if registered, _ := cloudprovider.GetCloudProvider(providerName, nil); registered != nil {
+		t.Errorf("cloud provider registered")
+	}
+}
+
 func TestLoadBalancer(t *testing.T) {
 	vc, _ := testGetValidCloud(t)
 	response, supported := vc.LoadBalancer()
@@ -178,3 +206,60 @@ func constructClient(authToken string, baseURL *string) *packngo.Client {
 	}
 	return packngo.NewClientWithAuth(ConsumerToken, authToken, client)
 }
+
+func TestServiceChanged(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "svc", Annotations: map[string]string{"a": "b"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	statusOnly := svc.DeepCopy()
+	statusOnly.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "147.75.100.1"}}
+	statusOnly.ResourceVersion = "2"
+	spec := svc.DeepCopy()
+	spec.Spec.LoadBalancerIP = "147.75.100.1"
+	annotations := svc.DeepCopy()
+	annotations.Annotations["a"] = "c"
+
+	tests := []struct {
+		svc     *v1.Service
+		changed bool
+	}{
+		{svc.DeepCopy(), false},
+		{statusOnly, false},
+		{spec, true},
+		{annotations, true},
+	}
+	for i, tt := range tests {
+		if changed := serviceChanged(svc, tt.svc); changed != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, tt.changed)
+		}
+	}
+}
+
+func TestTimerLoopInitialSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}}
+	informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(node), 0)
+	informer.Core().V1().Services().Informer()
+	informer.Core().V1().Nodes().Informer()
+	informer.Start(ctx.Done())
+	informer.WaitForCacheSync(ctx.Done())
+
+	synced := make(chan []*v1.Node, 1)
+	handler := func(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+		if mode == ModeSync {
+			synced <- nodes
+		}
+		return nil
+	}
+	go timerLoop(ctx, informer, []nodeReconciler{handler}, nil, nil, 0)
+	select {
+	case nodes := <-synced:
+		if len(nodes) != 1 || nodes[0].Name != nodeName {
+			t.Errorf("mismatched nodes, actual %v expected %s", nodes, nodeName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("no sync right after start")
+	}
+}
@@ -0,0 +1,60 @@
+package metal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/packethost/packngo"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// clusterAPITagPrefix the prefix of the tags with which Cluster API Provider Packet (CAPP)
+	// marks the devices and elastic IPs it manages, e.g. cluster-api-provider-packet:cluster-id:<name>
+	clusterAPITagPrefix = "cluster-api-provider-packet:"
+
+	// who moves the control plane elastic IP between control plane nodes
+	// eipManagementCCM the CCM, by reassigning it via the Equinix Metal API
+	eipManagementCCM = "ccm"
+	// eipManagementDefer something else, e.g. kube-vip as deployed by CAPP; the CCM never reassigns it
+	eipManagementDefer = "defer"
+	// eipManagementAuto defer if the elastic IP is tagged by CAPP, otherwise the CCM
+	eipManagementAuto = "auto"
+)
+
+// ValidateEIPManagement return an error if the setting is not a valid EIP management setting
+func ValidateEIPManagement(setting string) error {
+	switch setting {
+	case "", eipManagementCCM, eipManagementDefer, eipManagementAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid EIP management setting %q, must be one of %s, %s, %s", setting, eipManagementCCM, eipManagementDefer, eipManagementAuto)
+	}
+}
+
+// managedByClusterAPI whether the tags of a device or IP reservation mark it as managed by CAPP
+func managedByClusterAPI(tags []string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, clusterAPITagPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// eipManagementDeferred whether the CCM should leave the elastic IP where it is, because
+// something else, e.g. kube-vip as deployed by CAPP, moves it between control plane nodes
+func (m *controlPlaneEndpointManager) eipManagementDeferred(ip *packngo.IPAddressReservation) bool {
+	switch m.eipManagement {
+	case eipManagementDefer:
+		return true
+	case eipManagementAuto:
+		return managedByClusterAPI(ip.Tags)
+	default:
+		if managedByClusterAPI(ip.Tags) && !m.clusterAPIWarned {
+			klog.Warningf("elastic ip %s is tagged by Cluster API Provider Packet; if kube-vip moves it, set the EIP management setting to %s or %s so that the CCM does not move it concurrently", ip.Address, eipManagementDefer, eipManagementAuto)
+			m.clusterAPIWarned = true
+		}
+		return false
+	}
+}
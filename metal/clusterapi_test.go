@@ -0,0 +1,74 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEIPManagementDeferred(t *testing.T) {
+	cappTags := []string{"cluster-api-provider-packet:cluster-id:test"}
+	tests := []struct {
+		setting  string
+		tags     []string
+		deferred bool
+	}{
+		{"", nil, false},
+		{"", cappTags, false},
+		{eipManagementCCM, cappTags, false},
+		{eipManagementDefer, nil, true},
+		{eipManagementDefer, cappTags, true},
+		{eipManagementAuto, []string{"eiptag"}, false},
+		{eipManagementAuto, cappTags, true},
+	}
+	for i, tt := range tests {
+		m := &controlPlaneEndpointManager{eipManagement: tt.setting}
+		ip := &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: tt.tags}}
+		if deferred := m.eipManagementDeferred(ip); deferred != tt.deferred {
+			t.Errorf("%d: mismatched deferred for %q with tags %v, actual %t expected %t", i, tt.setting, tt.tags, deferred, tt.deferred)
+		}
+	}
+}
+
+func TestValidateEIPManagement(t *testing.T) {
+	for _, setting := range []string{"", eipManagementCCM, eipManagementDefer, eipManagementAuto} {
+		if err := ValidateEIPManagement(setting); err != nil {
+			t.Errorf("unexpected error for %q: %v", setting, err)
+		}
+	}
+	if err := ValidateEIPManagement("kube-vip"); err == nil {
+		t.Errorf("expected error for kube-vip")
+	}
+}
+
+func TestReconcileNodesDeferred(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag", "cluster-api-provider-packet:cluster-id:test"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/abc"}}},
+		},
+	}}
+	m.healthChecker = failingHealthChecker{}
+	m.apiServerPort = 6443
+	m.eipManagement = eipManagementAuto
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://abc"},
+	}
+
+	// deferred: no attempt to reassign, which would fail without any cloud instances
+	if err := m.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err != nil {
+		t.Errorf("unexpected error with management deferred: %v", err)
+	}
+
+	// managed by the ccm: reassign, which finds nowhere to go, since node port is not known
+	m.eipManagement = eipManagementCCM
+	if err := m.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err == nil {
+		t.Errorf("expected reassign error with management by the ccm")
+	}
+}
@@ -2,14 +2,30 @@ package metal
 
 import (
 	"fmt"
-	"math/rand"
+	"sync/atomic"
 
 	"github.com/packethost/packet-api-server/pkg/store"
 	"github.com/packethost/packngo"
 	"github.com/packethost/packngo/metadata"
 	randomdata "github.com/pallinder/go-randomdata"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 )
 
+// testDynamicClient a fake dynamic client with the objects, which can list all the custom resources the CCM uses
+func testDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{
+		metalNodeResource:            metalNodeKind + "List",
+		controlPlaneEndpointResource: controlPlaneEndpointKind + "List",
+		nodePoolResource:             "NodePoolList",
+		notificationResource:         notificationKind + "List",
+		gatewayResource:              "GatewayList",
+		tcpRouteResource:             "TCPRouteList",
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
 // find an ewr1 region or create it
 func testGetOrCreateValidRegion(name, code string, backend store.DataStore) (*packngo.Facility, error) {
 	facility, err := backend.GetFacilityByCode(code)
@@ -38,9 +54,12 @@ func testGetOrCreateValidPlan(name, slug string, backend store.DataStore) (*pack
 	return backend.CreatePlan(slug, name)
 }
 
-// get a unique name
+// testDevNameCount the number of device names handed out, to keep them unique
+var testDevNameCount int64
+
+// get a unique name; devices sharing a hostname are ambiguous to look up by node name
 func testGetNewDevName() string {
-	return fmt.Sprintf("device-%d", rand.Intn(1000))
+	return fmt.Sprintf("device-%d", atomic.AddInt64(&testDevNameCount, 1))
 }
 
 func testCreateAddress(ipv6, public bool) *packngo.IPAddressAssignment {
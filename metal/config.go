@@ -1,24 +1,92 @@
 package metal
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
 
 // Config configuration for a provider, includes authentication token, project ID ID, and optional override URL to talk to a different Equinix Metal API endpoint
 type Config struct {
-	AuthToken           string  `json:"apiKey"`
-	ProjectID           string  `json:"projectId"`
-	BaseURL             *string `json:"base-url,omitempty"`
-	LoadBalancerSetting string  `json:"loadbalancer"`
-	Facility            string  `json:"facility,omitempty"`
-	LocalASN            int     `json:"localASN,omitempty"`
-	BGPPass             string  `json:"bgpPass,omitempty"`
-	AnnotationLocalASN  string  `json:"annotationLocalASN,omitEmpty"`
-	AnnotationPeerASNs  string  `json:"annotationPeerASNs,omitEmpty"`
-	AnnotationPeerIPs   string  `json:"annotationPeerIPs,omitEmpty"`
-	AnnotationSrcIP     string  `json:"annotationSrcIP,omitEmpty"`
-	AnnotationBGPPass   string  `json:"annotationBGPPass,omitEmpty"`
-	EIPTag              string  `json:"eipTag,omitEmpty"`
-	APIServerPort       int32   `json:"apiServerPort,omitEmpty"`
-	BGPNodeSelector     string  `json:"bgpNodeSelector,omitEmpty"`
+	AuthToken                       string   `json:"apiKey"`
+	AuthTokenSource                 string   `json:"apiKeySource,omitempty"`
+	AuthTokenRefresh                string   `json:"apiKeyRefresh,omitempty"`
+	VaultAddress                    string   `json:"vaultAddress,omitempty"`
+	VaultToken                      string   `json:"vaultToken,omitempty"`
+	VaultRole                       string   `json:"vaultRole,omitempty"`
+	VaultAuthPath                   string   `json:"vaultAuthPath,omitempty"`
+	AWSRegion                       string   `json:"awsRegion,omitempty"`
+	ProjectID                       string   `json:"projectId"`
+	BaseURL                         *string  `json:"base-url,omitempty"`
+	LoadBalancerSetting             string   `json:"loadbalancer"`
+	Facility                        string   `json:"facility,omitempty"`
+	LocalASN                        int      `json:"localASN,omitempty"`
+	BGPPass                         string   `json:"bgpPass,omitempty"`
+	BGPPassSecret                   bool     `json:"bgpPassSecret,omitempty"`
+	AnnotationLocalASN              string   `json:"annotationLocalASN,omitEmpty"`
+	AnnotationPeerASNs              string   `json:"annotationPeerASNs,omitEmpty"`
+	AnnotationPeerIPs               string   `json:"annotationPeerIPs,omitEmpty"`
+	AnnotationSrcIP                 string   `json:"annotationSrcIP,omitEmpty"`
+	AnnotationBGPPass               string   `json:"annotationBGPPass,omitEmpty"`
+	EIPTag                          string   `json:"eipTag,omitEmpty"`
+	APIServerPort                   int32    `json:"apiServerPort,omitEmpty"`
+	BGPNodeSelector                 string   `json:"bgpNodeSelector,omitEmpty"`
+	FallbackMetros                  []string `json:"fallbackMetros,omitempty"`
+	LoadBalancerHealthCheck         bool     `json:"loadBalancerHealthCheck,omitempty"`
+	LBExcludeControlPlane           bool     `json:"lbExcludeControlPlane,omitempty"`
+	LBNamespaces                    []string `json:"lbNamespaces,omitempty"`
+	LBExcludedNamespaces            []string `json:"lbExcludedNamespaces,omitempty"`
+	LBMaxIPs                        int      `json:"lbMaxIPs,omitempty"`
+	LBMaxIPsPerNamespace            int      `json:"lbMaxIPsPerNamespace,omitempty"`
+	LBKeepIPGracePeriod             string   `json:"lbKeepIPGracePeriod,omitempty"`
+	LBNameFormat                    string   `json:"lbNameFormat,omitempty"`
+	LBIPAllocator                   string   `json:"lbIPAllocator,omitempty"`
+	LBAddressPool                   string   `json:"lbAddressPool,omitempty"`
+	LBRackSpread                    bool     `json:"lbRackSpread,omitempty"`
+	LBReusePoolTag                  string   `json:"lbReusePoolTag,omitempty"`
+	TracingEndpoint                 string   `json:"tracingEndpoint,omitempty"`
+	TracingInsecure                 bool     `json:"tracingInsecure,omitempty"`
+	FaultInjection                  string   `json:"faultInjection,omitempty"`
+	NodeAddressType                 string   `json:"nodeAddressType,omitempty"`
+	ControlPlaneLBSetting           string   `json:"controlPlaneLBSetting,omitempty"`
+	ControlPlaneHealthCheck         string   `json:"controlPlaneHealthCheck,omitempty"`
+	ControlPlaneExternalHealthCheck string   `json:"controlPlaneExternalHealthCheck,omitempty"`
+	ControlPlaneGatewayClass        string   `json:"controlPlaneGatewayClass,omitempty"`
+	EIPMaintenanceHold              bool     `json:"eipMaintenanceHold,omitempty"`
+	EIPFailoverCooldown             string   `json:"eipFailoverCooldown,omitempty"`
+	EIPMaxFailoversPerHour          int      `json:"eipMaxFailoversPerHour,omitempty"`
+	EIPFailoverGracePeriod          string   `json:"eipFailoverGracePeriod,omitempty"`
+	EIPManagement                   string   `json:"eipManagement,omitempty"`
+	EIPSelectionPolicy              string   `json:"eipSelectionPolicy,omitempty"`
+	EIPDriftPolicy                  string   `json:"eipDriftPolicy,omitempty"`
+	EIPLoopback                     bool     `json:"eipLoopback,omitempty"`
+	EIPHairpin                      bool     `json:"eipHairpin,omitempty"`
+	EIPEtcdLeaderMetrics            string   `json:"eipEtcdLeaderMetrics,omitempty"`
+	EIPRebootAfter                  string   `json:"eipRebootAfter,omitempty"`
+	EIPMaxReboots                   int      `json:"eipMaxReboots,omitempty"`
+	EIPHealthCheckConcurrency       int      `json:"eipHealthCheckConcurrency,omitempty"`
+	EIPReconcileTimeout             string   `json:"eipReconcileTimeout,omitempty"`
+	EIPCreate                       bool     `json:"eipCreate,omitempty"`
+	EIPCreateMetro                  string   `json:"eipCreateMetro,omitempty"`
+	PrivateASNRange                 string   `json:"privateASNRange,omitempty"`
+	AnnotationPrivateASN            string   `json:"annotationPrivateASN,omitempty"`
+	PlanCapacity                    bool     `json:"planCapacity,omitempty"`
+	IngressHints                    bool     `json:"ingressHints,omitempty"`
+	FeatureGates                    string   `json:"featureGates,omitempty"`
+	DisabledReconcilers             string   `json:"disabledReconcilers,omitempty"`
+	IPv6NodeAddresses               bool     `json:"ipv6NodeAddresses,omitempty"`
+	NodeDeletionConfirmations       int      `json:"nodeDeletionConfirmations,omitempty"`
+	NodeDeletionDisabled            bool     `json:"nodeDeletionDisabled,omitempty"`
+	WebhookAddress                  string   `json:"webhookAddress,omitempty"`
+	WebhookCertFile                 string   `json:"webhookCertFile,omitempty"`
+	WebhookKeyFile                  string   `json:"webhookKeyFile,omitempty"`
+	AgentMode                       bool     `json:"agentMode,omitempty"`
+	// DeprecatedSettings the names of deprecated settings in use, e.g. env vars from before the rename from Packet
+	DeprecatedSettings []string `json:"-"`
+	// Clock if set, the clock of the control plane endpoint manager and the load balancers, e.g. a fake one in tests
+	Clock Clock `json:"-"`
+	// HealthCheckProber if set, sends the http and https control plane health checks, e.g. with a client certificate
+	HealthCheckProber Prober `json:"-"`
 }
 
 // String converts the Config structure to a string, while masking hidden fields.
@@ -31,17 +99,98 @@ func (c Config) Strings() []string {
 	} else {
 		ret = append(ret, "authToken: ''")
 	}
+	ret = append(ret, fmt.Sprintf("authToken source: '%s', refresh: '%s'", c.AuthTokenSource, c.AuthTokenRefresh))
+	if c.VaultToken != "" {
+		ret = append(ret, fmt.Sprintf("Vault address: '%s', token: '<masked>', role: '%s', auth path: '%s'", redactURL(c.VaultAddress), c.VaultRole, c.VaultAuthPath))
+	} else {
+		ret = append(ret, fmt.Sprintf("Vault address: '%s', token: '', role: '%s', auth path: '%s'", redactURL(c.VaultAddress), c.VaultRole, c.VaultAuthPath))
+	}
+	ret = append(ret, fmt.Sprintf("AWS region: '%s'", c.AWSRegion))
 	ret = append(ret, fmt.Sprintf("projectID: '%s'", c.ProjectID))
 	if c.LoadBalancerSetting == "" {
 		ret = append(ret, "loadbalancer config: disabled")
 	} else {
-		ret = append(ret, "load balancer config: ''%s", c.LoadBalancerSetting)
+		ret = append(ret, fmt.Sprintf("load balancer config: '%s'", c.LoadBalancerSetting))
 	}
+	ret = append(ret, fmt.Sprintf("load balancer health check: '%t'", c.LoadBalancerHealthCheck))
+	ret = append(ret, fmt.Sprintf("load balancer exclude control plane: '%t'", c.LBExcludeControlPlane))
+	ret = append(ret, fmt.Sprintf("load balancer namespaces: '%s', excluded: '%s'", strings.Join(c.LBNamespaces, ","), strings.Join(c.LBExcludedNamespaces, ",")))
+	ret = append(ret, fmt.Sprintf("load balancer max IPs: '%d', per namespace: '%d'", c.LBMaxIPs, c.LBMaxIPsPerNamespace))
+	ret = append(ret, fmt.Sprintf("load balancer keep IP grace period: '%s'", c.LBKeepIPGracePeriod))
+	ret = append(ret, fmt.Sprintf("load balancer name format: '%s'", c.LBNameFormat))
+	ret = append(ret, fmt.Sprintf("load balancer address pool: '%s'", c.LBAddressPool))
+	ret = append(ret, fmt.Sprintf("load balancer IP allocator: '%s'", redactURL(c.LBIPAllocator)))
+	ret = append(ret, fmt.Sprintf("load balancer rack spread: '%t'", c.LBRackSpread))
+	ret = append(ret, fmt.Sprintf("load balancer reuse pool tag: '%s'", c.LBReusePoolTag))
 	ret = append(ret, fmt.Sprintf("facility: '%s'", c.Facility))
+	ret = append(ret, fmt.Sprintf("fallback metros: '%s'", strings.Join(c.FallbackMetros, ",")))
 	ret = append(ret, fmt.Sprintf("local ASN: '%d'", c.LocalASN))
+	ret = append(ret, fmt.Sprintf("BGP password secret: '%t'", c.BGPPassSecret))
 	ret = append(ret, fmt.Sprintf("Elastic IP Tag: '%s'", c.EIPTag))
 	ret = append(ret, fmt.Sprintf("API Server Port: '%d'", c.APIServerPort))
+	ret = append(ret, fmt.Sprintf("Elastic IP Maintenance Hold: '%t'", c.EIPMaintenanceHold))
+	ret = append(ret, fmt.Sprintf("Elastic IP Failover Cooldown: '%s', max per hour: '%d'", c.EIPFailoverCooldown, c.EIPMaxFailoversPerHour))
+	ret = append(ret, fmt.Sprintf("Elastic IP Failover Grace Period: '%s'", c.EIPFailoverGracePeriod))
+	ret = append(ret, fmt.Sprintf("Elastic IP Management: '%s'", c.EIPManagement))
+	ret = append(ret, fmt.Sprintf("Elastic IP Selection Policy: '%s'", c.EIPSelectionPolicy))
+	ret = append(ret, fmt.Sprintf("Elastic IP Drift Policy: '%s'", c.EIPDriftPolicy))
+	ret = append(ret, fmt.Sprintf("Elastic IP Loopback: '%t'", c.EIPLoopback))
+	ret = append(ret, fmt.Sprintf("Elastic IP Hairpin Workaround: '%t'", c.EIPHairpin))
+	ret = append(ret, fmt.Sprintf("Elastic IP etcd Leader Metrics: '%s'", c.EIPEtcdLeaderMetrics))
+	ret = append(ret, fmt.Sprintf("Elastic IP Reboot Failed Nodes After: '%s', max reboots: '%d'", c.EIPRebootAfter, c.EIPMaxReboots))
+	ret = append(ret, fmt.Sprintf("Elastic IP Health Check Concurrency: '%d', reconcile timeout: '%s'", c.EIPHealthCheckConcurrency, c.EIPReconcileTimeout))
+	ret = append(ret, fmt.Sprintf("Elastic IP Create If Missing: '%t', metro: '%s'", c.EIPCreate, c.EIPCreateMetro))
+	ret = append(ret, fmt.Sprintf("Control Plane Load Balancer: '%s'", c.ControlPlaneLBSetting))
+	ret = append(ret, fmt.Sprintf("Control Plane Health Check: '%s'", redactURL(c.ControlPlaneHealthCheck)))
+	ret = append(ret, fmt.Sprintf("Control Plane External Health Check: '%s'", redactURL(c.ControlPlaneExternalHealthCheck)))
+	ret = append(ret, fmt.Sprintf("Control Plane Gateway Class: '%s'", c.ControlPlaneGatewayClass))
 	ret = append(ret, fmt.Sprintf("BGP Node Selector: '%s'", c.BGPNodeSelector))
+	if c.PrivateASNRange == "" {
+		ret = append(ret, "private node ASNs: disabled")
+	} else {
+		ret = append(ret, fmt.Sprintf("private node ASN range: '%s', annotation: '%s'", c.PrivateASNRange, c.AnnotationPrivateASN))
+	}
+	ret = append(ret, fmt.Sprintf("plan capacity configmap: '%t'", c.PlanCapacity))
+	ret = append(ret, fmt.Sprintf("ingress hints configmap: '%t'", c.IngressHints))
+	ret = append(ret, fmt.Sprintf("feature gates: '%s'", c.FeatureGates))
+	ret = append(ret, fmt.Sprintf("disabled reconcilers: '%s'", c.DisabledReconcilers))
+	ret = append(ret, fmt.Sprintf("IPv6 node addresses: '%t'", c.IPv6NodeAddresses))
+	ret = append(ret, fmt.Sprintf("node deletion confirmations: '%d', disabled: '%t'", c.NodeDeletionConfirmations, c.NodeDeletionDisabled))
+	if c.WebhookAddress == "" {
+		ret = append(ret, "admission webhook: disabled")
+	} else {
+		ret = append(ret, fmt.Sprintf("admission webhook: '%s', cert: '%s', key: '%s'", c.WebhookAddress, c.WebhookCertFile, c.WebhookKeyFile))
+	}
+	ret = append(ret, fmt.Sprintf("agent mode: '%t'", c.AgentMode))
+	ret = append(ret, fmt.Sprintf("node address type: '%s'", c.NodeAddressType))
+	if c.TracingEndpoint == "" {
+		ret = append(ret, "tracing: disabled")
+	} else {
+		ret = append(ret, fmt.Sprintf("tracing endpoint: '%s', insecure: '%t'", redactURL(c.TracingEndpoint), c.TracingInsecure))
+	}
+	// the faults themselves are only logged at debug verbosity, when the config is printed
+	if c.FaultInjection != "" {
+		ret = append(ret, "fault injection, do not use in production: enabled")
+	}
+	if len(c.DeprecatedSettings) > 0 {
+		ret = append(ret, fmt.Sprintf("deprecated settings in use: '%s'", strings.Join(c.DeprecatedSettings, ",")))
+	}
 
 	return ret
 }
+
+// redactURL the setting, with the userinfo and the query of a URL masked, as either may hold
+// credentials, e.g. a password or a token
+func redactURL(setting string) string {
+	u, err := url.Parse(setting)
+	if err != nil {
+		return setting
+	}
+	if u.User != nil {
+		u.User = url.User("masked")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "masked"
+	}
+	return u.String()
+}
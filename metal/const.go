@@ -1,9 +1,37 @@
 package metal
 
+import "fmt"
+
+// UpdateMode why a node or service reconciler is called, and so what it should do
+// with the nodes or services it is given
 type UpdateMode int
 
 const (
+	// ModeAdd the given objects were created: reconcile each of them, leaving everything else as is
 	ModeAdd UpdateMode = iota
+	// ModeRemove the given objects were deleted: clean up what was created for each of them,
+	// leaving everything else as is; a removed object is never a candidate for anything
 	ModeRemove
+	// ModeSync the given objects are all there are, listed once per loop: reconcile each of them,
+	// and clean up what was created for any object not in the list
 	ModeSync
+	// ModeUpdate the given existing objects changed: reconcile each of them, as for ModeAdd.
+	// Only services are updated; nodes change on every heartbeat of their kubelet, so node
+	// reconcilers pick up changes on the next ModeSync instead.
+	ModeUpdate
 )
+
+func (m UpdateMode) String() string {
+	switch m {
+	case ModeAdd:
+		return "add"
+	case ModeRemove:
+		return "remove"
+	case ModeSync:
+		return "sync"
+	case ModeUpdate:
+		return "update"
+	default:
+		return fmt.Sprintf("UpdateMode(%d)", int(m))
+	}
+}
@@ -4,13 +4,21 @@ const (
 	configMapResource         = "configmaps"
 	hostnameKey               = "kubernetes.io/hostname"
 	emIdentifier              = "cloud-provider-equinix-metal-auto"
-	emTag                     = "usage=" + emIdentifier
+	emTag                     = tagKeyUsage + "=" + emIdentifier
+	tagKeyUsage               = "usage"
+	tagKeyCluster             = "cluster"
+	tagKeyService             = "service"
 	ccmIPDescription          = "Equinix Metal Kubernetes CCM auto-generated for Load Balancer"
 	DefaultAnnotationNodeASN  = "metal.equinix.com/node-asn"
 	DefaultAnnotationPeerASNs = "metal.equinix.com/peer-asn"
 	DefaultAnnotationPeerIPs  = "metal.equinix.com/peer-ip"
 	DefaultAnnotationSrcIP    = "metal.equinix.com/src-ip"
 	DefaultAnnotationBGPPass  = "metal.equinix.com/bgp-pass"
+	annotationEIPFacility     = "metal.equinix.com/eip-facility"
+	annotationEIPMetro        = "metal.equinix.com/eip-metro"
+	annotationBGPMultihop     = "metal.equinix.com/bgp-multihop"
+	annotationPeerIPsIPv6     = "metal.equinix.com/peer-ip-v6"
+	annotationSrcIPIPv6       = "metal.equinix.com/src-ip-v6"
 	DefaultLocalASN           = 65000
 	DefaultPeerASN            = 65530
 )
@@ -0,0 +1,182 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// controlPlaneEndpointName the name of the single, cluster-scoped, ControlPlaneEndpoint
+	controlPlaneEndpointName = "control-plane"
+	controlPlaneEndpointKind = "ControlPlaneEndpoint"
+)
+
+// controlPlaneEndpointResource the ControlPlaneEndpoint custom resource, whose status reports
+// where the control plane elastic IP is, see deploy/crds
+var controlPlaneEndpointResource = schema.GroupVersionResource{Group: "metal.equinix.com", Version: "v1alpha1", Resource: "controlplaneendpoints"}
+
+// controlPlaneEndpointStatus the status of the ControlPlaneEndpoint
+type controlPlaneEndpointStatus struct {
+	Address            string
+	DeviceID           string
+	NodeName           string
+	LastFailoverTime   time.Time
+	LastFailoverReason string
+	// RecentFailoverTimes when the elastic IP was moved within the last hour, so that a
+	// restarted CCM keeps to the failover cooldown and maximum per hour
+	RecentFailoverTimes []time.Time
+}
+
+func (s controlPlaneEndpointStatus) unstructured() map[string]interface{} {
+	status := map[string]interface{}{
+		"address":  s.Address,
+		"deviceID": s.DeviceID,
+		"nodeName": s.NodeName,
+	}
+	if !s.LastFailoverTime.IsZero() {
+		status["lastFailoverTime"] = s.LastFailoverTime.UTC().Format(time.RFC3339)
+		status["lastFailoverReason"] = s.LastFailoverReason
+	}
+	if len(s.RecentFailoverTimes) > 0 {
+		times := make([]interface{}, 0, len(s.RecentFailoverTimes))
+		for _, t := range s.RecentFailoverTimes {
+			times = append(times, t.UTC().Format(time.RFC3339))
+		}
+		status["recentFailoverTimes"] = times
+	}
+	return status
+}
+
+// parseFailoverHistory the failover history in the status of a ControlPlaneEndpoint; times
+// that cannot be parsed are skipped
+func parseFailoverHistory(obj map[string]interface{}) (moves []time.Time, last time.Time, lastReason string) {
+	if v, _, _ := unstructured.NestedString(obj, "status", "lastFailoverTime"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			last = t
+		}
+	}
+	lastReason, _, _ = unstructured.NestedString(obj, "status", "lastFailoverReason")
+	times, _, _ := unstructured.NestedStringSlice(obj, "status", "recentFailoverTimes")
+	for _, v := range times {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			moves = append(moves, t)
+		}
+	}
+	return moves, last, lastReason
+}
+
+func (m *controlPlaneEndpointManager) initCustomResources(client dynamic.Interface) {
+	m.dynamicClient = client
+}
+
+// reportStatus record where the elastic IP is in the status of the ControlPlaneEndpoint,
+// creating it if needed. It only writes when the status changed since the last report.
+// If the custom resource definition is not installed, it does nothing.
+func (m *controlPlaneEndpointManager) reportStatus(ctx context.Context, address, deviceID, nodeName string) {
+	if m.dynamicClient == nil {
+		return
+	}
+	// the history must be restored before it is first written, or it would be lost
+	if err := m.restoreFailovers(ctx); err != nil {
+		klog.Errorf("unable to restore failover history, not reporting control plane endpoint status: %v", err)
+		return
+	}
+	m.failovers.prune(clockNow(m.clock))
+	status := controlPlaneEndpointStatus{
+		Address:             address,
+		DeviceID:            deviceID,
+		NodeName:            nodeName,
+		LastFailoverTime:    m.failovers.last,
+		LastFailoverReason:  m.failovers.lastReason,
+		RecentFailoverTimes: append([]time.Time(nil), m.failovers.moves...),
+	}
+	if m.reportedStatus != nil && reflect.DeepEqual(*m.reportedStatus, status) {
+		return
+	}
+	if err := m.writeStatus(ctx, status); err != nil {
+		if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+			klog.V(2).Infof("%s custom resource definition not installed, not reporting control plane endpoint status", controlPlaneEndpointResource.GroupResource())
+			return
+		}
+		klog.Errorf("unable to report control plane endpoint status: %v", err)
+		return
+	}
+	m.reportedStatus = &status
+}
+
+// restoreFailovers restore the failover history from the status of the ControlPlaneEndpoint,
+// once, so that a restarted CCM does not move the elastic IP more often than configured.
+// Moves recorded since are kept.
+func (m *controlPlaneEndpointManager) restoreFailovers(ctx context.Context) error {
+	if m.failoversRestored {
+		return nil
+	}
+	obj, err := m.dynamicClient.Resource(controlPlaneEndpointResource).Get(ctx, controlPlaneEndpointName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		moves, last, lastReason := parseFailoverHistory(obj.Object)
+		if m.failovers.last.IsZero() {
+			m.failovers.last, m.failovers.lastReason = last, lastReason
+		}
+		m.failovers.moves = mergeFailoverTimes(moves, m.failovers.moves)
+		if len(moves) > 0 {
+			klog.Infof("restored %d recent failovers of the control plane elastic ip", len(moves))
+		}
+	case meta.IsNoMatchError(err) || apierrors.IsNotFound(err):
+		// nothing reported yet, or not installed, so nothing to restore
+	default:
+		return err
+	}
+	m.failoversRestored = true
+	return nil
+}
+
+// mergeFailoverTimes the restored moves followed by the later ones recorded since, oldest first
+func mergeFailoverTimes(restored, recorded []time.Time) []time.Time {
+	merged := append([]time.Time(nil), restored...)
+	for _, t := range recorded {
+		if len(merged) == 0 || t.After(merged[len(merged)-1]) {
+			merged = append(merged, t)
+		}
+	}
+	return merged
+}
+
+// writeStatus write the status of the ControlPlaneEndpoint, creating it if needed, unless it already
+// has that status, e.g. as written before the CCM restarted
+func (m *controlPlaneEndpointManager) writeStatus(ctx context.Context, status controlPlaneEndpointStatus) error {
+	client := m.dynamicClient.Resource(controlPlaneEndpointResource)
+	obj, err := client.Get(ctx, controlPlaneEndpointName, metav1.GetOptions{})
+	if err == nil {
+		if existing, _, _ := unstructured.NestedMap(obj.Object, "status"); reflect.DeepEqual(existing, status.unstructured()) {
+			klog.V(4).Infof("status of %s %s unchanged, not updating", controlPlaneEndpointKind, controlPlaneEndpointName)
+			return nil
+		}
+	}
+	if apierrors.IsNotFound(err) {
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion(controlPlaneEndpointResource.GroupVersion().String())
+		obj.SetKind(controlPlaneEndpointKind)
+		obj.SetName(controlPlaneEndpointName)
+		obj.SetLabels(map[string]string{managedByLabel: managedByCCM})
+		obj, err = client.Create(ctx, obj, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if err := unstructured.SetNestedMap(obj.Object, status.unstructured(), "status"); err != nil {
+		return fmt.Errorf("unable to set status: %w", err)
+	}
+	_, err = client.UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
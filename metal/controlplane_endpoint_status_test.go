@@ -0,0 +1,110 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestReportStatus(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	client := testDynamicClient()
+	m.initCustomResources(client)
+
+	getStatus := func() map[string]interface{} {
+		obj, err := client.Resource(controlPlaneEndpointResource).Get(ctx, controlPlaneEndpointName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get control plane endpoint: %v", err)
+		}
+		status, _, _ := unstructured.NestedMap(obj.Object, "status")
+		return status
+	}
+
+	// created on first report
+	m.reportStatus(ctx, testEIP, "abc", "master-1")
+	status := getStatus()
+	if status["address"] != testEIP || status["deviceID"] != "abc" || status["nodeName"] != "master-1" {
+		t.Errorf("mismatched status, actual %v", status)
+	}
+	if _, ok := status["lastFailoverTime"]; ok {
+		t.Errorf("unexpected last failover time without failover: %v", status)
+	}
+
+	// unchanged status is not written again
+	client.ClearActions()
+	m.reportStatus(ctx, testEIP, "abc", "master-1")
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("mismatched actions for unchanged status, actual %v expected none", actions)
+	}
+
+	// nor after a restart, which forgets what was reported, but finds it in the status
+	restarted, _ := testControlPlaneEndpointManager(t)
+	restarted.initCustomResources(client)
+	client.ClearActions()
+	restarted.reportStatus(ctx, testEIP, "abc", "master-1")
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("mismatched action for unchanged status after restart, actual %v expected only gets", action)
+		}
+	}
+
+	// failover is reported
+	failoverTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.failovers.record(failoverTime, "healthcheck failed")
+	m.reportStatus(ctx, testEIP, "def", "master-2")
+	status = getStatus()
+	if status["nodeName"] != "master-2" || status["lastFailoverTime"] != "2021-01-01T00:00:00Z" || status["lastFailoverReason"] != "healthcheck failed" {
+		t.Errorf("mismatched status after failover, actual %v", status)
+	}
+}
+
+func TestRestoreFailovers(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	client := testDynamicClient()
+
+	// a first CCM moves the elastic ip twice, and reports it
+	first, _ := testControlPlaneEndpointManager(t)
+	first.initCustomResources(client)
+	first.failovers = failoverHistory{maxPerHour: 2}
+	first.failovers.record(now.Add(-2*time.Hour), "healthcheck failed")
+	first.failovers.record(now.Add(-10*time.Minute), "healthcheck failed")
+	first.failovers.record(now.Add(-5*time.Minute), "pinned to node master-2")
+	first.reportStatus(ctx, testEIP, "def", "master-2")
+
+	// after a restart, the next one keeps to the maximum per hour
+	second, _ := testControlPlaneEndpointManager(t)
+	second.initCustomResources(client)
+	second.failovers = failoverHistory{maxPerHour: 2}
+	second.reportStatus(ctx, testEIP, "def", "master-2")
+	expected := []time.Time{now.Add(-10 * time.Minute), now.Add(-5 * time.Minute)}
+	if !reflect.DeepEqual(second.failovers.moves, expected) {
+		t.Errorf("mismatched restored moves, actual %v expected %v", second.failovers.moves, expected)
+	}
+	if !second.failovers.last.Equal(now.Add(-5*time.Minute)) || second.failovers.lastReason != "pinned to node master-2" {
+		t.Errorf("mismatched restored last failover, actual %s %q", second.failovers.last, second.failovers.lastReason)
+	}
+	if err := second.failovers.allowed(now); err == nil {
+		t.Errorf("failover allowed after restart, expected the maximum per hour to apply")
+	}
+
+	// it is restored only once, and later moves are reported
+	second.failovers.moves = nil
+	second.failovers.record(now, "healthcheck failed")
+	second.reportStatus(ctx, testEIP, "abc", "master-1")
+	if len(second.failovers.moves) != 1 {
+		t.Errorf("mismatched moves after a second report, actual %v", second.failovers.moves)
+	}
+	obj, err := client.Resource(controlPlaneEndpointResource).Get(ctx, controlPlaneEndpointName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get control plane endpoint: %v", err)
+	}
+	if moves, _, _ := parseFailoverHistory(obj.Object); !reflect.DeepEqual(moves, []time.Time{now}) {
+		t.Errorf("mismatched reported moves, actual %v expected %v", moves, []time.Time{now})
+	}
+}
@@ -0,0 +1,242 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// supported control plane load balancer implementations, set as the scheme of the setting
+	controlPlaneLBTypeEquinixMetal = "equinixmetal"
+)
+
+// controlPlaneMembers an external TCP load balancer in front of the control plane.
+// Rather than moving the EIP to a healthy control plane node, the control plane
+// endpoint manager keeps exactly the healthy control plane nodes as its members.
+type controlPlaneMembers interface {
+	// Members the addresses of the current members
+	Members(ctx context.Context) ([]string, error)
+	// AddMember add a member at the given address and port
+	AddMember(ctx context.Context, address string, port int32) error
+	// RemoveMember remove the member at the given address
+	RemoveMember(ctx context.Context, address string) error
+}
+
+// newControlPlaneMembers the control plane load balancer for the setting,
+// which is a URL of the form <type>://<id>
+func newControlPlaneMembers(setting string, lbaas *lbaasClient) (controlPlaneMembers, error) {
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control plane load balancer setting %q: %w", setting, err)
+	}
+	switch u.Scheme {
+	case controlPlaneLBTypeEquinixMetal:
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid control plane load balancer setting %q: must be of the form %s://<pool id>", setting, controlPlaneLBTypeEquinixMetal)
+		}
+		return &equinixMetalMembers{client: lbaas, poolID: u.Host}, nil
+	case "":
+		return nil, fmt.Errorf("invalid control plane load balancer setting %q: must be of the form <type>://<id>", setting)
+	default:
+		return nil, fmt.Errorf("invalid control plane load balancer setting %q: unsupported type %q, must be %s", setting, u.Scheme, controlPlaneLBTypeEquinixMetal)
+	}
+}
+
+// ValidateControlPlaneLBSetting return an error if the control plane load balancer setting is
+// invalid; an empty one means the control plane endpoint is not an external load balancer
+func ValidateControlPlaneLBSetting(setting string) error {
+	if setting == "" {
+		return nil
+	}
+	_, err := newControlPlaneMembers(setting, nil)
+	return err
+}
+
+// equinixMetalMembers the origins of a pool of an Equinix Metal load balancer, which the
+// port of the load balancer in front of the control plane sends its traffic to
+type equinixMetalMembers struct {
+	client *lbaasClient
+	poolID string
+}
+
+func (e *equinixMetalMembers) Members(ctx context.Context) ([]string, error) {
+	origins, err := e.client.listOrigins(ctx, e.poolID)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, origin := range origins {
+		seen[origin.Target] = true
+	}
+	return sortedKeys(seen), nil
+}
+
+func (e *equinixMetalMembers) AddMember(ctx context.Context, address string, port int32) error {
+	return e.client.createOrigin(ctx, e.poolID, lbaasOrigin{Name: address, Target: address, PortNumber: port, Active: true})
+}
+
+func (e *equinixMetalMembers) RemoveMember(ctx context.Context, address string) error {
+	origins, err := e.client.listOrigins(ctx, e.poolID)
+	if err != nil {
+		return err
+	}
+	for _, origin := range origins {
+		if origin.Target != address {
+			continue
+		}
+		if err := e.client.deleteOrigin(ctx, origin.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileMembers health check the control plane nodes, and make the healthy
+// ones, and only those, the members of the control plane load balancer
+func (m *controlPlaneEndpointManager) reconcileMembers(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+	cpNodes := controlPlaneNodes(nodes)
+	switch mode {
+	case ModeAdd:
+		// new nodes are added once they are healthy, on the next sync
+		return nil
+	case ModeRemove:
+		var errs []error
+		for _, node := range cpNodes {
+			if addr := nodeProbeAddress(node, m.nodeAddressType); addr != "" {
+				klog.Infof("control plane node %s removed, removing %s from control plane load balancer", node.Name, addr)
+				if err := m.members.RemoveMember(ctx, addr); err != nil {
+					errs = append(errs, fmt.Errorf("failed to remove member %s: %w", addr, err))
+				}
+			}
+		}
+		return utilerrors.NewAggregate(errs)
+	}
+
+	if len(cpNodes) == 0 {
+		klog.V(2).Info("controlPlaneEndpoint.reconcileMembers: no control plane nodes, nothing to do")
+		return nil
+	}
+	ctx, cancel := m.reconcileContext(ctx)
+	defer cancel()
+	port, portChanged, err := m.lookupNodeAPIServerPort(ctx)
+	if err != nil {
+		return err
+	}
+
+	var addrs []string
+	for _, node := range cpNodes {
+		addr := nodeProbeAddress(node, m.nodeAddressType)
+		if addr == "" {
+			klog.V(2).Infof("control plane node %s has no address, skipping", node.Name)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	healthy := map[string]bool{}
+	results := m.healthCheckEach(ctx, len(addrs), func(ctx context.Context, i int) bool {
+		return m.healthCheck(ctx, healthCheckAddress(addrs[i], port))
+	})
+	for i, ok := range results {
+		if ok {
+			healthy[addrs[i]] = true
+		}
+	}
+	// checks cut short say nothing about the members, which are left as they are
+	if err := m.reconcileCutShort(ctx); err != nil {
+		return err
+	}
+	// never take the whole control plane out of the load balancer
+	if len(healthy) == 0 {
+		return fmt.Errorf("%w, leaving control plane load balancer members unchanged", ErrAllUnhealthy)
+	}
+
+	members, err := m.members.Members(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list control plane load balancer members: %w", err)
+	}
+	current := map[string]bool{}
+	for _, addr := range members {
+		current[addr] = true
+	}
+	// the members still point at the previous port, so add the healthy ones again on the new one
+	if portChanged {
+		var errs []error
+		for _, addr := range sortedKeys(current) {
+			if !healthy[addr] {
+				continue
+			}
+			klog.Infof("apiserver port changed, adding control plane node %s to control plane load balancer again on port %d", addr, port)
+			if err := m.members.RemoveMember(ctx, addr); err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove member %s: %w", addr, err))
+				continue
+			}
+			delete(current, addr)
+		}
+		if len(errs) > 0 {
+			return utilerrors.NewAggregate(errs)
+		}
+	}
+
+	var errs []error
+	for _, addr := range sortedKeys(healthy) {
+		if current[addr] {
+			continue
+		}
+		klog.Infof("adding healthy control plane node %s to control plane load balancer", addr)
+		if err := m.members.AddMember(ctx, addr, port); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add member %s: %w", addr, err))
+		}
+	}
+	for _, addr := range sortedKeys(current) {
+		if healthy[addr] {
+			continue
+		}
+		klog.Infof("removing unhealthy or unknown member %s from control plane load balancer", addr)
+		if err := m.members.RemoveMember(ctx, addr); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove member %s: %w", addr, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// lookupNodeAPIServerPort the port on which the apiserver listens on the control plane nodes,
+// from the `default/kubernetes` service, and whether it changed since the last lookup. It is
+// looked up every time, as there is no external service whose sync would follow it. If the
+// lookup fails, the port last known is kept, or else one is detected without the service.
+func (m *controlPlaneEndpointManager) lookupNodeAPIServerPort(ctx context.Context) (int32, bool, error) {
+	svc, err := m.k8sclient.CoreV1().Services("default").Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err == nil {
+		var changed bool
+		if changed, err = m.setNodeAPIServerPort(svc); err == nil {
+			return m.nodeAPIServerPort, changed, nil
+		}
+	}
+	if m.nodeAPIServerPort != 0 {
+		klog.Warningf("unable to determine apiserver port, keeping %d: %v", m.nodeAPIServerPort, err)
+		return m.nodeAPIServerPort, false, nil
+	}
+	if port, source, fallbackErr := m.fallbackNodeAPIServerPort(ctx); fallbackErr == nil {
+		klog.Warningf("unable to get service default/kubernetes, using apiserver port %d from %s: %v", port, source, err)
+		m.nodeAPIServerPort = port
+		m.nodeAPIServerPortDetected = true
+		return port, false, nil
+	}
+	return 0, false, fmt.Errorf("unable to get default/kubernetes service to determine apiserver port: %w", err)
+}
+
+// sortedKeys the keys of the map, sorted for stable ordering
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
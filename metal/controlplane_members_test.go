@@ -0,0 +1,136 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testMembers an in-memory control plane load balancer
+type testMembers struct {
+	members map[string]int32
+}
+
+func (t *testMembers) Members(ctx context.Context) ([]string, error) {
+	addrs := []string{}
+	for addr := range t.members {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+func (t *testMembers) AddMember(ctx context.Context, address string, port int32) error {
+	t.members[address] = port
+	return nil
+}
+func (t *testMembers) RemoveMember(ctx context.Context, address string) error {
+	delete(t.members, address)
+	return nil
+}
+
+func testControlPlaneNode(name, ip string) *v1.Node {
+	node := testNodeWithIP(name, ip)
+	node.Labels = map[string]string{controlPlaneLabel: ""}
+	return node
+}
+
+func TestNewControlPlaneMembers(t *testing.T) {
+	tests := []struct {
+		setting string
+		err     bool
+	}{
+		{"equinixmetal://abc", false},
+		{"equinixmetal://", true},
+		{"", true},
+		{"foo://abc", true},
+		{"abc", true},
+	}
+	for i, tt := range tests {
+		members, err := newControlPlaneMembers(tt.setting, nil)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched error for %q, actual %v expected error %v", i, tt.setting, err, tt.err)
+			continue
+		}
+		if err == nil && members.(*equinixMetalMembers).poolID != "abc" {
+			t.Errorf("%d: mismatched pool, actual %q expected abc", i, members.(*equinixMetalMembers).poolID)
+		}
+	}
+}
+
+func TestReconcileMembers(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	m, _ := testControlPlaneEndpointManager(t)
+	members := &testMembers{members: map[string]int32{"127.0.0.2": 6443, "10.0.0.1": 6443}}
+	m.members = members
+	svc := testKubernetesService()
+	svc.Spec.Ports[0].TargetPort.IntVal = int32(port)
+	if _, err := m.k8sclient.CoreV1().Services("default").Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update service: %v", err)
+	}
+
+	// only 127.0.0.1 answers; 127.0.0.2 is down, 10.0.0.1 is not a control plane node
+	nodes := []*v1.Node{
+		testControlPlaneNode("healthy", "127.0.0.1"),
+		testControlPlaneNode("unhealthy", "127.0.0.2"),
+		testNodeWithIP("worker", "127.0.0.3"),
+	}
+	if err := m.reconcileMembers(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	actual, _ := members.Members(ctx)
+	if strings.Join(actual, ",") != "127.0.0.1" {
+		t.Errorf("mismatched members, actual %v expected [127.0.0.1]", actual)
+	}
+
+	// nothing healthy: leave members alone
+	if err := m.reconcileMembers(ctx, nodes[1:], ModeSync); !errors.Is(err, ErrAllUnhealthy) {
+		t.Errorf("mismatched error with no healthy nodes, actual %v expected %v", err, ErrAllUnhealthy)
+	}
+	if actual, _ := members.Members(ctx); strings.Join(actual, ",") != "127.0.0.1" {
+		t.Errorf("mismatched members after failed sync, actual %v expected [127.0.0.1]", actual)
+	}
+
+	// removed node is removed
+	if err := m.reconcileMembers(ctx, nodes[:1], ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual, _ := members.Members(ctx); len(actual) != 0 {
+		t.Errorf("mismatched members after remove, actual %v expected none", actual)
+	}
+}
+
+func TestReconcileMembersPortChanged(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	m.nodeAPIServerPort = 6443
+	members := &testMembers{members: map[string]int32{"127.0.0.1": 6443}}
+	m.members = members
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{"127.0.0.1:7443": true}}
+	svc := testKubernetesService()
+	svc.Spec.Ports[0].TargetPort.IntVal = 7443
+	if _, err := m.k8sclient.CoreV1().Services("default").Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update service: %v", err)
+	}
+
+	if err := m.reconcileMembers(ctx, []*v1.Node{testControlPlaneNode("master-1", "127.0.0.1")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.nodeAPIServerPort != 7443 {
+		t.Errorf("mismatched apiserver port, actual %d expected 7443", m.nodeAPIServerPort)
+	}
+	if port := members.members["127.0.0.1"]; port != 7443 {
+		t.Errorf("mismatched member port, actual %d expected 7443", port)
+	}
+}
@@ -0,0 +1,523 @@
+package metal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// authTokenSourceFile the auth token is the content of a file, e.g. one mounted from a secret
+	// or written by an agent, such as the Vault agent
+	authTokenSourceFile = "file"
+	// authTokenSourceSecret the auth token is a key of a kubernetes secret, read with the
+	// credentials of the CCM itself
+	authTokenSourceSecret = "secret"
+	// authTokenSourceVault the auth token is a field of a secret in HashiCorp Vault
+	authTokenSourceVault = "vault"
+	// defaultAuthTokenRefresh how often to read the auth token from its source again, if not set
+	defaultAuthTokenRefresh = 5 * time.Minute
+	// defaultVaultAuthPath the path at which the kubernetes auth method of Vault is mounted, if not set
+	defaultVaultAuthPath = "kubernetes"
+	// serviceAccountTokenPath the token of the service account of the CCM, with which it logs in to Vault
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// vaultRequestTimeout the longest a request to Vault may take
+	vaultRequestTimeout = 10 * time.Second
+	// vaultRenewRetryMin, vaultRenewRetryMax how long to wait before renewing the Vault token again,
+	// after the first and after many failures that may pass, such as timeouts
+	vaultRenewRetryMin = 10 * time.Second
+	vaultRenewRetryMax = 5 * time.Minute
+)
+
+// authTokenSource where to read the auth token from, as parsed from the setting
+type authTokenSource struct {
+	// kind one of the authTokenSource constants
+	kind string
+	// location the path of the file, the namespace/name of the secret, or the path of the Vault secret
+	location string
+	// key the key of the secret, or the field of the Vault secret
+	key string
+}
+
+// parseAuthTokenSource parse the setting of where to read the auth token from, one of:
+//
+//	file:<path>
+//	secret:<namespace>/<name>/<key>
+//	vault:<path>#<field>, e.g. vault:secret/data/equinix-metal#token
+//	aws:<secret id>[#<key>], e.g. aws:equinix-metal#token, the key of a secret that is a JSON object
+//
+// Empty means the token is the one set in the config, which never changes; nil is returned.
+func parseAuthTokenSource(setting string) (*authTokenSource, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(setting, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid auth token source %q, must be file:<path>, secret:<namespace>/<name>/<key>, vault:<path>#<field> or aws:<secret id>[#<key>]", setting)
+	}
+	kind, location := parts[0], parts[1]
+	switch kind {
+	case authTokenSourceFile:
+		return &authTokenSource{kind: kind, location: location}, nil
+	case authTokenSourceSecret:
+		ref := strings.Split(location, "/")
+		if len(ref) != 3 || ref[0] == "" || ref[1] == "" || ref[2] == "" {
+			return nil, fmt.Errorf("invalid secret %q of auth token source, must be <namespace>/<name>/<key>", location)
+		}
+		return &authTokenSource{kind: kind, location: ref[0] + "/" + ref[1], key: ref[2]}, nil
+	case authTokenSourceVault:
+		ref := strings.SplitN(location, "#", 2)
+		if len(ref) != 2 || strings.Trim(ref[0], "/") == "" || ref[1] == "" {
+			return nil, fmt.Errorf("invalid Vault secret %q of auth token source, must be <path>#<field>", location)
+		}
+		return &authTokenSource{kind: kind, location: strings.Trim(ref[0], "/"), key: ref[1]}, nil
+	case authTokenSourceAWS:
+		ref := strings.SplitN(location, "#", 2)
+		if ref[0] == "" || (len(ref) == 2 && ref[1] == "") {
+			return nil, fmt.Errorf("invalid AWS secret %q of auth token source, must be <secret id>[#<key>]", location)
+		}
+		source := &authTokenSource{kind: kind, location: ref[0]}
+		if len(ref) == 2 {
+			source.key = ref[1]
+		}
+		return source, nil
+	default:
+		return nil, fmt.Errorf("invalid auth token source %q, unknown kind %s, must be one of %s, %s, %s or %s", setting, kind, authTokenSourceFile, authTokenSourceSecret, authTokenSourceVault, authTokenSourceAWS)
+	}
+}
+
+// ValidateAuthTokenSource return an error if the setting is not a valid source of the auth token;
+// empty means the token is the one set in the config
+func ValidateAuthTokenSource(setting string) error {
+	_, err := parseAuthTokenSource(setting)
+	return err
+}
+
+// credentialProvider a source of the Equinix Metal auth token, which is read again periodically,
+// so that the token can be rotated without restarting the CCM
+type credentialProvider interface {
+	// String the source, for logs; never the token
+	String() string
+	// token the current auth token
+	token(ctx context.Context) (string, error)
+}
+
+// kubernetesCredentialProvider a credential provider that needs the kubernetes client of the CCM,
+// which it only gets when the CCM is initialized
+type kubernetesCredentialProvider interface {
+	credentialProvider
+	setKubernetes(k8sclient kubernetes.Interface)
+}
+
+// newCredentialProvider the provider of the source set in the config; nil if there is none
+func newCredentialProvider(config Config) (credentialProvider, error) {
+	source, err := parseAuthTokenSource(config.AuthTokenSource)
+	if err != nil || source == nil {
+		return nil, err
+	}
+	switch source.kind {
+	case authTokenSourceFile:
+		return fileCredentials{path: source.location}, nil
+	case authTokenSourceSecret:
+		ref := strings.SplitN(source.location, "/", 2)
+		return &secretCredentials{namespace: ref[0], name: ref[1], key: source.key}, nil
+	case authTokenSourceAWS:
+		if config.AWSRegion == "" {
+			return nil, fmt.Errorf("auth token source %s needs the AWS region of the secret", config.AuthTokenSource)
+		}
+		credentials, err := newAWSCredentials(source.location, source.key, config.AWSRegion)
+		if err != nil {
+			return nil, err
+		}
+		return credentials, nil
+	default:
+		address := strings.TrimSuffix(config.VaultAddress, "/")
+		if address == "" {
+			return nil, fmt.Errorf("auth token source %s needs the address of Vault", config.AuthTokenSource)
+		}
+		if config.VaultToken == "" && config.VaultRole == "" {
+			return nil, fmt.Errorf("auth token source %s needs a Vault token, or a role to log in to Vault with", config.AuthTokenSource)
+		}
+		authPath := strings.Trim(config.VaultAuthPath, "/")
+		if authPath == "" {
+			authPath = defaultVaultAuthPath
+		}
+		return &vaultCredentials{
+			address:    address,
+			path:       source.location,
+			field:      source.key,
+			role:       config.VaultRole,
+			authPath:   authPath,
+			vaultToken: config.VaultToken,
+			jwtPath:    serviceAccountTokenPath,
+			httpClient: &http.Client{Timeout: vaultRequestTimeout},
+		}, nil
+	}
+}
+
+// fileCredentials read the auth token from a file, without surrounding whitespace
+type fileCredentials struct {
+	path string
+}
+
+func (f fileCredentials) String() string {
+	return authTokenSourceFile + ":" + f.path
+}
+
+func (f fileCredentials) token(ctx context.Context) (string, error) {
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read auth token file: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// secretCredentials read the auth token from a key of a kubernetes secret
+type secretCredentials struct {
+	k8sclient kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+}
+
+func (s *secretCredentials) String() string {
+	return fmt.Sprintf("%s:%s/%s/%s", authTokenSourceSecret, s.namespace, s.name, s.key)
+}
+
+func (s *secretCredentials) setKubernetes(k8sclient kubernetes.Interface) {
+	s.k8sclient = k8sclient
+}
+
+func (s *secretCredentials) token(ctx context.Context) (string, error) {
+	if s.k8sclient == nil {
+		return "", fmt.Errorf("unable to read auth token secret %s/%s without a kubernetes client", s.namespace, s.name)
+	}
+	secret, err := s.k8sclient.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to get auth token secret %s/%s: %w", s.namespace, s.name, err)
+	}
+	value, ok := secret.Data[s.key]
+	if !ok {
+		return "", fmt.Errorf("auth token secret %s/%s has no key %s", s.namespace, s.name, s.key)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// vaultCredentials read the auth token from a field of a secret in HashiCorp Vault, of either
+// version of the key/value secrets engine, via the Vault HTTP API. It authenticates with the given
+// Vault token, which it renews, or, with a role, logs in with the service account token of the CCM,
+// via the kubernetes auth method, and again once half the lease of the Vault token has passed.
+type vaultCredentials struct {
+	address    string
+	path       string
+	field      string
+	role       string
+	authPath   string
+	vaultToken string
+	jwtPath    string
+	httpClient *http.Client
+
+	// renewAt when to renew the Vault token, or log in again; zero to do so right away
+	renewAt time.Time
+	// unrenewable once Vault refused to renew the given Vault token, so that it is not tried again
+	unrenewable bool
+	// renewFailures the failures in a row to renew the given Vault token, other than a refusal
+	renewFailures int
+}
+
+func (v *vaultCredentials) String() string {
+	return fmt.Sprintf("%s:%s#%s at %s", authTokenSourceVault, v.path, v.field, v.address)
+}
+
+// vaultResponse the parts of the answers of Vault that are used
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// vaultError an error answer from Vault
+type vaultError struct {
+	method string
+	path   string
+	status int
+	errors []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("vault answered %s %s with %d: %s", e.method, e.path, e.status, strings.Join(e.errors, "; "))
+}
+
+// do send a request to Vault, with the Vault token if it has one, and decode the answer
+func (v *vaultCredentials) do(ctx context.Context, method, path string, body interface{}) (*vaultResponse, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, v.address+"/v1/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if v.vaultToken != "" {
+		req.Header.Set("X-Vault-Token", v.vaultToken)
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var answer vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil && resp.StatusCode < http.StatusBadRequest {
+		return nil, fmt.Errorf("invalid answer from Vault to %s %s: %w", method, path, err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &vaultError{method: method, path: path, status: resp.StatusCode, errors: answer.Errors}
+	}
+	return &answer, nil
+}
+
+// authenticate log in to Vault, or renew the Vault token, if it is time to
+func (v *vaultCredentials) authenticate(ctx context.Context) error {
+	now := time.Now()
+	if now.Before(v.renewAt) {
+		return nil
+	}
+	if v.role == "" {
+		if v.unrenewable {
+			return nil
+		}
+		answer, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", nil)
+		switch {
+		case vaultRefused(err):
+			// e.g. a root token, or one issued by the Vault agent, which renews it itself
+			klog.V(2).Infof("not renewing Vault token of auth token source: %v", err)
+			v.unrenewable = true
+		case err != nil:
+			// the Vault token may still be valid, so keep using it, and try again later
+			v.renewFailures++
+			v.renewAt = now.Add(vaultRenewBackoff(v.renewFailures))
+			klog.Warningf("unable to renew Vault token of auth token source, trying again at %s: %v", v.renewAt.Format(time.RFC3339), err)
+		case answer.Auth != nil && !answer.Auth.Renewable:
+			klog.V(2).Infof("not renewing Vault token of auth token source, which is not renewable")
+			v.unrenewable = true
+		default:
+			v.renewFailures = 0
+			v.renewAt = now.Add(vaultLeaseHalf(answer))
+		}
+		return nil
+	}
+	jwt, err := ioutil.ReadFile(v.jwtPath)
+	if err != nil {
+		return fmt.Errorf("unable to read service account token to log in to Vault: %w", err)
+	}
+	v.vaultToken = ""
+	answer, err := v.do(ctx, http.MethodPost, "auth/"+v.authPath+"/login", map[string]string{"role": v.role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return fmt.Errorf("unable to log in to Vault with role %s: %w", v.role, err)
+	}
+	if answer.Auth == nil || answer.Auth.ClientToken == "" {
+		return fmt.Errorf("no Vault token in answer to log in with role %s", v.role)
+	}
+	v.vaultToken = answer.Auth.ClientToken
+	v.renewAt = now.Add(vaultLeaseHalf(answer))
+	klog.V(2).Infof("logged in to Vault with role %s, logging in again at %s", v.role, v.renewAt.Format(time.RFC3339))
+	return nil
+}
+
+// vaultRefused whether Vault definitively refused a request, rather than failing to answer it
+func vaultRefused(err error) bool {
+	var verr *vaultError
+	if !errors.As(err, &verr) {
+		return false
+	}
+	return verr.status == http.StatusBadRequest || verr.status == http.StatusForbidden
+}
+
+// vaultRenewBackoff how long to wait after the given number of failures in a row to renew the Vault token
+func vaultRenewBackoff(failures int) time.Duration {
+	backoff := vaultRenewRetryMin
+	for i := 1; i < failures && backoff < vaultRenewRetryMax; i++ {
+		backoff *= 2
+	}
+	if backoff > vaultRenewRetryMax {
+		backoff = vaultRenewRetryMax
+	}
+	return backoff
+}
+
+// vaultLeaseHalf half the lease of the Vault token in an answer, after which to renew it; with no
+// lease, the token does not expire, and is renewed as often as the auth token is read
+func vaultLeaseHalf(answer *vaultResponse) time.Duration {
+	if answer.Auth == nil || answer.Auth.LeaseDuration <= 0 {
+		return 0
+	}
+	return time.Duration(answer.Auth.LeaseDuration) * time.Second / 2
+}
+
+func (v *vaultCredentials) token(ctx context.Context) (string, error) {
+	if err := v.authenticate(ctx); err != nil {
+		return "", err
+	}
+	answer, err := v.do(ctx, http.MethodGet, v.path, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to read Vault secret %s: %w", v.path, err)
+	}
+	data := answer.Data
+	// version 2 of the key/value engine nests the secret, next to its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+	value, ok := data[v.field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string field %s", v.path, v.field)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// credentialManager keeps the auth token of the Equinix Metal API current: the one set in the config,
+// or, with a source, the one read from it, again every refresh interval. A failed read keeps the
+// last token, which may still be valid.
+type credentialManager struct {
+	provider credentialProvider
+	refresh  time.Duration
+	// loading serializes reads from the provider, which may keep state, e.g. its Vault token
+	loading sync.Mutex
+	lock    sync.RWMutex
+	current string
+}
+
+// newCredentialManager the credential manager for the config; its source and refresh interval have
+// been validated when the config was loaded
+func newCredentialManager(config Config) (*credentialManager, error) {
+	provider, err := newCredentialProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	refresh, _ := time.ParseDuration(config.AuthTokenRefresh)
+	if refresh <= 0 {
+		refresh = defaultAuthTokenRefresh
+	}
+	return &credentialManager{provider: provider, refresh: refresh, current: config.AuthToken}, nil
+}
+
+func (m *credentialManager) name() string {
+	return "credentials"
+}
+
+// init read the auth token from a source that needs kubernetes, now that there is a client
+func (m *credentialManager) init(k8sclient kubernetes.Interface) error {
+	p, ok := m.provider.(kubernetesCredentialProvider)
+	if !ok {
+		return nil
+	}
+	p.setKubernetes(k8sclient)
+	return m.load(context.Background())
+}
+
+func (m *credentialManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *credentialManager) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch read the auth token from its source again every refresh interval
+func (m *credentialManager) watch(ctx context.Context) error {
+	if m.provider == nil {
+		return nil
+	}
+	klog.Infof("reading auth token from %s every %s", m.provider, m.refresh)
+	go wait.Until(func() {
+		if err := m.load(ctx); err != nil {
+			klog.Errorf("keeping the last auth token: %v", err)
+		}
+	}, m.refresh, ctx.Done())
+	return nil
+}
+
+// load read the auth token from its source, and use it from now on
+func (m *credentialManager) load(ctx context.Context) error {
+	if m.provider == nil {
+		return nil
+	}
+	m.loading.Lock()
+	defer m.loading.Unlock()
+	token, err := m.provider.token(ctx)
+	if err != nil {
+		authTokenRefreshFailed.Set(1)
+		return fmt.Errorf("unable to read auth token from %s: %w", m.provider, err)
+	}
+	if token == "" {
+		authTokenRefreshFailed.Set(1)
+		return fmt.Errorf("empty auth token from %s", m.provider)
+	}
+	authTokenRefreshFailed.Set(0)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.current != "" && m.current != token {
+		klog.Infof("auth token from %s changed, using the new one", m.provider)
+	}
+	m.current = token
+	return nil
+}
+
+// token the current auth token
+func (m *credentialManager) token() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.current
+}
+
+// credentialRoundTripper set the current auth token on each request to the Equinix Metal API, rather
+// than the one the client was created with, so that it follows rotations
+type credentialRoundTripper struct {
+	credentials *credentialManager
+	next        http.RoundTripper
+}
+
+func (t *credentialRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if token := t.credentials.token(); token != "" && req.Header.Get("X-Auth-Token") != token {
+		req = req.Clone(req.Context())
+		req.Header.Set("X-Auth-Token", token)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// loadAuthToken the auth token of the config, or, with a source, the one read from it, for commands
+// that only need it once, e.g. check; a secret cannot be read without a kubernetes client
+func loadAuthToken(ctx context.Context, config Config) (string, error) {
+	m, err := newCredentialManager(config)
+	if err != nil {
+		return "", err
+	}
+	if err := m.load(ctx); err != nil {
+		return "", err
+	}
+	return m.token(), nil
+}
@@ -0,0 +1,89 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// authTokenSourceAWS the auth token is a secret in AWS Secrets Manager, or a key of its JSON
+	authTokenSourceAWS = "aws"
+	// awsRequestTimeout the longest a request to AWS may take
+	awsRequestTimeout = 10 * time.Second
+	// awsSessionName the name of the session of the role assumed with a web identity
+	awsSessionName = "cloud-provider-equinix-metal"
+)
+
+// awsCredentials read the auth token from a secret in AWS Secrets Manager, via the AWS SDK. It
+// authenticates with the credentials the SDK finds, e.g. the access key in AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, or, with AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE, assumes that role
+// with the web identity token in the file, and again before the session expires.
+type awsCredentials struct {
+	secretID string
+	key      string
+	region   string
+	client   secretsmanageriface.SecretsManagerAPI
+}
+
+func newAWSCredentials(secretID, key, region string) (*awsCredentials, error) {
+	return newAWSCredentialsWithConfig(secretID, key, aws.NewConfig().WithRegion(region))
+}
+
+// newAWSCredentialsWithConfig the AWS credentials, with the given config of the AWS clients, e.g.
+// with the endpoint of a test server
+func newAWSCredentialsWithConfig(secretID, key string, config *aws.Config) (*awsCredentials, error) {
+	sess, err := session.NewSession(config.WithHTTPClient(&http.Client{Timeout: awsRequestTimeout}))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AWS session: %w", err)
+	}
+	if roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); roleARN != "" && tokenFile != "" {
+		provider := stscreds.NewWebIdentityRoleProvider(sts.New(sess), roleARN, awsSessionName, tokenFile)
+		sess = sess.Copy(aws.NewConfig().WithCredentials(credentials.NewCredentials(provider)))
+	}
+	return &awsCredentials{
+		secretID: secretID,
+		key:      key,
+		region:   aws.StringValue(config.Region),
+		client:   secretsmanager.New(sess),
+	}, nil
+}
+
+func (a *awsCredentials) String() string {
+	if a.key == "" {
+		return fmt.Sprintf("%s:%s in %s", authTokenSourceAWS, a.secretID, a.region)
+	}
+	return fmt.Sprintf("%s:%s#%s in %s", authTokenSourceAWS, a.secretID, a.key, a.region)
+}
+
+func (a *awsCredentials) token(ctx context.Context) (string, error) {
+	answer, err := a.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(a.secretID)})
+	if err != nil {
+		return "", fmt.Errorf("unable to get AWS secret %s: %w", a.secretID, err)
+	}
+	value := aws.StringValue(answer.SecretString)
+	if a.key == "" {
+		return strings.TrimSpace(value), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("AWS secret %s is not a JSON object with key %s", a.secretID, a.key)
+	}
+	field, ok := fields[a.key].(string)
+	if !ok {
+		return "", fmt.Errorf("AWS secret %s has no string key %s", a.secretID, a.key)
+	}
+	return strings.TrimSpace(field), nil
+}
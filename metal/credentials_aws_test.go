@@ -0,0 +1,159 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// setTestEnv set the env vars, and unset all others of the names, returning how to restore them
+func setTestEnv(names []string, env map[string]string) func() {
+	previous := map[string]string{}
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			previous[name] = value
+		}
+		if value, ok := env[name]; ok {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+	return func() {
+		for _, name := range names {
+			if value, ok := previous[name]; ok {
+				os.Setenv(name, value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+}
+
+func TestAWSCredentials(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "aws")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("service-account-jwt"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var assumed int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "" {
+			_ = r.ParseForm()
+			if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/ccm" || r.Form.Get("WebIdentityToken") != "service-account-jwt" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`<ErrorResponse><Error><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`))
+				return
+			}
+			assumed++
+			expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+			_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>` +
+				`<AccessKeyId>ASIAROLE</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey><SessionToken>role-session</SessionToken>` +
+				`<Expiration>` + expiration + `</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		signed := (strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDSTATIC/") && r.Header.Get("X-Amz-Security-Token") == "") ||
+			(strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=ASIAROLE/") && r.Header.Get("X-Amz-Security-Token") == "role-session")
+		if !signed || !strings.Contains(auth, "/us-east-1/secretsmanager/aws4_request") || r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"UnrecognizedClientException","message":"The security token included in the request is invalid."}`))
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch body["SecretId"] {
+		case "metal-token":
+			_, _ = w.Write([]byte(`{"Name":"metal-token","SecretString":"metal-token-1\n"}`))
+		case "metal":
+			_, _ = w.Write([]byte(`{"Name":"metal","SecretString":"{\"token\":\"metal-token-2\"}"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`))
+		}
+	}))
+	defer ts.Close()
+
+	names := []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE",
+		"AWS_PROFILE", "AWS_SDK_LOAD_CONFIG", "AWS_SHARED_CREDENTIALS_FILE", "AWS_CONFIG_FILE", "AWS_EC2_METADATA_DISABLED"}
+	none := map[string]string{"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(dir, "missing"), "AWS_CONFIG_FILE": filepath.Join(dir, "missing"), "AWS_EC2_METADATA_DISABLED": "true"}
+	withEnv := func(env map[string]string) map[string]string {
+		all := map[string]string{}
+		for _, e := range []map[string]string{none, env} {
+			for name, value := range e {
+				all[name] = value
+			}
+		}
+		return all
+	}
+	static := withEnv(map[string]string{"AWS_ACCESS_KEY_ID": "AKIDSTATIC", "AWS_SECRET_ACCESS_KEY": "static-secret"})
+	role := withEnv(map[string]string{"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/ccm", "AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile})
+	config := func() *aws.Config {
+		return aws.NewConfig().WithRegion("us-east-1").WithEndpoint(ts.URL).WithMaxRetries(0)
+	}
+	tests := []struct {
+		secretID string
+		key      string
+		env      map[string]string
+		expected string
+		err      bool
+	}{
+		{"metal-token", "", static, "metal-token-1", false},
+		{"metal", "token", role, "metal-token-2", false},
+		{"metal", "other", static, "", true},
+		{"metal-token", "token", static, "", true},
+		{"missing", "", static, "", true},
+		{"metal-token", "", withEnv(map[string]string{"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/other", "AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile}), "", true},
+		{"metal-token", "", none, "", true},
+	}
+	for i, tt := range tests {
+		restore := setTestEnv(names, tt.env)
+		provider, err := newAWSCredentialsWithConfig(tt.secretID, tt.key, config())
+		if err != nil {
+			restore()
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		token, err := provider.token(ctx)
+		restore()
+		if (err != nil) != tt.err || token != tt.expected {
+			t.Errorf("%d: mismatched token, actual %q %v expected %q error %v", i, token, err, tt.expected, tt.err)
+		}
+	}
+
+	// the role is assumed again only once its session is about to expire
+	assumed = 0
+	restore := setTestEnv(names, role)
+	defer restore()
+	provider, err := newAWSCredentialsWithConfig("metal", "token", config())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := provider.token(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if assumed != 1 {
+		t.Errorf("mismatched roles assumed, actual %d expected 1", assumed)
+	}
+
+	// without a region, there is no provider
+	if _, err := newCredentialProvider(Config{AuthTokenSource: "aws:metal-token"}); err == nil {
+		t.Errorf("expected error without an AWS region")
+	}
+}
@@ -0,0 +1,286 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseAuthTokenSource(t *testing.T) {
+	tests := []struct {
+		setting  string
+		expected *authTokenSource
+		err      bool
+	}{
+		{"", nil, false},
+		{"file:/etc/metal/token", &authTokenSource{kind: authTokenSourceFile, location: "/etc/metal/token"}, false},
+		{"secret:kube-system/metal-cloud-config/apiKey", &authTokenSource{kind: authTokenSourceSecret, location: "kube-system/metal-cloud-config", key: "apiKey"}, false},
+		{"vault:/secret/data/metal/#token", &authTokenSource{kind: authTokenSourceVault, location: "secret/data/metal", key: "token"}, false},
+		{"file:", nil, true},
+		{"secret:kube-system/metal-cloud-config", nil, true},
+		{"secret:kube-system//apiKey", nil, true},
+		{"vault:secret/data/metal", nil, true},
+		{"vault:#token", nil, true},
+		{"aws:metal-token", &authTokenSource{kind: authTokenSourceAWS, location: "metal-token"}, false},
+		{"aws:arn:aws:secretsmanager:us-east-1:123456789012:secret:metal#token", &authTokenSource{kind: authTokenSourceAWS, location: "arn:aws:secretsmanager:us-east-1:123456789012:secret:metal", key: "token"}, false},
+		{"aws:#token", nil, true},
+		{"aws:metal-token#", nil, true},
+		{"gcp:metal-token", nil, true},
+		{"/etc/metal/token", nil, true},
+	}
+	for i, tt := range tests {
+		source, err := parseAuthTokenSource(tt.setting)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched error, actual %v expected error %v", i, err, tt.err)
+			continue
+		}
+		if (source == nil) != (tt.expected == nil) || (source != nil && *source != *tt.expected) {
+			t.Errorf("%d: mismatched source, actual %v expected %v", i, source, tt.expected)
+		}
+	}
+}
+
+func TestSecretCredentials(t *testing.T) {
+	ctx := context.Background()
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "metal-cloud-config"},
+		Data:       map[string][]byte{"apiKey": []byte("token-1\n")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	m, err := newCredentialManager(Config{AuthTokenSource: "secret:kube-system/metal-cloud-config/apiKey"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// not before there is a kubernetes client
+	if _, err := loadAuthToken(ctx, Config{AuthTokenSource: "secret:kube-system/metal-cloud-config/apiKey"}); err == nil {
+		t.Errorf("expected error reading secret without a kubernetes client")
+	}
+	if err := m.init(client); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token := m.token(); token != "token-1" {
+		t.Errorf("mismatched token, actual %q expected token-1", token)
+	}
+
+	// a rotated token is used after the next refresh; a failed one keeps the last
+	secret.Data["apiKey"] = []byte("token-2")
+	if _, err := client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.load(ctx); err != nil || m.token() != "token-2" {
+		t.Errorf("mismatched rotated token, actual %q %v expected token-2", m.token(), err)
+	}
+	delete(secret.Data, "apiKey")
+	if _, err := client.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.load(ctx); err == nil || m.token() != "token-2" {
+		t.Errorf("mismatched token after failed refresh, actual %q %v expected token-2 and error", m.token(), err)
+	}
+}
+
+func TestVaultCredentials(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jwtPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(jwtPath, []byte("service-account-jwt"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var logins, renewals int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/kubernetes/login", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["role"] != "ccm" || body["jwt"] != "service-account-jwt" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		logins++
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"vault-token","lease_duration":3600,"renewable":true}}`))
+	})
+	mux.HandleFunc("/v1/auth/token/renew-self", func(w http.ResponseWriter, r *http.Request) {
+		renewals++
+		_, _ = w.Write([]byte(`{"auth":{"client_token":"static-token","lease_duration":3600,"renewable":true}}`))
+	})
+	mux.HandleFunc("/v1/secret/data/metal", func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Vault-Token"); token != "vault-token" && token != "static-token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"token":"metal-token-v2"},"metadata":{"version":3}}}`))
+	})
+	mux.HandleFunc("/v1/kv/metal", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"token":"metal-token-v1"}}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		config   Config
+		expected string
+		err      bool
+	}{
+		{Config{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL, VaultRole: "ccm"}, "metal-token-v2", false},
+		{Config{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL + "/", VaultToken: "static-token"}, "metal-token-v2", false},
+		{Config{AuthTokenSource: "vault:kv/metal#token", VaultAddress: ts.URL, VaultToken: "static-token"}, "metal-token-v1", false},
+		{Config{AuthTokenSource: "vault:secret/data/metal#other", VaultAddress: ts.URL, VaultRole: "ccm"}, "", true},
+		{Config{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL, VaultRole: "other"}, "", true},
+		{Config{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL, VaultToken: "wrong"}, "", true},
+	}
+	for i, tt := range tests {
+		provider, err := newCredentialProvider(tt.config)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		provider.(*vaultCredentials).jwtPath = jwtPath
+		token, err := provider.token(ctx)
+		if (err != nil) != tt.err || token != tt.expected {
+			t.Errorf("%d: mismatched token, actual %q %v expected %q error %v", i, token, err, tt.expected, tt.err)
+		}
+	}
+
+	// the Vault token is reused for half its lease, rather than logging in or renewing on each read
+	logins, renewals = 0, 0
+	for _, config := range []Config{
+		{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL, VaultRole: "ccm"},
+		{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL, VaultToken: "static-token"},
+	} {
+		provider, _ := newCredentialProvider(config)
+		provider.(*vaultCredentials).jwtPath = jwtPath
+		for i := 0; i < 3; i++ {
+			if _, err := provider.token(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	if logins != 1 || renewals != 1 {
+		t.Errorf("mismatched logins and renewals, actual %d and %d expected 1 each", logins, renewals)
+	}
+
+	// without an address or a way to authenticate, there is no provider
+	for i, config := range []Config{
+		{AuthTokenSource: "vault:secret/data/metal#token", VaultRole: "ccm"},
+		{AuthTokenSource: "vault:secret/data/metal#token", VaultAddress: ts.URL},
+	} {
+		if _, err := newCredentialProvider(config); err == nil {
+			t.Errorf("%d: expected error for incomplete Vault config", i)
+		}
+	}
+}
+
+func TestVaultTokenRenewal(t *testing.T) {
+	ctx := context.Background()
+	var status int
+	var answer string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(answer))
+	}))
+	defer ts.Close()
+
+	// only a refusal, or a token that is not renewable, stops the renewals; any other failure is retried later
+	tests := []struct {
+		status      int
+		answer      string
+		unrenewable bool
+		retry       bool
+	}{
+		{http.StatusOK, `{"auth":{"client_token":"static-token","lease_duration":3600,"renewable":true}}`, false, false},
+		{http.StatusOK, `{"auth":{"client_token":"static-token","renewable":false}}`, true, false},
+		{http.StatusBadRequest, `{"errors":["lease is not renewable"]}`, true, false},
+		{http.StatusForbidden, `{"errors":["permission denied"]}`, true, false},
+		{http.StatusInternalServerError, `{"errors":["internal error"]}`, false, true},
+		{http.StatusServiceUnavailable, ``, false, true},
+	}
+	for i, tt := range tests {
+		status, answer = tt.status, tt.answer
+		v := &vaultCredentials{address: ts.URL, vaultToken: "static-token", httpClient: ts.Client()}
+		if err := v.authenticate(ctx); err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if v.unrenewable != tt.unrenewable {
+			t.Errorf("%d: mismatched unrenewable, actual %v expected %v", i, v.unrenewable, tt.unrenewable)
+		}
+		if retry := v.renewFailures > 0 && v.renewAt.After(time.Now()); retry != tt.retry {
+			t.Errorf("%d: mismatched retry, actual %v expected %v", i, retry, tt.retry)
+		}
+	}
+
+	// a timeout is retried, with backoff
+	v := &vaultCredentials{address: "http://127.0.0.1:1", vaultToken: "static-token", httpClient: &http.Client{Timeout: time.Second}}
+	for i := 1; i <= 2; i++ {
+		v.renewAt = time.Time{}
+		_ = v.authenticate(ctx)
+		if v.unrenewable || v.renewFailures != i {
+			t.Errorf("%d: mismatched failures, actual %d unrenewable %v expected %d", i, v.renewFailures, v.unrenewable, i)
+		}
+	}
+	if backoff := vaultRenewBackoff(2); backoff != 2*vaultRenewRetryMin {
+		t.Errorf("mismatched backoff, actual %v expected %v", backoff, 2*vaultRenewRetryMin)
+	}
+	if backoff := vaultRenewBackoff(100); backoff != vaultRenewRetryMax {
+		t.Errorf("mismatched backoff, actual %v expected %v", backoff, vaultRenewRetryMax)
+	}
+}
+
+func TestCredentialRoundTripper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("token-1"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var seen []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("X-Auth-Token"))
+		_, _ = w.Write([]byte(`{"projects":[]}`))
+	}))
+	defer ts.Close()
+
+	m, err := newCredentialManager(Config{AuthToken: "static", AuthTokenSource: "file:" + path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.load(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var faults *faultInjector
+	client := faults.newPacketClient("static", m)
+	client.BaseURL, _ = client.BaseURL.Parse(ts.URL + "/")
+	if _, _, err := client.Projects.List(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("token-2\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.load(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := client.Projects.List(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(seen) != 2 || seen[0] != "token-1" || seen[1] != "token-2" {
+		t.Errorf("mismatched tokens of requests, actual %v expected token-1, token-2", seen)
+	}
+}
@@ -2,27 +2,63 @@ package metal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/packethost/packngo"
 	"github.com/packethost/packngo/metadata"
 	"github.com/pkg/errors"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 )
 
+const (
+	// labelHardwareReserved whether the node is a device on reserved hardware, true or false,
+	// so that autoscalers and schedulers can prefer reserved capacity
+	labelHardwareReserved = "metal.equinix.com/hardware-reserved"
+
+	eventReasonNodeAddressesChanged = "NodeAddressesChanged"
+)
+
 type instances struct {
-	client  *packngo.Client
-	project string
+	client    *packngo.Client
+	project   string
+	k8sclient kubernetes.Interface
+	recorder  record.EventRecorder
+	// ipv6 whether to include the IPv6 addresses of devices in the node addresses, for dual-stack clusters
+	ipv6 bool
+	// deletionConfirmations how many not found answers in a row delete a node, see confirmNotFound;
+	// deletionDisabled never report a device as not found by its provider ID, so that no node is deleted
+	deletionConfirmations int
+	deletionDisabled      bool
+	// notFoundLock protects notFound, how many not found answers in a row each node got so far
+	notFoundLock sync.Mutex
+	notFound     map[string]int
 }
 
-func newInstances(client *packngo.Client, projectID string) *instances {
-	return &instances{client, projectID}
+func newInstances(client *packngo.Client, projectID string, ipv6 bool, deletionConfirmations int, deletionDisabled bool) *instances {
+	if deletionConfirmations < 1 {
+		deletionConfirmations = 1
+	}
+	return &instances{
+		client:                client,
+		project:               projectID,
+		ipv6:                  ipv6,
+		deletionConfirmations: deletionConfirmations,
+		deletionDisabled:      deletionDisabled,
+		notFound:              map[string]int{},
+	}
 }
 
 // cloudService implementation
@@ -30,10 +66,12 @@ func (i *instances) name() string {
 	return "instances"
 }
 func (i *instances) init(k8sclient kubernetes.Interface) error {
+	i.k8sclient = k8sclient
+	i.recorder = newEventRecorder(k8sclient)
 	return nil
 }
 func (i *instances) nodeReconciler() nodeReconciler {
-	return nil
+	return i.reconcileNodes
 }
 func (i *instances) serviceReconciler() serviceReconciler {
 	return nil
@@ -49,7 +87,7 @@ func (i *instances) NodeAddresses(_ context.Context, name types.NodeName) ([]v1.
 		return nil, err
 	}
 
-	return nodeAddresses(device)
+	return nodeAddresses(device, i.ipv6)
 }
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
@@ -64,10 +102,13 @@ func (i *instances) NodeAddressesByProviderID(_ context.Context, providerID stri
 		return nil, err
 	}
 
-	return nodeAddresses(device)
+	return nodeAddresses(device, i.ipv6)
 }
 
-func nodeAddresses(device *packngo.Device) ([]v1.NodeAddress, error) {
+// nodeAddresses the hostname, and the private and public IPv4 addresses of the device as the internal and
+// external IPs. With ipv6, the private and public IPv6 addresses follow, as internal and external IPs too;
+// they come after the IPv4 addresses, so that the first internal IP, which the kubelet uses, stays IPv4.
+func nodeAddresses(device *packngo.Device, ipv6 bool) ([]v1.NodeAddress, error) {
 	var addresses []v1.NodeAddress
 	addresses = append(addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: device.Hostname})
 
@@ -85,6 +126,18 @@ func nodeAddresses(device *packngo.Device) ([]v1.NodeAddress, error) {
 			addresses = append(addresses, v1.NodeAddress{Type: addrType, Address: address.Address})
 		}
 	}
+	if ipv6 {
+		for _, address := range device.Network {
+			if address.AddressFamily != int(metadata.IPv6) {
+				continue
+			}
+			addrType := v1.NodeInternalIP
+			if address.Public {
+				addrType = v1.NodeExternalIP
+			}
+			addresses = append(addresses, v1.NodeAddress{Type: addrType, Address: address.Address})
+		}
+	}
 
 	if privateIP == "" {
 		return nil, errors.New("could not get at least one private ip")
@@ -130,7 +183,7 @@ func (i *instances) InstanceType(_ context.Context, nodeName types.NodeName) (st
 		return "", err
 	}
 
-	return device.Plan.Name, nil
+	return device.Plan.Slug, nil
 }
 
 // InstanceTypeByProviderID returns the type of the specified instance.
@@ -141,7 +194,7 @@ func (i *instances) InstanceTypeByProviderID(_ context.Context, providerID strin
 		return "", err
 	}
 
-	return device.Plan.Name, nil
+	return device.Plan.Slug, nil
 }
 
 // AddSSHKeyToAllInstances adds an SSH public key as a legal identity for all instances
@@ -159,16 +212,18 @@ func (i *instances) CurrentNodeName(_ context.Context, nodeName string) (types.N
 }
 
 // InstanceExistsByProviderID returns true if the instance for the given provider id still is running.
-// If false is returned with no error, the instance will be immediately deleted by the cloud controller manager.
+// If false is returned with no error, the instance will be immediately deleted by the cloud controller manager,
+// so it is only returned once the device was confirmed to be gone, see confirmNotFound.
 func (i *instances) InstanceExistsByProviderID(_ context.Context, providerID string) (bool, error) {
 	klog.V(2).Infof("called InstanceExistsByProviderID with providerID %s", providerID)
 	_, err := i.deviceFromProviderID(providerID)
 	switch {
 	case err != nil && err == cloudprovider.InstanceNotFound:
-		return false, nil
+		return i.confirmNotFound(providerID)
 	case err != nil:
 		return false, err
 	}
+	i.forgetNotFound(providerID)
 
 	return true, nil
 }
@@ -187,10 +242,13 @@ func (i *instances) InstanceShutdownByProviderID(_ context.Context, providerID s
 func deviceByID(client *packngo.Client, id string) (*packngo.Device, error) {
 	klog.V(2).Infof("called deviceByID with ID %s", id)
 	device, _, err := client.Devices.Get(id, nil)
-	if isNotFound(err) {
+	switch {
+	case isNotFound(err):
 		return nil, cloudprovider.InstanceNotFound
+	case err != nil:
+		return nil, wrapAPIError(err)
 	}
-	return device, err
+	return device, nil
 }
 
 // deviceByName returns an instance whose hostname matches the kubernetes node.Name
@@ -201,18 +259,25 @@ func deviceByName(client *packngo.Client, projectID string, nodeName types.NodeN
 	}
 	devices, _, err := client.Devices.List(projectID, nil)
 	if err != nil {
-		return nil, err
+		return nil, wrapAPIError(err)
 	}
 
-	for _, device := range devices {
-		if device.Hostname == string(nodeName) {
-			klog.V(2).Infof("Found device for nodeName %s", nodeName)
-			klog.V(3).Infof("%#v", device)
-			return &device, nil
+	var found *packngo.Device
+	for i, device := range devices {
+		if device.Hostname != string(nodeName) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: devices %s and %s both have hostname %s", ErrAmbiguous, found.ID, device.ID, nodeName)
 		}
+		found = &devices[i]
 	}
-
-	return nil, cloudprovider.InstanceNotFound
+	if found == nil {
+		return nil, cloudprovider.InstanceNotFound
+	}
+	klog.V(2).Infof("Found device for nodeName %s", nodeName)
+	klog.V(3).Infof("%#v", *found)
+	return found, nil
 }
 
 // deviceIDFromProviderID returns a device's ID from providerID.
@@ -242,6 +307,137 @@ func deviceIDFromProviderID(providerID string) (string, error) {
 	return deviceID, nil
 }
 
+// reconcileNodes label each node with whether its device is on reserved hardware, and with its rack, and, on a full
+// sync, refresh its addresses if those of its device changed, e.g. after a network conversion,
+// and report the state of its device.
+// A device stays on the hardware it was provisioned on, so a node that has the label already is not labeled again.
+func (i *instances) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+	if mode == ModeRemove {
+		// a removed node no longer needs its not found answers counted
+		for _, node := range nodes {
+			i.forgetNotFound(node.Spec.ProviderID)
+		}
+		return nil
+	}
+	// on a full sync, one list of the devices instead of a get per node
+	var devices map[string]*packngo.Device
+	if mode == ModeSync {
+		list, _, err := i.client.Devices.List(i.project, nil)
+		if err != nil {
+			return fmt.Errorf("unable to list devices: %w", wrapAPIError(err))
+		}
+		devices = map[string]*packngo.Device{}
+		for j := range list {
+			devices[list[j].ID] = &list[j]
+		}
+	}
+	var errs []error
+	for _, node := range nodes {
+		if node.Spec.ProviderID == "" {
+			continue
+		}
+		_, labeled := node.Labels[labelHardwareReserved]
+		if labeled && mode != ModeSync {
+			continue
+		}
+		var device *packngo.Device
+		if devices != nil {
+			id, err := deviceIDFromProviderID(node.Spec.ProviderID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to get device for node %s: %w", node.Name, err))
+				continue
+			}
+			// a node without a device is deleted by the node lifecycle controller
+			if device = devices[id]; device == nil {
+				continue
+			}
+		} else {
+			var err error
+			if device, err = i.deviceFromProviderID(node.Spec.ProviderID); err != nil {
+				errs = append(errs, fmt.Errorf("unable to get device for node %s: %w", node.Name, err))
+				continue
+			}
+		}
+		if !labeled {
+			if err := i.labelHardwareReserved(ctx, node, device); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if _, racked := node.Labels[labelRack]; !racked && device.SwitchUUID != "" {
+			if err := i.labelNodeRack(ctx, node, device); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if mode == ModeSync {
+			if err := i.refreshNodeAddresses(ctx, node, device); err != nil {
+				errs = append(errs, err)
+			}
+			if err := i.setDeviceState(ctx, node, device); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// labelHardwareReserved label the node with whether its device is on reserved hardware
+func (i *instances) labelHardwareReserved(ctx context.Context, node *v1.Node, device *packngo.Device) error {
+	reserved := strconv.FormatBool(device.HardwareReservation.Href != "")
+	mergePatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{labelHardwareReserved: reserved},
+		},
+	})
+	if err := patchUpdatedNode(ctx, node.Name, mergePatch, i.k8sclient); err != nil {
+		return err
+	}
+	klog.V(2).Infof("labeled node %s with %s=%s", node.Name, labelHardwareReserved, reserved)
+	return nil
+}
+
+// refreshNodeAddresses update the addresses in the node status if the IP addresses of its device changed,
+// e.g. because its network was converted between hybrid and layer3, so that the apiserver does not keep
+// reaching the kubelet on an address that is gone until the next cloud node status update
+func (i *instances) refreshNodeAddresses(ctx context.Context, node *v1.Node, device *packngo.Device) error {
+	addresses, err := nodeAddresses(device, i.ipv6)
+	if err != nil {
+		// e.g. in the middle of a conversion; try again on the next sync
+		klog.V(2).Infof("not refreshing addresses of node %s: %v", node.Name, err)
+		return nil
+	}
+	previous := nodeIPAddresses(node.Status.Addresses)
+	current := nodeIPAddresses(addresses)
+	if previous == current {
+		return nil
+	}
+	// a merge patch replaces the addresses as a whole; a strategic merge patch would merge
+	// them by type, of which a node may have several
+	mergePatch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"addresses": addresses},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode addresses of node %s: %w", node.Name, err)
+	}
+	if _, err := i.k8sclient.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, mergePatch, metav1.PatchOptions{}, "status"); err != nil {
+		return fmt.Errorf("unable to refresh addresses of node %s: %w", node.Name, err)
+	}
+	klog.Infof("refreshed addresses of node %s, network type %s, from %s to %s", node.Name, device.GetNetworkType(), previous, current)
+	i.recorder.Eventf(node, v1.EventTypeNormal, eventReasonNodeAddressesChanged, "device addresses changed from %s to %s, network type %s", previous, current, device.GetNetworkType())
+	return nil
+}
+
+// nodeIPAddresses the internal and external IP addresses, sorted, as a string to compare and report
+func nodeIPAddresses(addresses []v1.NodeAddress) string {
+	var ips []string
+	for _, address := range addresses {
+		if address.Type == v1.NodeInternalIP || address.Type == v1.NodeExternalIP {
+			ips = append(ips, fmt.Sprintf("%s=%s", address.Type, address.Address))
+		}
+	}
+	sort.Strings(ips)
+	return strings.Join(ips, ",")
+}
+
 // deviceFromProviderID uses providerID to get the device id and return the device
 func (i *instances) deviceFromProviderID(providerID string) (*packngo.Device, error) {
 	klog.V(2).Infof("called deviceFromProviderID with providerID %s", providerID)
@@ -0,0 +1,112 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodeConditionDeviceActive whether the device of a node is active, with the state of the
+	// device as the reason, so that kubectl users see its lifecycle without access to the API
+	nodeConditionDeviceActive v1.NodeConditionType = "metal.equinix.com/DeviceActive"
+	// annotationDeviceState the state of the device of a node, as the Equinix Metal API reports it
+	annotationDeviceState = "metal.equinix.com/device-state"
+
+	deviceStateActive = "active"
+)
+
+// deviceStateReason the state of a device as a CamelCase reason, e.g. Provisioning or PoweringOff
+func deviceStateReason(state string) string {
+	if state == "" {
+		return "Unknown"
+	}
+	var reason strings.Builder
+	for _, word := range strings.Split(state, "_") {
+		if word != "" {
+			reason.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return reason.String()
+}
+
+// nodeCondition the condition of the node of the given type, nil if it has none
+func nodeCondition(node *v1.Node, conditionType v1.NodeConditionType) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setDeviceState report the state of the device of the node in its DeviceActive condition and its
+// device state annotation, e.g. provisioning, active, rebooting or deprovisioning. Each is only
+// written if it changed.
+func (i *instances) setDeviceState(ctx context.Context, node *v1.Node, device *packngo.Device) error {
+	if node.Annotations[annotationDeviceState] != device.State {
+		mergePatch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{annotationDeviceState: device.State},
+			},
+		})
+		if err := patchUpdatedNode(ctx, node.Name, mergePatch, i.k8sclient); err != nil {
+			return err
+		}
+	}
+
+	status := v1.ConditionFalse
+	if device.State == deviceStateActive {
+		status = v1.ConditionTrue
+	}
+	written, err := setNodeCondition(ctx, i.k8sclient, node, nodeConditionDeviceActive, status, deviceStateReason(device.State), fmt.Sprintf("device %s is %s", device.ID, device.State))
+	if err != nil {
+		return err
+	}
+	if written {
+		klog.V(2).Infof("device %s of node %s is %s", device.ID, node.Name, device.State)
+	}
+	return nil
+}
+
+// setNodeCondition set a condition in the status of a node, unless the node already has it with the
+// same status, reason and message, returning whether it was written. Conditions are merged by type,
+// so this leaves those of the kubelet and others alone.
+func setNodeCondition(ctx context.Context, client kubernetes.Interface, node *v1.Node, conditionType v1.NodeConditionType, status v1.ConditionStatus, reason, message string) (bool, error) {
+	now := metav1.NewTime(time.Now())
+	condition := v1.NodeCondition{
+		Type:               conditionType,
+		Status:             status,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	}
+	if existing := nodeCondition(node, conditionType); existing != nil {
+		if existing.Status == status && existing.Reason == reason && existing.Message == message {
+			return false, nil
+		}
+		if existing.Status == status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"conditions": []v1.NodeCondition{condition}},
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to encode condition %s of node %s: %w", conditionType, node.Name, err)
+	}
+	if _, err := client.CoreV1().Nodes().Patch(ctx, node.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+		return false, fmt.Errorf("unable to set condition %s of node %s: %w", conditionType, node.Name, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,94 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeviceStateReason(t *testing.T) {
+	tests := []struct {
+		state  string
+		reason string
+	}{
+		{"active", "Active"},
+		{"provisioning", "Provisioning"},
+		{"powering_off", "PoweringOff"},
+		{"", "Unknown"},
+	}
+
+	for i, tt := range tests {
+		if reason := deviceStateReason(tt.state); reason != tt.reason {
+			t.Errorf("%d: mismatched reason, actual %q expected %q", i, reason, tt.reason)
+		}
+	}
+}
+
+func TestReconcileNodesDeviceState(t *testing.T) {
+	ctx := context.Background()
+	vc, backend := testGetValidCloud(t)
+	inst := newInstances(vc.client, projectID, false, 0, false)
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	devName := testGetNewDevName()
+	dev, _ := backend.CreateDevice(projectID, devName, plan, facility)
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: devName, Labels: map[string]string{labelHardwareReserved: "false"}},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://" + dev.ID},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+	}
+	client := fake.NewSimpleClientset(node)
+	if err := inst.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+
+	tests := []struct {
+		state  string
+		status v1.ConditionStatus
+		reason string
+	}{
+		{"active", v1.ConditionTrue, "Active"},
+		{"rebooting", v1.ConditionFalse, "Rebooting"},
+		{"deprovisioning", v1.ConditionFalse, "Deprovisioning"},
+	}
+
+	for i, tt := range tests {
+		dev.State = tt.state
+		if err := backend.UpdateDevice(dev.ID, dev); err != nil {
+			t.Fatalf("%d: unable to update device: %v", i, err)
+		}
+		if err := inst.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		updated, err := client.CoreV1().Nodes().Get(ctx, devName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: unable to get node: %v", i, err)
+		}
+		if updated.Annotations[annotationDeviceState] != tt.state {
+			t.Errorf("%d: mismatched device state annotation, actual %q expected %q", i, updated.Annotations[annotationDeviceState], tt.state)
+		}
+		condition := nodeCondition(updated, nodeConditionDeviceActive)
+		if condition == nil || condition.Status != tt.status || condition.Reason != tt.reason {
+			t.Errorf("%d: mismatched condition, actual %v expected status %s reason %s", i, condition, tt.status, tt.reason)
+		}
+		if ready := nodeCondition(updated, v1.NodeReady); ready == nil || ready.Status != v1.ConditionTrue {
+			t.Errorf("%d: ready condition lost, actual %v", i, ready)
+		}
+		node = updated
+	}
+
+	// unchanged, so not written again
+	client.ClearActions()
+	if err := inst.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" || action.GetVerb() == "patch" {
+			t.Errorf("unexpected %s of node with unchanged device state", action.GetVerb())
+		}
+	}
+}
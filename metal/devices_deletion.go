@@ -0,0 +1,45 @@
+package metal
+
+import (
+	"fmt"
+
+	"k8s.io/klog/v2"
+)
+
+// DefaultNodeDeletionConfirmations how many times in a row a device must be reported as not
+// found before its node may be deleted, so that a single bad answer of the API during an outage,
+// e.g. an empty device list, does not remove nodes
+const DefaultNodeDeletionConfirmations = 3
+
+// confirmNotFound record that the device of a node, identified by its provider ID,
+// was not found, and return whether it still is to be reported as existing. It is not once that
+// is confirmed, so that the node may be deleted. Until then, it returns an error, which keeps the node.
+// With node deletion disabled, the device is always reported as existing, without an error.
+//
+// Only a 404, or a successful list without the device, counts as not found; any other error of
+// the API is returned as it is, and neither confirms nor resets the count.
+func (i *instances) confirmNotFound(key string) (bool, error) {
+	if i.deletionDisabled {
+		klog.Warningf("device of node %s not found, not reporting it as deleted, since node deletion is disabled", key)
+		return true, nil
+	}
+	i.notFoundLock.Lock()
+	defer i.notFoundLock.Unlock()
+	i.notFound[key]++
+	count := i.notFound[key]
+	if count < i.deletionConfirmations {
+		klog.Warningf("device of node %s not found, %d of %d confirmations before reporting it as deleted", key, count, i.deletionConfirmations)
+		return false, fmt.Errorf("device of node %s not found, %d of %d confirmations", key, count, i.deletionConfirmations)
+	}
+	delete(i.notFound, key)
+	klog.Infof("device of node %s not found %d times in a row, reporting it as deleted", key, count)
+	return false, nil
+}
+
+// forgetNotFound forget the not found answers for the device of a node so far, once it was found,
+// or the node was removed
+func (i *instances) forgetNotFound(key string) {
+	i.notFoundLock.Lock()
+	defer i.notFoundLock.Unlock()
+	delete(i.notFound, key)
+}
@@ -1,13 +1,18 @@
 package metal
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/packethost/packngo"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 	cloudprovider "k8s.io/cloud-provider"
 )
 
@@ -141,7 +146,7 @@ func TestInstanceType(t *testing.T) {
 	devName := testGetNewDevName()
 	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
 	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
-	dev, _ := backend.CreateDevice(projectID, devName, plan, facility)
+	backend.CreateDevice(projectID, devName, plan, facility)
 
 	tests := []struct {
 		name string
@@ -150,7 +155,7 @@ func TestInstanceType(t *testing.T) {
 	}{
 		{"", "", fmt.Errorf("node name cannot be empty")},          // empty name
 		{"thisdoesnotexist", "", fmt.Errorf("instance not found")}, // unknown name
-		{devName, dev.Plan.Name, nil},                              // valid
+		{devName, validPlanSlug, nil},                              // valid
 	}
 
 	for i, tt := range tests {
@@ -181,8 +186,8 @@ func TestInstanceTypeByProviderID(t *testing.T) {
 		{"foo-bar-abcdefg", "", fmt.Errorf("instance not found")},                                    // invalid format
 		{"aws://abcdef5667", "", fmt.Errorf("provider name from providerID should be equinixmetal")}, // not equinixmetalk
 		{"equinixmetal://acbdef-56788", "", fmt.Errorf("instance not found")},                        // unknown ID
-		{fmt.Sprintf("equinixmetal://%s", dev.ID), dev.Plan.Name, nil},                               // valid
-		{fmt.Sprintf("packet://%s", dev.ID), dev.Plan.Name, nil},                                     // valid
+		{fmt.Sprintf("equinixmetal://%s", dev.ID), validPlanSlug, nil},                               // valid
+		{fmt.Sprintf("packet://%s", dev.ID), validPlanSlug, nil},                                     // valid
 	}
 
 	for i, tt := range tests {
@@ -315,3 +320,205 @@ func compareAddresses(a1, a2 []v1.NodeAddress) bool {
 	}
 
 }
+
+func TestReconcileNodesHardwareReserved(t *testing.T) {
+	vc, backend := testGetValidCloud(t)
+	inst := newInstances(vc.client, projectID, false, 0, false)
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	onDemand, _ := backend.CreateDevice(projectID, testGetNewDevName(), plan, facility)
+	reserved, _ := backend.CreateDevice(projectID, testGetNewDevName(), plan, facility)
+	reserved.HardwareReservation = packngo.Href{Href: "/hardware-reservations/abc"}
+	if err := backend.UpdateDevice(reserved.ID, reserved); err != nil {
+		t.Fatalf("unable to update device: %v", err)
+	}
+
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "on-demand"}, Spec: v1.NodeSpec{ProviderID: "equinixmetal://" + onDemand.ID}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "reserved"}, Spec: v1.NodeSpec{ProviderID: "equinixmetal://" + reserved.ID}},
+		// not yet initialized, so unknown device
+		{ObjectMeta: metav1.ObjectMeta{Name: "uninitialized"}},
+	}
+	objs := []runtime.Object{}
+	for _, node := range nodes {
+		objs = append(objs, node)
+	}
+	client := fake.NewSimpleClientset(objs...)
+	if err := inst.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	if err := inst.reconcileNodes(context.Background(), nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{"on-demand": "false", "reserved": "true", "uninitialized": ""}
+	for name, label := range expected {
+		node, err := client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get node %s: %v", name, err)
+		}
+		if actual := node.Labels[labelHardwareReserved]; actual != label {
+			t.Errorf("mismatched label for node %s, actual %q expected %q", name, actual, label)
+		}
+	}
+}
+
+func TestReconcileNodesRefreshAddresses(t *testing.T) {
+	ctx := context.Background()
+	vc, backend := testGetValidCloud(t)
+	inst := newInstances(vc.client, projectID, false, 0, false)
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	devName := testGetNewDevName()
+	dev, _ := backend.CreateDevice(projectID, devName, plan, facility)
+	// the addresses after a network conversion
+	networks := []*packngo.IPAddressAssignment{
+		testCreateAddress(false, false), // private ipv4
+		testCreateAddress(false, true),  // public ipv4
+	}
+	dev.Network = networks
+	if err := backend.UpdateDevice(dev.ID, dev); err != nil {
+		t.Fatalf("unable to update device: %v", err)
+	}
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: devName, Labels: map[string]string{labelHardwareReserved: "false"}},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://" + dev.ID},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: devName},
+			{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+			{Type: v1.NodeExternalIP, Address: "147.75.0.1"},
+		}},
+	}
+	client := fake.NewSimpleClientset(node)
+	if err := inst.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+
+	// not refreshed except on a full sync
+	if err := inst.reconcileNodes(ctx, []*v1.Node{node}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("unexpected actions on add of labeled node: %v", client.Actions())
+	}
+
+	if err := inst.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated, err := client.CoreV1().Nodes().Get(ctx, devName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get node: %v", err)
+	}
+	expected := []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: devName},
+		{Type: v1.NodeInternalIP, Address: networks[0].Address},
+		{Type: v1.NodeExternalIP, Address: networks[1].Address},
+	}
+	if !compareAddresses(updated.Status.Addresses, expected) {
+		t.Errorf("mismatched addresses, actual %v expected %v", updated.Status.Addresses, expected)
+	}
+
+	// unchanged, so not updated again
+	client.ClearActions()
+	if err := inst.reconcileNodes(ctx, []*v1.Node{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" || action.GetVerb() == "patch" {
+			t.Errorf("unexpected update of node with unchanged addresses")
+		}
+	}
+}
+
+func TestNodeAddressesIPv6(t *testing.T) {
+	privateIPv4 := testCreateAddress(false, false)
+	publicIPv4 := testCreateAddress(false, true)
+	publicIPv6 := testCreateAddress(true, true)
+	privateIPv6 := testCreateAddress(true, false)
+	device := &packngo.Device{
+		Hostname: "node-1",
+		// IPv6 first, to show the IPv4 addresses still come first
+		Network: []*packngo.IPAddressAssignment{publicIPv6, privateIPv6, privateIPv4, publicIPv4},
+	}
+
+	tests := []struct {
+		ipv6      bool
+		addresses []v1.NodeAddress
+	}{
+		{false, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: "node-1"},
+			{Type: v1.NodeInternalIP, Address: privateIPv4.Address},
+			{Type: v1.NodeExternalIP, Address: publicIPv4.Address},
+		}},
+		{true, []v1.NodeAddress{
+			{Type: v1.NodeHostName, Address: "node-1"},
+			{Type: v1.NodeInternalIP, Address: privateIPv4.Address},
+			{Type: v1.NodeExternalIP, Address: publicIPv4.Address},
+			{Type: v1.NodeExternalIP, Address: publicIPv6.Address},
+			{Type: v1.NodeInternalIP, Address: privateIPv6.Address},
+		}},
+	}
+	for i, tt := range tests {
+		addresses, err := nodeAddresses(device, tt.ipv6)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(addresses, tt.addresses) {
+			t.Errorf("%d: mismatched addresses, actual %v expected %v", i, addresses, tt.addresses)
+		}
+	}
+}
+
+func TestInstanceExistsConfirmations(t *testing.T) {
+	vc, backend := testGetValidCloud(t)
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	dev, _ := backend.CreateDevice(projectID, testGetNewDevName(), plan, facility)
+	missing := "equinixmetal://acbdef-56788"
+
+	// not found only once confirmed, and found in between starts over
+	inst := newInstances(vc.client, projectID, false, 3, false)
+	for i, tt := range []struct {
+		id     string
+		exists bool
+		err    bool
+	}{
+		{missing, false, true},
+		{missing, false, true},
+		{missing, false, false},
+		{missing, false, true},
+		{dev.ID, true, false},
+	} {
+		exists, err := inst.InstanceExistsByProviderID(nil, tt.id)
+		if exists != tt.exists || (err != nil) != tt.err {
+			t.Errorf("%d: mismatched exists %t and error %v, expected %t and error %t", i, exists, err, tt.exists, tt.err)
+		}
+	}
+
+	// only for deleting nodes: a node name is not found the first time
+	if _, err := inst.InstanceID(nil, "nonexistent"); err != cloudprovider.InstanceNotFound {
+		t.Errorf("mismatched error for missing device, actual %v expected not found", err)
+	}
+
+	// a removed node is forgotten
+	inst = newInstances(vc.client, projectID, false, 3, false)
+	if _, err := inst.InstanceExistsByProviderID(nil, missing); err == nil {
+		t.Errorf("missing device reported as not found unconfirmed")
+	}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Spec: v1.NodeSpec{ProviderID: missing}}
+	if err := inst.reconcileNodes(context.Background(), []*v1.Node{node}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(inst.notFound) != 0 {
+		t.Errorf("mismatched not found answers after removal, actual %v expected none", inst.notFound)
+	}
+
+	// with node deletion disabled, always exists
+	inst = newInstances(vc.client, projectID, false, 1, true)
+	for i := 0; i < 3; i++ {
+		if exists, err := inst.InstanceExistsByProviderID(nil, missing); !exists || err != nil {
+			t.Errorf("%d: mismatched exists %t and error %v with node deletion disabled, expected true and no error", i, exists, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// envKubernetesServicePort the port of the apiserver in the in-cluster config; as the CCM runs with
+// the host network, often set to that of the apiserver on the node, rather than of the service
+const envKubernetesServicePort = "KUBERNETES_SERVICE_PORT"
+
+// detectNodeAPIServerPort determine the port on which the apiserver listens on the control plane nodes
+// at startup, if the `default/kubernetes` service is unavailable, so that the EIP can still be moved
+// before the next full sync: from the endpoints of the service, or else from the in-cluster config.
+// If the service is available, its port is taken at the first sync, as always; a port detected
+// without it is replaced by that of the service once it is available.
+func (m *controlPlaneEndpointManager) detectNodeAPIServerPort(ctx context.Context) {
+	if m.nodeAPIServerPort != 0 || m.k8sclient == nil {
+		return
+	}
+	_, err := m.k8sclient.CoreV1().Services("default").Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err == nil {
+		return
+	}
+	port, source, fallbackErr := m.fallbackNodeAPIServerPort(ctx)
+	if fallbackErr != nil {
+		klog.Warningf("unable to detect apiserver port, will wait for service default/kubernetes: %v; %v", err, fallbackErr)
+		return
+	}
+	klog.Infof("service default/kubernetes unavailable, detected apiserver port %d from %s: %v", port, source, err)
+	m.nodeAPIServerPort = port
+	m.nodeAPIServerPortDetected = true
+}
+
+// fallbackNodeAPIServerPort the port on which the apiserver listens, without the `default/kubernetes`
+// service: that of its endpoints, which are the apiservers themselves, or else of the in-cluster config.
+// Returns the port, and where it came from.
+func (m *controlPlaneEndpointManager) fallbackNodeAPIServerPort(ctx context.Context) (int32, string, error) {
+	endpoints, err := m.k8sclient.CoreV1().Endpoints("default").Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err == nil {
+		for _, subset := range endpoints.Subsets {
+			for _, port := range subset.Ports {
+				if port.Port > 0 {
+					return port.Port, "endpoints default/kubernetes", nil
+				}
+			}
+		}
+		err = errors.New("endpoints default/kubernetes have no ports")
+	}
+	getenv := m.getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+	setting := getenv(envKubernetesServicePort)
+	if setting == "" {
+		return 0, "", fmt.Errorf("%v, and %s is not set", err, envKubernetesServicePort)
+	}
+	port, parseErr := strconv.ParseInt(setting, 10, 32)
+	if parseErr != nil || port < 1 || port > 65535 {
+		return 0, "", fmt.Errorf("%v, and %s is not a valid port: %s", err, envKubernetesServicePort, setting)
+	}
+	return int32(port), envKubernetesServicePort, nil
+}
@@ -0,0 +1,68 @@
+package metal
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDetectNodeAPIServerPort(t *testing.T) {
+	tests := []struct {
+		objects  []runtime.Object
+		env      string
+		port     int32
+		detected bool
+	}{
+		// the service is there, and its port is taken at the first sync
+		{[]runtime.Object{testKubernetesService(), testKubernetesEndpoints()}, "443", 0, false},
+		{[]runtime.Object{testKubernetesEndpoints()}, "443", 6443, true},
+		{nil, "6443", 6443, true},
+		{nil, "", 0, false},
+		{nil, "https", 0, false},
+		{[]runtime.Object{&v1.Endpoints{ObjectMeta: testKubernetesEndpoints().ObjectMeta}}, "7443", 7443, true},
+	}
+	for i, tt := range tests {
+		env := tt.env
+		m := newControlPlaneEndpointManager(Config{EIPTag: "eiptag", ProjectID: projectID}, nil, nil, nil)
+		m.getenv = func(key string) string {
+			if key == envKubernetesServicePort {
+				return env
+			}
+			return ""
+		}
+		if err := m.init(fake.NewSimpleClientset(tt.objects...)); err != nil {
+			t.Fatalf("%d: unexpected error initializing: %v", i, err)
+		}
+		if m.nodeAPIServerPort != tt.port || m.nodeAPIServerPortDetected != tt.detected {
+			t.Errorf("%d: mismatched port, actual %d/%t expected %d/%t", i, m.nodeAPIServerPort, m.nodeAPIServerPortDetected, tt.port, tt.detected)
+		}
+	}
+}
+
+func TestSetNodeAPIServerPortAfterDetected(t *testing.T) {
+	m := newControlPlaneEndpointManager(Config{EIPTag: "eiptag", ProjectID: projectID}, nil, nil, nil)
+	m.getenv = func(string) string { return "443" }
+	if err := m.init(fake.NewSimpleClientset()); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	m.recorder = recorder
+	if m.nodeAPIServerPort != 443 {
+		t.Fatalf("mismatched detected port, actual %d expected 443", m.nodeAPIServerPort)
+	}
+
+	// the port of the service replaces the detected one, without reporting it as a change of the apiserver
+	changed, err := m.setNodeAPIServerPort(testKubernetesService())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !changed || m.nodeAPIServerPort != 6443 || m.nodeAPIServerPortDetected {
+		t.Errorf("mismatched port, actual %d/%t changed %t, expected 6443 from the service", m.nodeAPIServerPort, m.nodeAPIServerPortDetected, changed)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected event: %s", <-recorder.Events)
+	}
+}
@@ -2,19 +2,30 @@ package metal
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"net/http"
+	"sync"
 	"time"
 
 	"errors"
 
 	"github.com/packethost/packngo"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	endpointsutil "k8s.io/kubernetes/pkg/api/v1/endpoints"
 )
 
 const (
@@ -23,6 +34,20 @@ const (
 	externalServiceNamespace = "kube-system"
 	metallbAnnotation        = "metallb.universe.tf/address-pool"
 	metallbDisabledtag       = "disabled-metallb-do-not-use-any-address-pool"
+	managedByLabel           = "app.kubernetes.io/managed-by"
+	managedByCCM             = "cloud-provider-equinix-metal"
+
+	eventReasonManagerConflict      = "ManagerConflict"
+	eventReasonEIPPortTranslation   = "EIPPortTranslationFailed"
+	eventReasonAPIServerPortChanged = "APIServerPortChanged"
+
+	// ipReservationsTTL how long the IP reservations are reused between reconcilers
+	ipReservationsTTL = checkLoopTimerSeconds / 2 * time.Second
+
+	// how the control plane endpoint is managed, see mode
+	controlPlaneEndpointDisabled = "disabled"
+	controlPlaneEndpointEIP      = "elastic-ip"
+	controlPlaneEndpointLB       = "load-balancer"
 )
 
 /*
@@ -45,15 +70,89 @@ const (
 */
 type controlPlaneEndpointManager struct {
 	inProcess         bool
-	apiServerPort     int32 // node on which the EIP is listening
+	apiServerPort     int32 // port on which the EIP is listening, if configured; see eipPort
 	nodeAPIServerPort int32 // port on which the api server is listening on the control plane nodes
 	eipTag            string
 	instances         cloudInstances
+	deviceSvc         packngo.DeviceService // to check the project of a device before assigning the EIP to it
 	deviceIPSrv       packngo.DeviceIPService
 	ipResSvr          packngo.ProjectIPService
 	projectID         string
-	httpClient        *http.Client
+	healthSetting     string // control plane health check setting
+	healthChecker     healthChecker
+	prober            Prober // sends the http and https health checks, if set, instead of the default client
+	// faults fail or delay health checks for soak testing, if set
+	faults *faultInjector
+	// nodeAddressType the type of node address to health check the nodes at, see nodeProbeAddress
+	nodeAddressType v1.NodeAddressType
+	// externalHealth the URL of a checker outside the cluster, which must also reach the EIP for it to be healthy
+	externalHealth        string
+	externalHealthChecker *externalHealthChecker
+	maintenanceHold       bool // do not move the EIP away from a node under maintenance
+	failovers             failoverHistory
+	// failoverGrace how long after its Ready condition changed a node holding the EIP is degraded, not failed
+	failoverGrace time.Duration
+	// eipManagement who moves the EIP, see eipManagementCCM; clusterAPIWarned whether the CAPP tag warning was logged
+	eipManagement    string
+	clusterAPIWarned bool
+	// eipSelection the order in which to try healthy nodes for the EIP, see eipSelectionFirst
+	eipSelection string
+	// etcdLeader if set, the node of the etcd leader is tried last for the EIP
+	etcdLeader *etcdLeaderChecker
+	// remediation if set, reboots control plane nodes that failed for too long, after the EIP moved away
+	remediation *nodeRemediation
+	// eipCreate if set, creates the EIP when there is none with its tag
+	eipCreate *eipBootstrap
+	// healthCheckConcurrency how many apiservers to health check at a time; one at a time if not set
+	healthCheckConcurrency int
+	// reconcileTimeout if set, the longest a reconcile of the nodes may take
+	reconcileTimeout time.Duration
+	// clock for failover cooldowns and grace periods, and the reuse of IP reservations; the real time if nil
+	clock Clock
+	// eipLoopback set the EIP as a loopback address of each control plane node in its MetalNode
+	eipLoopback bool
+	// eipDriftPolicy what to do when the EIP is changed outside the CCM, see eipDriftObserve;
+	// eipBaseline the EIP as the CCM last knew it, ipUpdater changes its tags and description
+	eipDriftPolicy string
+	eipBaseline    *eipBaseline
+	ipUpdater      ipReservationUpdater
+	// dynamicClient for the ControlPlaneEndpoint custom resource, and the status last reported in it;
+	// failoversRestored whether the failover history was restored from that status after a restart
+	dynamicClient     dynamic.Interface
+	reportedStatus    *controlPlaneEndpointStatus
+	failoversRestored bool
 	k8sclient         kubernetes.Interface
+	recorder          record.EventRecorder
+	// externalServiceLock protects the external service sync, as well as the
+	// last known state of the `default/kubernetes` service and the eip
+	externalServiceLock sync.Mutex
+	kubernetesService   *v1.Service
+	eip                 string
+	// gatewayClass if set, the EIP is exposed via a Gateway of this class, with a TCPRoute to the
+	// external service, instead of the external service being of type LoadBalancer
+	gatewayClass string
+	// hairpin whether clients in the cluster reach the EIP via the external service, see setHairpinWorkaround
+	hairpin bool
+	// noControlPlaneNodes whether the last full sync found no control plane nodes
+	noControlPlaneNodes bool
+	// kubeProxyIPVS whether kube-proxy runs in IPVS mode, which binds the EIP locally on every node
+	kubeProxyIPVS bool
+	// loadBalancer the external control plane load balancer setting; if set, its members
+	// are managed instead of moving the EIP
+	loadBalancer string
+	members      controlPlaneMembers
+	// lbaas the client of the Equinix Metal load balancer API, for a control plane load balancer of that type
+	lbaas *lbaasClient
+	// ipReservationsLock protects a short-lived copy of the project IP reservations,
+	// so that the node and service reconcilers of one pass share a single API call
+	ipReservationsLock    sync.Mutex
+	ipReservations        []packngo.IPAddressReservation
+	ipReservationsFetched time.Time
+
+	// nodeAPIServerPortDetected whether the node apiserver port was only detected at startup, without
+	// the `default/kubernetes` service, see detectNodeAPIServerPort; getenv looks up the environment
+	nodeAPIServerPortDetected bool
+	getenv                    func(string) string
 }
 
 func (m *controlPlaneEndpointManager) name() string {
@@ -62,87 +161,374 @@ func (m *controlPlaneEndpointManager) name() string {
 
 func (m *controlPlaneEndpointManager) init(k8sclient kubernetes.Interface) error {
 	m.k8sclient = k8sclient
+	m.recorder = newEventRecorder(k8sclient)
 	klog.V(2).Info("controlPlaneEndpointManager.init(): enabling BGP on project")
+	healthChecker, err := newHealthChecker(m.healthSetting, m.prober)
+	if err != nil {
+		return err
+	}
+	m.healthChecker = m.faults.healthChecker(healthChecker)
+	if m.externalHealthChecker, err = newExternalHealthChecker(m.externalHealth); err != nil {
+		return err
+	}
+	if m.loadBalancer != "" {
+		if m.eipTag != "" {
+			return errors.New("control plane elastic ip tag and control plane load balancer are mutually exclusive, set only one")
+		}
+		members, err := newControlPlaneMembers(m.loadBalancer, m.lbaas)
+		if err != nil {
+			return err
+		}
+		m.members = members
+		klog.Infof("control plane load balancer %s enabled, managing its members", m.loadBalancer)
+	}
+	if m.eipTag != "" {
+		m.detectKubeProxyMode(context.Background())
+		m.detectNodeAPIServerPort(context.Background())
+	}
+	mode := m.mode()
+	if mode == controlPlaneEndpointDisabled {
+		klog.Infof("no control plane elastic ip tag or load balancer set, control plane endpoint management disabled")
+	}
+	for _, known := range []string{controlPlaneEndpointDisabled, controlPlaneEndpointEIP, controlPlaneEndpointLB} {
+		value := 0.0
+		if known == mode {
+			value = 1
+		}
+		controlPlaneEndpointMode.WithLabelValues(known).Set(value)
+	}
 	return nil
 }
 
+// mode how the control plane endpoint is managed: not at all without an elastic IP tag or
+// load balancer, in which case neither reconciler is registered
+func (m *controlPlaneEndpointManager) mode() string {
+	switch {
+	case m.members != nil:
+		return controlPlaneEndpointLB
+	case m.eipTag != "":
+		return controlPlaneEndpointEIP
+	default:
+		return controlPlaneEndpointDisabled
+	}
+}
+
+// detectKubeProxyMode check the kube-proxy mode, and warn if it is IPVS.
+// In IPVS mode, kube-proxy binds every load balancer IP, including the EIP, to the
+// kube-ipvs0 interface on every node. A health check of the EIP from any node then
+// is answered locally, and never reaches the device that actually holds the EIP,
+// so the health check instead goes directly to that device.
+func (m *controlPlaneEndpointManager) detectKubeProxyMode(ctx context.Context) {
+	cm, mode, err := kubeProxyMode(ctx, m.k8sclient)
+	if err != nil {
+		klog.Errorf("unable to determine kube-proxy mode, assuming %s: %v", kubeProxyModeIPTables, err)
+		return
+	}
+	klog.V(2).Infof("controlPlaneEndpointManager: kube-proxy mode %q", mode)
+	if mode != kubeProxyModeIPVS {
+		return
+	}
+	m.kubeProxyIPVS = true
+	klog.Warningf("kube-proxy runs in %s mode, which binds the elastic IP on every node; health checks will go to the device holding the elastic IP instead of the elastic IP", mode)
+	m.recorder.Event(cm, v1.EventTypeWarning, eventReasonKubeProxyIPVS, "kube-proxy in ipvs mode answers for the control plane elastic IP on every node, health checks go to the device holding the elastic IP instead")
+}
+
 func (m *controlPlaneEndpointManager) nodeReconciler() nodeReconciler {
-	return m.reconcileNodes
+	switch m.mode() {
+	case controlPlaneEndpointLB:
+		return m.reconcileMembers
+	case controlPlaneEndpointEIP:
+		return m.reconcileNodes
+	default:
+		return nil
+	}
 }
 func (m *controlPlaneEndpointManager) serviceReconciler() serviceReconciler {
+	// with an external load balancer, there is no EIP to expose via the external service
+	if m.mode() != controlPlaneEndpointEIP {
+		return nil
+	}
 	return m.reconcileServices
 }
 
 func (m *controlPlaneEndpointManager) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
 	klog.V(2).Info("controlPlaneEndpoint.reconcile: new reconciliation")
+	// a removed node is no candidate for the EIP; if it held it, the health check of the
+	// next sync fails, and moves it to a node that is still there
+	if mode == ModeRemove {
+		return nil
+	}
+	cpNodes := controlPlaneNodes(nodes)
+	// with no control plane nodes, there is nowhere to move the EIP. If this is the
+	// full list, the control plane is external to the cluster, e.g. hosted, so tell the user once.
+	if len(cpNodes) == 0 {
+		if mode == ModeSync && !m.noControlPlaneNodes {
+			klog.Infof("no nodes with label %s found, control plane assumed to be external to the cluster; elastic IP management is inactive until control plane nodes join", controlPlaneLabel)
+		}
+		if mode == ModeSync {
+			m.noControlPlaneNodes = true
+		}
+		klog.V(2).Info("controlPlaneEndpoint.reconcileNodes: no control plane nodes, nothing to do")
+		return nil
+	}
+	if mode == ModeSync && m.noControlPlaneNodes {
+		klog.Infof("control plane nodes found, elastic IP management is active")
+		m.noControlPlaneNodes = false
+	}
 	if m.inProcess {
 		klog.V(2).Info("controlPlaneEndpoint.reconcileNodes: already in process, not starting a new one")
 		return nil
 	}
 	// must have figured out the node port first, or nothing to do
-	if m.apiServerPort == 0 {
+	if m.eipPort() == 0 {
 		return errors.New("control plane apiserver port not provided or determined, cannot check, will try again on next loop")
 	}
 	m.inProcess = true
 	defer func() {
 		m.inProcess = false
 	}()
+	ctx, cancel := m.reconcileContext(ctx)
+	defer cancel()
 	if m.eipTag == "" {
 		return errors.New("control plane loadbalancer elastic ip tag is empty. Nothing to do")
 	}
-	ipList, _, err := m.ipResSvr.List(m.projectID, &packngo.ListOptions{
-		Includes: []string{"assignments"},
-	})
+	ipList, err := m.listIPReservations(ctx)
 	if err != nil {
 		return err
 	}
 	controlPlaneEndpoint := ipReservationByAllTags([]string{m.eipTag}, ipList)
+	if controlPlaneEndpoint == nil {
+		if controlPlaneEndpoint, err = m.bootstrapEIP(ctx); err != nil {
+			return err
+		}
+	}
 	if controlPlaneEndpoint == nil {
 		// IP NOT FOUND nothing to do here.
-		klog.Errorf("elastic IP not found. Please verify you have one with the expected tag: %s", m.eipTag)
-		return err
+		repeatedErrors.Errorf(errorReasonEIPNotFound, "elastic IP not found. Please verify you have one with the expected tag: %s", m.eipTag)
+		return fmt.Errorf("%w with tag %s", ErrEIPNotFound, m.eipTag)
 	}
 	if len(controlPlaneEndpoint.Assignments) > 1 {
-		return fmt.Errorf("the elastic ip %s has more than one node assigned to it and this is currently not supported. Fix it manually unassigning devices", controlPlaneEndpoint.ID)
+		return fmt.Errorf("%w: the elastic ip %s has more than one node assigned to it and this is currently not supported. Fix it manually unassigning devices", ErrAmbiguous, controlPlaneEndpoint.ID)
 	}
-	healthCheckURL := fmt.Sprintf("https://%s:%d/healthz", controlPlaneEndpoint.Address, m.apiServerPort)
-	klog.Infof("healthcheck elastic ip %s", healthCheckURL)
-	req, err := http.NewRequest("GET", healthCheckURL, nil)
-	if err != nil {
-		return err
+	var assignedNodeName string
+	if node := m.assignedNode(cpNodes, controlPlaneEndpoint); node != nil {
+		assignedNodeName = node.Name
 	}
-	resp, err := m.httpClient.Do(req)
-	// if there was no error, ensure we close
-	if err == nil && resp.Body != nil {
-		defer resp.Body.Close()
+	m.reportStatus(ctx, controlPlaneEndpoint.Address, assignedDeviceID(controlPlaneEndpoint), assignedNodeName)
+	// only the full list tells to which node the EIP is assigned, if to a device at all
+	if mode == ModeSync {
+		reportEIPAssignment(controlPlaneEndpoint.Address, assignedDeviceID(controlPlaneEndpoint), assignedNodeName)
 	}
-	if err != nil || resp.StatusCode != http.StatusOK {
-		if err != nil {
-			klog.Errorf("http client error during healthcheck, will try to reassign to a healthy node. err \"%s\"", err)
-		}
-		// filter down to only those nodes that are tagged as control plane
-		cpNodes := []*v1.Node{}
-		for _, n := range nodes {
-			if _, ok := n.Labels[controlPlaneLabel]; ok {
-				cpNodes = append(cpNodes, n)
-				klog.V(2).Infof("adding control plane node %s", n.Name)
+	// only the full list tells which nodes should not have the EIP
+	if m.eipLoopback && mode == ModeSync {
+		if err := m.syncLoopbackAddresses(ctx, cpNodes, controlPlaneEndpoint.Address); err != nil {
+			klog.Errorf("unable to set the elastic ip as loopback address of the control plane nodes: %v", err)
+		}
+	}
+	deferred := m.eipManagementDeferred(controlPlaneEndpoint)
+	if m.checkDrift(ctx, cpNodes, controlPlaneEndpoint, deferred) {
+		return nil
+	}
+	if deferred {
+		klog.V(2).Infof("controlPlaneEndpoint.reconcileNodes: elastic ip %s is managed by something else, e.g. kube-vip, not moving it", controlPlaneEndpoint.Address)
+		return nil
+	}
+	// an operator asked for the EIP to move to a node, e.g. ahead of maintenance on the one holding it
+	if requested := failoverRequestedNode(cpNodes); requested != nil {
+		if m.requestedFailover(ctx, requested, cpNodes, controlPlaneEndpoint) {
+			return nil
+		}
+	}
+	// a healthy pinned node gets the EIP, wherever it is now
+	if pinned := pinnedNode(cpNodes); pinned != nil {
+		assigned := m.assignedNode(cpNodes, controlPlaneEndpoint)
+		if assigned == nil || assigned.Name != pinned.Name {
+			klog.Infof("elastic ip %s is pinned to node %s, trying to move it there", controlPlaneEndpoint.Address, pinned.Name)
+			err := m.reassign(ctx, []*v1.Node{pinned}, controlPlaneEndpoint, "", fmt.Sprintf("pinned to node %s", pinned.Name))
+			if err == nil {
+				return nil
+			}
+			klog.Errorf("unable to move elastic ip %s to pinned node %s, keeping the usual failover: %v", controlPlaneEndpoint.Address, pinned.Name, err)
+		}
+	}
+	eipAddress := healthCheckAddress(controlPlaneEndpoint.Address, m.eipPort())
+	if m.kubeProxyIPVS {
+		eipAddress = m.assignedNodeHealthCheckAddress(cpNodes, controlPlaneEndpoint)
+		if eipAddress == "" {
+			if m.failoverThrottled(m.assignedNode(cpNodes, controlPlaneEndpoint), controlPlaneEndpoint, "cannot be health checked on the node holding it") {
+				return nil
 			}
+			klog.Errorf("elastic ip %s is not assigned to any control plane node, will try to assign to a healthy node", controlPlaneEndpoint.Address)
+			return m.reassign(ctx, cpNodes, controlPlaneEndpoint, eipAddress, "not assigned to a control plane node")
 		}
-		if err := m.reassign(ctx, cpNodes, controlPlaneEndpoint, healthCheckURL); err != nil {
-			klog.Errorf("error reassigning control plane endpoint to a different device. err \"%s\"", err)
+	}
+	if mode == ModeSync {
+		health := m.observeNodeHealthChecks(ctx, cpNodes)
+		if err := m.reconcileCutShort(ctx); err != nil {
 			return err
 		}
+		m.remediateNodes(ctx, cpNodes, controlPlaneEndpoint, health)
+	}
+	klog.Infof("healthcheck elastic ip %s", eipAddress)
+	// the checker outside the cluster reaches the EIP itself, whichever node kube-proxy in IPVS mode answers on
+	healthy := m.observedHealthCheck(ctx, eipAddress, healthCheckTargetEIP, "") && m.externalHealthCheck(ctx, healthCheckAddress(controlPlaneEndpoint.Address, m.eipPort()))
+	if err := m.reconcileCutShort(ctx); err != nil {
+		return err
+	}
+	reportEIPHealth(controlPlaneEndpoint.Address, healthy)
+	if healthy {
+		return nil
+	}
+	node := m.assignedNode(cpNodes, controlPlaneEndpoint)
+	m.checkPortTranslation(ctx, node, controlPlaneEndpoint.Address)
+	if node != nil && m.maintenanceHold && eipFailoverHeld(node) {
+		klog.Warningf("healthcheck of elastic ip %s failed, but node %s holding it is under maintenance, not reassigning; set annotation %s=true on the node to reassign", eipAddress, node.Name, annotationAllowEIPFailover)
+		m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonEIPFailoverHeld, "control plane elastic ip %s failed healthcheck, not moving it away from node under maintenance", controlPlaneEndpoint.Address)
+		return nil
+	}
+	if node != nil && !eipFailoverAllowed(node) {
+		if changed, ok := nodeRecentlyRestarted(node, m.failoverGrace, clockNow(m.clock)); ok {
+			klog.Warningf("healthcheck of elastic ip %s failed, but node %s holding it changed readiness at %s, within the grace period of %s, not reassigning yet; set annotation %s=true on the node to reassign", eipAddress, node.Name, changed.Format(time.RFC3339), m.failoverGrace, annotationAllowEIPFailover)
+			m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonEIPFailoverDeferred, "control plane elastic ip %s failed healthcheck, not moving it within %s of the node changing readiness", controlPlaneEndpoint.Address, m.failoverGrace)
+			return nil
+		}
+	}
+	if m.failoverThrottled(node, controlPlaneEndpoint, "failed healthcheck") {
+		return nil
+	}
+	klog.Errorf("healthcheck of elastic ip %s failed, will try to reassign to a healthy node", eipAddress)
+	if err := m.reassign(ctx, cpNodes, controlPlaneEndpoint, eipAddress, "healthcheck failed"); err != nil {
+		klog.Errorf("error reassigning control plane endpoint to a different device. err \"%s\"", err)
+		return err
+	}
+	return nil
+}
+
+// requestedFailover move the EIP to the node on which it was requested, if that node is healthy,
+// and clear the request either way, so that it happens once. Returns whether the EIP is on the node.
+func (m *controlPlaneEndpointManager) requestedFailover(ctx context.Context, node *v1.Node, nodes []*v1.Node, ip *packngo.IPAddressReservation) bool {
+	defer m.clearFailoverRequest(ctx, node)
+	if assigned := m.assignedNode(nodes, ip); assigned != nil && assigned.Name == node.Name {
+		klog.Infof("elastic ip %s requested to move to node %s, which already holds it", ip.Address, node.Name)
+		return true
+	}
+	klog.Infof("elastic ip %s requested to move to node %s, trying to move it there", ip.Address, node.Name)
+	if err := m.reassign(ctx, []*v1.Node{node}, ip, "", fmt.Sprintf("requested on node %s", node.Name)); err != nil {
+		klog.Errorf("unable to move elastic ip %s to node %s as requested: %v", ip.Address, node.Name, err)
+		m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonEIPFailoverRequested, "control plane elastic ip %s not moved to node as requested: %v", ip.Address, err)
+		return false
+	}
+	m.recorder.Eventf(node, v1.EventTypeNormal, eventReasonEIPFailoverRequested, "control plane elastic ip %s moved to node as requested", ip.Address)
+	return true
+}
+
+// clearFailoverRequest remove the failover request annotation from the node
+func (m *controlPlaneEndpointManager) clearFailoverRequest(ctx context.Context, node *v1.Node) {
+	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, annotationEIPFailoverRequest))
+	if err := patchUpdatedNode(ctx, node.Name, patch, m.k8sclient); err != nil {
+		klog.Errorf("unable to clear elastic ip failover request on node %s: %v", node.Name, err)
+	}
+}
+
+// listIPReservations the IP reservations of the project, with their assignments.
+// The node and service reconcilers each need them on every pass, so they are reused
+// for ipReservationsTTL, which is well below the loop period, rather than listed twice.
+func (m *controlPlaneEndpointManager) listIPReservations(ctx context.Context) ([]packngo.IPAddressReservation, error) {
+	m.ipReservationsLock.Lock()
+	defer m.ipReservationsLock.Unlock()
+	if m.ipReservations != nil && clockNow(m.clock).Sub(m.ipReservationsFetched) < ipReservationsTTL {
+		klog.V(5).Info("controlPlaneEndpoint.listIPReservations: reusing IP reservations")
+		return m.ipReservations, nil
+	}
+	_, span := startSpan(ctx, "metal.ProjectIPs.List")
+	ipList, _, err := m.ipResSvr.List(m.projectID, &packngo.ListOptions{
+		Includes: []string{"assignments"},
+	})
+	endSpan(ctx, span, err)
+	if err != nil {
+		return nil, wrapAPIError(err)
+	}
+	m.ipReservations = ipList
+	m.ipReservationsFetched = clockNow(m.clock)
+	return ipList, nil
+}
+
+// invalidateIPReservations forget the IP reservations, e.g. after changing an
+// assignment, so that the next reconciler gets them from the API again
+func (m *controlPlaneEndpointManager) invalidateIPReservations() {
+	m.ipReservationsLock.Lock()
+	defer m.ipReservationsLock.Unlock()
+	m.ipReservations = nil
+}
+
+// assignedNodeHealthCheckAddress the health check address of the apiserver on the control plane
+// node to which the EIP is assigned, or empty if the EIP is not assigned to one of the nodes
+func (m *controlPlaneEndpointManager) assignedNodeHealthCheckAddress(nodes []*v1.Node, ip *packngo.IPAddressReservation) string {
+	if m.nodeAPIServerPort == 0 {
+		return ""
+	}
+	node := m.assignedNode(nodes, ip)
+	if node == nil {
+		return ""
+	}
+	if addr := nodeProbeAddress(node, m.nodeAddressType); addr != "" {
+		return healthCheckAddress(addr, m.nodeAPIServerPort)
+	}
+	return ""
+}
+
+// failoverThrottled whether moving the EIP, which has the problem, would be too soon after the
+// last moves. An EIP that is not assigned at all is always assigned, and one on a node annotated to
+// allow failover is always moved.
+func (m *controlPlaneEndpointManager) failoverThrottled(node *v1.Node, ip *packngo.IPAddressReservation, problem string) bool {
+	if assignedDeviceID(ip) == "" || (node != nil && eipFailoverAllowed(node)) {
+		return false
+	}
+	err := m.failovers.allowed(clockNow(m.clock))
+	if err == nil {
+		return false
+	}
+	klog.Warningf("elastic ip %s %s, but not reassigning to avoid flapping: %v; set annotation %s=true on the node holding it to reassign", ip.Address, problem, err, annotationAllowEIPFailover)
+	if node != nil {
+		m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonEIPFailoverThrottled, "control plane elastic ip %s %s, not moving it: %v", ip.Address, problem, err)
+	}
+	return true
+}
+
+// assignedNode the node to which the EIP is assigned, or nil if the EIP is not assigned to one of the nodes
+func (m *controlPlaneEndpointManager) assignedNode(nodes []*v1.Node, ip *packngo.IPAddressReservation) *v1.Node {
+	deviceID := assignedDeviceID(ip)
+	if deviceID == "" {
+		return nil
+	}
+	for _, node := range nodes {
+		if id, err := deviceIDFromProviderID(node.Spec.ProviderID); err == nil && id == deviceID {
+			return node
+		}
 	}
 	return nil
 }
 
-func (m *controlPlaneEndpointManager) reassign(ctx context.Context, nodes []*v1.Node, ip *packngo.IPAddressReservation, eipURL string) error {
+// controlPlaneNodes filter down to only those nodes that are tagged as control plane
+func controlPlaneNodes(nodes []*v1.Node) []*v1.Node {
+	cpNodes := []*v1.Node{}
+	for _, n := range nodes {
+		if _, ok := n.Labels[controlPlaneLabel]; ok {
+			cpNodes = append(cpNodes, n)
+			klog.V(2).Infof("adding control plane node %s", n.Name)
+		}
+	}
+	return cpNodes
+}
+
+func (m *controlPlaneEndpointManager) reassign(ctx context.Context, nodes []*v1.Node, ip *packngo.IPAddressReservation, eipAddress, reason string) error {
 	klog.V(2).Info("controlPlaneEndpoint.reassign")
 	// must have figured out the node port first, or nothing to do
 	if m.nodeAPIServerPort == 0 {
 		return errors.New("control plane node apiserver port not yet determined, cannot reassign, will try again on next loop")
 	}
-	for _, node := range nodes {
+nodes:
+	for _, node := range m.avoidEtcdLeader(ctx, orderCandidates(eipCandidates(nodes), m.eipSelection, ip.Address)) {
 		addresses, err := m.instances.NodeAddresses(ctx, types.NodeName(node.Name))
 		if err != nil {
 			return err
@@ -155,87 +541,147 @@ func (m *controlPlaneEndpointManager) reassign(ctx context.Context, nodes []*v1.
 				klog.V(2).Infof("skipping address check of type %s: %s", a.Type, a.Address)
 				continue
 			}
-			healthCheckAddress := fmt.Sprintf("https://%s:%d/healthz", a.Address, m.nodeAPIServerPort)
-			if healthCheckAddress == eipURL {
-				klog.V(2).Infof("skipping address check for EIP on this node: %s", eipURL)
+			nodeAddress := healthCheckAddress(a.Address, m.nodeAPIServerPort)
+			if nodeAddress == eipAddress {
+				klog.V(2).Infof("skipping address check for EIP on this node: %s", eipAddress)
 				continue
 			}
-			klog.Infof("healthcheck node %s", healthCheckAddress)
-			req, err := http.NewRequest("GET", healthCheckAddress, nil)
-			if err != nil {
-				klog.Errorf("healthcheck failed for node %s. err \"%s\"", node.Name, err)
-				continue
-			}
-			resp, err := m.httpClient.Do(req)
-
-			if err != nil {
-				if err != nil {
-					klog.Errorf("http client error during healthcheck. err \"%s\"", err)
+			klog.Infof("healthcheck node %s", nodeAddress)
+			if !m.healthCheck(ctx, nodeAddress) {
+				if err := m.reconcileCutShort(ctx); err != nil {
+					return err
 				}
+				klog.Infof("will not assign control plane endpoint to new device %s", node.Name)
 				continue
 			}
 
 			// We have a healthy node, this is the candidate to receive the EIP
-			if resp.StatusCode == http.StatusOK {
-				deviceID, err := m.instances.InstanceID(ctx, types.NodeName(node.Name))
+			deviceID, err := m.instances.InstanceID(ctx, types.NodeName(node.Name))
+			if err != nil {
+				return err
+			}
+			// in a cluster that spans projects, the API refuses to assign the EIP to a device
+			// outside its project, with an error that does not say so
+			project, err := m.deviceProject(deviceID)
+			if err != nil {
+				return err
+			}
+			if eipProject := m.reservationProject(ip); project != "" && project != eipProject {
+				klog.Warningf("will not assign control plane endpoint to device %s of node %s, which is in project %s, not %s", deviceID, node.Name, project, eipProject)
+				m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonEIPProjectMismatch, "device %s is in project %s, not in project %s of elastic ip %s, not assigning it", deviceID, project, eipProject, ip.Address)
+				continue nodes
+			}
+			if len(ip.Assignments) == 1 {
+				// whatever happens next, the assignments we know of are stale
+				m.invalidateIPReservations()
+				_, span := startSpan(ctx, "metal.DeviceIPs.Unassign")
+				_, err := m.deviceIPSrv.Unassign(ip.Assignments[0].ID)
+				endSpan(ctx, span, err)
 				if err != nil {
-					return err
+					return wrapAPIError(err)
 				}
-				if len(ip.Assignments) == 1 {
-					if _, err := m.deviceIPSrv.Unassign(ip.Assignments[0].ID); err != nil {
-						return err
-					}
-				}
-				if _, _, err := m.deviceIPSrv.Assign(deviceID, &packngo.AddressStruct{
-					Address: ip.Address,
-				}); err != nil {
-					return err
-				}
-				klog.Infof("control plane endpoint assigned to new device %s", node.Name)
-				return nil
 			}
-			klog.Infof("will not assign control plane endpoint to new device %s: returned http code %d", node.Name, resp.StatusCode)
+			_, span := startSpan(ctx, "metal.DeviceIPs.Assign")
+			_, _, err = m.deviceIPSrv.Assign(deviceID, &packngo.AddressStruct{
+				Address: ip.Address,
+			})
+			endSpan(ctx, span, err)
+			if err != nil {
+				return wrapAPIError(err)
+			}
+			m.invalidateIPReservations()
+			if m.eipBaseline != nil {
+				m.eipBaseline.deviceID = deviceID
+			}
+			m.failovers.record(clockNow(m.clock), reason)
+			m.reportStatus(ctx, ip.Address, deviceID, node.Name)
+			klog.Infof("control plane endpoint assigned to new device %s", node.Name)
+			return nil
 		}
 	}
-	return errors.New("ccm didn't find a good candidate for IP allocation. Cluster is unhealthy")
+	return fmt.Errorf("%w, ccm didn't find a good candidate for IP allocation", ErrAllUnhealthy)
 }
 
-func newControlPlaneEndpointManager(eipTag, projectID string, deviceIPSrv packngo.DeviceIPService, ipResSvr packngo.ProjectIPService, i cloudInstances, apiServerPort int32) *controlPlaneEndpointManager {
-	return &controlPlaneEndpointManager{
-		httpClient: &http.Client{
-			Timeout: time.Second * 5,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}},
-		eipTag:        eipTag,
-		projectID:     projectID,
-		instances:     i,
-		ipResSvr:      ipResSvr,
-		deviceIPSrv:   deviceIPSrv,
-		apiServerPort: apiServerPort,
+// newControlPlaneEndpointManager the manager of the control plane endpoint of the config. Its settings
+// were validated when the config was loaded. If client is nil, e.g. in tests, the manager has no
+// Equinix Metal API services until they are set.
+func newControlPlaneEndpointManager(config Config, client *packngo.Client, i cloudInstances, lbaas *lbaasClient) *controlPlaneEndpointManager {
+	// empty means no cooldown, grace period, remediation or timeout
+	failoverCooldown, _ := time.ParseDuration(config.EIPFailoverCooldown)
+	failoverGrace, _ := time.ParseDuration(config.EIPFailoverGracePeriod)
+	rebootAfter, _ := time.ParseDuration(config.EIPRebootAfter)
+	reconcileTimeout, _ := time.ParseDuration(config.EIPReconcileTimeout)
+	// nil means no faults are injected, and the etcd leader is not avoided
+	faults, _ := parseFaultInjection(config.FaultInjection)
+	etcdLeader, _ := newEtcdLeaderChecker(config.EIPEtcdLeaderMetrics)
+	m := &controlPlaneEndpointManager{
+		eipTag:                 config.EIPTag,
+		projectID:              config.ProjectID,
+		instances:              i,
+		apiServerPort:          config.APIServerPort,
+		loadBalancer:           config.ControlPlaneLBSetting,
+		lbaas:                  lbaas,
+		healthSetting:          config.ControlPlaneHealthCheck,
+		externalHealth:         config.ControlPlaneExternalHealthCheck,
+		prober:                 config.HealthCheckProber,
+		faults:                 faults,
+		nodeAddressType:        v1.NodeAddressType(config.NodeAddressType),
+		maintenanceHold:        config.EIPMaintenanceHold,
+		failovers:              failoverHistory{cooldown: failoverCooldown, maxPerHour: config.EIPMaxFailoversPerHour},
+		failoverGrace:          failoverGrace,
+		eipManagement:          config.EIPManagement,
+		eipSelection:           config.EIPSelectionPolicy,
+		eipDriftPolicy:         config.EIPDriftPolicy,
+		eipLoopback:            config.EIPLoopback,
+		etcdLeader:             etcdLeader,
+		remediation:            newNodeRemediation(rebootAfter, config.EIPMaxReboots),
+		healthCheckConcurrency: config.EIPHealthCheckConcurrency,
+		reconcileTimeout:       reconcileTimeout,
+		clock:                  config.Clock,
+		gatewayClass:           config.ControlPlaneGatewayClass,
+		hairpin:                config.EIPHairpin,
 	}
+	if client != nil {
+		m.deviceSvc = client.Devices
+		m.deviceIPSrv = client.DeviceIPs
+		m.ipResSvr = client.ProjectIPs
+		m.ipUpdater = packngoIPReservationUpdater{client}
+		m.eipCreate = newEIPBootstrap(config.EIPCreate, packngoEIPCreator{client}, config.EIPCreateMetro, config.Facility)
+	}
+	return m
 }
 
 // reconcileServices ensure that our Elastic IP is assigned as `externalIPs` for
-// the `default/kubernetes` service
+// the `default/kubernetes` service. Whether added, updated or synced, the external
+// service is synced with it; once it is removed, so are the endpoints of the external service.
 func (m *controlPlaneEndpointManager) reconcileServices(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
 	if m.eipTag == "" {
 		return errors.New("elastic ip tag is empty. Nothing to do")
 	}
+	if mode == ModeRemove {
+		for _, svc := range svcs {
+			if svc.Namespace == "default" && svc.Name == "kubernetes" {
+				return m.removeExternalEndpoints(ctx)
+			}
+		}
+		return nil
+	}
 
-	var err error
 	// get IP address reservations and check if they any exists for this svc
-	ipList, _, err := m.ipResSvr.List(m.projectID, &packngo.ListOptions{
-		Includes: []string{"assignments"},
-	})
+	ipList, err := m.listIPReservations(ctx)
 	if err != nil {
 		return err
 	}
 	controlPlaneEndpoint := ipReservationByAllTags([]string{m.eipTag}, ipList)
+	if controlPlaneEndpoint == nil {
+		if controlPlaneEndpoint, err = m.bootstrapEIP(ctx); err != nil {
+			return err
+		}
+	}
 	if controlPlaneEndpoint == nil {
 		// IP NOT FOUND nothing to do here.
-		klog.Errorf("elastic IP not found. Please verify you have one with the expected tag: %s", m.eipTag)
-		return err
+		repeatedErrors.Errorf(errorReasonEIPNotFound, "elastic IP not found. Please verify you have one with the expected tag: %s", m.eipTag)
+		return fmt.Errorf("%w with tag %s", ErrEIPNotFound, m.eipTag)
 	}
 	if len(controlPlaneEndpoint.Assignments) > 1 {
 		return fmt.Errorf("the elastic ip %s has more than one node assigned to it and this is currently not supported. Fix it manually unassigning devices", controlPlaneEndpoint.ID)
@@ -249,127 +695,542 @@ func (m *controlPlaneEndpointManager) reconcileServices(ctx context.Context, svc
 		if svc.Namespace != "default" || svc.Name != "kubernetes" {
 			continue
 		}
+		return m.syncExternalService(ctx, svc, eip)
+	}
+	// every sync should find default/kubernetes
+	if mode == ModeSync {
+		return fmt.Errorf("Service default/kubernetes not found")
+	}
+	return nil
+}
 
-		// get the target port
-		existingPorts := svc.Spec.Ports
-		if len(existingPorts) < 1 {
-			return errors.New("default/kubernetes service does not have any ports defined")
-		}
+// removeExternalEndpoints empty the endpoints of the external service, and forget
+// the `default/kubernetes` service, after that was deleted, so that traffic to the
+// EIP does not go to apiservers that departed with it, nor are they mirrored again
+// by a repair. The external service itself is left, for when the apiserver recreates
+// `default/kubernetes`, which is then synced as added.
+func (m *controlPlaneEndpointManager) removeExternalEndpoints(ctx context.Context) error {
+	m.externalServiceLock.Lock()
+	defer m.externalServiceLock.Unlock()
+	m.kubernetesService = nil
 
-		// track which port the kube-apiserver actually is listening on
-		m.nodeAPIServerPort = existingPorts[0].TargetPort.IntVal
-		// did we set a specific port, or did we request that it just be left as is?
-		if m.apiServerPort == 0 {
-			m.apiServerPort = m.nodeAPIServerPort
+	myeps := m.k8sclient.CoreV1().Endpoints(externalServiceNamespace)
+	myep, err := myeps.Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
 		}
+		return fmt.Errorf("failed to get my endpoints: %w", err)
+	}
+	if myep.Labels[managedByLabel] != managedByCCM || len(myep.Subsets) == 0 {
+		return nil
+	}
+	klog.Infof("service default/kubernetes removed, removing endpoints of %s/%s", externalServiceNamespace, externalServiceName)
+	// a merge patch, so that the endpoints need not be the latest version
+	patch, err := json.Marshal(map[string]interface{}{"subsets": nil})
+	if err != nil {
+		return fmt.Errorf("failed to encode my endpoints: %w", err)
+	}
+	if _, err := myeps.Patch(ctx, externalServiceName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to update my endpoints: %w", err)
+	}
+	return nil
+}
 
-		// get the endpoints for this service
-		eps := m.k8sclient.CoreV1().Endpoints(svc.Namespace)
-		ep, err := eps.Get(ctx, svc.Name, metav1.GetOptions{})
-		if err != nil {
-			klog.V(2).Infof("failed to get endpoints %s: %v", svc.Name, err)
-			return fmt.Errorf("failed to get endpoints %s: %v", svc.Name, err)
-		}
-		// two options:
-		// - our endpoints already exists: just copy the endpoints
-		// - our endpoints does not exist: create it
-		epExisted := true
-		myeps := m.k8sclient.CoreV1().Endpoints(externalServiceNamespace)
-		myep, err := myeps.Get(ctx, externalServiceName, metav1.GetOptions{})
-		if err != nil {
-			klog.Infof("endpoint %s/%s did not yet exist, creating", externalServiceNamespace, externalServiceName)
-			myep = &v1.Endpoints{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      externalServiceName,
-					Namespace: externalServiceNamespace,
-				},
-			}
-			epExisted = false
-		}
+// syncExternalService ensure that the external service and its endpoints
+// mirror the given `default/kubernetes` service, exposed on the given eip.
+// It remembers both, so that the external service can be repaired later
+// without going back to the Equinix Metal API.
+func (m *controlPlaneEndpointManager) syncExternalService(ctx context.Context, svc *v1.Service, eip string) error {
+	m.externalServiceLock.Lock()
+	defer m.externalServiceLock.Unlock()
 
-		myep.Subsets = []v1.EndpointSubset{}
-		for _, s := range ep.Subsets {
-			copiedSubset := s.DeepCopy()
-			myep.Subsets = append(myep.Subsets, *copiedSubset)
-		}
+	// get the target port
+	existingPorts := svc.Spec.Ports
+	if len(existingPorts) < 1 {
+		return errors.New("default/kubernetes service does not have any ports defined")
+	}
 
-		// save the endpoints
-		if epExisted {
-			if _, err := myeps.Update(ctx, myep, metav1.UpdateOptions{}); err != nil {
-				klog.Errorf("failed to update my endpoints: %v", err)
-				return fmt.Errorf("failed to update my endpoints: %v", err)
-			}
-		} else {
-			if _, err := myeps.Create(ctx, myep, metav1.CreateOptions{}); err != nil {
-				klog.Errorf("failed to create my endpoints: %v", err)
-				return fmt.Errorf("failed to create my endpoints: %v", err)
-			}
-		}
+	// track which port the kube-apiserver actually is listening on
+	if _, err := m.setNodeAPIServerPort(svc); err != nil {
+		return err
+	}
+	m.kubernetesService = svc.DeepCopy()
+	m.eip = eip
 
-		// now for my service
-		ports := []v1.ServicePort{}
-		for _, p := range existingPorts {
-			copiedPort := p.DeepCopy()
-			ports = append(ports, *copiedPort)
+	// make sure we are not about to overwrite a service someone else manages
+	svcIntf := m.k8sclient.CoreV1().Services(externalServiceNamespace)
+	existingService, err := svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{})
+	serviceExisted := err == nil
+	// the service is ours to create, but, if marked so, not to change; it is not checked for
+	// a conflicting manager, as whoever marked it knows that it manages the service
+	external := serviceExisted && externallyManaged(existingService.ObjectMeta)
+	if serviceExisted && !external {
+		legacy := existingService.Annotations[metallbAnnotation] == metallbDisabledtag
+		if manager := conflictingManager(existingService.ObjectMeta, legacy); manager != "" {
+			m.recorder.Eventf(existingService, v1.EventTypeWarning, eventReasonManagerConflict, "service %s/%s is managed by %s, not overwriting with control plane endpoint", externalServiceNamespace, externalServiceName, manager)
+			return fmt.Errorf("service %s/%s is managed by %s, not overwriting", externalServiceNamespace, externalServiceName, manager)
 		}
-		// set the port on which to listen
-		ports[0].Port = m.apiServerPort
+	}
 
-		externalService := &v1.Service{
+	// get the endpoints for this service
+	eps := m.k8sclient.CoreV1().Endpoints(svc.Namespace)
+	ep, err := eps.Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(2).Infof("failed to get endpoints %s: %v", svc.Name, err)
+		return fmt.Errorf("failed to get endpoints %s: %w", svc.Name, err)
+	}
+	// two options:
+	// - our endpoints already exists: just copy the endpoints
+	// - our endpoints does not exist: create it
+	epExisted := true
+	myeps := m.k8sclient.CoreV1().Endpoints(externalServiceNamespace)
+	myep, err := myeps.Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		klog.Infof("endpoint %s/%s did not yet exist, creating", externalServiceNamespace, externalServiceName)
+		myep = &v1.Endpoints{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: externalServiceName,
-				Annotations: map[string]string{
-					metallbAnnotation: metallbDisabledtag,
-				},
+				Name:      externalServiceName,
 				Namespace: externalServiceNamespace,
 			},
-			Spec: v1.ServiceSpec{
-				Type:           v1.ServiceTypeLoadBalancer,
-				LoadBalancerIP: eip,
-				Ports:          ports,
-			},
 		}
+		epExisted = false
+	} else if manager := conflictingManager(myep.ObjectMeta, serviceExisted); manager != "" {
+		// unlabeled endpoints are ours only if they belong to a service that is ours
+		m.recorder.Eventf(myep, v1.EventTypeWarning, eventReasonManagerConflict, "endpoints %s/%s are managed by %s, not overwriting with control plane endpoints", externalServiceNamespace, externalServiceName, manager)
+		return fmt.Errorf("endpoints %s/%s are managed by %s, not overwriting", externalServiceNamespace, externalServiceName, manager)
+	}
+	// the apiserver endpoint reconciler may rewrite the same endpoints in a different order,
+	// so only write ours if they are not already ours, or the subsets actually differ
+	switch {
+	case epExisted && myep.Labels[managedByLabel] == managedByCCM && endpointSubsetsHash(myep.Subsets) == endpointSubsetsHash(ep.Subsets):
+		klog.V(2).Infof("endpoints %s/%s unchanged, not updating", externalServiceNamespace, externalServiceName)
+	case epExisted:
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": map[string]string{managedByLabel: managedByCCM}},
+			"subsets":  copyEndpointSubsets(ep.Subsets),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode my endpoints: %w", err)
+		}
+		if _, err := myeps.Patch(ctx, externalServiceName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			klog.Errorf("failed to update my endpoints: %v", err)
+			return fmt.Errorf("failed to update my endpoints: %w", err)
+		}
+	default:
+		setManagedBy(&myep.ObjectMeta)
+		myep.Subsets = copyEndpointSubsets(ep.Subsets)
+		if _, err := myeps.Create(ctx, myep, metav1.CreateOptions{}); err != nil {
+			klog.Errorf("failed to create my endpoints: %v", err)
+			return fmt.Errorf("failed to create my endpoints: %w", err)
+		}
+	}
 
-		// did it already exist? Then update it
-		svcIntf := m.k8sclient.CoreV1().Services(externalServiceNamespace)
-		var updatedService *v1.Service
-		if updatedService, err = svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{}); err == nil {
-			klog.V(2).Infof("service %s already exists, just updating", externalServiceName)
-			// we do not want to override everything, as there is important information we need
-			updatedService.Spec.LoadBalancerIP = externalService.Spec.LoadBalancerIP
-			updatedService.Spec.Ports = externalService.Spec.Ports
-			if _, err := svcIntf.Update(ctx, updatedService, metav1.UpdateOptions{}); err != nil {
-				klog.Errorf("failed to update service: %v", err)
-				return fmt.Errorf("failed to update service: %v", err)
-			}
-		} else {
-			klog.V(2).Infof("service %s did not exist, creating", externalServiceName)
-			if updatedService, err = svcIntf.Create(ctx, externalService, metav1.CreateOptions{}); err != nil {
-				klog.Errorf("failed to create service: %v", err)
-				return fmt.Errorf("failed to create service: %v", err)
-			}
+	// now for my service
+	externalService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: externalServiceName,
+			Annotations: map[string]string{
+				metallbAnnotation: metallbDisabledtag,
+			},
+			Labels: map[string]string{
+				managedByLabel: managedByCCM,
+			},
+			Namespace: externalServiceNamespace,
+		},
+		Spec: v1.ServiceSpec{
+			Type:  m.externalServiceType(),
+			Ports: m.externalServicePorts(existingPorts),
+		},
+	}
+	if externalService.Spec.Type == v1.ServiceTypeLoadBalancer {
+		externalService.Spec.LoadBalancerIP = eip
+	}
+	m.setHairpinWorkaround(externalService, eip)
+
+	// did it already exist? Then patch only what we manage, as there is important information we need,
+	// and only if it changed, since this runs on every sync
+	var updatedService *v1.Service
+	switch {
+	case external:
+		updatedService = existingService
+		if !externalServiceUnchanged(existingService, externalService) {
+			klog.V(2).Infof("service %s is externally managed and differs from the control plane endpoint, only updating its status", externalServiceName)
 		}
-		if updatedService, err = svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{}); err != nil {
-			klog.Errorf("could not get service %s for status update: %v", externalServiceName, err)
-			return fmt.Errorf("could not get service %s for status update: %v", externalServiceName, err)
+	case serviceExisted && externalServiceUnchanged(existingService, externalService):
+		updatedService = existingService
+		klog.V(4).Infof("service %s unchanged, not updating", externalServiceName)
+	case serviceExisted:
+		updatedService = existingService
+		klog.V(2).Infof("service %s already exists, just updating", externalServiceName)
+		spec := map[string]interface{}{
+			"type":           externalService.Spec.Type,
+			"loadBalancerIP": externalService.Spec.LoadBalancerIP,
+			"ports":          externalService.Spec.Ports,
 		}
-		// and finally update status
-		updatedService.Status = v1.ServiceStatus{
-			LoadBalancer: v1.LoadBalancerStatus{
-				Ingress: []v1.LoadBalancerIngress{
-					{IP: eip},
-				},
+		hairpinPatch(spec, externalService)
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      externalService.Labels,
+				"annotations": externalService.Annotations,
 			},
+			"spec": spec,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode service: %w", err)
 		}
-		if _, err := svcIntf.UpdateStatus(ctx, updatedService, metav1.UpdateOptions{}); err != nil {
-			klog.Errorf("failed to update service status: %v", err)
-			return fmt.Errorf("failed to update service status: %v", err)
+		if _, err := svcIntf.Patch(ctx, externalServiceName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			klog.Errorf("failed to update service: %v", err)
+			return fmt.Errorf("failed to update service: %w", err)
 		}
+	default:
+		klog.V(2).Infof("service %s did not exist, creating", externalServiceName)
+		if updatedService, err = svcIntf.Create(ctx, externalService, metav1.CreateOptions{}); err != nil {
+			klog.Errorf("failed to create service: %v", err)
+			return fmt.Errorf("failed to create service: %w", err)
+		}
+	}
+	// exposed via a gateway, which has the EIP, rather than the service
+	if m.gatewayClass != "" {
+		return m.syncExternalGateway(ctx, eip, externalService.Spec.Ports[0].Port)
+	}
+	// and finally update status, if it is not already the EIP
+	ingress := []v1.LoadBalancerIngress{{IP: eip}}
+	if equality.Semantic.DeepEqual(updatedService.Status.LoadBalancer.Ingress, ingress) {
 		return nil
 	}
-	// every sync should find default/kubernetes
-	if mode == ModeSync {
-		return fmt.Errorf("Service default/kubernetes not found")
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{"loadBalancer": map[string]interface{}{"ingress": ingress}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode service status: %w", err)
+	}
+	if _, err := svcIntf.Patch(ctx, externalServiceName, types.MergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+		klog.Errorf("failed to update service status: %v", err)
+		return fmt.Errorf("failed to update service status: %w", err)
+	}
+	return nil
+}
+
+// externalServiceUnchanged whether the existing external service already has the labels,
+// annotations and spec fields of the desired one that the CCM manages; the node ports
+// are allocated by the apiserver, so they are not compared
+func externalServiceUnchanged(existing, desired *v1.Service) bool {
+	for k, v := range desired.Labels {
+		if existing.Labels[k] != v {
+			return false
+		}
+	}
+	for k, v := range desired.Annotations {
+		if existing.Annotations[k] != v {
+			return false
+		}
+	}
+	ports := make([]v1.ServicePort, len(existing.Spec.Ports))
+	for i, port := range existing.Spec.Ports {
+		port.NodePort = 0
+		ports[i] = port
+	}
+	return existing.Spec.Type == desired.Spec.Type &&
+		existing.Spec.LoadBalancerIP == desired.Spec.LoadBalancerIP &&
+		equality.Semantic.DeepEqual(ports, desired.Spec.Ports) &&
+		hairpinUnchanged(existing, desired)
+}
+
+// externalServicePorts the ports for the external service, copied from the
+// `default/kubernetes` service, but listening on the EIP port
+func (m *controlPlaneEndpointManager) externalServicePorts(existingPorts []v1.ServicePort) []v1.ServicePort {
+	ports := []v1.ServicePort{}
+	for _, p := range existingPorts {
+		copiedPort := p.DeepCopy()
+		// keep the protocol explicit, so the comparison with what kubernetes saves is stable
+		copiedPort.Protocol = servicePortProtocol(p)
+		// node ports are allocated for the external service itself, never copied
+		copiedPort.NodePort = 0
+		ports = append(ports, *copiedPort)
+	}
+	// set the port on which to listen
+	ports[0].Port = m.eipPort()
+	return ports
+}
+
+// eipPort the port on which the EIP listens: the configured one, e.g. 443 in front of
+// apiservers on 6443, or else the port on which the apiserver listens on the nodes.
+// It is not fixed at the first sync, so that it follows the apiserver if that moves.
+func (m *controlPlaneEndpointManager) eipPort() int32 {
+	if m.apiServerPort != 0 {
+		return m.apiServerPort
+	}
+	return m.nodeAPIServerPort
+}
+
+// serviceTargetPort the port to which a port of the `default/kubernetes` service forwards, i.e.
+// on which the apiserver listens on the nodes. A named target port cannot be resolved without
+// the pods of the apiserver, which may not run in the cluster.
+func serviceTargetPort(port v1.ServicePort) (int32, error) {
+	switch {
+	case port.TargetPort.Type == intstr.String:
+		return 0, fmt.Errorf("default/kubernetes service has named target port %q, which is not supported", port.TargetPort.StrVal)
+	case port.TargetPort.IntVal > 0:
+		return port.TargetPort.IntVal, nil
+	case port.Port > 0:
+		// kubernetes defaults the target port to the port
+		return port.Port, nil
+	default:
+		return 0, fmt.Errorf("default/kubernetes service has no valid port")
+	}
+}
+
+// setNodeAPIServerPort record the port on which the apiserver listens on the control plane nodes,
+// from the `default/kubernetes` service, and whether it changed from the one known until now. The
+// health checks and the external service follow the new port; a change is recorded as an event.
+func (m *controlPlaneEndpointManager) setNodeAPIServerPort(svc *v1.Service) (bool, error) {
+	if len(svc.Spec.Ports) < 1 {
+		return false, errors.New("default/kubernetes service does not have any ports defined")
+	}
+	port, err := serviceTargetPort(svc.Spec.Ports[0])
+	if err != nil {
+		return false, err
+	}
+	previous, detected := m.nodeAPIServerPort, m.nodeAPIServerPortDetected
+	m.nodeAPIServerPort = port
+	m.nodeAPIServerPortDetected = false
+	if previous == 0 || previous == port {
+		return false, nil
+	}
+	if detected {
+		klog.Infof("apiserver port on the control plane nodes is %d, not %d as detected at startup", port, previous)
+		return true, nil
+	}
+	klog.Infof("apiserver port on the control plane nodes changed from %d to %d", previous, port)
+	if m.recorder != nil {
+		m.recorder.Eventf(svc, v1.EventTypeNormal, eventReasonAPIServerPortChanged, "apiserver port on the control plane nodes changed from %d to %d, control plane endpoint follows", previous, port)
+	}
+	return true, nil
+}
+
+// checkPortTranslation when the EIP listens on a different port than the apiserver on the
+// nodes, kube-proxy translates between them via the external service. If the EIP failed
+// its healthcheck, but the apiserver on the node holding it is healthy on the node port,
+// it is the translation that is broken, not the apiserver; say so, as moving the EIP to
+// another node only helps if kube-proxy works there.
+func (m *controlPlaneEndpointManager) checkPortTranslation(ctx context.Context, node *v1.Node, eip string) {
+	if node == nil || m.kubeProxyIPVS || m.eipPort() == m.nodeAPIServerPort {
+		return
+	}
+	addr := nodeProbeAddress(node, m.nodeAddressType)
+	if addr == "" || !m.healthCheck(ctx, healthCheckAddress(addr, m.nodeAPIServerPort)) {
+		return
+	}
+	klog.Warningf("elastic ip %s failed healthcheck on port %d, but the apiserver on node %s is healthy on port %d; check that kube-proxy serves service %s/%s", eip, m.eipPort(), node.Name, m.nodeAPIServerPort, externalServiceNamespace, externalServiceName)
+	m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonEIPPortTranslation, "control plane elastic ip %s failed healthcheck on port %d, but the apiserver is healthy on port %d", eip, m.eipPort(), m.nodeAPIServerPort)
+}
+
+// watch watches the external service and its endpoints, and repairs them
+// immediately if they are deleted or changed by someone else, rather than
+// waiting for the next sync loop.
+func (m *controlPlaneEndpointManager) watch(ctx context.Context) error {
+	if m.eipTag == "" {
+		klog.V(2).Info("controlPlaneEndpointManager.watch(): no elastic ip tag, not watching external service")
+		return nil
+	}
+	informer := informers.NewSharedInformerFactoryWithOptions(m.k8sclient, 0,
+		informers.WithNamespace(externalServiceNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", externalServiceName).String()
+		}),
+	)
+
+	servicesInformer := informer.Core().V1().Services().Informer()
+	servicesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			svc, ok := obj.(*v1.Service)
+			if !ok || !m.externalServiceChanged(svc) {
+				return
+			}
+			m.repairExternalService(ctx, "changed")
+		},
+		DeleteFunc: func(obj interface{}) {
+			m.repairExternalService(ctx, "deleted")
+		},
+	})
+	endpointsInformer := informer.Core().V1().Endpoints().Informer()
+	endpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			ep, ok := obj.(*v1.Endpoints)
+			if !ok || !m.externalEndpointsChanged(ctx, ep) {
+				return
+			}
+			m.repairExternalService(ctx, "endpoints changed")
+		},
+		DeleteFunc: func(obj interface{}) {
+			m.repairExternalService(ctx, "endpoints deleted")
+		},
+	})
+
+	// the endpoints of `default/kubernetes` change as apiservers come and go; mirror them
+	// right away, rather than leaving the external service pointing at a removed apiserver
+	// until the next loop
+	sourceInformer := informers.NewSharedInformerFactoryWithOptions(m.k8sclient, 0,
+		informers.WithNamespace("default"),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", "kubernetes").String()
+		}),
+	)
+	sourceEndpointsInformer := sourceInformer.Core().V1().Endpoints().Informer()
+	sourceEndpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			ep, ok := obj.(*v1.Endpoints)
+			if !ok || !m.sourceEndpointsChanged(ctx, ep) {
+				return
+			}
+			m.repairExternalService(ctx, "source endpoints changed")
+		},
+	})
+
+	informer.Start(ctx.Done())
+	sourceInformer.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), servicesInformer.HasSynced, endpointsInformer.HasSynced, sourceEndpointsInformer.HasSynced) {
+		return fmt.Errorf("syncing caches failed")
 	}
+	klog.Info("external service watcher started")
 	return nil
 }
+
+// repairExternalService re-run the sync of the external service based on the
+// last known `default/kubernetes` service and eip
+func (m *controlPlaneEndpointManager) repairExternalService(ctx context.Context, reason string) {
+	m.externalServiceLock.Lock()
+	svc, eip := m.kubernetesService, m.eip
+	m.externalServiceLock.Unlock()
+	if svc == nil || eip == "" {
+		klog.V(2).Infof("external service %s/%s %s, but not yet synced, waiting for next loop", externalServiceNamespace, externalServiceName, reason)
+		return
+	}
+	klog.Infof("external service %s/%s %s, repairing", externalServiceNamespace, externalServiceName, reason)
+	if err := m.syncExternalService(ctx, svc, eip); err != nil {
+		klog.Errorf("failed to repair external service %s/%s: %v", externalServiceNamespace, externalServiceName, err)
+	}
+}
+
+// externalServiceChanged check if the external service differs from what we
+// last set it to. Only the fields we manage are considered.
+func (m *controlPlaneEndpointManager) externalServiceChanged(svc *v1.Service) bool {
+	m.externalServiceLock.Lock()
+	defer m.externalServiceLock.Unlock()
+	if m.kubernetesService == nil || m.eip == "" {
+		return false
+	}
+	// only the status of an externally managed service is ours
+	if externallyManaged(svc.ObjectMeta) {
+		ingress := svc.Status.LoadBalancer.Ingress
+		return svc.Spec.Type == v1.ServiceTypeLoadBalancer && (len(ingress) != 1 || ingress[0].IP != m.eip)
+	}
+	if svc.Spec.Type != m.externalServiceType() {
+		return true
+	}
+	if svc.Spec.Type == v1.ServiceTypeLoadBalancer && svc.Spec.LoadBalancerIP != m.eip {
+		return true
+	}
+	if svc.Annotations[metallbAnnotation] != metallbDisabledtag || svc.Labels[managedByLabel] != managedByCCM {
+		return true
+	}
+	expected := m.externalServicePorts(m.kubernetesService.Spec.Ports)
+	if len(svc.Spec.Ports) != len(expected) {
+		return true
+	}
+	for i, p := range svc.Spec.Ports {
+		// the node port is allocated by kubernetes, so ignore it
+		e := expected[i]
+		if p.Name != e.Name || servicePortProtocol(p) != e.Protocol || p.Port != e.Port || p.TargetPort != e.TargetPort {
+			return true
+		}
+	}
+	desired := &v1.Service{Spec: v1.ServiceSpec{Type: svc.Spec.Type}}
+	m.setHairpinWorkaround(desired, m.eip)
+	if !hairpinUnchanged(svc, desired) {
+		return true
+	}
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return false
+	}
+	ingress := svc.Status.LoadBalancer.Ingress
+	return len(ingress) != 1 || ingress[0].IP != m.eip
+}
+
+// externalEndpointsChanged check if the external endpoints differ from those
+// of the `default/kubernetes` service
+func (m *controlPlaneEndpointManager) externalEndpointsChanged(ctx context.Context, ep *v1.Endpoints) bool {
+	m.externalServiceLock.Lock()
+	svc := m.kubernetesService
+	m.externalServiceLock.Unlock()
+	if svc == nil {
+		return false
+	}
+	source, err := m.k8sclient.CoreV1().Endpoints(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(2).Infof("failed to get endpoints %s/%s: %v", svc.Namespace, svc.Name, err)
+		return false
+	}
+	return ep.Labels[managedByLabel] != managedByCCM || endpointSubsetsHash(source.Subsets) != endpointSubsetsHash(ep.Subsets)
+}
+
+// sourceEndpointsChanged check if the endpoints of the `default/kubernetes` service
+// differ from those of the external service, which mirrors them
+func (m *controlPlaneEndpointManager) sourceEndpointsChanged(ctx context.Context, source *v1.Endpoints) bool {
+	m.externalServiceLock.Lock()
+	svc := m.kubernetesService
+	m.externalServiceLock.Unlock()
+	if svc == nil || source.Namespace != svc.Namespace || source.Name != svc.Name {
+		return false
+	}
+	ep, err := m.k8sclient.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(2).Infof("failed to get endpoints %s/%s: %v", externalServiceNamespace, externalServiceName, err)
+		return false
+	}
+	return endpointSubsetsHash(source.Subsets) != endpointSubsetsHash(ep.Subsets)
+}
+
+// endpointSubsetsHash a hash of endpoint subsets that does not depend on the order
+// of their addresses and ports, so that equivalent endpoints have the same hash
+func endpointSubsetsHash(subsets []v1.EndpointSubset) string {
+	b, _ := json.Marshal(endpointsutil.RepackSubsets(subsets))
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// copyEndpointSubsets a deep copy of the endpoint subsets
+func copyEndpointSubsets(subsets []v1.EndpointSubset) []v1.EndpointSubset {
+	copied := []v1.EndpointSubset{}
+	for _, s := range subsets {
+		copied = append(copied, *s.DeepCopy())
+	}
+	return copied
+}
+
+// conflictingManager return who manages the object, if it is anyone other
+// than the CCM. Objects without the managed-by label are treated as ours
+// only if legacy is set, i.e. they were created by an earlier version of the
+// CCM that did not label its objects.
+func conflictingManager(meta metav1.ObjectMeta, legacy bool) string {
+	manager, ok := meta.Labels[managedByLabel]
+	switch {
+	case ok && manager == managedByCCM:
+		return ""
+	case ok:
+		return manager
+	case legacy:
+		return ""
+	default:
+		return "an unknown manager"
+	}
+}
+
+// setManagedBy mark the object as managed by the CCM
+func setManagedBy(meta *metav1.ObjectMeta) {
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	meta.Labels[managedByLabel] = managedByCCM
+}
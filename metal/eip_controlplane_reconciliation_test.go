@@ -0,0 +1,522 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const testEIP = "147.75.100.1"
+
+func testKubernetesService() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "https", Protocol: v1.ProtocolTCP, Port: 443, TargetPort: intstr.FromInt(6443)},
+			},
+		},
+	}
+}
+
+func testKubernetesEndpoints() *v1.Endpoints {
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+				Ports:     []v1.EndpointPort{{Name: "https", Port: 6443, Protocol: v1.ProtocolTCP}},
+			},
+		},
+	}
+}
+
+func testControlPlaneEndpointManager(t *testing.T) (*controlPlaneEndpointManager, *fake.Clientset) {
+	client := fake.NewSimpleClientset(testKubernetesService(), testKubernetesEndpoints())
+	m := newControlPlaneEndpointManager(Config{EIPTag: "eiptag", ProjectID: projectID}, nil, nil, nil)
+	if err := m.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	return m, client
+}
+
+func TestSyncExternalService(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	if m.nodeAPIServerPort != 6443 || m.eipPort() != 6443 {
+		t.Errorf("mismatched ports, actual %d/%d expected 6443/6443", m.eipPort(), m.nodeAPIServerPort)
+	}
+	svc, err := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("external service not created: %v", err)
+	}
+	if svc.Spec.LoadBalancerIP != testEIP {
+		t.Errorf("mismatched loadBalancerIP, actual %s expected %s", svc.Spec.LoadBalancerIP, testEIP)
+	}
+	if m.externalServiceChanged(svc) {
+		t.Errorf("freshly synced external service reported as changed")
+	}
+	ep, err := client.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("external endpoints not created: %v", err)
+	}
+	if m.externalEndpointsChanged(ctx, ep) {
+		t.Errorf("freshly synced external endpoints reported as changed")
+	}
+}
+
+func TestSyncExternalServicePortChanged(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	recorder := record.NewFakeRecorder(10)
+	m.recorder = recorder
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	moved := testKubernetesService()
+	moved.Spec.Ports[0].TargetPort = intstr.FromInt(7443)
+	if err := m.syncExternalService(ctx, moved, testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	if m.nodeAPIServerPort != 7443 || m.eipPort() != 7443 {
+		t.Errorf("mismatched ports, actual %d/%d expected 7443/7443", m.eipPort(), m.nodeAPIServerPort)
+	}
+	svc, err := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get external service: %v", err)
+	}
+	if port := svc.Spec.Ports[0]; port.Port != 7443 || port.TargetPort.IntVal != 7443 {
+		t.Errorf("mismatched external service port, actual %d -> %s expected 7443 -> 7443", port.Port, port.TargetPort.String())
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, eventReasonAPIServerPortChanged) {
+			t.Errorf("mismatched event, actual %q", event)
+		}
+	default:
+		t.Errorf("no event recorded for changed apiserver port")
+	}
+
+	// a named target port cannot be resolved, so the last known port is kept
+	named := testKubernetesService()
+	named.Spec.Ports[0].TargetPort = intstr.FromString("https")
+	if err := m.syncExternalService(ctx, named, testEIP); err == nil {
+		t.Errorf("expected error for named target port")
+	}
+	if m.nodeAPIServerPort != 7443 {
+		t.Errorf("mismatched port after named target port, actual %d expected 7443", m.nodeAPIServerPort)
+	}
+}
+
+func TestRepairExternalService(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	svcIntf := client.CoreV1().Services(externalServiceNamespace)
+
+	// nothing synced yet, so nothing to repair from
+	m.repairExternalService(ctx, "deleted")
+	if _, err := svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{}); err == nil {
+		t.Fatalf("external service created before first sync")
+	}
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+
+	// mangle the service
+	svc, _ := svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{})
+	svc.Spec.LoadBalancerIP = "1.2.3.4"
+	svc.Spec.Ports[0].Port = 8443
+	if !m.externalServiceChanged(svc) {
+		t.Errorf("mangled external service not reported as changed")
+	}
+	if _, err := svcIntf.Update(ctx, svc, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error mangling service: %v", err)
+	}
+	m.repairExternalService(ctx, "changed")
+	svc, _ = svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{})
+	if svc.Spec.LoadBalancerIP != testEIP || svc.Spec.Ports[0].Port != 6443 {
+		t.Errorf("external service not repaired: %#v", svc.Spec)
+	}
+
+	// delete the service and endpoints
+	if err := svcIntf.Delete(ctx, externalServiceName, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error deleting service: %v", err)
+	}
+	if err := client.CoreV1().Endpoints(externalServiceNamespace).Delete(ctx, externalServiceName, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error deleting endpoints: %v", err)
+	}
+	m.repairExternalService(ctx, "deleted")
+	if _, err := svcIntf.Get(ctx, externalServiceName, metav1.GetOptions{}); err != nil {
+		t.Errorf("external service not recreated: %v", err)
+	}
+	if _, err := client.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{}); err != nil {
+		t.Errorf("external endpoints not recreated: %v", err)
+	}
+}
+
+func TestSyncExternalServiceConflict(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		legacy   bool
+		conflict bool
+	}{
+		{"unlabeled user service", nil, false, true},
+		{"other manager", map[string]string{managedByLabel: "argocd"}, true, true},
+		{"legacy ccm service", nil, true, false},
+		{"labeled ccm service", map[string]string{managedByLabel: managedByCCM}, false, false},
+	}
+	for _, tt := range tests {
+		m, client := testControlPlaneEndpointManager(t)
+		existing := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        externalServiceName,
+				Namespace:   externalServiceNamespace,
+				Labels:      tt.labels,
+				Annotations: map[string]string{},
+			},
+			Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP},
+		}
+		if tt.legacy {
+			existing.Annotations[metallbAnnotation] = metallbDisabledtag
+		}
+		if _, err := client.CoreV1().Services(externalServiceNamespace).Create(ctx, existing, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("%s: unexpected error creating service: %v", tt.name, err)
+		}
+		err := m.syncExternalService(ctx, testKubernetesService(), testEIP)
+		if (err != nil) != tt.conflict {
+			t.Errorf("%s: mismatched conflict, actual error %v expected conflict %v", tt.name, err, tt.conflict)
+		}
+		svc, _ := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+		overwritten := svc.Spec.LoadBalancerIP == testEIP
+		if overwritten == tt.conflict {
+			t.Errorf("%s: mismatched overwrite, actual %v expected %v", tt.name, overwritten, !tt.conflict)
+		}
+		if !tt.conflict && svc.Labels[managedByLabel] != managedByCCM {
+			t.Errorf("%s: managed-by label not set, labels %v", tt.name, svc.Labels)
+		}
+	}
+}
+
+func TestReconcileNodesNoControlPlane(t *testing.T) {
+	m, _ := testControlPlaneEndpointManager(t)
+	// no ip reservation service, so any call to the Equinix Metal API would fail
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "worker-2"}},
+	}
+	for _, mode := range []UpdateMode{ModeSync, ModeSync, ModeAdd} {
+		if err := m.reconcileNodes(context.Background(), nodes, mode); err != nil {
+			t.Errorf("unexpected error for mode %v with no control plane nodes: %v", mode, err)
+		}
+	}
+	if !m.noControlPlaneNodes {
+		t.Errorf("sync without control plane nodes not recorded")
+	}
+}
+
+func TestControlPlaneEndpointDisabled(t *testing.T) {
+	client := fake.NewSimpleClientset(testKubernetesService(), testKubernetesEndpoints())
+	m := newControlPlaneEndpointManager(Config{ProjectID: projectID}, nil, nil, nil)
+	if err := m.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	if mode := m.mode(); mode != controlPlaneEndpointDisabled {
+		t.Errorf("mismatched mode, actual %s expected %s", mode, controlPlaneEndpointDisabled)
+	}
+	if m.nodeReconciler() != nil || m.serviceReconciler() != nil {
+		t.Errorf("reconcilers registered without elastic ip tag or load balancer")
+	}
+
+	m, _ = testControlPlaneEndpointManager(t)
+	if mode := m.mode(); mode != controlPlaneEndpointEIP {
+		t.Errorf("mismatched mode, actual %s expected %s", mode, controlPlaneEndpointEIP)
+	}
+	if m.nodeReconciler() == nil || m.serviceReconciler() == nil {
+		t.Errorf("reconcilers not registered with elastic ip tag")
+	}
+}
+
+func TestReconcileNodesRemove(t *testing.T) {
+	m, _ := testControlPlaneEndpointManager(t)
+	// no ip reservation service, so any call to the Equinix Metal API would fail
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}}},
+	}
+	if err := m.reconcileNodes(context.Background(), nodes, ModeRemove); err != nil {
+		t.Errorf("unexpected error removing control plane node: %v", err)
+	}
+}
+
+func TestReconcileServicesRemove(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+
+	// no ip reservation service, so any call to the Equinix Metal API would fail
+	if err := m.reconcileServices(ctx, []*v1.Service{testKubernetesService()}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error removing: %v", err)
+	}
+	ep, err := client.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get external endpoints: %v", err)
+	}
+	if len(ep.Subsets) != 0 {
+		t.Errorf("mismatched external endpoints after removal, actual %v expected none", ep.Subsets)
+	}
+	if _, err := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{}); err != nil {
+		t.Errorf("external service removed: %v", err)
+	}
+
+	// the departed apiservers are not mirrored again by a repair
+	client.ClearActions()
+	m.repairExternalService(ctx, "endpoints changed")
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("mismatched actions for repair after removal, actual %v expected none", actions)
+	}
+}
+
+func TestSyncExternalServiceReorderedEndpoints(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+
+	// the apiserver endpoint reconciler rewrites the same endpoints in a different order
+	source := testKubernetesEndpoints()
+	source.Subsets[0].Addresses = []v1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}}
+	if _, err := client.CoreV1().Endpoints("default").Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error updating source endpoints: %v", err)
+	}
+	ep, err := client.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("external endpoints not created: %v", err)
+	}
+	if m.externalEndpointsChanged(ctx, ep) {
+		t.Errorf("reordered source endpoints reported as changed")
+	}
+
+	client.ClearActions()
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if (action.GetVerb() == "update" || action.GetVerb() == "patch") && action.GetResource().Resource == "endpoints" {
+			t.Errorf("external endpoints updated although only the order of the source endpoints changed")
+		}
+		// the external service, and its status, are unchanged too
+		if (action.GetVerb() == "update" || action.GetVerb() == "patch") && action.GetResource().Resource == "services" {
+			t.Errorf("unchanged external service updated, subresource %q", action.GetSubresource())
+		}
+	}
+
+	// an actual change is still mirrored
+	source.Subsets[0].Addresses = []v1.EndpointAddress{{IP: "10.0.0.3"}}
+	if _, err := client.CoreV1().Endpoints("default").Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error updating source endpoints: %v", err)
+	}
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	ep, err = client.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("external endpoints missing: %v", err)
+	}
+	if len(ep.Subsets) != 1 || len(ep.Subsets[0].Addresses) != 1 || ep.Subsets[0].Addresses[0].IP != "10.0.0.3" {
+		t.Errorf("mismatched external endpoints, actual %v expected 10.0.0.3", ep.Subsets)
+	}
+}
+
+func TestReconcileServicesUnchanged(t *testing.T) {
+	ctx := context.Background()
+	ips := &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}}},
+	}}
+	m, client := testControlPlaneEndpointManager(t)
+	m.ipResSvr = ips
+	if err := m.reconcileServices(ctx, []*v1.Service{testKubernetesService()}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// neither another sync, nor one after a restart, which starts without knowing what it wrote,
+	// writes anything, as the external service, its endpoints and its status are already as they should be
+	restarted := newControlPlaneEndpointManager(Config{EIPTag: "eiptag", ProjectID: projectID}, nil, nil, nil)
+	if err := restarted.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	restarted.ipResSvr = ips
+	for i, manager := range []*controlPlaneEndpointManager{m, restarted} {
+		client.ClearActions()
+		if err := manager.reconcileServices(ctx, []*v1.Service{testKubernetesService()}, ModeSync); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		for _, action := range client.Actions() {
+			if verb := action.GetVerb(); verb != "get" && verb != "list" && verb != "watch" {
+				t.Errorf("%d: unexpected %s of %s %q on unchanged sync", i, verb, action.GetResource().Resource, action.GetSubresource())
+			}
+		}
+	}
+}
+
+// countingProjectIPService a project IP service that only counts how often the IPs are listed
+type countingProjectIPService struct {
+	packngo.ProjectIPService
+	ips   []packngo.IPAddressReservation
+	lists int
+}
+
+func (s *countingProjectIPService) List(projectID string, opts *packngo.ListOptions) ([]packngo.IPAddressReservation, *packngo.Response, error) {
+	s.lists++
+	return s.ips, nil, nil
+}
+
+func TestListIPReservationsShared(t *testing.T) {
+	ctx := context.Background()
+	ipResSvr := &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}}},
+	}}
+	m, _ := testControlPlaneEndpointManager(t)
+	m.ipResSvr = ipResSvr
+
+	// the service and node reconcilers of a pass share one list
+	if err := m.reconcileServices(ctx, []*v1.Service{testKubernetesService()}, ModeSync); err != nil {
+		t.Fatalf("unexpected error reconciling services: %v", err)
+	}
+	if _, err := m.listIPReservations(ctx); err != nil {
+		t.Fatalf("unexpected error listing: %v", err)
+	}
+	if ipResSvr.lists != 1 {
+		t.Errorf("mismatched lists, actual %d expected 1", ipResSvr.lists)
+	}
+
+	// once stale, or after changing an assignment, they are listed again
+	m.ipReservationsFetched = m.ipReservationsFetched.Add(-ipReservationsTTL)
+	if _, err := m.listIPReservations(ctx); err != nil {
+		t.Fatalf("unexpected error listing: %v", err)
+	}
+	m.invalidateIPReservations()
+	if _, err := m.listIPReservations(ctx); err != nil {
+		t.Fatalf("unexpected error listing: %v", err)
+	}
+	if ipResSvr.lists != 3 {
+		t.Errorf("mismatched lists, actual %d expected 3", ipResSvr.lists)
+	}
+}
+
+func TestReconcileEIPNotFound(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"othertag"}}},
+	}}
+	m.apiServerPort = 6443
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}}},
+	}
+
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); !errors.Is(err, ErrEIPNotFound) {
+		t.Errorf("mismatched node reconcile error, actual %v expected %v", err, ErrEIPNotFound)
+	}
+	if err := m.reconcileServices(ctx, []*v1.Service{testKubernetesService()}, ModeSync); !errors.Is(err, ErrEIPNotFound) {
+		t.Errorf("mismatched service reconcile error, actual %v expected %v", err, ErrEIPNotFound)
+	}
+}
+
+func TestEIPPort(t *testing.T) {
+	tests := []struct {
+		configured, node, expected int32
+	}{
+		{0, 0, 0},
+		{0, 6443, 6443},
+		{443, 6443, 443},
+	}
+	for i, tt := range tests {
+		m := &controlPlaneEndpointManager{apiServerPort: tt.configured, nodeAPIServerPort: tt.node}
+		if actual := m.eipPort(); actual != tt.expected {
+			t.Errorf("%d: mismatched port, actual %d expected %d", i, actual, tt.expected)
+		}
+	}
+}
+
+func TestCheckPortTranslation(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "master-1"},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+	tests := []struct {
+		eipPort     int32
+		nodeHealthy bool
+		event       bool
+	}{
+		// same port, nothing to translate
+		{6443, true, false},
+		// apiserver healthy on the node, so the translation is broken
+		{443, true, true},
+		// apiserver itself is unhealthy
+		{443, false, false},
+	}
+	for i, tt := range tests {
+		recorder := record.NewFakeRecorder(10)
+		m := &controlPlaneEndpointManager{
+			apiServerPort:     tt.eipPort,
+			nodeAPIServerPort: 6443,
+			recorder:          recorder,
+			healthChecker:     &addressHealthChecker{healthy: map[string]bool{"10.0.0.1:6443": tt.nodeHealthy}},
+		}
+		m.checkPortTranslation(context.Background(), node, testEIP)
+		if actual := len(recorder.Events) == 1; actual != tt.event {
+			t.Errorf("%d: mismatched event, actual %t expected %t", i, actual, tt.event)
+		}
+	}
+}
+
+func TestSourceEndpointsChanged(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+
+	// not yet synced, nothing to mirror to
+	if m.sourceEndpointsChanged(ctx, testKubernetesEndpoints()) {
+		t.Errorf("source endpoints reported as changed before the first sync")
+	}
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+
+	tests := []struct {
+		addresses []v1.EndpointAddress
+		changed   bool
+	}{
+		{[]v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}}, false},
+		{[]v1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}}, false},
+		// an apiserver went away
+		{[]v1.EndpointAddress{{IP: "10.0.0.1"}}, true},
+		// an apiserver joined
+		{[]v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}, {IP: "10.0.0.3"}}, true},
+	}
+	for i, tt := range tests {
+		source := testKubernetesEndpoints()
+		source.Subsets[0].Addresses = tt.addresses
+		if actual := m.sourceEndpointsChanged(ctx, source); actual != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, actual, tt.changed)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventReasonEIPCreated      = "ControlPlaneEIPCreated"
+	eventReasonEIPCreateFailed = "ControlPlaneEIPCreateFailed"
+
+	// eipCreateDescription the description of an elastic IP the CCM created for the control plane
+	eipCreateDescription = "control plane endpoint, created by the cloud-controller-manager"
+)
+
+// eipCreateRequest a request for an IP reservation that can place it in a metro,
+// which packngo.IPReservationRequest does not support yet
+type eipCreateRequest struct {
+	packngo.IPReservationRequest
+	Metro string `json:"metro,omitempty"`
+}
+
+// eipCreator request an IP reservation in a project
+type eipCreator interface {
+	create(projectID string, req *eipCreateRequest) (*packngo.IPAddressReservation, error)
+}
+
+// packngoEIPCreator eipCreator with the Equinix Metal API
+type packngoEIPCreator struct {
+	client *packngo.Client
+}
+
+func (c packngoEIPCreator) create(projectID string, req *eipCreateRequest) (*packngo.IPAddressReservation, error) {
+	ip := new(packngo.IPAddressReservation)
+	_, err := c.client.DoRequest("POST", fmt.Sprintf("/projects/%s/ips", projectID), req, ip)
+	return ip, wrapAPIError(err)
+}
+
+// eipBootstrap create the control plane elastic IP when there is none with its tag, in the metro,
+// or the facility if there is no metro. It creates at most one per process: the tag finds the
+// one it created from then on, also after a restart.
+type eipBootstrap struct {
+	creator  eipCreator
+	metro    string
+	facility string
+	// created the elastic IP it created, if any
+	created *packngo.IPAddressReservation
+}
+
+// newEIPBootstrap the bootstrap that creates the elastic IP in the metro or facility; nil, i.e.
+// none, if not enabled
+func newEIPBootstrap(enabled bool, creator eipCreator, metro, facility string) *eipBootstrap {
+	if !enabled {
+		return nil
+	}
+	return &eipBootstrap{creator: creator, metro: metro, facility: facility}
+}
+
+// bootstrapEIP create the control plane elastic IP, which was not found with its tag, if enabled.
+// Returns nil without an error if not enabled, so that the caller reports it as not found.
+func (m *controlPlaneEndpointManager) bootstrapEIP(ctx context.Context) (*packngo.IPAddressReservation, error) {
+	b := m.eipCreate
+	if b == nil {
+		return nil, nil
+	}
+	// never create a second one: whatever happened to the first, e.g. its tag was removed, needs a look
+	if b.created != nil {
+		return nil, fmt.Errorf("%w with tag %s, and the elastic ip %s created earlier no longer has it, not creating another", ErrEIPNotFound, m.eipTag, b.created.Address)
+	}
+	req := &eipCreateRequest{
+		IPReservationRequest: packngo.IPReservationRequest{
+			Type:                   "public_ipv4",
+			Quantity:               1,
+			Description:            eipCreateDescription,
+			Tags:                   []string{m.eipTag},
+			FailOnApprovalRequired: true,
+		},
+		Metro: b.metro,
+	}
+	location := b.metro
+	if location == "" {
+		req.Facility = &b.facility
+		location = b.facility
+	}
+	klog.Infof("no control plane elastic ip with tag %s, creating one in %s", m.eipTag, location)
+	_, span := startSpan(ctx, "metal.ProjectIPs.Request")
+	ip, err := b.creator.create(m.projectID, req)
+	endSpan(ctx, span, err)
+	if err != nil {
+		m.recordEIPCreateEvent(v1.EventTypeWarning, eventReasonEIPCreateFailed, "unable to create control plane elastic ip with tag %s in %s: %v", m.eipTag, location, err)
+		return nil, fmt.Errorf("unable to create control plane elastic ip with tag %s in %s: %w", m.eipTag, location, err)
+	}
+	b.created = ip
+	m.invalidateIPReservations()
+	klog.Infof("created control plane elastic ip %s with tag %s in %s", ip.Address, m.eipTag, location)
+	m.recordEIPCreateEvent(v1.EventTypeNormal, eventReasonEIPCreated, "created control plane elastic ip %s with tag %s in %s", ip.Address, m.eipTag, location)
+	return ip, nil
+}
+
+// recordEIPCreateEvent record an event about the creation of the elastic IP on the default/kubernetes
+// service, as there is nothing in the cluster for the elastic IP itself yet
+func (m *controlPlaneEndpointManager) recordEIPCreateEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if m.recorder == nil {
+		return
+	}
+	svc := &v1.ObjectReference{APIVersion: "v1", Kind: "Service", Namespace: "default", Name: "kubernetes"}
+	m.recorder.Eventf(svc, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,114 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	"k8s.io/client-go/tools/record"
+)
+
+// testEIPCreator record the requests, and fail them with err if set
+type testEIPCreator struct {
+	requests []*eipCreateRequest
+	err      error
+}
+
+func (c *testEIPCreator) create(projectID string, req *eipCreateRequest) (*packngo.IPAddressReservation, error) {
+	c.requests = append(c.requests, req)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: "eip-1", Address: testEIP, Tags: req.Tags}}, nil
+}
+
+func TestBootstrapEIP(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		enabled  bool
+		metro    string
+		err      error
+		created  bool
+		metroReq string
+		facility string
+	}{
+		{false, "da", nil, false, "", ""},
+		{true, "da", nil, true, "da", ""},
+		{true, "", nil, true, "", "ewr1"},
+		{true, "da", errors.New("quota exceeded"), false, "da", ""},
+	}
+	for i, tt := range tests {
+		creator := &testEIPCreator{err: tt.err}
+		recorder := record.NewFakeRecorder(10)
+		m := &controlPlaneEndpointManager{eipTag: "eiptag", projectID: projectID, recorder: recorder}
+		m.eipCreate = newEIPBootstrap(tt.enabled, creator, tt.metro, "ewr1")
+		ip, err := m.bootstrapEIP(ctx)
+		switch {
+		case tt.err != nil && !errors.Is(err, tt.err):
+			t.Errorf("%d: mismatched error, actual %v expected %v", i, err, tt.err)
+		case tt.err == nil && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if (ip != nil) != tt.created {
+			t.Errorf("%d: mismatched created, actual %v expected %t", i, ip, tt.created)
+		}
+		if !tt.enabled {
+			if len(creator.requests) != 0 || len(recorder.Events) != 0 {
+				t.Errorf("%d: requested %d elastic ips and recorded %d events while not enabled", i, len(creator.requests), len(recorder.Events))
+			}
+			continue
+		}
+		if len(creator.requests) != 1 {
+			t.Fatalf("%d: mismatched requests, actual %d expected 1", i, len(creator.requests))
+		}
+		req := creator.requests[0]
+		if req.Metro != tt.metroReq {
+			t.Errorf("%d: mismatched metro, actual %s expected %s", i, req.Metro, tt.metroReq)
+		}
+		var facility string
+		if req.Facility != nil {
+			facility = *req.Facility
+		}
+		if facility != tt.facility {
+			t.Errorf("%d: mismatched facility, actual %s expected %s", i, facility, tt.facility)
+		}
+		if !reflect.DeepEqual(req.Tags, []string{"eiptag"}) || req.Type != "public_ipv4" || req.Quantity != 1 {
+			t.Errorf("%d: mismatched request, actual %+v", i, req.IPReservationRequest)
+		}
+		reason := eventReasonEIPCreated
+		if tt.err != nil {
+			reason = eventReasonEIPCreateFailed
+		}
+		if event := <-recorder.Events; !strings.Contains(event, reason) {
+			t.Errorf("%d: mismatched event, actual %s expected %s", i, event, reason)
+		}
+	}
+}
+
+func TestBootstrapEIPOnce(t *testing.T) {
+	ctx := context.Background()
+	creator := &testEIPCreator{err: errors.New("temporarily unavailable")}
+	m := &controlPlaneEndpointManager{eipTag: "eiptag", projectID: projectID, recorder: record.NewFakeRecorder(10)}
+	m.eipCreate = newEIPBootstrap(true, creator, "da", "")
+
+	// a failed request is retried
+	for i := 0; i < 2; i++ {
+		if _, err := m.bootstrapEIP(ctx); err == nil {
+			t.Fatalf("%d: unexpected success", i)
+		}
+	}
+	creator.err = nil
+	if ip, err := m.bootstrapEIP(ctx); err != nil || ip == nil {
+		t.Fatalf("unexpected result creating: %v %v", ip, err)
+	}
+	// once created, there is never a second one, even if the tag cannot find the first
+	if _, err := m.bootstrapEIP(ctx); !errors.Is(err, ErrEIPNotFound) {
+		t.Errorf("mismatched error, actual %v expected %v", err, ErrEIPNotFound)
+	}
+	if len(creator.requests) != 3 {
+		t.Errorf("mismatched requests, actual %d expected 3", len(creator.requests))
+	}
+}
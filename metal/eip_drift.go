@@ -0,0 +1,138 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// what the CCM does when the control plane elastic IP is changed outside of it, e.g. by Terraform
+	// eipDriftObserve record an event, and accept the change
+	eipDriftObserve = "observe"
+	// eipDriftEnforce record an event, and change the elastic IP back
+	eipDriftEnforce = "enforce"
+
+	eventReasonEIPDrift         = "EIPDrift"
+	eventReasonEIPDriftReverted = "EIPDriftReverted"
+)
+
+// ValidateEIPDriftPolicy return an error if the setting is not a valid EIP drift policy
+func ValidateEIPDriftPolicy(setting string) error {
+	switch setting {
+	case "", eipDriftObserve, eipDriftEnforce:
+		return nil
+	default:
+		return fmt.Errorf("invalid EIP drift policy %q, must be one of %s, %s", setting, eipDriftObserve, eipDriftEnforce)
+	}
+}
+
+// ipReservationUpdater change the tags and description of an IP reservation, which
+// the packngo project IP service cannot
+type ipReservationUpdater interface {
+	update(id string, tags []string, description string) error
+}
+
+// packngoIPReservationUpdater ipReservationUpdater with the Equinix Metal API
+type packngoIPReservationUpdater struct {
+	client *packngo.Client
+}
+
+func (u packngoIPReservationUpdater) update(id string, tags []string, description string) error {
+	req := map[string]interface{}{"tags": tags, "details": description}
+	_, err := u.client.DoRequest("PATCH", fmt.Sprintf("/ips/%s", id), req, nil)
+	return wrapAPIError(err)
+}
+
+// eipBaseline what the control plane elastic IP last was as far as the CCM knows: as it
+// first found it, as it last changed it, or as it accepted a change made outside of it
+type eipBaseline struct {
+	tags        []string
+	description string
+	deviceID    string
+}
+
+func newEIPBaseline(ip *packngo.IPAddressReservation) eipBaseline {
+	b := eipBaseline{
+		tags:     append([]string(nil), ip.Tags...),
+		deviceID: assignedDeviceID(ip),
+	}
+	sort.Strings(b.tags)
+	if ip.Description != nil {
+		b.description = *ip.Description
+	}
+	return b
+}
+
+// controlPlaneEndpointRef the ControlPlaneEndpoint, on which drift events are recorded
+var controlPlaneEndpointRef = &v1.ObjectReference{
+	APIVersion: controlPlaneEndpointResource.GroupVersion().String(),
+	Kind:       controlPlaneEndpointKind,
+	Name:       controlPlaneEndpointName,
+}
+
+// checkDrift compare the control plane elastic IP with the baseline, and, if its tags,
+// description or, unless something else moves it, its assignment were changed outside
+// of the CCM, record an event, and either accept the change or revert it, by policy.
+// An assignment is only reverted to a healthy control plane node. Returns whether it
+// moved the elastic IP back.
+func (m *controlPlaneEndpointManager) checkDrift(ctx context.Context, nodes []*v1.Node, ip *packngo.IPAddressReservation, deferred bool) bool {
+	if m.eipDriftPolicy == "" {
+		return false
+	}
+	current := newEIPBaseline(ip)
+	if m.eipBaseline == nil {
+		m.eipBaseline = &current
+		return false
+	}
+	baseline := *m.eipBaseline
+	enforce := m.eipDriftPolicy == eipDriftEnforce
+
+	if !reflect.DeepEqual(current.tags, baseline.tags) || current.description != baseline.description {
+		klog.Warningf("elastic ip %s changed outside the CCM: tags %v, description %q, were tags %v, description %q", ip.Address, current.tags, current.description, baseline.tags, baseline.description)
+		m.recorder.Eventf(controlPlaneEndpointRef, v1.EventTypeWarning, eventReasonEIPDrift, "tags or description of elastic ip %s changed outside the CCM, to tags %v, description %q", ip.Address, current.tags, current.description)
+		switch {
+		case !enforce:
+			m.eipBaseline.tags, m.eipBaseline.description = current.tags, current.description
+		case m.ipUpdater == nil:
+			klog.Errorf("unable to revert tags and description of elastic ip %s: no API client", ip.Address)
+		default:
+			if err := m.ipUpdater.update(ip.ID, baseline.tags, baseline.description); err != nil {
+				klog.Errorf("unable to revert tags and description of elastic ip %s: %v", ip.Address, err)
+			} else {
+				m.invalidateIPReservations()
+				m.recorder.Eventf(controlPlaneEndpointRef, v1.EventTypeNormal, eventReasonEIPDriftReverted, "reverted tags of elastic ip %s to %v, description to %q", ip.Address, baseline.tags, baseline.description)
+			}
+		}
+	}
+
+	// whatever else moves the elastic IP may do so
+	if deferred {
+		m.eipBaseline.deviceID = current.deviceID
+	}
+	if deferred || current.deviceID == baseline.deviceID {
+		return false
+	}
+	klog.Warningf("elastic ip %s was moved outside the CCM, to device %q, was on device %q", ip.Address, current.deviceID, baseline.deviceID)
+	m.recorder.Eventf(controlPlaneEndpointRef, v1.EventTypeWarning, eventReasonEIPDrift, "elastic ip %s was moved outside the CCM, to device %q, was on device %q", ip.Address, current.deviceID, baseline.deviceID)
+	if enforce {
+		for _, node := range nodes {
+			if id, err := deviceIDFromProviderID(node.Spec.ProviderID); err != nil || id != baseline.deviceID {
+				continue
+			}
+			if err := m.reassign(ctx, []*v1.Node{node}, ip, "", "reverting a move outside the CCM"); err != nil {
+				klog.Errorf("unable to move elastic ip %s back to node %s, accepting the move: %v", ip.Address, node.Name, err)
+				break
+			}
+			m.recorder.Eventf(controlPlaneEndpointRef, v1.EventTypeNormal, eventReasonEIPDriftReverted, "moved elastic ip %s back to node %s", ip.Address, node.Name)
+			return true
+		}
+	}
+	m.eipBaseline.deviceID = current.deviceID
+	return false
+}
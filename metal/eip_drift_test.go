@@ -0,0 +1,109 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+	"k8s.io/client-go/tools/record"
+)
+
+type testIPReservationUpdater struct {
+	tags        []string
+	description string
+	err         error
+}
+
+func (u *testIPReservationUpdater) update(id string, tags []string, description string) error {
+	if u.err != nil {
+		return u.err
+	}
+	u.tags, u.description = tags, description
+	return nil
+}
+
+func testDriftEIP(tags []string, description, deviceID string) *packngo.IPAddressReservation {
+	ip := &packngo.IPAddressReservation{}
+	ip.ID = "eip-id"
+	ip.Address = testEIP
+	ip.Tags = tags
+	ip.Description = &description
+	if deviceID != "" {
+		ip.Assignments = []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/metal/v1/devices/" + deviceID}}}
+	}
+	return ip
+}
+
+func TestCheckDrift(t *testing.T) {
+	baseline := testDriftEIP([]string{"eiptag", "b"}, "control plane", "device-a")
+	tests := []struct {
+		policy    string
+		deferred  bool
+		updateErr error
+		ip        *packngo.IPAddressReservation
+		events    int
+		updated   bool
+		expected  eipBaseline
+	}{
+		// not checked
+		{"", false, nil, testDriftEIP([]string{"other"}, "", "device-b"), 0, false, eipBaseline{}},
+		// unchanged, or only reordered tags
+		{eipDriftObserve, false, nil, testDriftEIP([]string{"b", "eiptag"}, "control plane", "device-a"), 0, false, eipBaseline{[]string{"b", "eiptag"}, "control plane", "device-a"}},
+		// observed changes are accepted
+		{eipDriftObserve, false, nil, testDriftEIP([]string{"eiptag"}, "changed", "device-a"), 1, false, eipBaseline{[]string{"eiptag"}, "changed", "device-a"}},
+		{eipDriftObserve, false, nil, testDriftEIP([]string{"b", "eiptag"}, "control plane", "device-b"), 1, false, eipBaseline{[]string{"b", "eiptag"}, "control plane", "device-b"}},
+		// enforced changes of tags and description are reverted
+		{eipDriftEnforce, false, nil, testDriftEIP([]string{"eiptag"}, "changed", "device-a"), 2, true, eipBaseline{[]string{"b", "eiptag"}, "control plane", "device-a"}},
+		{eipDriftEnforce, false, errors.New("api down"), testDriftEIP([]string{"eiptag"}, "changed", "device-a"), 1, false, eipBaseline{[]string{"b", "eiptag"}, "control plane", "device-a"}},
+		// a move to an unknown node cannot be reverted, and is accepted
+		{eipDriftEnforce, false, nil, testDriftEIP([]string{"b", "eiptag"}, "control plane", "device-b"), 1, false, eipBaseline{[]string{"b", "eiptag"}, "control plane", "device-b"}},
+		// something else moves the elastic IP
+		{eipDriftEnforce, true, nil, testDriftEIP([]string{"b", "eiptag"}, "control plane", "device-b"), 0, false, eipBaseline{[]string{"b", "eiptag"}, "control plane", "device-b"}},
+	}
+	for i, tt := range tests {
+		m, _ := testControlPlaneEndpointManager(t)
+		recorder := record.NewFakeRecorder(10)
+		updater := &testIPReservationUpdater{err: tt.updateErr}
+		m.recorder = recorder
+		m.ipUpdater = updater
+		m.eipDriftPolicy = tt.policy
+
+		ctx := context.Background()
+		m.checkDrift(ctx, nil, baseline, false)
+		if moved := m.checkDrift(ctx, nil, tt.ip, tt.deferred); moved {
+			t.Errorf("%d: unexpectedly moved the elastic ip", i)
+		}
+		if len(recorder.Events) != tt.events {
+			t.Errorf("%d: mismatched events, actual %d expected %d", i, len(recorder.Events), tt.events)
+		}
+		if updated := updater.tags != nil; updated != tt.updated {
+			t.Errorf("%d: mismatched update, actual %v expected %v", i, updated, tt.updated)
+		}
+		var actual eipBaseline
+		if m.eipBaseline != nil {
+			actual = *m.eipBaseline
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("%d: mismatched baseline, actual %#v expected %#v", i, actual, tt.expected)
+		}
+	}
+}
+
+func TestValidateEIPDriftPolicy(t *testing.T) {
+	tests := []struct {
+		setting string
+		valid   bool
+	}{
+		{"", true},
+		{eipDriftObserve, true},
+		{eipDriftEnforce, true},
+		{"revert", false},
+	}
+	for i, tt := range tests {
+		if err := ValidateEIPDriftPolicy(tt.setting); (err == nil) != tt.valid {
+			t.Errorf("%d: mismatched validity, actual %v expected %v", i, err == nil, tt.valid)
+		}
+	}
+}
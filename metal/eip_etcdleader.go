@@ -0,0 +1,136 @@
+package metal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// etcdLeaderNodePlaceholder in the etcd metrics URL, replaced by the address of each control plane node
+	etcdLeaderNodePlaceholder = "{node}"
+	// etcdLeaderMetric the etcd gauge that is 1 on the leader, and 0 on the other members
+	etcdLeaderMetric = "etcd_server_is_leader"
+)
+
+// etcdLeaderChecker ask the etcd member on each control plane node whether it is the leader,
+// via its metrics endpoint, as the apiserver does not tell which member leads
+type etcdLeaderChecker struct {
+	url    string
+	client *http.Client
+}
+
+// ValidateEIPEtcdLeaderMetrics whether the etcd leader metrics setting is valid
+func ValidateEIPEtcdLeaderMetrics(setting string) error {
+	_, err := newEtcdLeaderChecker(setting)
+	return err
+}
+
+// newEtcdLeaderChecker the checker of the etcd metrics at the URL of the setting, in which
+// the placeholder stands for the node address, nil if it is empty
+func newEtcdLeaderChecker(setting string) (*etcdLeaderChecker, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	if !strings.Contains(setting, etcdLeaderNodePlaceholder) {
+		return nil, fmt.Errorf("invalid etcd leader metrics %q: must contain %s for the address of the node", setting, etcdLeaderNodePlaceholder)
+	}
+	u, err := url.Parse(strings.Replace(setting, etcdLeaderNodePlaceholder, "127.0.0.1", -1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid etcd leader metrics %q: %w", setting, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid etcd leader metrics %q: must be an http or https URL", setting)
+	}
+	return &etcdLeaderChecker{
+		url: setting,
+		client: &http.Client{
+			Timeout:   healthCheckTimeout,
+			Transport: newTracingRoundTripper("etcd leader", http.DefaultTransport),
+		},
+	}, nil
+}
+
+// isLeader whether the etcd member at the address is the leader
+func (e *etcdLeaderChecker) isLeader(ctx context.Context, address string) (bool, error) {
+	host := address
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		host = "[" + address + "]"
+	}
+	u := strings.Replace(e.url, etcdLeaderNodePlaceholder, host, -1)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("http client error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned http code %d", u, resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != etcdLeaderMetric {
+			continue
+		}
+		val, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return false, fmt.Errorf("%s returned invalid %s %q: %w", u, etcdLeaderMetric, fields[1], err)
+		}
+		return val == 1, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("reading %s: %w", u, err)
+	}
+	return false, fmt.Errorf("%s returned no %s", u, etcdLeaderMetric)
+}
+
+// leader the node on which the etcd leader runs, nil if none of the nodes tells that it does
+func (e *etcdLeaderChecker) leader(ctx context.Context, nodes []*v1.Node, addressType v1.NodeAddressType) *v1.Node {
+	for _, node := range nodes {
+		addr := nodeProbeAddress(node, addressType)
+		if addr == "" {
+			continue
+		}
+		leader, err := e.isLeader(ctx, addr)
+		if err != nil {
+			klog.Warningf("unable to tell whether the etcd member on node %s is the leader: %v", node.Name, err)
+			continue
+		}
+		if leader {
+			return node
+		}
+	}
+	return nil
+}
+
+// avoidEtcdLeader the candidates for the elastic IP, with the node of the etcd leader, if known,
+// moved last, so that it gets the EIP only if none of the others is healthy
+func (m *controlPlaneEndpointManager) avoidEtcdLeader(ctx context.Context, candidates []*v1.Node) []*v1.Node {
+	if m.etcdLeader == nil || len(candidates) < 2 {
+		return candidates
+	}
+	leader := m.etcdLeader.leader(ctx, candidates, m.nodeAddressType)
+	if leader == nil {
+		return candidates
+	}
+	klog.V(2).Infof("etcd leader is on node %s, trying it last for the control plane elastic ip", leader.Name)
+	ordered := make([]*v1.Node, 0, len(candidates))
+	for _, node := range candidates {
+		if node != leader {
+			ordered = append(ordered, node)
+		}
+	}
+	return append(ordered, leader)
+}
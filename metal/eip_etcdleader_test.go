@@ -0,0 +1,145 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateEIPEtcdLeaderMetrics(t *testing.T) {
+	tests := []struct {
+		setting string
+		err     bool
+	}{
+		{"", false},
+		{"http://{node}:2381/metrics", false},
+		{"https://{node}:2379/metrics", false},
+		{"http://10.0.0.1:2381/metrics", true},
+		{"tcp://{node}:2381", true},
+		{"{node}:2381/metrics", true},
+	}
+
+	for i, tt := range tests {
+		err := ValidateEIPEtcdLeaderMetrics(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		}
+	}
+}
+
+func TestEtcdLeaderIsLeader(t *testing.T) {
+	var body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	tests := []struct {
+		status int
+		body   string
+		leader bool
+		err    bool
+	}{
+		{http.StatusOK, "# TYPE etcd_server_is_leader gauge\netcd_server_is_leader 1\n", true, false},
+		{http.StatusOK, "etcd_server_has_leader 1\netcd_server_is_leader 0\n", false, false},
+		{http.StatusOK, "etcd_server_has_leader 1\n", false, true},
+		{http.StatusOK, "etcd_server_is_leader yes\n", false, true},
+		{http.StatusNotFound, "etcd_server_is_leader 1\n", false, true},
+	}
+
+	checker, err := newEtcdLeaderChecker("http://{node}:" + port + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, tt := range tests {
+		status, body = tt.status, tt.body
+		leader, err := checker.isLeader(context.TODO(), "127.0.0.1")
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error", i)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if leader != tt.leader {
+			t.Errorf("%d: mismatched leader, actual %t expected %t", i, leader, tt.leader)
+		}
+	}
+}
+
+func TestAvoidEtcdLeader(t *testing.T) {
+	// every node address reaches the same server, which answers by the address asked for
+	leaders := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		val := 0
+		if leaders[host] {
+			val = 1
+		}
+		fmt.Fprintf(w, "etcd_server_is_leader %d\n", val)
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	checker, err := newEtcdLeaderChecker("http://{node}:2381/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checker.client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	node := func(name, address string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: address}}},
+		}
+	}
+	nodes := []*v1.Node{node("cp-a", "10.0.0.1"), node("cp-b", "10.0.0.2"), node("cp-c", "10.0.0.3")}
+
+	tests := []struct {
+		checker  *etcdLeaderChecker
+		leaders  []string
+		nodes    []*v1.Node
+		expected []string
+	}{
+		// not configured
+		{nil, []string{"10.0.0.1"}, nodes, []string{"cp-a", "cp-b", "cp-c"}},
+		// the leader is tried last
+		{checker, []string{"10.0.0.1"}, nodes, []string{"cp-b", "cp-c", "cp-a"}},
+		{checker, []string{"10.0.0.2"}, nodes, []string{"cp-a", "cp-c", "cp-b"}},
+		// no member tells that it leads
+		{checker, nil, nodes, []string{"cp-a", "cp-b", "cp-c"}},
+		// a single candidate is not asked
+		{checker, []string{"10.0.0.1"}, nodes[:1], []string{"cp-a"}},
+	}
+
+	for i, tt := range tests {
+		leaders = map[string]bool{}
+		for _, l := range tt.leaders {
+			leaders[l] = true
+		}
+		m := &controlPlaneEndpointManager{etcdLeader: tt.checker}
+		ordered := m.avoidEtcdLeader(context.TODO(), tt.nodes)
+		var names []string
+		for _, n := range ordered {
+			names = append(names, n.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("%d: mismatched order, actual %v expected %v", i, names, tt.expected)
+		}
+	}
+}
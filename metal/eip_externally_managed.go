@@ -0,0 +1,18 @@
+package metal
+
+import (
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotationExternallyManaged set to true on the external service when something else, e.g. a GitOps
+// tool like Argo CD, manages its metadata and spec, so that the CCM sets only its status, rather
+// than both of them endlessly reverting what the other set
+const annotationExternallyManaged = "metal.equinix.com/externally-managed"
+
+// externallyManaged whether the object has been marked as managed by something other than the CCM
+func externallyManaged(meta metav1.ObjectMeta) bool {
+	external, err := strconv.ParseBool(meta.Annotations[annotationExternallyManaged])
+	return err == nil && external
+}
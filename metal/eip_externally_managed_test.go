@@ -0,0 +1,66 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestSyncExternalServiceExternallyManaged(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	// as a GitOps tool would have it, with a manager of its own and ports that differ from ours
+	existing := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        externalServiceName,
+			Namespace:   externalServiceNamespace,
+			Labels:      map[string]string{managedByLabel: "argocd"},
+			Annotations: map[string]string{annotationExternallyManaged: "true"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "https", Protocol: v1.ProtocolTCP, Port: 6443, TargetPort: intstr.FromInt(6443)}},
+		},
+	}
+	if _, err := client.CoreV1().Services(externalServiceNamespace).Create(ctx, existing, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error creating service: %v", err)
+	}
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	svc, err := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting service: %v", err)
+	}
+	if !reflect.DeepEqual(svc.Spec, existing.Spec) {
+		t.Errorf("mismatched spec, actual %v expected %v", svc.Spec, existing.Spec)
+	}
+	if !reflect.DeepEqual(svc.Labels, existing.Labels) || !reflect.DeepEqual(svc.Annotations, existing.Annotations) {
+		t.Errorf("mismatched metadata, actual %v %v expected %v %v", svc.Labels, svc.Annotations, existing.Labels, existing.Annotations)
+	}
+	if ingress := svc.Status.LoadBalancer.Ingress; len(ingress) != 1 || ingress[0].IP != testEIP {
+		t.Errorf("mismatched ingress, actual %v expected %s", ingress, testEIP)
+	}
+	ep, err := client.CoreV1().Endpoints(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("endpoints not created: %v", err)
+	}
+	if !reflect.DeepEqual(ep.Subsets, testKubernetesEndpoints().Subsets) {
+		t.Errorf("mismatched subsets, actual %v expected %v", ep.Subsets, testKubernetesEndpoints().Subsets)
+	}
+
+	// its spec is not repaired, its status is
+	if m.externalServiceChanged(svc) {
+		t.Errorf("externally managed service reported changed for its spec")
+	}
+	noStatus := svc.DeepCopy()
+	noStatus.Status.LoadBalancer.Ingress = nil
+	if !m.externalServiceChanged(noStatus) {
+		t.Errorf("externally managed service without ingress not reported changed")
+	}
+}
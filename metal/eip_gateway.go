@@ -0,0 +1,161 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	gatewayAPIVersion = "gateway.networking.k8s.io/v1alpha2"
+	// gatewayListenerName the listener of the external gateway to which the route attaches
+	gatewayListenerName = "apiserver"
+)
+
+// gatewayResource, tcpRouteResource the Gateway API resources the external apiserver gateway is
+// made of, if a gateway class is set, instead of a service of type LoadBalancer
+var (
+	gatewayResource  = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1alpha2", Resource: "gateways"}
+	tcpRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1alpha2", Resource: "tcproutes"}
+)
+
+// ValidateControlPlaneGatewayClass return an error if the setting is not a valid name of a GatewayClass;
+// empty means the external service is a service of type LoadBalancer, without a gateway
+func ValidateControlPlaneGatewayClass(setting string) error {
+	if setting == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(setting); len(errs) > 0 {
+		return fmt.Errorf("invalid gateway class %q: %s", setting, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// externalServiceType the type of the external service: of type LoadBalancer, with the EIP as its
+// IP, unless it is exposed via a gateway, which is then the one with the EIP
+func (m *controlPlaneEndpointManager) externalServiceType() v1.ServiceType {
+	if m.gatewayClass != "" {
+		return v1.ServiceTypeClusterIP
+	}
+	return v1.ServiceTypeLoadBalancer
+}
+
+// syncExternalGateway ensure that a Gateway of the configured class listens on the EIP, on the given
+// port, with a TCPRoute from it to the external service, named and labeled like that service
+func (m *controlPlaneEndpointManager) syncExternalGateway(ctx context.Context, eip string, port int32) error {
+	if m.dynamicClient == nil {
+		return fmt.Errorf("no client for gateway %s/%s", externalServiceNamespace, externalServiceName)
+	}
+	gateway := map[string]interface{}{
+		"gatewayClassName": m.gatewayClass,
+		"addresses": []interface{}{
+			map[string]interface{}{"type": "IPAddress", "value": eip},
+		},
+		"listeners": []interface{}{
+			map[string]interface{}{"name": gatewayListenerName, "protocol": "TCP", "port": int64(port)},
+		},
+	}
+	if err := m.applyGatewayObject(ctx, gatewayResource, "Gateway", gateway); err != nil {
+		return err
+	}
+	route := map[string]interface{}{
+		"parentRefs": []interface{}{
+			map[string]interface{}{"name": externalServiceName, "sectionName": gatewayListenerName},
+		},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"backendRefs": []interface{}{
+					map[string]interface{}{"name": externalServiceName, "port": int64(port)},
+				},
+			},
+		},
+	}
+	return m.applyGatewayObject(ctx, tcpRouteResource, "TCPRoute", route)
+}
+
+// applyGatewayObject create the Gateway API object of the external service with the given spec,
+// or patch the spec of the existing one, if it is managed by the CCM and the spec differs
+func (m *controlPlaneEndpointManager) applyGatewayObject(ctx context.Context, resource schema.GroupVersionResource, kind string, spec map[string]interface{}) error {
+	client := m.dynamicClient.Resource(resource).Namespace(externalServiceNamespace)
+	existing, err := client.Get(ctx, externalServiceName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": gatewayAPIVersion,
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":      externalServiceName,
+				"namespace": externalServiceNamespace,
+				"labels":    map[string]interface{}{managedByLabel: managedByCCM},
+			},
+			"spec": spec,
+		}}
+		klog.V(2).Infof("%s %s/%s did not exist, creating", kind, externalServiceNamespace, externalServiceName)
+		if _, err := client.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create %s %s/%s: %w", kind, externalServiceNamespace, externalServiceName, err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to get %s %s/%s: %w", kind, externalServiceNamespace, externalServiceName, err)
+	}
+
+	if manager := conflictingManager(metav1.ObjectMeta{Labels: existing.GetLabels()}, false); manager != "" {
+		m.recorder.Eventf(existing, v1.EventTypeWarning, eventReasonManagerConflict, "%s %s/%s is managed by %s, not overwriting with control plane endpoint", kind, externalServiceNamespace, externalServiceName, manager)
+		return fmt.Errorf("%s %s/%s is managed by %s, not overwriting", kind, externalServiceNamespace, externalServiceName, manager)
+	}
+	// fields defaulted by the apiserver are not in the desired spec, so only compare those that are
+	if unstructuredContains(existing.Object["spec"], spec) {
+		klog.V(4).Infof("%s %s/%s unchanged, not updating", kind, externalServiceNamespace, externalServiceName)
+		return nil
+	}
+	klog.V(2).Infof("%s %s/%s already exists, just updating", kind, externalServiceNamespace, externalServiceName)
+	patch, err := json.Marshal(map[string]interface{}{"spec": spec})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", kind, err)
+	}
+	if _, err := client.Patch(ctx, externalServiceName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to update %s %s/%s: %w", kind, externalServiceNamespace, externalServiceName, err)
+	}
+	return nil
+}
+
+// unstructuredContains whether the existing unstructured value has all that the desired one has:
+// the same scalars, the same keys of maps, and lists of the same length, each recursively
+func unstructuredContains(existing, desired interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		e, ok := existing.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range d {
+			if !unstructuredContains(e[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		e, ok := existing.([]interface{})
+		if !ok || len(e) != len(d) {
+			return false
+		}
+		for i := range d {
+			if !unstructuredContains(e[i], d[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return existing == desired
+	}
+}
@@ -0,0 +1,120 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSyncExternalServiceGateway(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	m.gatewayClass = "example"
+	dynamicClient := testDynamicClient()
+	m.initCustomResources(dynamicClient)
+
+	tests := []struct {
+		eip     string
+		patches int
+	}{
+		{testEIP, 0},
+		// unchanged, not written again
+		{testEIP, 0},
+		{"147.75.100.2", 1},
+	}
+	for i, tt := range tests {
+		dynamicClient.ClearActions()
+		if err := m.syncExternalService(ctx, testKubernetesService(), tt.eip); err != nil {
+			t.Fatalf("%d: unexpected error syncing: %v", i, err)
+		}
+		svc, err := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: external service not created: %v", i, err)
+		}
+		if svc.Spec.Type != v1.ServiceTypeClusterIP || svc.Spec.LoadBalancerIP != "" || len(svc.Status.LoadBalancer.Ingress) != 0 {
+			t.Errorf("%d: mismatched external service, type %s loadBalancerIP %q ingress %v", i, svc.Spec.Type, svc.Spec.LoadBalancerIP, svc.Status.LoadBalancer.Ingress)
+		}
+		if m.externalServiceChanged(svc) {
+			t.Errorf("%d: freshly synced external service reported as changed", i)
+		}
+
+		gateway, err := dynamicClient.Resource(gatewayResource).Namespace(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: gateway not created: %v", i, err)
+		}
+		class, _, _ := unstructured.NestedString(gateway.Object, "spec", "gatewayClassName")
+		addresses, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "addresses")
+		if class != "example" || len(addresses) != 1 || addresses[0].(map[string]interface{})["value"] != tt.eip {
+			t.Errorf("%d: mismatched gateway, class %s addresses %v", i, class, addresses)
+		}
+		route, err := dynamicClient.Resource(tcpRouteResource).Namespace(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: route not created: %v", i, err)
+		}
+		rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+		if len(rules) != 1 {
+			t.Errorf("%d: mismatched route rules, actual %v", i, rules)
+		}
+
+		var patches int
+		for _, action := range dynamicClient.Actions() {
+			if action.GetVerb() == "patch" {
+				patches++
+			}
+		}
+		if patches != tt.patches {
+			t.Errorf("%d: mismatched patches, actual %d expected %d", i, patches, tt.patches)
+		}
+	}
+}
+
+func TestSyncExternalGatewayConflict(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	m.gatewayClass = "example"
+	existing := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gatewayAPIVersion,
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"name": externalServiceName, "namespace": externalServiceNamespace},
+		"spec":       map[string]interface{}{"gatewayClassName": "other"},
+	}}
+	// created rather than passed to the fake client, which would guess its resource to be gatewaies
+	dynamicClient := testDynamicClient()
+	if _, err := dynamicClient.Resource(gatewayResource).Namespace(externalServiceNamespace).Create(ctx, existing, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unable to create gateway: %v", err)
+	}
+	m.initCustomResources(dynamicClient)
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err == nil {
+		t.Fatalf("expected error overwriting gateway managed by someone else")
+	}
+	gateway, err := dynamicClient.Resource(gatewayResource).Namespace(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if class, _, _ := unstructured.NestedString(gateway.Object, "spec", "gatewayClassName"); class != "other" {
+		t.Errorf("gateway managed by someone else overwritten, class %s", class)
+	}
+}
+
+func TestUnstructuredContains(t *testing.T) {
+	tests := []struct {
+		existing interface{}
+		desired  interface{}
+		contains bool
+	}{
+		{map[string]interface{}{"a": "x", "b": int64(1)}, map[string]interface{}{"a": "x"}, true},
+		{map[string]interface{}{"a": "x"}, map[string]interface{}{"a": "y"}, false},
+		{map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": "x", "c": "defaulted"}}}, map[string]interface{}{"a": []interface{}{map[string]interface{}{"b": "x"}}}, true},
+		{[]interface{}{"x", "y"}, []interface{}{"x"}, false},
+		{nil, map[string]interface{}{"a": "x"}, false},
+	}
+	for i, tt := range tests {
+		if contains := unstructuredContains(tt.existing, tt.desired); contains != tt.contains {
+			t.Errorf("%d: mismatched contains, actual %t expected %t", i, contains, tt.contains)
+		}
+	}
+}
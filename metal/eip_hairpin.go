@@ -0,0 +1,48 @@
+package metal
+
+import (
+	v1 "k8s.io/api/core/v1"
+)
+
+// setHairpinWorkaround configure the external service so that clients in the cluster reach the
+// apiserver at the EIP without hairpinning: the EIP is an external IP of the service, so that
+// kube-proxy on every node, including the one holding the EIP, sends traffic to it straight to the
+// endpoints, like to the cluster IP, and, for a service of type LoadBalancer, with the external
+// traffic policy Cluster, so that every node serves it, not only those with an apiserver
+func (m *controlPlaneEndpointManager) setHairpinWorkaround(svc *v1.Service, eip string) {
+	if !m.hairpin {
+		return
+	}
+	svc.Spec.ExternalIPs = []string{eip}
+	if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+		svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	}
+}
+
+// hairpinPatch the fields of the spec of the external service for the hairpin workaround, to merge
+// into the patch of the spec: without the workaround, the external IPs are removed, and the external
+// traffic policy is left alone
+func hairpinPatch(spec map[string]interface{}, desired *v1.Service) {
+	if len(desired.Spec.ExternalIPs) == 0 {
+		spec["externalIPs"] = nil
+		return
+	}
+	spec["externalIPs"] = desired.Spec.ExternalIPs
+	if desired.Spec.ExternalTrafficPolicy != "" {
+		spec["externalTrafficPolicy"] = desired.Spec.ExternalTrafficPolicy
+	}
+}
+
+// hairpinUnchanged whether the existing external service has the external IPs of the desired one,
+// and its external traffic policy, if it sets one
+func hairpinUnchanged(existing, desired *v1.Service) bool {
+	if len(existing.Spec.ExternalIPs) != len(desired.Spec.ExternalIPs) {
+		return false
+	}
+	for i, ip := range desired.Spec.ExternalIPs {
+		if existing.Spec.ExternalIPs[i] != ip {
+			return false
+		}
+	}
+	return desired.Spec.ExternalTrafficPolicy == "" || existing.Spec.ExternalTrafficPolicy == desired.Spec.ExternalTrafficPolicy
+}
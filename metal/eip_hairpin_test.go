@@ -0,0 +1,64 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSyncExternalServiceHairpin(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	m.hairpin = true
+
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	svc, err := client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("external service not created: %v", err)
+	}
+	if !reflect.DeepEqual(svc.Spec.ExternalIPs, []string{testEIP}) {
+		t.Errorf("mismatched external IPs, actual %v expected %s", svc.Spec.ExternalIPs, testEIP)
+	}
+	if svc.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeCluster {
+		t.Errorf("mismatched external traffic policy, actual %q expected Cluster", svc.Spec.ExternalTrafficPolicy)
+	}
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: testEIP}}
+	if m.externalServiceChanged(svc) {
+		t.Errorf("external service reported changed right after sync")
+	}
+
+	// changed outside the CCM, it is noticed
+	changed := svc.DeepCopy()
+	changed.Spec.ExternalIPs = nil
+	if !m.externalServiceChanged(changed) {
+		t.Errorf("external service without external IPs not reported changed")
+	}
+
+	// disabled again, the external IPs are removed
+	m.hairpin = false
+	if err := m.syncExternalService(ctx, testKubernetesService(), testEIP); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	svc, err = client.CoreV1().Services(externalServiceNamespace).Get(ctx, externalServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting service: %v", err)
+	}
+	if len(svc.Spec.ExternalIPs) != 0 {
+		t.Errorf("mismatched external IPs, actual %v expected none", svc.Spec.ExternalIPs)
+	}
+}
+
+func TestSetHairpinWorkaroundGateway(t *testing.T) {
+	m := &controlPlaneEndpointManager{hairpin: true}
+	svc := &v1.Service{Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP}}
+	m.setHairpinWorkaround(svc, testEIP)
+	// a service of type ClusterIP cannot have an external traffic policy
+	if !reflect.DeepEqual(svc.Spec.ExternalIPs, []string{testEIP}) || svc.Spec.ExternalTrafficPolicy != "" {
+		t.Errorf("mismatched spec, actual %v/%q expected %s without policy", svc.Spec.ExternalIPs, svc.Spec.ExternalTrafficPolicy, testEIP)
+	}
+}
@@ -0,0 +1,95 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+// metalNodeLoopbackAddresses the addresses in the spec of a MetalNode, for its agent to
+// bind to the loopback interface
+func metalNodeLoopbackAddresses(obj map[string]interface{}) []string {
+	addresses, _, _ := unstructured.NestedStringSlice(obj, "spec", "loopbackAddresses")
+	return addresses
+}
+
+// syncLoopbackAddresses set the loopback addresses in the spec of the MetalNode of each node,
+// for the node agents to bind: the control plane elastic IP on every control plane node, so
+// that a node accepts its traffic whether the EIP was moved to it or announced by it over BGP,
+// and nothing on the other nodes. It creates the MetalNodes of control plane nodes that have
+// none yet; the agent fills in their status.
+func (m *controlPlaneEndpointManager) syncLoopbackAddresses(ctx context.Context, cpNodes []*v1.Node, address string) error {
+	if m.dynamicClient == nil {
+		return nil
+	}
+	client := m.dynamicClient.Resource(metalNodeResource)
+	list, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+			klog.V(2).Infof("%s custom resource definition not installed, not setting loopback addresses", metalNodeResource.GroupResource())
+			return nil
+		}
+		return fmt.Errorf("unable to list metal nodes: %w", err)
+	}
+	desired := map[string][]string{}
+	for _, node := range cpNodes {
+		desired[node.Name] = []string{address}
+	}
+
+	var errs []error
+	for i := range list.Items {
+		obj := &list.Items[i]
+		want := desired[obj.GetName()]
+		delete(desired, obj.GetName())
+		current := metalNodeLoopbackAddresses(obj.Object)
+		if len(current) == 0 && len(want) == 0 || reflect.DeepEqual(current, want) {
+			continue
+		}
+		if err := setMetalNodeLoopbackAddresses(obj, want); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := client.Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("unable to update metal node %s: %w", obj.GetName(), err))
+			continue
+		}
+		klog.V(2).Infof("set loopback addresses of metal node %s to %v", obj.GetName(), want)
+	}
+	// whatever is left are control plane nodes without a MetalNode yet
+	for name, want := range desired {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion(metalNodeResource.GroupVersion().String())
+		obj.SetKind(metalNodeKind)
+		obj.SetName(name)
+		obj.SetLabels(map[string]string{managedByLabel: managedByCCM})
+		if err := setMetalNodeLoopbackAddresses(obj, want); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := client.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("unable to create metal node %s: %w", name, err))
+			continue
+		}
+		klog.V(2).Infof("created metal node %s with loopback addresses %v", name, want)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func setMetalNodeLoopbackAddresses(obj *unstructured.Unstructured, addresses []string) error {
+	if len(addresses) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "spec", "loopbackAddresses")
+		return nil
+	}
+	if err := unstructured.SetNestedStringSlice(obj.Object, addresses, "spec", "loopbackAddresses"); err != nil {
+		return fmt.Errorf("unable to set loopback addresses of metal node %s: %w", obj.GetName(), err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSyncLoopbackAddresses(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	client := testDynamicClient()
+	m.initCustomResources(client)
+
+	newMetalNode := func(name string, addresses ...string) {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion(metalNodeResource.GroupVersion().String())
+		obj.SetKind(metalNodeKind)
+		obj.SetName(name)
+		if err := setMetalNodeLoopbackAddresses(obj, addresses); err != nil {
+			t.Fatalf("unable to set loopback addresses: %v", err)
+		}
+		if _, err := client.Resource(metalNodeResource).Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unable to create metal node %s: %v", name, err)
+		}
+	}
+	getAddresses := func(name string) []string {
+		obj, err := client.Resource(metalNodeResource).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get metal node %s: %v", name, err)
+		}
+		return metalNodeLoopbackAddresses(obj.Object)
+	}
+	// master-1 has a MetalNode already, master-2 not yet; worker-1 still lists
+	// the elastic ip from when it was a control plane node, worker-2 nothing
+	newMetalNode("master-1")
+	newMetalNode("worker-1", testEIP)
+	newMetalNode("worker-2")
+	cpNodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "master-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "master-2"}},
+	}
+
+	if err := m.syncLoopbackAddresses(ctx, cpNodes, testEIP); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		node      string
+		addresses []string
+	}{
+		{"master-1", []string{testEIP}},
+		{"master-2", []string{testEIP}},
+		{"worker-1", nil},
+		{"worker-2", nil},
+	}
+	for i, tt := range tests {
+		if addresses := getAddresses(tt.node); !reflect.DeepEqual(addresses, tt.addresses) {
+			t.Errorf("%d: mismatched loopback addresses of %s, actual %v expected %v", i, tt.node, addresses, tt.addresses)
+		}
+	}
+
+	// nothing is written when nothing changed
+	client.ClearActions()
+	if err := m.syncLoopbackAddresses(ctx, cpNodes, testEIP); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "list" {
+			t.Errorf("unexpected action when nothing changed: %v", action)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package metal
+
+// reportEIPAssignment report where the control plane elastic IP is assigned, replacing where it was
+// assigned before; unassigned with an empty node and device, and to a device without a node with an empty node
+func reportEIPAssignment(eip, deviceID, nodeName string) {
+	eipAssigned.Reset()
+	if deviceID == "" {
+		eipAssigned.WithLabelValues(eip, "", "").Set(0)
+		return
+	}
+	eipAssigned.WithLabelValues(eip, nodeName, deviceID).Set(1)
+}
+
+// reportEIPHealth report whether the control plane elastic IP answered its health check
+func reportEIPHealth(eip string, up bool) {
+	val := 0.0
+	if up {
+		val = 1
+	}
+	eipHealthCheckUp.WithLabelValues(eip).Set(val)
+}
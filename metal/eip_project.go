@@ -0,0 +1,45 @@
+package metal
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/packethost/packngo"
+)
+
+const eventReasonEIPProjectMismatch = "EIPProjectMismatch"
+
+// hrefID the ID at the end of an API href, such as /metal/v1/projects/<id>
+func hrefID(href string) string {
+	if href == "" {
+		return ""
+	}
+	return path.Base(href)
+}
+
+// reservationProject the project of an IP reservation, the configured one if the API did not say
+func (m *controlPlaneEndpointManager) reservationProject(ip *packngo.IPAddressReservation) string {
+	if id := hrefID(ip.Project.Href); id != "" {
+		return id
+	}
+	return m.projectID
+}
+
+// deviceProject the project of a device; empty, with no error, if it cannot be told,
+// e.g. without a device service
+func (m *controlPlaneEndpointManager) deviceProject(deviceID string) (string, error) {
+	if m.deviceSvc == nil {
+		return "", nil
+	}
+	device, _, err := m.deviceSvc.Get(deviceID, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to get device %s: %w", deviceID, wrapAPIError(err))
+	}
+	if device.Project == nil {
+		return "", nil
+	}
+	if device.Project.ID != "" {
+		return device.Project.ID, nil
+	}
+	return hrefID(device.Project.URL), nil
+}
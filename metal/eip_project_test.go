@@ -0,0 +1,68 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// testDeviceService devices in the projects known up front
+type testDeviceService struct {
+	packngo.DeviceService
+	projects map[string]string
+}
+
+func (s *testDeviceService) Get(deviceID string, getOpt *packngo.GetOptions) (*packngo.Device, *packngo.Response, error) {
+	return &packngo.Device{ID: deviceID, Project: &packngo.Project{URL: "/metal/v1/projects/" + s.projects[deviceID]}}, nil, nil
+}
+
+func TestReassignOtherProject(t *testing.T) {
+	tests := []struct {
+		projects map[string]string
+		expected string
+		events   int
+	}{
+		// the first candidate is in another project, so the EIP goes to the second
+		{map[string]string{"device-master-1": "other", "device-master-2": projectID}, "device-master-2", 1},
+		{map[string]string{"device-master-1": projectID, "device-master-2": projectID}, "device-master-1", 0},
+		// no candidate in the project of the EIP
+		{map[string]string{"device-master-1": "other", "device-master-2": "other"}, "", 2},
+	}
+	for i, tt := range tests {
+		m, _ := testControlPlaneEndpointManager(t)
+		recorder := record.NewFakeRecorder(10)
+		m.recorder = recorder
+		deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+		m.deviceIPSrv = deviceIPSrv
+		m.deviceSvc = &testDeviceService{projects: tt.projects}
+		m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.1", "master-2": "127.0.0.2"}}
+		m.nodeAPIServerPort = 6443
+		m.healthChecker = &addressHealthChecker{healthy: map[string]bool{
+			healthCheckAddress("127.0.0.1", 6443): true,
+			healthCheckAddress("127.0.0.2", 6443): true,
+		}}
+		ip := &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+			Address: testEIP,
+			Project: packngo.Href{Href: "/metal/v1/projects/" + projectID},
+		}}
+		nodes := []*v1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "master-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "master-2"}},
+		}
+
+		err := m.reassign(context.Background(), nodes, ip, "", "test")
+		if (err != nil) != (tt.expected == "") {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if device := deviceIPSrv.assigned[testEIP]; device != tt.expected {
+			t.Errorf("%d: mismatched device, actual %q expected %q", i, device, tt.expected)
+		}
+		if len(recorder.Events) != tt.events {
+			t.Errorf("%d: mismatched events, actual %d expected %d", i, len(recorder.Events), tt.events)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package metal
+
+import (
+	"context"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultEIPMaxReboots how often to reboot the device of a failed control plane node, unless configured
+	defaultEIPMaxReboots = 3
+
+	eventReasonNodeRebooted         = "ControlPlaneNodeRebooted"
+	eventReasonNodeRebootFailed     = "ControlPlaneNodeRebootFailed"
+	eventReasonNodeRebootsExhausted = "ControlPlaneNodeRebootsExhausted"
+)
+
+// nodeRemediation reboot the device of a control plane node whose apiserver failed its health
+// checks for too long, after the elastic IP moved away from it, up to a number of times
+type nodeRemediation struct {
+	// after how long a node must have failed its health checks before it is rebooted
+	after      time.Duration
+	maxReboots int
+	// unhealthySince when each failing node started to fail, or was last rebooted;
+	// reboots how often it was rebooted since it last passed; exhausted whether that was reported
+	unhealthySince map[string]time.Time
+	reboots        map[string]int
+	exhausted      map[string]bool
+}
+
+// newNodeRemediation the remediation that reboots nodes that failed for the duration, at most
+// maxReboots times, or the default if not positive; nil, i.e. none, if the duration is not positive
+func newNodeRemediation(after time.Duration, maxReboots int) *nodeRemediation {
+	if after <= 0 {
+		return nil
+	}
+	if maxReboots <= 0 {
+		maxReboots = defaultEIPMaxReboots
+	}
+	return &nodeRemediation{
+		after:          after,
+		maxReboots:     maxReboots,
+		unhealthySince: map[string]time.Time{},
+		reboots:        map[string]int{},
+		exhausted:      map[string]bool{},
+	}
+}
+
+// forget the state of a node, e.g. once it passed its health check again
+func (r *nodeRemediation) forget(name string) {
+	delete(r.unhealthySince, name)
+	delete(r.reboots, name)
+	delete(r.exhausted, name)
+}
+
+// remediateNodes reboot the devices of the control plane nodes that have failed their health checks,
+// as given by health, for longer than the remediation allows, and no longer hold the elastic IP.
+// Nodes under maintenance are left alone, as are those not health checked.
+func (m *controlPlaneEndpointManager) remediateNodes(ctx context.Context, nodes []*v1.Node, ip *packngo.IPAddressReservation, health map[string]bool) {
+	r := m.remediation
+	if r == nil {
+		return
+	}
+	now := clockNow(m.clock)
+	known := map[string]bool{}
+	holder := m.assignedNode(nodes, ip)
+	for _, node := range nodes {
+		known[node.Name] = true
+		healthy, checked := health[node.Name]
+		switch {
+		case !checked:
+			continue
+		case healthy:
+			if r.reboots[node.Name] > 0 {
+				klog.Infof("control plane node %s passes its health check again, after %d reboots", node.Name, r.reboots[node.Name])
+			}
+			r.forget(node.Name)
+			continue
+		}
+		since, ok := r.unhealthySince[node.Name]
+		if !ok {
+			r.unhealthySince[node.Name] = now
+			continue
+		}
+		switch {
+		case now.Sub(since) < r.after:
+			continue
+		case holder != nil && holder.Name == node.Name:
+			klog.V(2).Infof("control plane node %s failed its health checks since %s, but still holds elastic ip %s, not rebooting it", node.Name, since.Format(time.RFC3339), ip.Address)
+			continue
+		case nodeInMaintenance(node):
+			klog.V(2).Infof("control plane node %s failed its health checks since %s, but is under maintenance, not rebooting it", node.Name, since.Format(time.RFC3339))
+			continue
+		case r.reboots[node.Name] >= r.maxReboots:
+			if !r.exhausted[node.Name] {
+				klog.Warningf("control plane node %s still fails its health checks after %d reboots, not rebooting it again", node.Name, r.reboots[node.Name])
+				m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonNodeRebootsExhausted, "apiserver still fails health checks after %d reboots, not rebooting again", r.reboots[node.Name])
+				r.exhausted[node.Name] = true
+			}
+			continue
+		}
+		m.rebootNode(ctx, node, now.Sub(since))
+		// every attempt counts, and the node gets as long again to recover
+		r.reboots[node.Name]++
+		r.unhealthySince[node.Name] = now
+	}
+	for name := range r.unhealthySince {
+		if !known[name] {
+			r.forget(name)
+		}
+	}
+}
+
+// rebootNode reboot the device of a control plane node that failed its health checks for the duration
+func (m *controlPlaneEndpointManager) rebootNode(ctx context.Context, node *v1.Node, failedFor time.Duration) {
+	attempt := m.remediation.reboots[node.Name] + 1
+	deviceID, err := deviceIDFromProviderID(node.Spec.ProviderID)
+	if err == nil {
+		_, span := startSpan(ctx, "metal.Devices.Reboot")
+		_, err = m.deviceSvc.Reboot(deviceID)
+		endSpan(ctx, span, err)
+		if err != nil {
+			err = wrapAPIError(err)
+		}
+	}
+	if err != nil {
+		klog.Errorf("unable to reboot control plane node %s, which failed its health checks for %s: %v", node.Name, failedFor, err)
+		m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonNodeRebootFailed, "apiserver failed health checks for %s, unable to reboot device, attempt %d of %d: %v", failedFor, attempt, m.remediation.maxReboots, err)
+		return
+	}
+	klog.Warningf("rebooted device %s of control plane node %s, which failed its health checks for %s, attempt %d of %d", deviceID, node.Name, failedFor, attempt, m.remediation.maxReboots)
+	m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonNodeRebooted, "apiserver failed health checks for %s, rebooted device %s, attempt %d of %d", failedFor, deviceID, attempt, m.remediation.maxReboots)
+}
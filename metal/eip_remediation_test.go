@@ -0,0 +1,129 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/tools/record"
+)
+
+// rebootingDeviceService record the devices rebooted
+type rebootingDeviceService struct {
+	packngo.DeviceService
+	rebooted []string
+}
+
+func (s *rebootingDeviceService) Reboot(deviceID string) (*packngo.Response, error) {
+	s.rebooted = append(s.rebooted, deviceID)
+	return nil, nil
+}
+
+func TestRemediateNodes(t *testing.T) {
+	ctx := context.Background()
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	devices := &rebootingDeviceService{}
+	recorder := record.NewFakeRecorder(10)
+	m := &controlPlaneEndpointManager{
+		deviceSvc:   devices,
+		recorder:    recorder,
+		clock:       fakeClock,
+		remediation: newNodeRemediation(10*time.Minute, 2),
+	}
+	ip := &packngo.IPAddressReservation{
+		IpAddressCommon: packngo.IpAddressCommon{Address: testEIP},
+		Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+	}
+	node := func(name string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		}
+	}
+	nodes := []*v1.Node{node("master-1"), node("master-2")}
+	failing := map[string]bool{"master-1": true, "master-2": false}
+
+	tests := []struct {
+		step     time.Duration
+		health   map[string]bool
+		rebooted []string
+		events   int
+	}{
+		// failing from now on, not for long enough yet
+		{0, failing, nil, 0},
+		{5 * time.Minute, failing, nil, 0},
+		{6 * time.Minute, failing, []string{"device-master-2"}, 1},
+		// after a reboot, it gets as long again to recover
+		{5 * time.Minute, failing, []string{"device-master-2"}, 1},
+		{6 * time.Minute, failing, []string{"device-master-2", "device-master-2"}, 2},
+		// with the attempts used up, it is left alone, which is reported once
+		{11 * time.Minute, failing, []string{"device-master-2", "device-master-2"}, 3},
+		{11 * time.Minute, failing, []string{"device-master-2", "device-master-2"}, 3},
+		// healthy again, it starts over
+		{time.Minute, map[string]bool{"master-1": true, "master-2": true}, []string{"device-master-2", "device-master-2"}, 3},
+		{time.Minute, failing, []string{"device-master-2", "device-master-2"}, 3},
+		{11 * time.Minute, failing, []string{"device-master-2", "device-master-2", "device-master-2"}, 4},
+	}
+	for i, tt := range tests {
+		fakeClock.Step(tt.step)
+		m.remediateNodes(ctx, nodes, ip, tt.health)
+		if !reflect.DeepEqual(devices.rebooted, tt.rebooted) {
+			t.Errorf("%d: mismatched rebooted, actual %v expected %v", i, devices.rebooted, tt.rebooted)
+		}
+		if events := len(recorder.Events); events != tt.events {
+			t.Errorf("%d: mismatched events, actual %d expected %d", i, events, tt.events)
+		}
+	}
+}
+
+func TestRemediateNodesSkipped(t *testing.T) {
+	ctx := context.Background()
+	ip := &packngo.IPAddressReservation{
+		IpAddressCommon: packngo.IpAddressCommon{Address: testEIP},
+		Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+	}
+	holding := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "master-1"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-1"},
+	}
+	maintenance := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "master-2", Annotations: map[string]string{annotationMaintenance: "true"}},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-2"},
+	}
+	unchecked := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "master-3"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-3"},
+	}
+
+	tests := []struct {
+		remediation *nodeRemediation
+		nodes       []*v1.Node
+		health      map[string]bool
+	}{
+		// not enabled
+		{nil, []*v1.Node{maintenance}, map[string]bool{"master-2": false}},
+		// the EIP has not yet moved away from it
+		{newNodeRemediation(time.Minute, 0), []*v1.Node{holding}, map[string]bool{"master-1": false}},
+		// under maintenance
+		{newNodeRemediation(time.Minute, 0), []*v1.Node{maintenance}, map[string]bool{"master-2": false}},
+		// not health checked
+		{newNodeRemediation(time.Minute, 0), []*v1.Node{unchecked}, nil},
+	}
+	for i, tt := range tests {
+		fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+		devices := &rebootingDeviceService{}
+		m := &controlPlaneEndpointManager{deviceSvc: devices, recorder: record.NewFakeRecorder(10), clock: fakeClock, remediation: tt.remediation}
+		for _, step := range []time.Duration{0, time.Hour} {
+			fakeClock.Step(step)
+			m.remediateNodes(ctx, tt.nodes, ip, tt.health)
+		}
+		if len(devices.rebooted) != 0 {
+			t.Errorf("%d: mismatched rebooted, actual %v expected none", i, devices.rebooted)
+		}
+	}
+}
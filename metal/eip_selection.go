@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// in which order reassign tries the healthy control plane nodes for the elastic IP
+	// eipSelectionFirst the order in which the nodes are listed
+	eipSelectionFirst = "first"
+	// eipSelectionHeartbeat the node whose kubelet reported Ready most recently first
+	eipSelectionHeartbeat = "heartbeat"
+	// eipSelectionHash a stable order per elastic IP, from a hash of the IP and the node name,
+	// so that different clusters do not all pick their alphabetically first node
+	eipSelectionHash = "hash"
+)
+
+// ValidateEIPSelectionPolicy return an error if the setting is not a valid EIP selection policy
+func ValidateEIPSelectionPolicy(setting string) error {
+	switch setting {
+	case "", eipSelectionFirst, eipSelectionHeartbeat, eipSelectionHash:
+		return nil
+	default:
+		return fmt.Errorf("invalid EIP selection policy %q, must be one of %s, %s, %s", setting, eipSelectionFirst, eipSelectionHeartbeat, eipSelectionHash)
+	}
+}
+
+// orderCandidates the nodes in the order in which to try them for the elastic IP,
+// according to the policy; the given slice is not changed
+func orderCandidates(nodes []*v1.Node, policy, eip string) []*v1.Node {
+	ordered := make([]*v1.Node, len(nodes))
+	copy(ordered, nodes)
+	switch policy {
+	case eipSelectionHeartbeat:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			hi, hj := readyHeartbeat(ordered[i]), readyHeartbeat(ordered[j])
+			if !hi.Equal(hj) {
+				return hi.After(hj)
+			}
+			return ordered[i].Name < ordered[j].Name
+		})
+	case eipSelectionHash:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			hi, hj := candidateHash(eip, ordered[i].Name), candidateHash(eip, ordered[j].Name)
+			if hi != hj {
+				return hi > hj
+			}
+			return ordered[i].Name < ordered[j].Name
+		})
+	}
+	return ordered
+}
+
+// readyHeartbeat when the kubelet of a node last reported its Ready condition, zero if never
+func readyHeartbeat(node *v1.Node) time.Time {
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.LastHeartbeatTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// candidateHash the rendezvous hash of a node for an elastic IP
+func candidateHash(eip, nodeName string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(eip))
+	h.Write([]byte{0})
+	h.Write([]byte(nodeName))
+	return h.Sum64()
+}
@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateEIPSelectionPolicy(t *testing.T) {
+	for _, setting := range []string{"", eipSelectionFirst, eipSelectionHeartbeat, eipSelectionHash} {
+		if err := ValidateEIPSelectionPolicy(setting); err != nil {
+			t.Errorf("unexpected error for %q: %v", setting, err)
+		}
+	}
+	if err := ValidateEIPSelectionPolicy("random"); err == nil {
+		t.Errorf("expected error for random")
+	}
+}
+
+func TestOrderCandidates(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := func(name string, heartbeat time.Time) *v1.Node {
+		n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if !heartbeat.IsZero() {
+			n.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue, LastHeartbeatTime: metav1.NewTime(heartbeat)}}
+		}
+		return n
+	}
+	nodes := []*v1.Node{
+		node("master-1", now.Add(-time.Minute)),
+		node("master-2", now),
+		node("master-3", time.Time{}),
+		node("master-4", now),
+	}
+	names := func(nodes []*v1.Node) []string {
+		var ret []string
+		for _, n := range nodes {
+			ret = append(ret, n.Name)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{"", []string{"master-1", "master-2", "master-3", "master-4"}},
+		{eipSelectionFirst, []string{"master-1", "master-2", "master-3", "master-4"}},
+		{eipSelectionHeartbeat, []string{"master-2", "master-4", "master-1", "master-3"}},
+	}
+	for i, tt := range tests {
+		if ordered := names(orderCandidates(nodes, tt.policy, testEIP)); !reflect.DeepEqual(ordered, tt.expected) {
+			t.Errorf("%d: mismatched order for %q, actual %v expected %v", i, tt.policy, ordered, tt.expected)
+		}
+	}
+	if actual := names(nodes); !reflect.DeepEqual(actual, []string{"master-1", "master-2", "master-3", "master-4"}) {
+		t.Errorf("mismatched nodes after ordering, actual %v", actual)
+	}
+
+	// hash is stable whatever the order of the nodes, and differs between elastic IPs
+	reversed := []*v1.Node{nodes[3], nodes[2], nodes[1], nodes[0]}
+	hashed := names(orderCandidates(nodes, eipSelectionHash, testEIP))
+	if actual := names(orderCandidates(reversed, eipSelectionHash, testEIP)); !reflect.DeepEqual(actual, hashed) {
+		t.Errorf("mismatched hash order for reversed nodes, actual %v expected %v", actual, hashed)
+	}
+	firsts := map[string]bool{}
+	for _, eip := range []string{"147.75.100.1", "147.75.100.2", "147.75.100.3", "147.75.100.4", "147.75.100.5", "147.75.100.6"} {
+		firsts[orderCandidates(nodes, eipSelectionHash, eip)[0].Name] = true
+	}
+	if len(firsts) < 2 {
+		t.Errorf("mismatched hash order, every elastic IP picks the same first node %v", firsts)
+	}
+}
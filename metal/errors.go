@@ -1,19 +1,85 @@
 package metal
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+
 	"github.com/packethost/packngo"
 )
 
 // isNotFound check if an error is a 404 not found
 func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || apiStatusCode(err) == http.StatusNotFound
+}
+
+// isCapacityError check if an error is the Equinix Metal API rejecting a request
+// because it cannot be fulfilled at the location, e.g. no capacity or approval required
+func isCapacityError(err error) bool {
 	if err == nil {
 		return false
 	}
-	if perr, ok := err.(*packngo.ErrorResponse); ok {
-		if perr.Response == nil {
-			return false
-		}
-		return perr.Response.StatusCode == 404
+	code := apiStatusCode(err)
+	return code == http.StatusUnprocessableEntity || code == http.StatusServiceUnavailable
+}
+
+// apiStatusCode the HTTP status code of an Equinix Metal API error, wrapped or not; 0 if it is not one
+func apiStatusCode(err error) int {
+	var perr *packngo.ErrorResponse
+	if !errors.As(err, &perr) || perr.Response == nil {
+		return 0
+	}
+	return perr.Response.StatusCode
+}
+
+// apiError an Equinix Metal API error, classified as one of the Err* errors, so that callers can
+// branch with errors.Is on the class and still get the API error with errors.As
+type apiError struct {
+	class error
+	err   error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func (e *apiError) Is(target error) bool {
+	return target == e.class
+}
+
+// wrapAPIError classify an error from the Equinix Metal API: not found as ErrNotFound,
+// rate limited as ErrAPIRateLimited. Any other error is returned as is.
+func wrapAPIError(err error) error {
+	switch apiStatusCode(err) {
+	case http.StatusNotFound:
+		return &apiError{class: ErrNotFound, err: err}
+	case http.StatusTooManyRequests:
+		return &apiError{class: ErrAPIRateLimited, err: err}
+	default:
+		return err
 	}
-	return false
 }
+
+var (
+	// ErrNotFound the Equinix Metal API does not have the requested object
+	ErrNotFound = errors.New("not found")
+	// ErrAmbiguous more than one object matches where exactly one is expected,
+	// e.g. two devices with the same hostname
+	ErrAmbiguous = errors.New("ambiguous")
+	// ErrNoCapacity none of the facilities in which a request was tried could fulfill it,
+	// e.g. for lack of capacity or because approval is required
+	ErrNoCapacity = errors.New("no capacity")
+	// ErrIPQuotaExceeded the CCM already allocated as many Elastic IPs for services as it is configured to
+	ErrIPQuotaExceeded = errors.New("elastic ip quota exceeded")
+	// ErrAPIRateLimited the Equinix Metal API rejected the request because of too many requests; retry later
+	ErrAPIRateLimited = errors.New("equinix metal api rate limited")
+	// ErrEIPNotFound there is no elastic IP with the control plane tag
+	ErrEIPNotFound = fmt.Errorf("control plane elastic ip %w", ErrNotFound)
+	// ErrAllUnhealthy none of the control plane nodes passed the healthcheck,
+	// so there is nowhere to move the control plane elastic IP
+	ErrAllUnhealthy = errors.New("no healthy control plane node found, cluster is unhealthy")
+)
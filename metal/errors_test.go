@@ -0,0 +1,87 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+func testAPIError(code int) error {
+	return &packngo.ErrorResponse{Response: &http.Response{StatusCode: code, Request: &http.Request{Method: "GET"}}}
+}
+
+func TestWrapAPIError(t *testing.T) {
+	tests := []struct {
+		err         error
+		notFound    bool
+		rateLimited bool
+	}{
+		{nil, false, false},
+		{errors.New("connection refused"), false, false},
+		{testAPIError(http.StatusNotFound), true, false},
+		{testAPIError(http.StatusTooManyRequests), false, true},
+		{testAPIError(http.StatusInternalServerError), false, false},
+		{fmt.Errorf("wrapped: %w", testAPIError(http.StatusNotFound)), true, false},
+	}
+	for i, tt := range tests {
+		err := wrapAPIError(tt.err)
+		if (err == nil) != (tt.err == nil) {
+			t.Errorf("%d: mismatched nil, actual %v expected %v", i, err, tt.err)
+		}
+		if actual := errors.Is(err, ErrNotFound); actual != tt.notFound {
+			t.Errorf("%d: mismatched not found, actual %t expected %t", i, actual, tt.notFound)
+		}
+		if actual := errors.Is(err, ErrAPIRateLimited); actual != tt.rateLimited {
+			t.Errorf("%d: mismatched rate limited, actual %t expected %t", i, actual, tt.rateLimited)
+		}
+		if isNotFound(err) != tt.notFound {
+			t.Errorf("%d: mismatched isNotFound, actual %t expected %t", i, isNotFound(err), tt.notFound)
+		}
+		// the API error is still there
+		var perr *packngo.ErrorResponse
+		if apiStatusCode(tt.err) != 0 && !errors.As(err, &perr) {
+			t.Errorf("%d: API error lost when wrapping", i)
+		}
+	}
+}
+
+func TestErrNoCapacity(t *testing.T) {
+	err := fmt.Errorf("none of facilities %v: %w", []string{"ewr1"}, &apiError{class: ErrNoCapacity, err: testAPIError(http.StatusUnprocessableEntity)})
+	if !errors.Is(err, ErrNoCapacity) || !isCapacityError(err) {
+		t.Errorf("expected %v to be %v and a capacity error", err, ErrNoCapacity)
+	}
+	if errors.Is(testAPIError(http.StatusUnprocessableEntity), ErrNoCapacity) {
+		t.Errorf("unexpected %v for a single API error", ErrNoCapacity)
+	}
+}
+
+func TestErrEIPNotFound(t *testing.T) {
+	err := fmt.Errorf("%w with tag %s", ErrEIPNotFound, "eiptag")
+	if !errors.Is(err, ErrEIPNotFound) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v to be both %v and %v", err, ErrEIPNotFound, ErrNotFound)
+	}
+}
+
+func TestDeviceByNameAmbiguous(t *testing.T) {
+	vc, backend := testGetValidCloud(t)
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	devName := testGetNewDevName()
+	for i := 0; i < 2; i++ {
+		if _, err := backend.CreateDevice(projectID, devName, plan, facility); err != nil {
+			t.Fatalf("unable to create device: %v", err)
+		}
+	}
+
+	if _, err := deviceByName(vc.client, projectID, "nonexistent"); err != cloudprovider.InstanceNotFound {
+		t.Errorf("mismatched error for missing device, actual %v expected %v", err, cloudprovider.InstanceNotFound)
+	}
+	if _, err := deviceByName(vc.client, projectID, types.NodeName(devName)); !errors.Is(err, ErrAmbiguous) {
+		t.Errorf("mismatched error for duplicate hostname, actual %v expected %v", err, ErrAmbiguous)
+	}
+}
@@ -0,0 +1,24 @@
+package metal
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// eventComponent the source component for events recorded by the CCM
+	eventComponent = "cloud-provider-equinix-metal"
+)
+
+// newEventRecorder create a recorder for kubernetes events, which are sent
+// to the apiserver and logged
+func newEventRecorder(k8sclient kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&typedv1.EventSinkImpl{Interface: k8sclient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
@@ -0,0 +1,78 @@
+package metal
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	eventReasonEIPFailoverThrottled = "EIPFailoverThrottled"
+	eventReasonEIPFailoverDeferred  = "EIPFailoverDeferred"
+)
+
+// failoverHistory when the control plane elastic IP was moved recently, to keep it from
+// moving back and forth when two control plane nodes are both marginally unhealthy
+type failoverHistory struct {
+	// cooldown minimum time between two moves, 0 for none
+	cooldown time.Duration
+	// maxPerHour maximum number of moves in any hour, 0 for unlimited
+	maxPerHour int
+	// moves when the elastic IP was moved within the last hour, oldest first
+	moves []time.Time
+	// last when and why the elastic IP was last moved, kept beyond the hour
+	last       time.Time
+	lastReason string
+}
+
+// record that the elastic IP was moved at the given time, and why
+func (h *failoverHistory) record(now time.Time, reason string) {
+	h.prune(now)
+	h.moves = append(h.moves, now)
+	h.last = now
+	h.lastReason = reason
+}
+
+// allowed return an error describing why the elastic IP may not be moved at the given time, if it may not
+func (h *failoverHistory) allowed(now time.Time) error {
+	h.prune(now)
+	if len(h.moves) == 0 {
+		return nil
+	}
+	last := h.moves[len(h.moves)-1]
+	if h.cooldown > 0 && now.Sub(last) < h.cooldown {
+		return fmt.Errorf("last moved at %s, within cooldown of %s", last.Format(time.RFC3339), h.cooldown)
+	}
+	if h.maxPerHour > 0 && len(h.moves) >= h.maxPerHour {
+		return fmt.Errorf("moved %d times in the last hour, the maximum", len(h.moves))
+	}
+	return nil
+}
+
+// prune forget moves more than an hour before the given time
+func (h *failoverHistory) prune(now time.Time) {
+	i := 0
+	for i < len(h.moves) && now.Sub(h.moves[i]) >= time.Hour {
+		i++
+	}
+	h.moves = h.moves[i:]
+}
+
+// nodeRecentlyRestarted whether the Ready condition of the node changed within the grace period
+// before the given time, i.e. it went NotReady, or came back Ready after its kubelet or the
+// node restarted, as during a routine control plane upgrade; and if so, when it changed.
+// An apiserver on such a node is degraded rather than failed, and may well recover on its own.
+func nodeRecentlyRestarted(node *v1.Node, grace time.Duration, now time.Time) (time.Time, bool) {
+	if grace <= 0 {
+		return time.Time{}, false
+	}
+	for _, c := range node.Status.Conditions {
+		if c.Type != v1.NodeReady || c.LastTransitionTime.IsZero() {
+			continue
+		}
+		changed := c.LastTransitionTime.Time
+		return changed, now.Sub(changed) < grace
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,291 @@
+package metal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestFailoverHistory(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		cooldown   time.Duration
+		maxPerHour int
+		moves      []time.Duration
+		at         time.Duration
+		allowed    bool
+	}{
+		{0, 0, nil, 0, true},
+		{0, 0, []time.Duration{0, time.Second, 2 * time.Second}, 3 * time.Second, true},
+		{5 * time.Minute, 0, []time.Duration{0}, 4 * time.Minute, false},
+		{5 * time.Minute, 0, []time.Duration{0}, 5 * time.Minute, true},
+		{0, 2, []time.Duration{0, 10 * time.Minute}, 20 * time.Minute, false},
+		// the first move is more than an hour ago
+		{0, 2, []time.Duration{0, 10 * time.Minute}, 61 * time.Minute, true},
+	}
+	for i, tt := range tests {
+		h := failoverHistory{cooldown: tt.cooldown, maxPerHour: tt.maxPerHour}
+		for _, move := range tt.moves {
+			h.record(start.Add(move), "test")
+		}
+		if err := h.allowed(start.Add(tt.at)); (err == nil) != tt.allowed {
+			t.Errorf("%d: mismatched allowed, actual error %v expected allowed %t", i, err, tt.allowed)
+		}
+	}
+}
+
+func TestReconcileNodesFailoverCooldown(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	m, _ := testControlPlaneEndpointManager(t)
+	deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+	m.deviceIPSrv = deviceIPSrv
+	m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.2", "master-2": "127.0.0.1"}}
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+		},
+	}}
+	m.apiServerPort = 6443
+	m.nodeAPIServerPort = int32(server.Listener.Addr().(*net.TCPAddr).Port)
+	// only master-2 is healthy, the EIP is not
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{healthCheckAddress("127.0.0.1", m.nodeAPIServerPort): true}}
+	m.failovers = failoverHistory{cooldown: time.Hour}
+	m.failovers.record(time.Now(), "test")
+	nodes := []*v1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}, Annotations: map[string]string{}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-2", Labels: map[string]string{controlPlaneLabel: ""}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-2"},
+		},
+	}
+
+	// within the cooldown, the EIP stays
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deviceIPSrv.assigned) != 0 {
+		t.Errorf("elastic IP moved within cooldown: %v", deviceIPSrv.assigned)
+	}
+
+	// unless explicitly allowed
+	nodes[0].Annotations[annotationAllowEIPFailover] = "true"
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device := deviceIPSrv.assigned[testEIP]; device != "device-master-2" {
+		t.Errorf("mismatched device, actual %q expected device-master-2", device)
+	}
+	if len(m.failovers.moves) != 2 {
+		t.Errorf("mismatched failover history, actual %d moves expected 2", len(m.failovers.moves))
+	}
+}
+
+func TestReconcileNodesFailoverCooldownUnassigned(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tests := []struct {
+		kubeProxyIPVS bool
+		assignedTo    string
+		moved         bool
+	}{
+		// an EIP assigned to no device is assigned, whatever the cooldown
+		{false, "", true},
+		{true, "", true},
+		// one assigned to a device that is not a control plane node is not moved within it
+		{false, "/devices/device-worker-1", false},
+		{true, "/devices/device-worker-1", false},
+	}
+	for i, tt := range tests {
+		m, _ := testControlPlaneEndpointManager(t)
+		deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+		m.deviceIPSrv = deviceIPSrv
+		m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.2", "master-2": "127.0.0.1"}}
+		ip := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}}}
+		if tt.assignedTo != "" {
+			ip.Assignments = []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: tt.assignedTo}}}
+		}
+		m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{ip}}
+		m.apiServerPort = 6443
+		m.nodeAPIServerPort = int32(server.Listener.Addr().(*net.TCPAddr).Port)
+		m.kubeProxyIPVS = tt.kubeProxyIPVS
+		// only master-2 is healthy, the EIP is not
+		m.healthChecker = &addressHealthChecker{healthy: map[string]bool{healthCheckAddress("127.0.0.1", m.nodeAPIServerPort): true}}
+		m.failovers = failoverHistory{cooldown: time.Hour}
+		m.failovers.record(time.Now(), "test")
+		nodes := []*v1.Node{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}},
+				Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-1"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "master-2", Labels: map[string]string{controlPlaneLabel: ""}},
+				Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-2"},
+			},
+		}
+		if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if moved := deviceIPSrv.assigned[testEIP] == "device-master-2"; moved != tt.moved {
+			t.Errorf("%d: mismatched moved, actual %t expected %t: %v", i, moved, tt.moved, deviceIPSrv.assigned)
+		}
+	}
+}
+
+func TestNodeRecentlyRestarted(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 10, 0, 0, time.UTC)
+	readyAt := func(changed time.Time) *v1.Node {
+		return &v1.Node{Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+			{Type: v1.NodeMemoryPressure, Status: v1.ConditionFalse, LastTransitionTime: metav1.NewTime(now)},
+			{Type: v1.NodeReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.NewTime(changed)},
+		}}}
+	}
+	tests := []struct {
+		node      *v1.Node
+		grace     time.Duration
+		restarted bool
+	}{
+		{readyAt(now.Add(-time.Minute)), 0, false},
+		{readyAt(now.Add(-time.Minute)), 5 * time.Minute, true},
+		{readyAt(now.Add(-5 * time.Minute)), 5 * time.Minute, false},
+		{&v1.Node{}, 5 * time.Minute, false},
+	}
+	for i, tt := range tests {
+		if _, restarted := nodeRecentlyRestarted(tt.node, tt.grace, now); restarted != tt.restarted {
+			t.Errorf("%d: mismatched restarted, actual %t expected %t", i, restarted, tt.restarted)
+		}
+	}
+}
+
+func TestReconcileNodesFailoverGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	m, _ := testControlPlaneEndpointManager(t)
+	deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+	m.deviceIPSrv = deviceIPSrv
+	m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.2", "master-2": "127.0.0.1"}}
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+		},
+	}}
+	m.apiServerPort = 6443
+	m.nodeAPIServerPort = int32(server.Listener.Addr().(*net.TCPAddr).Port)
+	// only master-2 is healthy, the EIP is not
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{healthCheckAddress("127.0.0.1", m.nodeAPIServerPort): true}}
+	m.failoverGrace = 5 * time.Minute
+	nodes := []*v1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-1"},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Minute))},
+			}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-2", Labels: map[string]string{controlPlaneLabel: ""}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-2"},
+		},
+	}
+
+	// the node holding the EIP just restarted, so the EIP stays
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deviceIPSrv.assigned) != 0 {
+		t.Errorf("elastic IP moved within grace period: %v", deviceIPSrv.assigned)
+	}
+
+	// once the grace period has passed, it moves
+	nodes[0].Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device := deviceIPSrv.assigned[testEIP]; device != "device-master-2" {
+		t.Errorf("mismatched device, actual %q expected device-master-2", device)
+	}
+}
+
+func TestReconcileNodesFailoverClock(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	m, _ := testControlPlaneEndpointManager(t)
+	fakeClock := clock.NewFakeClock(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	m.clock = fakeClock
+	deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+	m.deviceIPSrv = deviceIPSrv
+	m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.2", "master-2": "127.0.0.1"}}
+	ipResSvr := &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+		},
+	}}
+	m.ipResSvr = ipResSvr
+	m.apiServerPort = 6443
+	m.nodeAPIServerPort = int32(server.Listener.Addr().(*net.TCPAddr).Port)
+	// only master-2 is healthy, the EIP is not
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{healthCheckAddress("127.0.0.1", m.nodeAPIServerPort): true}}
+	m.failovers = failoverHistory{cooldown: time.Hour}
+	m.failovers.record(fakeClock.Now(), "test")
+	nodes := []*v1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-1"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-2", Labels: map[string]string{controlPlaneLabel: ""}},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-master-2"},
+		},
+	}
+
+	// within the cooldown, the EIP stays, and the IP reservations are reused
+	for _, step := range []time.Duration{0, ipReservationsTTL / 2} {
+		fakeClock.Step(step)
+		if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(deviceIPSrv.assigned) != 0 {
+		t.Errorf("elastic IP moved within cooldown: %v", deviceIPSrv.assigned)
+	}
+	if ipResSvr.lists != 1 {
+		t.Errorf("mismatched lists, actual %d expected 1", ipResSvr.lists)
+	}
+
+	// once the cooldown has passed, it moves, after listing the stale IP reservations again
+	fakeClock.Step(time.Hour)
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device := deviceIPSrv.assigned[testEIP]; device != "device-master-2" {
+		t.Errorf("mismatched device, actual %q expected device-master-2", device)
+	}
+	if ipResSvr.lists != 2 {
+		t.Errorf("mismatched lists, actual %d expected 2", ipResSvr.lists)
+	}
+	if last := m.failovers.last; !last.Equal(fakeClock.Now()) {
+		t.Errorf("mismatched last failover, actual %v expected %v", last, fakeClock.Now())
+	}
+}
@@ -0,0 +1,193 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/packethost/packngo"
+	"k8s.io/klog/v2"
+)
+
+const (
+	faultAPIError          = "api-error"
+	faultAPIDelay          = "api-delay"
+	faultHealthCheckError  = "healthcheck-error"
+	faultHealthCheckDelay  = "healthcheck-delay"
+	faultMaxDelay          = "max-delay"
+	defaultFaultMaxDelay   = 5 * time.Second
+	faultTargetAPI         = "api"
+	faultTargetHealthCheck = "healthcheck"
+	faultKindError         = "error"
+	faultKindDelay         = "delay"
+)
+
+// faultInjector randomly fails or delays Equinix Metal API calls and control plane health
+// checks, for soak testing of failover in staging clusters. Never enable it in production.
+type faultInjector struct {
+	// the probability, from 0 to 1, of each fault
+	apiError, apiDelay, healthCheckError, healthCheckDelay float64
+	// maxDelay the longest delay; each is random, up to it
+	maxDelay time.Duration
+
+	// lock protects random, which is not safe for concurrent use
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+// ValidateFaultInjection whether the fault injection setting is valid
+func ValidateFaultInjection(setting string) error {
+	_, err := parseFaultInjection(setting)
+	return err
+}
+
+// parseFaultInjection parse the fault injection setting, a comma-separated list of
+// fault=probability, plus optionally max-delay=duration, e.g.
+// "api-error=0.1,healthcheck-delay=0.2,max-delay=10s". Returns nil if the setting is empty.
+func parseFaultInjection(setting string) (*faultInjector, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	f := &faultInjector{maxDelay: defaultFaultMaxDelay, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, part := range strings.Split(setting, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid fault injection %q: must be of the form fault=value", part)
+		}
+		key, value := kv[0], kv[1]
+		if key == faultMaxDelay {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid fault injection %s %q: must be a positive duration", key, value)
+			}
+			f.maxDelay = d
+			continue
+		}
+		var probability *float64
+		switch key {
+		case faultAPIError:
+			probability = &f.apiError
+		case faultAPIDelay:
+			probability = &f.apiDelay
+		case faultHealthCheckError:
+			probability = &f.healthCheckError
+		case faultHealthCheckDelay:
+			probability = &f.healthCheckDelay
+		default:
+			return nil, fmt.Errorf("invalid fault injection %q: unknown fault, must be one of %s, %s, %s, %s or %s", key, faultAPIError, faultAPIDelay, faultHealthCheckError, faultHealthCheckDelay, faultMaxDelay)
+		}
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid fault injection %s %q: must be a probability from 0 to 1", key, value)
+		}
+		*probability = p
+	}
+	return f, nil
+}
+
+// roll whether a fault of the probability happens this time
+func (f *faultInjector) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.random.Float64() < probability
+}
+
+// delay wait for a random time up to the longest delay, or until the context is done
+func (f *faultInjector) delay(ctx context.Context, target string) {
+	f.lock.Lock()
+	d := time.Duration(f.random.Int63n(int64(f.maxDelay)))
+	f.lock.Unlock()
+	klog.V(2).Infof("fault injection: delaying %s by %s", target, d)
+	faultInjected.WithLabelValues(target, faultKindDelay).Inc()
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// newPacketClient the Equinix Metal API client, with the same retries as packngo uses by default,
+// whose calls fail or are delayed as configured, if at all. With credentials that read the auth
+// token from a source, each call is made with their current token.
+func (f *faultInjector) newPacketClient(authToken string, credentials *credentialManager) *packngo.Client {
+	faulty := f != nil && (f.apiError != 0 || f.apiDelay != 0)
+	rotated := credentials != nil && credentials.provider != nil
+	if !faulty && !rotated {
+		return packngo.NewClientWithAuth("", authToken, nil)
+	}
+	httpClient := retryablehttp.NewClient()
+	httpClient.RetryWaitMin = time.Second
+	httpClient.RetryWaitMax = 30 * time.Second
+	httpClient.RetryMax = 10
+	httpClient.CheckRetry = packngo.RetryPolicy
+	if faulty {
+		httpClient.HTTPClient.Transport = &faultRoundTripper{faults: f, next: httpClient.HTTPClient.Transport}
+	}
+	if rotated {
+		httpClient.HTTPClient.Transport = &credentialRoundTripper{credentials: credentials, next: httpClient.HTTPClient.Transport}
+	}
+	return packngo.NewClientWithAuth("", authToken, httpClient)
+}
+
+// faultRoundTripper fail or delay requests. A failure is a 503 answer, as from an API outage,
+// rather than a transport error, which would be retried.
+type faultRoundTripper struct {
+	faults *faultInjector
+	next   http.RoundTripper
+}
+
+func (t *faultRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.faults.roll(t.faults.apiDelay) {
+		t.faults.delay(req.Context(), faultTargetAPI)
+	}
+	if !t.faults.roll(t.faults.apiError) {
+		return t.next.RoundTrip(req)
+	}
+	klog.V(2).Infof("fault injection: failing %s %s", req.Method, req.URL.Path)
+	faultInjected.WithLabelValues(faultTargetAPI, faultKindError).Inc()
+	body := `{"errors":["fault injection: service unavailable"]}`
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// healthChecker wrap the health checker so that its checks fail or are delayed as configured, if at all
+func (f *faultInjector) healthChecker(next healthChecker) healthChecker {
+	if f == nil || (f.healthCheckError == 0 && f.healthCheckDelay == 0) {
+		return next
+	}
+	return &faultHealthChecker{faults: f, next: next}
+}
+
+type faultHealthChecker struct {
+	faults *faultInjector
+	next   healthChecker
+}
+
+func (h *faultHealthChecker) check(ctx context.Context, address string) error {
+	if h.faults.roll(h.faults.healthCheckDelay) {
+		h.faults.delay(ctx, faultTargetHealthCheck)
+	}
+	if h.faults.roll(h.faults.healthCheckError) {
+		faultInjected.WithLabelValues(faultTargetHealthCheck, faultKindError).Inc()
+		return fmt.Errorf("fault injection: health check of %s failed", address)
+	}
+	return h.next.check(ctx, address)
+}
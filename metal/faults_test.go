@@ -0,0 +1,103 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseFaultInjection(t *testing.T) {
+	tests := []struct {
+		setting string
+		faults  *faultInjector
+		err     bool
+	}{
+		{"", nil, false},
+		{"api-error=0.1", &faultInjector{apiError: 0.1, maxDelay: defaultFaultMaxDelay}, false},
+		{"api-error=0.1, api-delay=1,healthcheck-error=0,healthcheck-delay=0.5,max-delay=10s", &faultInjector{apiError: 0.1, apiDelay: 1, healthCheckDelay: 0.5, maxDelay: 10 * time.Second}, false},
+		{"api-error", nil, true},
+		{"api-error=1.5", nil, true},
+		{"api-error=-0.1", nil, true},
+		{"api-error=often", nil, true},
+		{"max-delay=0s", nil, true},
+		{"disk-error=0.1", nil, true},
+	}
+
+	for i, tt := range tests {
+		faults, err := parseFaultInjection(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		case tt.faults == nil && faults != nil:
+			t.Errorf("%d: mismatched faults, actual %#v expected nil", i, faults)
+		case tt.faults != nil && (faults == nil || faults.apiError != tt.faults.apiError || faults.apiDelay != tt.faults.apiDelay ||
+			faults.healthCheckError != tt.faults.healthCheckError || faults.healthCheckDelay != tt.faults.healthCheckDelay || faults.maxDelay != tt.faults.maxDelay):
+			t.Errorf("%d: mismatched faults, actual %#v expected %#v", i, faults, tt.faults)
+		}
+	}
+}
+
+func TestFaultRoundTripper(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		setting string
+		status  int
+		calls   int
+	}{
+		{"api-error=1", http.StatusServiceUnavailable, 0},
+		{"api-error=0,api-delay=1,max-delay=1ms", http.StatusOK, 1},
+	}
+
+	for i, tt := range tests {
+		faults, err := parseFaultInjection(tt.setting)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		calls = 0
+		client := &http.Client{Transport: &faultRoundTripper{faults: faults, next: http.DefaultTransport}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || calls != tt.calls {
+			t.Errorf("%d: mismatched status %d and calls %d, expected %d and %d", i, resp.StatusCode, calls, tt.status, tt.calls)
+		}
+	}
+}
+
+func TestFaultHealthChecker(t *testing.T) {
+	healthy := &addressHealthChecker{healthy: map[string]bool{"10.0.0.1:6443": true}}
+
+	// without faults to inject, the health checker is not wrapped
+	var faults *faultInjector
+	if checker := faults.healthChecker(healthy); checker != healthChecker(healthy) {
+		t.Errorf("health checker wrapped without fault injection")
+	}
+
+	faults, _ = parseFaultInjection("healthcheck-error=1")
+	if err := faults.healthChecker(healthy).check(context.Background(), "10.0.0.1:6443"); err == nil {
+		t.Errorf("injected health check error not returned")
+	}
+
+	// a delay ends with the context
+	faults, _ = parseFaultInjection("healthcheck-delay=1,max-delay=1h")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := faults.healthChecker(healthy).check(ctx, "10.0.0.1:6443"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > time.Minute {
+		t.Errorf("delay did not end with the context, took %s", d)
+	}
+}
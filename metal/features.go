@@ -0,0 +1,44 @@
+package metal
+
+import (
+	"fmt"
+
+	"k8s.io/component-base/featuregate"
+)
+
+const (
+	// FeatureNodePools create and delete devices from NodePool resources, see nodePoolManager
+	FeatureNodePools featuregate.Feature = "NodePools"
+)
+
+// defaultFeatureGates the experimental behaviors of the CCM, and whether they are on by default
+var defaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	FeatureNodePools: {Default: false, PreRelease: featuregate.Alpha},
+}
+
+// ParseFeatureGates the feature gates from the setting, which is a comma-separated list
+// of Feature=true|false, like the upstream --feature-gates flag; features not in it get their default
+func ParseFeatureGates(setting string) (featuregate.FeatureGate, error) {
+	gates := featuregate.NewFeatureGate()
+	if err := gates.Add(defaultFeatureGates); err != nil {
+		return nil, err
+	}
+	if setting == "" {
+		return gates, nil
+	}
+	if err := gates.Set(setting); err != nil {
+		return nil, fmt.Errorf("invalid feature gates %q: %w", setting, err)
+	}
+	return gates, nil
+}
+
+// reportFeatureGates export the state of each feature gate as a metric
+func reportFeatureGates(gates featuregate.FeatureGate) {
+	for feature, spec := range defaultFeatureGates {
+		enabled := 0.0
+		if gates.Enabled(feature) {
+			enabled = 1
+		}
+		featureEnabled.WithLabelValues(string(feature), string(spec.PreRelease)).Set(enabled)
+	}
+}
@@ -0,0 +1,32 @@
+package metal
+
+import (
+	"testing"
+)
+
+func TestParseFeatureGates(t *testing.T) {
+	tests := []struct {
+		setting   string
+		nodePools bool
+		err       bool
+	}{
+		{"", false, false},
+		{"NodePools=true", true, false},
+		{"NodePools=false", false, false},
+		{"NodePools=maybe", false, true},
+		{"Unknown=true", false, true},
+		{"NodePools=true,Unknown=true", false, true},
+	}
+	for i, tt := range tests {
+		gates, err := ParseFeatureGates(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		case tt.err:
+		case gates.Enabled(FeatureNodePools) != tt.nodePools:
+			t.Errorf("%d: mismatched %s for %q, actual %t expected %t", i, FeatureNodePools, tt.setting, gates.Enabled(FeatureNodePools), tt.nodePools)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package metal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/kv"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// supported control plane health check strategies, set as the scheme of the setting
+	healthCheckTypeHTTPS = "https"
+	healthCheckTypeHTTP  = "http"
+	healthCheckTypeTCP   = "tcp"
+	healthCheckTypeGRPC  = "grpc"
+
+	defaultHealthCheckPath = "/healthz"
+	healthCheckTimeout     = 5 * time.Second
+
+	// what a timed health check went to, see observedHealthCheck
+	healthCheckTargetEIP  = "elastic-ip"
+	healthCheckTargetNode = "node"
+)
+
+// healthChecker a strategy to check whether the apiserver on a control plane node,
+// or behind the elastic IP, is healthy
+type healthChecker interface {
+	// check return an error if the apiserver at the address, of the form host:port, is not healthy
+	check(ctx context.Context, address string) error
+}
+
+// Prober sends the requests of the http and https control plane health checks, e.g. an *http.Client
+// whose transport presents a client certificate or a SPIFFE identity, for apiservers that require one
+type Prober interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// newHealthChecker the health check strategy for the setting, which is of the form
+// <type>://<detail>, with an empty setting the same as https:///healthz:
+//
+//	https:///<path> or http:///<path>: GET the path, which must return 200; https does not verify the certificate,
+//	  unless the prober, if not nil, which sends the requests instead of the default client, does
+//	tcp://: open a TCP connection, for apiservers that reject unauthenticated requests, e.g. enforce mTLS
+//	grpc:///<service>: the gRPC health checking protocol over TLS, which must return SERVING for the service
+func newHealthChecker(setting string, prober Prober) (healthChecker, error) {
+	if setting == "" {
+		setting = healthCheckTypeHTTPS + "://" + defaultHealthCheckPath
+	}
+	// allow just the type, e.g. tcp
+	if !strings.Contains(setting, "://") {
+		setting += "://"
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control plane health check setting %q: %w", setting, err)
+	}
+	switch u.Scheme {
+	case healthCheckTypeHTTPS, healthCheckTypeHTTP:
+		path := u.Path
+		if path == "" {
+			path = defaultHealthCheckPath
+		}
+		if prober == nil {
+			prober = &http.Client{
+				Timeout: healthCheckTimeout,
+				Transport: newTracingRoundTripper("healthcheck", &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				})}
+		}
+		return &httpHealthChecker{
+			scheme: u.Scheme,
+			path:   path,
+			client: prober,
+		}, nil
+	case healthCheckTypeTCP:
+		return &tcpHealthChecker{}, nil
+	case healthCheckTypeGRPC:
+		return &grpcHealthChecker{service: strings.TrimPrefix(u.Path, "/")}, nil
+	default:
+		return nil, fmt.Errorf("invalid control plane health check setting %q: unsupported type %q, must be one of %s, %s, %s, %s", setting, u.Scheme, healthCheckTypeHTTPS, healthCheckTypeHTTP, healthCheckTypeTCP, healthCheckTypeGRPC)
+	}
+}
+
+// healthCheckAddress the host:port address of the apiserver to health check
+func healthCheckAddress(host string, port int32) string {
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// httpHealthChecker GET a path, which must return 200 OK
+type httpHealthChecker struct {
+	scheme string
+	path   string
+	client Prober
+}
+
+func (h *httpHealthChecker) check(ctx context.Context, address string) error {
+	healthCheckURL := fmt.Sprintf("%s://%s%s", h.scheme, address, h.path)
+	req, err := http.NewRequestWithContext(ctx, "GET", healthCheckURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http client error: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned http code %d", healthCheckURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// tcpHealthChecker open a TCP connection
+type tcpHealthChecker struct{}
+
+func (h *tcpHealthChecker) check(ctx context.Context, address string) (err error) {
+	ctx, span := startSpan(ctx, "healthcheck tcp", kv.String("address", address))
+	defer func() { endSpan(ctx, span, err) }()
+	dialer := net.Dialer{Timeout: healthCheckTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcHealthChecker call the gRPC health checking protocol, which must return SERVING
+type grpcHealthChecker struct {
+	service string
+}
+
+func (h *grpcHealthChecker) check(ctx context.Context, address string) (err error) {
+	ctx, span := startSpan(ctx, "healthcheck grpc", kv.String("address", address), kv.String("service", h.service))
+	defer func() { endSpan(ctx, span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithBlock(),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		return fmt.Errorf("unable to connect: %w", err)
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: h.service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service %q is %s", h.service, resp.Status)
+	}
+	return nil
+}
+
+// healthCheck whether the apiserver at the address, of the form host:port, is healthy
+func (m *controlPlaneEndpointManager) healthCheck(ctx context.Context, address string) bool {
+	if err := m.healthChecker.check(ctx, address); err != nil {
+		klog.Infof("healthcheck of %s failed: %v", address, err)
+		return false
+	}
+	return true
+}
+
+// observedHealthCheck healthCheck, also recording how long it took, labelled with what it went to:
+// the elastic IP, or the apiserver on a node, with the name of the node
+func (m *controlPlaneEndpointManager) observedHealthCheck(ctx context.Context, address, target, nodeName string) bool {
+	start := time.Now()
+	healthy := m.healthCheck(ctx, address)
+	result := "success"
+	if !healthy {
+		result = "failure"
+	}
+	controlPlaneHealthCheckDuration.WithLabelValues(target, nodeName, result).Observe(time.Since(start).Seconds())
+	return healthy
+}
+
+// observeNodeHealthChecks health check the apiserver on each control plane node directly, to
+// record how long it takes, for comparison with the elastic IP. Returns whether each node that
+// was checked is healthy, by name.
+func (m *controlPlaneEndpointManager) observeNodeHealthChecks(ctx context.Context, nodes []*v1.Node) map[string]bool {
+	if m.nodeAPIServerPort == 0 {
+		return nil
+	}
+	var (
+		checked []*v1.Node
+		addrs   []string
+	)
+	for _, node := range nodes {
+		if addr := nodeProbeAddress(node, m.nodeAddressType); addr != "" {
+			checked = append(checked, node)
+			addrs = append(addrs, healthCheckAddress(addr, m.nodeAPIServerPort))
+		}
+	}
+	results := m.healthCheckEach(ctx, len(addrs), func(ctx context.Context, i int) bool {
+		return m.observedHealthCheck(ctx, addrs[i], healthCheckTargetNode, checked[i].Name)
+	})
+	health := map[string]bool{}
+	for i, node := range checked {
+		health[node.Name] = results[i]
+	}
+	return health
+}
+
+// healthCheckEach run check for each of n health checks, up to the health check concurrency at a
+// time, so that one that hangs holds up the others no longer than its own timeout. Returns the
+// result of each, in order.
+func (m *controlPlaneEndpointManager) healthCheckEach(ctx context.Context, n int, check func(ctx context.Context, i int) bool) []bool {
+	concurrency := m.healthCheckConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]bool, n)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = check(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// reconcileContext the context of a reconcile of the nodes, which ends after the reconcile timeout, if set
+func (m *controlPlaneEndpointManager) reconcileContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.reconcileTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, m.reconcileTimeout)
+}
+
+// reconcileCutShort an error if the reconcile of the nodes ran out of time, or was cancelled. Health
+// checks that failed then may only have been cut short, so nothing must be moved, rebooted or removed
+// because of them.
+func (m *controlPlaneEndpointManager) reconcileCutShort(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("control plane reconcile cut short, with a timeout of %s, not acting on its health checks: %w", m.reconcileTimeout, err)
+	}
+	return nil
+}
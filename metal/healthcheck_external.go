@@ -0,0 +1,95 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"k8s.io/klog/v2"
+)
+
+// externalHealthCheckTarget the query parameter with which the external checker is told what to check
+const externalHealthCheckTarget = "target"
+
+// externalHealthChecker ask a checker outside the cluster whether it reaches an address.
+// The path from the CCM to the EIP may be healthy while the one from outside is broken,
+// e.g. when the BGP route to it was withdrawn.
+type externalHealthChecker struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// ValidateControlPlaneExternalHealthCheck whether the external health check setting is valid
+func ValidateControlPlaneExternalHealthCheck(setting string) error {
+	_, err := newExternalHealthChecker(setting)
+	return err
+}
+
+// newExternalHealthChecker the external checker at the URL of the setting, nil if it is empty
+func newExternalHealthChecker(setting string) (*externalHealthChecker, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control plane external health check %q: %w", setting, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid control plane external health check %q: must be an http or https URL", setting)
+	}
+	return &externalHealthChecker{
+		url: u,
+		client: &http.Client{
+			// the checker checks the target in turn, so give it the time to time out first
+			Timeout:   2 * healthCheckTimeout,
+			Transport: newTracingRoundTripper("healthcheck external", http.DefaultTransport),
+		},
+	}, nil
+}
+
+// check whether the checker reaches the address, of the form host:port, as
+// GET <url>?target=<address>, which returns 200 if it does. Returns an error if the
+// checker itself cannot be reached, or does not answer 200 or 503, in which case
+// whether it reaches the address is not known.
+func (e *externalHealthChecker) check(ctx context.Context, address string) (bool, error) {
+	u := *e.url
+	q := u.Query()
+	q.Set(externalHealthCheckTarget, address)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("http client error: %w", err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusServiceUnavailable:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s returned http code %d", e.url, resp.StatusCode)
+	}
+}
+
+// externalHealthCheck whether the external checker, if any, reaches the apiserver at the
+// address. If the checker cannot tell, the in-cluster health check alone decides, so that an
+// outage of the checker does not move the EIP.
+func (m *controlPlaneEndpointManager) externalHealthCheck(ctx context.Context, address string) bool {
+	if m.externalHealthChecker == nil {
+		return true
+	}
+	reachable, err := m.externalHealthChecker.check(ctx, address)
+	if err != nil {
+		klog.Warningf("external healthcheck of %s inconclusive, relying on the in-cluster one: %v", address, err)
+		return true
+	}
+	if !reachable {
+		klog.Infof("external healthcheck of %s failed: not reachable from outside the cluster", address)
+	}
+	return reachable
+}
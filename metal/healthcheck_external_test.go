@@ -0,0 +1,81 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateControlPlaneExternalHealthCheck(t *testing.T) {
+	tests := []struct {
+		setting string
+		err     bool
+	}{
+		{"", false},
+		{"https://checker.example.com/check", false},
+		{"http://10.0.0.1:8080", false},
+		{"tcp://checker.example.com", true},
+		{"checker.example.com", true},
+		{"https://", true},
+	}
+
+	for i, tt := range tests {
+		err := ValidateControlPlaneExternalHealthCheck(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		}
+	}
+}
+
+func TestExternalHealthCheck(t *testing.T) {
+	var target string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.URL.Query().Get(externalHealthCheckTarget)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		status  int
+		healthy bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusServiceUnavailable, false},
+		// the checker cannot tell, so the in-cluster health check decides
+		{http.StatusInternalServerError, true},
+		{http.StatusNotFound, true},
+	}
+
+	for i, tt := range tests {
+		checker, err := newExternalHealthChecker(server.URL + "/check")
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		m := &controlPlaneEndpointManager{externalHealthChecker: checker}
+		status, target = tt.status, ""
+		healthy := m.externalHealthCheck(context.Background(), "10.0.0.1:6443")
+		if healthy != tt.healthy {
+			t.Errorf("%d: mismatched healthy, actual %t instead of %t", i, healthy, tt.healthy)
+		}
+		if target != "10.0.0.1:6443" {
+			t.Errorf("%d: mismatched target, actual %q", i, target)
+		}
+	}
+
+	// no checker configured, or the checker unreachable
+	m := &controlPlaneEndpointManager{}
+	if !m.externalHealthCheck(context.Background(), "10.0.0.1:6443") {
+		t.Errorf("unconfigured external health check reported unhealthy")
+	}
+	checker, _ := newExternalHealthChecker(server.URL)
+	server.Close()
+	m.externalHealthChecker = checker
+	if !m.externalHealthCheck(context.Background(), "10.0.0.1:6443") {
+		t.Errorf("unreachable external checker reported unhealthy")
+	}
+}
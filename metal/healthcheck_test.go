@@ -0,0 +1,286 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewHealthChecker(t *testing.T) {
+	tests := []struct {
+		setting string
+		checker healthChecker
+		err     bool
+	}{
+		{"", &httpHealthChecker{scheme: "https", path: "/healthz"}, false},
+		{"https", &httpHealthChecker{scheme: "https", path: "/healthz"}, false},
+		{"https:///livez", &httpHealthChecker{scheme: "https", path: "/livez"}, false},
+		{"http:///readyz", &httpHealthChecker{scheme: "http", path: "/readyz"}, false},
+		{"tcp", &tcpHealthChecker{}, false},
+		{"tcp://", &tcpHealthChecker{}, false},
+		{"grpc", &grpcHealthChecker{}, false},
+		{"grpc:///kube-apiserver", &grpcHealthChecker{service: "kube-apiserver"}, false},
+		{"exec", nil, true},
+		{"ftp:///healthz", nil, true},
+	}
+
+	for i, tt := range tests {
+		checker, err := newHealthChecker(tt.setting, nil)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		case tt.err:
+		default:
+			// the http client is not interesting to compare
+			if h, ok := checker.(*httpHealthChecker); ok {
+				checker = &httpHealthChecker{scheme: h.scheme, path: h.path}
+			}
+			if describeHealthChecker(checker) != describeHealthChecker(tt.checker) {
+				t.Errorf("%d: mismatched checker for %q, actual %s expected %s", i, tt.setting, describeHealthChecker(checker), describeHealthChecker(tt.checker))
+			}
+		}
+	}
+}
+
+func describeHealthChecker(h healthChecker) string {
+	switch c := h.(type) {
+	case *httpHealthChecker:
+		return c.scheme + " " + c.path
+	case *tcpHealthChecker:
+		return "tcp"
+	case *grpcHealthChecker:
+		return "grpc " + c.service
+	}
+	return "unknown"
+}
+
+func TestHTTPHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/livez" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	tests := []struct {
+		setting string
+		healthy bool
+	}{
+		{"https:///livez", true},
+		{"https:///healthz", false},
+		// plain http to a TLS server
+		{"http:///livez", false},
+	}
+	for i, tt := range tests {
+		checker, err := newHealthChecker(tt.setting, nil)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if err := checker.check(ctx, address); (err == nil) != tt.healthy {
+			t.Errorf("%d: mismatched health for %q, actual error %v expected healthy %t", i, tt.setting, err, tt.healthy)
+		}
+	}
+}
+
+// recordingProber answer every request with the status, recording the URLs
+type recordingProber struct {
+	status int
+	urls   []string
+}
+
+func (p *recordingProber) Do(req *http.Request) (*http.Response, error) {
+	p.urls = append(p.urls, req.URL.String())
+	return &http.Response{StatusCode: p.status, Body: http.NoBody}, nil
+}
+
+func TestHTTPHealthCheckerProber(t *testing.T) {
+	ctx := context.Background()
+	prober := &recordingProber{status: http.StatusOK}
+	checker, err := newHealthChecker("https:///livez", prober)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checker.check(ctx, "10.0.0.1:6443"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	prober.status = http.StatusServiceUnavailable
+	if err := checker.check(ctx, "10.0.0.1:6443"); err == nil {
+		t.Errorf("expected error for http code %d", prober.status)
+	}
+	expected := []string{"https://10.0.0.1:6443/livez", "https://10.0.0.1:6443/livez"}
+	if !reflect.DeepEqual(prober.urls, expected) {
+		t.Errorf("mismatched urls, actual %v expected %v", prober.urls, expected)
+	}
+}
+
+func TestTCPHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	address := listener.Addr().String()
+
+	checker := &tcpHealthChecker{}
+	if err := checker.check(ctx, address); err != nil {
+		t.Errorf("unexpected error with listener: %v", err)
+	}
+	listener.Close()
+	if err := checker.check(ctx, address); err == nil {
+		t.Errorf("expected error without listener")
+	}
+}
+
+func TestGRPCHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	// borrow the self-signed certificate of an httptest server
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	cert := tlsServer.TLS.Certificates[0]
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("kube-apiserver", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("other", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+	address := listener.Addr().String()
+
+	tests := []struct {
+		service string
+		healthy bool
+	}{
+		{"", true},
+		{"kube-apiserver", true},
+		{"other", false},
+		{"unknown", false},
+	}
+	for i, tt := range tests {
+		checker := &grpcHealthChecker{service: tt.service}
+		if err := checker.check(ctx, address); (err == nil) != tt.healthy {
+			t.Errorf("%d: mismatched health for service %q, actual error %v expected healthy %t", i, tt.service, err, tt.healthy)
+		}
+	}
+}
+
+// recordingHealthChecker a health checker that records the addresses it checked
+type recordingHealthChecker struct {
+	checked []string
+}
+
+func (h *recordingHealthChecker) check(ctx context.Context, address string) error {
+	h.checked = append(h.checked, address)
+	return nil
+}
+
+func TestObserveNodeHealthChecks(t *testing.T) {
+	checker := &recordingHealthChecker{}
+	m := &controlPlaneEndpointManager{healthChecker: checker}
+	nodes := []*v1.Node{
+		testControlPlaneNode("master-1", "10.0.0.1"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "no-address"}},
+		testControlPlaneNode("master-2", "10.0.0.2"),
+	}
+
+	// the apiserver port is not known before the first sync of default/kubernetes
+	m.observeNodeHealthChecks(context.Background(), nodes)
+	if len(checker.checked) != 0 {
+		t.Errorf("mismatched checks without apiserver port, actual %v expected none", checker.checked)
+	}
+
+	m.nodeAPIServerPort = 6443
+	m.observeNodeHealthChecks(context.Background(), nodes)
+	if actual := strings.Join(checker.checked, ","); actual != "10.0.0.1:6443,10.0.0.2:6443" {
+		t.Errorf("mismatched checks, actual %s expected 10.0.0.1:6443,10.0.0.2:6443", actual)
+	}
+}
+
+func TestHealthCheckEach(t *testing.T) {
+	tests := []struct {
+		concurrency int
+		expected    int
+	}{
+		{0, 1},
+		{1, 1},
+		{3, 3},
+		{10, 5},
+	}
+	for i, tt := range tests {
+		m := &controlPlaneEndpointManager{healthCheckConcurrency: tt.concurrency}
+		var lock sync.Mutex
+		var running, most int
+		results := m.healthCheckEach(context.Background(), 5, func(ctx context.Context, j int) bool {
+			lock.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			lock.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return j%2 == 0
+		})
+		if !reflect.DeepEqual(results, []bool{true, false, true, false, true}) {
+			t.Errorf("%d: mismatched results, actual %v", i, results)
+		}
+		if most != tt.expected {
+			t.Errorf("%d: mismatched concurrent checks, actual %d expected %d", i, most, tt.expected)
+		}
+	}
+}
+
+// blockingHealthChecker a health checker that answers only once its context is done
+type blockingHealthChecker struct{}
+
+func (h blockingHealthChecker) check(ctx context.Context, address string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestReconcileNodesTimeout(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/abc"}}},
+		},
+	}}
+	m.healthChecker = blockingHealthChecker{}
+	m.apiServerPort = 6443
+	m.reconcileTimeout = 10 * time.Millisecond
+	node := testControlPlaneNode("master-1", "10.0.0.1")
+	node.Spec.ProviderID = "equinixmetal://abc"
+
+	// the failed check was only cut short, so there is no attempt to reassign the EIP
+	err := m.reconcileNodes(ctx, []*v1.Node{node}, ModeSync)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("mismatched error, actual %v expected deadline exceeded", err)
+	}
+}
@@ -0,0 +1,148 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ingressHintsConfigMap the configmap in which to publish the load balancer IPs and BGP
+	// settings, for ingress controllers and those who deploy them
+	ingressHintsConfigMapName      = "cloud-provider-equinix-metal-ingress"
+	ingressHintsConfigMapNamespace = "kube-system"
+
+	ingressHintsKeyAddresses = "addresses"
+	ingressHintsKeyLocalASN  = "localASN"
+	ingressHintsKeyPeerASN   = "peerASN"
+	// ingressHintsValuesSuffix the suffix of the key of the Helm values of an ingress-nginx
+	// controller service that keep its IP across reinstalls
+	ingressHintsValuesSuffix = ".ingress-nginx-values.yaml"
+
+	labelAppName      = "app.kubernetes.io/name"
+	labelAppComponent = "app.kubernetes.io/component"
+)
+
+// ingressHintsManager publishes the IPs of the services of type LoadBalancer, and the BGP settings
+// of the cluster, to a configmap, on each sync; ingress controllers can read it, e.g. referenced from
+// the parameters of an IngressClass, and those who deploy them can pin the IP of an ingress-nginx
+// controller with the Helm values published for it
+type ingressHintsManager struct {
+	k8sclient kubernetes.Interface
+	localASN  int
+	enabled   bool
+}
+
+func newIngressHintsManager(localASN int, enabled bool) *ingressHintsManager {
+	return &ingressHintsManager{localASN: localASN, enabled: enabled}
+}
+
+func (m *ingressHintsManager) name() string {
+	return "ingresshints"
+}
+
+func (m *ingressHintsManager) init(k8sclient kubernetes.Interface) error {
+	m.k8sclient = k8sclient
+	return nil
+}
+
+func (m *ingressHintsManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *ingressHintsManager) serviceReconciler() serviceReconciler {
+	if !m.enabled {
+		klog.V(2).Info("ingress hints disabled, not publishing configmap")
+		return nil
+	}
+	return m.reconcileServices
+}
+
+// reconcileServices publish the hints of all services on each sync; adding or removing a single
+// service is published on the next one, since the hints need all of them
+func (m *ingressHintsManager) reconcileServices(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
+	if mode != ModeSync {
+		return nil
+	}
+	return m.publish(ctx, m.hints(svcs))
+}
+
+// hints the configmap data for the services: the IP of each of type LoadBalancer that has one,
+// by namespace and name, all of them, the BGP settings, and Helm values for ingress-nginx
+func (m *ingressHintsManager) hints(svcs []*v1.Service) map[string]string {
+	data := map[string]string{
+		ingressHintsKeyLocalASN: strconv.Itoa(m.localASN),
+		ingressHintsKeyPeerASN:  strconv.Itoa(DefaultPeerASN),
+	}
+	var addresses []string
+	for _, svc := range svcs {
+		if svc.Spec.Type != v1.ServiceTypeLoadBalancer || svc.Spec.LoadBalancerIP == "" {
+			continue
+		}
+		if svc.Namespace == externalServiceNamespace && svc.Name == externalServiceName {
+			continue
+		}
+		key := fmt.Sprintf("%s.%s", svc.Namespace, svc.Name)
+		data[key] = svc.Spec.LoadBalancerIP
+		addresses = append(addresses, svc.Spec.LoadBalancerIP)
+		if isIngressNginxController(svc) {
+			data[key+ingressHintsValuesSuffix] = ingressNginxValues(svc.Spec.LoadBalancerIP)
+		}
+	}
+	sort.Strings(addresses)
+	data[ingressHintsKeyAddresses] = strings.Join(addresses, ",")
+	return data
+}
+
+// isIngressNginxController whether the service is that of an ingress-nginx controller, as labeled by its Helm chart
+func isIngressNginxController(svc *v1.Service) bool {
+	return svc.Labels[labelAppName] == "ingress-nginx" && svc.Labels[labelAppComponent] == "controller"
+}
+
+// ingressNginxValues the Helm values of the ingress-nginx chart that keep the controller service on the IP
+func ingressNginxValues(ip string) string {
+	return fmt.Sprintf("controller:\n  service:\n    loadBalancerIP: %q\n    externalTrafficPolicy: Local\n", ip)
+}
+
+// publish write the hints to the configmap, if they changed
+func (m *ingressHintsManager) publish(ctx context.Context, data map[string]string) error {
+	configMaps := m.k8sclient.CoreV1().ConfigMaps(ingressHintsConfigMapNamespace)
+	cm, err := configMaps.Get(ctx, ingressHintsConfigMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ingressHintsConfigMapName,
+				Namespace: ingressHintsConfigMapNamespace,
+				Labels:    map[string]string{managedByLabel: managedByCCM},
+			},
+			Data: data,
+		}
+		if _, err := configMaps.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("unable to create configmap %s/%s: %w", ingressHintsConfigMapNamespace, ingressHintsConfigMapName, err)
+		}
+	case err != nil:
+		return fmt.Errorf("unable to get configmap %s/%s: %w", ingressHintsConfigMapNamespace, ingressHintsConfigMapName, err)
+	case cm.Labels[managedByLabel] != managedByCCM:
+		return fmt.Errorf("configmap %s/%s is not managed by %s, not overwriting", ingressHintsConfigMapNamespace, ingressHintsConfigMapName, managedByCCM)
+	case reflect.DeepEqual(cm.Data, data):
+		klog.V(4).Infof("ingress hints unchanged, %s", data[ingressHintsKeyAddresses])
+		return nil
+	default:
+		cm.Data = data
+		if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("unable to update configmap %s/%s: %w", ingressHintsConfigMapNamespace, ingressHintsConfigMapName, err)
+		}
+	}
+	klog.V(2).Infof("published ingress hints to configmap %s/%s, addresses %s", ingressHintsConfigMapNamespace, ingressHintsConfigMapName, data[ingressHintsKeyAddresses])
+	return nil
+}
@@ -0,0 +1,85 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestIngressHints(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	m := newIngressHintsManager(DefaultLocalASN, true)
+	if err := m.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+	lb := func(namespace, name, ip string, labels map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerIP: ip},
+		}
+	}
+	svcs := []*v1.Service{
+		lb("default", "web", "147.75.100.2", nil),
+		lb("ingress-nginx", "ingress-nginx-controller", "147.75.100.1", map[string]string{labelAppName: "ingress-nginx", labelAppComponent: "controller"}),
+		// not yet assigned
+		lb("default", "pending", "", nil),
+		lb(externalServiceNamespace, externalServiceName, testEIP, nil),
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "internal"}, Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP}},
+	}
+
+	// only published on a full sync
+	if err := m.reconcileServices(ctx, svcs, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("unexpected actions on add: %v", client.Actions())
+	}
+
+	if err := m.reconcileServices(ctx, svcs, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cm, err := client.CoreV1().ConfigMaps(ingressHintsConfigMapNamespace).Get(ctx, ingressHintsConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("configmap not created: %v", err)
+	}
+	expected := map[string]string{
+		ingressHintsKeyLocalASN:                  "65000",
+		ingressHintsKeyPeerASN:                   "65530",
+		ingressHintsKeyAddresses:                 "147.75.100.1,147.75.100.2",
+		"default.web":                            "147.75.100.2",
+		"ingress-nginx.ingress-nginx-controller": "147.75.100.1",
+		"ingress-nginx.ingress-nginx-controller" + ingressHintsValuesSuffix: "controller:\n  service:\n    loadBalancerIP: \"147.75.100.1\"\n    externalTrafficPolicy: Local\n",
+	}
+	if len(cm.Data) != len(expected) {
+		t.Errorf("mismatched hints, actual %v expected %v", cm.Data, expected)
+	}
+	for k, v := range expected {
+		if cm.Data[k] != v {
+			t.Errorf("mismatched hint %s, actual %q expected %q", k, cm.Data[k], v)
+		}
+	}
+
+	// unchanged, so not written again
+	client.ClearActions()
+	if err := m.reconcileServices(ctx, svcs, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("unexpected %s of unchanged hints", action.GetVerb())
+		}
+	}
+
+	// not overwritten if managed by someone else
+	cm.Labels = nil
+	if _, err := client.CoreV1().ConfigMaps(ingressHintsConfigMapNamespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update configmap: %v", err)
+	}
+	if err := m.reconcileServices(ctx, svcs[:1], ModeSync); err == nil {
+		t.Errorf("expected error overwriting configmap managed by someone else")
+	}
+}
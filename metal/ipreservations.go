@@ -1,6 +1,8 @@
 package metal
 
 import (
+	"strings"
+
 	"github.com/packethost/packngo"
 )
 
@@ -77,3 +79,62 @@ func ipReservationsByAnyTags(targetTags []string, ips []packngo.IPAddressReserva
 	// if we made it here, nothing matched
 	return ret
 }
+
+// structuredTags the tags of reservations of the CCM, each of the form <key>=<value>, e.g.
+// usage=cloud-provider-equinix-metal-auto, cluster=<id>, service=<uid>; for each key, the values
+// of which a reservation must have one, e.g. the UID of a service, or the hash of its name
+type structuredTags map[string][]string
+
+// parseStructuredTag the key and value of a tag of the form <key>=<value>, where the value may
+// contain = as well, e.g. a base64 hash; false for a free-form tag
+func parseStructuredTag(tag string) (string, string, bool) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ipReservationByStructuredTags given a set of packngo.IPAddressReservation and structured tags,
+// find the first reservation that has, for each key, a tag with one of its values
+func ipReservationByStructuredTags(targetTags structuredTags, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
+	ret := ipReservationsByStructuredTags(targetTags, ips)
+	if len(ret) > 0 {
+		return ret[0]
+	}
+	return nil
+}
+
+// ipReservationsByStructuredTags given a set of packngo.IPAddressReservation and structured tags,
+// find all of the reservations that have, for each key, a tag with one of its values. Unlike matching
+// free-form tags, the key and value are compared on their own, so that free-form tags that merely
+// look alike, never match, and a key without any accepted value matches nothing.
+func ipReservationsByStructuredTags(targetTags structuredTags, ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+	ret := []*packngo.IPAddressReservation{}
+ips:
+	for i, ip := range ips {
+		found := map[string]map[string]bool{}
+		for _, tag := range ip.Tags {
+			if key, value, ok := parseStructuredTag(tag); ok {
+				if found[key] == nil {
+					found[key] = map[string]bool{}
+				}
+				found[key][value] = true
+			}
+		}
+		for key, values := range targetTags {
+			var matched bool
+			for _, value := range values {
+				if found[key][value] {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue ips
+			}
+		}
+		ret = append(ret, &ips[i])
+	}
+	return ret
+}
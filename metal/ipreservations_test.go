@@ -76,3 +76,39 @@ func TestIPReservationByAnyTags(t *testing.T) {
 		}
 	}
 }
+
+func TestIPReservationByStructuredTags(t *testing.T) {
+	ips := []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{Tags: []string{"usage=ccm", "cluster=a", "service=abc="}}},
+		{IpAddressCommon: packngo.IpAddressCommon{Tags: []string{"usage=ccm", "cluster=b", "service=uid-1"}}},
+		// free-form tags that only look alike
+		{IpAddressCommon: packngo.IpAddressCommon{Tags: []string{"usage", "cluster=a=b", "service"}}},
+	}
+	tests := []struct {
+		tags  structuredTags
+		match int
+	}{
+		{structuredTags{"usage": {"ccm"}, "cluster": {"a"}}, 0},
+		{structuredTags{"usage": {"ccm"}, "service": {"abc="}}, 0},
+		{structuredTags{"usage": {"ccm"}, "service": {"uid-1", "abc="}}, 0},
+		{structuredTags{"cluster": {"b"}, "service": {"uid-1", "other"}}, 1},
+		{structuredTags{"cluster": {"a=b"}}, 2},
+		{structuredTags{"cluster": {"a"}, "service": {"uid-1"}}, -1},
+		{structuredTags{"usage": {"ccm"}, "service": {}}, -1},
+		{structuredTags{"service": {""}}, -1},
+	}
+
+	for i, tt := range tests {
+		matched := ipReservationByStructuredTags(tt.tags, ips)
+		switch {
+		case matched == nil && tt.match >= 0:
+			t.Errorf("%d: found no match but expected index %d", i, tt.match)
+		case matched != nil && tt.match < 0:
+			t.Errorf("%d: found a match but expected none", i)
+		case matched == nil && tt.match < 0:
+			// this is good
+		case matched != &ips[tt.match]:
+			t.Errorf("%d: match did not find index %d", i, tt.match)
+		}
+	}
+}
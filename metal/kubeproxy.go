@@ -0,0 +1,69 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/packethost/packngo"
+	yaml "gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// kube-proxy configmap as deployed by kubeadm and most installers that follow it
+	kubeProxyConfigMapNamespace = "kube-system"
+	kubeProxyConfigMapName      = "kube-proxy"
+	kubeProxyConfigMapKey       = "config.conf"
+
+	kubeProxyModeIPTables = "iptables"
+	kubeProxyModeIPVS     = "ipvs"
+
+	eventReasonKubeProxyIPVS = "KubeProxyIPVS"
+)
+
+// kubeProxyConfig the only part of the kube-proxy configuration we care about
+type kubeProxyConfig struct {
+	Mode string `yaml:"mode"`
+}
+
+// kubeProxyMode detect the mode in which kube-proxy runs from its configmap.
+// Returns the configmap, so that events can be recorded on it, and the mode.
+// kube-proxy defaults an empty mode to iptables. If the configmap does not
+// exist, e.g. because kube-proxy was not deployed by kubeadm, returns an empty mode.
+func kubeProxyMode(ctx context.Context, k8sclient kubernetes.Interface) (*v1.ConfigMap, string, error) {
+	cm, err := k8sclient.CoreV1().ConfigMaps(kubeProxyConfigMapNamespace).Get(ctx, kubeProxyConfigMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil, "", nil
+	case err != nil:
+		return nil, "", fmt.Errorf("unable to get kube-proxy configmap: %w", err)
+	}
+	data, ok := cm.Data[kubeProxyConfigMapKey]
+	if !ok {
+		return cm, "", nil
+	}
+	var config kubeProxyConfig
+	if err := yaml.Unmarshal([]byte(data), &config); err != nil {
+		return cm, "", fmt.Errorf("unable to parse kube-proxy config: %w", err)
+	}
+	mode := strings.ToLower(config.Mode)
+	if mode == "" {
+		mode = kubeProxyModeIPTables
+	}
+	return cm, mode, nil
+}
+
+// assignedDeviceID the ID of the device to which an IP reservation is assigned,
+// or empty if it is not assigned to exactly one device
+func assignedDeviceID(ip *packngo.IPAddressReservation) string {
+	if len(ip.Assignments) != 1 || ip.Assignments[0] == nil || ip.Assignments[0].AssignedTo.Href == "" {
+		return ""
+	}
+	// the href ends with /devices/<id>
+	return path.Base(ip.Assignments[0].AssignedTo.Href)
+}
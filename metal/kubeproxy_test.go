@@ -0,0 +1,67 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubeProxyMode(t *testing.T) {
+	tests := []struct {
+		data     map[string]string
+		exists   bool
+		expected string
+		err      bool
+	}{
+		{nil, false, "", false},
+		{map[string]string{}, true, "", false},
+		{map[string]string{kubeProxyConfigMapKey: "apiVersion: kubeproxy.config.k8s.io/v1alpha1\nkind: KubeProxyConfiguration\nmode: \"\"\n"}, true, kubeProxyModeIPTables, false},
+		{map[string]string{kubeProxyConfigMapKey: "kind: KubeProxyConfiguration\nmode: iptables\n"}, true, kubeProxyModeIPTables, false},
+		{map[string]string{kubeProxyConfigMapKey: "kind: KubeProxyConfiguration\nmode: ipvs\nipvs:\n  strictARP: true\n"}, true, kubeProxyModeIPVS, false},
+		{map[string]string{kubeProxyConfigMapKey: "mode: [ipvs"}, true, "", true},
+	}
+	for i, tt := range tests {
+		objects := []runtime.Object{}
+		if tt.exists {
+			objects = append(objects, &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: kubeProxyConfigMapName, Namespace: kubeProxyConfigMapNamespace},
+				Data:       tt.data,
+			})
+		}
+		client := fake.NewSimpleClientset(objects...)
+		_, mode, err := kubeProxyMode(context.Background(), client)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched errors, actual %v expected error %v", i, err, tt.err)
+		case mode != tt.expected:
+			t.Errorf("%d: mismatched mode, actual %q expected %q", i, mode, tt.expected)
+		}
+	}
+}
+
+func TestAssignedDeviceID(t *testing.T) {
+	assignment := func(href string) *packngo.IPAddressAssignment {
+		return &packngo.IPAddressAssignment{AssignedTo: packngo.Href{Href: href}}
+	}
+	tests := []struct {
+		assignments []*packngo.IPAddressAssignment
+		expected    string
+	}{
+		{nil, ""},
+		{[]*packngo.IPAddressAssignment{assignment("/devices/abc")}, "abc"},
+		{[]*packngo.IPAddressAssignment{assignment("/metal/v1/devices/abc")}, "abc"},
+		{[]*packngo.IPAddressAssignment{assignment("")}, ""},
+		{[]*packngo.IPAddressAssignment{assignment("/devices/abc"), assignment("/devices/def")}, ""},
+	}
+	for i, tt := range tests {
+		id := assignedDeviceID(&packngo.IPAddressReservation{Assignments: tt.assignments})
+		if id != tt.expected {
+			t.Errorf("%d: mismatched device ID, actual %q expected %q", i, id, tt.expected)
+		}
+	}
+}
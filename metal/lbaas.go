@@ -0,0 +1,297 @@
+package metal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lbaasAPIURL the Equinix Metal load balancer API, which is separate from the Equinix Metal API
+	lbaasAPIURL = "https://lb.metalctrl.io/v1"
+	// lbaasTokenURL where to exchange the auth token of the Equinix Metal API for one of the load balancer API
+	lbaasTokenURL = "https://iam.metalctrl.io/api-keys/exchange"
+	// lbaasProviderID the provider of the load balancers the CCM creates, the only one there is
+	lbaasProviderID = "loadpvd-gOB_-byp5ebFo7A3LHv2B"
+	// lbaasTokenMargin how long before it expires to exchange the auth token again
+	lbaasTokenMargin = time.Minute
+)
+
+// lbaasClient a small client of the Equinix Metal load balancer API. packngo has no support for it,
+// so it talks to the API over HTTP. The API does not take the auth token of the Equinix Metal API
+// itself, but a short-lived one exchanged for it, which the client exchanges again before it expires.
+type lbaasClient struct {
+	apiURL   string
+	tokenURL string
+	// authToken the current auth token of the Equinix Metal API, which follows rotations
+	authToken  func() string
+	httpClient *http.Client
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newLBaaSClient(authToken func() string) *lbaasClient {
+	return &lbaasClient{
+		apiURL:     lbaasAPIURL,
+		tokenURL:   lbaasTokenURL,
+		authToken:  authToken,
+		httpClient: &http.Client{Transport: newTracingRoundTripper("lbaas", nil), Timeout: 30 * time.Second},
+	}
+}
+
+// lbaasOrigin a target in a pool, to which a port of a load balancer sends traffic
+type lbaasOrigin struct {
+	ID         string `json:"id,omitempty"`
+	Name       string `json:"name"`
+	Target     string `json:"target"`
+	PortNumber int32  `json:"port_number"`
+	Active     bool   `json:"active"`
+	PoolID     string `json:"pool_id,omitempty"`
+}
+
+// lbaasError an error answer of the load balancer API, classified like those of the Equinix Metal API
+type lbaasError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	Message    string
+}
+
+func (e *lbaasError) Error() string {
+	return fmt.Sprintf("load balancer API answered %s %s with %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (e *lbaasError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrAPIRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	default:
+		return false
+	}
+}
+
+// accessToken the token for the load balancer API, exchanged again shortly before it expires,
+// or when the auth token of the Equinix Metal API changed
+func (c *lbaasClient) accessToken(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	req, err := http.NewRequest(http.MethodPost, c.tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c.authToken())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to exchange auth token for the load balancer API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("unable to exchange auth token for the load balancer API: %s", resp.Status)
+	}
+	var answer struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil || answer.AccessToken == "" {
+		return "", fmt.Errorf("no token in answer to the auth token exchange for the load balancer API: %v", err)
+	}
+	c.token = answer.AccessToken
+	c.expires = time.Now().Add(time.Duration(answer.ExpiresIn)*time.Second - lbaasTokenMargin)
+	return c.token, nil
+}
+
+// do send a request to the load balancer API, and decode the answer into out, if given. A
+// rejected token is exchanged again once, in case the auth token was rotated since.
+func (c *lbaasClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = b
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(method, strings.TrimSuffix(c.apiURL, "/")+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			c.lock.Lock()
+			c.token = ""
+			c.lock.Unlock()
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			var answer struct {
+				Message string `json:"message"`
+			}
+			_ = json.NewDecoder(resp.Body).Decode(&answer)
+			if answer.Message == "" {
+				answer.Message = resp.Status
+			}
+			return &lbaasError{StatusCode: resp.StatusCode, Method: method, Path: path, Message: answer.Message}
+		}
+		if out == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("invalid answer from load balancer API to %s %s: %w", method, path, err)
+		}
+		return nil
+	}
+}
+
+// listOrigins the origins of a pool
+func (c *lbaasClient) listOrigins(ctx context.Context, poolID string) ([]lbaasOrigin, error) {
+	var answer struct {
+		Origins []lbaasOrigin `json:"origins"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/loadbalancers/pools/"+poolID+"/origins", nil, &answer); err != nil {
+		return nil, err
+	}
+	return answer.Origins, nil
+}
+
+// createOrigin add an origin to a pool
+func (c *lbaasClient) createOrigin(ctx context.Context, poolID string, origin lbaasOrigin) error {
+	origin.PoolID = poolID
+	return c.do(ctx, http.MethodPost, "/loadbalancers/pools/"+poolID+"/origins", origin, nil)
+}
+
+// deleteOrigin remove an origin from its pool; one already gone is not an error
+func (c *lbaasClient) deleteOrigin(ctx context.Context, originID string) error {
+	err := c.do(ctx, http.MethodDelete, "/loadbalancers/pools/origins/"+originID, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// lbaasLoadBalancer a load balancer, with the IPs it answers on once it is provisioned
+type lbaasLoadBalancer struct {
+	ID    string      `json:"id"`
+	Name  string      `json:"name"`
+	IPs   []string    `json:"ips"`
+	Ports []lbaasPort `json:"ports"`
+}
+
+// lbaasPort a port of a load balancer, which sends its traffic to the origins of its pools, passing
+// them the client IP as set by ProxyProtocol: v1 or v2 for the PROXY protocol, empty for none
+type lbaasPort struct {
+	ID            string   `json:"id,omitempty"`
+	Name          string   `json:"name"`
+	Number        int32    `json:"number"`
+	PoolIDs       []string `json:"pool_ids"`
+	ProxyProtocol string   `json:"proxy_protocol,omitempty"`
+}
+
+// lbaasCreated the answer to the creation of any object
+type lbaasCreated struct {
+	ID string `json:"id"`
+}
+
+// listLoadBalancers the load balancers of a project
+func (c *lbaasClient) listLoadBalancers(ctx context.Context, projectID string) ([]lbaasLoadBalancer, error) {
+	var answer struct {
+		LoadBalancers []lbaasLoadBalancer `json:"loadbalancers"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/projects/"+projectID+"/loadbalancers", nil, &answer); err != nil {
+		return nil, err
+	}
+	return answer.LoadBalancers, nil
+}
+
+// getLoadBalancer a load balancer, with its ports
+func (c *lbaasClient) getLoadBalancer(ctx context.Context, id string) (*lbaasLoadBalancer, error) {
+	var lb lbaasLoadBalancer
+	if err := c.do(ctx, http.MethodGet, "/loadbalancers/"+id, nil, &lb); err != nil {
+		return nil, err
+	}
+	return &lb, nil
+}
+
+// createLoadBalancer create a load balancer at the location, returning its ID
+func (c *lbaasClient) createLoadBalancer(ctx context.Context, projectID, name, locationID string) (string, error) {
+	body := map[string]interface{}{"name": name, "location_id": locationID, "provider_id": lbaasProviderID}
+	var created lbaasCreated
+	if err := c.do(ctx, http.MethodPost, "/projects/"+projectID+"/loadbalancers", body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// deleteLoadBalancer delete a load balancer, with its ports; one already gone is not an error
+func (c *lbaasClient) deleteLoadBalancer(ctx context.Context, id string) error {
+	err := c.do(ctx, http.MethodDelete, "/loadbalancers/"+id, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// createPool create a pool of TCP origins, returning its ID
+func (c *lbaasClient) createPool(ctx context.Context, projectID, name string) (string, error) {
+	body := map[string]interface{}{"name": name, "protocol": "tcp"}
+	var created lbaasCreated
+	if err := c.do(ctx, http.MethodPost, "/projects/"+projectID+"/loadbalancers/pools", body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// deletePool delete a pool, with its origins; one already gone is not an error
+func (c *lbaasClient) deletePool(ctx context.Context, id string) error {
+	err := c.do(ctx, http.MethodDelete, "/loadbalancers/pools/"+id, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// createPort add a port to a load balancer
+func (c *lbaasClient) createPort(ctx context.Context, lbID string, port lbaasPort) error {
+	return c.do(ctx, http.MethodPost, "/loadbalancers/"+lbID+"/ports", port, nil)
+}
+
+// updatePortProxyProtocol change how a port of a load balancer passes the client IP to its origins
+func (c *lbaasClient) updatePortProxyProtocol(ctx context.Context, lbID, portID, proxyProtocol string) error {
+	return c.do(ctx, http.MethodPatch, "/loadbalancers/"+lbID+"/ports/"+portID, map[string]string{"proxy_protocol": proxyProtocol}, nil)
+}
+
+// deletePort remove a port from a load balancer; one already gone is not an error
+func (c *lbaasClient) deletePort(ctx context.Context, lbID, portID string) error {
+	err := c.do(ctx, http.MethodDelete, "/loadbalancers/"+lbID+"/ports/"+portID, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
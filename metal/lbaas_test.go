@@ -0,0 +1,255 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLBaaS an in-memory Equinix Metal load balancer API, which accepts the tokens it handed out
+// in exchange for the current auth token
+type testLBaaS struct {
+	lock      sync.Mutex
+	authToken string
+	exchanges int
+	issued    map[string]bool
+	nextID    int
+	origins   map[string]lbaasOrigin
+	pools     map[string]string
+	lbs       map[string]*lbaasLoadBalancer
+	// provisioned whether load balancers get an IP as soon as they are created
+	provisioned bool
+	// failPorts whether adding a port to a load balancer fails
+	failPorts bool
+}
+
+func newTestLBaaS(t *testing.T, authToken string) (*testLBaaS, *lbaasClient) {
+	f := &testLBaaS{authToken: authToken, issued: map[string]bool{}, origins: map[string]lbaasOrigin{}, pools: map[string]string{}, lbs: map[string]*lbaasLoadBalancer{}, provisioned: true}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	client := newLBaaSClient(func() string {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return f.authToken
+	})
+	client.apiURL = ts.URL + "/v1"
+	client.tokenURL = ts.URL + "/exchange"
+	return f, client
+}
+
+// rotate change the auth token, and stop accepting the tokens handed out for the previous one
+func (f *testLBaaS) rotate(authToken string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.authToken = authToken
+	f.issued = map[string]bool{}
+}
+
+func (f *testLBaaS) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%d", prefix, f.nextID)
+}
+
+func (f *testLBaaS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if r.URL.Path == "/exchange" {
+		if token != f.authToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.exchanges++
+		issued := f.id("token")
+		f.issued[issued] = true
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": issued, "expires_in": 3600})
+		return
+	}
+	if !f.issued[token] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/projects/") {
+		f.serveProject(w, r, strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/projects/"), "/"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/loadbalancers/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "pools" && parts[2] == "origins":
+		origins := []lbaasOrigin{}
+		for _, origin := range f.origins {
+			if origin.PoolID == parts[1] {
+				origins = append(origins, origin)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"origins": origins})
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "pools" && parts[2] == "origins":
+		var origin lbaasOrigin
+		_ = json.NewDecoder(r.Body).Decode(&origin)
+		origin.ID = f.id("origin")
+		f.origins[origin.ID] = origin
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": origin.ID})
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[0] == "pools" && parts[1] == "origins":
+		if _, ok := f.origins[parts[2]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message":"origin not found"}`))
+			return
+		}
+		delete(f.origins, parts[2])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "pools":
+		if _, ok := f.pools[parts[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.pools, parts[1])
+		for id, origin := range f.origins {
+			if origin.PoolID == parts[1] {
+				delete(f.origins, id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && f.lbs[parts[0]] != nil && r.Method == http.MethodGet:
+		_ = json.NewEncoder(w).Encode(f.lbs[parts[0]])
+	case len(parts) == 1 && f.lbs[parts[0]] != nil && r.Method == http.MethodDelete:
+		delete(f.lbs, parts[0])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && f.lbs[parts[0]] != nil && parts[1] == "ports" && r.Method == http.MethodPost && f.failPorts:
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"message":"internal error"}`))
+	case len(parts) == 2 && f.lbs[parts[0]] != nil && parts[1] == "ports" && r.Method == http.MethodPost:
+		var port lbaasPort
+		_ = json.NewDecoder(r.Body).Decode(&port)
+		port.ID = f.id("port")
+		lb := f.lbs[parts[0]]
+		lb.Ports = append(lb.Ports, port)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": port.ID})
+	case len(parts) == 3 && f.lbs[parts[0]] != nil && parts[1] == "ports" && r.Method == http.MethodPatch:
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		lb := f.lbs[parts[0]]
+		for i := range lb.Ports {
+			if lb.Ports[i].ID == parts[2] {
+				lb.Ports[i].ProxyProtocol = body["proxy_protocol"]
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && f.lbs[parts[0]] != nil && parts[1] == "ports" && r.Method == http.MethodDelete:
+		lb := f.lbs[parts[0]]
+		ports := []lbaasPort{}
+		for _, port := range lb.Ports {
+			if port.ID != parts[2] {
+				ports = append(ports, port)
+			}
+		}
+		lb.Ports = ports
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"message":"no such path"}`))
+	}
+}
+
+// serveProject the load balancers and pools of a project
+func (f *testLBaaS) serveProject(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 2 && parts[1] == "loadbalancers" && r.Method == http.MethodGet:
+		lbs := []lbaasLoadBalancer{}
+		for _, lb := range f.lbs {
+			lbs = append(lbs, lbaasLoadBalancer{ID: lb.ID, Name: lb.Name})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"loadbalancers": lbs})
+	case len(parts) == 2 && parts[1] == "loadbalancers" && r.Method == http.MethodPost:
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body["location_id"] == "" || body["provider_id"] != lbaasProviderID {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"message":"invalid location or provider"}`))
+			return
+		}
+		lb := &lbaasLoadBalancer{ID: f.id("lb"), Name: body["name"], Ports: []lbaasPort{}}
+		if f.provisioned {
+			lb.IPs = []string{"147.75.0.1"}
+		}
+		f.lbs[lb.ID] = lb
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": lb.ID})
+	case len(parts) == 3 && parts[1] == "loadbalancers" && parts[2] == "pools" && r.Method == http.MethodPost:
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		id := f.id("pool")
+		f.pools[id] = body["name"]
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": id})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestLBaaSClientToken(t *testing.T) {
+	ctx := context.Background()
+	f, client := newTestLBaaS(t, "metal-token-1")
+
+	// the token is exchanged once, and reused while it is valid
+	for i := 0; i < 3; i++ {
+		if _, err := client.listOrigins(ctx, "pool-1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if f.exchanges != 1 {
+		t.Errorf("mismatched exchanges, actual %d expected 1", f.exchanges)
+	}
+
+	// a token rejected after a rotation is exchanged again, with the new auth token
+	f.rotate("metal-token-2")
+	if _, err := client.listOrigins(ctx, "pool-1"); err != nil {
+		t.Fatalf("unexpected error after rotation: %v", err)
+	}
+	if f.exchanges != 2 {
+		t.Errorf("mismatched exchanges after rotation, actual %d expected 2", f.exchanges)
+	}
+
+	// an error answer is classified
+	if err := client.do(ctx, http.MethodGet, "/loadbalancers/missing", nil, nil); !isNotFound(err) {
+		t.Errorf("mismatched error, actual %v expected not found", err)
+	}
+}
+
+func TestEquinixMetalMembers(t *testing.T) {
+	ctx := context.Background()
+	f, client := newTestLBaaS(t, "metal-token")
+	f.origins["origin-0"] = lbaasOrigin{ID: "origin-0", Target: "10.0.0.9", PortNumber: 6443, PoolID: "other-pool"}
+	members, err := newControlPlaneMembers("equinixmetal://pool-1", client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, addr := range []string{"10.0.0.2", "10.0.0.1"} {
+		if err := members.AddMember(ctx, addr, 6443); err != nil {
+			t.Fatalf("unexpected error adding %s: %v", addr, err)
+		}
+	}
+	actual, err := members.Members(ctx)
+	if err != nil || strings.Join(actual, ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("mismatched members, actual %v %v expected 10.0.0.1,10.0.0.2", actual, err)
+	}
+	for _, origin := range f.origins {
+		if origin.PoolID == "pool-1" && (origin.PortNumber != 6443 || !origin.Active) {
+			t.Errorf("mismatched origin %v, expected active on port 6443", origin)
+		}
+	}
+
+	if err := members.RemoveMember(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual, _ := members.Members(ctx); strings.Join(actual, ",") != "10.0.0.2" {
+		t.Errorf("mismatched members after remove, actual %v expected 10.0.0.2", actual)
+	}
+	// the origins of other pools are left alone
+	if _, ok := f.origins["origin-0"]; !ok {
+		t.Errorf("origin of other pool removed")
+	}
+}
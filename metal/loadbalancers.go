@@ -4,8 +4,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
 	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/empty"
@@ -15,26 +20,182 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	servicehelpers "k8s.io/cloud-provider/service/helpers"
 	"k8s.io/klog/v2"
 )
 
 const (
 	bufferSize = 4096
+
+	eventReasonInvalidPorts        = "InvalidPorts"
+	eventReasonInvalidSourceRanges = "InvalidSourceRanges"
+	eventReasonInvalidIPFamily     = "InvalidIPFamily"
+	eventReasonNoIPCapacity        = "IPCapacityUnavailable"
+	// eventReasonSyncLoadBalancerFailed as the service controller of kubernetes reports it
+	eventReasonSyncLoadBalancerFailed = "SyncLoadBalancerFailed"
+
+	// supported load balancer implementations, set as the scheme of the load balancer setting
+	lbTypeKubeVIP = "kube-vip"
+	lbTypeMetalLB = "metallb"
+	lbTypeEmpty   = "empty"
+	// lbTypeEquinixMetal an Equinix Metal managed load balancer for each service, see ensureManagedLoadBalancer
+	lbTypeEquinixMetal = "equinixmetal"
 )
 
+// LoadBalancerSetting the parsed form of the load balancer setting, which is
+// a URL of the form <type>://<detail>, e.g. metallb:///metallb-system/config
+type LoadBalancerSetting struct {
+	// Type the load balancer implementation, one of kube-vip, metallb, empty, equinixmetal
+	Type string
+	// Detail any implementation-specific configuration, e.g. the metallb configmap namespace/name,
+	// or the location of equinixmetal load balancers
+	Detail string
+}
+
+// MigrateLoadBalancerSetting the load balancer setting in the form of a URL, if it is in the legacy
+// form <namespace>:<name> of the metallb configmap, from before the setting was a URL; e.g.
+// metallb-system:config, once the default, becomes metallb:///metallb-system/config. Whether the
+// setting was in the legacy form is returned as well.
+func MigrateLoadBalancerSetting(setting string) (string, bool) {
+	if strings.Contains(setting, "/") {
+		return setting, false
+	}
+	parts := strings.Split(setting, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return setting, false
+	}
+	switch parts[0] {
+	case lbTypeKubeVIP, lbTypeMetalLB, lbTypeEmpty, lbTypeEquinixMetal:
+		return setting, false
+	}
+	return fmt.Sprintf("%s:///%s/%s", lbTypeMetalLB, parts[0], parts[1]), true
+}
+
+// ParseLoadBalancerSetting parse a load balancer setting URL and validate that
+// it refers to a supported implementation. An empty setting returns nil, meaning
+// that load balancing is disabled.
+func ParseLoadBalancerSetting(setting string) (*LoadBalancerSetting, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid load balancer setting %q: %w", setting, err)
+	}
+	switch u.Scheme {
+	case lbTypeKubeVIP, lbTypeMetalLB, lbTypeEmpty:
+	case lbTypeEquinixMetal:
+		if managedLocation(u.Host+u.Path) == "" {
+			return nil, fmt.Errorf("invalid load balancer setting %q: must be of the form %s://<location id>", setting, lbTypeEquinixMetal)
+		}
+	case "":
+		return nil, fmt.Errorf("invalid load balancer setting %q: must be of the form <type>://<detail>", setting)
+	default:
+		return nil, fmt.Errorf("invalid load balancer setting %q: unsupported type %q, must be one of %s, %s, %s, %s", setting, u.Scheme, lbTypeKubeVIP, lbTypeMetalLB, lbTypeEmpty, lbTypeEquinixMetal)
+	}
+	// anything in the host portion is part of the detail as well, so that
+	// metallb://metallb-system/config works just like metallb:///metallb-system/config
+	detail := u.Path
+	if u.Host != "" {
+		detail = "/" + u.Host + u.Path
+	}
+	return &LoadBalancerSetting{Type: u.Scheme, Detail: detail}, nil
+}
+
 type loadBalancers struct {
 	client            *packngo.Client
 	k8sclient         kubernetes.Interface
+	recorder          record.EventRecorder
 	project           string
 	facility          string
+	fallbackMetros    []string
 	clusterID         string
 	implementor       loadbalancers.LB
 	implementorConfig string
+	implementorType   string
+	healthCheck       bool
+	// nodeAddressType the type of node address to probe the backends at, see nodeProbeAddress
+	nodeAddressType v1.NodeAddressType
+	// excludeControlPlane keep control plane nodes out of the nodes that announce service IPs
+	excludeControlPlane bool
+	// namespaces if set, the only namespaces whose services get IPs; excludedNamespaces never get them
+	namespaces         []string
+	excludedNamespaces []string
+	// maxIPs, maxIPsPerNamespace the most Elastic IPs to allocate for services, in all and in each namespace; 0 for no maximum
+	maxIPs             int
+	maxIPsPerNamespace int
+	// keepIPGrace how long to keep the IP of a deleted service that asks for it, see annotationKeepIP
+	keepIPGrace time.Duration
+	ipUpdater   ipReservationUpdater
+	// ipAllocator allocates the IPs of services, via the Equinix Metal API unless configured otherwise
+	ipAllocator ipAllocator
+	// nameFormat the format of the names of load balancers, see loadBalancerName
+	nameFormat string
+	// addressPoolDefault the MetalLB address pool of services without annotationAddressPool; empty for one of their own
+	addressPoolDefault string
+	// rackSpread pick a rack of nodes to announce each service IP, see spreadServiceIP
+	rackSpread bool
+	// reusePoolTag if set, the tag of idle reservations to claim before requesting new IPs, and to return IPs to
+	reusePoolTag string
+	// backendLock protects the nodes and backend health used for service health checks
+	backendLock sync.Mutex
+	nodes       []*v1.Node
+	backendDown map[string]string
+	// metalNodes the BGP neighbours reported by node agents, if in agent mode
+	metalNodes *metalNodeManager
+	// lbaas the client of the Equinix Metal load balancer API, and location the location of the
+	// load balancers of services, with load balancer type equinixmetal
+	lbaas    *lbaasClient
+	location string
+	// proxyProtocolLock protects the proxy protocol annotation last warned about on each service
+	proxyProtocolLock sync.Mutex
+	proxyProtocols    map[string]string
+	// conditionsLock protects the status conditions last set on each service
+	conditionsLock sync.Mutex
+	conditions     map[string]map[string]serviceCondition
+	// clock for how long to keep the IPs of deleted services, and when conditions changed; the real time if nil
+	clock Clock
 }
 
-func newLoadBalancers(client *packngo.Client, projectID, facility string, config string) *loadBalancers {
-	return &loadBalancers{client, nil, projectID, facility, "", nil, config}
+func newLoadBalancers(config Config, client *packngo.Client, metalNodes *metalNodeManager, lbaas *lbaasClient) *loadBalancers {
+	// validated when the config was loaded; empty means the default grace period
+	keepIPGrace, _ := time.ParseDuration(config.LBKeepIPGracePeriod)
+	if keepIPGrace <= 0 {
+		keepIPGrace = DefaultKeepIPGracePeriod
+	}
+	// validated when the config was loaded
+	l := &loadBalancers{
+		client:              client,
+		project:             config.ProjectID,
+		facility:            config.Facility,
+		fallbackMetros:      config.FallbackMetros,
+		implementorConfig:   config.LoadBalancerSetting,
+		healthCheck:         config.LoadBalancerHealthCheck,
+		excludeControlPlane: config.LBExcludeControlPlane,
+		namespaces:          config.LBNamespaces,
+		excludedNamespaces:  config.LBExcludedNamespaces,
+		maxIPs:              config.LBMaxIPs,
+		maxIPsPerNamespace:  config.LBMaxIPsPerNamespace,
+		keepIPGrace:         keepIPGrace,
+		nameFormat:          config.LBNameFormat,
+		nodeAddressType:     v1.NodeAddressType(config.NodeAddressType),
+		addressPoolDefault:  config.LBAddressPool,
+		rackSpread:          config.LBRackSpread,
+		reusePoolTag:        config.LBReusePoolTag,
+		clock:               config.Clock,
+		lbaas:               lbaas,
+		backendDown:         map[string]string{},
+		conditions:          map[string]map[string]serviceCondition{},
+		metalNodes:          metalNodes,
+	}
+	// validated when the config was loaded
+	allocator := newIPAllocator(config.LBIPAllocator, client, config.ProjectID, config.Facility, config.FallbackMetros, l.controlPlaneMetros)
+	l.ipAllocator, l.ipUpdater = allocator, allocator
+	return l
 }
 
 func (l *loadBalancers) name() string {
@@ -49,59 +210,91 @@ func (l *loadBalancers) init(k8sclient kubernetes.Interface) error {
 	}
 
 	l.k8sclient = k8sclient
+	l.recorder = newEventRecorder(k8sclient)
 	// get the UID of the kube-system namespace
 	systemNamespace, err := k8sclient.CoreV1().Namespaces().Get(context.Background(), "kube-system", metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to get kube-system namespace: %v", err)
+		return fmt.Errorf("failed to get kube-system namespace: %w", err)
 	}
 	if systemNamespace == nil {
 		return fmt.Errorf("kube-system namespace is missing unexplainably")
 	}
 
-	u, err := url.Parse(l.implementorConfig)
+	setting, err := ParseLoadBalancerSetting(l.implementorConfig)
 	if err != nil {
-		return fmt.Errorf("invalid config: %v", err)
+		return fmt.Errorf("invalid config: %w", err)
 	}
-	config := u.Path
+	config := setting.Detail
 	var impl loadbalancers.LB
-	switch u.Scheme {
-	case "kube-vip":
+	switch setting.Type {
+	case lbTypeKubeVIP:
 		klog.Info("loadbalancer implementation enabled: kube-vip")
 		impl = kubevip.NewLB(k8sclient, config)
-	case "metallb":
+	case lbTypeMetalLB:
 		klog.Info("loadbalancer implementation enabled: metallb")
 		impl = metallb.NewLB(k8sclient, config)
-	case "empty":
+	case lbTypeEmpty:
 		klog.Info("loadbalancer implementation enabled: empty, bgp only")
 		impl = empty.NewLB(k8sclient, config)
-	default:
-		klog.Info("loadbalancer implementation disabled")
-		impl = nil
+	case lbTypeEquinixMetal:
+		// no implementation, and so no reconcilers: the service controller of kubernetes drives these
+		l.location = managedLocation(config)
+		klog.Infof("loadbalancer implementation enabled: equinixmetal, a managed load balancer at location %s for each service", l.location)
 	}
 
 	l.clusterID = string(systemNamespace.UID)
 	l.implementor = impl
+	l.implementorType = setting.Type
 	klog.V(2).Info("loadBalancers.init(): complete")
 	return nil
 }
 
 // implementation of cloudprovider.LoadBalancer
-// we do this via metallb, not directly, so none of this works... for now.
+// only for managed load balancers; the other types do this via metallb etc. in the reconcilers instead,
+// and the cloud does not offer the interface for them, see cloud.LoadBalancer
 
 func (l *loadBalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
-	return nil, false, nil
+	if !l.managed() {
+		return nil, false, nil
+	}
+	lb, err := l.managedLoadBalancer(ctx, service)
+	if err != nil || lb == nil {
+		return nil, false, err
+	}
+	return managedStatus(lb), true, nil
 }
+
+// GetLoadBalancerName the name of the load balancer of a service, as set by the configured format;
+// the managed load balancer of the service is created with it, and its IP reservations tagged with it
 func (l *loadBalancers) GetLoadBalancerName(ctx context.Context, clusterName string, service *v1.Service) string {
-	return ""
+	return loadBalancerName(l.nameFormat, l.clusterID, service)
 }
 func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	return nil, nil
+	if !l.managed() {
+		return nil, nil
+	}
+	return l.ensureManagedLoadBalancer(ctx, service, nodes)
 }
 func (l *loadBalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
-	return nil
+	if !l.managed() {
+		return nil
+	}
+	proxyProtocol, err := serviceProxyProtocol(service)
+	if err != nil {
+		return err
+	}
+	lb, err := l.managedLoadBalancer(ctx, service)
+	if err != nil || lb == nil {
+		// one not created yet is created by EnsureLoadBalancer
+		return err
+	}
+	return l.syncManagedPorts(ctx, service, lb, l.managedOrigins(nodes), proxyProtocol)
 }
 func (l *loadBalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
-	return nil
+	if !l.managed() {
+		return nil
+	}
+	return l.deleteManagedLoadBalancer(ctx, service)
 }
 
 // utility funcs
@@ -130,6 +323,13 @@ func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mo
 		err  error
 	)
 	klog.V(2).Infof("loadbalancers.reconcileNodes(): called for nodes %v", nodes)
+	// removed nodes are removed, whatever their role or state; otherwise only available backends are of interest
+	if mode != ModeRemove && l.excludeControlPlane {
+		nodes = workerNodes(nodes)
+	}
+	if mode != ModeRemove {
+		nodes = availableNodes(nodes)
+	}
 
 	// are we adding, removing or syncing the node?
 	switch mode {
@@ -149,7 +349,7 @@ func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mo
 			if id == "" {
 				return fmt.Errorf("no provider ID given for node %s", node.Name)
 			}
-			if peer, err = getNodeBGPConfig(id, l.client); err != nil || peer == nil {
+			if peer, err = nodeBGPConfig(node, l.client, l.metalNodes); err != nil || peer == nil {
 				klog.Errorf("loadbalancers.reconcileNodes(): could not add metallb node peer address for node %s: %v", node.Name, err)
 				continue
 			}
@@ -159,6 +359,7 @@ func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mo
 			}
 		}
 	case ModeSync:
+		l.setKnownNodes(nodes)
 		// make sure the list of nodes exactly matches between the provided nodes and the ones in the configmap
 		goodMap := map[string]loadbalancers.Node{}
 		for _, node := range nodes {
@@ -167,7 +368,7 @@ func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mo
 			if id == "" {
 				return fmt.Errorf("no provider ID given for node %s", node.Name)
 			}
-			if peer, err = getNodeBGPConfig(id, l.client); err != nil || peer == nil {
+			if peer, err = nodeBGPConfig(node, l.client, l.metalNodes); err != nil || peer == nil {
 				klog.Errorf("loadbalancers.reconcileNodes(): could not get node peer address for node %s: %v", node.Name, err)
 				continue
 			}
@@ -181,13 +382,24 @@ func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mo
 			}
 		}
 		if err := l.implementor.SyncNodes(ctx, goodMap); err != nil {
-			return fmt.Errorf("error syncing nodes: %v", err)
+			return fmt.Errorf("error syncing nodes: %w", err)
 		}
 	}
 	klog.V(2).Infof("loadbalancers.reconcileNodes(): config changed, done")
 	return nil
 }
 
+// workerNodes the nodes that are not control plane nodes
+func workerNodes(nodes []*v1.Node) []*v1.Node {
+	workers := []*v1.Node{}
+	for _, n := range nodes {
+		if _, ok := n.Labels[controlPlaneLabel]; !ok {
+			workers = append(workers, n)
+		}
+	}
+	return workers
+}
+
 // reconcileServices add or remove services to have loadbalancers. If it adds a
 // service, then it requests a new IP reservation, with "fast-fail", i.e. if it
 // cannot create the IP reservation immediately, then it fails, rather than
@@ -199,9 +411,9 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 
 	var err error
 	// get IP address reservations and check if they any exists for this svc
-	ips, _, err := l.client.ProjectIPs.List(l.project, &packngo.ListOptions{})
+	ips, err := l.ipAllocator.list(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)
+		return err
 	}
 
 	validSvcs := []*v1.Service{}
@@ -211,48 +423,35 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 			validSvcs = append(validSvcs, svc)
 		}
 	}
+	// services in namespaces the CCM does not manage get no IP, and are told so when added
+	// or changed; any IP they already have is left alone, and still released on removal
+	var deniedSvcs []*v1.Service
+	if mode != ModeRemove {
+		validSvcs, deniedSvcs = l.filterServiceNamespaces(validSvcs, mode == ModeAdd || mode == ModeUpdate)
+	}
 	klog.V(5).Infof("loadbalancer.reconcileServices(): valid services %#v", validSvcs)
 
+	// one broken service does not keep the others from being reconciled; the errors
+	// of each are reported on it, and returned together
+	var errs []error
 	switch mode {
-	case ModeAdd:
-		// ADDITION
+	case ModeAdd, ModeUpdate:
+		// ADDITION; an updated service is added again, in case e.g. its requested IP changed
 		for _, svc := range validSvcs {
 			klog.V(2).Infof("loadbalancer.reconcileServices(): add: service %s", svc.Name)
-			if err := l.addService(ctx, svc, ips); err != nil {
-				return err
+			if err := l.reconcileService(svc, l.addService(ctx, svc, ips)); err != nil {
+				errs = append(errs, err)
 			}
 		}
 	case ModeRemove:
 		// REMOVAL
 		for _, svc := range validSvcs {
-			svcName := serviceRep(svc)
-			svcTag := serviceTag(svc)
-			clsTag := clusterTag(l.clusterID)
-			svcIP := svc.Spec.LoadBalancerIP
-
-			var svcIPCidr string
-			ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
-
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: %s with existing IP assignment %s", svcName, svcIP)
-
-			// get the IPs and see if there is anything to clean up
-			if ipReservation == nil {
-				klog.V(2).Infof("loadbalancer.reconcileServices(): remove: no IP reservation found for %s, nothing to delete", svcName)
+			if err := l.reconcileService(svc, l.removeService(ctx, svc, ips)); err != nil {
+				errs = append(errs, err)
 				continue
 			}
-			// delete the reservation
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s EIP ID %s", svcName, ipReservation.ID)
-			_, err = l.client.ProjectIPs.Remove(ipReservation.ID)
-			if err != nil {
-				return fmt.Errorf("failed to remove IP address reservation %s from project: %v", ipReservation.String(), err)
-			}
-			// remove it from the configmap
-			svcIPCidr = fmt.Sprintf("%s/%d", ipReservation.Address, ipReservation.CIDR)
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s entry %s", svcName, svcIPCidr)
-			if err := l.implementor.RemoveService(ctx, svcIPCidr); err != nil {
-				return fmt.Errorf("error removing IP from configmap for %s: %v", svcName, err)
-			}
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: removed service %s from implementation", svcName)
+			loadBalancerServiceFailed.Delete(map[string]string{"service": serviceRep(svc)})
+			l.forgetServiceConditions(svc)
 		}
 	case ModeSync:
 		// what we have to do:
@@ -261,11 +460,14 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 		// 3. for each EIP, ensure it exists in the configmap
 		// 4. get each EIP in the configmap, check if it is in our list; if not, delete
 
+		// services sharing an IP can only each have the traffic of their own ports
+		l.reportSharedIPPortConflicts(validSvcs)
+
 		// add each service that is in the known list
 		for _, svc := range validSvcs {
 			klog.V(2).Infof("loadbalancer.reconcileServices(): sync: service %s", svc.Name)
-			if err := l.addService(ctx, svc, ips); err != nil {
-				return err
+			if err := l.reconcileService(svc, l.addService(ctx, svc, ips)); err != nil {
+				errs = append(errs, err)
 			}
 		}
 
@@ -273,9 +475,10 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 
 		// we need to get the addresses again, because we might have changed them
 		klog.V(5).Info("loadbalancer.reconcileServices(): sync: getting all IP reservations")
-		ips, _, err = l.client.ProjectIPs.List(l.project, &packngo.ListOptions{})
+		ips, err = l.ipAllocator.list(ctx)
 		if err != nil {
-			return fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)
+			errs = append(errs, err)
+			return utilerrors.NewAggregate(errs)
 		}
 		// get all EIP that have the equinix metal tag and are allocated to this cluster
 		ipReservations := ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips)
@@ -289,21 +492,31 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 		validTags := map[string]bool{}
 		validIPs := map[string]bool{}
 
-		for _, svc := range validSvcs {
+		for _, svc := range append(validSvcs, deniedSvcs...) {
 			validTags[serviceTag(svc)] = true
+			if uidTag := serviceUIDTag(svc); uidTag != "" {
+				validTags[uidTag] = true
+			}
 			svcIP := svc.Spec.LoadBalancerIP
 			if svcIP != "" {
 				if cidr, ok := ipCidr[svcIP]; ok {
 					validIPs[fmt.Sprintf("%s/%d", svcIP, cidr)] = true
 				}
 			}
+			for _, ip := range l.serviceExtraReservations(svc, ips) {
+				validIPs[fmt.Sprintf("%s/%d", ip.Address, ip.CIDR)] = true
+			}
+			if ip := l.serviceIPv6Reservation(svc, ips); ip != nil {
+				validIPs[fmt.Sprintf("%s/%d", ip.Address, ip.CIDR)] = true
+			}
 		}
 
 		klog.V(2).Infof("loadbalancer.reconcileServices(): sync: valid tags %v", validTags)
 		klog.V(2).Infof("loadbalancer.reconcileServices(): sync: valid svc IPs %v", validIPs)
 
 		if err := l.implementor.SyncServices(ctx, validIPs); err != nil {
-			return err
+			errs = append(errs, err)
+			return utilerrors.NewAggregate(errs)
 		}
 
 		// remove any EIPs that do not have a reservation
@@ -316,67 +529,178 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 					foundTag = true
 				}
 			}
+			// the IP of a deleted service may be kept for a while, in case it is recreated
+			if !foundTag && !keptIPExpired(ipReservation, clockNow(l.clock)) {
+				klog.V(2).Infof("loadbalancer.reconcileServices(): sync: keeping reservation %s of a deleted service", ipReservation.Address)
+				continue
+			}
 			// did we find a valid tag?
 			if !foundTag {
 				klog.V(2).Infof("loadbalancer.reconcileServices(): sync: removing reservation with service= tag but not in validTags list %#v", ipReservation)
 				// delete the reservation
-				_, err = l.client.ProjectIPs.Remove(ipReservation.ID)
-				if err != nil {
-					return fmt.Errorf("failed to remove IP address reservation %s from project: %v", ipReservation.String(), err)
+				if err := l.releaseServiceIP(ctx, ipReservation); err != nil {
+					errs = append(errs, err)
 				}
 			}
 		}
+
+		if l.healthCheck {
+			l.checkServiceBackends(ctx, validSvcs)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// removeService remove a single service; releases its IP and wraps the implementation
+func (l *loadBalancers) removeService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	svcName := serviceRep(svc)
+	svcIP := svc.Spec.LoadBalancerIP
+
+	var svcIPCidr string
+	ipReservation := l.serviceReservation(svc, ips)
+
+	klog.V(2).Infof("loadbalancer.reconcileServices(): remove: %s with existing IP assignment %s", svcName, svcIP)
+
+	l.proxyProtocolChanged(svcName, "")
+
+	// any additional IPs are never kept, nor is the IPv6 one
+	for _, ip := range l.serviceExtraReservations(svc, ips) {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s additional EIP ID %s", svcName, ip.ID)
+		if err := l.releaseServiceExtraIP(ctx, ip); err != nil {
+			return err
+		}
 	}
+	if ip := l.serviceIPv6Reservation(svc, ips); ip != nil {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s IPv6 EIP ID %s", svcName, ip.ID)
+		if err := l.releaseServiceExtraIP(ctx, ip); err != nil {
+			return err
+		}
+	}
+
+	// get the IPs and see if there is anything to clean up
+	if ipReservation == nil {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: no IP reservation found for %s, nothing to delete", svcName)
+		return nil
+	}
+	if keepIP(svc) {
+		return l.keepServiceIP(ctx, svc, ipReservation)
+	}
+	// delete the reservation
+	klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s EIP ID %s", svcName, ipReservation.ID)
+	if err := l.releaseServiceIP(ctx, ipReservation); err != nil {
+		return err
+	}
+	// remove it from the configmap
+	svcIPCidr = fmt.Sprintf("%s/%d", ipReservation.Address, ipReservation.CIDR)
+	klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s entry %s", svcName, svcIPCidr)
+	if err := l.implementor.RemoveService(ctx, svcIPCidr); err != nil {
+		return fmt.Errorf("error removing IP from configmap for %s: %w", svcName, err)
+	}
+	klog.V(2).Infof("loadbalancer.reconcileServices(): remove: removed service %s from implementation", svcName)
+	l.forgetServiceBackends(svc)
 	return nil
 }
 
+// reconcileService report the result of reconciling a single service on the service, as an
+// event, and in a metric, and return the error, if any, naming the service
+func (l *loadBalancers) reconcileService(svc *v1.Service, err error) error {
+	svcName := serviceRep(svc)
+	if err == nil {
+		loadBalancerServiceFailed.WithLabelValues(svcName).Set(0)
+		return nil
+	}
+	loadBalancerServiceFailed.WithLabelValues(svcName).Set(1)
+	l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonSyncLoadBalancerFailed, "Error syncing load balancer: %v", err)
+	return fmt.Errorf("service %s: %w", svcName, err)
+}
+
 // addService add a single service; wraps the implementation
 func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
 	svcName := serviceRep(svc)
-	svcTag := serviceTag(svc)
-	clsTag := clusterTag(l.clusterID)
 	svcIP := svc.Spec.LoadBalancerIP
 
 	var (
 		svcIPCidr string
 		err       error
 	)
-	ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
+	ipReservation := l.serviceReservation(svc, ips)
+	if ipReservation != nil {
+		l.migrateServiceTags(svc, ipReservation)
+	}
+	// the service was recreated in time to get back the IP it kept, which it now has again for good
+	if ipReservation != nil {
+		if _, ok := keepUntil(ipReservation); ok {
+			if err := l.setKeepUntil(ipReservation, time.Time{}); err != nil {
+				return err
+			}
+			klog.Infof("service %s recreated, got back its kept IP %s", svcName, ipReservation.Address)
+		}
+	}
+
+	// the IP is announced for all protocols, but make sure we can actually serve the ports
+	if err := validateServicePorts(svc); err != nil {
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonInvalidPorts, "Not allocating a load balancer IP: %v", err)
+		l.setServiceIPAllocated(ctx, svc, "", eventReasonInvalidPorts, err)
+		return fmt.Errorf("invalid ports for service %s: %w", svcName, err)
+	}
+	// the first Elastic IP is IPv4, so never give an IPv6 only service an address it cannot use
+	if err := validateServiceIPFamily(svc); err != nil {
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonInvalidIPFamily, "Not allocating a load balancer IP: %v", err)
+		l.setServiceIPAllocated(ctx, svc, "", eventReasonInvalidIPFamily, err)
+		return fmt.Errorf("invalid IP family for service %s: %w", svcName, err)
+	}
+	if _, err := serviceEIPCount(svc); err != nil {
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonInvalidEIPCount, "Not allocating a load balancer IP: %v", err)
+		l.setServiceIPAllocated(ctx, svc, "", eventReasonInvalidEIPCount, err)
+		return fmt.Errorf("invalid Elastic IP count for service %s: %w", svcName, err)
+	}
+	// never expose a service to the world when the user asked for it to be restricted
+	if err := validateSourceRanges(svc, l.implementorType); err != nil {
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonInvalidSourceRanges, "Not allocating a load balancer IP: %v", err)
+		l.setServiceIPAllocated(ctx, svc, "", eventReasonInvalidSourceRanges, err)
+		return fmt.Errorf("invalid source ranges for service %s: %w", svcName, err)
+	}
+
+	l.checkProxyProtocol(svc)
 
 	klog.V(2).Infof("processing %s with existing IP assignment %s", svcName, svcIP)
 	// if it already has an IP, no need to get it one
 	if svcIP == "" {
 		klog.V(2).Infof("no IP assigned for service %s; searching reservations", svcName)
+		// the metro in which a new IP was reserved, if not in the facility
+		var metro string
 
 		// if no IP found, request a new one
 		if ipReservation == nil {
 
+			// stay within the configured quotas, rather than run into the one of the project
+			if err := l.checkIPQuota(ctx, svc, ips); err != nil {
+				if errors.Is(err, ErrIPQuotaExceeded) {
+					l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonIPQuotaExceeded, "Not allocating a load balancer IP: %v", err)
+					l.setServiceIPAllocated(ctx, svc, "", eventReasonIPQuotaExceeded, err)
+				}
+				return err
+			}
+
 			// if we did not find an IP reserved, create a request
 			klog.V(2).Infof("no IP assignment found for %s, requesting", svcName)
-			// create a request
-			facility := l.facility
-			req := packngo.IPReservationRequest{
-				Type:        "public_ipv4",
-				Quantity:    1,
-				Description: ccmIPDescription,
-				Facility:    &facility,
-				Tags: []string{
-					emTag,
-					svcTag,
-					clsTag,
-				},
-				FailOnApprovalRequired: true,
+			lbTag := loadBalancerTagPrefix + l.GetLoadBalancerName(ctx, "", svc)
+			ipReservation, metro, err = l.allocateServiceIP(ctx, svcName, v1.IPv4Protocol, l.serviceReservationTagList(svc, lbTag), ips)
+			if errors.Is(err, ErrNoCapacity) {
+				l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonNoIPCapacity, "Not allocating a load balancer IP: %v", err)
+				l.setServiceIPAllocated(ctx, svc, "", eventReasonNoIPCapacity, err)
+			} else if err != nil {
+				l.setServiceIPAllocated(ctx, svc, "", conditionReasonRequestFailed, err)
 			}
-
-			ipReservation, _, err = l.client.ProjectIPs.Request(l.project, &req)
 			if err != nil {
-				return fmt.Errorf("failed to request an IP for the load balancer: %v", err)
+				return err
 			}
 		}
 
 		// if we have no IP from existing or a new reservation, log it and return
 		if ipReservation == nil {
 			klog.V(2).Infof("no IP to assign to service %s, will need to wait until it is allocated", svcName)
+			l.setServiceIPAllocated(ctx, svc, "", "", nil)
 			return nil
 		}
 
@@ -384,20 +708,31 @@ func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, ips []p
 		// map and assign it
 		svcIP = ipReservation.Address
 
-		// assign the IP and save it
+		// assign the IP and save it, as a patch, so that it neither needs the latest
+		// version of the service, nor conflicts with other changes to it
 		klog.V(2).Infof("assigning IP %s to %s", svcIP, svcName)
-		intf := l.k8sclient.CoreV1().Services(svc.Namespace)
-		existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
-		if err != nil || existing == nil {
-			klog.V(2).Infof("failed to get latest for service %s: %v", svcName, err)
-			return fmt.Errorf("failed to get latest for service %s: %v", svcName, err)
+		patch := map[string]interface{}{
+			"spec": map[string]interface{}{"loadBalancerIP": svcIP},
 		}
-		existing.Spec.LoadBalancerIP = svcIP
-
-		_, err = intf.Update(ctx, existing, metav1.UpdateOptions{})
+		// let the user know where the IP actually came from, as it may be a fallback metro
+		switch {
+		case metro != "":
+			patch["metadata"] = map[string]interface{}{
+				"annotations": map[string]string{annotationEIPMetro: metro},
+			}
+		case ipReservation.Facility != nil && ipReservation.Facility.Code != "":
+			patch["metadata"] = map[string]interface{}{
+				"annotations": map[string]string{annotationEIPFacility: ipReservation.Facility.Code},
+			}
+		}
+		mergePatch, err := json.Marshal(patch)
+		if err != nil {
+			return fmt.Errorf("failed to encode patch of service %s: %w", svcName, err)
+		}
+		_, err = l.k8sclient.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, k8stypes.MergePatchType, mergePatch, metav1.PatchOptions{})
 		if err != nil {
 			klog.V(2).Infof("failed to update service %s: %v", svcName, err)
-			return fmt.Errorf("failed to update service %s: %v", svcName, err)
+			return fmt.Errorf("failed to update service %s: %w", svcName, err)
 		}
 		klog.V(2).Infof("successfully assigned %s update service %s", svcIP, svcName)
 	}
@@ -407,7 +742,89 @@ func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, ips []p
 		cidr = ipReservation.CIDR
 	}
 	svcIPCidr = fmt.Sprintf("%s/%d", svcIP, cidr)
-	return l.implementor.AddService(ctx, svcName, svcIPCidr)
+	l.setServiceIPAllocated(ctx, svc, svcIP, "", nil)
+	if err := l.addServiceToImplementor(ctx, svc, svcName, svcIPCidr); err != nil {
+		l.setServiceCondition(ctx, svc, conditionAnnouncementReady, metav1.ConditionFalse, conditionReasonAnnouncementError, err.Error())
+		return err
+	}
+	l.setServiceCondition(ctx, svc, conditionAnnouncementReady, metav1.ConditionTrue, conditionReasonAnnounced, fmt.Sprintf("Elastic IP %s configured in load balancer %s", svcIPCidr, l.implementorType))
+	if err := l.spreadServiceIP(ctx, svc, svcIP); err != nil {
+		return err
+	}
+	return l.syncServiceExtraIPs(ctx, svc, svcIP, ips)
+}
+
+// servicePortProtocol the protocol of a service port, which kubernetes treats as TCP if not set
+func servicePortProtocol(port v1.ServicePort) v1.Protocol {
+	if port.Protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// validateServicePorts check that the ports of a service can be served through an EIP.
+// The EIP itself is announced, whether via BGP or static assignment, for all protocols,
+// and kube-proxy handles TCP, UDP and SCTP on the nodes, so those are the supported protocols.
+// The same port may be used with different protocols, e.g. DNS on 53 for TCP and UDP.
+func validateServicePorts(svc *v1.Service) error {
+	seen := map[string]bool{}
+	for _, port := range svc.Spec.Ports {
+		protocol := servicePortProtocol(port)
+		switch protocol {
+		case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+		default:
+			return fmt.Errorf("port %d has unsupported protocol %s", port.Port, protocol)
+		}
+		if port.Port < 1 || port.Port > 65535 {
+			return fmt.Errorf("port %d/%s is out of range", port.Port, protocol)
+		}
+		key := fmt.Sprintf("%d/%s", port.Port, protocol)
+		if seen[key] {
+			return fmt.Errorf("port %s is defined more than once", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// validateServiceIPFamily return an error if the service is not IPv4 or dual-stack. The first
+// Elastic IP of a service, its spec.loadBalancerIP, is reserved as public_ipv4, so an IPv6 only
+// service cannot be given one; a dual-stack service gets an IPv6 one as well, see serviceDualStack.
+func validateServiceIPFamily(svc *v1.Service) error {
+	if ipv4, _ := serviceIPFamilies(svc); ipv4 {
+		return nil
+	}
+	return fmt.Errorf("IP families %v are not supported, only %s or %s with %s", svc.Spec.IPFamilies, v1.IPv4Protocol, v1.IPv4Protocol, v1.IPv6Protocol)
+}
+
+// sourceRangesEnforced whether the source ranges of a service are enforced for the
+// given load balancer implementation. None of the implementations filter traffic
+// themselves; kube-proxy restricts traffic to the IPs in the service status to the
+// source ranges. metallb and kube-vip set the status, but nothing does for empty.
+func sourceRangesEnforced(lbType string) bool {
+	switch lbType {
+	case lbTypeMetalLB, lbTypeKubeVIP:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateSourceRanges check that the source ranges of a service, from either
+// spec.loadBalancerSourceRanges or the equivalent annotation, are valid and
+// actually enforced for the given load balancer implementation.
+func validateSourceRanges(svc *v1.Service, lbType string) error {
+	ranges, err := servicehelpers.GetLoadBalancerSourceRanges(svc)
+	if err != nil {
+		return err
+	}
+	if servicehelpers.IsAllowAll(ranges) {
+		return nil
+	}
+	if !sourceRangesEnforced(lbType) {
+		return fmt.Errorf("source ranges %v cannot be enforced by load balancer implementation %s", ranges.StringSlice(), lbType)
+	}
+	return nil
 }
 
 func serviceRep(svc *v1.Service) string {
@@ -417,13 +834,28 @@ func serviceRep(svc *v1.Service) string {
 	return fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
 }
 
+// serviceTag the tag of the reservation of a service by the hash of its name, which it keeps when
+// the service is recreated, e.g. to get back a kept IP
 func serviceTag(svc *v1.Service) string {
 	if svc == nil {
 		return ""
 	}
+	return fmt.Sprintf("%s=%s", tagKeyService, serviceNameHash(svc))
+}
+
+// serviceUIDTag the tag of the reservation of a service by its UID, empty if it has none
+func serviceUIDTag(svc *v1.Service) string {
+	if svc == nil || svc.UID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s=%s", tagKeyService, svc.UID)
+}
+
+func serviceNameHash(svc *v1.Service) string {
 	hash := sha256.Sum256([]byte(serviceRep(svc)))
-	return fmt.Sprintf("service=%s", base64.StdEncoding.EncodeToString(hash[:]))
+	return base64.StdEncoding.EncodeToString(hash[:])
 }
+
 func clusterTag(clusterID string) string {
-	return fmt.Sprintf("cluster=%s", clusterID)
+	return fmt.Sprintf("%s=%s", tagKeyCluster, clusterID)
 }
@@ -18,3 +18,9 @@ type LB interface {
 	// SyncServices ensure that the list of services is only those with the matched IPs
 	SyncServices(ctx context.Context, ips map[string]bool) error
 }
+
+// PoolLB a load balancer whose services can share named address pools, e.g. one per team
+type PoolLB interface {
+	// AddServiceToPool add a service with the provided name and IP to the named address pool
+	AddServiceToPool(ctx context.Context, svc, ip, pool string) error
+}
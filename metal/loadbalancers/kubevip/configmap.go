@@ -0,0 +1,115 @@
+package kubevip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	// cidrPrefix, rangePrefix the prefixes of the keys of the kube-vip cloud provider configmap,
+	// followed by the namespace whose services may get IPs from the CIDRs or ranges
+	cidrPrefix  = "cidr-"
+	rangePrefix = "range-"
+	// globalNamespace the keys for all namespaces, which are left to the administrator
+	globalNamespace = "global"
+)
+
+// addCIDR add the CIDR of a service to those of its namespace
+// Returns if anything changed
+func addCIDR(data map[string]string, namespace, cidr string) bool {
+	cidrs := splitCIDRs(data[cidrPrefix+namespace])
+	for _, c := range cidrs {
+		if c == cidr {
+			return false
+		}
+	}
+	setNamespaceCIDRs(data, namespace, append(cidrs, cidr))
+	return true
+}
+
+// removeCIDR remove a CIDR from every namespace that has it
+// Returns if anything changed
+func removeCIDR(data map[string]string, cidr string) bool {
+	return filterCIDRs(data, func(c string) bool { return c != cidr })
+}
+
+// syncCIDRs remove the CIDRs that are not in the valid ones from every namespace
+// Returns if anything changed
+func syncCIDRs(data map[string]string, valid map[string]bool) bool {
+	return filterCIDRs(data, func(c string) bool { return valid[c] })
+}
+
+// filterCIDRs keep the CIDRs of each namespace, other than global, for which keep returns true
+func filterCIDRs(data map[string]string, keep func(string) bool) bool {
+	var changed bool
+	for key, value := range data {
+		if !strings.HasPrefix(key, cidrPrefix) {
+			continue
+		}
+		namespace := strings.TrimPrefix(key, cidrPrefix)
+		if namespace == globalNamespace {
+			continue
+		}
+		cidrs := splitCIDRs(value)
+		kept := make([]string, 0, len(cidrs))
+		for _, c := range cidrs {
+			if keep(c) {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) != len(cidrs) {
+			setNamespaceCIDRs(data, namespace, kept)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// setNamespaceCIDRs set the CIDRs of a namespace, sorted, and the equivalent ranges, for the
+// versions of kube-vip that read those; without any CIDRs, remove both keys of the namespace
+func setNamespaceCIDRs(data map[string]string, namespace string, cidrs []string) {
+	if len(cidrs) == 0 {
+		delete(data, cidrPrefix+namespace)
+		delete(data, rangePrefix+namespace)
+		return
+	}
+	sort.Strings(cidrs)
+	ranges := make([]string, 0, len(cidrs))
+	for _, c := range cidrs {
+		r, err := cidrRange(c)
+		if err != nil {
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	data[cidrPrefix+namespace] = strings.Join(cidrs, ",")
+	data[rangePrefix+namespace] = strings.Join(ranges, ",")
+}
+
+// cidrRange the range of addresses of a CIDR, as <first>-<last>, e.g. 147.75.100.0-147.75.100.3 for 147.75.100.0/30
+func cidrRange(cidr string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+	// the IP of an IPv4 network has as many bytes as its mask
+	first := ipNet.IP
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^ipNet.Mask[i]
+	}
+	return fmt.Sprintf("%s-%s", first, last), nil
+}
+
+// splitCIDRs the CIDRs of a comma-separated list, without empty ones
+func splitCIDRs(value string) []string {
+	var cidrs []string
+	for _, c := range strings.Split(value, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			cidrs = append(cidrs, c)
+		}
+	}
+	return cidrs
+}
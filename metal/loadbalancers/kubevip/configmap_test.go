@@ -0,0 +1,77 @@
+package kubevip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddCIDR(t *testing.T) {
+	tests := []struct {
+		data      map[string]string
+		namespace string
+		cidr      string
+		changed   bool
+		expected  map[string]string
+	}{
+		{map[string]string{}, "default", "147.75.100.2/32", true, map[string]string{"cidr-default": "147.75.100.2/32", "range-default": "147.75.100.2-147.75.100.2"}},
+		{map[string]string{"cidr-default": "147.75.100.2/32"}, "default", "147.75.100.0/30", true, map[string]string{"cidr-default": "147.75.100.0/30,147.75.100.2/32", "range-default": "147.75.100.0-147.75.100.3,147.75.100.2-147.75.100.2"}},
+		{map[string]string{"cidr-default": "147.75.100.2/32"}, "default", "147.75.100.2/32", false, map[string]string{"cidr-default": "147.75.100.2/32"}},
+		// the global keys are left alone
+		{map[string]string{"cidr-global": "10.0.0.0/24"}, "team-a", "2604:1380::/127", true, map[string]string{"cidr-global": "10.0.0.0/24", "cidr-team-a": "2604:1380::/127", "range-team-a": "2604:1380::-2604:1380::1"}},
+	}
+	for i, tt := range tests {
+		changed := addCIDR(tt.data, tt.namespace, tt.cidr)
+		if changed != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, tt.changed)
+		}
+		if !reflect.DeepEqual(tt.data, tt.expected) {
+			t.Errorf("%d: mismatched data, actual %v expected %v", i, tt.data, tt.expected)
+		}
+	}
+}
+
+func TestRemoveCIDR(t *testing.T) {
+	tests := []struct {
+		data     map[string]string
+		cidr     string
+		changed  bool
+		expected map[string]string
+	}{
+		{map[string]string{"cidr-default": "147.75.100.2/32,147.75.100.3/32"}, "147.75.100.2/32", true, map[string]string{"cidr-default": "147.75.100.3/32", "range-default": "147.75.100.3-147.75.100.3"}},
+		{map[string]string{"cidr-default": "147.75.100.2/32", "range-default": "147.75.100.2-147.75.100.2"}, "147.75.100.2/32", true, map[string]string{}},
+		{map[string]string{"cidr-default": "147.75.100.2/32"}, "147.75.100.9/32", false, map[string]string{"cidr-default": "147.75.100.2/32"}},
+		{map[string]string{"cidr-global": "147.75.100.2/32"}, "147.75.100.2/32", false, map[string]string{"cidr-global": "147.75.100.2/32"}},
+	}
+	for i, tt := range tests {
+		changed := removeCIDR(tt.data, tt.cidr)
+		if changed != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, tt.changed)
+		}
+		if !reflect.DeepEqual(tt.data, tt.expected) {
+			t.Errorf("%d: mismatched data, actual %v expected %v", i, tt.data, tt.expected)
+		}
+	}
+}
+
+func TestSyncCIDRs(t *testing.T) {
+	data := map[string]string{
+		"cidr-default": "147.75.100.2/32,147.75.100.3/32",
+		"cidr-team-a":  "147.75.100.4/32",
+		"cidr-global":  "10.0.0.0/24",
+	}
+	valid := map[string]bool{"147.75.100.3/32": true}
+	if !syncCIDRs(data, valid) {
+		t.Errorf("expected changes")
+	}
+	expected := map[string]string{
+		"cidr-default":  "147.75.100.3/32",
+		"range-default": "147.75.100.3-147.75.100.3",
+		"cidr-global":   "10.0.0.0/24",
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("mismatched data, actual %v expected %v", data, expected)
+	}
+	if syncCIDRs(data, valid) {
+		t.Errorf("unexpected changes on second sync")
+	}
+}
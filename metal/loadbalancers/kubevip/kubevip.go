@@ -1,30 +1,78 @@
-// kubevip loadbalancer that does nothing, but exists to enable bgp functionality
+// kubevip loadbalancer that enables bgp functionality, and optionally maintains the configmap of
+// the kube-vip cloud provider, so that it allocates service IPs from those the CCM reserved
 package kubevip
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultNamespace = "kube-system"
+	defaultName      = "kubevip"
 )
 
 type LB struct {
+	// configMapInterface nil unless the configmap of the kube-vip cloud provider is maintained
+	configMapInterface typedv1.ConfigMapInterface
+	configMapNamespace string
+	configMapName      string
 }
 
+// NewLB a kube-vip load balancer; with an empty config, it does nothing, otherwise it maintains
+// the configmap <namespace>/<name> of the config, by default kube-system/kubevip
 func NewLB(k8sclient kubernetes.Interface, config string) *LB {
-	return &LB{}
+	if config == "" {
+		return &LB{}
+	}
+	var configmapnamespace, configmapname string
+	// it may have an extra slash at the beginning or end, so get rid of it
+	config = strings.TrimSuffix(strings.TrimPrefix(config, "/"), "/")
+	cmparts := strings.SplitN(config, "/", 2)
+	if len(cmparts) >= 2 {
+		configmapnamespace, configmapname = cmparts[0], cmparts[1]
+	}
+	// defaults
+	if configmapname == "" {
+		configmapname = defaultName
+	}
+	if configmapnamespace == "" {
+		configmapnamespace = defaultNamespace
+	}
+	return &LB{
+		configMapInterface: k8sclient.CoreV1().ConfigMaps(configmapnamespace),
+		configMapNamespace: configmapnamespace,
+		configMapName:      configmapname,
+	}
 }
 
+// AddService add the IP of the service, named <namespace>/<name>, to the CIDRs of its namespace
 func (l *LB) AddService(ctx context.Context, svc, ip string) error {
-	return nil
+	namespace := strings.SplitN(svc, "/", 2)[0]
+	return l.updateConfigMap(ctx, func(data map[string]string) bool {
+		return addCIDR(data, namespace, ip)
+	})
 }
 
 func (l *LB) RemoveService(ctx context.Context, ip string) error {
-	return nil
+	return l.updateConfigMap(ctx, func(data map[string]string) bool {
+		return removeCIDR(data, ip)
+	})
 }
 
 func (l *LB) SyncServices(ctx context.Context, ips map[string]bool) error {
-	return nil
+	return l.updateConfigMap(ctx, func(data map[string]string) bool {
+		return syncCIDRs(data, ips)
+	})
 }
 
 // AddNode add a node with the provided name, srcIP, and bgp information
@@ -41,3 +89,41 @@ func (l *LB) RemoveNode(ctx context.Context, nodeName string) error {
 func (l *LB) SyncNodes(ctx context.Context, nodes map[string]loadbalancers.Node) error {
 	return nil
 }
+
+// updateConfigMap apply update to the data of the configmap, creating it if it does not exist,
+// and save it, if update returns that it changed anything
+func (l *LB) updateConfigMap(ctx context.Context, update func(map[string]string) bool) error {
+	if l.configMapInterface == nil {
+		return nil
+	}
+	cm, err := l.configMapInterface.Get(ctx, l.configMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: l.configMapName, Namespace: l.configMapNamespace},
+			Data:       map[string]string{},
+		}
+		if !update(cm.Data) {
+			return nil
+		}
+		klog.V(2).Infof("kube-vip configmap %s/%s did not exist, creating", l.configMapNamespace, l.configMapName)
+		if _, err := l.configMapInterface.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("unable to create kube-vip config map %s/%s: %w", l.configMapNamespace, l.configMapName, err)
+		}
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to retrieve kube-vip config map %s/%s: %w", l.configMapNamespace, l.configMapName, err)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	if !update(cm.Data) {
+		klog.V(5).Infof("kube-vip configmap %s/%s unchanged", l.configMapNamespace, l.configMapName)
+		return nil
+	}
+	if _, err := l.configMapInterface.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("unable to update kube-vip config map %s/%s: %w", l.configMapNamespace, l.configMapName, err)
+	}
+	klog.V(2).Infof("updated kube-vip configmap %s/%s", l.configMapNamespace, l.configMapName)
+	return nil
+}
@@ -0,0 +1,45 @@
+package kubevip
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLBConfigMap(t *testing.T) {
+	ctx := context.Background()
+
+	// without a configmap, nothing is maintained
+	client := fake.NewSimpleClientset()
+	if err := NewLB(client, "").AddService(ctx, "default/web", "147.75.100.2/32"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("unexpected actions without configmap: %v", client.Actions())
+	}
+
+	lb := NewLB(client, "/")
+	if err := lb.AddService(ctx, "default/web", "147.75.100.2/32"); err != nil {
+		t.Fatalf("unexpected error adding: %v", err)
+	}
+	cm, err := client.CoreV1().ConfigMaps(defaultNamespace).Get(ctx, defaultName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("configmap not created: %v", err)
+	}
+	if cidrs := cm.Data["cidr-default"]; cidrs != "147.75.100.2/32" {
+		t.Errorf("mismatched cidrs, actual %q expected 147.75.100.2/32", cidrs)
+	}
+
+	if err := lb.SyncServices(ctx, map[string]bool{}); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	cm, err = client.CoreV1().ConfigMaps(defaultNamespace).Get(ctx, defaultName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting configmap: %v", err)
+	}
+	if len(cm.Data) != 0 {
+		t.Errorf("mismatched data after sync, actual %v expected none", cm.Data)
+	}
+}
@@ -88,6 +88,43 @@ func (cfg *ConfigFile) RemovePeerBySelector(remove *NodeSelector) bool {
 	return len(cfg.Peers) != originalCount
 }
 
+// ReplacePeersBySelector make the peers that match a selector exactly the given peers,
+// e.g. when the password of a node changed. If they already are, do not change anything.
+// Returns if anything changed.
+func (cfg *ConfigFile) ReplacePeersBySelector(selector *NodeSelector, replace []Peer) bool {
+	if selector == nil {
+		return false
+	}
+	current := make([]Peer, 0)
+	for _, peer := range cfg.Peers {
+		if peer.MatchSelector(selector) {
+			current = append(current, peer)
+		}
+	}
+	if len(current) == len(replace) {
+		same := true
+		for i := range replace {
+			var found bool
+			for _, peer := range current {
+				if peer.Equal(&replace[i]) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				same = false
+				break
+			}
+		}
+		if same {
+			return false
+		}
+	}
+	cfg.RemovePeerBySelector(selector)
+	cfg.Peers = append(cfg.Peers, replace...)
+	return true
+}
+
 // AddAddressPool adds an address pool. If a matching pool already exists, do not change anything.
 // Returns if anything changed
 func (cfg *ConfigFile) AddAddressPool(add *AddressPool) bool {
@@ -150,6 +187,77 @@ func (cfg *ConfigFile) RemoveAddressPoolByAddress(addr string) {
 	cfg.Pools = pools
 }
 
+// AddAddressToPool add an address to the pool with the given name, creating the pool if it does not exist,
+// and remove it from any other pool, so that the services of a team can share a pool. If the address already
+// is in that pool alone, do not change anything.
+// Returns if anything changed
+func (cfg *ConfigFile) AddAddressToPool(name, addr string) bool {
+	if name == "" || addr == "" {
+		return false
+	}
+	var inPool, inOthers bool
+	for _, pool := range cfg.Pools {
+		for _, ipaddr := range pool.Addresses {
+			if ipaddr != addr {
+				continue
+			}
+			if pool.Name == name {
+				inPool = true
+			} else {
+				inOthers = true
+			}
+		}
+	}
+	if inPool && !inOthers {
+		return false
+	}
+	cfg.RemoveAddress(addr)
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Name == name {
+			cfg.Pools[i].Addresses = append(cfg.Pools[i].Addresses, addr)
+			return true
+		}
+	}
+	autoAssign := false
+	cfg.Pools = append(cfg.Pools, AddressPool{
+		Protocol:   "bgp",
+		Name:       name,
+		Addresses:  []string{addr},
+		AutoAssign: &autoAssign,
+	})
+	return true
+}
+
+// RemoveAddress remove an address from the pools that have it, and any pool left without addresses,
+// leaving the other addresses of a shared pool. If no pool has the address, do not change anything.
+// Returns if anything changed
+func (cfg *ConfigFile) RemoveAddress(addr string) bool {
+	if addr == "" {
+		return false
+	}
+	var changed bool
+	pools := make([]AddressPool, 0)
+	for _, pool := range cfg.Pools {
+		addrs := make([]string, 0)
+		for _, ipaddr := range pool.Addresses {
+			if ipaddr != addr {
+				addrs = append(addrs, ipaddr)
+			}
+		}
+		if len(addrs) == len(pool.Addresses) {
+			pools = append(pools, pool)
+			continue
+		}
+		changed = true
+		if len(addrs) > 0 {
+			pool.Addresses = addrs
+			pools = append(pools, pool)
+		}
+	}
+	cfg.Pools = pools
+	return changed
+}
+
 type NodeSelectors []NodeSelector
 
 func (n NodeSelectors) Len() int {
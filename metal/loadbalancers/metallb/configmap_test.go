@@ -1,6 +1,7 @@
 package metallb
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -90,6 +91,42 @@ func TestConfigFileRemovePeerBySelector(t *testing.T) {
 	}
 }
 
+func TestConfigFileReplacePeersBySelector(t *testing.T) {
+	peers := []Peer{
+		genPeer(),
+		genPeer(),
+	}
+	rotated := peers[0].Duplicate()
+	rotated.Password = genRandomString(10)
+
+	tests := []struct {
+		selector NodeSelector
+		replace  []Peer
+		changed  bool
+		total    int
+		message  string
+	}{
+		{peers[0].NodeSelectors[0], []Peer{peers[0].Duplicate()}, false, len(peers), "same peer"},
+		{peers[0].NodeSelectors[0], []Peer{rotated}, true, len(peers), "changed password"},
+		{peers[0].NodeSelectors[0], []Peer{}, true, len(peers) - 1, "no peers"},
+		{genNodeSelector(), []Peer{genPeer()}, true, len(peers) + 1, "new node"},
+	}
+
+	for i, tt := range tests {
+		// get a clean set of peers
+		cfg := ConfigFile{
+			Peers: append([]Peer{}, peers...),
+		}
+		changed := cfg.ReplacePeersBySelector(&tt.selector, tt.replace)
+		if changed != tt.changed {
+			t.Errorf("%d: mismatched changed actual %t vs expected %t: %s", i, changed, tt.changed, tt.message)
+		}
+		if len(cfg.Peers) != tt.total {
+			t.Errorf("%d: mismatch actual %d vs expected %d: %s", i, len(cfg.Peers), tt.total, tt.message)
+		}
+	}
+}
+
 func TestConfigFileAddAddressPool(t *testing.T) {
 	// NOTE: this leverages AddressPool.Equal(), which we test below,
 	// so no need to test the various forms of equality, just that it does the
@@ -177,6 +214,68 @@ func TestConfigFileRemoveAddressPoolByAddress(t *testing.T) {
 	}
 }
 
+func TestConfigFileAddAddressToPool(t *testing.T) {
+	tests := []struct {
+		pools    []AddressPool
+		pool     string
+		addr     string
+		changed  bool
+		expected map[string][]string
+	}{
+		{nil, "team-a", "10.0.0.1/32", true, map[string][]string{"team-a": {"10.0.0.1/32"}}},
+		{[]AddressPool{{Name: "team-a", Addresses: []string{"10.0.0.1/32"}}}, "team-a", "10.0.0.2/32", true, map[string][]string{"team-a": {"10.0.0.1/32", "10.0.0.2/32"}}},
+		{[]AddressPool{{Name: "team-a", Addresses: []string{"10.0.0.1/32"}}}, "team-a", "10.0.0.1/32", false, map[string][]string{"team-a": {"10.0.0.1/32"}}},
+		// moved from the pool of its own, which is left empty
+		{[]AddressPool{{Name: "default/web", Addresses: []string{"10.0.0.1/32"}}}, "team-a", "10.0.0.1/32", true, map[string][]string{"team-a": {"10.0.0.1/32"}}},
+		// moved from another shared pool, which keeps its other addresses
+		{[]AddressPool{{Name: "team-b", Addresses: []string{"10.0.0.1/32", "10.0.0.2/32"}}}, "team-a", "10.0.0.1/32", true, map[string][]string{"team-a": {"10.0.0.1/32"}, "team-b": {"10.0.0.2/32"}}},
+		{nil, "", "10.0.0.1/32", false, map[string][]string{}},
+	}
+
+	for i, tt := range tests {
+		cfg := ConfigFile{Pools: tt.pools}
+		changed := cfg.AddAddressToPool(tt.pool, tt.addr)
+		if changed != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, tt.changed)
+		}
+		actual := map[string][]string{}
+		for _, pool := range cfg.Pools {
+			actual[pool.Name] = pool.Addresses
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("%d: mismatched pools, actual %v expected %v", i, actual, tt.expected)
+		}
+	}
+}
+
+func TestConfigFileRemoveAddress(t *testing.T) {
+	tests := []struct {
+		pools    []AddressPool
+		addr     string
+		changed  bool
+		expected map[string][]string
+	}{
+		{[]AddressPool{{Name: "team-a", Addresses: []string{"10.0.0.1/32", "10.0.0.2/32"}}}, "10.0.0.1/32", true, map[string][]string{"team-a": {"10.0.0.2/32"}}},
+		{[]AddressPool{{Name: "team-a", Addresses: []string{"10.0.0.1/32"}}}, "10.0.0.1/32", true, map[string][]string{}},
+		{[]AddressPool{{Name: "team-a", Addresses: []string{"10.0.0.1/32"}}}, "10.0.0.3/32", false, map[string][]string{"team-a": {"10.0.0.1/32"}}},
+	}
+
+	for i, tt := range tests {
+		cfg := ConfigFile{Pools: tt.pools}
+		changed := cfg.RemoveAddress(tt.addr)
+		if changed != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, tt.changed)
+		}
+		actual := map[string][]string{}
+		for _, pool := range cfg.Pools {
+			actual[pool.Name] = pool.Addresses
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("%d: mismatched pools, actual %v expected %v", i, actual, tt.expected)
+		}
+	}
+}
+
 func TestNodeSelectorsLen(t *testing.T) {
 	sl := []NodeSelector{
 		genNodeSelector(),
@@ -63,7 +63,18 @@ func (l *LB) AddService(ctx context.Context, svc, ip string) error {
 	}
 
 	// Update the service and configmap and save them
-	return mapIP(ctx, config, ip, svc, l.configMapName, l.configMapInterface)
+	return mapIP(ctx, config, ip, svc, "", l.configMapName, l.configMapInterface)
+}
+
+// AddServiceToPool add a service with the provided name and IP to the address pool with the given
+// name, which the services of e.g. a team share, rather than to a pool of its own
+func (l *LB) AddServiceToPool(ctx context.Context, svc, ip, pool string) error {
+	config, err := l.getConfigMap(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
+	}
+
+	return mapIP(ctx, config, ip, svc, pool, l.configMapName, l.configMapInterface)
 }
 
 func (l *LB) RemoveService(ctx context.Context, ip string) error {
@@ -102,20 +113,9 @@ func (l *LB) AddNode(ctx context.Context, nodeName string, localASN, peerASN int
 		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
 	}
 
-	ns := NodeSelector{
-		MatchLabels: map[string]string{
-			hostnameKey: nodeName,
-		},
-	}
 	var changed bool
-	for _, peer := range peers {
-		p := Peer{
-			MyASN:         uint32(localASN),
-			ASN:           uint32(peerASN),
-			Password:      password,
-			Addr:          peer,
-			NodeSelectors: []NodeSelector{ns},
-		}
+	for _, p := range nodePeers(nodeName, localASN, peerASN, password, peers...) {
+		p := p
 		if config.AddPeer(&p) {
 			changed = true
 		}
@@ -148,42 +148,63 @@ func (l *LB) RemoveNode(ctx context.Context, nodeName string) error {
 	return nil
 }
 
-// SyncNodes ensure that the list of nodes is only those with the matched names
+// SyncNodes ensure that the list of nodes is only those with the matched names,
+// each with exactly its current bgp information. All of the changes are saved
+// at once, so that a changed password, e.g. after the project BGP password is
+// rotated, reaches the peers of every node at the same time.
 func (l *LB) SyncNodes(ctx context.Context, nodes map[string]loadbalancers.Node) error {
 	config, err := l.getConfigMap(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
 	}
 
+	var changed bool
 	// first remove every node from the configmap that is not in the provided nodes
-	configNodes := getNodes(config)
-	for _, node := range configNodes {
+	for _, node := range getNodes(config) {
 		if _, ok := nodes[node]; !ok {
 			klog.V(2).Infof("metallb.SyncNodes(): removing node from configmap: %s", node)
-			if err := l.RemoveNode(ctx, node); err != nil {
-				klog.V(2).Infof("metallb.SyncNodes(): error removing node %s: %v", node, err)
-				continue
+			if config.RemovePeerBySelector(nodeSelector(node)) {
+				changed = true
 			}
 		}
 	}
-	// now see if any nodes are missing
-	// get the list of nodes afresh
-	configNodes = getNodes(config)
-	configMap := map[string]bool{}
-	for _, node := range configNodes {
-		configMap[node] = true
-	}
+	// now make sure every node has exactly its peers, adding missing nodes and updating changed ones
 	for _, node := range nodes {
-		if _, ok := configMap[node.Name]; !ok {
-			if err := l.AddNode(ctx, node.Name, node.LocalASN, node.PeerASN, node.Password, node.SourceIP, node.Peers...); err != nil {
-				klog.V(2).Infof("loadbalancers.reconcileNodes(): error adding node %s: %v", node.Name, err)
-				continue
-			}
+		if config.ReplacePeersBySelector(nodeSelector(node.Name), nodePeers(node.Name, node.LocalASN, node.PeerASN, node.Password, node.Peers...)) {
+			klog.V(2).Infof("metallb.SyncNodes(): updating peers for node in configmap: %s", node.Name)
+			changed = true
 		}
 	}
+	if changed {
+		return saveUpdatedConfigMap(ctx, l.configMapInterface, l.configMapName, config)
+	}
 	return nil
 }
 
+// nodeSelector the selector for the peers of a node
+func nodeSelector(nodeName string) *NodeSelector {
+	return &NodeSelector{
+		MatchLabels: map[string]string{
+			hostnameKey: nodeName,
+		},
+	}
+}
+
+// nodePeers the peers for a node with the provided name and bgp information
+func nodePeers(nodeName string, localASN, peerASN int, password string, peers ...string) []Peer {
+	ret := make([]Peer, 0, len(peers))
+	for _, peer := range peers {
+		ret = append(ret, Peer{
+			MyASN:         uint32(localASN),
+			ASN:           uint32(peerASN),
+			Password:      password,
+			Addr:          peer,
+			NodeSelectors: []NodeSelector{*nodeSelector(nodeName)},
+		})
+	}
+	return ret
+}
+
 func (l *LB) getConfigMap(ctx context.Context) (*ConfigFile, error) {
 	cm, err := l.configMapInterface.Get(ctx, l.configMapName, metav1.GetOptions{})
 	if err != nil {
@@ -194,25 +215,32 @@ func (l *LB) getConfigMap(ctx context.Context) (*ConfigFile, error) {
 	return ParseConfig([]byte(configData))
 }
 
-// mapIP add a given ip address to the metallb configmap
-func mapIP(ctx context.Context, config *ConfigFile, addr, svcName, configmapname string, cmInterface typedv1.ConfigMapInterface) error {
+// mapIP add a given ip address to the metallb configmap, in a pool of the service's own, or in the
+// given shared pool, if any
+func mapIP(ctx context.Context, config *ConfigFile, addr, svcName, pool, configmapname string, cmInterface typedv1.ConfigMapInterface) error {
 	klog.V(2).Infof("mapping IP %s", addr)
-	return updateMapIP(ctx, config, addr, svcName, configmapname, cmInterface, true)
+	return updateMapIP(ctx, config, addr, svcName, pool, configmapname, cmInterface, true)
 }
 
 // unmapIP remove a given IP address from the metalllb config map
 func unmapIP(ctx context.Context, config *ConfigFile, addr, configmapname string, cmInterface typedv1.ConfigMapInterface) error {
 	klog.V(2).Infof("unmapping IP %s", addr)
-	return updateMapIP(ctx, config, addr, "", configmapname, cmInterface, false)
+	return updateMapIP(ctx, config, addr, "", "", configmapname, cmInterface, false)
 }
 
-func updateMapIP(ctx context.Context, config *ConfigFile, addr, svcName, configmapname string, cmInterface typedv1.ConfigMapInterface, add bool) error {
+func updateMapIP(ctx context.Context, config *ConfigFile, addr, svcName, pool, configmapname string, cmInterface typedv1.ConfigMapInterface, add bool) error {
 	if config == nil {
 		klog.V(2).Info("config unchanged, not updating")
 		return nil
 	}
 	// update the configmap and save it
-	if add {
+	switch {
+	case add && pool != "":
+		if !config.AddAddressToPool(pool, addr) {
+			klog.V(2).Infof("address already in pool %s on ConfigMap, unchanged", pool)
+			return nil
+		}
+	case add:
 		autoAssign := false
 		if !config.AddAddressPool(&AddressPool{
 			Protocol:   "bgp",
@@ -223,8 +251,12 @@ func updateMapIP(ctx context.Context, config *ConfigFile, addr, svcName, configm
 			klog.V(2).Info("address already on ConfigMap, unchanged")
 			return nil
 		}
-	} else {
-		config.RemoveAddressPoolByAddress(addr)
+	default:
+		// only the address, since a shared pool may have the addresses of other services
+		if !config.RemoveAddress(addr) {
+			klog.V(2).Info("address not on ConfigMap, unchanged")
+			return nil
+		}
 	}
 	klog.V(2).Info("config changed, updating")
 	if err := saveUpdatedConfigMap(ctx, cmInterface, configmapname, config); err != nil {
@@ -0,0 +1,106 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// conditionIPAllocated whether the service has an Elastic IP
+	conditionIPAllocated = "metal.equinix.com/IPAllocated"
+	// conditionAnnouncementReady whether the load balancer implementation announces the Elastic IP of the service
+	conditionAnnouncementReady = "metal.equinix.com/AnnouncementReady"
+
+	conditionReasonAllocated         = "Allocated"
+	conditionReasonPending           = "Pending"
+	conditionReasonRequestFailed     = "RequestFailed"
+	conditionReasonAnnounced         = "Announced"
+	conditionReasonAnnouncementError = "AnnouncementFailed"
+)
+
+// serviceCondition a condition in the status of a service; kept apart from the service,
+// whose type in this version of the kubernetes API does not have conditions yet
+type serviceCondition struct {
+	status  metav1.ConditionStatus
+	reason  string
+	message string
+	// since when the condition has had its status
+	since time.Time
+}
+
+// setServiceCondition set a condition in the status of a service, with a strategic merge
+// patch, so that conditions set by others are kept. It only writes when the condition
+// changed since this CCM last set it. Status conditions need kubernetes 1.20; failures to
+// set them are only logged, as they are informational.
+func (l *loadBalancers) setServiceCondition(ctx context.Context, svc *v1.Service, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	svcName := serviceRep(svc)
+	now := clockNow(l.clock)
+
+	l.conditionsLock.Lock()
+	conditions := l.conditions[svcName]
+	if conditions == nil {
+		conditions = map[string]serviceCondition{}
+		l.conditions[svcName] = conditions
+	}
+	last, ok := conditions[conditionType]
+	if ok && last.status == status && last.reason == reason && last.message == message {
+		l.conditionsLock.Unlock()
+		return
+	}
+	since := now
+	if ok && last.status == status {
+		since = last.since
+	}
+	conditions[conditionType] = serviceCondition{status: status, reason: reason, message: message, since: since}
+	l.conditionsLock.Unlock()
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []metav1.Condition{{
+				Type:               conditionType,
+				Status:             status,
+				ObservedGeneration: svc.Generation,
+				LastTransitionTime: metav1.NewTime(since),
+				Reason:             reason,
+				Message:            message,
+			}},
+		},
+	})
+	if err != nil {
+		klog.Errorf("unable to encode condition %s of service %s: %v", conditionType, svcName, err)
+		return
+	}
+	if _, err := l.k8sclient.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+		klog.V(2).Infof("unable to set condition %s of service %s: %v", conditionType, svcName, err)
+		// try again next time
+		l.conditionsLock.Lock()
+		delete(l.conditions[svcName], conditionType)
+		l.conditionsLock.Unlock()
+	}
+}
+
+// setServiceIPAllocated set the IPAllocated condition of a service from the result of allocating it an IP
+func (l *loadBalancers) setServiceIPAllocated(ctx context.Context, svc *v1.Service, ip, reason string, err error) {
+	switch {
+	case err != nil:
+		l.setServiceCondition(ctx, svc, conditionIPAllocated, metav1.ConditionFalse, reason, err.Error())
+	case ip == "":
+		l.setServiceCondition(ctx, svc, conditionIPAllocated, metav1.ConditionFalse, conditionReasonPending, "waiting for an Elastic IP to be allocated")
+	default:
+		l.setServiceCondition(ctx, svc, conditionIPAllocated, metav1.ConditionTrue, conditionReasonAllocated, fmt.Sprintf("Elastic IP %s", ip))
+	}
+}
+
+// forgetServiceConditions forget the conditions set on a removed service
+func (l *loadBalancers) forgetServiceConditions(svc *v1.Service) {
+	l.conditionsLock.Lock()
+	defer l.conditionsLock.Unlock()
+	delete(l.conditions, serviceRep(svc))
+}
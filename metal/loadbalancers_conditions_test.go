@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSetServiceCondition(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Generation: 3}}
+	client := fake.NewSimpleClientset(svc)
+	l := newLoadBalancers(Config{ProjectID: projectID}, nil, nil, nil)
+	l.k8sclient = client
+
+	// the conditions patched into the status, oldest first
+	patched := func() []metav1.Condition {
+		var conditions []metav1.Condition
+		for _, action := range client.Actions() {
+			patch, ok := action.(k8stesting.PatchAction)
+			if !ok || patch.GetSubresource() != "status" {
+				continue
+			}
+			var body struct {
+				Status struct {
+					Conditions []metav1.Condition `json:"conditions"`
+				} `json:"status"`
+			}
+			if err := json.Unmarshal(patch.GetPatch(), &body); err != nil {
+				t.Fatalf("invalid patch %s: %v", patch.GetPatch(), err)
+			}
+			conditions = append(conditions, body.Status.Conditions...)
+		}
+		return conditions
+	}
+
+	l.setServiceIPAllocated(ctx, svc, "", eventReasonNoIPCapacity, errors.New("no capacity in ewr1"))
+	// unchanged, so not written again
+	l.setServiceIPAllocated(ctx, svc, "", eventReasonNoIPCapacity, errors.New("no capacity in ewr1"))
+	l.setServiceIPAllocated(ctx, svc, "147.75.100.2", "", nil)
+	l.setServiceCondition(ctx, svc, conditionAnnouncementReady, metav1.ConditionTrue, conditionReasonAnnounced, "announced")
+
+	conditions := patched()
+	if len(conditions) != 3 {
+		t.Fatalf("mismatched number of conditions written, actual %d expected 3: %v", len(conditions), conditions)
+	}
+	expected := []struct {
+		conditionType string
+		status        metav1.ConditionStatus
+		reason        string
+	}{
+		{conditionIPAllocated, metav1.ConditionFalse, eventReasonNoIPCapacity},
+		{conditionIPAllocated, metav1.ConditionTrue, conditionReasonAllocated},
+		{conditionAnnouncementReady, metav1.ConditionTrue, conditionReasonAnnounced},
+	}
+	for i, e := range expected {
+		c := conditions[i]
+		if c.Type != e.conditionType || c.Status != e.status || c.Reason != e.reason || c.ObservedGeneration != 3 || c.LastTransitionTime.IsZero() {
+			t.Errorf("%d: mismatched condition, actual %+v expected %s %s %s", i, c, e.conditionType, e.status, e.reason)
+		}
+	}
+
+	// once removed, the conditions are written again for a new service of the same name
+	l.forgetServiceConditions(svc)
+	client.ClearActions()
+	l.setServiceIPAllocated(ctx, svc, "147.75.100.2", "", nil)
+	if conditions := patched(); len(conditions) != 1 {
+		t.Errorf("mismatched conditions after forgetting, actual %v expected 1", conditions)
+	}
+}
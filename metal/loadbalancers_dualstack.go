@@ -0,0 +1,54 @@
+package metal
+
+import (
+	"net"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+// A dual-stack service, one with both IPv4 and IPv6 in spec.ipFamilies, gets an IPv6 Elastic IP as
+// well as its IPv4 one, which remains its spec.loadBalancerIP. The IPv6 one is a reservation of the
+// service like any other, told apart by its address, announced like the additional IPs of a service,
+// and never kept once the service is deleted. Both are set in the ingress of the status of the service.
+
+// reservationFamily the IP family of the address of a reservation
+func reservationFamily(ip *packngo.IPAddressReservation) v1.IPFamily {
+	if parsed := net.ParseIP(ip.Address); parsed != nil && parsed.To4() == nil {
+		return v1.IPv6Protocol
+	}
+	return v1.IPv4Protocol
+}
+
+// serviceIPFamilies whether a service has the IPv4 and the IPv6 family, where one without any
+// families has the cluster default, which is IPv4 unless the cluster is IPv6 only
+func serviceIPFamilies(svc *v1.Service) (ipv4, ipv6 bool) {
+	if len(svc.Spec.IPFamilies) == 0 {
+		return true, false
+	}
+	for _, family := range svc.Spec.IPFamilies {
+		switch family {
+		case v1.IPv4Protocol:
+			ipv4 = true
+		case v1.IPv6Protocol:
+			ipv6 = true
+		}
+	}
+	return ipv4, ipv6
+}
+
+// serviceDualStack whether a service gets an IPv6 Elastic IP as well as its IPv4 one
+func serviceDualStack(svc *v1.Service) bool {
+	ipv4, ipv6 := serviceIPFamilies(svc)
+	return ipv4 && ipv6
+}
+
+// serviceIPv6Reservation the reservation of the IPv6 Elastic IP of a service, if it has one
+func (l *loadBalancers) serviceIPv6Reservation(svc *v1.Service, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
+	for _, ip := range ipReservationsByStructuredTags(l.serviceReservationTags(svc), ips) {
+		if reservationFamily(ip) == v1.IPv6Protocol {
+			return ip
+		}
+	}
+	return nil
+}
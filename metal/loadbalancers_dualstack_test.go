@@ -0,0 +1,110 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestAddServiceDualStack(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-web"},
+		Spec: v1.ServiceSpec{
+			Type:       v1.ServiceTypeLoadBalancer,
+			Ports:      []v1.ServicePort{{Port: 443, Protocol: v1.ProtocolTCP}},
+			IPFamilies: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	client := fake.NewSimpleClientset(svc)
+	lb := &testServicesLB{added: map[string]string{}}
+	allocator := &testIPAllocator{}
+	l := newLoadBalancers(Config{ProjectID: projectID}, &packngo.Client{ProjectIPs: &countingProjectIPService{}}, nil, nil)
+	l.k8sclient = client
+	l.recorder = record.NewFakeRecorder(10)
+	l.implementor = lb
+	l.ipAllocator = allocator
+
+	tests := []struct {
+		families []v1.IPFamily
+		ingress  []string
+		ips      int
+	}{
+		{[]v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}, []string{"147.75.100.1", "2604:1380:100::2"}, 2},
+		// again, nothing changes
+		{[]v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol}, []string{"147.75.100.1", "2604:1380:100::2"}, 2},
+		// single-stack again, the IPv6 one is released
+		{[]v1.IPFamily{v1.IPv4Protocol}, []string{"147.75.100.1"}, 1},
+		// IPv6 first, the IPv4 one is still the loadBalancerIP
+		{[]v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol}, []string{"147.75.100.1", "2604:1380:100::3"}, 2},
+	}
+	for i, tt := range tests {
+		current, _ := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		current.Spec.IPFamilies = tt.families
+		if _, err := client.CoreV1().Services(svc.Namespace).Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("%d: unexpected error updating service: %v", i, err)
+		}
+		ips, _ := allocator.list(ctx)
+		current, _ = client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err := l.addService(ctx, current, ips); err != nil {
+			t.Fatalf("%d: unexpected error adding service: %v", i, err)
+		}
+		current, _ = client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if current.Spec.LoadBalancerIP != "147.75.100.1" {
+			t.Errorf("%d: mismatched loadBalancerIP, actual %s expected 147.75.100.1", i, current.Spec.LoadBalancerIP)
+		}
+		var ingress []string
+		for _, in := range current.Status.LoadBalancer.Ingress {
+			ingress = append(ingress, in.IP)
+		}
+		if !reflect.DeepEqual(ingress, tt.ingress) {
+			t.Errorf("%d: mismatched ingress, actual %v expected %v", i, ingress, tt.ingress)
+		}
+		if len(allocator.ips) != tt.ips {
+			t.Errorf("%d: mismatched reservations, actual %d expected %d", i, len(allocator.ips), tt.ips)
+		}
+	}
+	if lb.added["default/web"] != "147.75.100.1/32" || lb.added["default/web-ipv6"] != "2604:1380:100::3/128" {
+		t.Errorf("mismatched announced IPs, actual %v", lb.added)
+	}
+
+	// removing the service releases the IPv6 one, too
+	current, _ := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	ips, _ := allocator.list(ctx)
+	if err := l.removeService(ctx, current, ips); err != nil {
+		t.Fatalf("unexpected error removing service: %v", err)
+	}
+	if len(allocator.ips) != 0 {
+		t.Errorf("mismatched reservations after removal, actual %v expected none", allocator.ips)
+	}
+}
+
+func TestAddServiceIPv6Only(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: v1.ServiceSpec{
+			Type:       v1.ServiceTypeLoadBalancer,
+			Ports:      []v1.ServicePort{{Port: 443}},
+			IPFamilies: []v1.IPFamily{v1.IPv6Protocol},
+		},
+	}
+	allocator := &testIPAllocator{}
+	l := newLoadBalancers(Config{ProjectID: projectID}, &packngo.Client{ProjectIPs: &countingProjectIPService{}}, nil, nil)
+	l.k8sclient = fake.NewSimpleClientset(svc)
+	l.recorder = record.NewFakeRecorder(10)
+	l.implementor = &testServicesLB{added: map[string]string{}}
+	l.ipAllocator = allocator
+	if err := l.addService(ctx, svc, nil); err == nil {
+		t.Errorf("expected error for IPv6 only service")
+	}
+	if len(allocator.ips) != 0 {
+		t.Errorf("mismatched reservations, actual %v expected none", allocator.ips)
+	}
+}
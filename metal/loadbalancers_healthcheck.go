@@ -0,0 +1,263 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	backendHealthCheckTimeout = 2 * time.Second
+	// annotationHealthCheckPath set on a service to probe its backends with an HTTP GET of the path,
+	// instead of a TCP connect; a 2xx or 3xx response is healthy
+	annotationHealthCheckPath = "metal.equinix.com/healthcheck-path"
+	// annotationHealthCheckPort set on a service to probe only one of its ports, by number or name
+	annotationHealthCheckPort = "metal.equinix.com/healthcheck-port"
+	// kubeProxyHealthCheckPath the path on the health check node port of a service with
+	// externalTrafficPolicy=Local, on which kube-proxy answers whether the node has ready endpoints
+	kubeProxyHealthCheckPath = "/healthz"
+
+	eventReasonBackendsUnhealthy = "BackendsUnhealthy"
+	eventReasonBackendsHealthy   = "BackendsHealthy"
+)
+
+// backendProbe the result of probing a single service node port on a single node
+type backendProbe struct {
+	node string
+	port int32
+	up   bool
+}
+
+// backendCheck how to probe a node as a backend of a service: a node port, and for an HTTP probe, the path
+type backendCheck struct {
+	port int32
+	path string
+}
+
+// serviceBackendChecks how to probe the nodes as backends of a service:
+//   - with the healthcheck-path annotation, an HTTP GET of the path on the node port of each TCP port,
+//     or only of the one in the healthcheck-port annotation
+//   - else, with externalTrafficPolicy=Local, an HTTP GET of the kube-proxy health check, which
+//     only succeeds on nodes with ready endpoints of the service, as those without drop the traffic
+//   - else, a TCP connect to the node port of each TCP port
+func serviceBackendChecks(svc *v1.Service) ([]backendCheck, error) {
+	path, portSetting := svc.Annotations[annotationHealthCheckPath], svc.Annotations[annotationHealthCheckPort]
+	if path == "" && svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && svc.Spec.HealthCheckNodePort != 0 {
+		return []backendCheck{{port: svc.Spec.HealthCheckNodePort, path: kubeProxyHealthCheckPath}}, nil
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid annotation %s=%q, must start with /", annotationHealthCheckPath, path)
+	}
+	var checks []backendCheck
+	for _, port := range svc.Spec.Ports {
+		if portSetting != "" && portSetting != port.Name && portSetting != strconv.Itoa(int(port.Port)) {
+			continue
+		}
+		// only TCP can be probed with a simple connect, or HTTP
+		if port.NodePort == 0 || servicePortProtocol(port) != v1.ProtocolTCP {
+			continue
+		}
+		checks = append(checks, backendCheck{port: port.NodePort, path: path})
+	}
+	if portSetting != "" && len(checks) == 0 {
+		return nil, fmt.Errorf("invalid annotation %s=%q, not the number or name of a TCP port of the service", annotationHealthCheckPort, portSetting)
+	}
+	return checks, nil
+}
+
+// checkServiceBackends probe the node ports of each service on each known node,
+// so that users can tell the difference between the load balancer IP being
+// announced and the service actually answering behind it.
+func (l *loadBalancers) checkServiceBackends(ctx context.Context, svcs []*v1.Service) {
+	nodes := l.knownNodes()
+	if len(nodes) == 0 {
+		klog.V(2).Info("loadbalancer.checkServiceBackends(): no nodes known yet, skipping")
+		return
+	}
+	// start afresh, so that services and nodes that went away are no longer reported
+	loadBalancerBackendUp.Reset()
+	for _, svc := range svcs {
+		l.checkServiceBackend(ctx, svc, nodes)
+	}
+}
+
+// checkServiceBackend probe the node ports of a single service, record the
+// results as metrics, and record an event if the set of unhealthy backends changed
+func (l *loadBalancers) checkServiceBackend(ctx context.Context, svc *v1.Service, nodes []*v1.Node) {
+	svcName := serviceRep(svc)
+	checks, err := serviceBackendChecks(svc)
+	if err != nil {
+		klog.Errorf("service %s: %v, probing the node ports with TCP instead", svcName, err)
+		checks, _ = serviceBackendChecks(&v1.Service{Spec: v1.ServiceSpec{Ports: svc.Spec.Ports}})
+	}
+	probes := probeServiceBackends(ctx, checks, nodes, l.nodeAddressType)
+	if len(probes) == 0 {
+		klog.V(2).Infof("loadbalancer.checkServiceBackend(): no probeable node ports for %s", svcName)
+		return
+	}
+
+	var (
+		down []string
+		up   int
+	)
+	for _, p := range probes {
+		val := 0.0
+		if p.up {
+			val = 1
+			up++
+		} else {
+			down = append(down, fmt.Sprintf("%s:%d", p.node, p.port))
+		}
+		loadBalancerBackendUp.WithLabelValues(svcName, p.node, strconv.Itoa(int(p.port))).Set(val)
+	}
+	sort.Strings(down)
+	current := strings.Join(down, ",")
+
+	l.backendLock.Lock()
+	previous, known := l.backendDown[svcName]
+	l.backendDown[svcName] = current
+	l.backendLock.Unlock()
+
+	if known && previous == current {
+		return
+	}
+	switch {
+	case up == 0:
+		klog.Warningf("service %s: no node answers on any of its node ports", svcName)
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonBackendsUnhealthy, "No node answers on any node port, the load balancer IP is reachable but the service is not: %s", current)
+	case len(down) > 0:
+		klog.V(2).Infof("service %s: node ports not answering: %s", svcName, current)
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonBackendsUnhealthy, "Some nodes do not answer on node ports: %s", current)
+	case known:
+		l.recorder.Event(svc, v1.EventTypeNormal, eventReasonBackendsHealthy, "All nodes answer on all node ports")
+	}
+}
+
+// probeServiceBackends probe each node with each check in parallel
+func probeServiceBackends(ctx context.Context, checks []backendCheck, nodes []*v1.Node, addressType v1.NodeAddressType) []backendProbe {
+	var (
+		probes []backendProbe
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, node := range nodes {
+		addr := nodeProbeAddress(node, addressType)
+		if addr == "" {
+			continue
+		}
+		for _, check := range checks {
+			wg.Add(1)
+			go func(name, addr string, check backendCheck) {
+				defer wg.Done()
+				var up bool
+				if check.path != "" {
+					up = probeHTTP(ctx, addr, check.port, check.path)
+				} else {
+					up = probeTCP(ctx, addr, check.port)
+				}
+				lock.Lock()
+				probes = append(probes, backendProbe{node: name, port: check.port, up: up})
+				lock.Unlock()
+			}(node.Name, addr, check)
+		}
+	}
+	wg.Wait()
+	return probes
+}
+
+// probeTCP check if anything accepts connections at the address and port
+func probeTCP(ctx context.Context, addr string, port int32) bool {
+	dialer := net.Dialer{Timeout: backendHealthCheckTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	if err != nil {
+		klog.V(5).Infof("probe of %s:%d failed: %v", addr, port, err)
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// probeHTTP check if an HTTP GET of the path at the address and port succeeds, with a 2xx or 3xx response
+func probeHTTP(ctx context.Context, addr string, port int32, path string) bool {
+	u := fmt.Sprintf("http://%s%s", net.JoinHostPort(addr, strconv.Itoa(int(port))), path)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		klog.V(5).Infof("probe of %s failed: %v", u, err)
+		return false
+	}
+	client := &http.Client{
+		Timeout: backendHealthCheckTimeout,
+		// a redirect already says the backend answers
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		klog.V(5).Infof("probe of %s failed: %v", u, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		klog.V(5).Infof("probe of %s failed: %s", u, resp.Status)
+		return false
+	}
+	return true
+}
+
+// ValidateNodeAddressType whether the type of node address to probe nodes at is valid: empty for
+// the default, InternalIP, or ExternalIP, e.g. when the CCM runs outside of the Equinix Metal network
+func ValidateNodeAddressType(addressType string) error {
+	switch v1.NodeAddressType(addressType) {
+	case "", v1.NodeInternalIP, v1.NodeExternalIP:
+		return nil
+	default:
+		return fmt.Errorf("invalid node address type %q: must be %s or %s", addressType, v1.NodeInternalIP, v1.NodeExternalIP)
+	}
+}
+
+// nodeProbeAddress the address at which to probe a node, preferring the address of the given type,
+// by default the internal IP, and else falling back to the other of internal and external IP
+func nodeProbeAddress(node *v1.Node, preferred v1.NodeAddressType) string {
+	if preferred == "" {
+		preferred = v1.NodeInternalIP
+	}
+	var fallback string
+	for _, a := range node.Status.Addresses {
+		switch {
+		case a.Type == preferred:
+			return a.Address
+		case (a.Type == v1.NodeInternalIP || a.Type == v1.NodeExternalIP) && fallback == "":
+			fallback = a.Address
+		}
+	}
+	return fallback
+}
+
+// knownNodes the nodes as of the last full node sync
+func (l *loadBalancers) knownNodes() []*v1.Node {
+	l.backendLock.Lock()
+	defer l.backendLock.Unlock()
+	return l.nodes
+}
+
+// setKnownNodes save the nodes from a full node sync, for use in backend health checks
+func (l *loadBalancers) setKnownNodes(nodes []*v1.Node) {
+	l.backendLock.Lock()
+	defer l.backendLock.Unlock()
+	l.nodes = nodes
+}
+
+// forgetServiceBackends stop tracking backend health for a removed service
+func (l *loadBalancers) forgetServiceBackends(svc *v1.Service) {
+	l.backendLock.Lock()
+	defer l.backendLock.Unlock()
+	delete(l.backendDown, serviceRep(svc))
+}
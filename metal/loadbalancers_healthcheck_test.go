@@ -0,0 +1,206 @@
+package metal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// testListener listen on a local port, returning the port and a closer
+func testListener(t *testing.T) (int32, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	return int32(l.Addr().(*net.TCPAddr).Port), func() { l.Close() }
+}
+
+func testNodeWithIP(name, ip string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func TestCheckServiceBackend(t *testing.T) {
+	ctx := context.Background()
+	openPort, closeOpen := testListener(t)
+	defer closeOpen()
+	// get a port that is guaranteed closed
+	closedPort, closeClosed := testListener(t)
+	closeClosed()
+
+	recorder := record.NewFakeRecorder(10)
+	l := newLoadBalancers(Config{ProjectID: projectID, Facility: validRegionCode, LoadBalancerHealthCheck: true}, nil, nil, nil)
+	l.recorder = recorder
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{
+				{Name: "http", Protocol: v1.ProtocolTCP, NodePort: openPort},
+				{Name: "dns", Protocol: v1.ProtocolUDP, NodePort: closedPort},
+			},
+		},
+	}
+	nodes := []*v1.Node{testNodeWithIP("up", "127.0.0.1"), {ObjectMeta: metav1.ObjectMeta{Name: "noaddress"}}}
+
+	checks, err := serviceBackendChecks(svc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	probes := probeServiceBackends(ctx, checks, nodes, "")
+	if len(probes) != 1 || !probes[0].up || probes[0].node != "up" {
+		t.Fatalf("mismatched probes, actual %#v expected single healthy tcp probe", probes)
+	}
+
+	// all healthy on first check: nothing to report
+	l.checkServiceBackend(ctx, svc, nodes)
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected event for healthy service: %s", <-recorder.Events)
+	}
+
+	// break the backend
+	svc.Spec.Ports[0].NodePort = closedPort
+	l.checkServiceBackend(ctx, svc, nodes)
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, eventReasonBackendsUnhealthy) {
+			t.Errorf("mismatched event, actual %s expected %s", e, eventReasonBackendsUnhealthy)
+		}
+	default:
+		t.Errorf("no event for unhealthy service")
+	}
+
+	// unchanged: no repeated event
+	l.checkServiceBackend(ctx, svc, nodes)
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected repeated event: %s", <-recorder.Events)
+	}
+
+	// recover
+	svc.Spec.Ports[0].NodePort = openPort
+	l.checkServiceBackend(ctx, svc, nodes)
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, eventReasonBackendsHealthy) {
+			t.Errorf("mismatched event, actual %s expected %s", e, eventReasonBackendsHealthy)
+		}
+	default:
+		t.Errorf("no event for recovered service")
+	}
+}
+
+func TestServiceBackendChecks(t *testing.T) {
+	service := func(annotations map[string]string, policy v1.ServiceExternalTrafficPolicyType) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+			Spec: v1.ServiceSpec{
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080},
+					{Name: "https", Port: 443, Protocol: v1.ProtocolTCP, NodePort: 30443},
+					{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP, NodePort: 30053},
+				},
+				ExternalTrafficPolicy: policy,
+				HealthCheckNodePort:   32000,
+			},
+		}
+	}
+	tests := []struct {
+		svc      *v1.Service
+		expected []backendCheck
+		err      bool
+	}{
+		{service(nil, v1.ServiceExternalTrafficPolicyTypeCluster), []backendCheck{{port: 30080}, {port: 30443}}, false},
+		// whether the node has ready endpoints
+		{service(nil, v1.ServiceExternalTrafficPolicyTypeLocal), []backendCheck{{port: 32000, path: kubeProxyHealthCheckPath}}, false},
+		{service(map[string]string{annotationHealthCheckPath: "/ready"}, v1.ServiceExternalTrafficPolicyTypeLocal), []backendCheck{{port: 30080, path: "/ready"}, {port: 30443, path: "/ready"}}, false},
+		{service(map[string]string{annotationHealthCheckPath: "/ready", annotationHealthCheckPort: "http"}, v1.ServiceExternalTrafficPolicyTypeCluster), []backendCheck{{port: 30080, path: "/ready"}}, false},
+		{service(map[string]string{annotationHealthCheckPort: "443"}, v1.ServiceExternalTrafficPolicyTypeCluster), []backendCheck{{port: 30443}}, false},
+		{service(map[string]string{annotationHealthCheckPort: "dns"}, v1.ServiceExternalTrafficPolicyTypeCluster), nil, true},
+		{service(map[string]string{annotationHealthCheckPath: "ready"}, v1.ServiceExternalTrafficPolicyTypeCluster), nil, true},
+	}
+	for i, tt := range tests {
+		checks, err := serviceBackendChecks(tt.svc)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched error, actual %v expected %t", i, err, tt.err)
+		}
+		if !reflect.DeepEqual(checks, tt.expected) {
+			t.Errorf("%d: mismatched checks, actual %v expected %v", i, checks, tt.expected)
+		}
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	port := int32(server.Listener.Addr().(*net.TCPAddr).Port)
+	tests := []struct {
+		path string
+		up   bool
+	}{
+		{"/ready", true},
+		{"/moved", true},
+		{"/healthz", false},
+	}
+	for i, tt := range tests {
+		if up := probeHTTP(context.Background(), "127.0.0.1", port, tt.path); up != tt.up {
+			t.Errorf("%d: mismatched up, actual %t expected %t", i, up, tt.up)
+		}
+	}
+}
+
+func TestNodeProbeAddress(t *testing.T) {
+	both := []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node1"},
+		{Type: v1.NodeExternalIP, Address: "147.75.0.1"},
+		{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+	}
+	tests := []struct {
+		addresses []v1.NodeAddress
+		preferred v1.NodeAddressType
+		address   string
+	}{
+		{both, "", "10.0.0.1"},
+		{both, v1.NodeInternalIP, "10.0.0.1"},
+		{both, v1.NodeExternalIP, "147.75.0.1"},
+		{both[:2], "", "147.75.0.1"},
+		{both[2:], v1.NodeExternalIP, "10.0.0.1"},
+		{both[:1], "", ""},
+	}
+
+	for i, tt := range tests {
+		node := &v1.Node{Status: v1.NodeStatus{Addresses: tt.addresses}}
+		if address := nodeProbeAddress(node, tt.preferred); address != tt.address {
+			t.Errorf("%d: mismatched address, actual %q expected %q", i, address, tt.address)
+		}
+	}
+
+	for _, addressType := range []string{"", "InternalIP", "ExternalIP"} {
+		if err := ValidateNodeAddressType(addressType); err != nil {
+			t.Errorf("unexpected error for %q: %v", addressType, err)
+		}
+	}
+	if err := ValidateNodeAddressType("Hostname"); err == nil {
+		t.Errorf("expected error for Hostname")
+	}
+}
@@ -0,0 +1,347 @@
+package metal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/packethost/packngo"
+	"go.opentelemetry.io/otel/api/kv"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ipAllocatorEquinixMetal the default IP allocator setting, Elastic IPs reserved via the Equinix Metal API
+	ipAllocatorEquinixMetal = "equinixmetal"
+
+	externalIPAllocatorTimeout = 30 * time.Second
+)
+
+// ipAllocator allocates and releases the IPs of services of type=LoadBalancer. The IPs are
+// represented as IP reservations, whose tags find the IP of each service again, and can be
+// changed, e.g. to keep the IP of a deleted service for a while.
+type ipAllocator interface {
+	ipReservationUpdater
+	// list the IPs allocated so far; the caller finds those of the CCM by their tags
+	list(ctx context.Context) ([]packngo.IPAddressReservation, error)
+	// allocate a new IP of the family for the service with the given tags, returning the metro in
+	// which it was reserved, if it is not in the configured facility
+	allocate(ctx context.Context, svcName string, family v1.IPFamily, tags []string) (*packngo.IPAddressReservation, string, error)
+	// release an IP, which is no longer used by any service
+	release(ctx context.Context, ip *packngo.IPAddressReservation) error
+}
+
+// ValidateIPAllocator whether the IP allocator setting is valid: empty or equinixmetal for the
+// Equinix Metal API, or the http or https URL of an external allocator
+func ValidateIPAllocator(setting string) error {
+	if setting == "" || setting == ipAllocatorEquinixMetal {
+		return nil
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return fmt.Errorf("invalid IP allocator %q: %w", setting, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid IP allocator %q: must be %s or an http or https URL", setting, ipAllocatorEquinixMetal)
+	}
+	return nil
+}
+
+// newIPAllocator the IP allocator for the setting, which must be valid. Elastic IPs reserved via
+// the Equinix Metal API fall back to those of the metros that controlPlaneMetros returns.
+func newIPAllocator(setting string, client *packngo.Client, project, facility string, fallbackMetros []string, controlPlaneMetros func(context.Context) (map[string]bool, error)) ipAllocator {
+	if setting == "" || setting == ipAllocatorEquinixMetal {
+		return &metalIPAllocator{
+			client:             client,
+			creator:            packngoEIPCreator{client},
+			project:            project,
+			facility:           facility,
+			fallbackMetros:     fallbackMetros,
+			controlPlaneMetros: controlPlaneMetros,
+		}
+	}
+	return &externalIPAllocator{
+		url:    strings.TrimSuffix(setting, "/"),
+		client: &http.Client{Timeout: externalIPAllocatorTimeout, Transport: newTracingRoundTripper("ipam", http.DefaultTransport)},
+	}
+}
+
+// metalIPAllocator reserve Elastic IPs via the Equinix Metal API, in the configured facility,
+// or else in the fallback metros
+type metalIPAllocator struct {
+	client         *packngo.Client
+	creator        eipCreator
+	project        string
+	facility       string
+	fallbackMetros []string
+	// the metros in which a control plane node has its device, and so can announce an Elastic IP
+	controlPlaneMetros func(context.Context) (map[string]bool, error)
+}
+
+func (a *metalIPAllocator) list(ctx context.Context) ([]packngo.IPAddressReservation, error) {
+	_, span := startSpan(ctx, "metal.ProjectIPs.List")
+	ips, _, err := a.client.ProjectIPs.List(a.project, &packngo.ListOptions{})
+	endSpan(ctx, span, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", a.project, wrapAPIError(err))
+	}
+	return ips, nil
+}
+
+// allocate request a new IP reservation with the given tags, public_ipv4 or for IPv6 public_ipv6, in
+// the configured facility. If that facility cannot fulfill the request, e.g. for lack of capacity,
+// try each of the fallback metros in order, skipping those without a control plane node, where
+// nothing would announce the IP.
+func (a *metalIPAllocator) allocate(ctx context.Context, svcName string, family v1.IPFamily, tags []string) (*packngo.IPAddressReservation, string, error) {
+	reservationType := "public_ipv4"
+	if family == v1.IPv6Protocol {
+		reservationType = "public_ipv6"
+	}
+	request := func(facility, metro string) (*packngo.IPAddressReservation, error) {
+		req := &eipCreateRequest{
+			IPReservationRequest: packngo.IPReservationRequest{
+				Type:                   reservationType,
+				Quantity:               1,
+				Description:            ccmIPDescription,
+				Tags:                   tags,
+				FailOnApprovalRequired: true,
+			},
+			Metro: metro,
+		}
+		if facility != "" {
+			req.Facility = &facility
+		}
+		_, span := startSpan(ctx, "metal.ProjectIPs.Request", kv.String("facility", facility), kv.String("metro", metro))
+		ip, err := a.creator.create(a.project, req)
+		endSpan(ctx, span, err)
+		return ip, err
+	}
+
+	ipReservation, err := request(a.facility, "")
+	switch {
+	case err == nil:
+		klog.V(2).Infof("requested IP for %s in facility %s", svcName, a.facility)
+		return ipReservation, "", nil
+	case !isCapacityError(err):
+		return nil, "", fmt.Errorf("failed to request an IP for the load balancer: %w", wrapAPIError(err))
+	}
+	lastErr := err
+	metros := uniqueMetros(a.fallbackMetros)
+	if len(metros) == 0 {
+		return nil, "", fmt.Errorf("failed to request an IP for the load balancer, facility %s cannot fulfill it: %w", a.facility, &apiError{class: ErrNoCapacity, err: lastErr})
+	}
+	klog.Warningf("facility %s cannot fulfill IP request for %s, trying fallback metros: %v", a.facility, svcName, err)
+	controlPlaneMetros, err := a.controlPlaneMetros(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to request an IP for the load balancer, unable to find the metros of the control plane nodes: %w", err)
+	}
+	for _, metro := range metros {
+		if !controlPlaneMetros[metro] {
+			klog.V(2).Infof("not requesting IP for %s in fallback metro %s, which has no control plane node", svcName, metro)
+			continue
+		}
+		ipReservation, err := request("", metro)
+		switch {
+		case err == nil:
+			klog.V(2).Infof("requested IP for %s in fallback metro %s", svcName, metro)
+			return ipReservation, metro, nil
+		case isCapacityError(err):
+			klog.Warningf("metro %s cannot fulfill IP request for %s, trying next metro: %v", metro, svcName, err)
+			lastErr = err
+		default:
+			return nil, "", fmt.Errorf("failed to request an IP for the load balancer in metro %s: %w", metro, wrapAPIError(err))
+		}
+	}
+	return nil, "", fmt.Errorf("failed to request an IP for the load balancer, neither facility %s nor any of fallback metros %v with a control plane node can fulfill it: %w", a.facility, metros, &apiError{class: ErrNoCapacity, err: lastErr})
+}
+
+// uniqueMetros the metros, in order, without empty ones and duplicates
+func uniqueMetros(metros []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, m := range metros {
+		if m == "" || seen[m] {
+			continue
+		}
+		seen[m] = true
+		unique = append(unique, m)
+	}
+	return unique
+}
+
+// deviceMetro a device with the metro it is in, which packngo.Device does not support yet
+type deviceMetro struct {
+	Metro *struct {
+		Code string `json:"code"`
+	} `json:"metro,omitempty"`
+}
+
+// controlPlaneMetros the metros of the devices of the control plane nodes, in which an Elastic IP
+// can be announced by them
+func (l *loadBalancers) controlPlaneMetros(ctx context.Context) (map[string]bool, error) {
+	nodes, err := l.k8sclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: controlPlaneLabel})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list control plane nodes: %w", err)
+	}
+	metros := map[string]bool{}
+	for _, node := range nodes.Items {
+		id, err := deviceIDFromProviderID(node.Spec.ProviderID)
+		if err != nil {
+			klog.V(2).Infof("skipping control plane node %s without a device: %v", node.Name, err)
+			continue
+		}
+		var device deviceMetro
+		_, span := startSpan(ctx, "metal.Devices.Get")
+		_, err = l.client.DoRequest("GET", fmt.Sprintf("/devices/%s?include=metro", id), nil, &device)
+		endSpan(ctx, span, err)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get device %s of control plane node %s: %w", id, node.Name, wrapAPIError(err))
+		}
+		if device.Metro != nil && device.Metro.Code != "" {
+			metros[device.Metro.Code] = true
+		}
+	}
+	return metros, nil
+}
+
+func (a *metalIPAllocator) release(ctx context.Context, ip *packngo.IPAddressReservation) error {
+	_, span := startSpan(ctx, "metal.ProjectIPs.Remove")
+	_, err := a.client.ProjectIPs.Remove(ip.ID)
+	endSpan(ctx, span, err)
+	if err != nil {
+		return fmt.Errorf("failed to remove IP address reservation %s from project: %w", ip.String(), wrapAPIError(err))
+	}
+	return nil
+}
+
+func (a *metalIPAllocator) update(id string, tags []string, description string) error {
+	return packngoIPReservationUpdater{a.client}.update(id, tags, description)
+}
+
+// externalIPAllocator allocate IPs from an IPAM system outside Equinix Metal, e.g. NetBox or
+// Infoblox, through a small JSON over HTTP protocol, relative to its URL:
+//
+//	GET    <url>       list the IPs allocated to the CCM, as {"ips": [<ip>, ...]}
+//	POST   <url>       allocate an IP, with {"service": "<namespace>/<name>", "family": "IPv4", "tags": [...]}, answered with <ip>
+//	PATCH  <url>/<id>  change the tags and description of an IP, with {"tags": [...], "description": "..."}
+//	DELETE <url>/<id>  release an IP
+//
+// where <ip> is {"id": "...", "address": "10.0.0.1", "cidr": 32, "tags": [...], "description": "..."}. The
+// family is IPv4, or IPv6 for the second IP of a dual-stack service; a missing cidr is that of a single address.
+// Any 2xx answer is success; a 404 on DELETE means the IP was already released.
+type externalIPAllocator struct {
+	url    string
+	client *http.Client
+}
+
+// externalIP an IP as exchanged with an external IP allocator
+type externalIP struct {
+	ID          string   `json:"id"`
+	Address     string   `json:"address"`
+	CIDR        int      `json:"cidr"`
+	Tags        []string `json:"tags,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+func (ip externalIP) reservation() packngo.IPAddressReservation {
+	r := packngo.IPAddressReservation{
+		IpAddressCommon: packngo.IpAddressCommon{ID: ip.ID, Address: ip.Address, CIDR: ip.CIDR, Tags: ip.Tags},
+	}
+	if r.CIDR == 0 {
+		r.CIDR = 32
+		if reservationFamily(&r) == v1.IPv6Protocol {
+			r.CIDR = 128
+		}
+	}
+	if ip.Description != "" {
+		description := ip.Description
+		r.Description = &description
+	}
+	return r
+}
+
+// do send a request to the external allocator, and decode its answer into out, if any
+func (a *externalIPAllocator) do(ctx context.Context, method, u string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("IP allocator %s %s: %w", method, u, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("IP allocator %s %s returned %s: %s", method, u, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("IP allocator %s %s returned an invalid answer: %w", method, u, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (a *externalIPAllocator) list(ctx context.Context) ([]packngo.IPAddressReservation, error) {
+	var answer struct {
+		IPs []externalIP `json:"ips"`
+	}
+	if _, err := a.do(ctx, "GET", a.url, nil, &answer); err != nil {
+		return nil, err
+	}
+	ips := make([]packngo.IPAddressReservation, 0, len(answer.IPs))
+	for _, ip := range answer.IPs {
+		ips = append(ips, ip.reservation())
+	}
+	return ips, nil
+}
+
+func (a *externalIPAllocator) allocate(ctx context.Context, svcName string, family v1.IPFamily, tags []string) (*packngo.IPAddressReservation, string, error) {
+	var ip externalIP
+	request := map[string]interface{}{"service": svcName, "family": family, "tags": tags}
+	if _, err := a.do(ctx, "POST", a.url, request, &ip); err != nil {
+		return nil, "", fmt.Errorf("failed to allocate an IP for the load balancer: %w", err)
+	}
+	if ip.ID == "" || ip.Address == "" {
+		return nil, "", fmt.Errorf("failed to allocate an IP for the load balancer: IP allocator returned no id or address")
+	}
+	klog.V(2).Infof("allocated IP %s for %s from external IP allocator", ip.Address, svcName)
+	r := ip.reservation()
+	return &r, "", nil
+}
+
+func (a *externalIPAllocator) release(ctx context.Context, ip *packngo.IPAddressReservation) error {
+	code, err := a.do(ctx, "DELETE", a.url+"/"+url.PathEscape(ip.ID), nil, nil)
+	if err != nil && code != http.StatusNotFound {
+		return fmt.Errorf("failed to release IP %s: %w", ip.Address, err)
+	}
+	return nil
+}
+
+func (a *externalIPAllocator) update(id string, tags []string, description string) error {
+	request := map[string]interface{}{"tags": tags, "description": description}
+	_, err := a.do(context.Background(), "PATCH", a.url+"/"+url.PathEscape(id), request, nil)
+	return err
+}
@@ -0,0 +1,211 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestValidateIPAllocator(t *testing.T) {
+	tests := []struct {
+		setting string
+		err     bool
+	}{
+		{"", false},
+		{"equinixmetal", false},
+		{"https://ipam.example.com/ccm", false},
+		{"http://10.0.0.1:8080", false},
+		{"netbox", true},
+		{"tcp://ipam.example.com", true},
+		{"https://", true},
+	}
+
+	for i, tt := range tests {
+		err := ValidateIPAllocator(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		}
+	}
+}
+
+// testIPAM a minimal external IP allocator, handing out addresses from 10.0.0.0/24, or 2001:db8::/64 for IPv6
+type testIPAM struct {
+	lock sync.Mutex
+	ips  map[string]externalIP
+	next int
+}
+
+func (s *testIPAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/ips/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/ips":
+		answer := struct {
+			IPs []externalIP `json:"ips"`
+		}{}
+		for _, ip := range s.ips {
+			answer.IPs = append(answer.IPs, ip)
+		}
+		_ = json.NewEncoder(w).Encode(answer)
+	case r.Method == "POST" && r.URL.Path == "/ips":
+		var request struct {
+			Service string   `json:"service"`
+			Family  string   `json:"family"`
+			Tags    []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.next++
+		ip := externalIP{ID: request.Service, Address: "10.0.0." + string(rune('0'+s.next)), Tags: request.Tags}
+		if request.Family == string(v1.IPv6Protocol) {
+			ip.Address = "2001:db8::" + string(rune('0'+s.next))
+		}
+		s.ips[ip.ID] = ip
+		_ = json.NewEncoder(w).Encode(ip)
+	case r.Method == "PATCH":
+		ip, ok := s.ips[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ip); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ips[id] = ip
+	case r.Method == "DELETE":
+		if _, ok := s.ips[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.ips, id)
+	default:
+		http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestExternalIPAllocator(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(&testIPAM{ips: map[string]externalIP{}})
+	defer server.Close()
+	allocator := newIPAllocator(server.URL+"/ips/", nil, "project", "ewr1", nil, nil)
+
+	tags := []string{"usage=cloud-provider-equinix-metal-auto", "service=abc"}
+	ip, _, err := allocator.allocate(ctx, "default/a", v1.IPv4Protocol, tags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address != "10.0.0.1" || ip.CIDR != 32 || !reflect.DeepEqual(ip.Tags, tags) {
+		t.Errorf("mismatched allocated IP, actual %#v", ip)
+	}
+
+	if err := allocator.update(ip.ID, []string{"kept"}, "deleted"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ips, err := allocator.list(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || ips[0].Address != "10.0.0.1" || !reflect.DeepEqual(ips[0].Tags, []string{"kept"}) || ips[0].Description == nil || *ips[0].Description != "deleted" {
+		t.Errorf("mismatched listed IPs, actual %#v", ips)
+	}
+
+	// releasing twice is fine, the IP is gone either way
+	for i := 0; i < 2; i++ {
+		if err := allocator.release(ctx, ip); err != nil {
+			t.Errorf("%d: unexpected error on release: %v", i, err)
+		}
+	}
+	ips, err = allocator.list(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 0 {
+		t.Errorf("mismatched listed IPs after release, actual %#v", ips)
+	}
+
+	// an IPv6 one, for a dual-stack service, is a single address unless the allocator says otherwise
+	ip, _, err = allocator.allocate(ctx, "default/b", v1.IPv6Protocol, tags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip.Address != "2001:db8::2" || ip.CIDR != 128 {
+		t.Errorf("mismatched allocated IPv6 IP, actual %s/%d expected 2001:db8::2/128", ip.Address, ip.CIDR)
+	}
+
+	if err := allocator.update("missing", nil, ""); err == nil {
+		t.Errorf("expected error updating a missing IP")
+	}
+}
+
+// testLocationEIPCreator an eipCreator that fails the requests in the full facilities or metros for
+// lack of capacity, and records the locations of all requests
+type testLocationEIPCreator struct {
+	full      map[string]bool
+	locations []string
+}
+
+func (c *testLocationEIPCreator) create(projectID string, req *eipCreateRequest) (*packngo.IPAddressReservation, error) {
+	location := req.Metro
+	if req.Facility != nil {
+		location = *req.Facility
+	}
+	c.locations = append(c.locations, location)
+	if c.full[location] {
+		return nil, testAPIError(http.StatusUnprocessableEntity)
+	}
+	return &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: "ip-" + location, Address: "147.75.100.1", Tags: req.Tags}}, nil
+}
+
+func TestMetalIPAllocatorFallback(t *testing.T) {
+	ctx := context.Background()
+	controlPlaneMetros := func(context.Context) (map[string]bool, error) {
+		return map[string]bool{"ny": true, "da": true}, nil
+	}
+	tests := []struct {
+		fallbackMetros []string
+		full           map[string]bool
+		metro          string
+		locations      []string
+		noCapacity     bool
+	}{
+		{[]string{"ny"}, nil, "", []string{"ewr1"}, false},
+		{[]string{"ny", "da"}, map[string]bool{"ewr1": true}, "ny", []string{"ewr1", "ny"}, false},
+		// metros without a control plane node, and duplicates, are skipped
+		{[]string{"sv", "", "ny", "ny", "da"}, map[string]bool{"ewr1": true, "ny": true}, "da", []string{"ewr1", "ny", "da"}, false},
+		{[]string{"sv"}, map[string]bool{"ewr1": true}, "", []string{"ewr1"}, true},
+		{nil, map[string]bool{"ewr1": true}, "", []string{"ewr1"}, true},
+	}
+	for i, tt := range tests {
+		creator := &testLocationEIPCreator{full: tt.full}
+		allocator := &metalIPAllocator{creator: creator, project: "project", facility: "ewr1", fallbackMetros: tt.fallbackMetros, controlPlaneMetros: controlPlaneMetros}
+		ip, metro, err := allocator.allocate(ctx, "default/a", v1.IPv4Protocol, []string{"service=abc"})
+		switch {
+		case tt.noCapacity && !errors.Is(err, ErrNoCapacity):
+			t.Errorf("%d: mismatched error, actual %v expected %v", i, err, ErrNoCapacity)
+		case !tt.noCapacity && (err != nil || ip == nil):
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		if metro != tt.metro {
+			t.Errorf("%d: mismatched metro, actual %q expected %q", i, metro, tt.metro)
+		}
+		if !reflect.DeepEqual(creator.locations, tt.locations) {
+			t.Errorf("%d: mismatched requested locations, actual %v expected %v", i, creator.locations, tt.locations)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotationKeepIP set to true on a service to keep its Elastic IP for a while after it is
+	// deleted, so that the service gets the same IP back if it is recreated in the meantime
+	annotationKeepIP = "metal.equinix.com/keep-ip"
+	// keepUntilTagPrefix the tag on the reservation of a deleted service that keeps its IP, with the
+	// unix time until which it is kept; in the tags, so that it survives a restart of the CCM
+	keepUntilTagPrefix = "keep-until="
+	// DefaultKeepIPGracePeriod how long the IP of a deleted service that keeps it is kept by default
+	DefaultKeepIPGracePeriod = time.Hour
+)
+
+// keepIP whether to keep the IP of a service after it is deleted
+func keepIP(svc *v1.Service) bool {
+	keep, _ := strconv.ParseBool(svc.Annotations[annotationKeepIP])
+	return keep
+}
+
+// keepUntil the time until which the IP of a reservation is kept, and whether it is kept at all
+func keepUntil(ip *packngo.IPAddressReservation) (time.Time, bool) {
+	for _, tag := range ip.Tags {
+		if !strings.HasPrefix(tag, keepUntilTagPrefix) {
+			continue
+		}
+		until, err := strconv.ParseInt(strings.TrimPrefix(tag, keepUntilTagPrefix), 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(until, 0), true
+	}
+	return time.Time{}, false
+}
+
+// setKeepUntil set the tags of a reservation to keep its IP until the given time, or, for a
+// zero time, to no longer keep it, as its service has been recreated
+func (l *loadBalancers) setKeepUntil(ip *packngo.IPAddressReservation, until time.Time) error {
+	tags := make([]string, 0, len(ip.Tags)+1)
+	for _, tag := range ip.Tags {
+		if !strings.HasPrefix(tag, keepUntilTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	if !until.IsZero() {
+		tags = append(tags, fmt.Sprintf("%s%d", keepUntilTagPrefix, until.Unix()))
+	}
+	var description string
+	if ip.Description != nil {
+		description = *ip.Description
+	}
+	if err := l.ipUpdater.update(ip.ID, tags, description); err != nil {
+		return fmt.Errorf("unable to update tags of IP address reservation %s: %w", ip.Address, err)
+	}
+	ip.Tags = tags
+	return nil
+}
+
+// keepServiceIP stop announcing the IP of a deleted service, but keep its reservation,
+// still tagged for the service, until the grace period is over
+func (l *loadBalancers) keepServiceIP(ctx context.Context, svc *v1.Service, ip *packngo.IPAddressReservation) error {
+	svcName := serviceRep(svc)
+	until := clockNow(l.clock).Add(l.keepIPGrace)
+	if err := l.setKeepUntil(ip, until); err != nil {
+		return err
+	}
+	svcIPCidr := fmt.Sprintf("%s/%d", ip.Address, ip.CIDR)
+	if err := l.implementor.RemoveService(ctx, svcIPCidr); err != nil {
+		return fmt.Errorf("error removing IP from configmap for %s: %w", svcName, err)
+	}
+	klog.Infof("keeping IP %s of deleted service %s until %s, for when it is recreated", ip.Address, svcName, until.UTC().Format(time.RFC3339))
+	l.forgetServiceBackends(svc)
+	return nil
+}
+
+// keptIPExpired whether a reservation with no service left is to be released: true unless
+// its IP is kept and the grace period is not yet over
+func keptIPExpired(ip *packngo.IPAddressReservation, now time.Time) bool {
+	until, ok := keepUntil(ip)
+	return !ok || now.After(until)
+}
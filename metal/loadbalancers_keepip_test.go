@@ -0,0 +1,110 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestKeepServiceIP(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{annotationKeepIP: "true"}},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	// the project IP service has no Remove, so releasing the IP fails the test
+	ipResSvr := &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "ip-id", Address: "147.75.100.2", CIDR: 32, Tags: []string{emTag, serviceTag(svc), clusterTag("")}}},
+	}}
+	updater := &testIPReservationUpdater{}
+	lb := &testServicesLB{added: map[string]string{}}
+	l := newLoadBalancers(Config{ProjectID: projectID, LBKeepIPGracePeriod: "1h"}, &packngo.Client{ProjectIPs: ipResSvr}, nil, nil)
+	l.k8sclient = fake.NewSimpleClientset(svc)
+	l.recorder = record.NewFakeRecorder(10)
+	l.implementor = lb
+	l.ipUpdater = updater
+
+	// deleted, the IP is kept, and survives a sync
+	if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error removing: %v", err)
+	}
+	until, ok := keepUntil(&ipResSvr.ips[0])
+	if !ok || until.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("mismatched keep until, actual %v/%v expected an hour from now, tags %v", until, ok, updater.tags)
+	}
+	if err := l.reconcileServices(ctx, nil, ModeSync); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+
+	// recreated, it gets the same IP, which is no longer only kept
+	if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error adding: %v", err)
+	}
+	if ip := lb.added["default/web"]; ip != "147.75.100.2/32" {
+		t.Errorf("mismatched IP, actual %q expected 147.75.100.2/32", ip)
+	}
+	if _, ok := keepUntil(&ipResSvr.ips[0]); ok || len(updater.tags) != 3 {
+		t.Errorf("IP still kept, tags %v", updater.tags)
+	}
+}
+
+func TestKeptIPExpired(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		tags    []string
+		expired bool
+	}{
+		{nil, true},
+		{[]string{emTag}, true},
+		{[]string{emTag, fmt.Sprintf("%s%d", keepUntilTagPrefix, now.Add(time.Minute).Unix())}, false},
+		{[]string{emTag, fmt.Sprintf("%s%d", keepUntilTagPrefix, now.Add(-time.Minute).Unix())}, true},
+		{[]string{emTag, keepUntilTagPrefix + "soon"}, true},
+	}
+	for i, tt := range tests {
+		ip := &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Tags: tt.tags}}
+		if expired := keptIPExpired(ip, now); expired != tt.expired {
+			t.Errorf("%d: mismatched expired, actual %v expected %v", i, expired, tt.expired)
+		}
+	}
+}
+
+func TestKeepServiceIPClock(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{annotationKeepIP: "true"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+	}
+	ip := &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: "ip-id", Address: "147.75.100.2", CIDR: 32, Tags: []string{emTag, serviceTag(svc)}}}
+	fakeClock := clock.NewFakeClock(time.Unix(1600000000, 0))
+	l := newLoadBalancers(Config{ProjectID: projectID, LBKeepIPGracePeriod: "1h"}, &packngo.Client{}, nil, nil)
+	l.implementor = &testServicesLB{added: map[string]string{}}
+	l.ipUpdater = &testIPReservationUpdater{}
+	l.clock = fakeClock
+
+	if err := l.keepServiceIP(ctx, svc, ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if until, ok := keepUntil(ip); !ok || !until.Equal(fakeClock.Now().Add(time.Hour)) {
+		t.Errorf("mismatched keep until, actual %v/%v expected %v", until, ok, fakeClock.Now().Add(time.Hour))
+	}
+	// kept for the grace period, and not a moment longer
+	fakeClock.Step(59 * time.Minute)
+	if keptIPExpired(ip, clockNow(l.clock)) {
+		t.Errorf("kept IP expired within the grace period")
+	}
+	fakeClock.Step(2 * time.Minute)
+	if !keptIPExpired(ip, clockNow(l.clock)) {
+		t.Errorf("kept IP not expired after the grace period")
+	}
+}
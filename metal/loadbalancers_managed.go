@@ -0,0 +1,267 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+// Services get an Equinix Metal managed load balancer each, rather than an Elastic IP announced
+// via BGP, with load balancer type equinixmetal. The service controller of kubernetes drives
+// them via the cloudprovider.LoadBalancer interface, which the CCM offers only for this type, and
+// writes the IPs of the load balancer into the status of the service. For each port of the service,
+// the load balancer has a port of the same number, whose pool has an origin on each node, at the
+// node port of the service, and which passes the client IP to the origins as set by
+// annotationProxyProtocol.
+
+// managed whether services get Equinix Metal managed load balancers
+func (l *loadBalancers) managed() bool {
+	// validated when the config was loaded
+	setting, _ := ParseLoadBalancerSetting(l.implementorConfig)
+	return setting != nil && setting.Type == lbTypeEquinixMetal
+}
+
+// validateManagedServicePorts check that the ports of a service can be served by a managed load
+// balancer, which forwards TCP only, to the node port of each
+func validateManagedServicePorts(svc *v1.Service) error {
+	for _, port := range svc.Spec.Ports {
+		if protocol := servicePortProtocol(port); protocol != v1.ProtocolTCP {
+			return fmt.Errorf("port %d has protocol %s, an Equinix Metal load balancer supports only %s", port.Port, protocol, v1.ProtocolTCP)
+		}
+	}
+	return nil
+}
+
+// managedLoadBalancer the load balancer of the service, with its ports, or nil if it has none
+func (l *loadBalancers) managedLoadBalancer(ctx context.Context, svc *v1.Service) (*lbaasLoadBalancer, error) {
+	name := l.GetLoadBalancerName(ctx, "", svc)
+	lbs, err := l.lbaas.listLoadBalancers(ctx, l.project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list load balancers: %w", err)
+	}
+	for _, lb := range lbs {
+		if lb.Name == name {
+			return l.lbaas.getLoadBalancer(ctx, lb.ID)
+		}
+	}
+	return nil, nil
+}
+
+// managedStatus the status of a service with the load balancer, which has no IP until it is provisioned
+func managedStatus(lb *lbaasLoadBalancer) *v1.LoadBalancerStatus {
+	status := &v1.LoadBalancerStatus{}
+	for _, ip := range lb.IPs {
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{IP: ip})
+	}
+	return status
+}
+
+// managedOrigins the addresses of the nodes to which the load balancer of a service sends its traffic,
+// by default their external IPs, which the load balancer, outside the cluster, can reach
+func (l *loadBalancers) managedOrigins(nodes []*v1.Node) []string {
+	if l.excludeControlPlane {
+		nodes = workerNodes(nodes)
+	}
+	addressType := l.nodeAddressType
+	if addressType == "" {
+		addressType = v1.NodeExternalIP
+	}
+	var targets []string
+	for _, node := range availableNodes(nodes) {
+		if addr := nodeProbeAddress(node, addressType); addr != "" {
+			targets = append(targets, addr)
+		}
+	}
+	return targets
+}
+
+// ensureManagedLoadBalancer create the load balancer of the service, if it has none, and make its
+// ports and their origins match those of the service and the nodes
+func (l *loadBalancers) ensureManagedLoadBalancer(ctx context.Context, svc *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
+	if err := validateManagedServicePorts(svc); err != nil {
+		return nil, err
+	}
+	// the load balancer does not filter traffic, and kube-proxy sees only its addresses
+	if err := validateSourceRanges(svc, lbTypeEquinixMetal); err != nil {
+		return nil, err
+	}
+	// an invalid proxy protocol is reported once for each value, rather than on each attempt
+	changed := l.proxyProtocolChanged(serviceRep(svc), svc.Annotations[annotationProxyProtocol])
+	proxyProtocol, err := serviceProxyProtocol(svc)
+	if err != nil {
+		if changed {
+			l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonProxyProtocolUnsupported, "Not creating or updating the load balancer: %v", err)
+		}
+		return nil, err
+	}
+	lb, err := l.managedLoadBalancer(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+	if lb == nil {
+		// as with Elastic IPs, only services in namespaces the CCM manages get one, within the quotas
+		if ok, reason := l.namespaceAllowed(svc.Namespace); !ok {
+			l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonNamespaceNotAllowed, "Not creating a load balancer: %s", reason)
+			return nil, fmt.Errorf("not creating a load balancer for service %s: %s", serviceRep(svc), reason)
+		}
+		if err := l.checkManagedIPQuota(ctx, svc); err != nil {
+			if errors.Is(err, ErrIPQuotaExceeded) {
+				l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonIPQuotaExceeded, "Not creating a load balancer: %v", err)
+			}
+			return nil, err
+		}
+		name := l.GetLoadBalancerName(ctx, "", svc)
+		klog.Infof("creating load balancer %s for service %s at location %s", name, serviceRep(svc), l.location)
+		id, err := l.lbaas.createLoadBalancer(ctx, l.project, name, l.location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create load balancer %s: %w", name, err)
+		}
+		if lb, err = l.lbaas.getLoadBalancer(ctx, id); err != nil {
+			return nil, fmt.Errorf("failed to get created load balancer %s: %w", name, err)
+		}
+	}
+	if err := l.syncManagedPorts(ctx, svc, lb, l.managedOrigins(nodes), proxyProtocol); err != nil {
+		return nil, err
+	}
+	// the service controller retries until the load balancer is provisioned
+	if len(lb.IPs) == 0 {
+		return nil, fmt.Errorf("load balancer %s is being provisioned, it has no IP yet", lb.Name)
+	}
+	return managedStatus(lb), nil
+}
+
+// syncManagedPorts give the load balancer a port for each port of the service, each with a pool
+// of the targets at the node port and the proxy protocol, and remove any other port, with its pools
+func (l *loadBalancers) syncManagedPorts(ctx context.Context, svc *v1.Service, lb *lbaasLoadBalancer, targets []string, proxyProtocol string) error {
+	existing := map[int32]lbaasPort{}
+	for _, port := range lb.Ports {
+		existing[port.Number] = port
+	}
+	wanted := map[int32]bool{}
+	var errs []error
+	for _, port := range svc.Spec.Ports {
+		wanted[port.Port] = true
+		if lbPort, ok := existing[port.Port]; ok {
+			if lbPort.ProxyProtocol != proxyProtocol {
+				klog.Infof("setting proxy protocol %q on port %d of load balancer %s of service %s", proxyProtocol, port.Port, lb.Name, serviceRep(svc))
+				if err := l.lbaas.updatePortProxyProtocol(ctx, lb.ID, lbPort.ID, proxyProtocol); err != nil {
+					errs = append(errs, fmt.Errorf("failed to set proxy protocol of port %d of load balancer %s: %w", port.Port, lb.Name, err))
+				}
+			}
+			for _, poolID := range lbPort.PoolIDs {
+				if err := l.syncManagedOrigins(ctx, poolID, targets, port.NodePort); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+		klog.Infof("adding port %d to load balancer %s of service %s", port.Port, lb.Name, serviceRep(svc))
+		if err := l.addManagedPort(ctx, lb, port, targets, proxyProtocol); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for number, lbPort := range existing {
+		if wanted[number] {
+			continue
+		}
+		klog.Infof("removing port %d from load balancer %s of service %s", number, lb.Name, serviceRep(svc))
+		if err := l.lbaas.deletePort(ctx, lb.ID, lbPort.ID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove port %d from load balancer %s: %w", number, lb.Name, err))
+			continue
+		}
+		for _, poolID := range lbPort.PoolIDs {
+			if err := l.lbaas.deletePool(ctx, poolID); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete pool %s: %w", poolID, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// addManagedPort add a port to the load balancer, with a new pool of the targets at the node port.
+// If that fails, the pool is deleted again, rather than left behind for another on the next attempt.
+func (l *loadBalancers) addManagedPort(ctx context.Context, lb *lbaasLoadBalancer, port v1.ServicePort, targets []string, proxyProtocol string) error {
+	name := fmt.Sprintf("%s-%d", lb.Name, port.Port)
+	poolID, err := l.lbaas.createPool(ctx, l.project, name)
+	if err != nil {
+		return fmt.Errorf("failed to create pool %s: %w", name, err)
+	}
+	err = l.syncManagedOrigins(ctx, poolID, targets, port.NodePort)
+	if err == nil {
+		if err = l.lbaas.createPort(ctx, lb.ID, lbaasPort{Name: name, Number: port.Port, PoolIDs: []string{poolID}, ProxyProtocol: proxyProtocol}); err != nil {
+			err = fmt.Errorf("failed to add port %d to load balancer %s: %w", port.Port, lb.Name, err)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	if derr := l.lbaas.deletePool(ctx, poolID); derr != nil {
+		return utilerrors.NewAggregate([]error{err, fmt.Errorf("failed to delete pool %s: %w", poolID, derr)})
+	}
+	return err
+}
+
+// syncManagedOrigins make the origins of the pool exactly the targets, at the node port
+func (l *loadBalancers) syncManagedOrigins(ctx context.Context, poolID string, targets []string, nodePort int32) error {
+	origins, err := l.lbaas.listOrigins(ctx, poolID)
+	if err != nil {
+		return fmt.Errorf("failed to list origins of pool %s: %w", poolID, err)
+	}
+	wanted := map[string]bool{}
+	for _, target := range targets {
+		wanted[target] = true
+	}
+	current := map[string]bool{}
+	var errs []error
+	for _, origin := range origins {
+		if wanted[origin.Target] && origin.PortNumber == nodePort && !current[origin.Target] {
+			current[origin.Target] = true
+			continue
+		}
+		if err := l.lbaas.deleteOrigin(ctx, origin.ID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove origin %s from pool %s: %w", origin.Target, poolID, err))
+		}
+	}
+	for _, target := range sortedKeys(wanted) {
+		if current[target] {
+			continue
+		}
+		origin := lbaasOrigin{Name: target, Target: target, PortNumber: nodePort, Active: true}
+		if err := l.lbaas.createOrigin(ctx, poolID, origin); err != nil {
+			errs = append(errs, fmt.Errorf("failed to add origin %s to pool %s: %w", target, poolID, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// deleteManagedLoadBalancer delete the load balancer of the service, if it has one, and its pools
+func (l *loadBalancers) deleteManagedLoadBalancer(ctx context.Context, svc *v1.Service) error {
+	l.proxyProtocolChanged(serviceRep(svc), "")
+	lb, err := l.managedLoadBalancer(ctx, svc)
+	if err != nil || lb == nil {
+		return err
+	}
+	klog.Infof("deleting load balancer %s of service %s", lb.Name, serviceRep(svc))
+	if err := l.lbaas.deleteLoadBalancer(ctx, lb.ID); err != nil {
+		return fmt.Errorf("failed to delete load balancer %s: %w", lb.Name, err)
+	}
+	var errs []error
+	for _, port := range lb.Ports {
+		for _, poolID := range port.PoolIDs {
+			if err := l.lbaas.deletePool(ctx, poolID); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete pool %s: %w", poolID, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// managedLocation the location of the load balancers in the setting, equinixmetal://<location id>
+func managedLocation(detail string) string {
+	return strings.Trim(detail, "/")
+}
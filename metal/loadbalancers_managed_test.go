@@ -0,0 +1,298 @@
+package metal
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// testManagedNode a node with both an internal and an external IP
+func testManagedNode(name, internal, external string) *v1.Node {
+	node := testNodeWithIP(name, internal)
+	node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: external})
+	return node
+}
+
+func TestManagedLoadBalancer(t *testing.T) {
+	ctx := context.Background()
+	f, client := newTestLBaaS(t, "metal-token")
+	l := newLoadBalancers(Config{ProjectID: projectID, LoadBalancerSetting: "equinixmetal://lctnloc-1"}, nil, nil, client)
+	l.clusterID = "9a1c2b3d-0000-4000-8000-000000000000"
+	l.location = "lctnloc-1"
+	if !l.managed() {
+		t.Fatalf("expected managed load balancers")
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Port: 80, NodePort: 30001}, {Port: 443, NodePort: 30002}},
+		},
+	}
+	nodes := []*v1.Node{
+		testManagedNode("worker-1", "10.0.0.1", "147.75.1.1"),
+		testManagedNode("worker-2", "10.0.0.2", "147.75.1.2"),
+	}
+
+	// not provisioned yet: no status, so that the service controller tries again
+	f.provisioned = false
+	if _, err := l.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes); err == nil {
+		t.Errorf("expected error while the load balancer has no IP")
+	}
+	if len(f.lbs) != 1 {
+		t.Fatalf("mismatched load balancers, actual %d expected 1", len(f.lbs))
+	}
+	var lb *lbaasLoadBalancer
+	for _, found := range f.lbs {
+		lb = found
+	}
+	if lb.Name != "metal-9a1c2b3d-shop-97375646b1" {
+		t.Errorf("mismatched load balancer name, actual %q expected metal-9a1c2b3d-shop-97375646b1", lb.Name)
+	}
+	lb.IPs = []string{"147.75.0.1"}
+
+	// provisioned: the same load balancer, its IP in the status, a port for each of the service
+	status, err := l.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(status.Ingress) != 1 || status.Ingress[0].IP != "147.75.0.1" {
+		t.Errorf("mismatched status, actual %v expected ingress 147.75.0.1", status.Ingress)
+	}
+	if len(f.lbs) != 1 || len(lb.Ports) != 2 || len(f.pools) != 2 {
+		t.Fatalf("mismatched load balancers, ports and pools, actual %d, %d and %d expected 1, 2 and 2", len(f.lbs), len(lb.Ports), len(f.pools))
+	}
+	for _, port := range lb.Ports {
+		var targets []string
+		for _, origin := range f.origins {
+			if origin.PoolID != port.PoolIDs[0] {
+				continue
+			}
+			targets = append(targets, origin.Target)
+			if (port.Number == 80 && origin.PortNumber != 30001) || (port.Number == 443 && origin.PortNumber != 30002) {
+				t.Errorf("mismatched origin port for port %d, actual %d", port.Number, origin.PortNumber)
+			}
+		}
+		sort.Strings(targets)
+		// the external IPs of the nodes, which the load balancer can reach
+		if strings.Join(targets, ",") != "147.75.1.1,147.75.1.2" {
+			t.Errorf("mismatched origins of port %d, actual %v expected 147.75.1.1,147.75.1.2", port.Number, targets)
+		}
+	}
+
+	// nodes changed, and a port dropped: the origins follow, the port and its pool are removed
+	svc.Spec.Ports = svc.Spec.Ports[:1]
+	if err := l.UpdateLoadBalancer(ctx, "kubernetes", svc, nodes[1:]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.Ports) != 1 || lb.Ports[0].Number != 80 || len(f.pools) != 1 {
+		t.Fatalf("mismatched ports and pools after update, actual %v and %d expected port 80 and 1 pool", lb.Ports, len(f.pools))
+	}
+	if len(f.origins) != 1 {
+		t.Errorf("mismatched origins after update, actual %v expected only 147.75.1.2", f.origins)
+	}
+	for _, origin := range f.origins {
+		if origin.Target != "147.75.1.2" {
+			t.Errorf("mismatched origin after update, actual %s expected 147.75.1.2", origin.Target)
+		}
+	}
+
+	if status, exists, err := l.GetLoadBalancer(ctx, "kubernetes", svc); err != nil || !exists || status.Ingress[0].IP != "147.75.0.1" {
+		t.Errorf("mismatched load balancer, actual %v %v %v", status, exists, err)
+	}
+
+	// deleted with its pools, and deleting again is not an error
+	for i := 0; i < 2; i++ {
+		if err := l.EnsureLoadBalancerDeleted(ctx, "kubernetes", svc); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+	if len(f.lbs) != 0 || len(f.pools) != 0 || len(f.origins) != 0 {
+		t.Errorf("mismatched objects after delete, actual %d load balancers, %d pools, %d origins expected none", len(f.lbs), len(f.pools), len(f.origins))
+	}
+	if _, exists, err := l.GetLoadBalancer(ctx, "kubernetes", svc); err != nil || exists {
+		t.Errorf("mismatched load balancer after delete, actual exists %v %v", exists, err)
+	}
+}
+
+func TestManagedLoadBalancerPortFailed(t *testing.T) {
+	ctx := context.Background()
+	f, client := newTestLBaaS(t, "metal-token")
+	l := newLoadBalancers(Config{ProjectID: projectID, LoadBalancerSetting: "equinixmetal://lctnloc-1"}, nil, nil, client)
+	l.location = "lctnloc-1"
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 80, NodePort: 30001}}},
+	}
+	nodes := []*v1.Node{testManagedNode("worker-1", "10.0.0.1", "147.75.1.1")}
+
+	// the pool of a port that could not be added is deleted, rather than left behind on each attempt
+	f.failPorts = true
+	for i := 0; i < 2; i++ {
+		if _, err := l.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes); err == nil {
+			t.Errorf("%d: expected error while ports cannot be added", i)
+		}
+		if len(f.pools) != 0 || len(f.origins) != 0 {
+			t.Errorf("%d: mismatched pools and origins, actual %d and %d expected none", i, len(f.pools), len(f.origins))
+		}
+	}
+	f.failPorts = false
+	if _, err := l.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(f.pools) != 1 || len(f.origins) != 1 {
+		t.Errorf("mismatched pools and origins, actual %d and %d expected 1 each", len(f.pools), len(f.origins))
+	}
+}
+
+func TestManagedLoadBalancerNamespacesAndQuota(t *testing.T) {
+	ctx := context.Background()
+	service := func(namespace, name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 80, NodePort: 30001}}},
+		}
+	}
+	// team-a has a load balancer, as does a service of another cluster
+	a1 := service("team-a", "one")
+	tests := []struct {
+		config Config
+		svc    *v1.Service
+		reason string
+	}{
+		{Config{}, service("team-a", "new"), ""},
+		{Config{LBExcludedNamespaces: []string{"team-a"}}, service("team-a", "new"), eventReasonNamespaceNotAllowed},
+		{Config{LBNamespaces: []string{"team-b"}}, service("team-a", "new"), eventReasonNamespaceNotAllowed},
+		{Config{LBMaxIPs: 1}, service("team-b", "new"), eventReasonIPQuotaExceeded},
+		{Config{LBMaxIPs: 2}, service("team-b", "new"), ""},
+		{Config{LBMaxIPsPerNamespace: 1}, service("team-a", "new"), eventReasonIPQuotaExceeded},
+		{Config{LBMaxIPsPerNamespace: 1}, service("team-b", "new"), ""},
+		// a service that already has a load balancer keeps it
+		{Config{LBMaxIPs: 1, LBExcludedNamespaces: []string{"team-a"}}, a1, ""},
+	}
+	for i, tt := range tests {
+		f, client := newTestLBaaS(t, "metal-token")
+		config := tt.config
+		config.ProjectID, config.LoadBalancerSetting = projectID, "equinixmetal://lctnloc-1"
+		l := newLoadBalancers(config, nil, nil, client)
+		l.clusterID = "9a1c2b3d-0000-4000-8000-000000000000"
+		l.location = "lctnloc-1"
+		l.k8sclient = fake.NewSimpleClientset(a1, service("team-b", "new"), service("team-a", "new"))
+		recorder := record.NewFakeRecorder(10)
+		l.recorder = recorder
+		for _, name := range []string{l.GetLoadBalancerName(ctx, "", a1), "metal-other-team-a-0000000000"} {
+			id := f.id("lb")
+			f.lbs[id] = &lbaasLoadBalancer{ID: id, Name: name, IPs: []string{"147.75.0.9"}, Ports: []lbaasPort{}}
+		}
+		before := len(f.lbs)
+		_, err := l.EnsureLoadBalancer(ctx, "kubernetes", tt.svc, nil)
+		if (err != nil) != (tt.reason != "") {
+			t.Errorf("%d: mismatched error, actual %v expected %q", i, err, tt.reason)
+		}
+		var reasons []string
+		for len(recorder.Events) > 0 {
+			reasons = append(reasons, <-recorder.Events)
+		}
+		if tt.reason != "" && (len(reasons) != 1 || !strings.Contains(reasons[0], tt.reason)) {
+			t.Errorf("%d: mismatched events, actual %v expected %s", i, reasons, tt.reason)
+		}
+		if created := len(f.lbs) - before; (created == 1) != (tt.reason == "" && tt.svc != a1) {
+			t.Errorf("%d: mismatched load balancers created, actual %d", i, created)
+		}
+	}
+}
+
+func TestManagedLoadBalancerInvalid(t *testing.T) {
+	ctx := context.Background()
+	f, client := newTestLBaaS(t, "metal-token")
+	l := newLoadBalancers(Config{ProjectID: projectID, LoadBalancerSetting: "equinixmetal://lctnloc-1"}, nil, nil, client)
+	l.location = "lctnloc-1"
+	l.recorder = record.NewFakeRecorder(10)
+	tests := []struct {
+		annotations map[string]string
+		spec        v1.ServiceSpec
+	}{
+		{nil, v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 53, Protocol: v1.ProtocolUDP}}}},
+		{nil, v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 80}}, LoadBalancerSourceRanges: []string{"10.0.0.0/8"}}},
+		{map[string]string{annotationProxyProtocol: "v3"}, v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 80}}}},
+	}
+	for i, tt := range tests {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web", Annotations: tt.annotations}, Spec: tt.spec}
+		if _, err := l.EnsureLoadBalancer(ctx, "kubernetes", svc, nil); err == nil {
+			t.Errorf("%d: expected error", i)
+		}
+	}
+	if len(f.lbs) != 0 {
+		t.Errorf("mismatched load balancers, actual %d expected none", len(f.lbs))
+	}
+}
+
+func TestManagedLoadBalancerProxyProtocol(t *testing.T) {
+	ctx := context.Background()
+	f, client := newTestLBaaS(t, "metal-token")
+	l := newLoadBalancers(Config{ProjectID: projectID, LoadBalancerSetting: "equinixmetal://lctnloc-1"}, nil, nil, client)
+	l.location = "lctnloc-1"
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web", Annotations: map[string]string{annotationProxyProtocol: proxyProtocolV2}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 80, NodePort: 30001}, {Port: 443, NodePort: 30002}}},
+	}
+	nodes := []*v1.Node{testManagedNode("worker-1", "10.0.0.1", "147.75.1.1")}
+	recorder := record.NewFakeRecorder(10)
+	l.recorder = recorder
+	tests := []struct {
+		setting  string
+		expected string
+		event    bool
+	}{
+		// the ports are created with it
+		{proxyProtocolV2, proxyProtocolV2, false},
+		{proxyProtocolV1, proxyProtocolV1, false},
+		// invalid, the ports are left as they are, and it is reported once
+		{"forwarded", proxyProtocolV1, true},
+		{"forwarded", proxyProtocolV1, false},
+		// removed, the ports pass no client IP
+		{"", "", false},
+	}
+	for i, tt := range tests {
+		svc.Annotations[annotationProxyProtocol] = tt.setting
+		if _, err := l.EnsureLoadBalancer(ctx, "kubernetes", svc, nodes); (err != nil) != (tt.setting == "forwarded") {
+			t.Fatalf("%d: mismatched error, actual %v", i, err)
+		}
+		var event string
+		if len(recorder.Events) > 0 {
+			event = <-recorder.Events
+		}
+		if (event != "") != tt.event || (tt.event && !strings.Contains(event, eventReasonProxyProtocolUnsupported)) {
+			t.Errorf("%d: mismatched event, actual %q expected %v", i, event, tt.event)
+		}
+		for _, lb := range f.lbs {
+			if len(lb.Ports) != 2 {
+				t.Fatalf("%d: mismatched ports, actual %d expected 2", i, len(lb.Ports))
+			}
+			for _, port := range lb.Ports {
+				if port.ProxyProtocol != tt.expected {
+					t.Errorf("%d: mismatched proxy protocol of port %d, actual %q expected %q", i, port.Number, port.ProxyProtocol, tt.expected)
+				}
+			}
+		}
+	}
+}
+
+func TestManagedLoadBalancerOtherTypes(t *testing.T) {
+	for _, setting := range []string{"", "metallb:///metallb-system/config", "empty://"} {
+		l := newLoadBalancers(Config{ProjectID: projectID, LoadBalancerSetting: setting}, nil, nil, nil)
+		if l.managed() {
+			t.Errorf("%q: expected load balancers not to be managed", setting)
+		}
+		c := &cloud{loadBalancer: l}
+		if _, ok := c.LoadBalancer(); ok {
+			t.Errorf("%q: expected no load balancer interface", setting)
+		}
+	}
+}
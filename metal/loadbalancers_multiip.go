@@ -0,0 +1,216 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotationEIPCount set on a service to the number of Elastic IPs it gets, e.g. 2 for one for its TCP
+	// and one for its UDP listeners; the first is its spec.loadBalancerIP, as for any other service
+	annotationEIPCount = "metal.equinix.com/eip-count"
+	// annotationEIPAddresses set by the CCM on a service with more than one Elastic IP, to all of them, comma separated
+	annotationEIPAddresses = "metal.equinix.com/eip-addresses"
+	// tagKeyServiceIP the structured tag with the index of each additional IP of a service, from 1; the first has none
+	tagKeyServiceIP = "service-ip"
+	// maxServiceEIPs the most Elastic IPs a single service can get
+	maxServiceEIPs = 8
+
+	eventReasonInvalidEIPCount = "InvalidEIPCount"
+)
+
+// serviceEIPCount the number of Elastic IPs a service asks for, 1 unless annotated otherwise
+func serviceEIPCount(svc *v1.Service) (int, error) {
+	v, ok := svc.Annotations[annotationEIPCount]
+	if !ok || v == "" {
+		return 1, nil
+	}
+	count, err := strconv.Atoi(v)
+	if err != nil || count < 1 || count > maxServiceEIPs {
+		return 0, fmt.Errorf("annotation %s must be a number from 1 to %d, was %q", annotationEIPCount, maxServiceEIPs, v)
+	}
+	return count, nil
+}
+
+// serviceIPIndex the index of a reservation among the IPs of its service: 0 for the first, i.e. the
+// spec.loadBalancerIP of the service, or the index of an additional one
+func serviceIPIndex(ip *packngo.IPAddressReservation) int {
+	for _, tag := range ip.Tags {
+		key, value, ok := parseStructuredTag(tag)
+		if !ok || key != tagKeyServiceIP {
+			continue
+		}
+		if index, err := strconv.Atoi(value); err == nil && index > 0 {
+			return index
+		}
+	}
+	return 0
+}
+
+// serviceExtraReservations the reservations of the additional IPs of a service, by their index
+func (l *loadBalancers) serviceExtraReservations(svc *v1.Service, ips []packngo.IPAddressReservation) map[int]*packngo.IPAddressReservation {
+	extras := map[int]*packngo.IPAddressReservation{}
+	for _, ip := range ipReservationsByStructuredTags(l.serviceReservationTags(svc), ips) {
+		if index := serviceIPIndex(ip); index > 0 && extras[index] == nil {
+			extras[index] = ip
+		}
+	}
+	return extras
+}
+
+// syncServiceExtraIPs give a service with a first IP, svcIP, as many additional IPs as it asks for,
+// and an IPv6 one if it is dual-stack, announce them, and release those it no longer asks for. All of
+// its IPs are set in the status of the service, as the load balancer implementation sets only its
+// first, and in annotationEIPAddresses.
+func (l *loadBalancers) syncServiceExtraIPs(ctx context.Context, svc *v1.Service, svcIP string, ips []packngo.IPAddressReservation) error {
+	svcName := serviceRep(svc)
+	// validated before the first IP was allocated
+	count, _ := serviceEIPCount(svc)
+	extras := l.serviceExtraReservations(svc, ips)
+	dualStack, ipv6 := serviceDualStack(svc), l.serviceIPv6Reservation(svc, ips)
+	if count == 1 && len(extras) == 0 && !dualStack && ipv6 == nil && svc.Annotations[annotationEIPAddresses] == "" {
+		return nil
+	}
+	var errs []error
+	for index, ip := range extras {
+		if index < count {
+			continue
+		}
+		klog.V(2).Infof("releasing additional IP %s of service %s, which asks for %d", ip.Address, svcName, count)
+		if err := l.releaseServiceExtraIP(ctx, ip); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	addresses := []string{svcIP}
+	for index := 1; index < count; index++ {
+		ip := extras[index]
+		if ip == nil {
+			if err := l.checkIPQuota(ctx, svc, ips); err != nil {
+				errs = append(errs, err)
+				break
+			}
+			klog.V(2).Infof("no additional IP %d found for %s, requesting", index, svcName)
+			lbTag := loadBalancerTagPrefix + l.GetLoadBalancerName(ctx, "", svc)
+			indexTag := fmt.Sprintf("%s=%d", tagKeyServiceIP, index)
+			var err error
+			if ip, _, err = l.allocateServiceIP(ctx, svcName, v1.IPv4Protocol, l.serviceReservationTagList(svc, lbTag, indexTag), ips); err != nil {
+				errs = append(errs, err)
+				break
+			}
+			// the next quota check counts it
+			ips = append(ips, *ip)
+		}
+		// each IP in a pool of its own, as pools are named after their service
+		if err := l.addServiceToImplementor(ctx, svc, fmt.Sprintf("%s-%d", svcName, index), fmt.Sprintf("%s/%d", ip.Address, ip.CIDR)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addresses = append(addresses, ip.Address)
+	}
+	switch {
+	case !dualStack && ipv6 != nil:
+		klog.V(2).Infof("releasing IPv6 IP %s of service %s, which is no longer dual-stack", ipv6.Address, svcName)
+		if err := l.releaseServiceExtraIP(ctx, ipv6); err != nil {
+			errs = append(errs, err)
+		}
+	case dualStack:
+		if address, err := l.syncServiceIPv6(ctx, svc, ipv6, ips); err != nil {
+			errs = append(errs, err)
+		} else {
+			addresses = append(addresses, address)
+		}
+	}
+	if err := l.reportServiceIPs(ctx, svc, addresses); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// syncServiceIPv6 give a dual-stack service its IPv6 IP, ipv6, or a new one if it has none yet, and
+// announce it, returning its address
+func (l *loadBalancers) syncServiceIPv6(ctx context.Context, svc *v1.Service, ipv6 *packngo.IPAddressReservation, ips []packngo.IPAddressReservation) (string, error) {
+	svcName := serviceRep(svc)
+	if ipv6 == nil {
+		if err := l.checkIPQuota(ctx, svc, ips); err != nil {
+			return "", err
+		}
+		klog.V(2).Infof("no IPv6 IP found for dual-stack service %s, requesting", svcName)
+		lbTag := loadBalancerTagPrefix + l.GetLoadBalancerName(ctx, "", svc)
+		var err error
+		if ipv6, _, err = l.allocateServiceIP(ctx, svcName, v1.IPv6Protocol, l.serviceReservationTagList(svc, lbTag), ips); err != nil {
+			return "", err
+		}
+	}
+	// in a pool of its own, as pools are named after their service
+	if err := l.addServiceToImplementor(ctx, svc, svcName+"-ipv6", fmt.Sprintf("%s/%d", ipv6.Address, ipv6.CIDR)); err != nil {
+		return "", err
+	}
+	return ipv6.Address, nil
+}
+
+// releaseServiceExtraIP stop announcing an additional IP of a service and release it
+func (l *loadBalancers) releaseServiceExtraIP(ctx context.Context, ip *packngo.IPAddressReservation) error {
+	if err := l.implementor.RemoveService(ctx, fmt.Sprintf("%s/%d", ip.Address, ip.CIDR)); err != nil {
+		return fmt.Errorf("error removing additional IP %s from configmap: %w", ip.Address, err)
+	}
+	return l.releaseServiceIP(ctx, ip)
+}
+
+// reportServiceIPs set all the IPs of a service in its annotationEIPAddresses, or remove that once
+// the service has only one, and in the ingress of its status, if either differs
+func (l *loadBalancers) reportServiceIPs(ctx context.Context, svc *v1.Service, addresses []string) error {
+	svcName := serviceRep(svc)
+	var annotation string
+	if len(addresses) > 1 {
+		annotation = strings.Join(addresses, ",")
+	}
+	if svc.Annotations[annotationEIPAddresses] != annotation {
+		// null removes the annotation
+		var value interface{}
+		if annotation != "" {
+			value = annotation
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{annotationEIPAddresses: value},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode patch of service %s: %w", svcName, err)
+		}
+		if _, err := l.k8sclient.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return fmt.Errorf("failed to set IPs of service %s: %w", svcName, err)
+		}
+	}
+	ingress := make([]v1.LoadBalancerIngress, 0, len(addresses))
+	for _, address := range addresses {
+		ingress = append(ingress, v1.LoadBalancerIngress{IP: address})
+	}
+	if reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, ingress) {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"loadBalancer": v1.LoadBalancerStatus{Ingress: ingress},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode status patch of service %s: %w", svcName, err)
+	}
+	if _, err := l.k8sclient.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+		return fmt.Errorf("failed to set ingress IPs of service %s: %w", svcName, err)
+	}
+	klog.V(2).Infof("set ingress IPs of service %s to %v", svcName, addresses)
+	return nil
+}
@@ -0,0 +1,173 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// testIPAllocator an ipAllocator that hands out IPs from 147.75.100.1 on, or 2604:1380:100::1 on for
+// IPv6, and keeps them in memory
+type testIPAllocator struct {
+	ips  []packngo.IPAddressReservation
+	next int
+}
+
+func (a *testIPAllocator) list(ctx context.Context) ([]packngo.IPAddressReservation, error) {
+	return append([]packngo.IPAddressReservation(nil), a.ips...), nil
+}
+
+func (a *testIPAllocator) allocate(ctx context.Context, svcName string, family v1.IPFamily, tags []string) (*packngo.IPAddressReservation, string, error) {
+	a.next++
+	ip := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+		ID:      fmt.Sprintf("ip-%d", a.next),
+		Address: fmt.Sprintf("147.75.100.%d", a.next),
+		CIDR:    32,
+		Tags:    tags,
+	}}
+	if family == v1.IPv6Protocol {
+		ip.Address, ip.CIDR = fmt.Sprintf("2604:1380:100::%d", a.next), 128
+	}
+	a.ips = append(a.ips, ip)
+	return &ip, "", nil
+}
+
+func (a *testIPAllocator) release(ctx context.Context, ip *packngo.IPAddressReservation) error {
+	for i := range a.ips {
+		if a.ips[i].ID == ip.ID {
+			a.ips = append(a.ips[:i], a.ips[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no IP %s", ip.ID)
+}
+
+func (a *testIPAllocator) update(id string, tags []string, description string) error {
+	for i := range a.ips {
+		if a.ips[i].ID == id {
+			a.ips[i].Tags = tags
+			return nil
+		}
+	}
+	return fmt.Errorf("no IP %s", id)
+}
+
+func TestServiceEIPCount(t *testing.T) {
+	tests := []struct {
+		annotation string
+		count      int
+		err        bool
+	}{
+		{"", 1, false},
+		{"1", 1, false},
+		{"3", 3, false},
+		{"0", 0, true},
+		{"9", 0, true},
+		{"two", 0, true},
+	}
+	for i, tt := range tests {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationEIPCount: tt.annotation}}}
+		count, err := serviceEIPCount(svc)
+		if (err != nil) != tt.err || count != tt.count {
+			t.Errorf("%d: mismatched count, actual %d %v expected %d error %v", i, count, err, tt.count, tt.err)
+		}
+	}
+}
+
+func TestAddServiceMultipleIPs(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns", UID: "uid-dns", Annotations: map[string]string{annotationEIPCount: "3"}},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Port: 53, Protocol: v1.ProtocolTCP}, {Port: 53, Protocol: v1.ProtocolUDP}},
+		},
+	}
+	client := fake.NewSimpleClientset(svc)
+	lb := &testServicesLB{added: map[string]string{}}
+	allocator := &testIPAllocator{}
+	l := newLoadBalancers(Config{ProjectID: projectID}, &packngo.Client{ProjectIPs: &countingProjectIPService{}}, nil, nil)
+	l.k8sclient = client
+	l.recorder = record.NewFakeRecorder(10)
+	l.implementor = lb
+	l.ipAllocator = allocator
+
+	// the CCM reconciles the service as it finds it each time
+	reconcile := func() *v1.Service {
+		current, err := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error getting service: %v", err)
+		}
+		ips, _ := allocator.list(ctx)
+		if err := l.addService(ctx, current, ips); err != nil {
+			t.Fatalf("unexpected error adding service: %v", err)
+		}
+		current, _ = client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		return current
+	}
+
+	tests := []struct {
+		count     string
+		addresses string
+		ingress   []string
+		ips       int
+	}{
+		{"3", "147.75.100.1,147.75.100.2,147.75.100.3", []string{"147.75.100.1", "147.75.100.2", "147.75.100.3"}, 3},
+		// again, nothing changes
+		{"3", "147.75.100.1,147.75.100.2,147.75.100.3", []string{"147.75.100.1", "147.75.100.2", "147.75.100.3"}, 3},
+		{"2", "147.75.100.1,147.75.100.2", []string{"147.75.100.1", "147.75.100.2"}, 2},
+		{"1", "", []string{"147.75.100.1"}, 1},
+	}
+	for i, tt := range tests {
+		current, _ := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		current.Annotations[annotationEIPCount] = tt.count
+		if _, err := client.CoreV1().Services(svc.Namespace).Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("%d: unexpected error updating service: %v", i, err)
+		}
+		current = reconcile()
+		if current.Spec.LoadBalancerIP != "147.75.100.1" {
+			t.Errorf("%d: mismatched loadBalancerIP, actual %s expected 147.75.100.1", i, current.Spec.LoadBalancerIP)
+		}
+		if addresses := current.Annotations[annotationEIPAddresses]; addresses != tt.addresses {
+			t.Errorf("%d: mismatched addresses, actual %q expected %q", i, addresses, tt.addresses)
+		}
+		var ingress []string
+		for _, in := range current.Status.LoadBalancer.Ingress {
+			ingress = append(ingress, in.IP)
+		}
+		if !reflect.DeepEqual(ingress, tt.ingress) {
+			t.Errorf("%d: mismatched ingress, actual %v expected %v", i, ingress, tt.ingress)
+		}
+		if len(allocator.ips) != tt.ips {
+			t.Errorf("%d: mismatched reservations, actual %d expected %d", i, len(allocator.ips), tt.ips)
+		}
+	}
+	if lb.added["default/dns"] != "147.75.100.1/32" || lb.added["default/dns-1"] != "147.75.100.2/32" || lb.added["default/dns-2"] != "147.75.100.3/32" {
+		t.Errorf("mismatched announced IPs, actual %v", lb.added)
+	}
+
+	// removing the service releases them all
+	current, _ := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	current.Annotations[annotationEIPCount] = "2"
+	if _, err := client.CoreV1().Services(svc.Namespace).Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error updating service: %v", err)
+	}
+	current = reconcile()
+	if len(allocator.ips) != 2 {
+		t.Fatalf("mismatched reservations before removal, actual %d expected 2", len(allocator.ips))
+	}
+	ips, _ := allocator.list(ctx)
+	if err := l.removeService(ctx, current, ips); err != nil {
+		t.Fatalf("unexpected error removing service: %v", err)
+	}
+	if len(allocator.ips) != 0 {
+		t.Errorf("mismatched reservations after removal, actual %v expected none", allocator.ips)
+	}
+}
@@ -0,0 +1,64 @@
+package metal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultLoadBalancerNameFormat the name of the load balancer of a service by default, see loadBalancerName
+	DefaultLoadBalancerNameFormat = "metal-{cluster}-{namespace}-{hash}"
+	// loadBalancerTagPrefix the tag on the IP reservation of a service with the name of its load balancer
+	loadBalancerTagPrefix = "loadbalancer="
+)
+
+// loadBalancerNameLiteral what a load balancer name format may contain besides its placeholders
+var loadBalancerNameLiteral = regexp.MustCompile(`^[a-z0-9.-]*$`)
+
+// loadBalancerNameReplacer the placeholders of a load balancer name format, for a service
+func loadBalancerNameReplacer(clusterID string, svc *v1.Service) *strings.Replacer {
+	hash := sha256.Sum256([]byte(serviceRep(svc)))
+	if len(clusterID) > 8 {
+		clusterID = clusterID[:8]
+	}
+	return strings.NewReplacer(
+		"{cluster}", clusterID,
+		"{namespace}", svc.Namespace,
+		"{name}", svc.Name,
+		"{hash}", hex.EncodeToString(hash[:])[:10],
+	)
+}
+
+// ValidateLoadBalancerNameFormat return an error if the setting is not a valid load balancer name
+// format: lower case letters, digits, '.' and '-', and the placeholders {cluster}, {namespace},
+// {name} and {hash}, of which it must have either {hash} or both {namespace} and {name}, so that
+// each service gets its own name
+func ValidateLoadBalancerNameFormat(setting string) error {
+	if setting == "" {
+		return nil
+	}
+	literal := strings.NewReplacer("{cluster}", "", "{namespace}", "", "{name}", "", "{hash}", "").Replace(setting)
+	if !loadBalancerNameLiteral.MatchString(literal) {
+		return fmt.Errorf("invalid load balancer name format %q, only lower case letters, digits, '.', '-' and the placeholders {cluster}, {namespace}, {name} and {hash} are allowed", setting)
+	}
+	hasHash := strings.Contains(setting, "{hash}")
+	if !hasHash && (!strings.Contains(setting, "{namespace}") || !strings.Contains(setting, "{name}")) {
+		return fmt.Errorf("invalid load balancer name format %q, must have {hash}, or both {namespace} and {name}", setting)
+	}
+	return nil
+}
+
+// loadBalancerName the name of the load balancer of a service, from the format: {cluster} the first
+// characters of the cluster ID, {namespace} and {name} those of the service, and {hash} the first
+// characters of the sha256 hash of both
+func loadBalancerName(format, clusterID string, svc *v1.Service) string {
+	if format == "" {
+		format = DefaultLoadBalancerNameFormat
+	}
+	return loadBalancerNameReplacer(clusterID, svc).Replace(format)
+}
@@ -0,0 +1,86 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestGetLoadBalancerName(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"}}
+	other := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "api"}}
+	tests := []struct {
+		format   string
+		expected string
+		other    string
+	}{
+		{"", "metal-9a1c2b3d-shop-97375646b1", "metal-9a1c2b3d-shop-737a40b9f8"},
+		{"{namespace}.{name}", "shop.web", "shop.api"},
+		{"prod-{cluster}-{name}-{hash}", "prod-9a1c2b3d-web-97375646b1", "prod-9a1c2b3d-api-737a40b9f8"},
+	}
+	for i, tt := range tests {
+		l := newLoadBalancers(Config{ProjectID: projectID, LBNameFormat: tt.format}, nil, nil, nil)
+		l.clusterID = "9a1c2b3d-0000-4000-8000-000000000000"
+		if name := l.GetLoadBalancerName(context.Background(), "kubernetes", svc); name != tt.expected {
+			t.Errorf("%d: mismatched name, actual %q expected %q", i, name, tt.expected)
+		}
+		if name := l.GetLoadBalancerName(context.Background(), "kubernetes", other); name != tt.other {
+			t.Errorf("%d: mismatched name of other service, actual %q expected %q", i, name, tt.other)
+		}
+	}
+}
+
+func TestLoadBalancerNameTag(t *testing.T) {
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Port: 443}}},
+	}
+	allocator := &testIPAllocator{}
+	l := newLoadBalancers(Config{ProjectID: projectID, LBNameFormat: "prod-{cluster}-{name}-{hash}"}, &packngo.Client{ProjectIPs: &countingProjectIPService{}}, nil, nil)
+	l.clusterID = "9a1c2b3d-0000-4000-8000-000000000000"
+	l.k8sclient = fake.NewSimpleClientset(svc)
+	l.recorder = record.NewFakeRecorder(10)
+	l.implementor = &testServicesLB{added: map[string]string{}}
+	l.ipAllocator = allocator
+	if err := l.addService(ctx, svc, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(allocator.ips) != 1 {
+		t.Fatalf("mismatched reservations, actual %d expected 1", len(allocator.ips))
+	}
+	// the reservation is tagged with the name of the load balancer, for operators to find it
+	var found bool
+	for _, tag := range allocator.ips[0].Tags {
+		found = found || tag == "loadbalancer=prod-9a1c2b3d-web-97375646b1"
+	}
+	if !found {
+		t.Errorf("mismatched tags, actual %v expected loadbalancer=prod-9a1c2b3d-web-97375646b1", allocator.ips[0].Tags)
+	}
+}
+
+func TestValidateLoadBalancerNameFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		valid  bool
+	}{
+		{"", true},
+		{DefaultLoadBalancerNameFormat, true},
+		{"{namespace}.{name}", true},
+		{"lb-{hash}", true},
+		{"lb-{name}", false},
+		{"LB-{hash}", false},
+		{"lb_{hash}", false},
+		{"lb-{uid}-{hash}", false},
+	}
+	for i, tt := range tests {
+		if err := ValidateLoadBalancerNameFormat(tt.format); (err == nil) != tt.valid {
+			t.Errorf("%d: mismatched validity, actual %v expected %v", i, err, tt.valid)
+		}
+	}
+}
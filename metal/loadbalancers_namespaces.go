@@ -0,0 +1,50 @@
+package metal
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventReasonNamespaceNotAllowed = "LoadBalancerNamespaceNotAllowed"
+)
+
+// namespaceAllowed whether the CCM manages the load balancer services of a namespace, and if not, why:
+// with allowed namespaces, only those; never any of the excluded ones
+func (l *loadBalancers) namespaceAllowed(namespace string) (bool, string) {
+	for _, ns := range l.excludedNamespaces {
+		if ns == namespace {
+			return false, fmt.Sprintf("namespace %s is excluded from load balancer services", namespace)
+		}
+	}
+	if len(l.namespaces) == 0 {
+		return true, ""
+	}
+	for _, ns := range l.namespaces {
+		if ns == namespace {
+			return true, ""
+		}
+	}
+	return false, fmt.Sprintf("namespace %s is not one of the namespaces allowed load balancer services", namespace)
+}
+
+// filterServiceNamespaces split the services into those in namespaces the CCM manages,
+// and those it leaves alone. When told, it records an event on each service left alone,
+// saying why it gets no IP.
+func (l *loadBalancers) filterServiceNamespaces(svcs []*v1.Service, report bool) (allowed, denied []*v1.Service) {
+	for _, svc := range svcs {
+		ok, reason := l.namespaceAllowed(svc.Namespace)
+		if ok {
+			allowed = append(allowed, svc)
+			continue
+		}
+		denied = append(denied, svc)
+		klog.V(2).Infof("loadbalancer.reconcileServices(): not managing service %s: %s", serviceRep(svc), reason)
+		if report {
+			l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonNamespaceNotAllowed, "Not allocating a load balancer IP: %s", reason)
+		}
+	}
+	return allowed, denied
+}
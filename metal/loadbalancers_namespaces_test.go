@@ -0,0 +1,72 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReconcileServicesNamespaces(t *testing.T) {
+	service := func(namespace, ip string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "web"},
+			Spec: v1.ServiceSpec{
+				Type:           v1.ServiceTypeLoadBalancer,
+				LoadBalancerIP: ip,
+				Ports:          []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+	}
+	svcs := []*v1.Service{
+		service("team-a", "147.75.100.2"),
+		service("team-b", "147.75.100.3"),
+		service("kube-system", "147.75.100.4"),
+	}
+	tests := []struct {
+		namespaces []string
+		excluded   []string
+		added      []string
+	}{
+		{nil, nil, []string{"kube-system/web", "team-a/web", "team-b/web"}},
+		{[]string{"team-a", "team-b"}, nil, []string{"team-a/web", "team-b/web"}},
+		{nil, []string{"kube-system"}, []string{"team-a/web", "team-b/web"}},
+		// excluded wins over allowed
+		{[]string{"team-a", "team-b"}, []string{"team-b"}, []string{"team-a/web"}},
+	}
+	for i, tt := range tests {
+		lb := &testServicesLB{added: map[string]string{}}
+		recorder := record.NewFakeRecorder(10)
+		l := newLoadBalancers(Config{ProjectID: projectID, LBNamespaces: tt.namespaces, LBExcludedNamespaces: tt.excluded}, &packngo.Client{ProjectIPs: &countingProjectIPService{}}, nil, nil)
+		l.k8sclient = fake.NewSimpleClientset(svcs[0], svcs[1], svcs[2])
+		l.recorder = recorder
+		l.implementor = lb
+		if err := l.reconcileServices(context.Background(), svcs, ModeAdd); err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		var added []string
+		for svc := range lb.added {
+			added = append(added, svc)
+		}
+		sort.Strings(added)
+		if !reflect.DeepEqual(added, tt.added) {
+			t.Errorf("%d: mismatched added services, actual %v expected %v", i, added, tt.added)
+		}
+		var denied int
+		for len(recorder.Events) > 0 {
+			if strings.Contains(<-recorder.Events, eventReasonNamespaceNotAllowed) {
+				denied++
+			}
+		}
+		if denied != len(svcs)-len(tt.added) {
+			t.Errorf("%d: mismatched events, actual %d expected %d", i, denied, len(svcs)-len(tt.added))
+		}
+	}
+}
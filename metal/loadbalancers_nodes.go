@@ -0,0 +1,96 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// taintToBeDeletedByClusterAutoscaler the taint the cluster autoscaler sets on a node it is about to remove
+const taintToBeDeletedByClusterAutoscaler = "ToBeDeletedByClusterAutoscaler"
+
+// nodeUnavailableTaints the taints of a node that cannot serve traffic, or is about to be removed
+var nodeUnavailableTaints = map[string]bool{
+	v1.TaintNodeNotReady:                true,
+	v1.TaintNodeUnreachable:             true,
+	v1.TaintNodeNetworkUnavailable:      true,
+	taintToBeDeletedByClusterAutoscaler: true,
+}
+
+// nodeUnavailable why a node cannot receive traffic for load balancer IPs, empty if it can: it is not
+// ready, has no network, or is tainted as such or for removal. A node that has not reported its
+// conditions yet, e.g. one just registered, can.
+func nodeUnavailable(node *v1.Node) string {
+	for _, c := range node.Status.Conditions {
+		switch {
+		case c.Type == v1.NodeReady && c.Status != v1.ConditionTrue:
+			return fmt.Sprintf("condition %s is %s", c.Type, c.Status)
+		case c.Type == v1.NodeNetworkUnavailable && c.Status == v1.ConditionTrue:
+			return fmt.Sprintf("condition %s is %s", c.Type, c.Status)
+		}
+	}
+	for _, t := range node.Spec.Taints {
+		if nodeUnavailableTaints[t.Key] {
+			return fmt.Sprintf("tainted %s", t.Key)
+		}
+	}
+	return ""
+}
+
+// availableNodes the nodes that can receive traffic for load balancer IPs
+func availableNodes(nodes []*v1.Node) []*v1.Node {
+	available := []*v1.Node{}
+	for _, n := range nodes {
+		if reason := nodeUnavailable(n); reason != "" {
+			klog.V(2).Infof("loadbalancers: node %s is not a backend: %s", n.Name, reason)
+			continue
+		}
+		available = append(available, n)
+	}
+	return available
+}
+
+// nodeAvailabilityChanged reconcile a node whose availability changed as soon as it does,
+// rather than on the next sync: remove it from the backends once it becomes unavailable, so
+// that its load balancer IPs are no longer announced from it, and add it back once available
+func (l *loadBalancers) nodeAvailabilityChanged(ctx context.Context, old, node *v1.Node) {
+	before, after := nodeUnavailable(old), nodeUnavailable(node)
+	if (before == "") == (after == "") {
+		return
+	}
+	mode := ModeAdd
+	if after != "" {
+		klog.Infof("node %s became unavailable, %s, removing it from the load balancer backends", node.Name, after)
+		mode = ModeRemove
+	} else {
+		klog.Infof("node %s became available, adding it to the load balancer backends", node.Name)
+	}
+	if err := l.reconcileNodes(ctx, []*v1.Node{node}, mode); err != nil {
+		klog.Errorf("failed to reconcile node %s after its availability changed: %v", node.Name, err)
+	}
+}
+
+// watch follow the conditions and taints of the nodes, to change the backends as soon as a node
+// fails or recovers; the nodes watcher only passes nodes that are added or removed
+func (l *loadBalancers) watch(ctx context.Context) error {
+	if l.implementor == nil {
+		return nil
+	}
+	informer := informers.NewSharedInformerFactory(l.k8sclient, 0)
+	nodesInformer := informer.Core().V1().Nodes().Informer()
+	nodesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			l.nodeAvailabilityChanged(ctx, oldObj.(*v1.Node), newObj.(*v1.Node))
+		},
+	})
+	informer.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), nodesInformer.HasSynced) {
+		return fmt.Errorf("syncing caches failed")
+	}
+	klog.Info("load balancer node availability watcher started")
+	return nil
+}
@@ -0,0 +1,78 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/empty"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testNodeWithState(name string, ready, network v1.ConditionStatus, taints ...string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if ready != "" {
+		node.Status.Conditions = append(node.Status.Conditions, v1.NodeCondition{Type: v1.NodeReady, Status: ready})
+	}
+	if network != "" {
+		node.Status.Conditions = append(node.Status.Conditions, v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: network})
+	}
+	for _, key := range taints {
+		node.Spec.Taints = append(node.Spec.Taints, v1.Taint{Key: key, Effect: v1.TaintEffectNoSchedule})
+	}
+	return node
+}
+
+func TestNodeUnavailable(t *testing.T) {
+	tests := []struct {
+		node        *v1.Node
+		unavailable bool
+	}{
+		{testNodeWithState("new", "", ""), false},
+		{testNodeWithState("ready", v1.ConditionTrue, v1.ConditionFalse), false},
+		{testNodeWithState("notready", v1.ConditionFalse, v1.ConditionFalse), true},
+		{testNodeWithState("unknown", v1.ConditionUnknown, ""), true},
+		{testNodeWithState("nonetwork", v1.ConditionTrue, v1.ConditionTrue), true},
+		{testNodeWithState("unreachable", v1.ConditionTrue, "", v1.TaintNodeUnreachable), true},
+		{testNodeWithState("scaledown", v1.ConditionTrue, "", taintToBeDeletedByClusterAutoscaler), true},
+		{testNodeWithState("other", v1.ConditionTrue, "", "dedicated"), false},
+	}
+	for i, tt := range tests {
+		if unavailable := nodeUnavailable(tt.node) != ""; unavailable != tt.unavailable {
+			t.Errorf("%d: mismatched unavailable, actual %t expected %t", i, unavailable, tt.unavailable)
+		}
+	}
+}
+
+// testNodesLB a load balancer implementation that records the nodes removed from it
+type testNodesLB struct {
+	empty.LB
+	removed []string
+}
+
+func (l *testNodesLB) RemoveNode(ctx context.Context, nodeName string) error {
+	l.removed = append(l.removed, nodeName)
+	return nil
+}
+
+func TestNodeAvailabilityChanged(t *testing.T) {
+	lb := &testNodesLB{}
+	l := newLoadBalancers(Config{ProjectID: projectID}, nil, nil, nil)
+	l.implementor = lb
+	ctx := context.Background()
+
+	ready := testNodeWithState("worker-1", v1.ConditionTrue, v1.ConditionFalse)
+	notReady := testNodeWithState("worker-1", v1.ConditionFalse, v1.ConditionFalse)
+	noNetwork := testNodeWithState("worker-1", v1.ConditionFalse, v1.ConditionTrue)
+
+	// still ready, e.g. a heartbeat: nothing to do
+	l.nodeAvailabilityChanged(ctx, ready, ready)
+	// failed: removed at once
+	l.nodeAvailabilityChanged(ctx, ready, notReady)
+	// still unavailable, for another reason: nothing more to do
+	l.nodeAvailabilityChanged(ctx, notReady, noNetwork)
+	if !reflect.DeepEqual(lb.removed, []string{"worker-1"}) {
+		t.Errorf("mismatched removed nodes, actual %v expected [worker-1]", lb.removed)
+	}
+}
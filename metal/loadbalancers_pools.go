@@ -0,0 +1,87 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// annotationAddressPool set on a service to put its IP in the MetalLB address pool of that name,
+// which the services of e.g. a team share, instead of the default pool, see ValidateLBAddressPool
+const annotationAddressPool = "metal.equinix.com/address-pool"
+
+// ValidateLBAddressPool return an error if the setting is not a valid name of a MetalLB address pool;
+// empty means each service has a pool of its own, unless annotated with annotationAddressPool
+func ValidateLBAddressPool(setting string) error {
+	if setting == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(setting); len(errs) > 0 {
+		return fmt.Errorf("invalid address pool %q: %s", setting, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// addressPool the MetalLB address pool of the service: that of its annotation, else the default,
+// empty for a pool of its own
+func (l *loadBalancers) addressPool(svc *v1.Service) (string, error) {
+	if pool, ok := svc.Annotations[annotationAddressPool]; ok {
+		if err := ValidateLBAddressPool(pool); err != nil {
+			return "", fmt.Errorf("invalid annotation %s: %w", annotationAddressPool, err)
+		}
+		return pool, nil
+	}
+	return l.addressPoolDefault, nil
+}
+
+// addServiceToImplementor configure the IP of the service in the load balancer implementation, in the
+// address pool of the service, if it has one and the implementation supports pools, and inject the
+// pool as the MetalLB annotation on the service, so that MetalLB takes the IP from that pool
+func (l *loadBalancers) addServiceToImplementor(ctx context.Context, svc *v1.Service, svcName, svcIPCidr string) error {
+	pool, err := l.addressPool(svc)
+	if err != nil {
+		return err
+	}
+	poolLB, ok := l.implementor.(loadbalancers.PoolLB)
+	if pool == "" || !ok {
+		return l.implementor.AddService(ctx, svcName, svcIPCidr)
+	}
+	if err := poolLB.AddServiceToPool(ctx, svcName, svcIPCidr, pool); err != nil {
+		return err
+	}
+	return l.injectAddressPool(ctx, svc, pool)
+}
+
+// injectAddressPool set the MetalLB address pool annotation of the service, if it differs
+func (l *loadBalancers) injectAddressPool(ctx context.Context, svc *v1.Service, pool string) error {
+	existing := svc.Annotations[metallbAnnotation]
+	if existing == pool {
+		return nil
+	}
+	// the external apiserver service must not get an IP from MetalLB at all
+	if existing == metallbDisabledtag {
+		klog.V(2).Infof("service %s/%s has metallb disabled, not setting address pool %s", svc.Namespace, svc.Name, pool)
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{metallbAnnotation: pool},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode patch of service %s/%s: %w", svc.Namespace, svc.Name, err)
+	}
+	if _, err := l.k8sclient.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set address pool %s of service %s/%s: %w", pool, svc.Namespace, svc.Name, err)
+	}
+	klog.V(2).Infof("set address pool of service %s/%s to %s", svc.Namespace, svc.Name, pool)
+	return nil
+}
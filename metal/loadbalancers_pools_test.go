@@ -0,0 +1,94 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testPoolLB a load balancer implementation with address pools, that records the pool of each service
+type testPoolLB struct {
+	testServicesLB
+	pools map[string]string
+}
+
+func (l *testPoolLB) AddServiceToPool(ctx context.Context, svc, ip, pool string) error {
+	l.added[svc] = ip
+	l.pools[svc] = pool
+	return nil
+}
+
+func TestValidateLBAddressPool(t *testing.T) {
+	tests := []struct {
+		setting string
+		valid   bool
+	}{
+		{"", true},
+		{"team-a", true},
+		{"team.a", true},
+		{"Team_A", false},
+		{"-team", false},
+	}
+	for i, tt := range tests {
+		err := ValidateLBAddressPool(tt.setting)
+		if (err == nil) != tt.valid {
+			t.Errorf("%d: mismatched validity of %q, error %v", i, tt.setting, err)
+		}
+	}
+}
+
+func TestAddServiceToImplementorPools(t *testing.T) {
+	tests := []struct {
+		defaultPool string
+		annotations map[string]string
+		pool        string
+		injected    string
+		valid       bool
+	}{
+		// a pool of its own, as without pools
+		{"", nil, "", "", true},
+		{"shared", nil, "shared", "shared", true},
+		{"shared", map[string]string{annotationAddressPool: "team-a"}, "team-a", "team-a", true},
+		{"", map[string]string{annotationAddressPool: "team-a"}, "team-a", "team-a", true},
+		// metallb disabled on the service, the pool is configured, but not injected
+		{"shared", map[string]string{metallbAnnotation: metallbDisabledtag}, "shared", metallbDisabledtag, true},
+		{"", map[string]string{annotationAddressPool: "Team_A"}, "", "", false},
+	}
+	for i, tt := range tests {
+		ctx := context.Background()
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: tt.annotations},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerIP: "147.75.100.2"},
+		}
+		lb := &testPoolLB{testServicesLB: testServicesLB{added: map[string]string{}}, pools: map[string]string{}}
+		l := newLoadBalancers(Config{ProjectID: projectID}, &packngo.Client{}, nil, nil)
+		l.k8sclient = fake.NewSimpleClientset(svc)
+		l.implementor = lb
+		l.addressPoolDefault = tt.defaultPool
+		err := l.addServiceToImplementor(ctx, svc, "default/web", "147.75.100.2/32")
+		switch {
+		case (err == nil) != tt.valid:
+			t.Errorf("%d: mismatched error, actual %v expected valid %t", i, err, tt.valid)
+			continue
+		case err != nil:
+			continue
+		}
+		if lb.added["default/web"] != "147.75.100.2/32" {
+			t.Errorf("%d: service not added, %v", i, lb.added)
+		}
+		if pool := lb.pools["default/web"]; pool != tt.pool {
+			t.Errorf("%d: mismatched pool, actual %q expected %q", i, pool, tt.pool)
+		}
+		actual, err := l.k8sclient.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: unexpected error getting service: %v", i, err)
+		}
+		if injected := actual.Annotations[metallbAnnotation]; injected != tt.injected {
+			t.Errorf("%d: mismatched metallb annotation, actual %q expected %q", i, injected, tt.injected)
+		}
+	}
+}
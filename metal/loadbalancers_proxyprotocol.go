@@ -0,0 +1,65 @@
+package metal
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// annotationProxyProtocol how the load balancer of a service passes the client IP to its backends,
+	// with the PROXY protocol of version proxyProtocolV1 or proxyProtocolV2. Only the Equinix Metal
+	// managed load balancer has listeners that can do so; it is set on each of its ports, whose pools
+	// are TCP, so there are no HTTP headers to add the client IP to.
+	annotationProxyProtocol = "metal.equinix.com/proxy-protocol"
+	proxyProtocolV1         = "v1"
+	proxyProtocolV2         = "v2"
+
+	eventReasonProxyProtocolUnsupported = "ProxyProtocolUnsupported"
+)
+
+// serviceProxyProtocol how the service asks for the client IP to be passed to its backends;
+// empty if it does not
+func serviceProxyProtocol(svc *v1.Service) (string, error) {
+	switch setting := svc.Annotations[annotationProxyProtocol]; setting {
+	case "", proxyProtocolV1, proxyProtocolV2:
+		return setting, nil
+	default:
+		return "", fmt.Errorf("invalid annotation %s=%q, must be %s or %s", annotationProxyProtocol, setting, proxyProtocolV1, proxyProtocolV2)
+	}
+}
+
+// checkProxyProtocol record an event on a service that asks for the client IP to be passed to its
+// backends, as the load balancer implementations that announce Elastic IPs cannot do so. The service
+// still gets its IP; its backends see the client IP only with externalTrafficPolicy=Local. The event
+// is recorded once for each value of the annotation, rather than on each sync.
+func (l *loadBalancers) checkProxyProtocol(svc *v1.Service) {
+	setting := svc.Annotations[annotationProxyProtocol]
+	if !l.proxyProtocolChanged(serviceRep(svc), setting) || setting == "" {
+		return
+	}
+	if _, err := serviceProxyProtocol(svc); err != nil {
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonProxyProtocolUnsupported, "Ignoring %v", err)
+		return
+	}
+	l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonProxyProtocolUnsupported,
+		"Ignoring annotation %s=%s: load balancer %s does not terminate connections, only the %s load balancer can pass the client IP",
+		annotationProxyProtocol, setting, l.implementorType, lbTypeEquinixMetal)
+}
+
+// proxyProtocolChanged whether the proxy protocol annotation of the service differs from the one
+// it had when last checked, and remember it; an empty setting forgets the service
+func (l *loadBalancers) proxyProtocolChanged(svcName, setting string) bool {
+	l.proxyProtocolLock.Lock()
+	defer l.proxyProtocolLock.Unlock()
+	if l.proxyProtocols == nil {
+		l.proxyProtocols = map[string]string{}
+	}
+	last, ok := l.proxyProtocols[svcName]
+	if setting == "" {
+		delete(l.proxyProtocols, svcName)
+	} else {
+		l.proxyProtocols[svcName] = setting
+	}
+	return !ok || last != setting
+}
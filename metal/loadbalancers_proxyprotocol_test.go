@@ -0,0 +1,42 @@
+package metal
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckProxyProtocol(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	l := &loadBalancers{recorder: recorder, implementorType: lbTypeMetalLB}
+	// each a sync of the same service
+	tests := []struct {
+		annotations map[string]string
+		event       string
+	}{
+		{nil, ""},
+		{map[string]string{annotationProxyProtocol: proxyProtocolV2}, "only the equinixmetal load balancer"},
+		// unchanged, no event again
+		{map[string]string{annotationProxyProtocol: proxyProtocolV2}, ""},
+		{map[string]string{annotationProxyProtocol: proxyProtocolV1}, "only the equinixmetal load balancer"},
+		{map[string]string{annotationProxyProtocol: "forwarded"}, "invalid annotation"},
+		{map[string]string{annotationProxyProtocol: "v3"}, "invalid annotation"},
+		{map[string]string{annotationProxyProtocol: "v3"}, ""},
+		// removed and set again
+		{nil, ""},
+		{map[string]string{annotationProxyProtocol: proxyProtocolV1}, "only the equinixmetal load balancer"},
+	}
+	for i, tt := range tests {
+		l.checkProxyProtocol(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: tt.annotations}})
+		var event string
+		if len(recorder.Events) > 0 {
+			event = <-recorder.Events
+		}
+		if (tt.event == "") != (event == "") || !strings.Contains(event, tt.event) {
+			t.Errorf("%d: mismatched event, actual %q expected one with %q", i, event, tt.event)
+		}
+	}
+}
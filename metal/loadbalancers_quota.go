@@ -0,0 +1,99 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	eventReasonIPQuotaExceeded = "IPQuotaExceeded"
+)
+
+// checkIPQuota return an ErrIPQuotaExceeded error if requesting one more Elastic IP for the
+// service would take the cluster past the configured maximum of Elastic IPs for services,
+// in all or in the namespace of the service; 0 means no maximum
+func (l *loadBalancers) checkIPQuota(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	if l.maxIPs <= 0 && l.maxIPsPerNamespace <= 0 {
+		return nil
+	}
+	allocated := ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips)
+	if l.maxIPs > 0 && len(allocated) >= l.maxIPs {
+		return fmt.Errorf("%w: the cluster already has %d of at most %d", ErrIPQuotaExceeded, len(allocated), l.maxIPs)
+	}
+	if l.maxIPsPerNamespace <= 0 {
+		return nil
+	}
+	// the tags of a reservation name its service only by hash, so count the services of the namespace that have one
+	tags := map[string]bool{}
+	for _, ip := range allocated {
+		for _, tag := range ip.Tags {
+			tags[tag] = true
+		}
+	}
+	return l.checkNamespaceIPQuota(ctx, svc, func(other *v1.Service) bool {
+		return tags[serviceTag(other)]
+	})
+}
+
+// checkManagedIPQuota return an ErrIPQuotaExceeded error if creating a managed load balancer for
+// the service, which has an IP of its own, would take the cluster past the configured maximum, as
+// checkIPQuota does for Elastic IPs
+func (l *loadBalancers) checkManagedIPQuota(ctx context.Context, svc *v1.Service) error {
+	if l.maxIPs <= 0 && l.maxIPsPerNamespace <= 0 {
+		return nil
+	}
+	lbs, err := l.lbaas.listLoadBalancers(ctx, l.project)
+	if err != nil {
+		return fmt.Errorf("failed to list load balancers to check the quota: %w", err)
+	}
+	names := map[string]bool{}
+	for _, lb := range lbs {
+		names[lb.Name] = true
+	}
+	hasIP := func(other *v1.Service) bool {
+		return names[l.GetLoadBalancerName(ctx, "", other)]
+	}
+	if l.maxIPs > 0 {
+		// the project may have load balancers of other clusters, so count those of the services of this one
+		svcs, err := l.k8sclient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to list services to check the quota: %w", err)
+		}
+		var allocated int
+		for i := range svcs.Items {
+			if svcs.Items[i].Spec.Type == v1.ServiceTypeLoadBalancer && hasIP(&svcs.Items[i]) {
+				allocated++
+			}
+		}
+		if allocated >= l.maxIPs {
+			return fmt.Errorf("%w: the cluster already has %d of at most %d", ErrIPQuotaExceeded, allocated, l.maxIPs)
+		}
+	}
+	if l.maxIPsPerNamespace <= 0 {
+		return nil
+	}
+	return l.checkNamespaceIPQuota(ctx, svc, hasIP)
+}
+
+// checkNamespaceIPQuota return an ErrIPQuotaExceeded error if the other services in the namespace of the
+// service that have an IP are already at the configured maximum for a namespace
+func (l *loadBalancers) checkNamespaceIPQuota(ctx context.Context, svc *v1.Service, hasIP func(*v1.Service) bool) error {
+	svcs, err := l.k8sclient.CoreV1().Services(svc.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list services in namespace %s to check the quota: %w", svc.Namespace, err)
+	}
+	var count int
+	for i := range svcs.Items {
+		if svcs.Items[i].Name != svc.Name && hasIP(&svcs.Items[i]) {
+			count++
+		}
+	}
+	if count >= l.maxIPsPerNamespace {
+		return fmt.Errorf("%w: namespace %s already has %d of at most %d", ErrIPQuotaExceeded, svc.Namespace, count, l.maxIPsPerNamespace)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckIPQuota(t *testing.T) {
+	service := func(namespace, name string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+	}
+	reservation := func(svc *v1.Service) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Tags: []string{emTag, clusterTag("cluster"), serviceTag(svc)}}}
+	}
+	// two services in team-a and one in team-b have IPs, another reservation is not of this cluster
+	a1, a2, b1 := service("team-a", "one"), service("team-a", "two"), service("team-b", "one")
+	ips := []packngo.IPAddressReservation{
+		reservation(a1),
+		reservation(a2),
+		reservation(b1),
+		{IpAddressCommon: packngo.IpAddressCommon{Tags: []string{emTag, clusterTag("other")}}},
+	}
+	tests := []struct {
+		maxIPs, maxPerNamespace int
+		svc                     *v1.Service
+		exceeded                bool
+	}{
+		{0, 0, service("team-a", "new"), false},
+		{3, 0, service("team-b", "new"), true},
+		{4, 0, service("team-b", "new"), false},
+		{0, 2, service("team-a", "new"), true},
+		{0, 2, service("team-b", "new"), false},
+		// a service that already has an IP does not count against itself
+		{0, 2, a2, false},
+	}
+	for i, tt := range tests {
+		l := newLoadBalancers(Config{ProjectID: projectID, LBMaxIPs: tt.maxIPs, LBMaxIPsPerNamespace: tt.maxPerNamespace}, nil, nil, nil)
+		l.clusterID = "cluster"
+		l.k8sclient = fake.NewSimpleClientset(a1, a2, b1)
+		err := l.checkIPQuota(context.Background(), tt.svc, ips)
+		if exceeded := errors.Is(err, ErrIPQuotaExceeded); exceeded != tt.exceeded {
+			t.Errorf("%d: mismatched quota exceeded, actual %v expected %v", i, err, tt.exceeded)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// labelRack the rack of the device of a node, by the UUID of its top-of-rack switch, which is
+	// what the Equinix Metal API tells of where a device is within its facility
+	labelRack = "metal.equinix.com/rack"
+	// annotationAnnounceNodeSelector set by the CCM on a service, with rack spread enabled, to the
+	// node selector of the nodes that should announce its IP: those in the rack picked for the IP
+	annotationAnnounceNodeSelector = "metal.equinix.com/announce-node-selector"
+)
+
+// labelNodeRack label the node with the rack of its device
+func (i *instances) labelNodeRack(ctx context.Context, node *v1.Node, device *packngo.Device) error {
+	mergePatch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{labelRack: device.SwitchUUID},
+		},
+	})
+	if err := patchUpdatedNode(ctx, node.Name, mergePatch, i.k8sclient); err != nil {
+		return err
+	}
+	klog.V(2).Infof("labeled node %s with %s=%s", node.Name, labelRack, device.SwitchUUID)
+	return nil
+}
+
+// nodeRacks the racks of the nodes, sorted, of those that are labeled with one
+func nodeRacks(nodes []*v1.Node) []string {
+	seen := map[string]bool{}
+	racks := []string{}
+	for _, node := range nodes {
+		if rack := node.Labels[labelRack]; rack != "" && !seen[rack] {
+			seen[rack] = true
+			racks = append(racks, rack)
+		}
+	}
+	sort.Strings(racks)
+	return racks
+}
+
+// serviceIPRack the rack from which to announce a service IP: the one with the highest rendezvous
+// hash for the IP, so that the IPs spread across the racks, and a rack that comes or goes moves
+// only the IPs it gets or had; empty if there are no racks
+func serviceIPRack(ip string, racks []string) string {
+	var (
+		picked  string
+		highest uint64
+	)
+	for _, rack := range racks {
+		if h := candidateHash(ip, rack); picked == "" || h > highest {
+			picked, highest = rack, h
+		}
+	}
+	return picked
+}
+
+// spreadServiceIP set the node selector of the nodes in the rack picked for the IP of a service,
+// from the racks of the nodes of the last full sync, in annotationAnnounceNodeSelector. Without any
+// racks, e.g. before the first sync, the annotation is left as it is.
+func (l *loadBalancers) spreadServiceIP(ctx context.Context, svc *v1.Service, svcIP string) error {
+	if !l.rackSpread {
+		return nil
+	}
+	rack := serviceIPRack(svcIP, nodeRacks(l.knownNodes()))
+	if rack == "" {
+		klog.V(2).Infof("no racks known, not spreading IP %s of service %s", svcIP, serviceRep(svc))
+		return nil
+	}
+	selector := labels.SelectorFromSet(labels.Set{labelRack: rack}).String()
+	if svc.Annotations[annotationAnnounceNodeSelector] == selector {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annotationAnnounceNodeSelector: selector},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode patch of service %s: %w", serviceRep(svc), err)
+	}
+	if _, err := l.k8sclient.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to set announce node selector of service %s: %w", serviceRep(svc), err)
+	}
+	klog.V(2).Infof("set announce node selector of service %s with IP %s to %s", serviceRep(svc), svcIP, selector)
+	return nil
+}
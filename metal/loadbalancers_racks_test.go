@@ -0,0 +1,73 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestServiceIPRack(t *testing.T) {
+	racks := []string{"rack-a", "rack-b", "rack-c"}
+	if rack := serviceIPRack("147.75.100.1", nil); rack != "" {
+		t.Errorf("mismatched rack without racks, actual %s expected none", rack)
+	}
+	// without rack-c
+	others := []string{"rack-a", "rack-b"}
+	picked := map[string]int{}
+	for i := 1; i <= 60; i++ {
+		ip := fmt.Sprintf("147.75.100.%d", i)
+		rack := serviceIPRack(ip, racks)
+		picked[rack]++
+		// a rack that goes moves only the IPs it had
+		if after := serviceIPRack(ip, others); rack != "rack-c" && after != rack {
+			t.Errorf("%s: moved from %s to %s when another rack went", ip, rack, after)
+		}
+	}
+	for _, rack := range racks {
+		if picked[rack] == 0 {
+			t.Errorf("mismatched spread, no IPs for %s: %v", rack, picked)
+		}
+	}
+}
+
+func TestSpreadServiceIP(t *testing.T) {
+	ctx := context.Background()
+	node := func(name, rack string) *v1.Node {
+		n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if rack != "" {
+			n.Labels = map[string]string{labelRack: rack}
+		}
+		return n
+	}
+	tests := []struct {
+		rackSpread bool
+		nodes      []*v1.Node
+		expected   string
+	}{
+		{false, []*v1.Node{node("worker-1", "rack-a")}, ""},
+		{true, nil, ""},
+		{true, []*v1.Node{node("worker-1", "")}, ""},
+		{true, []*v1.Node{node("worker-1", "rack-a"), node("worker-2", "")}, labelRack + "=rack-a"},
+		{true, []*v1.Node{node("worker-1", "rack-a"), node("worker-2", "rack-b"), node("worker-3", "rack-a")}, labelRack + "=" + serviceIPRack("147.75.100.1", []string{"rack-a", "rack-b"})},
+	}
+	for i, tt := range tests {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+		client := fake.NewSimpleClientset(svc)
+		l := newLoadBalancers(Config{ProjectID: projectID}, &packngo.Client{}, nil, nil)
+		l.k8sclient = client
+		l.rackSpread = tt.rackSpread
+		l.setKnownNodes(tt.nodes)
+		if err := l.spreadServiceIP(ctx, svc, "147.75.100.1"); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		current, _ := client.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if selector := current.Annotations[annotationAnnounceNodeSelector]; selector != tt.expected {
+			t.Errorf("%d: mismatched selector, actual %q expected %q", i, selector, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ValidateLBReusePoolTag return an error if the setting is not a valid tag of a pool of idle IP
+// reservations to reuse; empty means there is none, and IPs are requested and released as needed
+func ValidateLBReusePoolTag(setting string) error {
+	if setting == "" {
+		return nil
+	}
+	if strings.HasPrefix(setting, keepUntilTagPrefix) || strings.HasPrefix(setting, loadBalancerTagPrefix) {
+		return fmt.Errorf("invalid reuse pool tag %q: the CCM tags reservations of services with it", setting)
+	}
+	if key, _, ok := parseStructuredTag(setting); ok {
+		switch key {
+		case tagKeyUsage, tagKeyCluster, tagKeyService, tagKeyServiceIP:
+			return fmt.Errorf("invalid reuse pool tag %q: the CCM tags reservations of services with key %s", setting, key)
+		}
+	}
+	return nil
+}
+
+// reusable whether a reservation is an idle one of the reuse pool, which a service can claim: in the
+// pool, a single public IPv4 address in the facility in which IPs are requested, or in no facility, e.g.
+// in a metro, assigned to no device, and not, or no longer, the reservation of any service
+func (l *loadBalancers) reusable(ip *packngo.IPAddressReservation) bool {
+	if !ip.Public || ip.Management || ip.AddressFamily != 4 || ip.CIDR != 32 || len(ip.Assignments) > 0 {
+		return false
+	}
+	var pooled bool
+	for _, tag := range ip.Tags {
+		if tag == l.reusePoolTag {
+			pooled = true
+		}
+		if key, _, ok := parseStructuredTag(tag); ok && (key == tagKeyService || key == tagKeyCluster) {
+			return false
+		}
+	}
+	if !pooled {
+		return false
+	}
+	return ip.Facility == nil || ip.Facility.Code == "" || ip.Facility.Code == l.facility
+}
+
+// allocateServiceIP claim an idle reservation of the reuse pool for a service, if there is a pool and
+// one in it, or else allocate a new one of the family, with the given tags, returning the metro in which it was reserved,
+// if it is not in the configured facility. A claimed reservation is retagged in ips as well, so that the next service
+// does not claim it, too.
+func (l *loadBalancers) allocateServiceIP(ctx context.Context, svcName string, family v1.IPFamily, tags []string, ips []packngo.IPAddressReservation) (*packngo.IPAddressReservation, string, error) {
+	// the pool holds IPv4 addresses only
+	if l.reusePoolTag == "" || family == v1.IPv6Protocol {
+		return l.ipAllocator.allocate(ctx, svcName, family, tags)
+	}
+	for i := range ips {
+		ip := &ips[i]
+		if !l.reusable(ip) {
+			continue
+		}
+		if err := l.ipAllocator.update(ip.ID, tags, ccmIPDescription); err != nil {
+			return nil, "", fmt.Errorf("unable to claim IP %s of reuse pool %s: %w", ip.Address, l.reusePoolTag, err)
+		}
+		klog.Infof("claimed IP %s of reuse pool %s for %s, rather than requesting a new one", ip.Address, l.reusePoolTag, svcName)
+		ip.Tags = tags
+		claimed := *ip
+		return &claimed, "", nil
+	}
+	klog.V(2).Infof("no idle IP in reuse pool %s for %s, requesting a new one", l.reusePoolTag, svcName)
+	return l.ipAllocator.allocate(ctx, svcName, family, tags)
+}
+
+// releaseServiceIP return a reservation no longer used by any service to the reuse pool, if there
+// is one and the reservation is IPv4, so that it is not lost, or else release it
+func (l *loadBalancers) releaseServiceIP(ctx context.Context, ip *packngo.IPAddressReservation) error {
+	if l.reusePoolTag == "" || reservationFamily(ip) == v1.IPv6Protocol {
+		return l.ipAllocator.release(ctx, ip)
+	}
+	if err := l.ipAllocator.update(ip.ID, []string{l.reusePoolTag}, ccmIPDescription); err != nil {
+		return fmt.Errorf("unable to return IP %s to reuse pool %s: %w", ip.Address, l.reusePoolTag, err)
+	}
+	klog.Infof("returned IP %s to reuse pool %s", ip.Address, l.reusePoolTag)
+	ip.Tags = []string{l.reusePoolTag}
+	return nil
+}
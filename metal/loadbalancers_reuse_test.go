@@ -0,0 +1,100 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestValidateLBReusePoolTag(t *testing.T) {
+	tests := []struct {
+		setting string
+		err     bool
+	}{
+		{"", false},
+		{"ipv4-pool", false},
+		{"pool=ipv4", false},
+		{"usage=cloud-provider-equinix-metal-auto", true},
+		{"cluster=abc", true},
+		{"service=abc", true},
+		{"loadbalancer=abc", true},
+		{"keep-until=1", true},
+	}
+	for i, tt := range tests {
+		if err := ValidateLBReusePoolTag(tt.setting); (err != nil) != tt.err {
+			t.Errorf("%d: mismatched errors for %q, actual %v expected error %v", i, tt.setting, err, tt.err)
+		}
+	}
+}
+
+func TestReusable(t *testing.T) {
+	l := &loadBalancers{reusePoolTag: "ipv4-pool", facility: "ewr1"}
+	ip := func(modify func(ip *packngo.IPAddressReservation)) *packngo.IPAddressReservation {
+		ip := &packngo.IPAddressReservation{
+			IpAddressCommon: packngo.IpAddressCommon{Address: "147.75.100.1", Public: true, AddressFamily: 4, CIDR: 32, Tags: []string{"ipv4-pool"}},
+			Facility:        &packngo.Facility{Code: "ewr1"},
+		}
+		modify(ip)
+		return ip
+	}
+	tests := []struct {
+		ip       *packngo.IPAddressReservation
+		expected bool
+	}{
+		{ip(func(ip *packngo.IPAddressReservation) {}), true},
+		{ip(func(ip *packngo.IPAddressReservation) { ip.Facility.Code = "ny5" }), false},
+		// e.g. in a metro
+		{ip(func(ip *packngo.IPAddressReservation) { ip.Facility = nil }), true},
+		{ip(func(ip *packngo.IPAddressReservation) { ip.Tags = []string{"other"} }), false},
+		{ip(func(ip *packngo.IPAddressReservation) { ip.Tags = append(ip.Tags, "service=abc") }), false},
+		{ip(func(ip *packngo.IPAddressReservation) { ip.Assignments = []*packngo.IPAddressAssignment{{}} }), false},
+		{ip(func(ip *packngo.IPAddressReservation) { ip.CIDR = 29 }), false},
+		{ip(func(ip *packngo.IPAddressReservation) { ip.Public = false }), false},
+	}
+	for i, tt := range tests {
+		if reusable := l.reusable(tt.ip); reusable != tt.expected {
+			t.Errorf("%d: mismatched reusable, actual %v expected %v", i, reusable, tt.expected)
+		}
+	}
+}
+
+func TestAllocateServiceIPReusePool(t *testing.T) {
+	ctx := context.Background()
+	allocator := &testIPAllocator{ips: []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "pooled", Address: "147.75.200.1", Public: true, AddressFamily: 4, CIDR: 32, Tags: []string{"ipv4-pool"}}},
+	}}
+	l := &loadBalancers{reusePoolTag: "ipv4-pool", ipAllocator: allocator}
+	tags := []string{emTag, "service=a"}
+
+	// the idle one is claimed, and only once
+	ips, _ := allocator.list(ctx)
+	first, _, err := l.allocateServiceIP(ctx, "default/a", v1.IPv4Protocol, tags, ips)
+	if err != nil || first.ID != "pooled" {
+		t.Fatalf("mismatched first IP, actual %v %v expected pooled", first, err)
+	}
+	second, _, err := l.allocateServiceIP(ctx, "default/b", v1.IPv4Protocol, []string{emTag, "service=b"}, ips)
+	if err != nil || second.ID == "pooled" {
+		t.Fatalf("mismatched second IP, actual %v %v expected a new one", second, err)
+	}
+	if !reflect.DeepEqual(allocator.ips[0].Tags, tags) {
+		t.Errorf("mismatched tags of claimed IP, actual %v expected %v", allocator.ips[0].Tags, tags)
+	}
+
+	// released, both go to the pool, rather than away
+	for _, ip := range []*packngo.IPAddressReservation{first, second} {
+		if err := l.releaseServiceIP(ctx, ip); err != nil {
+			t.Fatalf("unexpected error releasing %s: %v", ip.ID, err)
+		}
+	}
+	if len(allocator.ips) != 2 {
+		t.Fatalf("mismatched reservations, actual %d expected 2", len(allocator.ips))
+	}
+	for _, ip := range allocator.ips {
+		if !reflect.DeepEqual(ip.Tags, []string{"ipv4-pool"}) {
+			t.Errorf("%s: mismatched tags after release, actual %v expected the pool tag", ip.ID, ip.Tags)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package metal
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eventReasonSharedIPPortConflict = "SharedIPPortConflict"
+)
+
+// sharedIPPortConflicts find services that share a load balancer IP, i.e. set the same
+// spec.loadBalancerIP, and use a port and protocol that another of them already uses.
+// Only one of them can receive the traffic, so the oldest service keeps the port and
+// each later one is returned, with a description of the conflict.
+func sharedIPPortConflicts(svcs []*v1.Service) map[*v1.Service]string {
+	byIP := map[string][]*v1.Service{}
+	for _, svc := range svcs {
+		if ip := svc.Spec.LoadBalancerIP; ip != "" {
+			byIP[ip] = append(byIP[ip], svc)
+		}
+	}
+	conflicts := map[*v1.Service]string{}
+	for ip, shared := range byIP {
+		if len(shared) < 2 {
+			continue
+		}
+		sort.Slice(shared, func(i, j int) bool {
+			ti, tj := shared[i].CreationTimestamp, shared[j].CreationTimestamp
+			if !ti.Equal(&tj) {
+				return ti.Before(&tj)
+			}
+			return serviceRep(shared[i]) < serviceRep(shared[j])
+		})
+		owners := map[string]*v1.Service{}
+		for _, svc := range shared {
+			for _, port := range svc.Spec.Ports {
+				key := fmt.Sprintf("%d/%s", port.Port, servicePortProtocol(port))
+				if owner, ok := owners[key]; ok {
+					conflicts[svc] = fmt.Sprintf("port %s on load balancer IP %s is already used by service %s", key, ip, serviceRep(owner))
+					break
+				}
+			}
+			// a conflicting service claims none of its ports, so that it does not block others
+			if _, ok := conflicts[svc]; ok {
+				continue
+			}
+			for _, port := range svc.Spec.Ports {
+				owners[fmt.Sprintf("%d/%s", port.Port, servicePortProtocol(port))] = svc
+			}
+		}
+	}
+	return conflicts
+}
+
+// reportSharedIPPortConflicts record a warning event on each service whose ports conflict
+// with those of another service on the same load balancer IP
+func (l *loadBalancers) reportSharedIPPortConflicts(svcs []*v1.Service) {
+	for svc, conflict := range sharedIPPortConflicts(svcs) {
+		klog.Warningf("service %s: %s, traffic to it will not arrive", serviceRep(svc), conflict)
+		l.recorder.Eventf(svc, v1.EventTypeWarning, eventReasonSharedIPPortConflict, "Load balancer port conflict: %s", conflict)
+	}
+}
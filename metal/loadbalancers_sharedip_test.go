@@ -0,0 +1,62 @@
+package metal
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testSharedIPService(name, ip string, created time.Duration, ports ...v1.ServicePort) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			CreationTimestamp: metav1.NewTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Add(created)),
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerIP: ip, Ports: ports},
+	}
+}
+
+func TestSharedIPPortConflicts(t *testing.T) {
+	http := v1.ServicePort{Port: 80}
+	https := v1.ServicePort{Port: 443, Protocol: v1.ProtocolTCP}
+	dnsTCP := v1.ServicePort{Port: 53, Protocol: v1.ProtocolTCP}
+	dnsUDP := v1.ServicePort{Port: 53, Protocol: v1.ProtocolUDP}
+	tests := []struct {
+		svcs      []*v1.Service
+		conflicts []string
+	}{
+		// different IPs never conflict
+		{[]*v1.Service{testSharedIPService("a", "10.0.0.1", 0, http), testSharedIPService("b", "10.0.0.2", 0, http)}, nil},
+		// no IP yet
+		{[]*v1.Service{testSharedIPService("a", "", 0, http), testSharedIPService("b", "", 0, http)}, nil},
+		// same IP, different ports or protocols
+		{[]*v1.Service{testSharedIPService("a", "10.0.0.1", 0, http), testSharedIPService("b", "10.0.0.1", 0, https)}, nil},
+		{[]*v1.Service{testSharedIPService("a", "10.0.0.1", 0, dnsTCP), testSharedIPService("b", "10.0.0.1", 0, dnsUDP)}, nil},
+		// the later service conflicts, in whatever order they are listed
+		{[]*v1.Service{testSharedIPService("a", "10.0.0.1", time.Hour, http), testSharedIPService("b", "10.0.0.1", 0, http, https)}, []string{"default/a"}},
+		// the conflicting service does not claim its other ports
+		{[]*v1.Service{
+			testSharedIPService("a", "10.0.0.1", 0, http),
+			testSharedIPService("b", "10.0.0.1", time.Minute, http, https),
+			testSharedIPService("c", "10.0.0.1", time.Hour, https),
+		}, []string{"default/b"}},
+	}
+	for i, tt := range tests {
+		var actual []string
+		for svc, conflict := range sharedIPPortConflicts(tt.svcs) {
+			actual = append(actual, serviceRep(svc))
+			if !strings.Contains(conflict, "10.0.0.1") {
+				t.Errorf("%d: conflict of %s does not name the IP: %s", i, serviceRep(svc), conflict)
+			}
+		}
+		sort.Strings(actual)
+		if strings.Join(actual, ",") != strings.Join(tt.conflicts, ",") {
+			t.Errorf("%d: mismatched conflicts, actual %v expected %v", i, actual, tt.conflicts)
+		}
+	}
+}
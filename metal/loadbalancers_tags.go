@@ -0,0 +1,83 @@
+package metal
+
+import (
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// serviceReservationTags the structured tags of the reservation of a service: of the CCM, in this
+// cluster, and of the service, by its UID, or by the hash of its name, as all reservations were
+// tagged before the UID was, and as the reservation of a recreated service still is
+func (l *loadBalancers) serviceReservationTags(svc *v1.Service) structuredTags {
+	services := []string{serviceNameHash(svc)}
+	if svc.UID != "" {
+		services = append(services, string(svc.UID))
+	}
+	return structuredTags{
+		tagKeyUsage:   {emIdentifier},
+		tagKeyCluster: {l.clusterID},
+		tagKeyService: services,
+	}
+}
+
+// serviceReservation the reservation of the IP of a service, if any; not that of any additional
+// IP of the service, see annotationEIPCount
+func (l *loadBalancers) serviceReservation(svc *v1.Service, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
+	for _, ip := range ipReservationsByStructuredTags(l.serviceReservationTags(svc), ips) {
+		if serviceIPIndex(ip) == 0 && reservationFamily(ip) == v1.IPv4Protocol {
+			return ip
+		}
+	}
+	return nil
+}
+
+// serviceReservationTagList the tags with which to allocate a new reservation for a service
+func (l *loadBalancers) serviceReservationTagList(svc *v1.Service, extra ...string) []string {
+	tags := []string{emTag, serviceTag(svc), clusterTag(l.clusterID)}
+	if uidTag := serviceUIDTag(svc); uidTag != "" {
+		tags = append(tags, uidTag)
+	}
+	return append(tags, extra...)
+}
+
+// migrateServiceTags tag the reservation of a service with the UID of the service, if it is not yet,
+// e.g. as it was allocated before reservations were, or for a service since recreated, whose old UID
+// it loses. The tag with the hash of the name of the service is kept, as are all other tags. The
+// reservation is found by the hash until then, so a failure is only logged, and tried again later.
+func (l *loadBalancers) migrateServiceTags(svc *v1.Service, ip *packngo.IPAddressReservation) {
+	uidTag := serviceUIDTag(svc)
+	if uidTag == "" || l.ipUpdater == nil {
+		return
+	}
+	nameTag := serviceTag(svc)
+	tags := make([]string, 0, len(ip.Tags)+1)
+	var tagged bool
+	for _, tag := range ip.Tags {
+		key, _, ok := parseStructuredTag(tag)
+		switch {
+		case tag == uidTag:
+			tagged = true
+		case ok && key == tagKeyService && tag != nameTag:
+			// the UID of the service before it was recreated
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	if tagged && len(tags) == len(ip.Tags) {
+		return
+	}
+	if !tagged {
+		tags = append(tags, uidTag)
+	}
+	var description string
+	if ip.Description != nil {
+		description = *ip.Description
+	}
+	if err := l.ipUpdater.update(ip.ID, tags, description); err != nil {
+		klog.Warningf("unable to tag IP address reservation %s with the UID of service %s, will try again: %v", ip.Address, serviceRep(svc), err)
+		return
+	}
+	klog.V(2).Infof("tagged IP address reservation %s with the UID of service %s", ip.Address, serviceRep(svc))
+	ip.Tags = tags
+}
@@ -0,0 +1,62 @@
+package metal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceReservationMigration(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-2"}}
+	tests := []struct {
+		tags     []string
+		err      error
+		expected []string
+		updated  bool
+	}{
+		// allocated before reservations were tagged with the UID
+		{[]string{emTag, serviceTag(svc), clusterTag("cls")}, nil, []string{emTag, serviceTag(svc), clusterTag("cls"), "service=uid-2"}, true},
+		// the service was recreated, and its old UID is replaced
+		{[]string{emTag, serviceTag(svc), clusterTag("cls"), "service=uid-1", "keep"}, nil, []string{emTag, serviceTag(svc), clusterTag("cls"), "keep", "service=uid-2"}, true},
+		{[]string{emTag, serviceTag(svc), clusterTag("cls"), "service=uid-2"}, nil, []string{emTag, serviceTag(svc), clusterTag("cls"), "service=uid-2"}, false},
+		// still found by the hash of the name, so only tried again later
+		{[]string{emTag, serviceTag(svc), clusterTag("cls")}, errors.New("failed"), []string{emTag, serviceTag(svc), clusterTag("cls")}, false},
+	}
+	for i, tt := range tests {
+		updater := &testIPReservationUpdater{err: tt.err}
+		l := &loadBalancers{clusterID: "cls", ipUpdater: updater}
+		ips := []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "other", Tags: []string{emTag, "service=uid-3", clusterTag("cls")}}},
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "ip-id", Tags: tt.tags}},
+		}
+		ip := l.serviceReservation(svc, ips)
+		if ip == nil || ip.ID != "ip-id" {
+			t.Fatalf("%d: mismatched reservation, actual %v expected ip-id", i, ip)
+		}
+		l.migrateServiceTags(svc, ip)
+		if !reflect.DeepEqual(ip.Tags, tt.expected) {
+			t.Errorf("%d: mismatched tags, actual %v expected %v", i, ip.Tags, tt.expected)
+		}
+		if updated := updater.tags != nil; updated != tt.updated {
+			t.Errorf("%d: mismatched updated, actual %t expected %t", i, updated, tt.updated)
+		}
+	}
+}
+
+func TestServiceReservationTagList(t *testing.T) {
+	l := &loadBalancers{clusterID: "cls"}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"}}
+	expected := []string{emTag, serviceTag(svc), clusterTag("cls"), "service=uid-1", "lb=name"}
+	if tags := l.serviceReservationTagList(svc, "lb=name"); !reflect.DeepEqual(tags, expected) {
+		t.Errorf("mismatched tags, actual %v expected %v", tags, expected)
+	}
+	// what a reservation is allocated with, it is found by
+	ips := []packngo.IPAddressReservation{{IpAddressCommon: packngo.IpAddressCommon{Tags: expected}}}
+	if l.serviceReservation(svc, ips) == nil {
+		t.Errorf("reservation not found by its tags")
+	}
+}
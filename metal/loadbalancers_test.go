@@ -0,0 +1,218 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/empty"
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseLoadBalancerSetting(t *testing.T) {
+	tests := []struct {
+		setting  string
+		expected *LoadBalancerSetting
+		err      bool
+	}{
+		{"", nil, false},
+		{"kube-vip://", &LoadBalancerSetting{Type: "kube-vip"}, false},
+		{"empty://", &LoadBalancerSetting{Type: "empty"}, false},
+		{"metallb:///", &LoadBalancerSetting{Type: "metallb", Detail: "/"}, false},
+		{"metallb:///metallb-system/config", &LoadBalancerSetting{Type: "metallb", Detail: "/metallb-system/config"}, false},
+		{"metallb://metallb-system/config", &LoadBalancerSetting{Type: "metallb", Detail: "/metallb-system/config"}, false},
+		{"metallb-system:config", nil, true},
+		{"foo://bar", nil, true},
+		{"equinixmetal://lctnloc-1", &LoadBalancerSetting{Type: "equinixmetal", Detail: "/lctnloc-1"}, false},
+		{"equinixmetal://", nil, true},
+		{"metallb", nil, true},
+		{"://", nil, true},
+	}
+
+	for i, tt := range tests {
+		setting, err := ParseLoadBalancerSetting(tt.setting)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched errors for %q, actual %v expected error %v", i, tt.setting, err, tt.err)
+		case tt.expected == nil && setting != nil:
+			t.Errorf("%d: expected nil setting for %q, received %#v", i, tt.setting, setting)
+		case tt.expected != nil && (setting == nil || *setting != *tt.expected):
+			t.Errorf("%d: mismatched setting for %q, actual %#v expected %#v", i, tt.setting, setting, tt.expected)
+		}
+	}
+}
+
+func TestMigrateLoadBalancerSetting(t *testing.T) {
+	tests := []struct {
+		setting  string
+		expected string
+		legacy   bool
+	}{
+		{"", "", false},
+		{"metallb-system:config", "metallb:///metallb-system/config", true},
+		{"foonamespace:myconfig", "metallb:///foonamespace/myconfig", true},
+		{"metallb:///metallb-system/config", "metallb:///metallb-system/config", false},
+		{"kube-vip://", "kube-vip://", false},
+		{"metallb:", "metallb:", false},
+		{"metallb-system:", "metallb-system:", false},
+		{"a:b:c", "a:b:c", false},
+	}
+	for i, tt := range tests {
+		setting, legacy := MigrateLoadBalancerSetting(tt.setting)
+		if setting != tt.expected || legacy != tt.legacy {
+			t.Errorf("%d: mismatched setting for %q, actual %q %v expected %q %v", i, tt.setting, setting, legacy, tt.expected, tt.legacy)
+		}
+		if _, err := ParseLoadBalancerSetting(setting); legacy && err != nil {
+			t.Errorf("%d: unexpected error for migrated %q: %v", i, setting, err)
+		}
+	}
+}
+
+func TestValidateServicePorts(t *testing.T) {
+	tests := []struct {
+		ports []v1.ServicePort
+		err   bool
+	}{
+		{[]v1.ServicePort{{Port: 80}}, false},
+		{[]v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}, {Port: 443, Protocol: v1.ProtocolTCP}}, false},
+		{[]v1.ServicePort{{Port: 53, Protocol: v1.ProtocolTCP}, {Port: 53, Protocol: v1.ProtocolUDP}}, false},
+		{[]v1.ServicePort{{Port: 3868, Protocol: v1.ProtocolSCTP}}, false},
+		{[]v1.ServicePort{{Port: 80}, {Port: 80, Protocol: v1.ProtocolTCP}}, true},
+		{[]v1.ServicePort{{Port: 80, Protocol: "ICMP"}}, true},
+		{[]v1.ServicePort{{Port: 0, Protocol: v1.ProtocolUDP}}, true},
+	}
+	for i, tt := range tests {
+		svc := &v1.Service{Spec: v1.ServiceSpec{Ports: tt.ports}}
+		err := validateServicePorts(svc)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched errors, actual %v expected error %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestValidateServiceIPFamily(t *testing.T) {
+	ipv4, ipv6 := v1.IPv4Protocol, v1.IPv6Protocol
+	tests := []struct {
+		families  []v1.IPFamily
+		err       bool
+		dualStack bool
+	}{
+		{nil, false, false},
+		{[]v1.IPFamily{ipv4}, false, false},
+		{[]v1.IPFamily{ipv6}, true, false},
+		{[]v1.IPFamily{ipv4, ipv6}, false, true},
+		{[]v1.IPFamily{ipv6, ipv4}, false, true},
+	}
+	for i, tt := range tests {
+		svc := &v1.Service{Spec: v1.ServiceSpec{IPFamilies: tt.families}}
+		err := validateServiceIPFamily(svc)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched errors, actual %v expected error %v", i, err, tt.err)
+		}
+		if dualStack := serviceDualStack(svc); dualStack != tt.dualStack {
+			t.Errorf("%d: mismatched dual-stack, actual %v expected %v", i, dualStack, tt.dualStack)
+		}
+	}
+}
+
+func TestValidateSourceRanges(t *testing.T) {
+	tests := []struct {
+		ranges     []string
+		annotation string
+		lbType     string
+		err        bool
+	}{
+		{nil, "", lbTypeEmpty, false},
+		{[]string{"0.0.0.0/0"}, "", lbTypeEmpty, false},
+		{[]string{"10.0.0.0/8"}, "", lbTypeMetalLB, false},
+		{[]string{"10.0.0.0/8"}, "", lbTypeKubeVIP, false},
+		{[]string{"10.0.0.0/8"}, "", lbTypeEmpty, true},
+		{nil, "10.0.0.0/8", lbTypeEmpty, true},
+		{nil, "10.0.0.0/8", lbTypeMetalLB, false},
+		{[]string{"10.0.0.300/8"}, "", lbTypeMetalLB, true},
+	}
+	for i, tt := range tests {
+		svc := &v1.Service{Spec: v1.ServiceSpec{LoadBalancerSourceRanges: tt.ranges}}
+		if tt.annotation != "" {
+			svc.Annotations = map[string]string{v1.AnnotationLoadBalancerSourceRangesKey: tt.annotation}
+		}
+		err := validateSourceRanges(svc, tt.lbType)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched errors, actual %v expected error %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestWorkerNodes(t *testing.T) {
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "master-1", Labels: map[string]string{controlPlaneLabel: ""}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "worker-2", Labels: map[string]string{"node-role.kubernetes.io/worker": ""}}},
+	}
+	var names []string
+	for _, n := range workerNodes(nodes) {
+		names = append(names, n.Name)
+	}
+	if strings.Join(names, ",") != "worker-1,worker-2" {
+		t.Errorf("mismatched worker nodes, actual %v expected worker-1,worker-2", names)
+	}
+}
+
+// testServicesLB a load balancer implementation that records the services it was given
+type testServicesLB struct {
+	empty.LB
+	added map[string]string
+}
+
+func (l *testServicesLB) AddService(ctx context.Context, svc, ip string) error {
+	l.added[svc] = ip
+	return nil
+}
+
+func TestReconcileServicesErrors(t *testing.T) {
+	service := func(name, ip string, ports ...int32) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerIP: ip},
+		}
+		for _, port := range ports {
+			svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Port: port, Protocol: v1.ProtocolTCP})
+		}
+		return svc
+	}
+	// the first service defines a port twice, which keeps it from being added
+	svcs := []*v1.Service{
+		service("broken", "147.75.100.2", 80, 80),
+		service("fine", "147.75.100.3", 80),
+	}
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		lb := &testServicesLB{added: map[string]string{}}
+		recorder := record.NewFakeRecorder(10)
+		l := newLoadBalancers(Config{ProjectID: projectID}, &packngo.Client{ProjectIPs: &countingProjectIPService{}}, nil, nil)
+		l.k8sclient = fake.NewSimpleClientset(svcs[0], svcs[1])
+		l.recorder = recorder
+		l.implementor = lb
+		err := l.reconcileServices(context.Background(), svcs, mode)
+		if err == nil || !strings.Contains(err.Error(), "default/broken") {
+			t.Errorf("%v: mismatched error, actual %v expected one for default/broken", mode, err)
+		}
+		if lb.added["default/fine"] != "147.75.100.3/32" {
+			t.Errorf("%v: service after a broken one not added, added %v", mode, lb.added)
+		}
+		var events []string
+		for len(recorder.Events) > 0 {
+			events = append(events, <-recorder.Events)
+		}
+		found := false
+		for _, e := range events {
+			found = found || strings.Contains(e, eventReasonSyncLoadBalancerFailed)
+		}
+		if !found {
+			t.Errorf("%v: mismatched events, actual %v expected %s", mode, events, eventReasonSyncLoadBalancerFailed)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package metal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// loggingConfigMap the configmap whose contents adjust log verbosity at runtime
+	loggingConfigMapName      = "cloud-provider-equinix-metal-logging"
+	loggingConfigMapNamespace = "kube-system"
+	// loggingKeyVerbosity the global verbosity, same as the -v flag
+	loggingKeyVerbosity = "v"
+	// loggingKeyModules comma-separated list of module=verbosity, e.g. eip=4,bgp=5
+	loggingKeyModules = "modules"
+)
+
+// loggingModules the modules whose verbosity can be adjusted separately,
+// and the source file patterns, as understood by klog -vmodule, that belong to them
+var loggingModules = map[string][]string{
+	"eip":     {"eip_controlplane_reconciliation", "kubeproxy", "healthcheck"},
+	"lb":      {"loadbalancers*", "metallb", "configmap", "kubevip", "empty", "webhook"},
+	"bgp":     {"bgp"},
+	"devices": {"devices", "zones", "plans", "nodepools", "metalnodes", "agent"},
+}
+
+// loggingManager adjusts the klog verbosity at runtime from a configmap,
+// so that operators can debug an incident without restarting the CCM
+type loggingManager struct {
+	k8sclient kubernetes.Interface
+	// flags the klog flags, registered on our own flagset so they can be set at runtime
+	flags            *flag.FlagSet
+	lock             sync.Mutex
+	defaultVerbosity string
+	defaultVModule   string
+}
+
+func newLoggingManager() *loggingManager {
+	return &loggingManager{}
+}
+
+func (m *loggingManager) name() string {
+	return "logging"
+}
+
+func (m *loggingManager) init(k8sclient kubernetes.Interface) error {
+	m.k8sclient = k8sclient
+	m.flags = flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(m.flags)
+	// remember what was set on the command line, to return to when the configmap goes away
+	m.defaultVerbosity = m.flags.Lookup("v").Value.String()
+	m.defaultVModule = m.flags.Lookup("vmodule").Value.String()
+	return nil
+}
+
+func (m *loggingManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *loggingManager) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch the logging configmap and apply its settings whenever it changes
+func (m *loggingManager) watch(ctx context.Context) error {
+	informer := informers.NewSharedInformerFactoryWithOptions(m.k8sclient, 0,
+		informers.WithNamespace(loggingConfigMapNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", loggingConfigMapName).String()
+		}),
+	)
+
+	configMapsInformer := informer.Core().V1().ConfigMaps().Informer()
+	configMapsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*v1.ConfigMap); ok {
+				m.apply(cm.Data)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if cm, ok := obj.(*v1.ConfigMap); ok {
+				m.apply(cm.Data)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			m.apply(nil)
+		},
+	})
+
+	informer.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), configMapsInformer.HasSynced) {
+		return fmt.Errorf("syncing caches failed")
+	}
+	klog.Info("logging configmap watcher started")
+	return nil
+}
+
+// apply set the klog verbosity from the configmap data. Anything not set in the
+// data returns to what was set on the command line.
+func (m *loggingManager) apply(data map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	verbosity, vmodule, err := loggingSettings(data, m.defaultVerbosity, m.defaultVModule)
+	if err != nil {
+		klog.Errorf("invalid logging configmap %s/%s, keeping current log verbosity: %v", loggingConfigMapNamespace, loggingConfigMapName, err)
+		return
+	}
+	if err := m.flags.Set("v", verbosity); err != nil {
+		klog.Errorf("unable to set log verbosity %s: %v", verbosity, err)
+		return
+	}
+	if err := m.flags.Set("vmodule", vmodule); err != nil {
+		klog.Errorf("unable to set module log verbosity %s: %v", vmodule, err)
+		return
+	}
+	klog.Infof("log verbosity set to %s, module verbosity to %q", verbosity, vmodule)
+}
+
+// loggingSettings convert the logging configmap data to the klog -v and -vmodule
+// values, falling back to the given defaults for anything not set
+func loggingSettings(data map[string]string, defaultVerbosity, defaultVModule string) (string, string, error) {
+	verbosity := defaultVerbosity
+	if v := strings.TrimSpace(data[loggingKeyVerbosity]); v != "" {
+		if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+			return "", "", fmt.Errorf("invalid verbosity %q: %w", v, err)
+		}
+		verbosity = v
+	}
+
+	modules := strings.TrimSpace(data[loggingKeyModules])
+	if modules == "" {
+		return verbosity, defaultVModule, nil
+	}
+	var vmodule []string
+	for _, setting := range strings.Split(modules, ",") {
+		parts := strings.SplitN(strings.TrimSpace(setting), "=", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("invalid module setting %q, must be of the form <module>=<verbosity>", setting)
+		}
+		module, level := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		patterns, ok := loggingModules[module]
+		if !ok {
+			return "", "", fmt.Errorf("unknown module %q, must be one of %s", module, strings.Join(loggingModuleNames(), ", "))
+		}
+		if _, err := strconv.ParseUint(level, 10, 32); err != nil {
+			return "", "", fmt.Errorf("invalid verbosity %q for module %s: %w", level, module, err)
+		}
+		for _, p := range patterns {
+			vmodule = append(vmodule, fmt.Sprintf("%s=%s", p, level))
+		}
+	}
+	return verbosity, strings.Join(vmodule, ","), nil
+}
+
+// loggingModuleNames the sorted names of the modules whose verbosity can be adjusted
+func loggingModuleNames() []string {
+	names := []string{}
+	for name := range loggingModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,88 @@
+package metal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// repeatedErrorMaxInterval log a repeated error at least once in this many occurrences,
+	// about once an hour for an error of every sync
+	repeatedErrorMaxInterval = 64
+	// repeatedErrorForget forget an error not seen for this long, so that it is logged in
+	// full when it comes back, as a new incident
+	repeatedErrorForget = 15 * time.Minute
+
+	errorReasonSyncNodes    = "sync-nodes"
+	errorReasonSyncServices = "sync-services"
+	errorReasonEIPNotFound  = "eip-not-found"
+)
+
+// repeatedErrors suppresses the repeats of identical errors, e.g. the same error returned by
+// every sync loop, so that new ones stand out in the logs
+var repeatedErrors = newRepeatedErrorLog(time.Now)
+
+// repeatedErrorLog log an error the first time, and then only on its 2nd, 4th, 8th and so on
+// occurrence, up to every repeatedErrorMaxInterval occurrences, each time with how often it
+// was repeated. Every occurrence is counted in the logged_errors_total metric, by reason.
+type repeatedErrorLog struct {
+	now func() time.Time
+
+	// lock protects errors, by reason and message
+	lock   sync.Mutex
+	errors map[string]*repeatedError
+}
+
+type repeatedError struct {
+	// count how often it occurred, next at which count it is logged again
+	count, next int
+	first, last time.Time
+}
+
+func newRepeatedErrorLog(now func() time.Time) *repeatedErrorLog {
+	return &repeatedErrorLog{now: now, errors: map[string]*repeatedError{}}
+}
+
+// Errorf log an error, unless it is a repeat that is suppressed. The reason groups the
+// errors in the metric, so it must be one of a few constants; the message may vary.
+func (r *repeatedErrorLog) Errorf(reason, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	loggedErrors.WithLabelValues(reason).Inc()
+	if line, ok := r.record(reason, message); ok {
+		klog.ErrorDepth(1, line)
+	} else {
+		klog.V(4).Infof("suppressed repeated error: %s", message)
+	}
+}
+
+// record count an occurrence of the message, returning the line to log and whether to log it
+func (r *repeatedErrorLog) record(reason, message string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.now()
+	for key, e := range r.errors {
+		if now.Sub(e.last) > repeatedErrorForget {
+			delete(r.errors, key)
+		}
+	}
+	key := reason + "\x00" + message
+	e, ok := r.errors[key]
+	if !ok {
+		r.errors[key] = &repeatedError{count: 1, next: 2, first: now, last: now}
+		return message, true
+	}
+	e.count++
+	e.last = now
+	if e.count < e.next {
+		return "", false
+	}
+	interval := e.count
+	if interval > repeatedErrorMaxInterval {
+		interval = repeatedErrorMaxInterval
+	}
+	e.next = e.count + interval
+	return fmt.Sprintf("%s (repeated %d times since %s, next logged after %d more)", message, e.count, e.first.UTC().Format(time.RFC3339), interval), true
+}
@@ -0,0 +1,50 @@
+package metal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatedErrorLog(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newRepeatedErrorLog(func() time.Time { return now })
+
+	// logged on the 1st, 2nd, 4th, 8th, ... occurrence, then every repeatedErrorMaxInterval
+	var logged []int
+	for i := 1; i <= 300; i++ {
+		now = now.Add(time.Minute)
+		if line, ok := r.record(errorReasonSyncNodes, "port not determined"); ok {
+			logged = append(logged, i)
+			if i > 1 && !strings.Contains(line, "repeated") {
+				t.Errorf("%d: repeat logged without count: %s", i, line)
+			}
+		}
+	}
+	expected := []int{1, 2, 4, 8, 16, 32, 64, 128, 192, 256}
+	if len(logged) != len(expected) {
+		t.Fatalf("mismatched logged occurrences, actual %v expected %v", logged, expected)
+	}
+	for i := range expected {
+		if logged[i] != expected[i] {
+			t.Fatalf("mismatched logged occurrences, actual %v expected %v", logged, expected)
+		}
+	}
+
+	// a different message, or reason, is logged on its own
+	if _, ok := r.record(errorReasonSyncNodes, "elastic IP not found"); !ok {
+		t.Errorf("different message suppressed")
+	}
+	if _, ok := r.record(errorReasonSyncServices, "port not determined"); !ok {
+		t.Errorf("different reason suppressed")
+	}
+
+	// once gone for a while, an error is new again
+	now = now.Add(repeatedErrorForget + time.Minute)
+	if line, ok := r.record(errorReasonSyncNodes, "port not determined"); !ok || line != "port not determined" {
+		t.Errorf("returning error not logged as new, actual %q %t", line, ok)
+	}
+	if len(r.errors) != 1 {
+		t.Errorf("mismatched remembered errors, actual %d expected 1", len(r.errors))
+	}
+}
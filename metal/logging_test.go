@@ -0,0 +1,35 @@
+package metal
+
+import (
+	"testing"
+)
+
+func TestLoggingSettings(t *testing.T) {
+	tests := []struct {
+		data      map[string]string
+		verbosity string
+		vmodule   string
+		err       bool
+	}{
+		{nil, "2", "", false},
+		{map[string]string{}, "2", "", false},
+		{map[string]string{loggingKeyVerbosity: "4"}, "4", "", false},
+		{map[string]string{loggingKeyModules: "bgp=5"}, "2", "bgp=5", false},
+		{map[string]string{loggingKeyVerbosity: "3", loggingKeyModules: "eip=5, bgp=4"}, "3", "eip_controlplane_reconciliation=5,kubeproxy=5,healthcheck=5,bgp=4", false},
+		{map[string]string{loggingKeyVerbosity: "high"}, "", "", true},
+		{map[string]string{loggingKeyModules: "eip"}, "", "", true},
+		{map[string]string{loggingKeyModules: "storage=4"}, "", "", true},
+		{map[string]string{loggingKeyModules: "eip=-1"}, "", "", true},
+	}
+	for i, tt := range tests {
+		verbosity, vmodule, err := loggingSettings(tt.data, "2", "")
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched errors, actual %v expected error %v", i, err, tt.err)
+		case verbosity != tt.verbosity:
+			t.Errorf("%d: mismatched verbosity, actual %q expected %q", i, verbosity, tt.verbosity)
+		case vmodule != tt.vmodule:
+			t.Errorf("%d: mismatched vmodule, actual %q expected %q", i, vmodule, tt.vmodule)
+		}
+	}
+}
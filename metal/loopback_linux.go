@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package metal
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// systemLoopback adds and removes addresses on the loopback interface of the host with
+// netlink, as the image has no ip command; the agent runs with host networking
+type systemLoopback struct{}
+
+func (systemLoopback) add(ip net.IP) error {
+	err := loopbackAddressRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ip)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+func (systemLoopback) remove(ip net.IP) error {
+	err := loopbackAddressRequest(syscall.RTM_DELADDR, 0, ip)
+	if err == syscall.EADDRNOTAVAIL {
+		return nil
+	}
+	return err
+}
+
+// loopbackAddressRequest send a netlink request to add or delete a host address on the
+// loopback interface, and wait for its acknowledgement
+func loopbackAddressRequest(msgType, flags uint16, ip net.IP) error {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return err
+	}
+	family, prefix, addr := syscall.AF_INET, 32, ip.To4()
+	if addr == nil {
+		family, prefix, addr = syscall.AF_INET6, 128, ip.To16()
+	}
+	if addr == nil {
+		return fmt.Errorf("invalid address %s", ip)
+	}
+
+	ifa := syscall.IfAddrmsg{Family: uint8(family), Prefixlen: uint8(prefix), Index: uint32(lo.Index)}
+	body := (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&ifa))[:]
+	body = append(body, netlinkAttr(syscall.IFA_LOCAL, addr)...)
+	body = append(body, netlinkAttr(syscall.IFA_ADDRESS, addr)...)
+	hdr := syscall.NlMsghdr{
+		Len:   uint32(syscall.NLMSG_HDRLEN + len(body)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   1,
+	}
+	msg := append((*[syscall.NLMSG_HDRLEN]byte)(unsafe.Pointer(&hdr))[:], body...)
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != hdr.Seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("short netlink acknowledgement")
+			}
+			if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// netlinkAttr a netlink route attribute, padded to the netlink alignment
+func netlinkAttr(attrType uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	b := make([]byte, (length+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	*(*syscall.RtAttr)(unsafe.Pointer(&b[0])) = syscall.RtAttr{Len: uint16(length), Type: attrType}
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
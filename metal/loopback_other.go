@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package metal
+
+import (
+	"fmt"
+	"net"
+)
+
+// systemLoopback binding addresses to the loopback interface is only supported on linux
+type systemLoopback struct{}
+
+func (systemLoopback) add(ip net.IP) error {
+	return fmt.Errorf("binding addresses to the loopback interface is only supported on linux")
+}
+
+func (systemLoopback) remove(ip net.IP) error {
+	return fmt.Errorf("binding addresses to the loopback interface is only supported on linux")
+}
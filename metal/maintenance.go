@@ -0,0 +1,114 @@
+package metal
+
+import (
+	"sort"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotationMaintenance set to true on a node to mark it as under planned maintenance
+	annotationMaintenance = "metal.equinix.com/maintenance"
+	// taintMaintenance a taint that, on a cordoned node, marks it as under planned maintenance
+	taintMaintenance = "metal.equinix.com/maintenance"
+	// annotationAllowEIPFailover set to true on a node to move the elastic IP away from it even during maintenance or cooldown
+	annotationAllowEIPFailover = "metal.equinix.com/allow-eip-failover"
+	// annotationEIPPin set to true on a control plane node to keep the elastic IP on it, as long as it is healthy
+	annotationEIPPin = "metal.equinix.com/eip-pin"
+	// annotationEIPFailoverRequest set to true on a control plane node to move the elastic IP to it once, if it is healthy
+	annotationEIPFailoverRequest = "metal.equinix.com/eip-failover-request"
+	// annotationEIPExclude set to true on a control plane node to never move the elastic IP to it, e.g. ahead of its decommission
+	annotationEIPExclude = "metal.equinix.com/eip-exclude"
+
+	eventReasonEIPFailoverHeld      = "EIPFailoverHeld"
+	eventReasonEIPFailoverRequested = "EIPFailoverRequested"
+)
+
+// nodeInMaintenance whether the node is under planned maintenance, i.e. it has the
+// maintenance annotation set to true, or it is cordoned and has the maintenance taint
+func nodeInMaintenance(node *v1.Node) bool {
+	if v, err := strconv.ParseBool(node.Annotations[annotationMaintenance]); err == nil && v {
+		return true
+	}
+	if !node.Spec.Unschedulable {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == taintMaintenance {
+			return true
+		}
+	}
+	return false
+}
+
+// eipFailoverHeld whether the elastic IP should stay on the node, although it
+// appears unhealthy, because the node is under planned maintenance and has not
+// been explicitly allowed to fail over
+func eipFailoverHeld(node *v1.Node) bool {
+	if !nodeInMaintenance(node) {
+		return false
+	}
+	return !eipFailoverAllowed(node)
+}
+
+// eipFailoverAllowed whether the node has been explicitly allowed to have the elastic IP moved away from it
+func eipFailoverAllowed(node *v1.Node) bool {
+	allow, err := strconv.ParseBool(node.Annotations[annotationAllowEIPFailover])
+	return err == nil && allow
+}
+
+// eipExcluded whether the node has been excluded from the candidates for the elastic IP
+func eipExcluded(node *v1.Node) bool {
+	exclude, err := strconv.ParseBool(node.Annotations[annotationEIPExclude])
+	return err == nil && exclude
+}
+
+// eipCandidates the nodes to which the elastic IP may move, i.e. those not excluded from it
+func eipCandidates(nodes []*v1.Node) []*v1.Node {
+	var candidates []*v1.Node
+	for _, node := range nodes {
+		if eipExcluded(node) {
+			klog.Infof("will not assign control plane endpoint to node %s, which has annotation %s=true", node.Name, annotationEIPExclude)
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+	return candidates
+}
+
+// pinnedNode the control plane node to which the elastic IP is pinned, or nil if none is.
+// If more than one is, the one whose name sorts first wins, so that the choice is stable.
+func pinnedNode(nodes []*v1.Node) *v1.Node {
+	var pinned []*v1.Node
+	for _, node := range nodes {
+		if v, err := strconv.ParseBool(node.Annotations[annotationEIPPin]); err == nil && v {
+			pinned = append(pinned, node)
+		}
+	}
+	if len(pinned) == 0 {
+		return nil
+	}
+	sort.Slice(pinned, func(i, j int) bool { return pinned[i].Name < pinned[j].Name })
+	if len(pinned) > 1 {
+		klog.Warningf("%d control plane nodes have annotation %s=true, pinning the elastic IP to %s", len(pinned), annotationEIPPin, pinned[0].Name)
+	}
+	return pinned[0]
+}
+
+// failoverRequestedNode the control plane node to which the elastic IP was requested to move,
+// or nil if none was. If more than one was, the one whose name sorts first wins.
+func failoverRequestedNode(nodes []*v1.Node) *v1.Node {
+	var requested []*v1.Node
+	for _, node := range nodes {
+		if v, err := strconv.ParseBool(node.Annotations[annotationEIPFailoverRequest]); err == nil && v {
+			requested = append(requested, node)
+		}
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+	sort.Slice(requested, func(i, j int) bool { return requested[i].Name < requested[j].Name })
+	return requested[0]
+}
@@ -0,0 +1,322 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestEIPFailoverHeld(t *testing.T) {
+	tests := []struct {
+		annotations   map[string]string
+		unschedulable bool
+		taints        []v1.Taint
+		maintenance   bool
+		held          bool
+	}{
+		{nil, false, nil, false, false},
+		{map[string]string{annotationMaintenance: "true"}, false, nil, true, true},
+		{map[string]string{annotationMaintenance: "false"}, false, nil, false, false},
+		{map[string]string{annotationMaintenance: "yes please"}, false, nil, false, false},
+		// cordoned alone is not maintenance, nor is the taint without cordoning
+		{nil, true, nil, false, false},
+		{nil, false, []v1.Taint{{Key: taintMaintenance, Effect: v1.TaintEffectNoSchedule}}, false, false},
+		{nil, true, []v1.Taint{{Key: taintMaintenance, Effect: v1.TaintEffectNoSchedule}}, true, true},
+		{map[string]string{annotationMaintenance: "true", annotationAllowEIPFailover: "true"}, false, nil, true, false},
+		{map[string]string{annotationMaintenance: "true", annotationAllowEIPFailover: "false"}, false, nil, true, true},
+	}
+	for i, tt := range tests {
+		node := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-1", Annotations: tt.annotations},
+			Spec:       v1.NodeSpec{Unschedulable: tt.unschedulable, Taints: tt.taints},
+		}
+		if maintenance := nodeInMaintenance(node); maintenance != tt.maintenance {
+			t.Errorf("%d: mismatched maintenance, actual %t expected %t", i, maintenance, tt.maintenance)
+		}
+		if held := eipFailoverHeld(node); held != tt.held {
+			t.Errorf("%d: mismatched held, actual %t expected %t", i, held, tt.held)
+		}
+	}
+}
+
+// failingHealthChecker a health checker for which nothing is healthy
+type failingHealthChecker struct{}
+
+func (h failingHealthChecker) check(ctx context.Context, address string) error {
+	return errors.New("unhealthy")
+}
+
+func TestReconcileNodesMaintenanceHold(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/abc"}}},
+		},
+	}}
+	m.healthChecker = failingHealthChecker{}
+	m.apiServerPort = 6443
+	m.maintenanceHold = true
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "master-1",
+			Labels:      map[string]string{controlPlaneLabel: ""},
+			Annotations: map[string]string{annotationMaintenance: "true"},
+		},
+		Spec: v1.NodeSpec{ProviderID: "equinixmetal://abc"},
+	}
+
+	// held: no attempt to reassign, which would fail without any cloud instances
+	if err := m.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err != nil {
+		t.Errorf("unexpected error with failover held: %v", err)
+	}
+
+	// allowed: reassign, which finds nowhere to go, since node port is not known
+	node.Annotations[annotationAllowEIPFailover] = "true"
+	if err := m.reconcileNodes(ctx, []*v1.Node{node}, ModeSync); err == nil {
+		t.Errorf("expected reassign error with failover allowed")
+	}
+}
+
+func TestPinnedNode(t *testing.T) {
+	node := func(name, pin string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{annotationEIPPin: pin}}}
+	}
+	tests := []struct {
+		nodes    []*v1.Node
+		expected string
+	}{
+		{nil, ""},
+		{[]*v1.Node{node("master-1", ""), node("master-2", "false")}, ""},
+		{[]*v1.Node{node("master-1", ""), node("master-2", "true")}, "master-2"},
+		{[]*v1.Node{node("master-3", "true"), node("master-2", "true")}, "master-2"},
+	}
+	for i, tt := range tests {
+		var name string
+		if pinned := pinnedNode(tt.nodes); pinned != nil {
+			name = pinned.Name
+		}
+		if name != tt.expected {
+			t.Errorf("%d: mismatched pinned node, actual %q expected %q", i, name, tt.expected)
+		}
+	}
+}
+
+// testInstances cloud instances whose node addresses and device IDs are known up front
+type testInstances struct {
+	cloudInstances
+	addresses map[string]string
+}
+
+func (i *testInstances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
+	return []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: i.addresses[string(name)]}}, nil
+}
+
+func (i *testInstances) InstanceID(ctx context.Context, name types.NodeName) (string, error) {
+	return "device-" + string(name), nil
+}
+
+// testDeviceIPService records the device to which an IP is assigned
+type testDeviceIPService struct {
+	packngo.DeviceIPService
+	assigned map[string]string
+}
+
+func (s *testDeviceIPService) Unassign(assignmentID string) (*packngo.Response, error) {
+	return nil, nil
+}
+
+func (s *testDeviceIPService) Assign(deviceID string, assignRequest *packngo.AddressStruct) (*packngo.IPAddressAssignment, *packngo.Response, error) {
+	s.assigned[assignRequest.Address] = deviceID
+	return nil, nil, nil
+}
+
+func TestReconcileNodesPinned(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	m, _ := testControlPlaneEndpointManager(t)
+	deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+	m.deviceIPSrv = deviceIPSrv
+	m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.2", "master-2": "127.0.0.1", "master-3": "127.0.0.3"}}
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+		},
+	}}
+	m.apiServerPort = 6443
+	m.nodeAPIServerPort = int32(server.Listener.Addr().(*net.TCPAddr).Port)
+	node := func(name, pin string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{controlPlaneLabel: ""},
+				Annotations: map[string]string{annotationEIPPin: pin},
+			},
+			Spec: v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		}
+	}
+
+	// pinned to the healthy master-2, so the EIP moves there from master-1
+	if err := m.reconcileNodes(ctx, []*v1.Node{node("master-1", ""), node("master-2", "true")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device := deviceIPSrv.assigned[testEIP]; device != "device-master-2" {
+		t.Errorf("mismatched device, actual %q expected device-master-2", device)
+	}
+
+	// pinned to the unhealthy master-3, so the EIP stays where it is, as long as that is healthy
+	deviceIPSrv.assigned = map[string]string{}
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{healthCheckAddress(testEIP, m.apiServerPort): true}}
+	if err := m.reconcileNodes(ctx, []*v1.Node{node("master-1", ""), node("master-3", "true")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deviceIPSrv.assigned) != 0 {
+		t.Errorf("elastic IP moved to unhealthy pinned node: %v", deviceIPSrv.assigned)
+	}
+}
+
+func TestReconcileNodesFailoverRequest(t *testing.T) {
+	ctx := context.Background()
+	m, client := testControlPlaneEndpointManager(t)
+	deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+	m.deviceIPSrv = deviceIPSrv
+	m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.2", "master-2": "127.0.0.1", "master-3": "127.0.0.3"}}
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+		},
+	}}
+	m.apiServerPort = 6443
+	m.nodeAPIServerPort = 6443
+	// the EIP and master-2 are healthy, master-3 is not
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{
+		healthCheckAddress(testEIP, m.apiServerPort):         true,
+		healthCheckAddress("127.0.0.1", m.nodeAPIServerPort): true,
+	}}
+	node := func(name, request string) *v1.Node {
+		n := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{controlPlaneLabel: ""},
+				Annotations: map[string]string{annotationEIPFailoverRequest: request},
+			},
+			Spec: v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		}
+		if _, err := client.CoreV1().Nodes().Create(ctx, n, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("unable to create node %s: %v", name, err)
+		}
+		return n
+	}
+	requested := func(name string) bool {
+		n, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get node %s: %v", name, err)
+		}
+		_, ok := n.Annotations[annotationEIPFailoverRequest]
+		return ok
+	}
+	nodes := []*v1.Node{node("master-1", ""), node("master-2", "true"), node("master-3", "")}
+
+	// requested on the healthy master-2, so the EIP moves there, although it is healthy where it is
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device := deviceIPSrv.assigned[testEIP]; device != "device-master-2" {
+		t.Errorf("mismatched device, actual %q expected device-master-2", device)
+	}
+	if requested("master-2") {
+		t.Errorf("failover request not cleared on master-2")
+	}
+
+	// requested on the unhealthy master-3, so the EIP stays, and the request is cleared all the same
+	deviceIPSrv.assigned = map[string]string{}
+	nodes[1].Annotations = map[string]string{}
+	nodes[2].Annotations = map[string]string{annotationEIPFailoverRequest: "true"}
+	if _, err := client.CoreV1().Nodes().Update(ctx, nodes[2], metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update node: %v", err)
+	}
+	if err := m.reconcileNodes(ctx, nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deviceIPSrv.assigned) != 0 {
+		t.Errorf("elastic IP moved to unhealthy requested node: %v", deviceIPSrv.assigned)
+	}
+	if requested("master-3") {
+		t.Errorf("failover request not cleared on master-3")
+	}
+}
+
+// addressHealthChecker a health checker for which only the given addresses are healthy
+type addressHealthChecker struct {
+	healthy map[string]bool
+}
+
+func (h *addressHealthChecker) check(ctx context.Context, address string) error {
+	if !h.healthy[address] {
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
+func TestReconcileNodesExcluded(t *testing.T) {
+	ctx := context.Background()
+	m, _ := testControlPlaneEndpointManager(t)
+	deviceIPSrv := &testDeviceIPService{assigned: map[string]string{}}
+	m.deviceIPSrv = deviceIPSrv
+	m.instances = &testInstances{addresses: map[string]string{"master-1": "127.0.0.1", "master-2": "127.0.0.2", "master-3": "127.0.0.3"}}
+	m.ipResSvr = &countingProjectIPService{ips: []packngo.IPAddressReservation{
+		{
+			IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}},
+			Assignments:     []*packngo.IPAddressAssignment{{AssignedTo: packngo.Href{Href: "/devices/device-master-1"}}},
+		},
+	}}
+	m.apiServerPort = 6443
+	m.nodeAPIServerPort = 6443
+	// the EIP fails its health check, master-2 and master-3 are healthy
+	m.healthChecker = &addressHealthChecker{healthy: map[string]bool{
+		healthCheckAddress("127.0.0.2", m.nodeAPIServerPort): true,
+		healthCheckAddress("127.0.0.3", m.nodeAPIServerPort): true,
+	}}
+	node := func(name, exclude string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{controlPlaneLabel: ""},
+				Annotations: map[string]string{annotationEIPExclude: exclude},
+			},
+			Spec: v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		}
+	}
+
+	// master-2 would be first, but is excluded, so the EIP moves to master-3
+	if err := m.reconcileNodes(ctx, []*v1.Node{node("master-1", ""), node("master-2", "true"), node("master-3", "")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device := deviceIPSrv.assigned[testEIP]; device != "device-master-3" {
+		t.Errorf("mismatched device, actual %q expected device-master-3", device)
+	}
+
+	// with every healthy node excluded, the EIP has nowhere to go
+	deviceIPSrv.assigned = map[string]string{}
+	m.invalidateIPReservations()
+	err := m.reconcileNodes(ctx, []*v1.Node{node("master-1", ""), node("master-2", "true"), node("master-3", "true")}, ModeSync)
+	if !errors.Is(err, ErrAllUnhealthy) {
+		t.Errorf("mismatched error, actual %v expected %v", err, ErrAllUnhealthy)
+	}
+	if len(deviceIPSrv.assigned) != 0 {
+		t.Errorf("elastic IP moved to excluded node: %v", deviceIPSrv.assigned)
+	}
+}
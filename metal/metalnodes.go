@@ -0,0 +1,238 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	metalNodeKind = "MetalNode"
+	// metalNodeStaleAfter how old the status of a MetalNode may be before the CCM
+	// stops trusting it, and goes back to the Equinix Metal API
+	metalNodeStaleAfter = 5 * time.Minute
+
+	eventReasonSpotTermination = "SpotTermination"
+)
+
+// metalNodeResource the MetalNode custom resource, one per node, in whose status the
+// node agent reports what it reads from the metadata service, see deploy/crds
+var metalNodeResource = schema.GroupVersionResource{Group: "metal.equinix.com", Version: "v1alpha1", Resource: "metalnodes"}
+
+// metalNodeBGPNeighbour a BGP neighbour of a device as reported by the agent, without
+// its password, which is the same for every device in the project
+type metalNodeBGPNeighbour struct {
+	AddressFamily int      `json:"addressFamily"`
+	CustomerAS    int      `json:"customerAS"`
+	CustomerIP    string   `json:"customerIP"`
+	PeerAS        int      `json:"peerAS"`
+	PeerIPs       []string `json:"peerIPs,omitempty"`
+	Multihop      bool     `json:"multihop,omitempty"`
+	MD5Enabled    bool     `json:"md5Enabled,omitempty"`
+}
+
+// metalNodeStatus what the agent on a node reports about its device
+type metalNodeStatus struct {
+	DeviceID            string                  `json:"deviceID,omitempty"`
+	Hostname            string                  `json:"hostname,omitempty"`
+	Facility            string                  `json:"facility,omitempty"`
+	Plan                string                  `json:"plan,omitempty"`
+	BGPNeighbours       []metalNodeBGPNeighbour `json:"bgpNeighbors,omitempty"`
+	SpotTerminationTime *metav1.Time            `json:"spotTerminationTime,omitempty"`
+	LoopbackAddresses   []string                `json:"loopbackAddresses,omitempty"`
+	LastUpdateTime      metav1.Time             `json:"lastUpdateTime"`
+}
+
+func (s metalNodeStatus) unstructured() (map[string]interface{}, error) {
+	return runtime.DefaultUnstructuredConverter.ToUnstructured(&s)
+}
+
+// parseMetalNodeStatus the status of a MetalNode, from its unstructured object
+func parseMetalNodeStatus(obj map[string]interface{}) (metalNodeStatus, error) {
+	var status metalNodeStatus
+	statusObj, ok := obj["status"].(map[string]interface{})
+	if !ok {
+		return status, nil
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(statusObj, &status); err != nil {
+		return status, fmt.Errorf("invalid status: %w", err)
+	}
+	return status, nil
+}
+
+// metalNodeManager reads what the node agents report in the MetalNodes, so that the rest
+// of the CCM can use it instead of polling the Equinix Metal API for each node, and records
+// an event on each node whose device is about to be reclaimed from the spot market
+type metalNodeManager struct {
+	enabled       bool
+	project       string
+	bgpConfigs    packngo.BGPConfigService
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+
+	// lock protects the fields below, which are read by other services
+	lock     sync.Mutex
+	statuses map[string]metalNodeStatus
+	bgpPass  string
+	// spotReported the spot termination time last reported for each node
+	spotReported map[string]time.Time
+}
+
+func newMetalNodeManager(bgpConfigs packngo.BGPConfigService, project string, enabled bool) *metalNodeManager {
+	return &metalNodeManager{
+		enabled:      enabled,
+		project:      project,
+		bgpConfigs:   bgpConfigs,
+		statuses:     map[string]metalNodeStatus{},
+		spotReported: map[string]time.Time{},
+	}
+}
+
+func (m *metalNodeManager) name() string {
+	return "metalnodes"
+}
+
+func (m *metalNodeManager) init(k8sclient kubernetes.Interface) error {
+	if m.enabled {
+		m.recorder = newEventRecorder(k8sclient)
+	}
+	return nil
+}
+
+func (m *metalNodeManager) initCustomResources(client dynamic.Interface) {
+	m.dynamicClient = client
+}
+
+func (m *metalNodeManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *metalNodeManager) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch refresh the MetalNodes now, and then periodically
+func (m *metalNodeManager) watch(ctx context.Context) error {
+	if !m.enabled {
+		klog.V(2).Info("agent mode disabled, not reading metal nodes")
+		return nil
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := m.refresh(ctx); err != nil {
+			klog.Errorf("unable to refresh metal nodes: %v", err)
+		}
+	}, checkLoopTimerSeconds*time.Second)
+	return nil
+}
+
+// refresh read the status of every MetalNode, and the BGP password of the project
+func (m *metalNodeManager) refresh(ctx context.Context) error {
+	list, err := m.dynamicClient.Resource(metalNodeResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+			klog.V(2).Infof("%s custom resource definition not installed, not reading metal nodes", metalNodeResource.GroupResource())
+			return nil
+		}
+		return fmt.Errorf("unable to list metal nodes: %w", err)
+	}
+	statuses := map[string]metalNodeStatus{}
+	for i := range list.Items {
+		status, err := parseMetalNodeStatus(list.Items[i].Object)
+		if err != nil {
+			klog.Errorf("metal node %s: %v", list.Items[i].GetName(), err)
+			continue
+		}
+		statuses[list.Items[i].GetName()] = status
+	}
+	bgpPass := projectBGPPass(m.bgpConfigs, m.project)
+
+	m.lock.Lock()
+	m.statuses = statuses
+	m.bgpPass = bgpPass
+	m.lock.Unlock()
+
+	m.reportSpotTerminations(statuses)
+	return nil
+}
+
+// reportSpotTerminations record an event on each node whose device is about to be
+// reclaimed, once for each termination time
+func (m *metalNodeManager) reportSpotTerminations(statuses map[string]metalNodeStatus) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for name, status := range statuses {
+		if status.SpotTerminationTime == nil {
+			delete(m.spotReported, name)
+			continue
+		}
+		at := status.SpotTerminationTime.Time
+		if reported, ok := m.spotReported[name]; ok && reported.Equal(at) {
+			continue
+		}
+		m.spotReported[name] = at
+		node := &v1.ObjectReference{Kind: "Node", Name: name, UID: types.UID(name)}
+		m.recorder.Eventf(node, v1.EventTypeWarning, eventReasonSpotTermination,
+			"spot market device %s will be terminated at %s", status.DeviceID, at.UTC().Format(time.RFC3339))
+	}
+	for name := range m.spotReported {
+		if _, ok := statuses[name]; !ok {
+			delete(m.spotReported, name)
+		}
+	}
+}
+
+// bgpNeighbours the BGP neighbours of the device of a node, as last reported by its agent,
+// with the project password filled in. Returns false if agent mode is disabled, or there
+// is no recent report for the node.
+func (m *metalNodeManager) bgpNeighbours(nodeName string, now time.Time) ([]packngo.BGPNeighbor, bool) {
+	if m == nil || !m.enabled {
+		return nil, false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	status, ok := m.statuses[nodeName]
+	if !ok || len(status.BGPNeighbours) == 0 || now.Sub(status.LastUpdateTime.Time) > metalNodeStaleAfter {
+		return nil, false
+	}
+	neighbours := make([]packngo.BGPNeighbor, 0, len(status.BGPNeighbours))
+	for _, n := range status.BGPNeighbours {
+		neighbour := packngo.BGPNeighbor{
+			AddressFamily: n.AddressFamily,
+			CustomerAs:    n.CustomerAS,
+			CustomerIP:    n.CustomerIP,
+			PeerAs:        n.PeerAS,
+			PeerIps:       n.PeerIPs,
+			Multihop:      n.Multihop,
+			Md5Enabled:    n.MD5Enabled,
+		}
+		if n.MD5Enabled {
+			neighbour.Md5Password = m.bgpPass
+		}
+		neighbours = append(neighbours, neighbour)
+	}
+	return neighbours, true
+}
+
+// nodeBGPNeighbours the BGP neighbours of the device of a node, as reported by its agent
+// if there is a recent report, else from the Equinix Metal API
+func nodeBGPNeighbours(node *v1.Node, client *packngo.Client, metalNodes *metalNodeManager) ([]packngo.BGPNeighbor, error) {
+	if neighbours, ok := metalNodes.bgpNeighbours(node.Name, time.Now()); ok {
+		return neighbours, nil
+	}
+	return getNodeBGPNeighbours(node.Spec.ProviderID, client)
+}
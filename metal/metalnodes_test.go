@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestMetalNodeBGPNeighbours(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 10, 0, 0, time.UTC)
+	neighbour := metalNodeBGPNeighbour{AddressFamily: 4, CustomerAS: 65000, CustomerIP: "10.0.0.2", PeerAS: 65530, PeerIPs: []string{"169.254.255.1"}, MD5Enabled: true}
+	m := newMetalNodeManager(nil, "project", true)
+	m.bgpPass = "secret"
+	m.statuses = map[string]metalNodeStatus{
+		"fresh":   {BGPNeighbours: []metalNodeBGPNeighbour{neighbour}, LastUpdateTime: metav1.NewTime(now.Add(-time.Minute))},
+		"stale":   {BGPNeighbours: []metalNodeBGPNeighbour{neighbour}, LastUpdateTime: metav1.NewTime(now.Add(-time.Hour))},
+		"nothing": {LastUpdateTime: metav1.NewTime(now)},
+	}
+	disabled := newMetalNodeManager(nil, "project", false)
+	disabled.statuses = m.statuses
+	var missing *metalNodeManager
+
+	tests := []struct {
+		manager *metalNodeManager
+		node    string
+		ok      bool
+	}{
+		{m, "fresh", true},
+		{m, "stale", false},
+		{m, "nothing", false},
+		{m, "unknown", false},
+		{disabled, "fresh", false},
+		{missing, "fresh", false},
+	}
+	for i, tt := range tests {
+		neighbours, ok := tt.manager.bgpNeighbours(tt.node, now)
+		switch {
+		case ok != tt.ok:
+			t.Errorf("%d: mismatched ok, actual %t expected %t", i, ok, tt.ok)
+		case !ok:
+		case len(neighbours) != 1 || neighbours[0].CustomerIP != "10.0.0.2" || neighbours[0].Md5Password != "secret":
+			t.Errorf("%d: mismatched neighbours, actual %+v", i, neighbours)
+		}
+	}
+}
+
+func TestReportSpotTerminations(t *testing.T) {
+	at := metav1.NewTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	later := metav1.NewTime(at.Add(time.Minute))
+	recorder := record.NewFakeRecorder(10)
+	m := newMetalNodeManager(testCheckBGPConfig{config: &packngo.BGPConfig{}}, "project", true)
+	m.recorder = recorder
+
+	tests := []struct {
+		statuses map[string]metalNodeStatus
+		events   int
+	}{
+		{map[string]metalNodeStatus{"a": {}, "b": {SpotTerminationTime: &at}}, 1},
+		// reported once for each termination time
+		{map[string]metalNodeStatus{"a": {}, "b": {SpotTerminationTime: &at}}, 0},
+		{map[string]metalNodeStatus{"a": {}, "b": {SpotTerminationTime: &later}}, 1},
+		{map[string]metalNodeStatus{"a": {SpotTerminationTime: &at}, "b": {SpotTerminationTime: &later}}, 1},
+	}
+	for i, tt := range tests {
+		m.reportSpotTerminations(tt.statuses)
+		if events := len(recorder.Events); events != tt.events {
+			t.Errorf("%d: mismatched events, actual %d expected %d", i, events, tt.events)
+		}
+		for len(recorder.Events) > 0 {
+			<-recorder.Events
+		}
+	}
+}
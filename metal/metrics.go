@@ -0,0 +1,187 @@
+package metal
+
+import (
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// metricsSubsystem prefix for all metrics exported by the CCM, on the
+	// same /metrics endpoint as the rest of the cloud-controller-manager
+	metricsSubsystem = "metal"
+)
+
+var (
+	// loadBalancerBackendUp whether a node answers on a service's node port
+	loadBalancerBackendUp = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "loadbalancer_backend_up",
+			Help:           "Whether a node answers on the node port of a LoadBalancer service port, 1 for up, 0 for down.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service", "node", "port"},
+	)
+
+	// loadBalancerServiceFailed whether the last reconcile of a service failed
+	loadBalancerServiceFailed = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "loadbalancer_service_failed",
+			Help:           "Whether the last reconcile of a LoadBalancer service failed, 1 for failed, 0 for succeeded.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+
+	// deprecatedSetting which deprecated settings are in use, so that old deployments can be found and updated
+	deprecatedSetting = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "deprecated_setting",
+			Help:           "Deprecated settings in use, e.g. env vars from before the rename from Packet, 1 for each.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"name"},
+	)
+
+	// featureEnabled the state of each feature gate, so that experimental behaviors in use can be found
+	featureEnabled = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "feature_enabled",
+			Help:           "Whether a feature gate is enabled, 1 for enabled, 0 for disabled.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"name", "stage"},
+	)
+
+	// buildInfoMetric which build of the CCM is running, and with which configuration, so that it can be audited across clusters
+	buildInfoMetric = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "build_info",
+			Help:           "Build of the CCM and hash of its effective configuration, always 1.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"version", "git_commit", "go_version", "config_hash"},
+	)
+
+	// controlPlaneEndpointMode how the CCM manages the control plane endpoint, so that clusters
+	// without an elastic IP show as such rather than as failing
+	controlPlaneEndpointMode = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "control_plane_endpoint_mode",
+			Help:           "How the CCM manages the control plane endpoint, 1 for the mode in use: disabled, elastic-ip or load-balancer.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"mode"},
+	)
+
+	// controlPlaneHealthCheckDuration how long the health checks of the control plane elastic IP, and of
+	// the apiserver on each control plane node, take, so that a degrading route to the elastic IP shows
+	// before it fails
+	controlPlaneHealthCheckDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "control_plane_healthcheck_duration_seconds",
+			Help:           "Duration of the health checks of the control plane elastic IP and of the apiserver on each control plane node.",
+			Buckets:        metrics.ExponentialBuckets(0.005, 2, 11),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"target", "node", "result"},
+	)
+
+	// faultInjected how many faults were injected, see faultInjector, to tell them from real ones in soak tests
+	faultInjected = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "fault_injected_total",
+			Help:           "Faults injected into Equinix Metal API calls and control plane health checks, for soak testing.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"target", "fault"},
+	)
+
+	// loggedErrors how often each kind of error occurred, including the repeats that were
+	// not logged, see repeatedErrorLog
+	loggedErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "logged_errors_total",
+			Help:           "Errors that occurred, by reason, including the repeats not logged to keep the logs readable.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	// eipAssigned where the control plane elastic IP is assigned, so that dashboards show which node holds it
+	eipAssigned = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "eip_assigned",
+			Help:           "Node and device to which the control plane elastic IP is assigned, 1 if assigned, 0 with empty node and device if not.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"eip", "node", "device_id"},
+	)
+
+	// eipHealthCheckUp whether the control plane elastic IP answered its last health check
+	eipHealthCheckUp = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "eip_healthcheck_up",
+			Help:           "Whether the control plane elastic IP answered its last health check, 1 for up, 0 for down.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"eip"},
+	)
+
+	// authTokenRefreshFailed whether the last read of the auth token from its source failed
+	authTokenRefreshFailed = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "auth_token_refresh_failed",
+			Help:           "Whether the last read of the Equinix Metal auth token from its source failed, 1 for failed, 0 for succeeded.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	// syncInterval the interval between full syncs, longer than usual while the kubernetes API is under pressure
+	syncInterval = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "sync_interval_seconds",
+			Help:           "Interval between full syncs of nodes and services, longer than usual while the kubernetes API is under pressure.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics register all of the CCM metrics with the global registry.
+// Metrics that are not registered do nothing, so it is safe to use them
+// in tests without registering.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(
+			loadBalancerBackendUp,
+			loadBalancerServiceFailed,
+			deprecatedSetting,
+			featureEnabled,
+			buildInfoMetric,
+			controlPlaneEndpointMode,
+			controlPlaneHealthCheckDuration,
+			faultInjected,
+			loggedErrors,
+			syncInterval,
+			eipAssigned,
+			eipHealthCheckUp,
+			authTokenRefreshFailed,
+		)
+	})
+}
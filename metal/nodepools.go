@@ -0,0 +1,377 @@
+package metal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/packethost/packngo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// nodePoolTagPrefix the prefix of the tag that marks a device as belonging to a NodePool
+	nodePoolTagPrefix     = "nodepool="
+	nodePoolBillingCycle  = "hourly"
+	nodePoolHostnameChars = 5
+)
+
+// nodePoolResource the NodePool custom resource, from which the CCM creates and deletes
+// devices, see deploy/crds
+var nodePoolResource = schema.GroupVersionResource{Group: "metal.equinix.com", Version: "v1alpha1", Resource: "nodepools"}
+
+// nodePoolSpec the desired devices of a NodePool
+type nodePoolSpec struct {
+	Replicas        int      `json:"replicas"`
+	Plan            string   `json:"plan"`
+	Metro           string   `json:"metro,omitempty"`
+	Facilities      []string `json:"facilities,omitempty"`
+	OperatingSystem string   `json:"operatingSystem"`
+	BillingCycle    string   `json:"billingCycle,omitempty"`
+	// UserData a text/template for the userdata of each device, see nodePoolUserData
+	UserData string   `json:"userData,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// nodePoolUserData the data with which the userdata template of a NodePool is executed
+type nodePoolUserData struct {
+	// Hostname the hostname of the device being created
+	Hostname string
+	NodePool string
+	Plan     string
+	Metro    string
+	// Facility the first facility, if any
+	Facility string
+}
+
+// nodePoolStatus the observed devices of a NodePool
+type nodePoolStatus struct {
+	Replicas  int
+	DeviceIDs []string
+	Message   string
+}
+
+func (s nodePoolStatus) unstructured() map[string]interface{} {
+	deviceIDs := make([]interface{}, 0, len(s.DeviceIDs))
+	for _, id := range s.DeviceIDs {
+		deviceIDs = append(deviceIDs, id)
+	}
+	status := map[string]interface{}{
+		"replicas":  int64(s.Replicas),
+		"deviceIDs": deviceIDs,
+	}
+	if s.Message != "" {
+		status["message"] = s.Message
+	}
+	return status
+}
+
+// deviceCreateRequest a device create request that can place the device in a metro,
+// which packngo.DeviceCreateRequest does not support yet
+type deviceCreateRequest struct {
+	packngo.DeviceCreateRequest
+	Metro string `json:"metro,omitempty"`
+}
+
+// nodePoolDevices the Equinix Metal device operations a nodePoolManager needs
+type nodePoolDevices interface {
+	list(projectID string) ([]packngo.Device, error)
+	create(req *deviceCreateRequest) (*packngo.Device, error)
+	delete(deviceID string) error
+}
+
+// packngoNodePoolDevices nodePoolDevices with the Equinix Metal API
+type packngoNodePoolDevices struct {
+	client *packngo.Client
+}
+
+func (d packngoNodePoolDevices) list(projectID string) ([]packngo.Device, error) {
+	devices, _, err := d.client.Devices.List(projectID, nil)
+	return devices, wrapAPIError(err)
+}
+
+func (d packngoNodePoolDevices) create(req *deviceCreateRequest) (*packngo.Device, error) {
+	device := new(packngo.Device)
+	_, err := d.client.DoRequest("POST", fmt.Sprintf("/projects/%s/devices", req.ProjectID), req, device)
+	return device, wrapAPIError(err)
+}
+
+func (d packngoNodePoolDevices) delete(deviceID string) error {
+	_, err := d.client.Devices.Delete(deviceID, false)
+	return wrapAPIError(err)
+}
+
+// nodePoolManager an experimental, minimal machine manager for clusters without Cluster API:
+// it creates and deletes devices to match the replicas of each NodePool
+type nodePoolManager struct {
+	devices       nodePoolDevices
+	projectID     string
+	enabled       bool
+	clusterID     string
+	dynamicClient dynamic.Interface
+}
+
+func newNodePoolManager(devices nodePoolDevices, projectID string, enabled bool) *nodePoolManager {
+	return &nodePoolManager{devices: devices, projectID: projectID, enabled: enabled}
+}
+
+func (m *nodePoolManager) name() string {
+	return "nodepools"
+}
+
+func (m *nodePoolManager) init(k8sclient kubernetes.Interface) error {
+	if !m.enabled {
+		return nil
+	}
+	// tag devices with the UID of the kube-system namespace, as the load balancer does
+	// its elastic IPs, so that two clusters in a project never touch each other's devices
+	systemNamespace, err := k8sclient.CoreV1().Namespaces().Get(context.Background(), "kube-system", metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get kube-system namespace: %w", err)
+	}
+	m.clusterID = string(systemNamespace.UID)
+	return nil
+}
+
+func (m *nodePoolManager) initCustomResources(client dynamic.Interface) {
+	m.dynamicClient = client
+}
+
+func (m *nodePoolManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *nodePoolManager) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch reconcile the NodePools now, and then periodically
+func (m *nodePoolManager) watch(ctx context.Context) error {
+	if !m.enabled {
+		klog.V(2).Info("node pools disabled, not managing devices")
+		return nil
+	}
+	klog.Warning("node pools enabled; this is experimental, and creates and deletes devices")
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := m.reconcile(ctx); err != nil {
+			klog.Errorf("unable to reconcile node pools: %v", err)
+		}
+	}, checkLoopTimerSeconds*time.Second)
+	return nil
+}
+
+// reconcile create and delete devices to match the replicas of each NodePool, and
+// delete the devices of NodePools that no longer exist
+func (m *nodePoolManager) reconcile(ctx context.Context) error {
+	client := m.dynamicClient.Resource(nodePoolResource)
+	pools, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+			klog.V(2).Infof("%s custom resource definition not installed, not managing node pools", nodePoolResource.GroupResource())
+			return nil
+		}
+		return fmt.Errorf("unable to list node pools: %w", err)
+	}
+	devices, err := m.devices.list(m.projectID)
+	if err != nil {
+		return fmt.Errorf("unable to list devices: %w", err)
+	}
+	byPool := m.devicesByPool(devices)
+
+	var errs []error
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		status := m.reconcilePool(pool.GetName(), pool.Object, byPool[pool.GetName()])
+		delete(byPool, pool.GetName())
+		if err := m.writeStatus(ctx, pool, status); err != nil {
+			errs = append(errs, fmt.Errorf("unable to update status of node pool %s: %w", pool.GetName(), err))
+		}
+	}
+	// whatever is left belongs to node pools that were deleted
+	for name, orphans := range byPool {
+		for _, device := range orphans {
+			klog.Infof("deleting device %s of deleted node pool %s", device.ID, name)
+			if err := m.devices.delete(device.ID); err != nil {
+				errs = append(errs, fmt.Errorf("unable to delete device %s of deleted node pool %s: %w", device.ID, name, err))
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// reconcilePool create or delete devices of the NodePool, given its existing devices,
+// and return its resulting status
+func (m *nodePoolManager) reconcilePool(name string, obj map[string]interface{}, devices []packngo.Device) nodePoolStatus {
+	var spec nodePoolSpec
+	if specObj, ok := obj["spec"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(specObj, &spec); err != nil {
+			return newNodePoolStatus(devices, fmt.Sprintf("invalid spec: %v", err))
+		}
+	}
+	if err := validateNodePoolSpec(spec); err != nil {
+		return newNodePoolStatus(devices, fmt.Sprintf("invalid spec: %v", err))
+	}
+
+	var errs []error
+	switch {
+	case len(devices) < spec.Replicas:
+		for i := len(devices); i < spec.Replicas; i++ {
+			device, err := m.createDevice(name, spec)
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			klog.Infof("created device %s (%s) for node pool %s", device.ID, device.Hostname, name)
+			devices = append(devices, *device)
+		}
+	case len(devices) > spec.Replicas:
+		// delete the newest first; they are the least likely to be running workloads yet
+		sort.SliceStable(devices, func(i, j int) bool { return devices[i].Created > devices[j].Created })
+		for len(devices) > spec.Replicas {
+			device := devices[0]
+			if err := m.devices.delete(device.ID); err != nil {
+				errs = append(errs, fmt.Errorf("unable to delete device %s: %w", device.ID, err))
+				break
+			}
+			klog.Infof("deleted device %s (%s) of node pool %s", device.ID, device.Hostname, name)
+			devices = devices[1:]
+		}
+	}
+	var message string
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		klog.Errorf("unable to scale node pool %s to %d: %v", name, spec.Replicas, err)
+		message = err.Error()
+	}
+	return newNodePoolStatus(devices, message)
+}
+
+// createDevice create a device for the NodePool
+func (m *nodePoolManager) createDevice(name string, spec nodePoolSpec) (*packngo.Device, error) {
+	hostname := fmt.Sprintf("%s-%s", name, utilrand.String(nodePoolHostnameChars))
+	data := nodePoolUserData{Hostname: hostname, NodePool: name, Plan: spec.Plan, Metro: spec.Metro}
+	if len(spec.Facilities) > 0 {
+		data.Facility = spec.Facilities[0]
+	}
+	userData, err := nodePoolUserDataTemplate(spec.UserData, data)
+	if err != nil {
+		return nil, err
+	}
+	billingCycle := spec.BillingCycle
+	if billingCycle == "" {
+		billingCycle = nodePoolBillingCycle
+	}
+	req := &deviceCreateRequest{
+		DeviceCreateRequest: packngo.DeviceCreateRequest{
+			Hostname:     hostname,
+			Plan:         spec.Plan,
+			Facility:     spec.Facilities,
+			OS:           spec.OperatingSystem,
+			BillingCycle: billingCycle,
+			ProjectID:    m.projectID,
+			UserData:     userData,
+			Tags:         append([]string{emTag, clusterTag(m.clusterID), nodePoolTagPrefix + name}, spec.Tags...),
+		},
+		Metro: spec.Metro,
+	}
+	device, err := m.devices.create(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create device %s: %w", hostname, err)
+	}
+	return device, nil
+}
+
+// devicesByPool the devices of this cluster's NodePools, by NodePool name
+func (m *nodePoolManager) devicesByPool(devices []packngo.Device) map[string][]packngo.Device {
+	byPool := map[string][]packngo.Device{}
+	clsTag := clusterTag(m.clusterID)
+	for _, device := range devices {
+		var managed, cluster bool
+		var pool string
+		for _, tag := range device.Tags {
+			switch {
+			case tag == emTag:
+				managed = true
+			case tag == clsTag:
+				cluster = true
+			case strings.HasPrefix(tag, nodePoolTagPrefix):
+				pool = strings.TrimPrefix(tag, nodePoolTagPrefix)
+			}
+		}
+		// never touch devices that Cluster API manages, whatever their other tags
+		if managed && cluster && pool != "" && !managedByClusterAPI(device.Tags) {
+			byPool[pool] = append(byPool[pool], device)
+		}
+	}
+	return byPool
+}
+
+func (m *nodePoolManager) writeStatus(ctx context.Context, pool *unstructured.Unstructured, status nodePoolStatus) error {
+	current, _, _ := unstructured.NestedMap(pool.Object, "status")
+	desired := status.unstructured()
+	if reflect.DeepEqual(runtime.DeepCopyJSONValue(current), runtime.DeepCopyJSONValue(desired)) {
+		return nil
+	}
+	if err := unstructured.SetNestedMap(pool.Object, desired, "status"); err != nil {
+		return fmt.Errorf("unable to set status: %w", err)
+	}
+	_, err := m.dynamicClient.Resource(nodePoolResource).UpdateStatus(ctx, pool, metav1.UpdateOptions{})
+	return err
+}
+
+func newNodePoolStatus(devices []packngo.Device, message string) nodePoolStatus {
+	status := nodePoolStatus{Replicas: len(devices), Message: message}
+	for _, device := range devices {
+		status.DeviceIDs = append(status.DeviceIDs, device.ID)
+	}
+	sort.Strings(status.DeviceIDs)
+	return status
+}
+
+// validateNodePoolSpec return an error if a device cannot be created from the spec
+func validateNodePoolSpec(spec nodePoolSpec) error {
+	switch {
+	case spec.Replicas < 0:
+		return fmt.Errorf("replicas must not be negative, was %d", spec.Replicas)
+	case spec.Plan == "":
+		return fmt.Errorf("plan is required")
+	case spec.OperatingSystem == "":
+		return fmt.Errorf("operatingSystem is required")
+	case spec.Metro == "" && len(spec.Facilities) == 0:
+		return fmt.Errorf("one of metro or facilities is required")
+	case spec.Metro != "" && len(spec.Facilities) > 0:
+		return fmt.Errorf("only one of metro or facilities may be set")
+	}
+	if _, err := template.New("userData").Parse(spec.UserData); err != nil {
+		return fmt.Errorf("invalid userData template: %w", err)
+	}
+	return nil
+}
+
+// nodePoolUserDataTemplate execute the userdata template of a NodePool
+func nodePoolUserDataTemplate(userData string, data nodePoolUserData) (string, error) {
+	tmpl, err := template.New("userData").Option("missingkey=error").Parse(userData)
+	if err != nil {
+		return "", fmt.Errorf("invalid userData template: %w", err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("unable to execute userData template: %w", err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,202 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testClusterID = "cluster-uid"
+
+// testNodePoolDevices keeps devices in memory
+type testNodePoolDevices struct {
+	devices  []packngo.Device
+	requests []*deviceCreateRequest
+	deleted  []string
+	created  int
+}
+
+func (d *testNodePoolDevices) list(projectID string) ([]packngo.Device, error) {
+	return d.devices, nil
+}
+
+func (d *testNodePoolDevices) create(req *deviceCreateRequest) (*packngo.Device, error) {
+	d.created++
+	device := packngo.Device{
+		ID:       fmt.Sprintf("created-%d", d.created),
+		Hostname: req.Hostname,
+		Tags:     req.Tags,
+		Created:  fmt.Sprintf("2021-01-01T00:00:%02dZ", d.created),
+	}
+	d.requests = append(d.requests, req)
+	d.devices = append(d.devices, device)
+	return &device, nil
+}
+
+func (d *testNodePoolDevices) delete(deviceID string) error {
+	d.deleted = append(d.deleted, deviceID)
+	for i, device := range d.devices {
+		if device.ID == deviceID {
+			d.devices = append(d.devices[:i], d.devices[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func testNodePool(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(nodePoolResource.GroupVersion().String())
+	obj.SetKind("NodePool")
+	obj.SetName(name)
+	return obj
+}
+
+func testNodePoolDevice(id, pool string) packngo.Device {
+	return packngo.Device{ID: id, Tags: []string{emTag, clusterTag(testClusterID), nodePoolTagPrefix + pool}}
+}
+
+func TestValidateNodePoolSpec(t *testing.T) {
+	tests := []struct {
+		spec nodePoolSpec
+		err  bool
+	}{
+		{nodePoolSpec{Replicas: 1, Plan: "c3.small.x86", OperatingSystem: "ubuntu_20_04", Metro: "da"}, false},
+		{nodePoolSpec{Plan: "c3.small.x86", OperatingSystem: "ubuntu_20_04", Facilities: []string{"ewr1"}}, false},
+		{nodePoolSpec{Replicas: -1, Plan: "c3.small.x86", OperatingSystem: "ubuntu_20_04", Metro: "da"}, true},
+		{nodePoolSpec{OperatingSystem: "ubuntu_20_04", Metro: "da"}, true},
+		{nodePoolSpec{Plan: "c3.small.x86", Metro: "da"}, true},
+		{nodePoolSpec{Plan: "c3.small.x86", OperatingSystem: "ubuntu_20_04"}, true},
+		{nodePoolSpec{Plan: "c3.small.x86", OperatingSystem: "ubuntu_20_04", Metro: "da", Facilities: []string{"ewr1"}}, true},
+		{nodePoolSpec{Plan: "c3.small.x86", OperatingSystem: "ubuntu_20_04", Metro: "da", UserData: "{{ .Hostname"}, true},
+	}
+	for i, tt := range tests {
+		err := validateNodePoolSpec(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("%d: mismatched error, actual %v expected error %t", i, err, tt.err)
+		}
+	}
+}
+
+func TestNodePoolUserDataTemplate(t *testing.T) {
+	data := nodePoolUserData{Hostname: "workers-abcde", NodePool: "workers", Plan: "c3.small.x86", Metro: "da"}
+	tests := []struct {
+		userData string
+		expected string
+		err      bool
+	}{
+		{"", "", false},
+		{"#!/bin/sh\nhostname {{ .Hostname }}", "#!/bin/sh\nhostname workers-abcde", false},
+		{"{{ .NodePool }} {{ .Plan }} {{ .Metro }} {{ .Facility }}", "workers c3.small.x86 da ", false},
+		{"{{ .Unknown }}", "", true},
+	}
+	for i, tt := range tests {
+		actual, err := nodePoolUserDataTemplate(tt.userData, data)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: mismatched error, actual %v expected error %t", i, err, tt.err)
+		case actual != tt.expected:
+			t.Errorf("%d: mismatched userdata, actual %q expected %q", i, actual, tt.expected)
+		}
+	}
+}
+
+func TestNodePoolReconcile(t *testing.T) {
+	ctx := context.Background()
+	devices := &testNodePoolDevices{devices: []packngo.Device{
+		// scaled down from two to one, newest deleted
+		{ID: "shrink-old", Created: "2020-01-01T00:00:00Z", Tags: []string{emTag, clusterTag(testClusterID), nodePoolTagPrefix + "shrink"}},
+		{ID: "shrink-new", Created: "2020-06-01T00:00:00Z", Tags: []string{emTag, clusterTag(testClusterID), nodePoolTagPrefix + "shrink"}},
+		// node pool deleted
+		testNodePoolDevice("orphan", "deleted"),
+		// another cluster's node pool of the same name
+		{ID: "other-cluster", Tags: []string{emTag, clusterTag("other"), nodePoolTagPrefix + "deleted"}},
+		// not managed by the CCM at all
+		{ID: "unmanaged", Tags: []string{nodePoolTagPrefix + "deleted"}},
+		// managed by Cluster API
+		{ID: "clusterapi", Tags: []string{emTag, clusterTag(testClusterID), nodePoolTagPrefix + "deleted", "cluster-api-provider-packet:cluster-id:test"}},
+	}}
+	client := testDynamicClient(
+		testNodePool("grow", map[string]interface{}{
+			"replicas":        int64(2),
+			"plan":            "c3.small.x86",
+			"metro":           "da",
+			"operatingSystem": "ubuntu_20_04",
+			"userData":        "hostname {{ .Hostname }}",
+			"tags":            []interface{}{"workers"},
+		}),
+		testNodePool("shrink", map[string]interface{}{
+			"replicas":        int64(1),
+			"plan":            "c3.small.x86",
+			"facilities":      []interface{}{"ewr1"},
+			"operatingSystem": "ubuntu_20_04",
+		}),
+		testNodePool("invalid", map[string]interface{}{
+			"replicas": int64(1),
+			"plan":     "c3.small.x86",
+		}),
+	)
+	m := newNodePoolManager(devices, "project", true)
+	m.clusterID = testClusterID
+	m.initCustomResources(client)
+
+	if err := m.reconcile(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(devices.requests) != 2 {
+		t.Fatalf("mismatched created devices, actual %d expected 2", len(devices.requests))
+	}
+	for _, req := range devices.requests {
+		if !strings.HasPrefix(req.Hostname, "grow-") || req.Plan != "c3.small.x86" || req.Metro != "da" || req.BillingCycle != nodePoolBillingCycle || req.ProjectID != "project" {
+			t.Errorf("mismatched create request: %+v", req)
+		}
+		if req.UserData != "hostname "+req.Hostname {
+			t.Errorf("mismatched userdata, actual %q", req.UserData)
+		}
+		if strings.Join(req.Tags, ",") != strings.Join([]string{emTag, clusterTag(testClusterID), "nodepool=grow", "workers"}, ",") {
+			t.Errorf("mismatched tags, actual %v", req.Tags)
+		}
+	}
+	if strings.Join(devices.deleted, ",") != "shrink-new,orphan" {
+		t.Errorf("mismatched deleted devices, actual %v expected shrink-new,orphan", devices.deleted)
+	}
+
+	getStatus := func(name string) map[string]interface{} {
+		obj, err := client.Resource(nodePoolResource).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get node pool %s: %v", name, err)
+		}
+		status, _, _ := unstructured.NestedMap(obj.Object, "status")
+		return status
+	}
+	if status := getStatus("grow"); status["replicas"] != int64(2) || status["message"] != nil {
+		t.Errorf("mismatched status of grow, actual %v", status)
+	}
+	if status := getStatus("shrink"); status["replicas"] != int64(1) || fmt.Sprint(status["deviceIDs"]) != "[shrink-old]" {
+		t.Errorf("mismatched status of shrink, actual %v", status)
+	}
+	if status := getStatus("invalid"); status["replicas"] != int64(0) || !strings.Contains(fmt.Sprint(status["message"]), "operatingSystem is required") {
+		t.Errorf("mismatched status of invalid, actual %v", status)
+	}
+
+	// nothing more to do, and the status is not written again
+	client.ClearActions()
+	devices.requests, devices.deleted = nil, nil
+	if err := m.reconcile(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(devices.requests) != 0 || len(devices.deleted) != 0 {
+		t.Errorf("unexpected changes to devices, created %d deleted %v", len(devices.requests), devices.deleted)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "list" {
+			t.Errorf("unexpected %s of node pools", action.GetVerb())
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	notificationKind = "Notification"
+	// notificationInterval how often the CCM checks for what to notify about; the checks
+	// call the Equinix Metal API, and what they find rarely changes
+	notificationInterval = 10 * time.Minute
+
+	notificationSeverityError   = "Error"
+	notificationSeverityWarning = "Warning"
+)
+
+// notificationResource the Notification custom resource, in whose status the CCM reports
+// a problem an operator should act on, one per problem, see deploy/crds
+var notificationResource = schema.GroupVersionResource{Group: "metal.equinix.com", Version: "v1alpha1", Resource: "notifications"}
+
+// notificationCheck a check of the checker that the CCM keeps running, and notifies about
+type notificationCheck struct {
+	// name the name of the Notification, reason a CamelCase reason, as for events
+	name   string
+	reason string
+	check  func(c checker) checkResult
+	// ignoreWarn do not notify when the check only warns
+	ignoreWarn bool
+	// action what the operator should do, added to the detail of the check
+	action string
+}
+
+// notificationChecks what the CCM notifies about: unlike the other checks of Check, the
+// outcome of these can change while the CCM runs
+var notificationChecks = []notificationCheck{
+	// the token check only warns when it cannot tell the scope of the token
+	{name: "token-scope", reason: "TokenReadOnly", check: checker.checkToken, ignoreWarn: true, action: "use a read-write API key"},
+	{name: "control-plane-elastic-ip", reason: "ControlPlaneElasticIPInvalid", check: checker.checkEIP, action: "the CCM does not move the elastic IP until there is exactly one, assigned to at most one device"},
+	{name: "bgp", reason: "BGPDisabled", check: checker.checkBGP, action: "only when it starts, so restart it"},
+}
+
+// notificationStatus the status of a Notification
+type notificationStatus struct {
+	Severity string
+	Reason   string
+	Message  string
+	// Since when the message last changed
+	Since time.Time
+}
+
+func (s notificationStatus) unstructured() map[string]interface{} {
+	return map[string]interface{}{
+		"severity": s.Severity,
+		"reason":   s.Reason,
+		"message":  s.Message,
+		"since":    s.Since.UTC().Format(time.RFC3339),
+	}
+}
+
+// notificationManager reports, as Notifications, the problems that an operator should act on,
+// rather than only logging them, and deletes each once it is gone
+type notificationManager struct {
+	checker       checker
+	dynamicClient dynamic.Interface
+
+	// lock protects raised, the message of each Notification as last written, empty once deleted;
+	// a name that is not there may be left over from an earlier run of the CCM
+	lock   sync.Mutex
+	raised map[string]string
+}
+
+func newNotificationManager(config Config, client *packngo.Client) *notificationManager {
+	m := &notificationManager{raised: map[string]string{}}
+	if client != nil {
+		m.checker = checker{
+			config:    config,
+			apiKeys:   client.APIKeys,
+			ips:       client.ProjectIPs,
+			bgpConfig: client.BGPConfig,
+		}
+	}
+	return m
+}
+
+func (m *notificationManager) name() string {
+	return "notifications"
+}
+
+func (m *notificationManager) init(k8sclient kubernetes.Interface) error {
+	return nil
+}
+
+func (m *notificationManager) initCustomResources(client dynamic.Interface) {
+	m.dynamicClient = client
+}
+
+func (m *notificationManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *notificationManager) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch run the notification checks now, and then periodically
+func (m *notificationManager) watch(ctx context.Context) error {
+	if m.dynamicClient == nil || m.checker.apiKeys == nil {
+		return nil
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := m.runChecks(ctx); err != nil {
+			klog.Errorf("unable to report notifications: %v", err)
+		}
+	}, notificationInterval)
+	return nil
+}
+
+// runChecks raise a Notification for each check that fails, and resolve it for each that passes.
+// If the custom resource definition is not installed, the problems are only logged.
+func (m *notificationManager) runChecks(ctx context.Context) error {
+	var errs []error
+	for _, nc := range notificationChecks {
+		r := nc.check(m.checker)
+		var err error
+		if r.status == checkOK || (r.status == checkWarn && nc.ignoreWarn) {
+			err = m.resolve(ctx, nc.name)
+		} else {
+			severity := notificationSeverityWarning
+			if r.status == checkFail {
+				severity = notificationSeverityError
+			}
+			message := r.detail
+			if nc.action != "" {
+				message = fmt.Sprintf("%s; %s", message, nc.action)
+			}
+			err = m.raise(ctx, nc.name, severity, nc.reason, message)
+		}
+		switch {
+		case err == nil:
+		case meta.IsNoMatchError(err) || apierrors.IsNotFound(err):
+			klog.V(2).Infof("%s custom resource definition not installed, not reporting notification %s", notificationResource.GroupResource(), nc.name)
+		default:
+			errs = append(errs, fmt.Errorf("notification %s: %w", nc.name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// raise report a problem in the Notification of the name, creating it if needed. It only
+// writes when the message changed since it was last raised, or from the one in the Notification.
+func (m *notificationManager) raise(ctx context.Context, name, severity, reason, message string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.raised[name] == message {
+		return nil
+	}
+	klog.Warningf("%s: %s", reason, message)
+	status := notificationStatus{Severity: severity, Reason: reason, Message: message, Since: time.Now()}
+	client := m.dynamicClient.Resource(notificationResource)
+	obj, err := client.Get(ctx, name, metav1.GetOptions{})
+	if err == nil && notificationUnchanged(obj, status) {
+		// e.g. raised before the CCM restarted; keeps when it was first raised
+		m.raised[name] = message
+		return nil
+	}
+	if apierrors.IsNotFound(err) {
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion(notificationResource.GroupVersion().String())
+		obj.SetKind(notificationKind)
+		obj.SetName(name)
+		obj.SetLabels(map[string]string{managedByLabel: managedByCCM})
+		obj, err = client.Create(ctx, obj, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	if err := unstructured.SetNestedMap(obj.Object, status.unstructured(), "status"); err != nil {
+		return fmt.Errorf("unable to set status: %w", err)
+	}
+	if _, err := client.UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	m.raised[name] = message
+	return nil
+}
+
+// notificationUnchanged whether the Notification already has the severity, reason and message of the status
+func notificationUnchanged(obj *unstructured.Unstructured, status notificationStatus) bool {
+	severity, _, _ := unstructured.NestedString(obj.Object, "status", "severity")
+	reason, _, _ := unstructured.NestedString(obj.Object, "status", "reason")
+	message, _, _ := unstructured.NestedString(obj.Object, "status", "message")
+	return severity == status.Severity && reason == status.Reason && message == status.Message
+}
+
+// resolve delete the Notification of the name, once the problem is gone
+func (m *notificationManager) resolve(ctx context.Context, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if message, ok := m.raised[name]; ok && message == "" {
+		return nil
+	}
+	err := m.dynamicClient.Resource(notificationResource).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		klog.Infof("notification %s resolved", name)
+	}
+	m.raised[name] = ""
+	return nil
+}
@@ -0,0 +1,90 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestNotifications(t *testing.T) {
+	ctx := context.Background()
+	eip := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Address: testEIP, Tags: []string{"eiptag"}}}
+	client := testDynamicClient()
+	m := newNotificationManager(Config{}, nil)
+	m.initCustomResources(client)
+	m.checker = checker{
+		config:    Config{AuthToken: "token", ProjectID: "project", EIPTag: "eiptag"},
+		apiKeys:   testCheckAPIKeys{project: []packngo.APIKey{{Token: "token", ReadOnly: true, Project: &packngo.Project{}}}},
+		ips:       &countingProjectIPService{ips: []packngo.IPAddressReservation{eip}},
+		bgpConfig: testCheckBGPConfig{config: &packngo.BGPConfig{}},
+	}
+
+	getStatus := func(name string) (map[string]interface{}, bool) {
+		obj, err := client.Resource(notificationResource).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, false
+		}
+		if err != nil {
+			t.Fatalf("unable to get notification %s: %v", name, err)
+		}
+		status, _, _ := unstructured.NestedMap(obj.Object, "status")
+		return status, true
+	}
+
+	// a read-only token and BGP disabled are raised, a valid elastic IP is not
+	if err := m.runChecks(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status, ok := getStatus("token-scope")
+	if !ok || status["severity"] != notificationSeverityError || status["reason"] != "TokenReadOnly" || !strings.Contains(status["message"].(string), "read-only") {
+		t.Errorf("mismatched token scope notification, actual %v", status)
+	}
+	status, ok = getStatus("bgp")
+	if !ok || status["severity"] != notificationSeverityWarning || status["reason"] != "BGPDisabled" {
+		t.Errorf("mismatched bgp notification, actual %v", status)
+	}
+	if _, ok := getStatus("control-plane-elastic-ip"); ok {
+		t.Errorf("unexpected control plane elastic ip notification")
+	}
+
+	// unchanged problems are not written again, and resolved ones are not deleted again
+	client.ClearActions()
+	if err := m.runChecks(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("mismatched actions for unchanged checks, actual %v expected none", actions)
+	}
+
+	// nor after a restart, which forgets what was raised, but finds it in the notifications
+	checks := m.checker
+	m = newNotificationManager(Config{}, nil)
+	m.initCustomResources(client)
+	m.checker = checks
+	client.ClearActions()
+	if err := m.runChecks(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "create" || action.GetVerb() == "update" {
+			t.Errorf("mismatched action for unchanged checks after restart, actual %v expected no writes", action)
+		}
+	}
+
+	// fixed problems are deleted; a token whose scope is unknown is not a problem
+	m.checker.apiKeys = testCheckAPIKeys{}
+	m.checker.bgpConfig = testCheckBGPConfig{config: &packngo.BGPConfig{ID: "bgp", Status: "enabled"}}
+	if err := m.runChecks(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"token-scope", "bgp"} {
+		if _, ok := getStatus(name); ok {
+			t.Errorf("notification %s not deleted once resolved", name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// planCapacityConfigMap the configmap in which to publish the capacity of each plan,
+	// one key per plan slug, for cluster-autoscaler to build template nodes from
+	planCapacityConfigMapName      = "cloud-provider-equinix-metal-plans"
+	planCapacityConfigMapNamespace = "kube-system"
+	// planCapacityRefresh how often to refresh the plans; they rarely change
+	planCapacityRefresh = time.Hour
+)
+
+// planMemoryRegexp the memory total as reported by the plans API, e.g. 64GB
+var planMemoryRegexp = regexp.MustCompile(`^(\d+)\s*([KMGT])B$`)
+
+// planCapacity the shape of a node of a given plan, as published in the configmap
+type planCapacity struct {
+	// CPU the number of CPUs, as reported by the plans API
+	CPU string `json:"cpu"`
+	// CPUType the type of the CPUs, e.g. Intel Xeon E-2278G 8-Core Processor @ 3.40GHz
+	CPUType string `json:"cpuType,omitempty"`
+	// Memory the memory, as a kubernetes quantity, e.g. 64Gi
+	Memory string `json:"memory,omitempty"`
+	// Class the plan class, e.g. c3.small.x86
+	Class string `json:"class,omitempty"`
+	// Facilities the codes of the facilities in which the plan is available
+	Facilities []string `json:"facilities,omitempty"`
+}
+
+// planCapacityManager publishes the capacity of each Equinix Metal plan to a configmap,
+// so that cluster-autoscaler can scale a node pool of a plan up from zero
+type planCapacityManager struct {
+	client    packngo.PlanService
+	k8sclient kubernetes.Interface
+	enabled   bool
+}
+
+func newPlanCapacityManager(client packngo.PlanService, enabled bool) *planCapacityManager {
+	return &planCapacityManager{client: client, enabled: enabled}
+}
+
+func (m *planCapacityManager) name() string {
+	return "plans"
+}
+
+func (m *planCapacityManager) init(k8sclient kubernetes.Interface) error {
+	m.k8sclient = k8sclient
+	return nil
+}
+
+func (m *planCapacityManager) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (m *planCapacityManager) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch refresh the plan capacity configmap now, and then periodically
+func (m *planCapacityManager) watch(ctx context.Context) error {
+	if !m.enabled {
+		klog.V(2).Info("plan capacity disabled, not publishing configmap")
+		return nil
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := m.refresh(ctx); err != nil {
+			klog.Errorf("unable to publish plan capacity: %v", err)
+		}
+	}, planCapacityRefresh)
+	return nil
+}
+
+// refresh list the plans and write their capacity to the configmap, if it changed
+func (m *planCapacityManager) refresh(ctx context.Context) error {
+	plans, _, err := m.client.List(nil)
+	if err != nil {
+		return fmt.Errorf("unable to list plans: %w", wrapAPIError(err))
+	}
+	data := map[string]string{}
+	for _, plan := range plans {
+		capacity, ok := newPlanCapacity(plan)
+		if !ok {
+			continue
+		}
+		b, err := json.Marshal(capacity)
+		if err != nil {
+			return fmt.Errorf("unable to marshal capacity of plan %s: %w", plan.Slug, err)
+		}
+		data[plan.Slug] = string(b)
+	}
+
+	configMaps := m.k8sclient.CoreV1().ConfigMaps(planCapacityConfigMapNamespace)
+	cm, err := configMaps.Get(ctx, planCapacityConfigMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      planCapacityConfigMapName,
+				Namespace: planCapacityConfigMapNamespace,
+				Labels:    map[string]string{managedByLabel: managedByCCM},
+			},
+			Data: data,
+		}
+		if _, err := configMaps.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("unable to create configmap %s/%s: %w", planCapacityConfigMapNamespace, planCapacityConfigMapName, err)
+		}
+	case err != nil:
+		return fmt.Errorf("unable to get configmap %s/%s: %w", planCapacityConfigMapNamespace, planCapacityConfigMapName, err)
+	case reflect.DeepEqual(cm.Data, data):
+		klog.V(4).Infof("plan capacity unchanged, %d plans", len(data))
+		return nil
+	default:
+		cm.Data = data
+		if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("unable to update configmap %s/%s: %w", planCapacityConfigMapNamespace, planCapacityConfigMapName, err)
+		}
+	}
+	klog.V(2).Infof("published capacity of %d plans to configmap %s/%s", len(data), planCapacityConfigMapNamespace, planCapacityConfigMapName)
+	return nil
+}
+
+// newPlanCapacity the capacity of the plan, and whether it has any, i.e. it has a slug and CPU specs
+func newPlanCapacity(plan packngo.Plan) (planCapacity, bool) {
+	if plan.Slug == "" || plan.Specs == nil {
+		return planCapacity{}, false
+	}
+	var (
+		capacity planCapacity
+		cpus     int
+	)
+	for _, cpu := range plan.Specs.Cpus {
+		if cpu == nil {
+			continue
+		}
+		cpus += cpu.Count
+		if capacity.CPUType == "" {
+			capacity.CPUType = cpu.Type
+		}
+	}
+	if cpus == 0 {
+		return planCapacity{}, false
+	}
+	capacity.CPU = strconv.Itoa(cpus)
+	if plan.Specs.Memory != nil {
+		capacity.Memory = planMemory(plan.Specs.Memory.Total)
+	}
+	capacity.Class = plan.Class
+	for _, facility := range plan.AvailableIn {
+		capacity.Facilities = append(capacity.Facilities, facility.Code)
+	}
+	return capacity, true
+}
+
+// planMemory convert the memory total reported by the plans API, e.g. 64GB, which is
+// in binary units, to a kubernetes quantity, e.g. 64Gi; empty if it cannot be parsed
+func planMemory(total string) string {
+	matches := planMemoryRegexp.FindStringSubmatch(total)
+	if matches == nil {
+		if total != "" {
+			klog.V(2).Infof("unable to parse plan memory %q", total)
+		}
+		return ""
+	}
+	return matches[1] + matches[2] + "i"
+}
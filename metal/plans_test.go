@@ -0,0 +1,132 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/packethost/packngo"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testPlanService lists a fixed set of plans
+type testPlanService struct {
+	plans []packngo.Plan
+}
+
+func (s *testPlanService) List(*packngo.ListOptions) ([]packngo.Plan, *packngo.Response, error) {
+	return s.plans, nil, nil
+}
+
+func TestPlanMemory(t *testing.T) {
+	tests := []struct {
+		total  string
+		memory string
+	}{
+		{"64GB", "64Gi"},
+		{"512 MB", "512Mi"},
+		{"1TB", "1Ti"},
+		{"", ""},
+		{"lots", ""},
+		{"64GiB", ""},
+	}
+	for i, tt := range tests {
+		if memory := planMemory(tt.total); memory != tt.memory {
+			t.Errorf("%d: mismatched memory for %q, actual %q expected %q", i, tt.total, memory, tt.memory)
+		}
+	}
+}
+
+func TestNewPlanCapacity(t *testing.T) {
+	tests := []struct {
+		plan     packngo.Plan
+		capacity planCapacity
+		ok       bool
+	}{
+		{packngo.Plan{Slug: "legacy"}, planCapacity{}, false},
+		{packngo.Plan{Specs: &packngo.Specs{Cpus: []*packngo.Cpus{{Count: 1}}}}, planCapacity{}, false},
+		{packngo.Plan{Slug: "nocpu", Specs: &packngo.Specs{}}, planCapacity{}, false},
+		{
+			packngo.Plan{
+				Slug:        "c3.small.x86",
+				Class:       "c3.small.x86",
+				Specs:       &packngo.Specs{Cpus: []*packngo.Cpus{{Count: 1, Type: "Xeon"}}, Memory: &packngo.Memory{Total: "32GB"}},
+				AvailableIn: []packngo.Facility{{Code: "ewr1"}, {Code: "sjc1"}},
+			},
+			planCapacity{CPU: "1", CPUType: "Xeon", Memory: "32Gi", Class: "c3.small.x86", Facilities: []string{"ewr1", "sjc1"}},
+			true,
+		},
+		{
+			packngo.Plan{
+				Slug:  "m3.large.x86",
+				Specs: &packngo.Specs{Cpus: []*packngo.Cpus{{Count: 1, Type: "EPYC"}, {Count: 1, Type: "EPYC"}}},
+			},
+			planCapacity{CPU: "2", CPUType: "EPYC"},
+			true,
+		},
+	}
+	for i, tt := range tests {
+		capacity, ok := newPlanCapacity(tt.plan)
+		if ok != tt.ok {
+			t.Errorf("%d: mismatched ok, actual %t expected %t", i, ok, tt.ok)
+			continue
+		}
+		actual, _ := json.Marshal(capacity)
+		expected, _ := json.Marshal(tt.capacity)
+		if string(actual) != string(expected) {
+			t.Errorf("%d: mismatched capacity, actual %s expected %s", i, actual, expected)
+		}
+	}
+}
+
+func TestPlanCapacityRefresh(t *testing.T) {
+	ctx := context.Background()
+	plans := &testPlanService{plans: []packngo.Plan{
+		{Slug: "c3.small.x86", Specs: &packngo.Specs{Cpus: []*packngo.Cpus{{Count: 1}}, Memory: &packngo.Memory{Total: "32GB"}}},
+		{Slug: "legacy"},
+	}}
+	client := fake.NewSimpleClientset()
+	m := newPlanCapacityManager(plans, true)
+	if err := m.init(client); err != nil {
+		t.Fatalf("unexpected error initializing: %v", err)
+	}
+
+	get := func() map[string]string {
+		cm, err := client.CoreV1().ConfigMaps(planCapacityConfigMapNamespace).Get(ctx, planCapacityConfigMapName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get configmap: %v", err)
+		}
+		return cm.Data
+	}
+
+	// created
+	if err := m.refresh(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := get()
+	if len(data) != 1 || data["c3.small.x86"] != `{"cpu":"1","memory":"32Gi"}` {
+		t.Errorf("mismatched data after create: %v", data)
+	}
+
+	// updated
+	plans.plans = append(plans.plans, packngo.Plan{Slug: "s3.xlarge.x86", Specs: &packngo.Specs{Cpus: []*packngo.Cpus{{Count: 2}}}})
+	if err := m.refresh(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data = get()
+	if len(data) != 2 || data["s3.xlarge.x86"] != `{"cpu":"2"}` {
+		t.Errorf("mismatched data after update: %v", data)
+	}
+
+	// unchanged, so not written
+	client.ClearActions()
+	if err := m.refresh(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("unexpected %s of unchanged configmap", action.GetVerb())
+		}
+	}
+}
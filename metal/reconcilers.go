@@ -0,0 +1,79 @@
+package metal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// ReconcilerEIP the control plane endpoint, whether an elastic IP or a load balancer
+	ReconcilerEIP = "eip"
+	// ReconcilerLoadBalancer the IPs and configuration of services of type LoadBalancer
+	ReconcilerLoadBalancer = "loadbalancer"
+	// ReconcilerBGP BGP on the project and devices, and the BGP annotations of nodes
+	ReconcilerBGP = "bgp"
+	// ReconcilerLabels the labels, addresses and device state the CCM keeps up to date on nodes;
+	// the initial addresses and labels of new nodes are set by the cloud-controller-manager
+	ReconcilerLabels = "labels"
+)
+
+// reconcilers those that can be disabled
+var reconcilers = []string{ReconcilerEIP, ReconcilerLoadBalancer, ReconcilerBGP, ReconcilerLabels}
+
+// ParseDisabledReconcilers the reconcilers to disable from the setting, a comma-separated
+// list of their names, e.g. bgp,labels
+func ParseDisabledReconcilers(setting string) (map[string]bool, error) {
+	disabled := map[string]bool{}
+	for _, name := range strings.Split(setting, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, r := range reconcilers {
+			known = known || r == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown reconciler %q, must be one of %s", name, strings.Join(reconcilers, ", "))
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// reconcilerOf the name of the reconciler that can be disabled for a service, empty if it cannot be
+func (c *cloud) reconcilerOf(elm cloudService) string {
+	switch elm {
+	case c.controlPlaneEndpointManager:
+		return ReconcilerEIP
+	case c.loadBalancer:
+		return ReconcilerLoadBalancer
+	case c.bgp:
+		return ReconcilerBGP
+	case c.instances:
+		return ReconcilerLabels
+	default:
+		return ""
+	}
+}
+
+// enabledServices the services to initialize and run, in order, without those whose reconciler is
+// disabled. The instances are needed by the cloud-controller-manager even if their reconciler is
+// disabled, so they are kept, and only their node reconciler is not run, see Initialize.
+func (c *cloud) enabledServices() ([]cloudService, error) {
+	return c.registry.ordered(func(elm cloudService) bool {
+		name := c.reconcilerOf(elm)
+		return c.disabledReconcilers[name] && name != ReconcilerLabels
+	})
+}
+
+// disabledReconcilerNames the disabled reconcilers, sorted, for logging
+func (c *cloud) disabledReconcilerNames() []string {
+	var names []string
+	for name := range c.disabledReconcilers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,65 @@
+package metal
+
+import (
+	"testing"
+)
+
+func TestParseDisabledReconcilers(t *testing.T) {
+	tests := []struct {
+		setting  string
+		disabled []string
+		err      bool
+	}{
+		{"", nil, false},
+		{"bgp", []string{ReconcilerBGP}, false},
+		{"bgp,labels", []string{ReconcilerBGP, ReconcilerLabels}, false},
+		{" EIP , loadbalancer,", []string{ReconcilerEIP, ReconcilerLoadBalancer}, false},
+		{"bgp,routes", nil, true},
+	}
+	for i, tt := range tests {
+		disabled, err := ParseDisabledReconcilers(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error for %q", i, tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error for %q: %v", i, tt.setting, err)
+		case tt.err:
+		case len(disabled) != len(tt.disabled):
+			t.Errorf("%d: mismatched disabled reconcilers for %q, actual %v expected %v", i, tt.setting, disabled, tt.disabled)
+		default:
+			for _, name := range tt.disabled {
+				if !disabled[name] {
+					t.Errorf("%d: reconciler %s not disabled for %q", i, name, tt.setting)
+				}
+			}
+		}
+	}
+}
+
+func TestEnabledServices(t *testing.T) {
+	vc, _ := testGetValidCloud(t)
+	c := *vc
+	c.disabledReconcilers = map[string]bool{ReconcilerBGP: true, ReconcilerLabels: true}
+
+	services, err := c.enabledServices()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	enabled := map[string]bool{}
+	for _, elm := range services {
+		enabled[elm.name()] = true
+	}
+	if len(enabled) != len(c.registry.services)-1 {
+		t.Errorf("mismatched enabled services, actual %d expected %d", len(enabled), len(c.registry.services)-1)
+	}
+	if enabled[c.bgp.name()] {
+		t.Errorf("disabled service %s enabled", c.bgp.name())
+	}
+	// still needed by the cloud-controller-manager, only its reconciler is not run
+	if !enabled[c.instances.name()] {
+		t.Errorf("service %s not enabled", c.instances.name())
+	}
+	if !enabled[c.controlPlaneEndpointManager.name()] || !enabled[c.loadBalancer.name()] {
+		t.Errorf("services %s and %s not enabled", c.controlPlaneEndpointManager.name(), c.loadBalancer.name())
+	}
+}
@@ -0,0 +1,89 @@
+package metal
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// registeredService an internal service of the cloud, with the names of the services it depends on
+type registeredService struct {
+	service   cloudService
+	dependsOn []string
+}
+
+// serviceRegistry the internal services of the cloud. Each is initialized, and its reconcilers run,
+// after the services it depends on; otherwise, in the order they were registered.
+type serviceRegistry struct {
+	services []registeredService
+}
+
+// register add a service, which depends on the services with the given names, e.g. the load balancer
+// on bgp, since it needs BGP enabled on the project
+func (r *serviceRegistry) register(service cloudService, dependsOn ...string) {
+	r.services = append(r.services, registeredService{service: service, dependsOn: dependsOn})
+}
+
+// ordered the registered services, each after those it depends on, without those for which skip,
+// if given, returns true. A dependency on a skipped service is ignored, so that services can be
+// disabled on their own. An unknown dependency, or a cycle, is an error.
+func (r *serviceRegistry) ordered(skip func(cloudService) bool) ([]cloudService, error) {
+	registered := map[string]bool{}
+	for _, s := range r.services {
+		name := s.service.name()
+		if registered[name] {
+			return nil, fmt.Errorf("service %s registered more than once", name)
+		}
+		registered[name] = true
+	}
+	var pending []registeredService
+	skipped := map[string]bool{}
+	for _, s := range r.services {
+		for _, dep := range s.dependsOn {
+			if !registered[dep] {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", s.service.name(), dep)
+			}
+		}
+		if skip != nil && skip(s.service) {
+			skipped[s.service.name()] = true
+			continue
+		}
+		pending = append(pending, s)
+	}
+
+	// repeatedly take the first pending service whose dependencies are all done, which keeps the
+	// registration order where the dependencies allow it
+	var services []cloudService
+	done := map[string]bool{}
+	for len(pending) > 0 {
+		next := -1
+		for i, s := range pending {
+			ready := true
+			for _, dep := range s.dependsOn {
+				ready = ready && (done[dep] || skipped[dep])
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var names []string
+			for _, s := range pending {
+				names = append(names, s.service.name())
+			}
+			return nil, fmt.Errorf("cyclic dependencies between services %s", strings.Join(names, ", "))
+		}
+		s := pending[next]
+		for _, dep := range s.dependsOn {
+			if skipped[dep] {
+				klog.V(2).Infof("service %s depends on %s, which is disabled", s.service.name(), dep)
+			}
+		}
+		services = append(services, s.service)
+		done[s.service.name()] = true
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+	return services, nil
+}
@@ -0,0 +1,65 @@
+package metal
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// testService a service that does nothing, identified by its name
+type testService string
+
+func (s testService) name() string                         { return string(s) }
+func (s testService) init(kubernetes.Interface) error      { return nil }
+func (s testService) nodeReconciler() nodeReconciler       { return nil }
+func (s testService) serviceReconciler() serviceReconciler { return nil }
+
+func TestServiceRegistryOrdered(t *testing.T) {
+	tests := []struct {
+		services  []string
+		dependsOn map[string][]string
+		skip      []string
+		ordered   string
+		err       bool
+	}{
+		{[]string{"a", "b", "c"}, nil, nil, "a,b,c", false},
+		// dependencies first, otherwise in registration order
+		{[]string{"loadbalancer", "instances", "bgp", "metalnodes"}, map[string][]string{"loadbalancer": {"bgp", "metalnodes"}, "bgp": {"metalnodes"}}, nil, "instances,metalnodes,bgp,loadbalancer", false},
+		// a skipped dependency is ignored
+		{[]string{"loadbalancer", "bgp", "metalnodes"}, map[string][]string{"loadbalancer": {"bgp", "metalnodes"}, "bgp": {"metalnodes"}}, []string{"bgp"}, "metalnodes,loadbalancer", false},
+		{[]string{"a", "b"}, map[string][]string{"a": {"unknown"}}, nil, "", true},
+		{[]string{"a", "b", "c"}, map[string][]string{"a": {"b"}, "b": {"a"}}, nil, "", true},
+		{[]string{"a", "a"}, nil, nil, "", true},
+	}
+	for i, tt := range tests {
+		r := &serviceRegistry{}
+		for _, name := range tt.services {
+			r.register(testService(name), tt.dependsOn[name]...)
+		}
+		skip := func(s cloudService) bool {
+			for _, name := range tt.skip {
+				if s.name() == name {
+					return true
+				}
+			}
+			return false
+		}
+		services, err := r.ordered(skip)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected error", i)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case tt.err:
+		default:
+			var names []string
+			for _, s := range services {
+				names = append(names, s.name())
+			}
+			if ordered := strings.Join(names, ","); ordered != tt.ordered {
+				t.Errorf("%d: mismatched order, actual %s expected %s", i, ordered, tt.ordered)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package metal
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// apiSlowResponse how long a response of the kubernetes API may take before it counts as a sign
+	// that the apiserver or etcd is under pressure
+	apiSlowResponse = 5 * time.Second
+	// maxSyncIntervalFactor how many times longer than usual the interval between full syncs may get
+	// while the kubernetes API is under pressure
+	maxSyncIntervalFactor = 8
+)
+
+// apiPressure whether the kubernetes API is under pressure, i.e. answers 429 Too Many Requests or
+// slowly, so that the CCM syncs less often and does not aggravate a struggling control plane.
+// Each full sync with pressure since the one before doubles the interval to the next, up to
+// maxSyncIntervalFactor times the usual; each without halves it again, back to the usual.
+type apiPressure struct {
+	lock      sync.Mutex
+	pressured bool
+	factor    int
+}
+
+func newAPIPressure() *apiPressure {
+	return &apiPressure{factor: 1}
+}
+
+// observe a response of the kubernetes API, or the error instead of it, and how long it took
+func (p *apiPressure) observe(resp *http.Response, err error, took time.Duration) {
+	pressured := took >= apiSlowResponse
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		pressured = true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		pressured = true
+	}
+	if !pressured {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.pressured = true
+}
+
+// interval how long to wait until the next full sync, given the usual interval. A nil apiPressure
+// always returns the usual interval.
+func (p *apiPressure) interval(usual time.Duration) time.Duration {
+	if p == nil {
+		return usual
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	previous := p.factor
+	switch {
+	case p.pressured && p.factor < maxSyncIntervalFactor:
+		p.factor *= 2
+	case !p.pressured && p.factor > 1:
+		p.factor /= 2
+	}
+	p.pressured = false
+	interval := usual * time.Duration(p.factor)
+	switch {
+	case p.factor > previous:
+		klog.Warningf("kubernetes API under pressure, syncing every %s instead of every %s", interval, usual)
+	case p.factor < previous && p.factor == 1:
+		klog.Infof("kubernetes API no longer under pressure, syncing every %s again", interval)
+	}
+	syncInterval.Set(interval.Seconds())
+	return interval
+}
+
+// pressureRoundTripper observe how the kubernetes API answers each request, to detect pressure
+type pressureRoundTripper struct {
+	pressure *apiPressure
+	next     http.RoundTripper
+}
+
+func newPressureRoundTripper(pressure *apiPressure, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &pressureRoundTripper{pressure: pressure, next: next}
+}
+
+func (t *pressureRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	// watches are long-running by design, so their duration says nothing
+	if req.URL.Query().Get("watch") != "true" {
+		t.pressure.observe(resp, err, time.Since(start))
+	}
+	return resp, err
+}
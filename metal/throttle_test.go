@@ -0,0 +1,75 @@
+package metal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIPressureInterval(t *testing.T) {
+	usual := time.Minute
+	p := newAPIPressure()
+	tooMany := &http.Response{StatusCode: http.StatusTooManyRequests}
+	ok := &http.Response{StatusCode: http.StatusOK}
+
+	tests := []struct {
+		resp     *http.Response
+		err      error
+		took     time.Duration
+		interval time.Duration
+	}{
+		{ok, nil, time.Millisecond, usual},
+		{tooMany, nil, time.Millisecond, 2 * usual},
+		{ok, nil, apiSlowResponse, 4 * usual},
+		{nil, errors.New("connection refused"), time.Millisecond, 2 * usual},
+		{tooMany, nil, time.Millisecond, 4 * usual},
+		{tooMany, nil, time.Millisecond, 8 * usual},
+		// capped
+		{tooMany, nil, time.Millisecond, 8 * usual},
+		// back to usual as pressure subsides
+		{ok, nil, time.Millisecond, 4 * usual},
+		{ok, nil, time.Millisecond, 2 * usual},
+		{ok, nil, time.Millisecond, usual},
+		{ok, nil, time.Millisecond, usual},
+	}
+	for i, tt := range tests {
+		p.observe(tt.resp, tt.err, tt.took)
+		if interval := p.interval(usual); interval != tt.interval {
+			t.Errorf("%d: mismatched interval, actual %s expected %s", i, interval, tt.interval)
+		}
+	}
+
+	var none *apiPressure
+	if interval := none.interval(usual); interval != usual {
+		t.Errorf("mismatched interval without pressure detection, actual %s expected %s", interval, usual)
+	}
+}
+
+func TestPressureRoundTripper(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		url       string
+		pressured bool
+	}{
+		{ts.URL + "/api/v1/nodes?watch=true", false},
+		{ts.URL + "/api/v1/nodes", true},
+	}
+	for i, tt := range tests {
+		p := newAPIPressure()
+		client := &http.Client{Transport: newPressureRoundTripper(p, nil)}
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		resp.Body.Close()
+		if p.pressured != tt.pressured {
+			t.Errorf("%d: mismatched pressure, actual %t expected %t", i, p.pressured, tt.pressured)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// tracerName the name of the tracer, and of the service in exported spans
+	tracerName = "cloud-provider-equinix-metal"
+)
+
+// initTracing export spans via OTLP to the collector at the given endpoint.
+// Until this is called, all spans are no-ops, so tracing costs nothing when disabled.
+func initTracing(endpoint string, insecure bool) error {
+	opts := []otlp.ExporterOption{otlp.WithAddress(endpoint)}
+	if insecure {
+		opts = append(opts, otlp.WithInsecure())
+	} else {
+		opts = append(opts, otlp.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
+	}
+	exporter, err := otlp.NewExporter(opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create OTLP exporter for %s: %w", endpoint, err)
+	}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.New(kv.String("service.name", tracerName), kv.String("service.version", VERSION))),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create trace provider: %w", err)
+	}
+	global.SetTraceProvider(provider)
+	klog.Infof("exporting traces to %s", endpoint)
+	return nil
+}
+
+// startSpan start a span as a child of any span in the context
+func startSpan(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan end the span, marking it as failed if there is an error
+func endSpan(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.SetStatus(codes.Unknown, err.Error())
+	}
+	span.End()
+}
+
+// tracedNodeReconciler wrap a node reconciler so that each pass is a span
+func tracedNodeReconciler(name string, reconciler nodeReconciler) nodeReconciler {
+	return func(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+		ctx, span := startSpan(ctx, name+".reconcileNodes", kv.Stringer("mode", mode), kv.Int("nodes", len(nodes)))
+		err := reconciler(ctx, nodes, mode)
+		endSpan(ctx, span, err)
+		return err
+	}
+}
+
+// tracedServiceReconciler wrap a service reconciler so that each pass is a span
+func tracedServiceReconciler(name string, reconciler serviceReconciler) serviceReconciler {
+	return func(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
+		ctx, span := startSpan(ctx, name+".reconcileServices", kv.Stringer("mode", mode), kv.Int("services", len(svcs)))
+		err := reconciler(ctx, svcs, mode)
+		endSpan(ctx, span, err)
+		return err
+	}
+}
+
+// tracingRoundTripper record each HTTP request as a span, as a child of any
+// span in the request context, e.g. for kubernetes API calls and health checks
+type tracingRoundTripper struct {
+	component string
+	next      http.RoundTripper
+}
+
+func newTracingRoundTripper(component string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &tracingRoundTripper{component: component, next: next}
+}
+
+func (t *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := global.Tracer(tracerName).Start(req.Context(), fmt.Sprintf("%s %s", t.component, req.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(kv.String("http.method", req.Method), kv.String("http.host", req.URL.Host), kv.String("http.path", req.URL.Path)),
+	)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err == nil {
+		span.SetAttributes(kv.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Unknown, resp.Status)
+		}
+	}
+	endSpan(ctx, span, err)
+	return resp, err
+}
@@ -0,0 +1,69 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestTracingRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTracingRoundTripper("test", nil)}
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/healthz", http.StatusOK},
+		{"/missing", http.StatusNotFound},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequestWithContext(context.Background(), "GET", server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatalf("%d: unable to create request: %v", i, err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%d: mismatched status, actual %d expected %d", i, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestTracedReconcilers(t *testing.T) {
+	expected := errors.New("failed")
+	var mode UpdateMode
+	nodes := tracedNodeReconciler("test", func(ctx context.Context, nodes []*v1.Node, m UpdateMode) error {
+		mode = m
+		return expected
+	})
+	if err := nodes(context.Background(), nil, ModeSync); err != expected {
+		t.Errorf("mismatched node reconciler error, actual %v expected %v", err, expected)
+	}
+	if mode != ModeSync {
+		t.Errorf("mismatched node reconciler mode, actual %v expected %v", mode, ModeSync)
+	}
+	services := tracedServiceReconciler("test", func(ctx context.Context, svcs []*v1.Service, m UpdateMode) error {
+		mode = m
+		return nil
+	})
+	if err := services(context.Background(), nil, ModeAdd); err != nil {
+		t.Errorf("unexpected service reconciler error: %v", err)
+	}
+	if mode != ModeAdd {
+		t.Errorf("mismatched service reconciler mode, actual %v expected %v", mode, ModeAdd)
+	}
+}
@@ -5,4 +5,6 @@ package metal
 var (
 	// VERSION is reported in the API User-Agent
 	VERSION = "devel"
+	// GitCommit the commit the binary was built from, reported in build info
+	GitCommit = "unknown"
 )
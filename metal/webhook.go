@@ -0,0 +1,190 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// webhookServicePath the path on which the webhook validates services
+	webhookServicePath = "/validate-service"
+	// annotationPrefix the prefix of all annotations of the CCM
+	annotationPrefix = "metal.equinix.com/"
+)
+
+// serviceAnnotations the annotations of the CCM that belong on a service; all others are for nodes
+var serviceAnnotations = map[string]bool{
+	annotationEIPFacility:     true,
+	annotationEIPMetro:        true,
+	annotationKeepIP:          true,
+	annotationHealthCheckPath: true,
+	annotationHealthCheckPort: true,
+	annotationAddressPool:     true,
+	annotationProxyProtocol:   true,
+}
+
+// serviceWebhook an optional validating admission webhook for services of type=LoadBalancer,
+// which rejects at create or update time what the load balancer reconciler would otherwise
+// only report later, in an event, and warns about CCM annotations that have no effect on a service
+type serviceWebhook struct {
+	address  string
+	certFile string
+	keyFile  string
+	lbType   string
+}
+
+func newServiceWebhook(address, certFile, keyFile, lbType string) *serviceWebhook {
+	return &serviceWebhook{address: address, certFile: certFile, keyFile: keyFile, lbType: lbType}
+}
+
+func (w *serviceWebhook) name() string {
+	return "webhook"
+}
+
+func (w *serviceWebhook) init(k8sclient kubernetes.Interface) error {
+	return nil
+}
+
+func (w *serviceWebhook) nodeReconciler() nodeReconciler {
+	return nil
+}
+
+func (w *serviceWebhook) serviceReconciler() serviceReconciler {
+	return nil
+}
+
+// watch serve the webhook until the context is done
+func (w *serviceWebhook) watch(ctx context.Context) error {
+	if w.address == "" {
+		klog.V(2).Info("no webhook address, not serving admission webhook")
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookServicePath, w.serveHTTP)
+	server := &http.Server{Addr: w.address, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		klog.Infof("serving admission webhook on %s%s", w.address, webhookServicePath)
+		if err := server.ListenAndServeTLS(w.certFile, w.keyFile); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("admission webhook failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serveHTTP answer an AdmissionReview
+func (w *serviceWebhook) serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("unable to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(rw, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = w.review(review.Request)
+	review.Request = nil
+	b, err := json.Marshal(review)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("unable to marshal response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(b)
+}
+
+// review validate the service in an admission request
+func (w *serviceWebhook) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if len(req.Object.Raw) == 0 {
+		return resp
+	}
+	svc := &v1.Service{}
+	if err := json.Unmarshal(req.Object.Raw, svc); err != nil {
+		// never block services because of a problem in the webhook itself
+		klog.Errorf("admission webhook unable to decode service %s/%s: %v", req.Namespace, req.Name, err)
+		return resp
+	}
+	resp.Warnings = serviceAnnotationWarnings(svc)
+	// without a load balancer implementation, the CCM leaves services alone, and so does the webhook
+	if w.lbType == "" {
+		return resp
+	}
+	if err := validateLoadBalancerService(svc, w.lbType); err != nil {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: err.Error(),
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+	return resp
+}
+
+// validateLoadBalancerService the checks the load balancer reconciler applies before
+// allocating an IP, all at once; services of other types are always valid
+func validateLoadBalancerService(svc *v1.Service, lbType string) error {
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil
+	}
+	if err := validateServicePorts(svc); err != nil {
+		return fmt.Errorf("invalid ports: %w", err)
+	}
+	if lbType == lbTypeEquinixMetal {
+		if err := validateManagedServicePorts(svc); err != nil {
+			return fmt.Errorf("invalid ports: %w", err)
+		}
+		// with other types, the reconciler warns that the annotation is ignored
+		if _, err := serviceProxyProtocol(svc); err != nil {
+			return err
+		}
+	}
+	if err := validateServiceIPFamily(svc); err != nil {
+		return fmt.Errorf("invalid IP family: %w", err)
+	}
+	if err := validateSourceRanges(svc, lbType); err != nil {
+		return fmt.Errorf("invalid source ranges: %w", err)
+	}
+	if _, err := serviceBackendChecks(svc); err != nil {
+		return fmt.Errorf("invalid health check: %w", err)
+	}
+	if pool, ok := svc.Annotations[annotationAddressPool]; ok {
+		if err := ValidateLBAddressPool(pool); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", annotationAddressPool, err)
+		}
+	}
+	return nil
+}
+
+// serviceAnnotationWarnings a warning for each annotation of the CCM on the service that
+// has no effect there, e.g. a BGP annotation meant for a node
+func serviceAnnotationWarnings(svc *v1.Service) []string {
+	var warnings []string
+	for key := range svc.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) && !serviceAnnotations[key] {
+			warnings = append(warnings, fmt.Sprintf("annotation %s has no effect on a service", key))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
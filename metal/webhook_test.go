@@ -0,0 +1,95 @@
+package metal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testWebhookReview(t *testing.T, w *serviceWebhook, svc *v1.Service) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(svc)
+	if err != nil {
+		t.Fatalf("unable to marshal service: %v", err)
+	}
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  &admissionv1.AdmissionRequest{UID: types.UID("uid"), Object: runtime.RawExtension{Raw: raw}},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("unable to marshal review: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	w.serveHTTP(rec, httptest.NewRequest(http.MethodPost, webhookServicePath, bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("mismatched status, actual %d expected %d", rec.Code, http.StatusOK)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &review); err != nil {
+		t.Fatalf("unable to unmarshal response: %v", err)
+	}
+	if review.Response == nil || review.Response.UID != "uid" {
+		t.Fatalf("mismatched response: %+v", review.Response)
+	}
+	return review.Response
+}
+
+func TestServiceWebhook(t *testing.T) {
+	lb := func(annotations map[string]string, ports ...v1.ServicePort) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "default", Annotations: annotations},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: ports},
+		}
+	}
+	tests := []struct {
+		lbType   string
+		svc      *v1.Service
+		allowed  bool
+		warnings []string
+	}{
+		{lbTypeMetalLB, lb(nil, v1.ServicePort{Port: 80}), true, nil},
+		{lbTypeMetalLB, lb(nil, v1.ServicePort{Port: 80}, v1.ServicePort{Port: 80}), false, nil},
+		{lbTypeMetalLB, lb(nil, v1.ServicePort{Port: 80, Protocol: "ICMP"}), false, nil},
+		// a managed load balancer forwards TCP only
+		{lbTypeEquinixMetal, lb(nil, v1.ServicePort{Port: 53, Protocol: v1.ProtocolUDP}), false, nil},
+		{lbTypeEquinixMetal, lb(nil, v1.ServicePort{Port: 80}), true, nil},
+		{lbTypeEquinixMetal, lb(map[string]string{annotationProxyProtocol: proxyProtocolV1}, v1.ServicePort{Port: 80}), true, nil},
+		{lbTypeEquinixMetal, lb(map[string]string{annotationProxyProtocol: "v3"}, v1.ServicePort{Port: 80}), false, nil},
+		{lbTypeEquinixMetal, lb(map[string]string{annotationProxyProtocol: "forwarded"}, v1.ServicePort{Port: 80}), false, nil},
+		// not a load balancer
+		{lbTypeMetalLB, &v1.Service{Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, Ports: []v1.ServicePort{{Port: 80}, {Port: 80}}}}, true, nil},
+		// no load balancer implementation, nothing to reject
+		{"", lb(nil, v1.ServicePort{Port: 80}, v1.ServicePort{Port: 80}), true, nil},
+		{lbTypeMetalLB, lb(map[string]string{annotationHealthCheckPort: "8080"}, v1.ServicePort{Port: 80}), false, nil},
+		// annotations of the CCM for nodes, on a service
+		{lbTypeMetalLB, lb(map[string]string{DefaultAnnotationPeerIPs: "10.0.0.1", annotationEIPFacility: "ewr1", annotationKeepIP: "true", "other.io/x": "y"}, v1.ServicePort{Port: 80}), true, []string{"annotation metal.equinix.com/peer-ip has no effect on a service"}},
+	}
+	for i, tt := range tests {
+		resp := testWebhookReview(t, newServiceWebhook("", "", "", tt.lbType), tt.svc)
+		if resp.Allowed != tt.allowed {
+			t.Errorf("%d: mismatched allowed, actual %t expected %t", i, resp.Allowed, tt.allowed)
+		}
+		if !resp.Allowed && (resp.Result == nil || resp.Result.Message == "") {
+			t.Errorf("%d: denied without a message", i)
+		}
+		if strings.Join(resp.Warnings, ";") != strings.Join(tt.warnings, ";") {
+			t.Errorf("%d: mismatched warnings, actual %v expected %v", i, resp.Warnings, tt.warnings)
+		}
+	}
+}
+
+func TestServiceWebhookInvalidReview(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newServiceWebhook("", "", "", lbTypeMetalLB).serveHTTP(rec, httptest.NewRequest(http.MethodPost, webhookServicePath, strings.NewReader("{")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("mismatched status, actual %d expected %d", rec.Code, http.StatusBadRequest)
+	}
+}